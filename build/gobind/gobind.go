@@ -45,6 +45,7 @@ type Pinecone struct {
 	PineconeRouter    *pineconeRouter.Router
 	PineconeMulticast *pineconeMulticast.Multicast
 	PineconeManager   *pineconeConnections.ConnectionManager
+	PineconeLinks     *pineconeConnections.LinkWatcher
 }
 
 func (m *Pinecone) PeerCount(peertype int) int {
@@ -70,7 +71,7 @@ func (m *Pinecone) SetStaticPeer(uri string) {
 func (m *Pinecone) DisconnectType(peertype int) {
 	for _, p := range m.PineconeRouter.Peers() {
 		if int(peertype) == p.PeerType {
-			m.PineconeRouter.Disconnect(types.SwitchPortID(p.Port), nil)
+			m.PineconeRouter.DisconnectGeneration(types.SwitchPortID(p.Port), p.Generation, nil)
 		}
 	}
 }
@@ -78,7 +79,7 @@ func (m *Pinecone) DisconnectType(peertype int) {
 func (m *Pinecone) DisconnectZone(zone string) {
 	for _, p := range m.PineconeRouter.Peers() {
 		if zone == p.Zone {
-			m.PineconeRouter.Disconnect(types.SwitchPortID(p.Port), nil)
+			m.PineconeRouter.DisconnectGeneration(types.SwitchPortID(p.Port), p.Generation, nil)
 		}
 	}
 }
@@ -133,9 +134,19 @@ func (m *Pinecone) Start() {
 	m.PineconeRouter = pineconeRouter.NewRouter(m.logger, sk, false)
 	m.PineconeMulticast = pineconeMulticast.NewMulticast(m.logger, m.PineconeRouter)
 	m.PineconeManager = pineconeConnections.NewConnectionManager(m.PineconeRouter, nil)
+	m.PineconeLinks = pineconeConnections.NewLinkWatcher(m.logger, m.PineconeRouter, m.PineconeManager)
+	m.PineconeLinks.Start()
+}
+
+// NetworkChanged should be called by the app whenever the OS reports that the
+// network has changed, e.g. when moving between Wi-Fi and cellular, so that
+// peerings over interfaces that have gone away are dropped straight away.
+func (m *Pinecone) NetworkChanged() {
+	m.PineconeLinks.Check()
 }
 
 func (m *Pinecone) Stop() {
+	m.PineconeLinks.Stop()
 	m.PineconeMulticast.Stop()
 	_ = m.PineconeRouter.Close()
 	m.cancel()
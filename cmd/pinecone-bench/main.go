@@ -0,0 +1,211 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func main() {
+	nodes := flag.Int("nodes", 4, "number of in-process routers to create")
+	topology := flag.String("topology", "chain", "topology to build: \"chain\" or \"mesh\"")
+	routing := flag.String("routing", "tree", "routing scheme to use: \"tree\" or \"snek\"")
+	size := flag.Int("size", 1024, "payload size in bytes")
+	duration := flag.Duration("duration", time.Second*10, "how long to send traffic for")
+	rate := flag.Int("rate", 0, "packets per second to send, or 0 for as fast as possible")
+	flag.Parse()
+
+	if *nodes < 2 {
+		fmt.Fprintln(os.Stderr, "at least 2 nodes are required")
+		os.Exit(1)
+	}
+	if *size < 16 || *size > types.MaxPayloadSize {
+		fmt.Fprintf(os.Stderr, "size must be between 16 and %d bytes\n", types.MaxPayloadSize)
+		os.Exit(1)
+	}
+
+	routers := make([]*router.Router, 0, *nodes)
+	for i := 0; i < *nodes; i++ {
+		_, sk, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			panic(err)
+		}
+		routers = append(routers, router.NewRouter(nil, sk, false))
+	}
+
+	switch *topology {
+	case "chain":
+		for i := 1; i < len(routers); i++ {
+			connect(routers[i-1], routers[i])
+		}
+	case "mesh":
+		for i := range routers {
+			for j := i + 1; j < len(routers); j++ {
+				connect(routers[i], routers[j])
+			}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "unknown topology", *topology)
+		os.Exit(1)
+	}
+
+	src, dst := routers[0], routers[len(routers)-1]
+	addr := func() net.Addr {
+		if *routing == "snek" {
+			return dst.PublicKey()
+		}
+		return dst.Coords()
+	}
+
+	fmt.Printf("Waiting for %d-node %s to converge...\n", *nodes, *topology)
+	if err := converge(src, dst, addr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var mutex sync.Mutex
+	var received uint64
+	var latencies []time.Duration
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, types.MaxPayloadSize)
+		for {
+			// The read deadline is only checked when ReadFrom is called, so
+			// use a short one in order to be able to notice when to stop.
+			_ = dst.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+			n, from, err := dst.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if from == nil {
+				select {
+				case <-stop:
+					return
+				default:
+					continue
+				}
+			}
+			if n < 16 || binary.BigEndian.Uint64(buf[:8]) == 0 {
+				continue
+			}
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:16])))
+			mutex.Lock()
+			received++
+			latencies = append(latencies, time.Since(sent))
+			mutex.Unlock()
+		}
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	var interval time.Duration
+	if *rate > 0 {
+		interval = time.Second / time.Duration(*rate)
+	}
+	payload := make([]byte, *size)
+	dest := addr()
+	sent := uint64(0)
+	start := time.Now()
+	for time.Since(start) < *duration {
+		sent++
+		binary.BigEndian.PutUint64(payload[:8], sent)
+		binary.BigEndian.PutUint64(payload[8:16], uint64(time.Now().UnixNano()))
+		if _, err := src.WriteTo(payload, dest); err != nil {
+			fmt.Fprintln(os.Stderr, "WriteTo:", err)
+			os.Exit(1)
+		}
+		if interval > 0 {
+			time.Sleep(interval)
+		}
+	}
+	elapsed := time.Since(start)
+
+	// Give any frames still in flight a moment to arrive.
+	time.Sleep(time.Second)
+	close(stop)
+	<-done
+	runtime.ReadMemStats(&after)
+
+	for _, r := range routers {
+		_ = r.Close()
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	percentile := func(p float64) time.Duration {
+		if len(latencies) == 0 {
+			return 0
+		}
+		return latencies[int(float64(len(latencies)-1)*p)]
+	}
+
+	fmt.Printf("Topology:   %d-node %s, %s routing, %d byte payloads\n", *nodes, *topology, *routing, *size)
+	fmt.Printf("Sent:       %d packets in %s (%.0f pps)\n", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+	fmt.Printf("Received:   %d packets (%.0f pps, %.2f%% loss)\n", received, float64(received)/elapsed.Seconds(), 100-float64(received)/float64(sent)*100)
+	fmt.Printf("Throughput: %.2f Mbit/s\n", float64(received)*float64(*size)*8/elapsed.Seconds()/1000/1000)
+	fmt.Printf("Latency:    p50=%s p90=%s p99=%s max=%s\n", percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	fmt.Printf("Allocs:     %.1f allocs/packet, %.1f bytes/packet\n",
+		float64(after.Mallocs-before.Mallocs)/float64(sent),
+		float64(after.TotalAlloc-before.TotalAlloc)/float64(sent),
+	)
+}
+
+// connect peers two in-process routers using an in-memory pipe.
+func connect(a, b *router.Router) {
+	pa, pb := net.Pipe()
+	go func() {
+		_, _ = a.Connect(pa, router.ConnectionPublicKey(b.PublicKey()), router.ConnectionKeepalives(false))
+	}()
+	go func() {
+		_, _ = b.Connect(pb, router.ConnectionPublicKey(a.PublicKey()), router.ConnectionKeepalives(false))
+	}()
+}
+
+// converge sends probe packets from the source to the destination until
+// one of them arrives, which tells us that the routing state has settled
+// enough for the benchmark to be meaningful.
+func converge(src, dst *router.Router, addr func() net.Addr) error {
+	probe := make([]byte, 16)
+	buf := make([]byte, types.MaxPayloadSize)
+	deadline := time.Now().Add(time.Second * 30)
+	for time.Now().Before(deadline) {
+		if _, err := src.WriteTo(probe, addr()); err != nil {
+			return fmt.Errorf("src.WriteTo: %w", err)
+		}
+		_ = dst.SetReadDeadline(time.Now().Add(time.Millisecond * 250))
+		if _, from, _ := dst.ReadFrom(buf); from != nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("routers did not converge in time")
+}
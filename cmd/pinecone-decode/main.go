@@ -0,0 +1,558 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command pinecone-decode pretty-prints captured Pinecone frames, so that
+// traces can be included in support requests in a readable form. It reads
+// pcap captures, such as those made with the router's MirrorHandler, or text
+// with one frame per line encoded as hex or base64. Input is read from the
+// files given as arguments, or from stdin if there are none.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// pcapLinkTypeUser0 is the link type used by the router's MirrorHandler,
+// where each packet starts with a direction byte followed by the frame.
+const pcapLinkTypeUser0 = 147
+
+// capture is a single frame read from the input.
+type capture struct {
+	data      []byte
+	length    int       // the original length, if the capture was truncated
+	time      time.Time // only for pcap input
+	direction string    // only for pcap input from MirrorHandler
+}
+
+var payloadBytes = flag.Int("payload", 64, "how many bytes of each payload to dump, or -1 for all")
+
+func main() {
+	format := flag.String("format", "auto", "input format: auto, pcap, hex or base64")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: pinecone-decode [flags] [file ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// Announcements with bad signatures would otherwise fail to decode at
+	// all, whereas it's more useful to show them and say which signature
+	// is bad.
+	_ = os.Setenv("PINECONE_DISABLE_SIGNATURES", "1")
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	failed := false
+	count := 0
+	for _, input := range inputs {
+		var data []byte
+		var err error
+		if input == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(input)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to read input:", err)
+			os.Exit(1)
+		}
+		captures, err := parseInput(data, *format)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse %s: %s\n", input, err)
+			os.Exit(1)
+		}
+		for _, c := range captures {
+			count++
+			if !printCapture(os.Stdout, count, c) {
+				failed = true
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func parseInput(data []byte, format string) ([]capture, error) {
+	switch format {
+	case "auto":
+		if isPcap(data) {
+			return parsePcap(data)
+		}
+		return parseText(data, "")
+	case "pcap":
+		return parsePcap(data)
+	case "hex", "base64":
+		return parseText(data, format)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func isPcap(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(data[:4]) {
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return true
+	}
+	return false
+}
+
+// parsePcap reads the frames from a pcap capture. Captures from the router's
+// MirrorHandler start each packet with a direction byte, whereas packets in
+// captures with any other link type are taken to be whole frames.
+func parsePcap(data []byte) ([]capture, error) {
+	if len(data) < 24 {
+		return nil, fmt.Errorf("pcap header is too short")
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	nanos := false
+	switch binary.LittleEndian.Uint32(data[:4]) {
+	case 0xa1b2c3d4:
+	case 0xa1b23c4d:
+		nanos = true
+	case 0xd4c3b2a1:
+		order = binary.BigEndian
+	case 0x4d3cb2a1:
+		order, nanos = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("not a pcap capture")
+	}
+	linkType := order.Uint32(data[20:24])
+	var captures []capture
+	for offset := 24; offset < len(data); {
+		if offset+16 > len(data) {
+			return captures, fmt.Errorf("pcap record header is truncated")
+		}
+		seconds, fraction := order.Uint32(data[offset:]), order.Uint32(data[offset+4:])
+		included, original := int(order.Uint32(data[offset+8:])), int(order.Uint32(data[offset+12:]))
+		offset += 16
+		if offset+included > len(data) {
+			return captures, fmt.Errorf("pcap record is truncated")
+		}
+		packet := data[offset : offset+included]
+		offset += included
+		c := capture{data: packet, length: original}
+		if nanos {
+			c.time = time.Unix(int64(seconds), int64(fraction))
+		} else {
+			c.time = time.Unix(int64(seconds), int64(fraction)*1000)
+		}
+		if linkType == pcapLinkTypeUser0 && len(packet) > 0 {
+			switch packet[0] {
+			case 0:
+				c.direction = "received"
+			case 1:
+				c.direction = "sent"
+			default:
+				c.direction = fmt.Sprintf("unknown (%d)", packet[0])
+			}
+			c.data, c.length = packet[1:], original-1
+		}
+		captures = append(captures, c)
+	}
+	return captures, nil
+}
+
+// parseText reads one frame from each line of the input. Whitespace, colons
+// and a leading 0x are ignored, so that hex dumps can be pasted in as they
+// are. If no format is given then each line is treated as hex if it can be,
+// or as base64 otherwise.
+func parseText(data []byte, format string) ([]capture, error) {
+	var captures []capture
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var frame []byte
+		var err error
+		switch format {
+		case "hex":
+			frame, err = decodeHex(text)
+		case "base64":
+			frame, err = decodeBase64(text)
+		default:
+			if frame, err = decodeHex(text); err != nil {
+				frame, err = decodeBase64(text)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		captures = append(captures, capture{data: frame, length: len(frame)})
+	}
+	return captures, scanner.Err()
+}
+
+func decodeHex(text string) ([]byte, error) {
+	text = strings.TrimPrefix(text, "0x")
+	text = strings.NewReplacer(" ", "", "\t", "", ":", "").Replace(text)
+	return hex.DecodeString(text)
+}
+
+func decodeBase64(text string) ([]byte, error) {
+	text = strings.NewReplacer(" ", "", "\t", "").Replace(text)
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+		base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if data, err := encoding.DecodeString(text); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("not valid hex or base64")
+}
+
+// printCapture prints a single frame, returning false if it couldn't be
+// decoded.
+func printCapture(w io.Writer, index int, c capture) bool {
+	fmt.Fprintf(w, "Frame %d: %d bytes", index, len(c.data))
+	if c.length > len(c.data) {
+		fmt.Fprintf(w, " (truncated from %d bytes)", c.length)
+	}
+	fmt.Fprintln(w)
+	if !c.time.IsZero() {
+		field(w, 1, "Time", c.time.UTC().Format(time.RFC3339Nano))
+	}
+	if c.direction != "" {
+		field(w, 1, "Direction", c.direction)
+	}
+	defer fmt.Fprintln(w)
+
+	data := c.data
+	if len(data) < types.FrameHeaderLength {
+		field(w, 1, "Error", "too short for a frame header")
+		return false
+	}
+	if !bytes.Equal(data[:4], types.FrameMagicBytes) {
+		field(w, 1, "Error", fmt.Sprintf("missing magic bytes, got %x", data[:4]))
+		return false
+	}
+	length := int(binary.BigEndian.Uint16(data[8:10]))
+	field(w, 1, "Version", types.FrameVersion(data[4]).String())
+	field(w, 1, "Type", types.FrameType(data[5]).String())
+	field(w, 1, "Extra", fmt.Sprintf("%02x %02x%s", data[6], data[7], flagNames(types.FrameType(data[5]), data[6])))
+	field(w, 1, "Length", fmt.Sprintf("%d bytes", length))
+	if length > len(data) {
+		field(w, 1, "Error", fmt.Sprintf("frame is %d bytes but only %d bytes were captured", length, len(data)))
+		return false
+	}
+
+	f := types.Frame{
+		Payload: make([]byte, 0, types.MaxPayloadSize),
+	}
+	if _, err := f.UnmarshalBinary(data[:length]); err != nil {
+		field(w, 1, "Error", err.Error())
+		return false
+	}
+	printExtensions(w, &f)
+
+	switch f.Type {
+	case types.TypeKeepalive:
+
+	case types.TypeTreeAnnouncement:
+		printAnnouncement(w, f.Payload)
+
+	case types.TypeTreeRouted:
+		field(w, 1, "Destination", f.Destination.String())
+		field(w, 1, "Source", f.Source.String())
+		printPayload(w, f.Payload)
+
+	case types.TypeVirtualSnakeBootstrap:
+		field(w, 1, "Bootstrapping key", f.DestinationKey.String())
+		field(w, 1, "Source coords", f.Source.String())
+		printWatermark(w, f.Watermark)
+		printBootstrap(w, f.DestinationKey, f.Payload)
+
+	case types.TypeVirtualSnakeRouted:
+		field(w, 1, "Destination key", f.DestinationKey.String())
+		field(w, 1, "Source key", f.SourceKey.String())
+		printWatermark(w, f.Watermark)
+		if len(f.Destination) > 0 {
+			field(w, 1, "Fallback coords", f.Destination.String())
+		}
+		switch {
+		case f.Extra[0]&types.FrameFlagKeyspaceQuery != 0:
+			printKeyspaceQuery(w, f.Payload)
+		case f.Extra[0]&types.FrameFlagKeyspaceResponse != 0:
+			printKeyspaceResponse(w, f.Payload)
+		case f.Extra[0]&types.FrameFlagTopic != 0:
+			printTopicMessage(w, f.Payload)
+		case f.Extra[0]&types.FrameFlagReceipt != 0:
+			printReceipt(w, f.Payload)
+		default:
+			printPayload(w, f.Payload)
+		}
+
+	case types.TypePeerExchange:
+		printPEX(w, f.Payload)
+
+	default:
+		printPayload(w, f.Payload)
+	}
+	return true
+}
+
+func field(w io.Writer, depth int, name, value string) {
+	fmt.Fprintf(w, "%s%-18s %s\n", strings.Repeat("  ", depth), name+":", value)
+}
+
+func flagNames(t types.FrameType, extra byte) string {
+	var names []string
+	if extra&types.FrameFlagExtensions != 0 {
+		names = append(names, "extensions")
+	}
+	if t == types.TypeVirtualSnakeRouted {
+		if extra&types.FrameFlagKeyspaceQuery != 0 {
+			names = append(names, "keyspace query")
+		}
+		if extra&types.FrameFlagKeyspaceResponse != 0 {
+			names = append(names, "keyspace response")
+		}
+		if extra&types.FrameFlagTopic != 0 {
+			names = append(names, "topic")
+		}
+		if extra&types.FrameFlagReceipt != 0 {
+			names = append(names, "receipt")
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(names, ", ") + ")"
+}
+
+func printExtensions(w io.Writer, f *types.Frame) {
+	for offset := 0; offset+2 <= len(f.Extensions); {
+		t, l := types.ExtensionType(f.Extensions[offset]), int(f.Extensions[offset+1])
+		value := f.Extensions[offset+2 : offset+2+l]
+		offset += 2 + l
+		text := fmt.Sprintf("%x", value)
+		switch t {
+		case types.ExtensionTypeQoS:
+			if len(value) == 1 {
+				text = qosName(types.QoSClass(value[0]))
+			}
+		case types.ExtensionTypeTraceContext:
+			var tc types.TraceContext
+			if _, err := tc.UnmarshalBinary(value); err == nil {
+				text = fmt.Sprintf("trace %x span %x flags %02x", tc.TraceID, tc.SpanID, tc.Flags)
+			}
+		case types.ExtensionTypeMTUProbe:
+			var probe types.MTUProbe
+			if _, err := probe.UnmarshalBinary(value); err == nil {
+				text = fmt.Sprintf("probe %d for %d bytes", probe.ID, probe.Size)
+			}
+		case types.ExtensionTypeSuspend:
+			text = "the sender is suspending the peering"
+		case types.ExtensionTypeService:
+			var id types.ServiceID
+			if _, err := id.UnmarshalBinary(value); err == nil && len(value) == types.ServiceIDSize {
+				text = fmt.Sprintf("service %d", id)
+			}
+		case types.ExtensionTypeMigrate:
+			text = "the sender has moved the peering to a new connection"
+		case types.ExtensionTypeReceipt:
+			if len(value) == types.ReceiptRequestSize {
+				text = fmt.Sprintf("receipt requested for sequence %d", binary.BigEndian.Uint64(value))
+			}
+		}
+		field(w, 1, "Extension "+t.String(), text)
+	}
+}
+
+func qosName(c types.QoSClass) string {
+	switch c {
+	case types.QoSBestEffort:
+		return "best effort"
+	case types.QoSBulk:
+		return "bulk"
+	case types.QoSInteractive:
+		return "interactive"
+	case types.QoSRealtime:
+		return "realtime"
+	default:
+		return fmt.Sprintf("unknown (%d)", c)
+	}
+}
+
+func printWatermark(w io.Writer, wm types.VirtualSnakeWatermark) {
+	if wm.PublicKey == types.FullMask {
+		field(w, 1, "Watermark", fmt.Sprintf("none (sequence %d)", wm.Sequence))
+		return
+	}
+	field(w, 1, "Watermark", fmt.Sprintf("%s sequence %d", wm.PublicKey, wm.Sequence))
+}
+
+func printAnnouncement(w io.Writer, payload []byte) {
+	var ann types.SwitchAnnouncement
+	if _, err := ann.UnmarshalBinary(payload); err != nil {
+		field(w, 1, "Error", err.Error())
+		return
+	}
+	field(w, 1, "Root", ann.RootPublicKey.String())
+	field(w, 1, "Root sequence", fmt.Sprintf("%d", ann.RootSequence))
+	if len(ann.Signatures) > 0 {
+		field(w, 1, "Coords", ann.Coords().String())
+	}
+	valid := ann.Verify()
+	for i, sig := range ann.Signatures {
+		fmt.Fprintf(w, "    %d. port %-5d %s\n", i+1, sig.Hop, sig.PublicKey)
+		fmt.Fprintf(w, "       signature  %s\n", hex.EncodeToString(sig.Signature[:]))
+	}
+	if err := ann.Validate(); err != nil {
+		field(w, 1, "Chain", "malformed: "+err.Error())
+	} else if valid != nil {
+		field(w, 1, "Chain", "invalid: "+valid.Error())
+	} else {
+		field(w, 1, "Chain", "all signatures valid")
+	}
+}
+
+func printBootstrap(w io.Writer, key types.PublicKey, payload []byte) {
+	var bootstrap types.VirtualSnakeBootstrap
+	if _, err := bootstrap.UnmarshalBinary(payload); err != nil {
+		field(w, 1, "Error", err.Error())
+		return
+	}
+	field(w, 1, "Root", bootstrap.RootPublicKey.String())
+	field(w, 1, "Root sequence", fmt.Sprintf("%d", bootstrap.RootSequence))
+	sent := time.UnixMilli(int64(bootstrap.Sequence)).UTC().Format(time.RFC3339Nano)
+	field(w, 1, "Sequence", fmt.Sprintf("%d (sent at %s)", bootstrap.Sequence, sent))
+	status := "valid"
+	if protected, err := bootstrap.ProtectedPayload(); err != nil {
+		status = "can't be checked: " + err.Error()
+	} else if !ed25519.Verify(key[:], protected, bootstrap.Signature[:]) {
+		status = "invalid, or signatures are disabled on the sender"
+	}
+	field(w, 1, "Signature", hex.EncodeToString(bootstrap.Signature[:])+" ("+status+")")
+}
+
+func printKeyspaceQuery(w io.Writer, payload []byte) {
+	var query types.KeyspaceQuery
+	if _, err := query.UnmarshalBinary(payload); err != nil {
+		field(w, 1, "Error", err.Error())
+		return
+	}
+	field(w, 1, "Query nonce", fmt.Sprintf("%d", query.Nonce))
+	field(w, 1, "Query target", query.Target.String())
+	field(w, 1, "Query count", fmt.Sprintf("%d", query.Count))
+}
+
+func printKeyspaceResponse(w io.Writer, payload []byte) {
+	var response types.KeyspaceResponse
+	if _, err := response.UnmarshalBinary(payload); err != nil {
+		field(w, 1, "Error", err.Error())
+		return
+	}
+	field(w, 1, "Response nonce", fmt.Sprintf("%d", response.Nonce))
+	for i, key := range response.Keys {
+		fmt.Fprintf(w, "    %d. %s\n", i+1, key)
+	}
+}
+
+func printTopicMessage(w io.Writer, payload []byte) {
+	var message types.TopicMessage
+	if _, err := message.UnmarshalBinary(payload); err != nil {
+		field(w, 1, "Error", err.Error())
+		return
+	}
+	field(w, 1, "Topic message", message.Type.String())
+	field(w, 1, "Topic", message.Topic.String())
+	if message.Type == types.TopicDeliver {
+		field(w, 1, "Publisher", message.Publisher.String())
+	}
+	if len(message.Payload) > 0 {
+		printPayload(w, message.Payload)
+	}
+}
+
+func printReceipt(w io.Writer, payload []byte) {
+	var receipt types.Receipt
+	if _, err := receipt.UnmarshalBinary(payload); err != nil {
+		field(w, 1, "Error", err.Error())
+		return
+	}
+	field(w, 1, "Receipt for", receipt.Sender.String())
+	field(w, 1, "Receipt from", receipt.Receiver.String())
+	field(w, 1, "Sequence", fmt.Sprintf("%d", receipt.Sequence))
+	if err := receipt.Verify(); err != nil {
+		field(w, 1, "Error", err.Error())
+	}
+}
+
+func printPEX(w io.Writer, payload []byte) {
+	if len(payload) == 0 {
+		field(w, 1, "Error", "empty peer exchange")
+		return
+	}
+	count, offset := int(payload[0]), 1
+	field(w, 1, "Records", fmt.Sprintf("%d", count))
+	now := time.Now()
+	for i := 0; i < count; i++ {
+		var record types.PEXRecord
+		n, err := record.UnmarshalBinary(payload[offset:])
+		if err != nil {
+			field(w, 1, "Error", fmt.Sprintf("record %d: %s", i+1, err))
+			return
+		}
+		offset += n
+		status := "valid"
+		if err := record.Verify(now); err != nil {
+			status = err.Error()
+		}
+		fmt.Fprintf(w, "    %d. %s (%s)\n", i+1, record.Origin, status)
+		fmt.Fprintf(w, "       expires    %s\n", record.ExpiresAt().UTC().Format(time.RFC3339))
+		for _, uri := range record.URIs {
+			fmt.Fprintf(w, "       uri        %s\n", uri)
+		}
+	}
+}
+
+func printPayload(w io.Writer, payload []byte) {
+	field(w, 1, "Payload", fmt.Sprintf("%d bytes", len(payload)))
+	dump := payload
+	if *payloadBytes >= 0 && len(dump) > *payloadBytes {
+		dump = dump[:*payloadBytes]
+	}
+	if len(dump) == 0 {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(hex.Dump(dump), "\n"), "\n") {
+		fmt.Fprintln(w, "    "+line)
+	}
+	if len(dump) < len(payload) {
+		fmt.Fprintf(w, "    ... %d more bytes\n", len(payload)-len(dump))
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/pinecone/connections"
+	"github.com/matrix-org/pinecone/names"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// searchCount is how many keys to ask for in each keyspace search, which is
+// the most that a search will return.
+const searchCount = 32
+
+func main() {
+	connect := flag.String("connect", "", "peer to connect to in order to join the mesh, as host:port or a ws:// URI (required)")
+	settle := flag.Duration("settle", time.Second*10, "how long to wait after joining for the snake to form")
+	timeout := flag.Duration("timeout", time.Minute*5, "give up walking the snake after this long")
+	maxNodes := flag.Int("max", 10000, "stop after finding this many nodes")
+	format := flag.String("format", "json", "output format: \"json\" or \"dot\"")
+	output := flag.String("output", "", "file to write the snapshot to (stdout if empty)")
+	verbose := flag.Bool("verbose", false, "log router activity to stderr")
+	namesFile := flag.String("names", "", "file of names to label nodes with, one \"name hexkey\" per line")
+	flag.Parse()
+
+	if *connect == "" {
+		fmt.Fprintln(os.Stderr, "a peer to connect to must be given with -connect")
+		os.Exit(1)
+	}
+	if *format != "json" && *format != "dot" {
+		fmt.Fprintln(os.Stderr, "unknown format", *format)
+		os.Exit(1)
+	}
+
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	var logger types.Logger
+	if *verbose {
+		logger = log.New(os.Stderr, "", 0)
+	}
+	progress := log.New(os.Stderr, "", 0)
+	var resolver names.Resolver
+	if *namesFile != "" {
+		static, err := names.LoadStatic(*namesFile)
+		if err != nil {
+			progress.Println("Failed to load names:", err)
+			os.Exit(1)
+		}
+		resolver = static
+	}
+
+	r := router.NewRouter(logger, sk, false)
+	defer r.Close() // nolint:errcheck
+	manager := connections.NewConnectionManager(r, nil)
+	manager.AddPeer(*connect)
+
+	progress.Println("Joining the mesh via", *connect)
+	deadline := time.Now().Add(*timeout)
+	for r.PeerCount(-1) == 0 {
+		if time.Now().After(deadline) {
+			progress.Println("Timed out waiting to join the mesh")
+			os.Exit(1)
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	progress.Printf("Joined, waiting %s for the snake to form\n", *settle)
+	time.Sleep(*settle)
+
+	nodes := walk(r, progress, deadline, *maxNodes)
+	progress.Printf("Found %d nodes\n", len(nodes))
+	snapshot := buildSnapshot(r, nodes, resolver)
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			progress.Println("Failed to create output file:", err)
+			os.Exit(1)
+		}
+		defer f.Close() // nolint:errcheck
+		out = f
+	}
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(snapshot)
+	case "dot":
+		err = snapshot.writeDot(out)
+	}
+	if err != nil {
+		progress.Println("Failed to write snapshot:", err)
+		os.Exit(1)
+	}
+}
+
+// walk goes around the snake by successive keyspace searches, starting from
+// our own key and moving upwards. Each search returns the keys on either side
+// of the target, so the next search starts from the furthest key ahead of the
+// target that the last one found. The walk ends once it has gone all the way
+// around the keyspace and back past our own key.
+func walk(r *router.Router, progress *log.Logger, deadline time.Time, maxNodes int) map[types.PublicKey]struct{} {
+	self := r.PublicKey()
+	found := map[types.PublicKey]struct{}{self: {}}
+	searched := map[types.PublicKey]struct{}{}
+	travelled := new(big.Int)
+	for cur := self; len(found) < maxNodes && time.Now().Before(deadline); {
+		searched[cur] = struct{}{}
+		keys, err := r.SearchKeyspace(cur, searchCount)
+		if err != nil {
+			progress.Println("Search failed:", err)
+			break
+		}
+		for _, k := range keys {
+			found[k] = struct{}{}
+		}
+
+		// Prefer the furthest key ahead of us that this search returned, but
+		// if it didn't return any then step to the nearest key ahead of us
+		// that we haven't searched from yet.
+		var next types.PublicKey
+		var step *big.Int
+		for _, k := range keys {
+			if d := ahead(cur, k); d.Sign() > 0 && d.Cmp(half) < 0 && (step == nil || d.Cmp(step) > 0) {
+				next, step = k, d
+			}
+		}
+		if _, ok := searched[next]; step == nil || ok {
+			step = nil
+			for k := range found {
+				if _, ok := searched[k]; ok {
+					continue
+				}
+				if d := ahead(cur, k); d.Sign() > 0 && (step == nil || d.Cmp(step) < 0) {
+					next, step = k, d
+				}
+			}
+		}
+		if step == nil {
+			break
+		}
+		if travelled.Add(travelled, step).Cmp(keyspace) >= 0 {
+			// We've gone all the way around.
+			break
+		}
+		progress.Printf("Found %d nodes so far, %.1f%% of the keyspace covered\n",
+			len(found), coverage(travelled))
+		cur = next
+	}
+	return found
+}
+
+var (
+	keyspace = new(big.Int).Lsh(big.NewInt(1), ed25519.PublicKeySize*8)
+	half     = new(big.Int).Rsh(keyspace, 1)
+)
+
+// ahead returns how far the key b is ahead of the key a, going upwards and
+// wrapping around at the top of the keyspace.
+func ahead(a, b types.PublicKey) *big.Int {
+	d := new(big.Int).Sub(new(big.Int).SetBytes(b[:]), new(big.Int).SetBytes(a[:]))
+	return d.Mod(d, keyspace)
+}
+
+func coverage(travelled *big.Int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(travelled), new(big.Float).SetInt(keyspace)).Float64()
+	return f * 100
+}
+
+// Snapshot is the map of the mesh as seen from the mapping node.
+type Snapshot struct {
+	Time         time.Time         `json:"time"`
+	Self         types.PublicKey   `json:"self"`
+	Root         types.PublicKey   `json:"root"`
+	RootSequence uint64            `json:"root_sequence"`
+	Coords       types.Coordinates `json:"coords"`
+	Nodes        []Node            `json:"nodes"`
+	Links        []Link            `json:"links"`
+}
+
+// Node is a node that was found on the snake.
+type Node struct {
+	PublicKey types.PublicKey  `json:"public_key"`
+	Name      string           `json:"name,omitempty"`     // from the -names file
+	NextHop   *types.PublicKey `json:"next_hop,omitempty"` // our peer that SNEK routes towards the node
+	Peer      bool             `json:"peer,omitempty"`     // the node is directly peered with us
+	Root      bool             `json:"root,omitempty"`     // the node is the root of the tree
+}
+
+// Link is an edge in the approximate topology. "peer" links are direct
+// peerings with the mapping node, "tree" links go from the mapping node to its
+// parent in the tree, "route" links go from one of our peers to each node that
+// we route to through it, and "snake" links join neighbours in the keyspace.
+type Link struct {
+	From types.PublicKey `json:"from"`
+	To   types.PublicKey `json:"to"`
+	Kind string          `json:"kind"`
+}
+
+func buildSnapshot(r *router.Router, found map[types.PublicKey]struct{}, resolver names.Resolver) *Snapshot {
+	self := r.PublicKey()
+	stats := r.TreeStats()
+	snapshot := &Snapshot{
+		Time:         time.Now(),
+		Self:         self,
+		Root:         stats.Root,
+		RootSequence: stats.RootSequence,
+		Coords:       stats.Coords,
+	}
+
+	peers := map[types.PublicKey]struct{}{}
+	for _, p := range r.Peers() {
+		var public types.PublicKey
+		b, err := hex.DecodeString(p.PublicKey)
+		if err != nil || len(b) != len(public) {
+			continue
+		}
+		copy(public[:], b)
+		if public == self {
+			continue
+		}
+		if _, ok := peers[public]; ok {
+			continue
+		}
+		peers[public] = struct{}{}
+		snapshot.Links = append(snapshot.Links, Link{From: self, To: public, Kind: "peer"})
+	}
+	if !stats.Parent.IsZero() {
+		snapshot.Links = append(snapshot.Links, Link{From: self, To: stats.Parent, Kind: "tree"})
+	}
+
+	keys := make([]types.PublicKey, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CompareTo(keys[j]) < 0
+	})
+	for i, k := range keys {
+		node := Node{PublicKey: k, Root: k == stats.Root}
+		if resolver != nil {
+			node.Name, _ = resolver.ReverseResolve(context.Background(), k)
+		}
+		if _, ok := peers[k]; ok {
+			node.Peer = true
+		}
+		if k != self {
+			if hop, ok := r.NextHop(nil, types.TypeVirtualSnakeRouted, k).(types.PublicKey); ok && hop != self {
+				node.NextHop = &hop
+				if hop != k {
+					snapshot.Links = append(snapshot.Links, Link{From: hop, To: k, Kind: "route"})
+				}
+			}
+		}
+		snapshot.Nodes = append(snapshot.Nodes, node)
+		if len(keys) > 1 {
+			next := keys[(i+1)%len(keys)]
+			snapshot.Links = append(snapshot.Links, Link{From: k, To: next, Kind: "snake"})
+		}
+	}
+	return snapshot
+}
+
+// writeDot writes the snapshot as a Graphviz graph.
+func (s *Snapshot) writeDot(w io.Writer) error {
+	styles := map[string]string{
+		"peer":  "solid",
+		"tree":  "bold",
+		"route": "dashed",
+		"snake": "dotted",
+	}
+	if _, err := fmt.Fprintln(w, "digraph pinecone {"); err != nil {
+		return err
+	}
+	for _, n := range s.Nodes {
+		label := n.Name
+		if label == "" {
+			label = n.PublicKey.String()[:8]
+		}
+		attrs := fmt.Sprintf("label=%q", label)
+		switch {
+		case n.PublicKey == s.Self:
+			attrs += ", shape=doublecircle"
+		case n.Root:
+			attrs += ", shape=box"
+		}
+		if _, err := fmt.Fprintf(w, "  %q [%s];\n", n.PublicKey.String(), attrs); err != nil {
+			return err
+		}
+	}
+	for _, l := range s.Links {
+		if _, err := fmt.Fprintf(w, "  %q -> %q [style=%s];\n", l.From.String(), l.To.String(), styles[l.Kind]); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
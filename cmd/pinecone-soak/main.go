@@ -0,0 +1,504 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command pinecone-soak runs a network of in-process routers for a long time
+// with peerings going up and down, routers restarting and traffic flowing
+// between random pairs of nodes, in order to catch slow leaks that tests and
+// benchmarks are too short to notice. At the end, every router is stopped and
+// the harness checks that the goroutines that they started have gone away,
+// that the heap didn't keep growing while the network was running and, when
+// built with -tags framedebug, that no frames were returned to the frame pool
+// more than once. The exit code is non-zero if any of the checks fail.
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/test/fixtures"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func main() {
+	topology := flag.String("topology", "ring:32", "topology to build, i.e. \"ring:32\" or \"tree:40:3\"")
+	seed := flag.String("seed", "soak", "seed for the node keys and for the choice of churn and traffic")
+	duration := flag.Duration("duration", time.Hour, "how long to run for")
+	warmup := flag.Duration("warmup", time.Minute, "how long to run before taking the first heap sample")
+	interval := flag.Duration("interval", time.Minute, "how often to sample and print progress")
+	churn := flag.Duration("churn", time.Second*5, "how often to bounce a peering or restart a router, or 0 for no churn")
+	rate := flag.Int("rate", 200, "packets per second to send between random pairs of nodes")
+	heapGrowth := flag.Int("max-heap-growth", 32, "how many MiB the heap can grow by between the first and last samples")
+	report := flag.String("report", "", "file to write the report to as JSON, as well as printing it")
+	flag.Parse()
+
+	t, err := fixtures.Parse(*topology)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if t.Size < 2 {
+		fmt.Fprintln(os.Stderr, "at least 2 nodes are required")
+		os.Exit(1)
+	}
+
+	s := newSoak(t, *seed)
+	fmt.Printf("Soaking %d nodes (%s) for %s, seed %q\n", t.Size, *topology, *duration, *seed)
+	s.start()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	if *churn > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.churn(*churn, stop)
+		}()
+	}
+	if *rate > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.traffic(*rate, stop)
+		}()
+	}
+
+	start := time.Now()
+	end := start.Add(*duration)
+	ticker := time.NewTicker(*interval)
+	deadline := time.NewTimer(*duration)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			// Leave the last sample to the deadline if it is close.
+			if time.Until(end) > *interval/2 {
+				s.sample(start, time.Since(start) >= *warmup)
+			}
+		case <-deadline.C:
+			s.sample(start, time.Since(start) >= *warmup)
+			break loop
+		}
+	}
+	ticker.Stop()
+	close(stop)
+	wg.Wait()
+
+	r := s.finish(start, uint64(*heapGrowth)<<20)
+	r.print()
+	if *report != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(*report, data, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to write the report:", err)
+			os.Exit(1)
+		}
+	}
+	if !r.Passed {
+		os.Exit(1)
+	}
+}
+
+// node is one of the routers in the network. The router is replaced with a
+// new one, using the same key, when the node restarts.
+type node struct {
+	mutex  sync.Mutex
+	name   string
+	key    ed25519.PrivateKey
+	router *router.Router
+	done   chan struct{} // closed when the router is stopped, for its reader
+}
+
+// link is a peering between two nodes, which is carried over an in-memory
+// pipe that is replaced every time that the link comes back up.
+type link struct {
+	mutex sync.Mutex
+	a, b  *node
+	conns [2]net.Conn
+	up    bool
+}
+
+type soak struct {
+	nodes      []*node
+	links      []*link
+	rand       *rand.Rand // only used by churn
+	goroutines int        // before any routers were started
+	samples    []sample
+	sent       uint64 // atomic
+	received   uint64 // atomic
+	failed     uint64 // atomic, WriteTo errors
+	bounces    uint64 // atomic, links taken down and brought back up
+	restarts   uint64 // atomic, routers replaced
+}
+
+func newSoak(t fixtures.Topology, seed string) *soak {
+	s := &soak{
+		rand:       rand.New(rand.NewSource(seedValue(seed))),
+		goroutines: runtime.NumGoroutine(),
+	}
+	for i, key := range t.Keys(seed) {
+		s.nodes = append(s.nodes, &node{name: t.Name(i), key: key})
+	}
+	for _, l := range t.Links {
+		s.links = append(s.links, &link{a: s.nodes[l[0]], b: s.nodes[l[1]]})
+	}
+	return s
+}
+
+// seedValue turns the seed into a number for math/rand.
+func seedValue(seed string) int64 {
+	key := fixtures.PublicKey(seed, "rand")
+	return int64(binary.BigEndian.Uint64(key[:8]))
+}
+
+func (s *soak) start() {
+	for _, n := range s.nodes {
+		s.startNode(n)
+	}
+	for _, l := range s.links {
+		s.connect(l)
+	}
+}
+
+// startNode starts a new router for the node, along with a reader that
+// drains the traffic that is delivered to it.
+func (s *soak) startNode(n *node) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	r := router.NewRouter(nil, n.key, false)
+	done := make(chan struct{})
+	n.router, n.done = r, done
+	go func() {
+		buf := make([]byte, types.MaxPayloadSize)
+		for {
+			// The read deadline is only checked when ReadFrom is called, so
+			// use a short one in order to be able to notice when to stop.
+			_ = r.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+			_, from, _ := r.ReadFrom(buf)
+			if from != nil {
+				atomic.AddUint64(&s.received, 1)
+				continue
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+}
+
+// stopNode stops the node's router and its reader.
+func (s *soak) stopNode(n *node) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.router == nil {
+		return
+	}
+	_ = n.router.Close()
+	close(n.done)
+	n.router, n.done = nil, nil
+}
+
+func (n *node) current() *router.Router {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.router
+}
+
+// connect brings the link up over a new pipe, if it isn't up already.
+func (s *soak) connect(l *link) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	ra, rb := l.a.current(), l.b.current()
+	if l.up || ra == nil || rb == nil {
+		return
+	}
+	pa, pb := net.Pipe()
+	l.conns, l.up = [2]net.Conn{pa, pb}, true
+	go func() {
+		_, _ = ra.Connect(pa, router.ConnectionPublicKey(rb.PublicKey()))
+	}()
+	go func() {
+		_, _ = rb.Connect(pb, router.ConnectionPublicKey(ra.PublicKey()))
+	}()
+}
+
+// disconnect takes the link down by closing its pipe.
+func (s *soak) disconnect(l *link) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.up {
+		return
+	}
+	_ = l.conns[0].Close()
+	_ = l.conns[1].Close()
+	l.conns, l.up = [2]net.Conn{}, false
+}
+
+// churn bounces a random link, or every so often restarts a random node, at
+// the given interval. Links and nodes come back after a random delay of up to
+// the interval.
+func (s *soak) churn(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var pending sync.WaitGroup
+	defer pending.Wait()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		delay := time.Duration(s.rand.Int63n(int64(interval)))
+		pending.Add(1)
+		if s.rand.Intn(4) == 0 {
+			n := s.nodes[s.rand.Intn(len(s.nodes))]
+			var links []*link
+			for _, l := range s.links {
+				if l.a == n || l.b == n {
+					links = append(links, l)
+				}
+			}
+			s.stopNode(n)
+			for _, l := range links {
+				s.disconnect(l)
+			}
+			atomic.AddUint64(&s.restarts, 1)
+			time.AfterFunc(delay, func() {
+				defer pending.Done()
+				s.startNode(n)
+				for _, l := range links {
+					s.connect(l)
+				}
+			})
+		} else {
+			l := s.links[s.rand.Intn(len(s.links))]
+			s.disconnect(l)
+			atomic.AddUint64(&s.bounces, 1)
+			time.AfterFunc(delay, func() {
+				defer pending.Done()
+				s.connect(l)
+			})
+		}
+	}
+}
+
+// traffic sends packets between random pairs of nodes at the given rate,
+// alternating between SNEK routing and tree routing.
+func (s *soak) traffic(rate int, stop <-chan struct{}) {
+	rng := rand.New(rand.NewSource(s.rand.Int63()))
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	payload := make([]byte, 64)
+	for i := uint64(0); ; i++ {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		a := rng.Intn(len(s.nodes))
+		b := (a + 1 + rng.Intn(len(s.nodes)-1)) % len(s.nodes)
+		src, dst := s.nodes[a].current(), s.nodes[b].current()
+		if src == nil || dst == nil {
+			continue
+		}
+		var addr net.Addr = dst.PublicKey()
+		if i%2 == 1 {
+			addr = dst.Coords()
+		}
+		binary.BigEndian.PutUint64(payload, i)
+		atomic.AddUint64(&s.sent, 1)
+		if _, err := src.WriteTo(payload, addr); err != nil {
+			atomic.AddUint64(&s.failed, 1)
+		}
+	}
+}
+
+// sample is a snapshot of the harness, taken at every interval.
+type sample struct {
+	Elapsed    time.Duration `json:"elapsed_ns"`
+	Goroutines int           `json:"goroutines"`
+	HeapInUse  uint64        `json:"heap_in_use"`
+	Peerings   int           `json:"peerings"`    // counted from both sides
+	FrameLeaks uint64        `json:"frame_leaks"` // dropped without being returned to the pool, only with framedebug
+	Sent       uint64        `json:"sent"`
+	Received   uint64        `json:"received"`
+	Failed     uint64        `json:"failed"`
+	Bounces    uint64        `json:"bounces"`
+	Restarts   uint64        `json:"restarts"`
+	Warm       bool          `json:"warm"` // taken after the warm-up, so counts towards the heap check
+}
+
+func (s *soak) sample(start time.Time, warm bool) {
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	smp := sample{
+		Elapsed:    time.Since(start).Round(time.Second),
+		Goroutines: runtime.NumGoroutine(),
+		HeapInUse:  mem.HeapInuse,
+		Sent:       atomic.LoadUint64(&s.sent),
+		Received:   atomic.LoadUint64(&s.received),
+		Failed:     atomic.LoadUint64(&s.failed),
+		Bounces:    atomic.LoadUint64(&s.bounces),
+		Restarts:   atomic.LoadUint64(&s.restarts),
+		Warm:       warm,
+	}
+	for _, n := range s.nodes {
+		if r := n.current(); r != nil {
+			stats := r.DebugStats()
+			smp.Peerings += stats.PeerCount
+			smp.FrameLeaks = stats.FrameLeaks
+		}
+	}
+	s.samples = append(s.samples, smp)
+	fmt.Printf("%9s: %d goroutines, %.1f MiB heap, %d peerings, %d/%d packets received, %d bounces, %d restarts\n",
+		smp.Elapsed, smp.Goroutines, float64(smp.HeapInUse)/(1<<20), smp.Peerings,
+		smp.Received, smp.Sent, smp.Bounces, smp.Restarts,
+	)
+}
+
+// result is the outcome of the soak, which is printed at the end and can
+// also be written out as JSON.
+type result struct {
+	Nodes      int           `json:"nodes"`
+	Links      int           `json:"links"`
+	Duration   time.Duration `json:"duration_ns"`
+	Samples    []sample      `json:"samples"`
+	Checks     []check       `json:"checks"`
+	FrameDebug bool          `json:"frame_debug"`
+	Passed     bool          `json:"passed"`
+}
+
+type check struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+// finish stops every router and checks for leaks.
+func (s *soak) finish(start time.Time, heapGrowth uint64) *result {
+	r := &result{
+		Nodes:    len(s.nodes),
+		Links:    len(s.links),
+		Duration: time.Since(start).Round(time.Second),
+		Samples:  s.samples,
+		Passed:   true,
+	}
+	add := func(name string, passed bool, format string, args ...interface{}) {
+		r.Checks = append(r.Checks, check{name, passed, fmt.Sprintf(format, args...)})
+		r.Passed = r.Passed && passed
+	}
+
+	// The heap is compared between the first and last samples that were
+	// taken after the warm-up, so that the routers filling their tables
+	// and pools at the start doesn't count as growth.
+	var first, last *sample
+	for i := range s.samples {
+		if s.samples[i].Warm {
+			if first == nil {
+				first = &s.samples[i]
+			}
+			last = &s.samples[i]
+		}
+	}
+	if first == nil || first == last {
+		add("heap", true, "skipped, the run was too short to take two samples after the warm-up")
+	} else {
+		growth := int64(last.HeapInUse) - int64(first.HeapInUse)
+		add("heap", growth <= int64(heapGrowth),
+			"%.1f MiB at %s, %.1f MiB at %s, limit is %.1f MiB of growth",
+			float64(first.HeapInUse)/(1<<20), first.Elapsed,
+			float64(last.HeapInUse)/(1<<20), last.Elapsed, float64(heapGrowth)/(1<<20))
+	}
+
+	var stats router.DebugStats
+	for _, n := range s.nodes {
+		if rt := n.current(); rt != nil {
+			stats = rt.DebugStats()
+		}
+		s.stopNode(n)
+	}
+	for _, l := range s.links {
+		s.disconnect(l)
+	}
+
+	// Everything that the routers started should wind down on its own
+	// once they have been stopped.
+	goroutines := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second * 30); time.Now().Before(deadline); {
+		if goroutines = runtime.NumGoroutine(); goroutines <= s.goroutines {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	add("goroutines", goroutines <= s.goroutines,
+		"%d before the routers were started, %d after they were stopped", s.goroutines, goroutines)
+
+	// Frames that are dropped along the way aren't always returned to the
+	// pool, which only costs an allocation since the garbage collector
+	// reclaims them, so those are only reported. Frames that are held on to
+	// forever show up in the heap instead. A frame that is returned twice
+	// is always a bug though, since it can then be handed out twice.
+	r.FrameDebug = stats.FrameDebug
+	if !stats.FrameDebug {
+		add("frames", true, "skipped, build with -tags framedebug to check the frame pool")
+	} else {
+		runtime.GC()
+		runtime.GC()
+		stats = s.nodes[0].finalStats()
+		add("frames", stats.FrameDoubleFrees == 0,
+			"%d returned more than once, %d dropped without being returned", stats.FrameDoubleFrees, stats.FrameLeaks)
+	}
+	return r
+}
+
+// finalStats returns the debug stats from a new router for the node, which
+// is stopped again straight away. The frame pool counters are shared by all
+// routers, so this reads them after the rest of the network has gone.
+func (n *node) finalStats() router.DebugStats {
+	r := router.NewRouter(nil, n.key, false)
+	defer r.Close()
+	return r.DebugStats()
+}
+
+func (r *result) print() {
+	fmt.Printf("\nSoaked %d nodes with %d links for %s\n", r.Nodes, r.Links, r.Duration)
+	if len(r.Samples) > 0 {
+		last := r.Samples[len(r.Samples)-1]
+		fmt.Printf("Traffic: %d sent, %d received, %d failed to send\n", last.Sent, last.Received, last.Failed)
+		fmt.Printf("Churn:   %d bounced peerings, %d restarted routers\n", last.Bounces, last.Restarts)
+	}
+	for _, c := range r.Checks {
+		status := "PASS"
+		if !c.Passed {
+			status = "FAIL"
+		}
+		fmt.Printf("%s %-10s %s\n", status, c.Name, c.Detail)
+	}
+}
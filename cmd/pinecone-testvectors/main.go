@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command pinecone-testvectors writes out the wire format test vectors, or
+// checks the encodings produced by another implementation against them. The
+// encodings to check are given as a JSON object mapping each vector name to
+// the hex encoding of the frame, i.e. {"keepalive_v0": "70696e65..."}.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/matrix-org/pinecone/types/testvectors"
+)
+
+func main() {
+	write := flag.String("write", "", "write the test vectors to the given file, or - for stdout")
+	check := flag.String("check", "", "check the encodings in the given JSON file against the test vectors")
+	flag.Parse()
+
+	set, err := testvectors.Generate()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to generate test vectors:", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case *write != "":
+		data, err := set.Encode()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to encode test vectors:", err)
+			os.Exit(1)
+		}
+		if *write == "-" {
+			_, err = os.Stdout.Write(data)
+		} else {
+			err = ioutil.WriteFile(*write, data, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to write test vectors:", err)
+			os.Exit(1)
+		}
+
+	case *check != "":
+		data, err := ioutil.ReadFile(*check)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to read encodings:", err)
+			os.Exit(1)
+		}
+		var hexEncodings map[string]testvectors.HexBytes
+		if err := json.Unmarshal(data, &hexEncodings); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to parse encodings:", err)
+			os.Exit(1)
+		}
+		encodings := make(map[string][]byte, len(hexEncodings))
+		for name, encoded := range hexEncodings {
+			encodings[name] = encoded
+		}
+		if err := set.Validate(encodings); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("All %d vectors match\n", len(set.Vectors))
+
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
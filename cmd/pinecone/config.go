@@ -0,0 +1,369 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/connections"
+	"github.com/matrix-org/pinecone/names"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// config contains the settings that can be changed while the daemon is
+// running, by editing the config file and then sending SIGHUP or calling
+// the reload endpoint on the debug listener.
+type config struct {
+	StaticPeers []string `json:"static_peers"` // URIs to keep connected to
+	SeedDomains []string `json:"seed_domains"` // domains to find more static peers from
+	Listen      string   `json:"listen"`       // address to listen for TCP connections
+	ListenWS    string   `json:"listen_ws"`    // address to listen for WebSockets connections
+	ListenURIs  []string `json:"listen_uris"`  // more URIs to listen on, see connections.ListenerManager
+	Advertise   bool     `json:"advertise"`    // advertise the public listener addresses with PEX
+	BlockedKeys []string `json:"blocked_keys"` // public keys or names to refuse all traffic from
+	LogLevel    string   `json:"log_level"`    // "debug", "info" or "off"
+
+	// Names can be used in place of public keys once they can be resolved.
+	NamesFile         string `json:"names_file"`          // static names, see names.ParseStatic
+	NamesDomain       string `json:"names_domain"`        // domain to look up short names under in DNS
+	MatrixHomeserver  string `json:"matrix_homeserver"`   // homeserver whose user directory has names
+	MatrixAccessToken string `json:"matrix_access_token"` // for searching the user directory
+	MatrixSearchNames bool   `json:"matrix_search_names"` // also resolve unverified display names, see names.Matrix
+}
+
+// loadConfig reads the config file at the given path. Any settings that
+// are missing from the file keep their values from the defaults, which
+// come from the command line flags.
+func loadConfig(path string, defaults config) (config, error) {
+	cfg := defaults
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("ioutil.ReadFile: %w", err)
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return cfg, nil
+}
+
+type logLevel int32
+
+const (
+	logLevelOff logLevel = iota
+	logLevelInfo
+	logLevelDebug
+)
+
+func parseLogLevel(level string) (logLevel, error) {
+	switch level {
+	case "off":
+		return logLevelOff, nil
+	case "info":
+		return logLevelInfo, nil
+	case "debug", "":
+		return logLevelDebug, nil
+	default:
+		return logLevelOff, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+// leveledLogger only writes messages at or below the current log level,
+// which can be changed at any time.
+type leveledLogger struct {
+	out   *log.Logger
+	level *atomic.Int32
+	at    logLevel
+}
+
+func (l leveledLogger) Println(v ...interface{}) {
+	if logLevel(l.level.Load()) >= l.at {
+		l.out.Println(v...)
+	}
+}
+
+func (l leveledLogger) Printf(format string, v ...interface{}) {
+	if logLevel(l.level.Load()) >= l.at {
+		l.out.Printf(format, v...)
+	}
+}
+
+// listenURIs returns every URI that the config says to listen on.
+func (c config) listenURIs() []string {
+	var uris []string
+	if c.Listen != "" {
+		uris = append(uris, c.Listen)
+	}
+	if c.ListenWS != "" {
+		uris = append(uris, "ws://"+c.ListenWS)
+	}
+	return append(uris, c.ListenURIs...)
+}
+
+// resolver returns a resolver for the names that the config knows about.
+// The static file is tried first, then DNS and lastly the Matrix user
+// directory, if one is given.
+func (c config) resolver() (names.Resolver, error) {
+	var chain names.Chain
+	if c.NamesFile != "" {
+		static, err := names.LoadStatic(c.NamesFile)
+		if err != nil {
+			return nil, fmt.Errorf("names.LoadStatic: %w", err)
+		}
+		chain = append(chain, static)
+	}
+	chain = append(chain, &names.DNS{Domain: c.NamesDomain})
+	if c.MatrixHomeserver != "" {
+		chain = append(chain, &names.Matrix{
+			Homeserver:  c.MatrixHomeserver,
+			AccessToken: c.MatrixAccessToken,
+			SearchNames: c.MatrixSearchNames,
+		})
+	}
+	return chain, nil
+}
+
+// resolveTimeout is how long looking up a single name can take.
+const resolveTimeout = time.Second * 10
+
+// advertiseTTL is how long the PEX record advertising our listeners lasts
+// for. The router signs it again before it expires.
+const advertiseTTL = time.Hour
+
+// Limits on inbound connections that haven't finished negotiating yet, so
+// that a public listener can't be exhausted by slow or abusive clients.
+const (
+	handshakeTimeout     = time.Second * 5
+	handshakesInFlight   = 64
+	handshakesPerAddress = 1 // per second
+	handshakeBurst       = 8
+)
+
+// daemon owns everything that can be reconfigured at runtime.
+type daemon struct {
+	mutex      sync.Mutex
+	path       string
+	defaults   config
+	current    config
+	level      *atomic.Int32
+	info       types.Logger
+	router     *router.Router
+	manager    *connections.ConnectionManager
+	listeners  *connections.ListenerManager
+	blocked    atomic.Value // map[types.PublicKey]struct{}
+	names      names.Resolver
+	listenConf net.ListenConfig
+}
+
+// filter is installed as the router packet filter and drops everything
+// from blocked public keys.
+func (d *daemon) filter(from types.PublicKey, _ *types.Frame) bool {
+	blocked, _ := d.blocked.Load().(map[types.PublicKey]struct{})
+	_, ok := blocked[from]
+	return ok
+}
+
+// reload reads the config file again and applies any changes.
+func (d *daemon) reload() error {
+	if d.path == "" {
+		return fmt.Errorf("no config file was given with -config")
+	}
+	cfg, err := loadConfig(d.path, d.defaults)
+	if err != nil {
+		return err
+	}
+	return d.apply(cfg)
+}
+
+// apply works out what has changed since the last time config was applied
+// and only touches those things, so that peerings that aren't affected by
+// the change stay connected.
+func (d *daemon) apply(cfg config) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	resolver, err := cfg.resolver()
+	if err != nil {
+		return err
+	}
+	blocked := make(map[types.PublicKey]struct{}, len(cfg.BlockedKeys))
+	for _, k := range cfg.BlockedKeys {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		public, err := names.ResolveKey(ctx, resolver, k)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("invalid blocked key %q: %w", k, err)
+		}
+		blocked[public] = struct{}{}
+	}
+
+	d.level.Store(int32(level))
+	d.blocked.Store(blocked)
+	d.names = resolver
+	for _, p := range d.router.Peers() {
+		public, _ := names.ParseKey(p.PublicKey)
+		if _, ok := blocked[public]; ok {
+			d.router.DisconnectGeneration(types.SwitchPortID(p.Port), p.Generation, fmt.Errorf("public key is blocked"))
+		}
+	}
+	d.manager.SetStaticPeers(cfg.StaticPeers)
+	d.manager.SetSeedDomains(cfg.SeedDomains)
+
+	listenErr := d.listeners.SetListeners(cfg.listenURIs())
+	d.current = cfg
+	d.advertise()
+	if listenErr != nil {
+		return fmt.Errorf("d.listeners.SetListeners: %w", listenErr)
+	}
+
+	d.info.Printf("Configuration applied: %d static peers, %d seed domains, %d blocked keys, log level %q\n",
+		len(cfg.StaticPeers), len(cfg.SeedDomains), len(blocked), cfg.LogLevel)
+	return nil
+}
+
+// advertise updates the PEX record that advertises our listeners, if the
+// config asks for it. The mutex must be held.
+func (d *daemon) advertise() {
+	var uris []string
+	if d.current.Advertise {
+		uris = d.listeners.PublicURIs()
+		if len(uris) > types.MaxPEXURIs {
+			uris = uris[:types.MaxPEXURIs]
+		}
+	}
+	if _, err := d.router.AdvertisePEX(uris, advertiseTTL); err != nil {
+		d.info.Println("Failed to advertise listeners:", err)
+	}
+}
+
+// ReloadHandler is mounted on the debug listener and reloads the config
+// file when it receives a POST request.
+func (d *daemon) ReloadHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := d.reload(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintln(w, err)
+		return
+	}
+	_, _ = fmt.Fprintln(w, "OK")
+}
+
+// ResolveHandler is mounted on the debug listener and resolves names using
+// the resolvers from the config. GET with ?name=... returns the public key
+// for a name, and with ?key=... returns the name for a public key.
+func (d *daemon) ResolveHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	d.mutex.Lock()
+	resolver := d.names
+	d.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(req.Context(), resolveTimeout)
+	defer cancel()
+
+	var result struct {
+		Name      string `json:"name"`
+		PublicKey string `json:"public_key"`
+	}
+	var err error
+	if name := req.URL.Query().Get("name"); name != "" {
+		var key types.PublicKey
+		key, err = names.ResolveKey(ctx, resolver, name)
+		result.Name, result.PublicKey = name, key.String()
+	} else {
+		var key types.PublicKey
+		if key, err = names.ParseKey(req.URL.Query().Get("key")); err == nil {
+			result.Name, err = resolver.ReverseResolve(ctx, key)
+			result.PublicKey = key.String()
+		}
+	}
+	switch {
+	case errors.Is(err, names.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = fmt.Fprintln(w, err)
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintln(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// ListenersHandler is mounted on the debug listener and manages the inbound
+// listeners. GET lists them along with the public URIs that they can be
+// reached on, POST with a body like {"uri": "ws://:8080"} opens another and
+// DELETE with ?uri=... closes one. Changes made here last until the config
+// is next reloaded.
+func (d *daemon) ListenersHandler(w http.ResponseWriter, req *http.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var err error
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			URI string `json:"uri"`
+		}
+		if err = json.NewDecoder(req.Body).Decode(&body); err == nil {
+			_, err = d.listeners.Listen(body.URI)
+		}
+	case http.MethodDelete:
+		err = d.listeners.Close(req.URL.Query().Get("uri"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintln(w, err)
+		return
+	}
+	if req.Method != http.MethodGet {
+		d.advertise()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(struct {
+		Listeners  []connections.ListenerInfo `json:"listeners"`
+		PublicURIs []string                   `json:"public_uris"`
+	}{
+		Listeners:  d.listeners.Listeners(),
+		PublicURIs: d.listeners.PublicURIs(),
+	})
+}
@@ -18,118 +18,196 @@ import (
 	"context"
 	"crypto/ed25519"
 	"flag"
-	"fmt"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 
-	"github.com/gorilla/websocket"
 	"github.com/matrix-org/pinecone/connections"
+	"github.com/matrix-org/pinecone/keys"
 	"github.com/matrix-org/pinecone/multicast"
 	"github.com/matrix-org/pinecone/router"
-	"github.com/matrix-org/pinecone/util"
+	"go.uber.org/atomic"
 )
 
 func main() {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
 
-	_, sk, err := ed25519.GenerateKey(nil)
+	listentcp := flag.String("listen", ":0", "address to listen for TCP connections, on both IPv4 and IPv6 if the host is left out")
+	listenws := flag.String("listenws", ":0", "address to listen for WebSockets connections")
+	advertise := flag.Bool("advertise", false, "advertise the public addresses of the listeners to other nodes with peer exchange")
+	listendebug := flag.String("listendebug", os.Getenv("PPROFLISTEN"), "address to listen for pprof and debug stats (disabled if empty)")
+	listenhealth := flag.String("listenhealth", "", "address to serve /healthz on for liveness and readiness probes (disabled if empty)")
+	connect := flag.String("connect", "", "peer to connect to")
+	seed := flag.String("seed", "", "domain to look up more peers to connect to from DNS")
+	observer := flag.Bool("observer", false, "run as an observer which follows the tree but never carries traffic")
+	embedded := flag.Bool("embedded", false, "use smaller queues and tables for resource-limited devices")
+	network := flag.String("network", "", "name of the network to join instead of the default one")
+	routing := flag.String("routing", "both", "which routing schemes to take part in: both, tree-only or snake-only")
+	configpath := flag.String("config", "", "JSON config file with settings that can be reloaded with SIGHUP")
+	keypath := flag.String("key", "", "file to keep the private key in, which is generated if missing (random key each run if empty)")
+	flag.Parse()
+
+	mode, err := router.ParseRoutingMode(*routing)
 	if err != nil {
 		panic(err)
 	}
 
-	logger := log.New(os.Stdout, "", 0)
-	if hostPort := os.Getenv("PPROFLISTEN"); hostPort != "" {
-		logger.Println("Starting pprof on", hostPort)
-		go func() {
-			_ = http.ListenAndServe(hostPort, nil)
-		}()
+	// The passphrase comes from the environment rather than a flag so that
+	// it doesn't show up in the process list.
+	passphrase := []byte(os.Getenv("PINECONE_KEY_PASSPHRASE"))
+	var options []router.RouterOption
+	var sk ed25519.PrivateKey
+	if *keypath != "" {
+		if _, err := keys.LoadOrGenerate(*keypath, passphrase); err != nil {
+			panic(err)
+		}
+		rotation, err := keys.LoadRotation(*keypath, passphrase)
+		if err != nil {
+			panic(err)
+		}
+		sk = rotation.Current
+		if rotation.Previous != nil {
+			options = append(options, router.RouterPredecessorKey{
+				PrivateKey: rotation.Previous,
+				Until:      rotation.Until,
+			})
+		}
+	} else {
+		var err error
+		if _, sk, err = ed25519.GenerateKey(nil); err != nil {
+			panic(err)
+		}
 	}
 
-	listener := net.ListenConfig{}
+	defaults := config{
+		Listen:    *listentcp,
+		ListenWS:  *listenws,
+		Advertise: *advertise,
+		LogLevel:  "debug",
+	}
+	if *connect != "" {
+		defaults.StaticPeers = []string{*connect}
+	}
+	if *seed != "" {
+		defaults.SeedDomains = []string{*seed}
+	}
+	cfg, err := loadConfig(*configpath, defaults)
+	if err != nil {
+		panic(err)
+	}
 
-	pineconeRouter := router.NewRouter(logger, sk, false)
+	out := log.New(os.Stdout, "", 0)
+	level := atomic.NewInt32(int32(logLevelDebug))
+	logger := leveledLogger{out: out, level: level, at: logLevelDebug}
+	info := leveledLogger{out: out, level: level, at: logLevelInfo}
+
+	pineconeRouter := router.NewRouter(logger, sk, false, append(options,
+		router.RouterObserver(*observer),
+		router.RouterEmbedded(*embedded),
+		router.RouterNetwork(*network),
+		mode,
+		router.RouterHandshakeLimits{
+			Timeout:         handshakeTimeout,
+			MaxInFlight:     handshakesInFlight,
+			PerAddressRate:  handshakesPerAddress,
+			PerAddressBurst: handshakeBurst,
+		},
+	)...)
 	pineconeMulticast := multicast.NewMulticast(logger, pineconeRouter)
 	pineconeMulticast.Start()
 	pineconeManager := connections.NewConnectionManager(pineconeRouter, nil)
-
-	listentcp := flag.String("listen", ":0", "address to listen for TCP connections")
-	listenws := flag.String("listenws", ":0", "address to listen for WebSockets connections")
-	connect := flag.String("connect", "", "peer to connect to")
-	flag.Parse()
-
-	if connect != nil && *connect != "" {
-		pineconeManager.AddPeer(*connect)
+	pineconeLinks := connections.NewLinkWatcher(logger, pineconeRouter, pineconeManager)
+	pineconeLinks.Start()
+
+	d := &daemon{
+		path:      *configpath,
+		defaults:  defaults,
+		level:     level,
+		info:      info,
+		router:    pineconeRouter,
+		manager:   pineconeManager,
+		listeners: connections.NewListenerManager(info, pineconeRouter),
+	}
+	pineconeRouter.InjectPacketFilter(d.filter)
+	if err := d.apply(cfg); err != nil {
+		panic(err)
 	}
 
-	if listenws != nil && *listenws != "" {
+	if *observer {
 		go func() {
-			var upgrader = websocket.Upgrader{}
-			http.DefaultServeMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-				conn, err := upgrader.Upgrade(w, r, nil)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-
-				if _, err := pineconeRouter.Connect(
-					util.WrapWebSocketConn(conn),
-					router.ConnectionURI(conn.RemoteAddr().String()),
-					router.ConnectionPeerType(router.PeerTypeRemote),
-					router.ConnectionZone("websocket"),
-				); err != nil {
-					panic(err)
-				}
-
-				fmt.Println("Inbound WS connection", conn.RemoteAddr(), "is connected")
-			})
+			for range time.NewTicker(time.Minute).C {
+				stats := pineconeRouter.TreeStats()
+				info.Printf("Observed root %s (seq %d) at depth %d via %s, %d root changes, %d parent changes\n",
+					stats.Root, stats.RootSequence, stats.Depth, stats.Parent, stats.RootChanges, stats.ParentChanges)
+			}
+		}()
+	}
 
-			listener, err := listener.Listen(context.Background(), "tcp", *listenws)
+	if listendebug != nil && *listendebug != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/debug/pprof/", pprof.Index)
+			mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+			mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+			mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+			mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+			mux.HandleFunc("/debug/pinecone", pineconeRouter.DebugHandler)
+			mux.HandleFunc("/debug/pinecone/mirror", pineconeRouter.MirrorHandler)
+			mux.HandleFunc("/debug/pinecone/state", pineconeRouter.StateHandler)
+			mux.HandleFunc("/debug/pinecone/roots", pineconeRouter.RootHistoryHandler)
+			mux.HandleFunc("/debug/pinecone/reload", d.ReloadHandler)
+			mux.HandleFunc("/debug/pinecone/listeners", d.ListenersHandler)
+			mux.HandleFunc("/debug/pinecone/resolve", d.ResolveHandler)
+			mux.HandleFunc("/healthz", pineconeRouter.HealthHandler)
+
+			listener, err := d.listenConf.Listen(context.Background(), "tcp", *listendebug)
 			if err != nil {
 				panic(err)
 			}
 
-			fmt.Printf("Listening for WebSockets on http://%s\n", listener.Addr())
+			info.Printf("Listening for debug requests on http://%s/debug/\n", listener.Addr())
 
-			if err := http.Serve(listener, http.DefaultServeMux); err != nil {
+			if err := http.Serve(listener, mux); err != nil {
 				panic(err)
 			}
 		}()
 	}
 
-	if listentcp != nil && *listentcp != "" {
+	if *listenhealth != "" {
 		go func() {
-			listener, err := listener.Listen(context.Background(), "tcp", *listentcp)
+			mux := http.NewServeMux()
+			mux.HandleFunc("/healthz", pineconeRouter.HealthHandler)
+
+			listener, err := d.listenConf.Listen(context.Background(), "tcp", *listenhealth)
 			if err != nil {
 				panic(err)
 			}
 
-			fmt.Println("Listening on", listener.Addr())
-
-			for {
-				conn, err := listener.Accept()
-				if err != nil {
-					panic(err)
-				}
-
-				if _, err := pineconeRouter.Connect(
-					conn,
-					router.ConnectionURI(conn.RemoteAddr().String()),
-					router.ConnectionPeerType(router.PeerTypeRemote),
-				); err != nil {
-					panic(err)
-				}
+			info.Printf("Listening for health checks on http://%s/healthz\n", listener.Addr())
 
-				fmt.Println("Inbound TCP connection", conn.RemoteAddr(), "is connected")
+			if err := http.Serve(listener, mux); err != nil {
+				panic(err)
 			}
 		}()
 	}
 
-	<-sigs
+	for {
+		select {
+		case <-hups:
+			info.Println("Reloading configuration")
+			if err := d.reload(); err != nil {
+				info.Println("Failed to reload configuration:", err)
+			}
+		case <-sigs:
+			return
+		}
+	}
 }
@@ -21,13 +21,16 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/matrix-org/pinecone/cmd/pineconesim/simulator"
 	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/test/fixtures"
 	"github.com/matrix-org/pinecone/util"
 	"go.uber.org/atomic"
 
@@ -48,19 +51,41 @@ func main() {
 	sockets := flag.Bool("sockets", false, "use real TCP sockets to connect simulated nodes")
 	chaos := flag.Int("chaos", 0, "randomly connect and disconnect a certain number of links")
 	acceptCommands := flag.Bool("acceptCommands", true, "whether the sim can be commanded from the ui")
+	mobility := flag.Float64("mobility", 0, "move nodes around a 1000x1000 plane, connecting nodes within the given radio range")
+	invariants := flag.Duration("invariants", 0, "check the tree and snake invariants once the network has been quiet for this long, pausing when one is violated")
+	topology := flag.String("topology", "", "generate the topology instead of reading it from a file, i.e. line:8, star:8, ring:8, tree:15 or tree:40:3")
+	seed := flag.String("seed", "", "derive the node keys from this seed, so that nodes have the same identities every time")
+	load := flag.String("load", "", "carry on a simulation that was exported with -export from this directory, instead of reading the topology")
+	export := flag.String("export", "", "on interrupt, stop all nodes and export the topology, node stats and event log to this directory")
 	flag.Parse()
 
-	file, err := os.Open(*filename)
-	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
-
 	nodes := map[string]struct{}{}
 	wires := map[string]map[string]bool{}
 
+	var scanner *bufio.Scanner
+	switch {
+	case *load != "":
+		// The topology comes from the exported simulation instead.
+		scanner = bufio.NewScanner(strings.NewReader(""))
+	case *topology != "":
+		t, err := fixtures.Parse(*topology)
+		if err != nil {
+			panic(err)
+		}
+		for _, n := range t.Names() {
+			nodes[n] = struct{}{}
+		}
+		scanner = bufio.NewScanner(strings.NewReader(t.String()))
+	default:
+		file, err := os.Open(*filename)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		scanner = bufio.NewScanner(file)
+	}
+	scanner.Split(bufio.ScanLines)
+
 	for scanner.Scan() {
 		tokens := strings.Split(strings.TrimSpace(scanner.Text()), " ")
 		for _, t := range tokens {
@@ -80,10 +105,17 @@ func main() {
 
 	log := log.New(os.Stdout, "\u001b[36m***\u001b[0m ", 0)
 	sim := simulator.NewSimulator(log, *sockets, *acceptCommands)
+	sim.CheckInvariantsAfter(*invariants)
 	configureHTTPRouting(log, sim)
 
 	for n := range nodes {
-		if err := sim.CreateNode(n, simulator.DefaultNode); err != nil {
+		var err error
+		if *seed != "" {
+			err = sim.CreateNodeWithKey(n, simulator.DefaultNode, fixtures.Key(*seed, n))
+		} else {
+			err = sim.CreateNode(n, simulator.DefaultNode)
+		}
+		if err != nil {
 			panic(err)
 		}
 		sim.StartNodeEventHandler(n, simulator.DefaultNode)
@@ -103,6 +135,18 @@ func main() {
 		}
 	}
 
+	if *load != "" {
+		if err := sim.Load(*load); err != nil {
+			panic(err)
+		}
+		for _, link := range sim.Links() {
+			if _, ok := wires[link[0]]; !ok {
+				wires[link[0]] = map[string]bool{}
+			}
+			wires[link[0]][link[1]] = true
+		}
+	}
+
 	sim.CalculateShortestPaths()
 
 	if chaos != nil && *chaos > 0 {
@@ -155,14 +199,30 @@ func main() {
 		}()
 	}
 
+	if *mobility > 0 {
+		if err := sim.StartMobility(simulator.DefaultMobilityConfig(*mobility)); err != nil {
+			panic(err)
+		}
+	}
+
 	log.Println("Configuring HTTP listener")
 
-	select {}
+	// Stop the nodes in order on interrupt, exporting the simulation first
+	// if asked to, so that it can be carried on later with -load.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	log.Println("Shutting down")
+	if err := sim.Shutdown(*export); err != nil {
+		log.Println("Failed to export the simulation:", err)
+		os.Exit(1)
+	}
 }
 
 func configureHTTPRouting(log *log.Logger, sim *simulator.Simulator) {
 	var upgrader = websocket.Upgrader{}
 	http.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.Dir("./cmd/pineconesim/ui"))))
+	http.Handle("/api/", http.StripPrefix("/api", sim.APIHandler()))
 
 	http.DefaultServeMux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		conn, err := upgrader.Upgrade(w, r, nil)
@@ -222,6 +282,26 @@ func configureHTTPRouting(log *log.Logger, sim *simulator.Simulator) {
 		node.SimRouter.ManholeHandler(w, r)
 	})
 
+	http.DefaultServeMux.HandleFunc("/debug/pinecone", func(w http.ResponseWriter, r *http.Request) {
+		nodeID := r.URL.Query().Get("node")
+		node := sim.Node(nodeID)
+		if node == nil {
+			w.WriteHeader(404)
+			return
+		}
+		node.SimRouter.DebugHandler(w, r)
+	})
+
+	http.DefaultServeMux.HandleFunc("/debug/pinecone/mirror", func(w http.ResponseWriter, r *http.Request) {
+		nodeID := r.URL.Query().Get("node")
+		node := sim.Node(nodeID)
+		if node == nil {
+			w.WriteHeader(404)
+			return
+		}
+		node.SimRouter.MirrorHandler(w, r)
+	})
+
 	http.DefaultServeMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		_ = template.Must(template.ParseFiles("./cmd/pineconesim/page.html")).Execute(w, "")
 	})
@@ -342,6 +422,7 @@ func userProxyReporter(conn *websocket.Conn, connID uint64, sim *simulator.Simul
 				TreeAverageStretch:   treeStretch,
 				SnakePathConvergence: uint64(sim.CalculateSNEKPathConvergence()),
 				SnakeAverageStretch:  snekStretch,
+				Anomalies:            sim.CalculateAnomalies(),
 			}},
 	}); err != nil {
 		log.Println(err)
@@ -384,6 +465,8 @@ func handleSimEvents(log *log.Logger, conn *websocket.Conn, ch <-chan simulator.
 			eventType = simulator.SimNetworkStatsUpdated
 		case simulator.BandwidthReport:
 			eventType = simulator.SimBandwidthReport
+		case simulator.InvariantsViolated:
+			eventType = simulator.SimInvariantsViolated
 		}
 
 		if err := conn.WriteJSON(simulator.StateUpdateMsg{
@@ -107,7 +107,7 @@ type AdversaryRouter struct {
 }
 
 func NewAdversaryRouter(log *log.Logger, sk ed25519.PrivateKey, debug bool) *AdversaryRouter {
-	rtr := router.NewRouter(log, sk, debug)
+	rtr := router.NewRouter(log, sk, debug, router.RouterStrictConformance{})
 	adversary := &AdversaryRouter{
 		rtr,
 		NewDropSettings(),
@@ -155,6 +155,38 @@ func (a *AdversaryRouter) ManholeHandler(w http.ResponseWriter, req *http.Reques
 	a.rtr.ManholeHandler(w, req)
 }
 
+func (a *AdversaryRouter) DebugHandler(w http.ResponseWriter, req *http.Request) {
+	a.rtr.DebugHandler(w, req)
+}
+
+func (a *AdversaryRouter) MirrorHandler(w http.ResponseWriter, req *http.Request) {
+	a.rtr.MirrorHandler(w, req)
+}
+
+func (a *AdversaryRouter) SetClockSkew(offset time.Duration, rate float64) {
+	a.rtr.SetClockSkew(offset, rate)
+}
+
+func (a *AdversaryRouter) ClockSkew() (time.Duration, float64) {
+	return a.rtr.ClockSkew()
+}
+
+func (a *AdversaryRouter) TreeStats() router.TreeStats {
+	return a.rtr.TreeStats()
+}
+
+func (a *AdversaryRouter) DropCounts() map[router.DropReason]uint64 {
+	return a.rtr.DropCounts()
+}
+
+func (a *AdversaryRouter) SnakeNeighbours() []router.SnakeNeighbour {
+	return a.rtr.SnakeNeighbours()
+}
+
+func (a *AdversaryRouter) Close() error {
+	return a.rtr.Close()
+}
+
 func (a *AdversaryRouter) updatePacketCounts(from types.PublicKey, frameType types.FrameType) {
 	a.packetsRx.overall.Inc()
 	a.packetsRx.peers[from].overall.Inc()
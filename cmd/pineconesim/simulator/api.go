@@ -46,6 +46,7 @@ const (
 	SimPingStateUpdated
 	SimNetworkStatsUpdated
 	SimBandwidthReport
+	SimInvariantsViolated
 )
 
 const (
@@ -62,6 +63,15 @@ const (
 	SimConfigureAdversaryPeer
 	SimStartPings
 	SimStopPings
+	SimStartMobility
+	SimStopMobility
+	SimSetClockSkew
+	SimSetLinkLatency
+	SimSetGroup
+	SimDisconnectGroup
+	SimReconnectGroup
+	SimAddGroupLatency
+	SimRestartGroup
 )
 
 const (
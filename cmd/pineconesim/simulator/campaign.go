@@ -0,0 +1,436 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// Defaults for failure campaigns, used when the config leaves them unset.
+const (
+	defaultCampaignSettle = time.Second * 10
+	defaultCampaignProbes = 20
+	campaignProbeTimeout  = time.Second * 2
+	campaignPollInterval  = time.Millisecond * 50
+)
+
+// errCampaignRunning is returned by StartCampaign if there is already a
+// campaign running.
+var errCampaignRunning = fmt.Errorf("a campaign is already running")
+
+// CampaignConfig describes a failure campaign, which takes down every link in
+// the topology in turn, one at a time or optionally two at a time, to find
+// out which links the network can least afford to lose.
+type CampaignConfig struct {
+	Pairs  bool          // also fail every pair of links together
+	Settle time.Duration // how long to wait for the network to converge after each failure
+	Probes int           // how many node pairs to ping after each failure
+	Limit  int           // the most failures to inject, 0 for no limit
+}
+
+// CampaignResult is the impact of a single failure. The probed pairs are
+// pinged over SNEK once the network has converged, or once the settle time
+// has run out if it didn't. Pairs that were cut off from each other by the
+// failure count as partitioned rather than lost, and pairs that couldn't
+// reach each other before the campaign started aren't counted against any
+// failure.
+type CampaignResult struct {
+	Rank          int         `json:"rank"` // 1 is the most critical
+	Links         [][2]string `json:"links"`
+	Converged     bool        `json:"converged"`
+	ConvergenceMS float64     `json:"convergence_ms"`
+	Violations    int         `json:"violations"` // invariant violations left if the network didn't converge
+	Probed        int         `json:"probed"`
+	Delivered     int         `json:"delivered"`
+	Lost          int         `json:"lost"`
+	Partitioned   int         `json:"partitioned"`
+}
+
+// CampaignReport is the progress of the current or last failure campaign,
+// with the results so far ranked with the most critical failures first.
+type CampaignReport struct {
+	Running  bool             `json:"running"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished,omitempty"`
+	Total    int              `json:"total"`
+	Done     int              `json:"done"`
+	Error    string           `json:"error,omitempty"`
+	Results  []CampaignResult `json:"results"`
+}
+
+type campaign struct {
+	report CampaignReport
+	cancel context.CancelFunc
+}
+
+// StartCampaign starts a failure campaign in the background. Only one
+// campaign can run at a time. The links are restored after each failure,
+// and the network is given time to converge again before the next one, so
+// the topology is back as it started once the campaign is done.
+func (sim *Simulator) StartCampaign(config CampaignConfig) error {
+	if config.Settle <= 0 {
+		config.Settle = defaultCampaignSettle
+	}
+	if config.Probes <= 0 {
+		config.Probes = defaultCampaignProbes
+	}
+	if config.Limit < 0 {
+		return fmt.Errorf("limit can't be negative")
+	}
+	failures := campaignFailures(sim.Links(), config.Pairs)
+	if len(failures) == 0 {
+		return fmt.Errorf("there are no links to fail")
+	}
+	if config.Limit > 0 && len(failures) > config.Limit {
+		failures = failures[:config.Limit]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sim.campaignMutex.Lock()
+	defer sim.campaignMutex.Unlock()
+	if sim.campaign != nil && sim.campaign.report.Running {
+		cancel()
+		return errCampaignRunning
+	}
+	sim.campaign = &campaign{
+		report: CampaignReport{
+			Running: true,
+			Started: time.Now(),
+			Total:   len(failures),
+			Results: []CampaignResult{},
+		},
+		cancel: cancel,
+	}
+	go sim.runCampaign(ctx, config, failures)
+	return nil
+}
+
+// StopCampaign stops the running campaign, if there is one, after the
+// current failure has been restored.
+func (sim *Simulator) StopCampaign() {
+	sim.campaignMutex.Lock()
+	defer sim.campaignMutex.Unlock()
+	if sim.campaign != nil {
+		sim.campaign.cancel()
+	}
+}
+
+// Campaign returns the report of the current or last campaign, or false if
+// no campaign has been started.
+func (sim *Simulator) Campaign() (CampaignReport, bool) {
+	sim.campaignMutex.Lock()
+	defer sim.campaignMutex.Unlock()
+	if sim.campaign == nil {
+		return CampaignReport{}, false
+	}
+	report := sim.campaign.report
+	report.Results = append([]CampaignResult{}, report.Results...)
+	return report, true
+}
+
+// campaignFailures lists the sets of links to take down, which are single
+// links sorted by name, followed by every pair of them if asked for.
+func campaignFailures(links [][2]string, pairs bool) [][]savedLink {
+	sorted := make([][2]string, 0, len(links))
+	for _, link := range links {
+		if link[1] < link[0] {
+			link[0], link[1] = link[1], link[0]
+		}
+		sorted = append(sorted, link)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i][0] != sorted[j][0] {
+			return sorted[i][0] < sorted[j][0]
+		}
+		return sorted[i][1] < sorted[j][1]
+	})
+	var failures [][]savedLink
+	for _, link := range sorted {
+		failures = append(failures, []savedLink{{a: link[0], b: link[1]}})
+	}
+	if pairs {
+		for i := range sorted {
+			for j := i + 1; j < len(sorted); j++ {
+				failures = append(failures, []savedLink{
+					{a: sorted[i][0], b: sorted[i][1]},
+					{a: sorted[j][0], b: sorted[j][1]},
+				})
+			}
+		}
+	}
+	return failures
+}
+
+func (sim *Simulator) runCampaign(ctx context.Context, config CampaignConfig, failures [][]savedLink) {
+	var err error
+	defer func() {
+		sim.campaignMutex.Lock()
+		defer sim.campaignMutex.Unlock()
+		sim.campaign.report.Running = false
+		sim.campaign.report.Finished = time.Now()
+		if err != nil {
+			sim.campaign.report.Error = err.Error()
+		}
+	}()
+
+	// The same pairs are probed after every failure so that the results can
+	// be compared with each other, and any that can't reach each other to
+	// begin with are left out.
+	probes := sim.campaignProbes(config.Probes)
+	baseline := sim.probe(probes)
+	reachable := probes[:0]
+	for i, pair := range probes {
+		if baseline[i] {
+			reachable = append(reachable, pair)
+		}
+	}
+	probes = reachable
+	sim.log.Printf("Starting failure campaign of %d failures, probing %d pairs\n", len(failures), len(probes))
+
+	for _, links := range failures {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		default:
+		}
+		result := sim.injectFailure(links, probes, config.Settle)
+
+		sim.campaignMutex.Lock()
+		report := &sim.campaign.report
+		report.Results = append(report.Results, result)
+		rankCampaignResults(report.Results)
+		report.Done++
+		sim.campaignMutex.Unlock()
+	}
+	sim.log.Printf("Finished failure campaign of %d failures\n", len(failures))
+}
+
+// injectFailure takes down the given links, measures the impact and then
+// restores them again.
+func (sim *Simulator) injectFailure(links []savedLink, probes [][2]string, settle time.Duration) CampaignResult {
+	result := CampaignResult{
+		Links: make([][2]string, 0, len(links)),
+	}
+	for i := range links {
+		link := &links[i]
+		params, err := sim.LinkParams(link.a, link.b)
+		if err != nil {
+			params = DefaultLinkParams
+		}
+		link.params = params
+		result.Links = append(result.Links, [2]string{link.a, link.b})
+	}
+
+	start := time.Now()
+	for _, link := range links {
+		if err := sim.DisconnectNodes(link.a, link.b); err != nil {
+			sim.log.Printf("Failed disconnecting node %q from node %q: %s\n", link.a, link.b, err)
+		}
+	}
+	violations := sim.waitForConvergence(links, false, settle)
+	result.Converged = violations == 0
+	result.Violations = violations
+	result.ConvergenceMS = float64(time.Since(start)) / float64(time.Millisecond)
+
+	partitioned := map[int]bool{}
+	phony.Block(sim.State, func() {
+		component := map[string]int{}
+		for i, nodes := range components(sim.State._state) {
+			for _, node := range nodes {
+				component[node] = i
+			}
+		}
+		for i, pair := range probes {
+			partitioned[i] = component[pair[0]] != component[pair[1]]
+		}
+	})
+	delivered := sim.probe(probes)
+	for i := range probes {
+		result.Probed++
+		switch {
+		case partitioned[i]:
+			result.Partitioned++
+		case delivered[i]:
+			result.Delivered++
+		default:
+			result.Lost++
+		}
+	}
+
+	sim.restoreLinks(links)
+	if violations := sim.waitForConvergence(links, true, settle); violations > 0 {
+		sim.log.Printf("Network didn't converge after restoring %s, %d invariants violated\n", describeLinks(result.Links), violations)
+	}
+	return result
+}
+
+// waitForConvergence waits for the links to be reported as up or down, and
+// then for the invariants to hold, returning the number of invariants that
+// were still violated when the settle time ran out.
+func (sim *Simulator) waitForConvergence(links []savedLink, up bool, settle time.Duration) int {
+	deadline := time.Now().Add(settle)
+	violations := 0
+	for {
+		reported := true
+		phony.Block(sim.State, func() {
+			for _, link := range links {
+				if sim.State._linkReported(link.a, link.b) != up {
+					reported = false
+				}
+			}
+			violations = -1
+			if reported {
+				violations = len(CheckInvariants(sim.State._state))
+			}
+		})
+		if violations == 0 || time.Now().After(deadline) {
+			if violations < 0 {
+				violations = 0
+			}
+			return violations
+		}
+		time.Sleep(campaignPollInterval)
+	}
+}
+
+// _linkReported returns true if either end of the link reports a peering
+// with the other end.
+func (s *StateAccessor) _linkReported(a, b string) bool {
+	for _, name := range [][2]string{{a, b}, {b, a}} {
+		if node, ok := s._state.Nodes[name[0]]; ok {
+			for _, peer := range node.Connections {
+				if peer == name[1] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// campaignProbes picks up to count distinct pairs of nodes at random.
+func (sim *Simulator) campaignProbes(count int) [][2]string {
+	sim.nodesMutex.RLock()
+	names := make([]string, 0, len(sim.nodes))
+	for name := range sim.nodes {
+		names = append(names, name)
+	}
+	sim.nodesMutex.RUnlock()
+	sort.Strings(names)
+
+	var pairs [][2]string
+	for i := range names {
+		for j := i + 1; j < len(names); j++ {
+			pairs = append(pairs, [2]string{names[i], names[j]})
+		}
+	}
+	rand.Shuffle(len(pairs), func(i, j int) {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	})
+	if len(pairs) > count {
+		pairs = pairs[:count]
+	}
+	return pairs
+}
+
+// probe pings each pair over SNEK at the same time and returns which of
+// them answered. Unlike PingSNEK, the results aren't fed into the distance
+// and convergence statistics, since the topology is deliberately broken.
+func (sim *Simulator) probe(pairs [][2]string) []bool {
+	results := make([]bool, len(pairs))
+	var wg sync.WaitGroup
+	for i, pair := range pairs {
+		from, to := sim.Node(pair[0]), sim.Node(pair[1])
+		if from == nil || to == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), campaignProbeTimeout)
+			defer cancel()
+			_, _, err := from.Ping(ctx, to.PublicKey())
+			results[i] = err == nil
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// rankCampaignResults sorts the results with the most critical failures
+// first, which are those that lost the most traffic between nodes that
+// could still reach each other, then those that partitioned the most, then
+// those that didn't converge, and then those that took longest to converge.
+func rankCampaignResults(results []CampaignResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		switch {
+		case a.Lost != b.Lost:
+			return a.Lost > b.Lost
+		case a.Partitioned != b.Partitioned:
+			return a.Partitioned > b.Partitioned
+		case a.Converged != b.Converged:
+			return !a.Converged
+		default:
+			return a.ConvergenceMS > b.ConvergenceMS
+		}
+	})
+	for i := range results {
+		results[i].Rank = i + 1
+	}
+}
+
+// describeLinks names the links, i.e. "a-b c-d".
+func describeLinks(links [][2]string) string {
+	names := make([]string, 0, len(links))
+	for _, link := range links {
+		names = append(names, link[0]+"-"+link[1])
+	}
+	return strings.Join(names, " ")
+}
+
+// WriteCampaignCSV writes the ranked campaign results as CSV with a header
+// row. Failures of more than one link list them separated by spaces.
+func WriteCampaignCSV(w io.Writer, results []CampaignResult) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{
+		"rank", "links", "converged", "convergence_ms", "violations",
+		"probed", "delivered", "lost", "partitioned",
+	}); err != nil {
+		return fmt.Errorf("out.Write: %w", err)
+	}
+	for _, r := range results {
+		if err := out.Write([]string{
+			fmt.Sprint(r.Rank), describeLinks(r.Links),
+			fmt.Sprint(r.Converged), fmt.Sprintf("%.3f", r.ConvergenceMS), fmt.Sprint(r.Violations),
+			fmt.Sprint(r.Probed), fmt.Sprint(r.Delivered), fmt.Sprint(r.Lost), fmt.Sprint(r.Partitioned),
+		}); err != nil {
+			return fmt.Errorf("out.Write: %w", err)
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
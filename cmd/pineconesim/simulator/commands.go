@@ -207,6 +207,135 @@ func UnmarshalCommandJSON(command *SimCommandMsg) (SimCommand, error) {
 		msg = StartPings{}
 	case SimStopPings:
 		msg = StopPings{}
+	case SimStartMobility:
+		config := DefaultMobilityConfig(0)
+		fields := command.Event.(map[string]interface{})
+		if val, ok := fields["RadioRange"]; ok {
+			config.RadioRange = val.(float64)
+		} else {
+			err = fmt.Errorf("%sStartMobility.RadioRange field doesn't exist", FAILURE_PREAMBLE)
+		}
+		// The rest of the fields are optional and fall back to the defaults.
+		if val, ok := fields["Width"]; ok {
+			config.Width = val.(float64)
+		}
+		if val, ok := fields["Height"]; ok {
+			config.Height = val.(float64)
+		}
+		if val, ok := fields["MinSpeed"]; ok {
+			config.MinSpeed = val.(float64)
+		}
+		if val, ok := fields["MaxSpeed"]; ok {
+			config.MaxSpeed = val.(float64)
+		}
+		if val, ok := fields["Pause"]; ok {
+			config.Pause = time.Duration(val.(float64)) * time.Millisecond
+		}
+		if val, ok := fields["Interval"]; ok {
+			config.Interval = time.Duration(val.(float64)) * time.Millisecond
+		}
+		if val, ok := fields["Seed"]; ok {
+			config.Seed = int64(val.(float64))
+		}
+		msg = StartMobility{config}
+	case SimStopMobility:
+		msg = StopMobility{}
+	case SimSetClockSkew:
+		node := ""
+		rate := 1.0
+		offset := time.Duration(0)
+		fields := command.Event.(map[string]interface{})
+		if val, ok := fields["Node"]; ok {
+			node = val.(string)
+		} else {
+			err = fmt.Errorf("%sSetClockSkew.Node field doesn't exist", FAILURE_PREAMBLE)
+		}
+		// The offset and rate are optional and default to no skew.
+		if val, ok := fields["Offset"]; ok {
+			offset = time.Duration(val.(float64) * float64(time.Millisecond))
+		}
+		if val, ok := fields["Rate"]; ok {
+			rate = val.(float64)
+		}
+		msg = SetClockSkew{node, offset, rate}
+	case SimSetLinkLatency:
+		node := ""
+		peer := ""
+		fields := command.Event.(map[string]interface{})
+		if val, ok := fields["Node"]; ok {
+			node = val.(string)
+		} else {
+			err = fmt.Errorf("%sSetLinkLatency.Node field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := fields["Peer"]; ok {
+			peer = val.(string)
+		} else {
+			err = fmt.Errorf("%sSetLinkLatency.Peer field doesn't exist", FAILURE_PREAMBLE)
+		}
+		latency := time.Duration(0)
+		if val, ok := fields["Latency"]; ok {
+			latency = time.Duration(val.(float64) * float64(time.Millisecond))
+		} else {
+			err = fmt.Errorf("%sSetLinkLatency.Latency field doesn't exist", FAILURE_PREAMBLE)
+		}
+		// The reverse latency defaults to the same as the latency, and the
+		// jitter to whatever the link already has.
+		reverse := latency
+		if val, ok := fields["ReverseLatency"]; ok {
+			reverse = time.Duration(val.(float64) * float64(time.Millisecond))
+		}
+		jitter := time.Duration(-1)
+		if val, ok := fields["Jitter"]; ok {
+			jitter = time.Duration(val.(float64) * float64(time.Millisecond))
+		}
+		msg = SetLinkLatency{node, peer, latency, reverse, jitter}
+	case SimSetGroup:
+		group := ""
+		nodes := []string{}
+		fields := command.Event.(map[string]interface{})
+		if val, ok := fields["Group"]; ok {
+			group = val.(string)
+		} else {
+			err = fmt.Errorf("%sSetGroup.Group field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := fields["Nodes"]; ok {
+			for _, node := range val.([]interface{}) {
+				nodes = append(nodes, node.(string))
+			}
+		} else {
+			err = fmt.Errorf("%sSetGroup.Nodes field doesn't exist", FAILURE_PREAMBLE)
+		}
+		msg = SetGroup{group, nodes}
+	case SimDisconnectGroup, SimReconnectGroup, SimRestartGroup:
+		group := ""
+		if val, ok := command.Event.(map[string]interface{})["Group"]; ok {
+			group = val.(string)
+		} else {
+			err = fmt.Errorf("%sGroup field doesn't exist", FAILURE_PREAMBLE)
+		}
+		switch command.MsgID {
+		case SimDisconnectGroup:
+			msg = DisconnectGroup{group}
+		case SimReconnectGroup:
+			msg = ReconnectGroup{group}
+		default:
+			msg = RestartGroup{group}
+		}
+	case SimAddGroupLatency:
+		group := ""
+		latency := time.Duration(0)
+		fields := command.Event.(map[string]interface{})
+		if val, ok := fields["Group"]; ok {
+			group = val.(string)
+		} else {
+			err = fmt.Errorf("%sAddGroupLatency.Group field doesn't exist", FAILURE_PREAMBLE)
+		}
+		if val, ok := fields["Latency"]; ok {
+			latency = time.Duration(val.(float64) * float64(time.Millisecond))
+		} else {
+			err = fmt.Errorf("%sAddGroupLatency.Latency field doesn't exist", FAILURE_PREAMBLE)
+		}
+		msg = AddGroupLatency{group, latency}
 	default:
 		err = fmt.Errorf("%sUnknown Event ID=%v", FAILURE_PREAMBLE, command.MsgID)
 	}
@@ -390,3 +519,160 @@ func (c StopPings) Run(log *log.Logger, sim *Simulator) {
 func (c StopPings) String() string {
 	return "StopPings{}"
 }
+
+type StartMobility struct {
+	Config MobilityConfig
+}
+
+// Tag StartMobility as a Command
+func (c StartMobility) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	if err := sim.StartMobility(c.Config); err != nil {
+		log.Printf("Failed starting mobility: %s", err)
+	}
+}
+
+func (c StartMobility) String() string {
+	return fmt.Sprintf("StartMobility{Config:%+v}", c.Config)
+}
+
+type StopMobility struct{}
+
+// Tag StopMobility as a Command
+func (c StopMobility) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	sim.StopMobility()
+}
+
+func (c StopMobility) String() string {
+	return "StopMobility{}"
+}
+
+type SetClockSkew struct {
+	Node   string
+	Offset time.Duration
+	Rate   float64
+}
+
+// Tag SetClockSkew as a Command
+func (c SetClockSkew) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	if err := sim.SetClockSkew(c.Node, c.Offset, c.Rate); err != nil {
+		log.Printf("Failed setting clock skew on node %s: %s", c.Node, err)
+	}
+}
+
+func (c SetClockSkew) String() string {
+	return fmt.Sprintf("SetClockSkew{Node:%s, Offset:%s, Rate:%v}", c.Node, c.Offset, c.Rate)
+}
+
+type SetLinkLatency struct {
+	Node           string
+	Peer           string
+	Latency        time.Duration // from the node to the peer
+	ReverseLatency time.Duration // from the peer to the node
+	Jitter         time.Duration // negative to leave it unchanged
+}
+
+// Tag SetLinkLatency as a Command
+func (c SetLinkLatency) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	params, err := sim.LinkParams(c.Node, c.Peer)
+	if err != nil {
+		log.Printf("Failed setting latency between node %s and node %s: %s", c.Node, c.Peer, err)
+		return
+	}
+	params.Latency, params.ReverseLatency = c.Latency, c.ReverseLatency
+	if c.Jitter >= 0 {
+		params.Jitter = c.Jitter
+	}
+	if err := sim.SetLinkParams(c.Node, c.Peer, params); err != nil {
+		log.Printf("Failed setting latency between node %s and node %s: %s", c.Node, c.Peer, err)
+	}
+}
+
+func (c SetLinkLatency) String() string {
+	return fmt.Sprintf("SetLinkLatency{Node:%s, Peer:%s, Latency:%s, ReverseLatency:%s, Jitter:%s}", c.Node, c.Peer, c.Latency, c.ReverseLatency, c.Jitter)
+}
+
+type SetGroup struct {
+	Group string
+	Nodes []string
+}
+
+// Tag SetGroup as a Command
+func (c SetGroup) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	if err := sim.SetGroup(c.Group, c.Nodes); err != nil {
+		log.Printf("Failed setting group %s: %s", c.Group, err)
+	}
+}
+
+func (c SetGroup) String() string {
+	return fmt.Sprintf("SetGroup{Group:%s, Nodes:%v}", c.Group, c.Nodes)
+}
+
+type DisconnectGroup struct {
+	Group string
+}
+
+// Tag DisconnectGroup as a Command
+func (c DisconnectGroup) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	if err := sim.DisconnectGroup(c.Group); err != nil {
+		log.Printf("Failed disconnecting group %s: %s", c.Group, err)
+	}
+}
+
+func (c DisconnectGroup) String() string {
+	return fmt.Sprintf("DisconnectGroup{Group:%s}", c.Group)
+}
+
+type ReconnectGroup struct {
+	Group string
+}
+
+// Tag ReconnectGroup as a Command
+func (c ReconnectGroup) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	if err := sim.ReconnectGroup(c.Group); err != nil {
+		log.Printf("Failed reconnecting group %s: %s", c.Group, err)
+	}
+}
+
+func (c ReconnectGroup) String() string {
+	return fmt.Sprintf("ReconnectGroup{Group:%s}", c.Group)
+}
+
+type AddGroupLatency struct {
+	Group   string
+	Latency time.Duration // added to both directions, can be negative
+}
+
+// Tag AddGroupLatency as a Command
+func (c AddGroupLatency) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	if err := sim.AddGroupLatency(c.Group, c.Latency); err != nil {
+		log.Printf("Failed adding latency to group %s: %s", c.Group, err)
+	}
+}
+
+func (c AddGroupLatency) String() string {
+	return fmt.Sprintf("AddGroupLatency{Group:%s, Latency:%s}", c.Group, c.Latency)
+}
+
+type RestartGroup struct {
+	Group string
+}
+
+// Tag RestartGroup as a Command
+func (c RestartGroup) Run(log *log.Logger, sim *Simulator) {
+	log.Printf("Executing command %s", c)
+	if err := sim.RestartGroup(c.Group); err != nil {
+		log.Printf("Failed restarting group %s: %s", c.Group, err)
+	}
+}
+
+func (c RestartGroup) String() string {
+	return fmt.Sprintf("RestartGroup{Group:%s}", c.Group)
+}
@@ -107,6 +107,7 @@ type NetworkStatsUpdate struct {
 	TreeAverageStretch   float64
 	SnakePathConvergence uint64
 	SnakeAverageStretch  float64
+	Anomalies            ProtocolAnomalies
 }
 
 // Tag NetworkStatsUpdate as an Event
@@ -0,0 +1,369 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router"
+)
+
+// maxEventLog is how many events are kept for exporting before the oldest
+// are dropped.
+const maxEventLog = 65536
+
+// The files that make up an exported simulation, see Shutdown.
+const (
+	exportTopologyFile = "topology.json"
+	exportStatsFile    = "stats.json"
+	exportEventsFile   = "events.jsonl"
+)
+
+// ExportedTopology is everything needed to build the simulated network again:
+// the nodes with their keys, the links between them and their parameters,
+// and the groups.
+type ExportedTopology struct {
+	Exported time.Time      `json:"exported"`
+	Nodes    []ExportedNode `json:"nodes"`
+	Links    []APILink      `json:"links"`
+}
+
+// ExportedNode is a single node in an exported topology.
+type ExportedNode struct {
+	Name          string   `json:"name"`
+	Type          string   `json:"type"`
+	PrivateKey    string   `json:"private_key"`
+	ClockOffsetMS float64  `json:"clock_offset_ms"`
+	ClockRate     float64  `json:"clock_rate"`
+	Groups        []string `json:"groups,omitempty"`
+}
+
+// ExportedStats is the state that every node reported when the simulation
+// was exported, along with the network-wide stats.
+type ExportedStats struct {
+	Network APIStats            `json:"network"`
+	Nodes   []ExportedNodeStats `json:"nodes"`
+}
+
+// ExportedNodeStats is the final state of a single node.
+type ExportedNodeStats struct {
+	APINode
+	Tree       router.TreeStats             `json:"tree"`
+	Drops      map[router.DropReason]uint64 `json:"drops,omitempty"`
+	Neighbours []router.SnakeNeighbour      `json:"snake_neighbours"`
+}
+
+// LoggedEvent is an event that the simulator published, as written to the
+// event log. Events from a simulation that was loaded again are kept as they
+// were read, so that the log carries on from where it left off.
+type LoggedEvent struct {
+	Time  time.Time   `json:"time"`
+	Type  string      `json:"type"`
+	Event interface{} `json:"event"`
+}
+
+// _logEvent adds an event to the event log.
+func (s *StateAccessor) _logEvent(event SimEvent) {
+	if len(s._events) >= maxEventLog {
+		s._events = s._events[1:]
+	}
+	s._events = append(s._events, LoggedEvent{
+		Time:  time.Now(),
+		Type:  reflect.TypeOf(event).Name(),
+		Event: event,
+	})
+}
+
+// Shutdown stops the simulation in order: the event sequence, failure
+// campaign, mobility and pings are stopped first so that nothing changes
+// the topology while it is being exported, then the final topology, the
+// stats of every node and the event log are written to the given directory,
+// and finally all of the nodes are stopped. If the directory is empty then
+// nothing is exported. The simulation can be carried on later with Load.
+func (sim *Simulator) Shutdown(dir string) error {
+	sim.Pause()
+	sim.StopCampaign()
+	sim.StopMobility()
+	sim.StopPings()
+	sim.CheckInvariantsAfter(0)
+
+	var err error
+	if dir != "" {
+		if err = sim.export(dir); err == nil {
+			sim.log.Printf("Exported the simulation to %q\n", dir)
+		}
+	}
+
+	sim.wiresMutex.Lock()
+	for _, peers := range sim.wires {
+		for peer, conn := range peers {
+			if conn != nil {
+				_ = conn.Close()
+				peers[peer] = nil
+			}
+		}
+	}
+	sim.wiresMutex.Unlock()
+
+	sim.nodeRunnerChannelsMutex.Lock()
+	for node, quits := range sim.nodeRunnerChannels {
+		for _, quit := range quits {
+			quit <- true
+		}
+		delete(sim.nodeRunnerChannels, node)
+	}
+	sim.nodeRunnerChannelsMutex.Unlock()
+
+	sim.nodesMutex.Lock()
+	for name, node := range sim.nodes {
+		_ = node.Close()
+		if node.l != nil {
+			_ = node.l.Close()
+		}
+		delete(sim.nodes, name)
+	}
+	sim.nodesMutex.Unlock()
+	sim.log.Println("Stopped all nodes")
+	return err
+}
+
+// export writes the topology, stats and event log to the directory.
+func (sim *Simulator) export(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("os.MkdirAll: %w", err)
+	}
+
+	topology := ExportedTopology{Exported: time.Now()}
+	stats := ExportedStats{}
+	for _, node := range sim.apiNodeList() {
+		n := sim.Node(node.Name)
+		if n == nil {
+			continue
+		}
+		topology.Nodes = append(topology.Nodes, ExportedNode{
+			Name:          node.Name,
+			Type:          nodeTypeNames[n.Type],
+			PrivateKey:    hex.EncodeToString(n.privateKey),
+			ClockOffsetMS: node.ClockOffsetMS,
+			ClockRate:     node.ClockRate,
+			Groups:        node.Groups,
+		})
+		stats.Nodes = append(stats.Nodes, ExportedNodeStats{
+			APINode:    node,
+			Tree:       n.TreeStats(),
+			Drops:      n.DropCounts(),
+			Neighbours: n.SnakeNeighbours(),
+		})
+	}
+	links := sim.Links()
+	sort.Slice(links, func(i, j int) bool {
+		if links[i][0] != links[j][0] {
+			return links[i][0] < links[j][0]
+		}
+		return links[i][1] < links[j][1]
+	})
+	for _, pair := range links {
+		params, err := sim.LinkParams(pair[0], pair[1])
+		if err != nil {
+			continue
+		}
+		link := APILink{A: pair[0], B: pair[1]}
+		link.setParams(params)
+		topology.Links = append(topology.Links, link)
+	}
+	tree, snek := sim.CalculateStretch()
+	stats.Network = APIStats{
+		UptimeSeconds:       sim.Uptime().Seconds(),
+		Nodes:               len(topology.Nodes),
+		Links:               len(topology.Links),
+		TreeStretch:         tree,
+		SNEKStretch:         snek,
+		TreePathConvergence: sim.CalculateTreePathConvergence(),
+		SNEKPathConvergence: sim.CalculateSNEKPathConvergence(),
+		Anomalies:           sim.CalculateAnomalies(),
+	}
+
+	if err := writeJSON(filepath.Join(dir, exportTopologyFile), topology); err != nil {
+		return err
+	}
+	if err := writeJSON(filepath.Join(dir, exportStatsFile), stats); err != nil {
+		return err
+	}
+
+	var events []LoggedEvent
+	phony.Block(sim.State, func() {
+		events = append(events, sim.State._events...)
+	})
+	file, err := os.Create(filepath.Join(dir, exportEventsFile))
+	if err != nil {
+		return fmt.Errorf("os.Create: %w", err)
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return fmt.Errorf("encoder.Encode: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("writer.Flush: %w", err)
+	}
+	return file.Close()
+}
+
+// Load builds the network from a simulation that was exported by Shutdown,
+// with the same node keys, links, link parameters, clock skews and groups,
+// and carries on the event log from where it left off. The nodes mustn't
+// exist already.
+func (sim *Simulator) Load(dir string) error {
+	var topology ExportedTopology
+	if err := readJSON(filepath.Join(dir, exportTopologyFile), &topology); err != nil {
+		return err
+	}
+
+	if file, err := os.Open(filepath.Join(dir, exportEventsFile)); err == nil {
+		var events []LoggedEvent
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var event struct {
+				Time  time.Time       `json:"time"`
+				Type  string          `json:"type"`
+				Event json.RawMessage `json:"event"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				_ = file.Close()
+				return fmt.Errorf("json.Unmarshal: %w", err)
+			}
+			events = append(events, LoggedEvent{event.Time, event.Type, event.Event})
+		}
+		_ = file.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("scanner.Err: %w", err)
+		}
+		if len(events) > maxEventLog {
+			events = events[len(events)-maxEventLog:]
+		}
+		phony.Block(sim.State, func() {
+			sim.State._events = append(events, sim.State._events...)
+		})
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("os.Open: %w", err)
+	}
+
+	groups := map[string][]string{}
+	for _, node := range topology.Nodes {
+		nodeType := UnknownType
+		for t, name := range nodeTypeNames {
+			if name == node.Type {
+				nodeType = t
+			}
+		}
+		if nodeType == UnknownType {
+			return fmt.Errorf("node %q has unknown type %q", node.Name, node.Type)
+		}
+		sk, err := hex.DecodeString(node.PrivateKey)
+		if err != nil || len(sk) != ed25519.PrivateKeySize {
+			return fmt.Errorf("node %q has an invalid private key", node.Name)
+		}
+		if err := sim.CreateNodeWithKey(node.Name, nodeType, sk); err != nil {
+			return err
+		}
+		sim.StartNodeEventHandler(node.Name, nodeType)
+		if node.ClockOffsetMS != 0 || (node.ClockRate != 0 && node.ClockRate != 1) {
+			rate := node.ClockRate
+			if rate == 0 {
+				rate = 1
+			}
+			sim.Node(node.Name).SetClockSkew(time.Duration(node.ClockOffsetMS*float64(time.Millisecond)), rate)
+		}
+		for _, group := range node.Groups {
+			groups[group] = append(groups[group], node.Name)
+		}
+	}
+
+	for _, link := range topology.Links {
+		if err := sim.ConnectNodes(link.A, link.B); err != nil {
+			sim.log.Printf("Failed to connect %q and %q: %s\n", link.A, link.B, err)
+			continue
+		}
+		params := LinkParams{}
+		if link.LatencyMS != nil {
+			params.Latency = time.Duration(*link.LatencyMS * float64(time.Millisecond))
+		}
+		if link.ReverseLatencyMS != nil {
+			params.ReverseLatency = time.Duration(*link.ReverseLatencyMS * float64(time.Millisecond))
+		}
+		if link.JitterMS != nil {
+			params.Jitter = time.Duration(*link.JitterMS * float64(time.Millisecond))
+		}
+		if link.MTU != nil {
+			params.MTU = *link.MTU
+		}
+		if link.Fragment != nil {
+			params.Fragment = *link.Fragment
+		}
+		if link.Loss != nil {
+			params.Loss = *link.Loss
+		}
+		if err := sim.SetLinkParams(link.A, link.B, params); err != nil {
+			sim.log.Printf("Failed to set the parameters of %q and %q: %s\n", link.A, link.B, err)
+		}
+	}
+
+	for group, members := range groups {
+		if err := sim.SetGroup(group, members); err != nil {
+			return err
+		}
+	}
+
+	sim.CalculateShortestPaths()
+	sim.log.Printf("Loaded %d nodes and %d links from %q\n", len(topology.Nodes), len(topology.Links), dir)
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("json.MarshalIndent: %w", err)
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("ioutil.WriteFile: %w", err)
+	}
+	return nil
+}
+
+func readJSON(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ioutil.ReadFile: %w", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return nil
+}
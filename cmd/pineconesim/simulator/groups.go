@@ -0,0 +1,319 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// restartTimeout is how long RestartNode waits for the peerings of the old
+// node to be reported as down.
+const restartTimeout = time.Second * 5
+
+// savedLink is a link that was taken down by DisconnectGroup, so that it can
+// be brought back up again by ReconnectGroup.
+type savedLink struct {
+	a, b   string
+	params LinkParams
+}
+
+// nodeGroup is a set of nodes that can be acted on all at once, i.e. all of
+// the mobile nodes or all of the backbone nodes.
+type nodeGroup struct {
+	members      map[string]struct{}
+	disconnected []savedLink // links taken down by DisconnectGroup
+}
+
+// validGroupName returns an error if the name can't be used in the API path.
+func validGroupName(group string) error {
+	if group == "" || strings.ContainsAny(group, "/ ") {
+		return fmt.Errorf("group names must not be empty or contain slashes or spaces")
+	}
+	return nil
+}
+
+// SetGroup makes the given nodes the members of a group, creating the group
+// if it doesn't exist yet. A node can be in any number of groups. Setting a
+// group with no members removes it.
+func (sim *Simulator) SetGroup(group string, nodes []string) error {
+	if err := validGroupName(group); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if sim.Node(node) == nil {
+			return fmt.Errorf("node %q doesn't exist", node)
+		}
+	}
+	sim.groupsMutex.Lock()
+	defer sim.groupsMutex.Unlock()
+	if len(nodes) == 0 {
+		delete(sim.groups, group)
+		return nil
+	}
+	g, ok := sim.groups[group]
+	if !ok {
+		g = &nodeGroup{}
+		sim.groups[group] = g
+	}
+	g.members = make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		g.members[node] = struct{}{}
+	}
+	sim.log.Printf("Group %q now has %d nodes\n", group, len(nodes))
+	return nil
+}
+
+// Groups returns the members of every group, sorted by name.
+func (sim *Simulator) Groups() map[string][]string {
+	sim.groupsMutex.Lock()
+	defer sim.groupsMutex.Unlock()
+	groups := make(map[string][]string, len(sim.groups))
+	for name, g := range sim.groups {
+		groups[name] = g.sortedMembers()
+	}
+	return groups
+}
+
+// GroupMembers returns the members of a group, sorted by name.
+func (sim *Simulator) GroupMembers(group string) ([]string, error) {
+	sim.groupsMutex.Lock()
+	defer sim.groupsMutex.Unlock()
+	g, ok := sim.groups[group]
+	if !ok {
+		return nil, fmt.Errorf("group %q doesn't exist", group)
+	}
+	return g.sortedMembers(), nil
+}
+
+// NodeGroups returns the groups that a node is in, sorted by name.
+func (sim *Simulator) NodeGroups(node string) []string {
+	sim.groupsMutex.Lock()
+	defer sim.groupsMutex.Unlock()
+	groups := []string{}
+	for name, g := range sim.groups {
+		if _, ok := g.members[node]; ok {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func (g *nodeGroup) sortedMembers() []string {
+	members := make([]string, 0, len(g.members))
+	for node := range g.members {
+		members = append(members, node)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// removeFromGroups takes a node that is being removed out of every group.
+// Groups that are left empty are removed too.
+func (sim *Simulator) removeFromGroups(node string) {
+	sim.groupsMutex.Lock()
+	defer sim.groupsMutex.Unlock()
+	for name, g := range sim.groups {
+		delete(g.members, node)
+		if len(g.members) == 0 {
+			delete(sim.groups, name)
+		}
+	}
+}
+
+// groupLinks returns every link that has at least one end in the group,
+// with the parameters that it has now.
+func (sim *Simulator) groupLinks(members []string) []savedLink {
+	in := make(map[string]struct{}, len(members))
+	for _, node := range members {
+		in[node] = struct{}{}
+	}
+	var links []savedLink
+	for _, pair := range sim.Links() {
+		_, a := in[pair[0]]
+		_, b := in[pair[1]]
+		if !a && !b {
+			continue
+		}
+		params, err := sim.LinkParams(pair[0], pair[1])
+		if err != nil {
+			params = DefaultLinkParams
+		}
+		links = append(links, savedLink{pair[0], pair[1], params})
+	}
+	return links
+}
+
+// DisconnectGroup takes down every link that has at least one end in the
+// group, as if all of the nodes in it lost connectivity at once. The links
+// are remembered so that ReconnectGroup can bring them back.
+func (sim *Simulator) DisconnectGroup(group string) error {
+	members, err := sim.GroupMembers(group)
+	if err != nil {
+		return err
+	}
+	links := sim.groupLinks(members)
+	for _, link := range links {
+		if err := sim.DisconnectNodes(link.a, link.b); err != nil {
+			sim.log.Printf("Failed disconnecting node %q from node %q: %s\n", link.a, link.b, err)
+		}
+	}
+	sim.groupsMutex.Lock()
+	if g, ok := sim.groups[group]; ok {
+		g.disconnected = append(g.disconnected, links...)
+	}
+	sim.groupsMutex.Unlock()
+	sim.log.Printf("Disconnected group %q, taking down %d links\n", group, len(links))
+	return nil
+}
+
+// ReconnectGroup brings back the links that DisconnectGroup took down, with
+// the parameters that they had before. Links that are already up again, or
+// whose other end has since been removed, are skipped.
+func (sim *Simulator) ReconnectGroup(group string) error {
+	sim.groupsMutex.Lock()
+	g, ok := sim.groups[group]
+	var links []savedLink
+	if ok {
+		links, g.disconnected = g.disconnected, nil
+	}
+	sim.groupsMutex.Unlock()
+	if !ok {
+		return fmt.Errorf("group %q doesn't exist", group)
+	}
+	sim.restoreLinks(links)
+	sim.log.Printf("Reconnected group %q\n", group)
+	return nil
+}
+
+// restoreLinks connects the given links and sets their parameters again.
+func (sim *Simulator) restoreLinks(links []savedLink) {
+	for _, link := range links {
+		if err := sim.ConnectNodes(link.a, link.b); err != nil {
+			sim.log.Printf("Failed reconnecting node %q to node %q: %s\n", link.a, link.b, err)
+			continue
+		}
+		if err := sim.SetLinkParams(link.a, link.b, link.params); err != nil {
+			sim.log.Printf("Failed restoring the link between node %q and node %q: %s\n", link.a, link.b, err)
+		}
+	}
+}
+
+// AddGroupLatency adds the given delay, in both directions, to every link
+// that has at least one end in the group. Links between two members of the
+// group get it once, not twice. The delay can be negative to take latency
+// away again, although a link never goes below no latency at all.
+func (sim *Simulator) AddGroupLatency(group string, latency time.Duration) error {
+	members, err := sim.GroupMembers(group)
+	if err != nil {
+		return err
+	}
+	add := func(d time.Duration) time.Duration {
+		if d += latency; d < 0 {
+			return 0
+		}
+		return d
+	}
+	links := sim.groupLinks(members)
+	for _, link := range links {
+		link.params.Latency = add(link.params.Latency)
+		link.params.ReverseLatency = add(link.params.ReverseLatency)
+		if err := sim.SetLinkParams(link.a, link.b, link.params); err != nil {
+			sim.log.Printf("Failed setting latency between node %q and node %q: %s\n", link.a, link.b, err)
+		}
+	}
+	sim.log.Printf("Added %s of latency to %d links of group %q\n", latency, len(links), group)
+	return nil
+}
+
+// RestartGroup restarts every node in the group, see RestartNode.
+func (sim *Simulator) RestartGroup(group string) error {
+	members, err := sim.GroupMembers(group)
+	if err != nil {
+		return err
+	}
+	for _, node := range members {
+		if err := sim.RestartNode(node); err != nil {
+			sim.log.Printf("Failed restarting node %q: %s\n", node, err)
+		}
+	}
+	sim.log.Printf("Restarted group %q\n", group)
+	return nil
+}
+
+// RestartNode stops a node and starts it again with the same name, type and
+// private key, as if the process had been restarted, so that it comes back
+// with none of its routing state. Its links are connected again with the
+// same parameters and it stays in the same groups. Clock skew isn't kept.
+func (sim *Simulator) RestartNode(name string) error {
+	node := sim.Node(name)
+	if node == nil {
+		return fmt.Errorf("node %q doesn't exist", name)
+	}
+	links := sim.groupLinks([]string{name})
+	groups := sim.NodeGroups(name)
+
+	// The old peerings have to be gone from the state before the node comes
+	// back with the same key, otherwise the events that report them going
+	// down would take the new links down with them.
+	sim.DisconnectAllPeers(name)
+	sim.waitForPeeringsDown(name)
+	sim.RemoveNode(name)
+	if err := sim.createNode(name, node.Type, node.privateKey); err != nil {
+		return err
+	}
+	sim.StartNodeEventHandler(name, node.Type)
+	sim.restoreLinks(links)
+
+	sim.groupsMutex.Lock()
+	for _, group := range groups {
+		g, ok := sim.groups[group]
+		if !ok {
+			g = &nodeGroup{members: map[string]struct{}{}}
+			sim.groups[group] = g
+		}
+		g.members[name] = struct{}{}
+	}
+	sim.groupsMutex.Unlock()
+	return nil
+}
+
+// waitForPeeringsDown waits until no node, including the node itself, has a
+// peering with the node in the state, or until the restart timeout.
+func (sim *Simulator) waitForPeeringsDown(name string) {
+	deadline := time.Now().Add(restartTimeout)
+	for time.Now().Before(deadline) {
+		up := false
+		phony.Block(sim.State, func() {
+			for node, state := range sim.State._state.Nodes {
+				for _, peer := range state.Connections {
+					if node == name || peer == name {
+						up = true
+					}
+				}
+			}
+		})
+		if !up {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	sim.log.Printf("Timed out waiting for the peerings of node %q to go down\n", name)
+}
@@ -0,0 +1,792 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// APINode is the representation of a node in the HTTP API. The clock offset
+// is given in milliseconds.
+type APINode struct {
+	Name            string   `json:"name"`
+	PublicKey       string   `json:"public_key"`
+	Type            string   `json:"type"`
+	Coords          []uint64 `json:"coords"`
+	Root            string   `json:"root"`
+	Parent          string   `json:"parent"`
+	Peers           []string `json:"peers"`
+	SnakeAscending  string   `json:"snake_ascending"`
+	SnakeDescending string   `json:"snake_descending"`
+	ClockOffsetMS   float64  `json:"clock_offset_ms"`
+	ClockRate       float64  `json:"clock_rate"`
+	Groups          []string `json:"groups,omitempty"`
+}
+
+// APILink is the representation of a link in the HTTP API. Delays are given
+// in milliseconds. The latency is from A to B and the reverse latency from B
+// to A. When updating a link, a latency on its own sets the delay in both
+// directions.
+type APILink struct {
+	A                string     `json:"a"`
+	B                string     `json:"b"`
+	LatencyMS        *float64   `json:"latency_ms,omitempty"`
+	ReverseLatencyMS *float64   `json:"reverse_latency_ms,omitempty"`
+	JitterMS         *float64   `json:"jitter_ms,omitempty"`
+	MTU              *int       `json:"mtu,omitempty"`
+	Fragment         *bool      `json:"fragment,omitempty"`
+	Loss             *float64   `json:"loss,omitempty"`
+	Stats            *LinkStats `json:"stats,omitempty"`
+}
+
+// APIPing is the result of a ping in the HTTP API.
+type APIPing struct {
+	From  string  `json:"from"`
+	To    string  `json:"to"`
+	Via   string  `json:"via"`
+	Hops  uint16  `json:"hops"`
+	RTTMS float64 `json:"rtt_ms"`
+}
+
+// APIGroup is the representation of a node group in the HTTP API.
+type APIGroup struct {
+	Name  string   `json:"name"`
+	Nodes []string `json:"nodes"`
+}
+
+// APIStats is the representation of the simulation statistics in the HTTP
+// API.
+type APIStats struct {
+	UptimeSeconds       float64           `json:"uptime_seconds"`
+	Nodes               int               `json:"nodes"`
+	Links               int               `json:"links"`
+	TreeStretch         float64           `json:"tree_stretch"`
+	SNEKStretch         float64           `json:"snek_stretch"`
+	TreePathConvergence float64           `json:"tree_path_convergence"`
+	SNEKPathConvergence float64           `json:"snek_path_convergence"`
+	Anomalies           ProtocolAnomalies `json:"anomalies"`
+}
+
+var nodeTypeNames = map[APINodeType]string{
+	DefaultNode:          "default",
+	GeneralAdversaryNode: "adversary",
+}
+
+// APIHandler returns a handler for the JSON HTTP API, which allows external
+// tools such as test suites to build and inspect topologies. The endpoints
+// are documented in the simulator README. Requests that change the
+// simulation are refused unless the simulator accepts commands.
+func (sim *Simulator) APIHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes", sim.apiNodes)
+	mux.HandleFunc("/nodes/", sim.apiNode)
+	mux.HandleFunc("/links", sim.apiLinks)
+	mux.HandleFunc("/links/", sim.apiLink)
+	mux.HandleFunc("/ping/", sim.apiPing)
+	mux.HandleFunc("/stats", sim.apiStats)
+	mux.HandleFunc("/stretch", sim.apiStretch)
+	mux.HandleFunc("/invariants", sim.apiInvariants)
+	mux.HandleFunc("/snapshots", sim.apiSnapshots)
+	mux.HandleFunc("/snapshots/", sim.apiSnapshot)
+	mux.HandleFunc("/groups", sim.apiGroups)
+	mux.HandleFunc("/groups/", sim.apiGroup)
+	mux.HandleFunc("/campaign", sim.apiCampaign)
+	return mux
+}
+
+func apiRespond(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiRespond(w, status, map[string]string{"error": err.Error()})
+}
+
+// apiPath splits the part of the request path after the prefix into its
+// segments.
+func apiPath(r *http.Request, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
+// apiMutable returns false, after writing an error response, if the request
+// is trying to change a simulator that doesn't accept commands.
+func (sim *Simulator) apiMutable(w http.ResponseWriter) bool {
+	if !sim.AcceptCommands {
+		apiError(w, http.StatusForbidden, fmt.Errorf("simulator is not accepting commands"))
+		return false
+	}
+	return true
+}
+
+func (sim *Simulator) apiNodes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		apiRespond(w, http.StatusOK, sim.apiNodeList())
+
+	case http.MethodPost:
+		if !sim.apiMutable(w) {
+			return
+		}
+		var req struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("json.Decode: %w", err))
+			return
+		}
+		if req.Name == "" || strings.ContainsAny(req.Name, "/ ") {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("node names must not be empty or contain slashes or spaces"))
+			return
+		}
+		nodeType := DefaultNode
+		if req.Type != "" {
+			nodeType = UnknownType
+			for t, name := range nodeTypeNames {
+				if name == req.Type {
+					nodeType = t
+				}
+			}
+			if nodeType == UnknownType {
+				apiError(w, http.StatusBadRequest, fmt.Errorf("unknown node type %q", req.Type))
+				return
+			}
+		}
+		if sim.Node(req.Name) != nil {
+			apiError(w, http.StatusConflict, fmt.Errorf("node %q already exists", req.Name))
+			return
+		}
+		if err := sim.CreateNode(req.Name, nodeType); err != nil {
+			apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		sim.StartNodeEventHandler(req.Name, nodeType)
+		node, _ := sim.apiNodeInfo(req.Name)
+		apiRespond(w, http.StatusCreated, node)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (sim *Simulator) apiNode(w http.ResponseWriter, r *http.Request) {
+	path := apiPath(r, "/nodes/")
+	if len(path) != 1 && (len(path) != 2 || path[1] != "neighbours") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := path[0]
+	if sim.Node(name) == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("node %q doesn't exist", name))
+		return
+	}
+	if len(path) == 2 {
+		sim.apiNodeNeighbours(w, r, name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		node, ok := sim.apiNodeInfo(name)
+		if !ok {
+			apiError(w, http.StatusNotFound, fmt.Errorf("node %q doesn't exist", name))
+			return
+		}
+		apiRespond(w, http.StatusOK, node)
+
+	case http.MethodPut:
+		if !sim.apiMutable(w) {
+			return
+		}
+		var req struct {
+			ClockOffsetMS *float64 `json:"clock_offset_ms"`
+			ClockRate     *float64 `json:"clock_rate"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("json.Decode: %w", err))
+			return
+		}
+		offset, rate := sim.Node(name).ClockSkew()
+		if req.ClockOffsetMS != nil {
+			offset = time.Duration(*req.ClockOffsetMS * float64(time.Millisecond))
+		}
+		if req.ClockRate != nil {
+			rate = *req.ClockRate
+		}
+		if err := sim.SetClockSkew(name, offset, rate); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		node, _ := sim.apiNodeInfo(name)
+		apiRespond(w, http.StatusOK, node)
+
+	case http.MethodDelete:
+		if !sim.apiMutable(w) {
+			return
+		}
+		sim.RemoveNode(name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// apiNodeNeighbours returns the snake neighbour table of a node, exactly as
+// the router reports it, so that it can be compared with the neighbour
+// tables of real nodes.
+func (sim *Simulator) apiNodeNeighbours(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	node := sim.Node(name)
+	if node == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("node %q doesn't exist", name))
+		return
+	}
+	apiRespond(w, http.StatusOK, node.SnakeNeighbours())
+}
+
+// apiNodeList returns every node in the simulation, sorted by name.
+func (sim *Simulator) apiNodeList() []APINode {
+	var nodes []APINode
+	phony.Block(sim.State, func() {
+		names := make([]string, 0, len(sim.State._state.Nodes))
+		for name := range sim.State._state.Nodes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		nodes = make([]APINode, 0, len(names))
+		for _, name := range names {
+			nodes = append(nodes, sim.State._apiNode(name))
+		}
+	})
+	for i := range nodes {
+		sim.apiNodeClock(&nodes[i])
+		nodes[i].Groups = sim.NodeGroups(nodes[i].Name)
+	}
+	return nodes
+}
+
+func (sim *Simulator) apiNodeInfo(name string) (APINode, bool) {
+	var node APINode
+	var ok bool
+	phony.Block(sim.State, func() {
+		if _, ok = sim.State._state.Nodes[name]; ok {
+			node = sim.State._apiNode(name)
+		}
+	})
+	if ok {
+		sim.apiNodeClock(&node)
+		node.Groups = sim.NodeGroups(name)
+	}
+	return node, ok
+}
+
+// apiNodeClock fills in the clock skew of a node from its router.
+func (sim *Simulator) apiNodeClock(node *APINode) {
+	node.ClockRate = 1
+	if n := sim.Node(node.Name); n != nil {
+		offset, rate := n.ClockSkew()
+		node.ClockOffsetMS = float64(offset) / float64(time.Millisecond)
+		node.ClockRate = rate
+	}
+}
+
+// _apiNode builds the API representation of a node, replacing public keys
+// with node names where possible. The node must exist.
+func (s *StateAccessor) _apiNode(name string) APINode {
+	names := make(map[string]string, len(s._state.Nodes))
+	for n, state := range s._state.Nodes {
+		names[state.PeerID] = n
+	}
+	nameOf := func(peerID string) string {
+		if n, ok := names[peerID]; ok {
+			return n
+		}
+		return peerID
+	}
+	state := s._state.Nodes[name]
+	node := APINode{
+		Name:            name,
+		PublicKey:       state.PeerID,
+		Type:            nodeTypeNames[state.NodeType],
+		Coords:          append([]uint64{}, state.Coords...),
+		Root:            nameOf(state.Announcement.Root),
+		Parent:          nameOf(state.Parent),
+		Peers:           []string{},
+		SnakeAscending:  nameOf(state.AscendingPeer),
+		SnakeDescending: nameOf(state.DescendingPeer),
+	}
+	for _, peerID := range state.Connections {
+		node.Peers = append(node.Peers, nameOf(peerID))
+	}
+	sort.Strings(node.Peers)
+	return node
+}
+
+func (sim *Simulator) apiLinks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		links := []APILink{}
+		for _, pair := range sim.Links() {
+			link := APILink{A: pair[0], B: pair[1]}
+			if params, err := sim.LinkParams(pair[0], pair[1]); err == nil {
+				link.setParams(params)
+			}
+			links = append(links, link)
+		}
+		sort.Slice(links, func(i, j int) bool {
+			if links[i].A != links[j].A {
+				return links[i].A < links[j].A
+			}
+			return links[i].B < links[j].B
+		})
+		apiRespond(w, http.StatusOK, links)
+
+	case http.MethodPost:
+		if !sim.apiMutable(w) {
+			return
+		}
+		var link APILink
+		if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("json.Decode: %w", err))
+			return
+		}
+		if err := sim.ConnectNodes(link.A, link.B); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		sim.apiUpdateLink(w, link.A, link.B, link, http.StatusCreated)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (sim *Simulator) apiLink(w http.ResponseWriter, r *http.Request) {
+	path := apiPath(r, "/links/")
+	if len(path) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	a, b := path[0], path[1]
+
+	switch r.Method {
+	case http.MethodGet:
+		params, err := sim.LinkParams(a, b)
+		if err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		link := APILink{A: a, B: b}
+		link.setParams(params)
+		if stats, err := sim.LinkStats(a, b); err == nil {
+			link.Stats = &stats
+		}
+		apiRespond(w, http.StatusOK, link)
+
+	case http.MethodPut:
+		if !sim.apiMutable(w) {
+			return
+		}
+		var link APILink
+		if err := json.NewDecoder(r.Body).Decode(&link); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("json.Decode: %w", err))
+			return
+		}
+		sim.apiUpdateLink(w, a, b, link, http.StatusOK)
+
+	case http.MethodDelete:
+		if !sim.apiMutable(w) {
+			return
+		}
+		if err := sim.DisconnectNodes(a, b); err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// apiUpdateLink applies any parameters given in the request to the link,
+// leaving the others alone, and then responds with the new parameters.
+func (sim *Simulator) apiUpdateLink(w http.ResponseWriter, a, b string, req APILink, status int) {
+	params, err := sim.LinkParams(a, b)
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	if req.LatencyMS != nil {
+		params.Latency = time.Duration(*req.LatencyMS * float64(time.Millisecond))
+		params.ReverseLatency = params.Latency
+	}
+	if req.ReverseLatencyMS != nil {
+		params.ReverseLatency = time.Duration(*req.ReverseLatencyMS * float64(time.Millisecond))
+	}
+	if req.JitterMS != nil {
+		params.Jitter = time.Duration(*req.JitterMS * float64(time.Millisecond))
+	}
+	if req.MTU != nil {
+		params.MTU = *req.MTU
+	}
+	if req.Fragment != nil {
+		params.Fragment = *req.Fragment
+	}
+	if req.Loss != nil {
+		params.Loss = *req.Loss
+	}
+	if err := sim.SetLinkParams(a, b, params); err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	link := APILink{A: a, B: b}
+	link.setParams(params)
+	apiRespond(w, status, link)
+}
+
+func (l *APILink) setParams(params LinkParams) {
+	latency := float64(params.Latency) / float64(time.Millisecond)
+	reverse := float64(params.ReverseLatency) / float64(time.Millisecond)
+	jitter := float64(params.Jitter) / float64(time.Millisecond)
+	l.LatencyMS, l.ReverseLatencyMS, l.JitterMS = &latency, &reverse, &jitter
+	l.MTU, l.Fragment, l.Loss = &params.MTU, &params.Fragment, &params.Loss
+}
+
+func (sim *Simulator) apiPing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	path := apiPath(r, "/ping/")
+	if len(path) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	from, to := path[0], path[1]
+	if sim.Node(from) == nil || sim.Node(to) == nil {
+		apiError(w, http.StatusNotFound, fmt.Errorf("one or both of the nodes don't exist"))
+		return
+	}
+	result := APIPing{From: from, To: to, Via: r.URL.Query().Get("via")}
+	var rtt time.Duration
+	var err error
+	switch result.Via {
+	case "snek", "":
+		result.Via = "snek"
+		result.Hops, rtt, err = sim.PingSNEK(from, to)
+	case "tree":
+		result.Hops, rtt, err = sim.PingTree(from, to)
+	default:
+		apiError(w, http.StatusBadRequest, fmt.Errorf("via must be \"snek\" or \"tree\""))
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusGatewayTimeout, err)
+		return
+	}
+	result.RTTMS = float64(rtt) / float64(time.Millisecond)
+	apiRespond(w, http.StatusOK, result)
+}
+
+func (sim *Simulator) apiStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	tree, snek := sim.CalculateStretch()
+	apiRespond(w, http.StatusOK, APIStats{
+		UptimeSeconds:       sim.Uptime().Seconds(),
+		Nodes:               len(sim.apiNodeList()),
+		Links:               len(sim.Links()),
+		TreeStretch:         tree,
+		SNEKStretch:         snek,
+		TreePathConvergence: sim.CalculateTreePathConvergence(),
+		SNEKPathConvergence: sim.CalculateSNEKPathConvergence(),
+		Anomalies:           sim.CalculateAnomalies(),
+	})
+}
+
+// apiStretch returns the stretch matrix as JSON, or as a CSV file to
+// download if the request has ?format=csv.
+func (sim *Simulator) apiStretch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	pairs := sim.StretchMatrix()
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		apiRespond(w, http.StatusOK, pairs)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="stretch.csv"`)
+		if err := WriteStretchCSV(w, pairs); err != nil {
+			sim.log.Println("Failed to write stretch CSV:", err)
+		}
+	default:
+		apiError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q", r.URL.Query().Get("format")))
+	}
+}
+
+func (sim *Simulator) apiInvariants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	violations := []InvariantViolation{}
+	phony.Block(sim.State, func() {
+		violations = append(violations, CheckInvariants(sim.State._state)...)
+	})
+	apiRespond(w, http.StatusOK, violations)
+}
+
+// Snapshots don't change the simulation, so they can be taken and compared
+// even if the simulator isn't accepting commands.
+func (sim *Simulator) apiSnapshots(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		apiRespond(w, http.StatusOK, sim.Snapshots())
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				apiError(w, http.StatusBadRequest, fmt.Errorf("json.Decode: %w", err))
+				return
+			}
+		}
+		if strings.ContainsAny(req.Name, "/ ") {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("snapshot names must not contain slashes or spaces"))
+			return
+		}
+		apiRespond(w, http.StatusCreated, sim.TakeSnapshot(req.Name))
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (sim *Simulator) apiSnapshot(w http.ResponseWriter, r *http.Request) {
+	path := apiPath(r, "/snapshots/")
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+		snapshot, ok := sim.Snapshot(path[0])
+		if !ok {
+			apiError(w, http.StatusNotFound, fmt.Errorf("snapshot %q doesn't exist", path[0]))
+			return
+		}
+		apiRespond(w, http.StatusOK, snapshot)
+
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		if !sim.DeleteSnapshot(path[0]) {
+			apiError(w, http.StatusNotFound, fmt.Errorf("snapshot %q doesn't exist", path[0]))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(path) == 2 && r.Method == http.MethodGet:
+		diff, err := sim.DiffSnapshots(path[0], path[1])
+		if err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		apiRespond(w, http.StatusOK, diff)
+
+	case len(path) == 1 || len(path) == 2:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (sim *Simulator) apiGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	groups := sim.Groups()
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]APIGroup, 0, len(names))
+	for _, name := range names {
+		res = append(res, APIGroup{Name: name, Nodes: groups[name]})
+	}
+	apiRespond(w, http.StatusOK, res)
+}
+
+// apiGroup handles a single group, along with the bulk operations on it
+// which are given as a further path segment, i.e. /groups/mobile/restart.
+func (sim *Simulator) apiGroup(w http.ResponseWriter, r *http.Request) {
+	path := apiPath(r, "/groups/")
+	if len(path) != 1 && len(path) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	group := path[0]
+	if r.Method != http.MethodGet && !sim.apiMutable(w) {
+		return
+	}
+
+	var err error
+	switch {
+	case len(path) == 1 && r.Method == http.MethodGet:
+	case len(path) == 1 && r.Method == http.MethodPut:
+		var req struct {
+			Nodes []string `json:"nodes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			apiError(w, http.StatusBadRequest, fmt.Errorf("json.Decode: %w", err))
+			return
+		}
+		if err := sim.SetGroup(group, req.Nodes); err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(req.Nodes) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		if _, err := sim.GroupMembers(group); err != nil {
+			apiError(w, http.StatusNotFound, err)
+			return
+		}
+		_ = sim.SetGroup(group, nil)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case len(path) == 2 && r.Method == http.MethodPost:
+		switch path[1] {
+		case "disconnect":
+			err = sim.DisconnectGroup(group)
+		case "reconnect":
+			err = sim.ReconnectGroup(group)
+		case "restart":
+			err = sim.RestartGroup(group)
+		case "latency":
+			var req struct {
+				LatencyMS float64 `json:"latency_ms"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				apiError(w, http.StatusBadRequest, fmt.Errorf("json.Decode: %w", err))
+				return
+			}
+			err = sim.AddGroupLatency(group, time.Duration(req.LatencyMS*float64(time.Millisecond)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	nodes, err := sim.GroupMembers(group)
+	if err != nil {
+		apiError(w, http.StatusNotFound, err)
+		return
+	}
+	apiRespond(w, http.StatusOK, APIGroup{Name: group, Nodes: nodes})
+}
+
+func (sim *Simulator) apiCampaign(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		report, ok := sim.Campaign()
+		if !ok {
+			apiError(w, http.StatusNotFound, fmt.Errorf("no campaign has been started"))
+			return
+		}
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			apiRespond(w, http.StatusOK, report)
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="campaign.csv"`)
+			if err := WriteCampaignCSV(w, report.Results); err != nil {
+				sim.log.Println("Failed to write campaign CSV:", err)
+			}
+		default:
+			apiError(w, http.StatusBadRequest, fmt.Errorf("unknown format %q", r.URL.Query().Get("format")))
+		}
+
+	case http.MethodPost:
+		if !sim.apiMutable(w) {
+			return
+		}
+		var req struct {
+			Pairs    bool    `json:"pairs"`
+			SettleMS float64 `json:"settle_ms"`
+			Probes   int     `json:"probes"`
+			Limit    int     `json:"limit"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				apiError(w, http.StatusBadRequest, fmt.Errorf("json.Decode: %w", err))
+				return
+			}
+		}
+		if err := sim.StartCampaign(CampaignConfig{
+			Pairs:  req.Pairs,
+			Settle: time.Duration(req.SettleMS * float64(time.Millisecond)),
+			Probes: req.Probes,
+			Limit:  req.Limit,
+		}); err == errCampaignRunning {
+			apiError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			apiError(w, http.StatusBadRequest, err)
+			return
+		}
+		report, _ := sim.Campaign()
+		apiRespond(w, http.StatusAccepted, report)
+
+	case http.MethodDelete:
+		if !sim.apiMutable(w) {
+			return
+		}
+		sim.StopCampaign()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
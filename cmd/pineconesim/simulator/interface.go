@@ -16,9 +16,10 @@ package simulator
 
 import (
 	"strings"
+	"time"
 )
 
-func (sim *Simulator) ReportDistance(a, b string, l int64, snek bool) {
+func (sim *Simulator) ReportDistance(a, b string, l int64, rtt time.Duration, snek bool) {
 	if strings.Compare(a, b) > 0 {
 		a, b = b, a
 	}
@@ -32,8 +33,10 @@ func (sim *Simulator) ReportDistance(a, b string, l int64, snek bool) {
 	}
 	if snek {
 		sim.dists[a][b].ObservedSNEK = l
+		sim.dists[a][b].SNEKRTT = rtt
 	} else {
 		sim.dists[a][b].ObservedTree = l
+		sim.dists[a][b].TreeRTT = rtt
 	}
 	if sim.dists[a][b].Real == 0 {
 		na, _ := sim.graph.GetMapping(a)
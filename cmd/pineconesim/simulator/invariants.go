@@ -0,0 +1,381 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// InvariantViolation describes a way in which the simulated network doesn't
+// look like a converged Pinecone network should, as the difference between
+// what was expected of a node and what the node reported.
+type InvariantViolation struct {
+	Invariant string `json:"invariant"`
+	Node      string `json:"node"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+}
+
+func (v InvariantViolation) String() string {
+	return fmt.Sprintf("%s on %s:\n- %s\n+ %s", v.Invariant, v.Node, v.Expected, v.Actual)
+}
+
+type InvariantsViolated struct {
+	Violations []InvariantViolation
+}
+
+// Tag InvariantsViolated as an Event
+func (e InvariantsViolated) isEvent() {}
+
+// CheckInvariants checks the state reported by all of the nodes against the
+// invariants that should hold once the network has converged. Each group of
+// nodes that are connected to each other is checked on its own:
+//   - every node follows the node with the highest key as the root
+//   - the coordinates of every node are those of its parent followed by the
+//     port that the parent has it on, and following parents reaches the root
+//   - the descending node of every node is the node with the next lower key,
+//     and the ascending node, where known, is the one with the next higher key
+//   - following the snake entries for a path back towards the node that set
+//     it up never visits the same node twice
+func CheckInvariants(state *State) []InvariantViolation {
+	var violations []InvariantViolation
+	for _, component := range components(state) {
+		violations = append(violations, checkTree(state, component)...)
+		violations = append(violations, checkKeyspace(state, component)...)
+		violations = append(violations, checkSnakeLoops(state, component)...)
+	}
+	return violations
+}
+
+// components splits the nodes up into groups that are connected to each
+// other, with the nodes in each group sorted by key.
+func components(state *State) [][]string {
+	links := map[string]map[string]struct{}{}
+	for name, node := range state.Nodes {
+		if links[name] == nil {
+			links[name] = map[string]struct{}{}
+		}
+		for _, peer := range node.Connections {
+			if _, ok := state.Nodes[peer]; !ok {
+				continue
+			}
+			if links[peer] == nil {
+				links[peer] = map[string]struct{}{}
+			}
+			links[name][peer] = struct{}{}
+			links[peer][name] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(state.Nodes))
+	for name := range state.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result [][]string
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		component, pending := []string{}, []string{name}
+		for len(pending) > 0 {
+			next := pending[0]
+			pending = pending[1:]
+			component = append(component, next)
+			for peer := range links[next] {
+				if !seen[peer] {
+					seen[peer] = true
+					pending = append(pending, peer)
+				}
+			}
+		}
+		sort.Slice(component, func(i, j int) bool {
+			return state.Nodes[component[i]].PeerID < state.Nodes[component[j]].PeerID
+		})
+		result = append(result, component)
+	}
+	return result
+}
+
+func checkTree(state *State, component []string) []InvariantViolation {
+	var violations []InvariantViolation
+	root := component[len(component)-1]
+	for _, name := range sortedNames(component) {
+		node := state.Nodes[name]
+		if node.Announcement.Root != root {
+			violations = append(violations, InvariantViolation{
+				Invariant: "root",
+				Node:      name,
+				Expected:  root,
+				Actual:    node.Announcement.Root,
+			})
+		}
+
+		expected, ok := expectedCoords(state, name, root)
+		switch {
+		case !ok:
+			want := "parents leading to " + root
+			if name == root {
+				want = "no parent"
+			}
+			violations = append(violations, InvariantViolation{
+				Invariant: "parent",
+				Node:      name,
+				Expected:  want,
+				Actual:    "parents " + strings.Join(parentChain(state, name), " -> "),
+			})
+		case fmt.Sprint(expected) != fmt.Sprint(node.Coords):
+			violations = append(violations, InvariantViolation{
+				Invariant: "coords",
+				Node:      name,
+				Expected:  fmt.Sprint(expected),
+				Actual:    fmt.Sprint(node.Coords),
+			})
+		}
+	}
+	return violations
+}
+
+// expectedCoords works out what the coordinates of the node should be from
+// the coordinates of its parent and the port that the parent has it on.
+// Returns false if the node's parents don't lead to the root.
+func expectedCoords(state *State, name, root string) ([]uint64, bool) {
+	node := state.Nodes[name]
+	if name == root {
+		return []uint64{}, node.Parent == ""
+	}
+	chain := parentChain(state, name)
+	if chain[len(chain)-1] != root {
+		return nil, false
+	}
+	parent := state.Nodes[node.Parent]
+	var ports []int
+	for port, peer := range parent.Connections {
+		if peer == name {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) == 0 {
+		return nil, false
+	}
+	// If there is more than one link to the parent then the node could have
+	// heard the parent's announcement over any of them.
+	sort.Ints(ports)
+	port := uint64(ports[0])
+	if len(node.Coords) > 0 {
+		for _, p := range ports {
+			if uint64(p) == node.Coords[len(node.Coords)-1] {
+				port = uint64(p)
+			}
+		}
+	}
+	return append(append([]uint64{}, parent.Coords...), port), true
+}
+
+// parentChain follows the parents of the node until it gets to a node with
+// no parent, or to one that it has already visited.
+func parentChain(state *State, name string) []string {
+	chain := []string{name}
+	visited := map[string]bool{name: true}
+	for {
+		node, ok := state.Nodes[name]
+		if !ok || node.Parent == "" {
+			return chain
+		}
+		name = node.Parent
+		chain = append(chain, name)
+		if visited[name] {
+			return chain
+		}
+		visited[name] = true
+	}
+}
+
+func checkKeyspace(state *State, component []string) []InvariantViolation {
+	var violations []InvariantViolation
+	for i, name := range component {
+		node := state.Nodes[name]
+		desc := ""
+		if i > 0 {
+			desc = component[i-1]
+		}
+		if node.DescendingPeer != desc {
+			violations = append(violations, InvariantViolation{
+				Invariant: "descending",
+				Node:      name,
+				Expected:  desc,
+				Actual:    node.DescendingPeer,
+			})
+		}
+		asc := ""
+		if i < len(component)-1 {
+			asc = component[i+1]
+		}
+		if node.AscendingPeer != "" && node.AscendingPeer != asc {
+			violations = append(violations, InvariantViolation{
+				Invariant: "ascending",
+				Node:      name,
+				Expected:  asc,
+				Actual:    node.AscendingPeer,
+			})
+		}
+	}
+	return violations
+}
+
+func checkSnakeLoops(state *State, component []string) []InvariantViolation {
+	var violations []InvariantViolation
+	reported := map[string]bool{}
+	for _, name := range sortedNames(component) {
+		for _, origin := range sortedKeys(state.Nodes[name].SnakeEntries) {
+			if reported[origin] {
+				continue
+			}
+			path := []string{name}
+			visited := map[string]bool{name: true}
+			for current := name; current != origin; {
+				node, ok := state.Nodes[current]
+				if !ok {
+					break
+				}
+				next := node.SnakeEntries[origin]
+				if next == "" {
+					break // the path hasn't been set up all of the way
+				}
+				path = append(path, next)
+				if visited[next] {
+					reported[origin] = true
+					violations = append(violations, InvariantViolation{
+						Invariant: "snake loop",
+						Node:      name,
+						Expected:  "path towards " + origin,
+						Actual:    strings.Join(path, " -> "),
+					})
+					break
+				}
+				visited[next] = true
+				current = next
+			}
+		}
+	}
+	return violations
+}
+
+func sortedNames(names []string) []string {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// invariantChecker checks the invariants once the state has stopped changing
+// for the settle time, since the network won't have converged while events
+// are still arriving. After a violation, no more checks are made until the
+// simulation is played again.
+type invariantChecker struct {
+	settle time.Duration
+	timer  *time.Timer
+	halted bool
+	halt   func([]InvariantViolation)
+}
+
+// _touch is called for every event, and puts off the next check unless the
+// event doesn't change the state.
+func (s *StateAccessor) _touch(event SimEvent) {
+	c := s._invariants
+	if c == nil || c.halted {
+		return
+	}
+	switch event.(type) {
+	case PingStateUpdate, NetworkStatsUpdate, BandwidthReport, InvariantsViolated:
+		return // these don't change the state that the invariants are about
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.settle, func() {
+			s.Act(nil, s._checkInvariants)
+		})
+		return
+	}
+	c.timer.Reset(c.settle)
+}
+
+func (s *StateAccessor) _checkInvariants() {
+	c := s._invariants
+	if c == nil || c.halted {
+		return
+	}
+	violations := CheckInvariants(s._state)
+	if len(violations) == 0 {
+		return
+	}
+	c.halted = true
+	s._publish(InvariantsViolated{Violations: violations})
+	c.halt(violations)
+}
+
+// CheckInvariantsAfter makes the simulator check the invariants described in
+// CheckInvariants every time that the network has been quiet for the settle
+// time after an event. When an invariant is violated, the differences are
+// logged and the simulation is paused, so that the state can be looked at
+// before it moves on. Playing the simulation again resumes the checks. A
+// settle time of 0 stops checking.
+func (sim *Simulator) CheckInvariantsAfter(settle time.Duration) {
+	phony.Block(sim.State, func() {
+		if c := sim.State._invariants; c != nil && c.timer != nil {
+			c.timer.Stop()
+		}
+		sim.State._invariants = nil
+		if settle <= 0 {
+			return
+		}
+		sim.State._invariants = &invariantChecker{
+			settle: settle,
+			halt: func(violations []InvariantViolation) {
+				diffs := make([]string, 0, len(violations))
+				for _, v := range violations {
+					diffs = append(diffs, v.String())
+				}
+				sim.log.Printf("%d invariants violated, pausing the simulation:\n%s\n", len(violations), strings.Join(diffs, "\n"))
+				sim.Pause()
+			},
+		}
+		sim.State._touch(nil)
+	})
+}
+
+// resumeInvariants starts checking the invariants again after a violation.
+func (sim *Simulator) resumeInvariants() {
+	sim.State.Act(nil, func() {
+		if c := sim.State._invariants; c != nil && c.halted {
+			c.halted = false
+			sim.State._touch(nil)
+		}
+	})
+}
@@ -16,13 +16,194 @@ package simulator
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
 	"time"
 
 	"github.com/matrix-org/pinecone/router"
-	"github.com/matrix-org/pinecone/util"
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
 )
 
+// DefaultLinkParams are the parameters given to new links.
+var DefaultLinkParams = LinkParams{
+	Jitter: 5 * time.Millisecond,
+}
+
+// LinkParams describes the characteristics of a simulated link between nodes
+// a and b, in the order that they were given to SetLinkParams. Latency delays
+// the traffic from a to b and ReverseLatency the traffic from b to a, so that
+// links can be asymmetric, and jitter is added in both directions. The MTU and
+// loss are applied
+// to every frame written in either direction: frames larger than the MTU are
+// either dropped or split into MTU-sized fragments, and each frame, or each
+// fragment of a fragmented frame, is then lost with the given probability. A
+// fragmented frame only arrives if all of its fragments do.
+type LinkParams struct {
+	Latency        time.Duration // fixed delay from a to b
+	ReverseLatency time.Duration // fixed delay from b to a
+	Jitter         time.Duration // random extra delay of up to this much
+	MTU            int           // largest frame that fits in a packet, 0 for no limit
+	Fragment       bool          // fragment frames larger than the MTU instead of dropping them
+	Loss           float64       // probability that a packet is lost, from 0 to 1
+}
+
+// LinkStats counts what happened to the frames written to a link, in both
+// directions, since it was connected.
+type LinkStats struct {
+	Frames     uint64 `json:"frames"`     // frames written to the link
+	Fragmented uint64 `json:"fragmented"` // frames that were split into fragments
+	Oversized  uint64 `json:"oversized"`  // frames dropped because they exceeded the MTU
+	Lost       uint64 `json:"lost"`       // frames lost, including those that lost a fragment
+}
+
+// linkShape holds the parameters of a link. It is shared by both ends of the
+// link so that the parameters can be changed while the link is up. The
+// latencies are in the direction that the link was connected in.
+type linkShape struct {
+	latency    atomic.Int64
+	reverse    atomic.Int64
+	jitter     atomic.Int64
+	mtu        atomic.Int64
+	fragment   atomic.Bool
+	loss       atomic.Float64
+	frames     atomic.Uint64
+	fragmented atomic.Uint64
+	oversized  atomic.Uint64
+	lost       atomic.Uint64
+}
+
+func newLinkShape(params LinkParams) *linkShape {
+	shape := &linkShape{}
+	shape.set(params)
+	return shape
+}
+
+func (s *linkShape) set(params LinkParams) {
+	s.latency.Store(int64(params.Latency))
+	s.reverse.Store(int64(params.ReverseLatency))
+	s.jitter.Store(int64(params.Jitter))
+	s.mtu.Store(int64(params.MTU))
+	s.fragment.Store(params.Fragment)
+	s.loss.Store(params.Loss)
+}
+
+func (s *linkShape) get() LinkParams {
+	return LinkParams{
+		Latency:        time.Duration(s.latency.Load()),
+		ReverseLatency: time.Duration(s.reverse.Load()),
+		Jitter:         time.Duration(s.jitter.Load()),
+		MTU:            int(s.mtu.Load()),
+		Fragment:       s.fragment.Load(),
+		Loss:           s.loss.Load(),
+	}
+}
+
+func (s *linkShape) stats() LinkStats {
+	return LinkStats{
+		Frames:     s.frames.Load(),
+		Fragmented: s.fragmented.Load(),
+		Oversized:  s.oversized.Load(),
+		Lost:       s.lost.Load(),
+	}
+}
+
+// delay returns how long traffic in the given direction should be held up
+// for, including the jitter.
+func (s *linkShape) delay(reverse bool) time.Duration {
+	duration := time.Duration(s.latency.Load())
+	if reverse {
+		duration = time.Duration(s.reverse.Load())
+	}
+	if j := s.jitter.Load(); j > 0 {
+		duration += time.Duration(rand.Int63n(j))
+	}
+	return duration
+}
+
+// deliver decides whether a frame of the given length makes it across the
+// link, updating the link stats.
+func (s *linkShape) deliver(length int) bool {
+	s.frames.Inc()
+	packets := 1
+	if mtu := int(s.mtu.Load()); mtu > 0 && length > mtu {
+		if !s.fragment.Load() {
+			s.oversized.Inc()
+			return false
+		}
+		packets = (length + mtu - 1) / mtu
+		s.fragmented.Inc()
+	}
+	if loss := s.loss.Load(); loss > 0 {
+		// The frame only arrives if every packet does.
+		if rand.Float64() >= math.Pow(1-loss, float64(packets)) {
+			s.lost.Inc()
+			return false
+		}
+	}
+	return true
+}
+
+// linkConn delays reads according to the link parameters. If only one end of
+// the link is wrapped, as with TCP sockets, then writes are delayed as well so
+// that traffic in both directions is shaped.
+type linkConn struct {
+	net.Conn
+	shape       *linkShape
+	reverse     bool // reads carry the traffic from b to a
+	delayWrites bool // the other end of the link isn't wrapped
+}
+
+func (c *linkConn) Read(b []byte) (int, error) {
+	if duration := c.shape.delay(c.reverse); duration > 0 {
+		time.Sleep(duration)
+	}
+	return c.Conn.Read(b)
+}
+
+// Write applies the MTU and loss to each of the frames being written. The
+// router writes whole frames, often several at once, so frames that don't
+// make it across the link are cut out and the rest are written as normal.
+// Anything that doesn't look like a frame, i.e. the handshake, is written
+// unchanged.
+func (c *linkConn) Write(b []byte) (int, error) {
+	if c.delayWrites {
+		if duration := c.shape.delay(!c.reverse); duration > 0 {
+			time.Sleep(duration)
+		}
+	}
+	if c.shape.mtu.Load() == 0 && c.shape.loss.Load() == 0 {
+		return c.Conn.Write(b)
+	}
+	var out []byte
+	offset := 0
+	for offset < len(b) {
+		_, length, err := types.PeekFrameHeader(b[offset:])
+		if err != nil || offset+length > len(b) {
+			break
+		}
+		if c.shape.deliver(length) {
+			if out != nil {
+				out = append(out, b[offset:offset+length]...)
+			}
+		} else if out == nil {
+			out = append(make([]byte, 0, len(b)), b[:offset]...)
+		}
+		offset += length
+	}
+	if out == nil {
+		return c.Conn.Write(b)
+	}
+	out = append(out, b[offset:]...)
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
 func (sim *Simulator) ConnectNodes(a, b string) error {
 	if a == b {
 		return fmt.Errorf("invalid node pair, a node cannot peer with iself")
@@ -60,7 +241,7 @@ func (sim *Simulator) ConnectNodes(a, b string) error {
 		if err := c.SetNoDelay(true); err != nil {
 			panic(err)
 		}
-		sc := &util.SlowConn{Conn: c, ReadJitter: 5 * time.Millisecond}
+		sc := &linkConn{Conn: c, shape: newLinkShape(DefaultLinkParams), delayWrites: true}
 		if _, err := nb.Connect(
 			sc,
 			router.ConnectionKeepalives(true),
@@ -71,8 +252,9 @@ func (sim *Simulator) ConnectNodes(a, b string) error {
 		register(sc)
 	} else {
 		pa, pb := net.Pipe()
-		pa = &util.SlowConn{Conn: pa, ReadJitter: 5 * time.Millisecond}
-		pb = &util.SlowConn{Conn: pb, ReadJitter: 5 * time.Millisecond}
+		shape := newLinkShape(DefaultLinkParams)
+		pa = &linkConn{Conn: pa, shape: shape, reverse: true}
+		pb = &linkConn{Conn: pb, shape: shape}
 		go func() {
 			if _, err := na.Connect(
 				pa,
@@ -124,6 +306,88 @@ func (sim *Simulator) DisconnectNodes(a, b string) error {
 	return wire.Close()
 }
 
+// SetLinkParams changes the parameters of the link between two nodes. The
+// link stays up while the change is made.
+func (sim *Simulator) SetLinkParams(a, b string, params LinkParams) error {
+	if params.Latency < 0 || params.ReverseLatency < 0 || params.Jitter < 0 {
+		return fmt.Errorf("latency and jitter must not be negative")
+	}
+	if params.MTU < 0 {
+		return fmt.Errorf("MTU must not be negative")
+	}
+	if params.Loss < 0 || params.Loss > 1 {
+		return fmt.Errorf("loss must be between 0 and 1")
+	}
+	shape, swapped, err := sim.linkShape(a, b)
+	if err != nil {
+		return err
+	}
+	sim.log.Printf("Link between %q and %q now has latency %s (%s in reverse), jitter %s, MTU %d (fragment: %v) and loss %.2f\n", a, b, params.Latency, params.ReverseLatency, params.Jitter, params.MTU, params.Fragment, params.Loss)
+	if swapped {
+		params.Latency, params.ReverseLatency = params.ReverseLatency, params.Latency
+	}
+	shape.set(params)
+	return nil
+}
+
+// LinkParams returns the parameters of the link between two nodes, with the
+// latencies given in the direction from a to b.
+func (sim *Simulator) LinkParams(a, b string) (LinkParams, error) {
+	shape, swapped, err := sim.linkShape(a, b)
+	if err != nil {
+		return LinkParams{}, err
+	}
+	params := shape.get()
+	if swapped {
+		params.Latency, params.ReverseLatency = params.ReverseLatency, params.Latency
+	}
+	return params, nil
+}
+
+// LinkStats returns what has happened to the frames sent over the link
+// between two nodes.
+func (sim *Simulator) LinkStats(a, b string) (LinkStats, error) {
+	shape, _, err := sim.linkShape(a, b)
+	if err != nil {
+		return LinkStats{}, err
+	}
+	return shape.stats(), nil
+}
+
+// linkShape returns the parameters of the link between two nodes, and
+// whether the link was connected from b to a rather than from a to b.
+func (sim *Simulator) linkShape(a, b string) (*linkShape, bool, error) {
+	sim.wiresMutex.RLock()
+	wire, swapped := sim.wires[a][b], false
+	if wire == nil {
+		wire, swapped = sim.wires[b][a], true
+	}
+	sim.wiresMutex.RUnlock()
+	if wire == nil {
+		return nil, false, fmt.Errorf("nodes not connected")
+	}
+	conn, ok := wire.(*linkConn)
+	if !ok {
+		return nil, false, fmt.Errorf("link parameters can't be changed on this link")
+	}
+	return conn.shape, swapped, nil
+}
+
+// Links returns every link in the simulation as pairs of node names.
+func (sim *Simulator) Links() [][2]string {
+	sim.wiresMutex.RLock()
+	defer sim.wiresMutex.RUnlock()
+	var links [][2]string
+	for a, peers := range sim.wires {
+		for b, conn := range peers {
+			if conn != nil {
+				links = append(links, [2]string{a, b})
+			}
+		}
+	}
+	return links
+}
+
 func (sim *Simulator) DisconnectAllPeers(disconnectNode string) {
 	sim.wiresMutex.Lock()
 	nodeWires := sim.wires[disconnectNode]
@@ -0,0 +1,261 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MobilityConfig describes a random waypoint mobility model. Each node is
+// placed at a random position on a Width x Height plane, picks a random
+// destination and speed, travels there in a straight line, pauses, and then
+// picks a new destination. Any two nodes within RadioRange of each other are
+// connected and any two nodes further apart than that are disconnected.
+type MobilityConfig struct {
+	Width      float64       // width of the plane in arbitrary units
+	Height     float64       // height of the plane in arbitrary units
+	RadioRange float64       // how close two nodes need to be to connect
+	MinSpeed   float64       // slowest speed in units per second
+	MaxSpeed   float64       // fastest speed in units per second
+	Pause      time.Duration // how long to wait at each waypoint
+	Interval   time.Duration // how often positions and links are updated
+	Seed       int64         // seed for the random source, 0 to use the time
+}
+
+// DefaultMobilityConfig returns a configuration with sensible defaults for
+// everything except the radio range.
+func DefaultMobilityConfig(radioRange float64) MobilityConfig {
+	return MobilityConfig{
+		Width:      1000,
+		Height:     1000,
+		RadioRange: radioRange,
+		MinSpeed:   5,
+		MaxSpeed:   20,
+		Pause:      time.Second * 10,
+		Interval:   time.Second,
+	}
+}
+
+func (c MobilityConfig) validate() error {
+	switch {
+	case c.Width <= 0 || c.Height <= 0:
+		return fmt.Errorf("plane dimensions must be positive")
+	case c.RadioRange <= 0:
+		return fmt.Errorf("radio range must be positive")
+	case c.MinSpeed <= 0 || c.MaxSpeed < c.MinSpeed:
+		return fmt.Errorf("speeds must be positive and min must not exceed max")
+	case c.Interval <= 0:
+		return fmt.Errorf("update interval must be positive")
+	}
+	return nil
+}
+
+type Position struct {
+	X float64
+	Y float64
+}
+
+func (p Position) distanceTo(o Position) float64 {
+	return math.Hypot(p.X-o.X, p.Y-o.Y)
+}
+
+// mobileNode is the movement state of a single node.
+type mobileNode struct {
+	position    Position
+	waypoint    Position
+	speed       float64   // units per second
+	pausedUntil time.Time // when will the node start moving again?
+}
+
+// mobilityModel owns the positions of all nodes while mobility is running.
+type mobilityModel struct {
+	config MobilityConfig
+	rand   *rand.Rand
+	nodes  map[string]*mobileNode
+	mutex  sync.Mutex
+	quit   chan struct{}
+}
+
+// StartMobility starts moving nodes around according to the given random
+// waypoint configuration, rewiring links between them as they come into and
+// go out of radio range. While mobility is running it manages all links in
+// the simulation, including ones that were made by hand. Nodes that are added
+// while mobility is running are given a random position on the next update.
+func (sim *Simulator) StartMobility(config MobilityConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	m := &mobilityModel{
+		config: config,
+		rand:   rand.New(rand.NewSource(seed)),
+		nodes:  map[string]*mobileNode{},
+		quit:   make(chan struct{}),
+	}
+
+	sim.mobilityMutex.Lock()
+	if sim.mobility != nil {
+		sim.mobilityMutex.Unlock()
+		return fmt.Errorf("mobility is already running")
+	}
+	sim.mobility = m
+	sim.mobilityMutex.Unlock()
+
+	sim.log.Printf("Starting mobility (%.0fx%.0f plane, radio range %.0f)\n", config.Width, config.Height, config.RadioRange)
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		sim.updateMobility(m, config.Interval)
+		for {
+			select {
+			case <-m.quit:
+				return
+			case <-ticker.C:
+				sim.updateMobility(m, config.Interval)
+			}
+		}
+	}()
+	return nil
+}
+
+// StopMobility stops moving nodes around. The links that exist at the time
+// are left in place.
+func (sim *Simulator) StopMobility() {
+	sim.mobilityMutex.Lock()
+	defer sim.mobilityMutex.Unlock()
+	if sim.mobility == nil {
+		return
+	}
+	close(sim.mobility.quit)
+	sim.mobility = nil
+	sim.log.Println("Stopped mobility")
+}
+
+// Positions returns the current position of every node, or nil if mobility
+// isn't running.
+func (sim *Simulator) Positions() map[string]Position {
+	sim.mobilityMutex.Lock()
+	m := sim.mobility
+	sim.mobilityMutex.Unlock()
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	positions := make(map[string]Position, len(m.nodes))
+	for name, n := range m.nodes {
+		positions[name] = n.position
+	}
+	return positions
+}
+
+// updateMobility moves every node along by one interval and then connects
+// or disconnects pairs of nodes based on their new positions.
+func (sim *Simulator) updateMobility(m *mobilityModel, elapsed time.Duration) {
+	sim.nodesMutex.RLock()
+	names := make([]string, 0, len(sim.nodes))
+	for name := range sim.nodes {
+		names = append(names, name)
+	}
+	sim.nodesMutex.RUnlock()
+	// Sorting the names means that the same seed always gives the same
+	// movements for the same set of nodes.
+	sort.Strings(names)
+
+	now := time.Now()
+	positions := make(map[string]Position, len(names))
+	m.mutex.Lock()
+	for _, name := range names {
+		n, ok := m.nodes[name]
+		if !ok {
+			n = &mobileNode{position: m.randomPosition()}
+			m.nextWaypoint(n)
+			m.nodes[name] = n
+		}
+		m.move(n, now, elapsed)
+		positions[name] = n.position
+	}
+	// Forget about any nodes that have been removed.
+	for name := range m.nodes {
+		if _, ok := positions[name]; !ok {
+			delete(m.nodes, name)
+		}
+	}
+	m.mutex.Unlock()
+
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			inRange := positions[a].distanceTo(positions[b]) <= m.config.RadioRange
+			connected := sim.isWired(a, b)
+			switch {
+			case inRange && !connected:
+				if err := sim.ConnectNodes(a, b); err != nil {
+					sim.log.Printf("Mobility failed connecting %q and %q: %s\n", a, b, err)
+				}
+			case !inRange && connected:
+				if err := sim.DisconnectNodes(a, b); err != nil {
+					sim.log.Printf("Mobility failed disconnecting %q and %q: %s\n", a, b, err)
+				}
+			}
+		}
+	}
+}
+
+// isWired returns true if there is a link between the two nodes in
+// either direction.
+func (sim *Simulator) isWired(a, b string) bool {
+	sim.wiresMutex.RLock()
+	defer sim.wiresMutex.RUnlock()
+	return sim.wires[a][b] != nil || sim.wires[b][a] != nil
+}
+
+func (m *mobilityModel) randomPosition() Position {
+	return Position{
+		X: m.rand.Float64() * m.config.Width,
+		Y: m.rand.Float64() * m.config.Height,
+	}
+}
+
+// nextWaypoint picks a new destination and speed for the node.
+func (m *mobilityModel) nextWaypoint(n *mobileNode) {
+	n.waypoint = m.randomPosition()
+	n.speed = m.config.MinSpeed + m.rand.Float64()*(m.config.MaxSpeed-m.config.MinSpeed)
+}
+
+// move advances the node towards its waypoint. Once it arrives it pauses
+// before setting off towards a new waypoint.
+func (m *mobilityModel) move(n *mobileNode, now time.Time, elapsed time.Duration) {
+	if now.Before(n.pausedUntil) {
+		return
+	}
+	step := n.speed * elapsed.Seconds()
+	remaining := n.position.distanceTo(n.waypoint)
+	if step >= remaining {
+		n.position = n.waypoint
+		n.pausedUntil = now.Add(m.config.Pause)
+		m.nextWaypoint(n)
+		return
+	}
+	n.position.X += (n.waypoint.X - n.position.X) / remaining * step
+	n.position.Y += (n.waypoint.Y - n.position.Y) / remaining * step
+}
@@ -35,6 +35,22 @@ func (sim *Simulator) Node(t string) *Node {
 }
 
 func (sim *Simulator) CreateNode(t string, nodeType APINodeType) error {
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return fmt.Errorf("ed25519.GenerateKey: %w", err)
+	}
+	return sim.createNode(t, nodeType, sk)
+}
+
+// CreateNodeWithKey creates a node with the given private key rather than a
+// random one, i.e. one from the fixtures package, so that the node has the
+// same identity every time the simulation is run.
+func (sim *Simulator) CreateNodeWithKey(t string, nodeType APINodeType, sk ed25519.PrivateKey) error {
+	return sim.createNode(t, nodeType, sk)
+}
+
+// createNode creates a node with the given private key.
+func (sim *Simulator) createNode(t string, nodeType APINodeType, sk ed25519.PrivateKey) error {
 	if _, ok := sim.nodes[t]; ok {
 		return fmt.Errorf("%s already exists!", t)
 	}
@@ -56,10 +72,6 @@ func (sim *Simulator) CreateNode(t string, nodeType APINodeType) error {
 			return fmt.Errorf("net.Listen: %w", err)
 		}
 	}
-	_, sk, err := ed25519.GenerateKey(nil)
-	if err != nil {
-		return fmt.Errorf("ed25519.GenerateKey: %w", err)
-	}
 	crc := crc32.ChecksumIEEE([]byte(t))
 	color := 31 + (crc % 6)
 	logger := log.New(sim.log.Writer(), fmt.Sprintf("\033[%dmNode %s:\033[0m ", color, t), 0)
@@ -70,6 +82,7 @@ func (sim *Simulator) CreateNode(t string, nodeType APINodeType) error {
 		l:          l,
 		ListenAddr: tcpaddr,
 		Type:       nodeType,
+		privateKey: sk,
 	}
 	sim.nodeRunnerChannelsMutex.Lock()
 	sim.nodeRunnerChannels[t] = append(sim.nodeRunnerChannels[t], quit)
@@ -155,6 +168,7 @@ func (sim *Simulator) RemoveNode(node string) {
 	sim.nodesMutex.Unlock()
 
 	phony.Block(sim.State, func() { sim.State._removeNode(node) })
+	sim.removeFromGroups(node)
 
 	sim.CalculateShortestPaths()
 }
@@ -179,7 +193,7 @@ func (sim *Simulator) ConfigureFilterPeer(node string, peer string, rates advers
 
 func createDefaultRouter(log *log.Logger, sk ed25519.PrivateKey, debug bool, quit <-chan bool) SimRouter {
 	rtr := &DefaultRouter{
-		rtr: router.NewRouter(log, sk, debug),
+		rtr: router.NewRouter(log, sk, debug, router.RouterStrictConformance{}),
 	}
 
 	go rtr.OverlayReadHandler(quit)
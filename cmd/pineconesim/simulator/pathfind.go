@@ -43,7 +43,7 @@ func (sim *Simulator) PingTree(from, to string) (uint16, time.Duration, error) {
 	}
 
 	success = true
-	sim.ReportDistance(from, to, int64(hops), false)
+	sim.ReportDistance(from, to, int64(hops), rtt, false)
 	return hops, rtt, nil
 }
 
@@ -70,6 +70,6 @@ func (sim *Simulator) PingSNEK(from, to string) (uint16, time.Duration, error) {
 	}
 
 	success = true
-	sim.ReportDistance(from, to, int64(hops), true)
+	sim.ReportDistance(from, to, int64(hops), rtt, true)
 	return hops, rtt, nil
 }
@@ -37,6 +37,14 @@ type SimRouter interface {
 	ConfigureFilterDefaults(rates adversary.DropRates)
 	ConfigureFilterPeer(peer types.PublicKey, rates adversary.DropRates)
 	ManholeHandler(w http.ResponseWriter, req *http.Request)
+	DebugHandler(w http.ResponseWriter, req *http.Request)
+	MirrorHandler(w http.ResponseWriter, req *http.Request)
+	SetClockSkew(offset time.Duration, rate float64)
+	ClockSkew() (time.Duration, float64)
+	TreeStats() router.TreeStats
+	DropCounts() map[router.DropReason]uint64
+	SnakeNeighbours() []router.SnakeNeighbour
+	Close() error
 }
 
 type DefaultRouter struct {
@@ -48,6 +56,10 @@ func (r *DefaultRouter) Subscribe(ch chan events.Event) {
 	r.rtr.Subscribe(ch)
 }
 
+func (r *DefaultRouter) Close() error {
+	return r.rtr.Close()
+}
+
 func (r *DefaultRouter) PublicKey() types.PublicKey {
 	return r.rtr.PublicKey()
 }
@@ -68,6 +80,34 @@ func (r *DefaultRouter) ManholeHandler(w http.ResponseWriter, req *http.Request)
 	r.rtr.ManholeHandler(w, req)
 }
 
+func (r *DefaultRouter) DebugHandler(w http.ResponseWriter, req *http.Request) {
+	r.rtr.DebugHandler(w, req)
+}
+
+func (r *DefaultRouter) MirrorHandler(w http.ResponseWriter, req *http.Request) {
+	r.rtr.MirrorHandler(w, req)
+}
+
+func (r *DefaultRouter) SetClockSkew(offset time.Duration, rate float64) {
+	r.rtr.SetClockSkew(offset, rate)
+}
+
+func (r *DefaultRouter) ClockSkew() (time.Duration, float64) {
+	return r.rtr.ClockSkew()
+}
+
+func (r *DefaultRouter) TreeStats() router.TreeStats {
+	return r.rtr.TreeStats()
+}
+
+func (r *DefaultRouter) DropCounts() map[router.DropReason]uint64 {
+	return r.rtr.DropCounts()
+}
+
+func (r *DefaultRouter) SnakeNeighbours() []router.SnakeNeighbour {
+	return r.rtr.SnakeNeighbours()
+}
+
 func (r *DefaultRouter) Ping(ctx context.Context, a net.Addr) (uint16, time.Duration, error) {
 	id := a.String()
 
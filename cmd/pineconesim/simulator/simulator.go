@@ -93,6 +93,15 @@ type Simulator struct {
 	eventRunner              *EventSequenceRunner
 	routerCreationMap        map[APINodeType]RouterCreatorFn
 	pingControlChannel       chan<- bool
+	mobility                 *mobilityModel
+	mobilityMutex            sync.Mutex
+	snapshots                []*Snapshot // oldest first, see TakeSnapshot
+	snapshotCount            int         // how many snapshots have been taken
+	snapshotsMutex           sync.Mutex
+	groups                   map[string]*nodeGroup // see SetGroup
+	groupsMutex              sync.Mutex
+	campaign                 *campaign // the current or last failure campaign, see StartCampaign
+	campaignMutex            sync.Mutex
 }
 
 func NewSimulator(log *log.Logger, sockets, acceptCommands bool) *Simulator {
@@ -114,6 +123,7 @@ func NewSimulator(log *log.Logger, sockets, acceptCommands bool) *Simulator {
 		eventRunner:         &EventSequenceRunner{_playlist: make(chan []SimCommand)},
 		routerCreationMap:   make(map[APINodeType]RouterCreatorFn, 2),
 		pingControlChannel:  make(chan<- bool),
+		groups:              make(map[string]*nodeGroup),
 	}
 
 	sim.routerCreationMap[DefaultNode] = createDefaultRouter
@@ -178,6 +188,7 @@ func (sim *Simulator) StartPinging(ping_period time.Duration) {
 							TreeAverageStretch:   treeStretch,
 							SnakePathConvergence: uint64(sim.CalculateSNEKPathConvergence()),
 							SnakeAverageStretch:  snekStretch,
+							Anomalies:            sim.CalculateAnomalies(),
 						})
 				})
 
@@ -439,6 +450,7 @@ type EventSequencePlayer interface {
 
 func (sim *Simulator) Play() {
 	sim.eventRunner.Play()
+	sim.resumeInvariants()
 }
 
 func (sim *Simulator) Pause() {
@@ -0,0 +1,85 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// SetClockSkew skews the clock of a node, so that its timers, announcement
+// and path expiry and bootstrap sequence numbers drift away from the other
+// nodes. The offset is added to the node's clock and the rate is how fast
+// its clock runs compared to real time, where 1 is normal speed.
+func (sim *Simulator) SetClockSkew(name string, offset time.Duration, rate float64) error {
+	if rate < 0 {
+		return fmt.Errorf("clock rate must not be negative")
+	}
+	node := sim.Node(name)
+	if node == nil {
+		return fmt.Errorf("node %q doesn't exist", name)
+	}
+	node.SetClockSkew(offset, rate)
+	sim.log.Printf("Node %q now has clock offset %s and rate %.3f\n", name, offset, rate)
+	return nil
+}
+
+// ProtocolAnomalies totals up the signs of the protocol misbehaving across
+// all of the nodes in the simulation. They are most useful when nodes have
+// skewed clocks or links are asymmetric, since the tree and the snake both
+// depend on announcements and bootstraps arriving in time.
+type ProtocolAnomalies struct {
+	ParentChanges  uint64            `json:"parent_changes"`
+	RootChanges    uint64            `json:"root_changes"`
+	RootMismatches int               `json:"root_mismatches"` // nodes that don't agree with the most common root
+	SkewedNodes    int               `json:"skewed_nodes"`
+	Drops          map[string]uint64 `json:"drops"` // frames dropped by all nodes, by reason
+}
+
+// CalculateAnomalies counts the protocol anomalies across all of the nodes.
+func (sim *Simulator) CalculateAnomalies() ProtocolAnomalies {
+	anomalies := ProtocolAnomalies{
+		Drops: map[string]uint64{},
+	}
+	roots := map[types.PublicKey]int{}
+	sim.nodesMutex.RLock()
+	nodes := make([]*Node, 0, len(sim.nodes))
+	for _, node := range sim.nodes {
+		nodes = append(nodes, node)
+	}
+	sim.nodesMutex.RUnlock()
+	for _, node := range nodes {
+		stats := node.TreeStats()
+		anomalies.ParentChanges += stats.ParentChanges
+		anomalies.RootChanges += stats.RootChanges
+		roots[stats.Root]++
+		if offset, rate := node.ClockSkew(); offset != 0 || rate != 1 {
+			anomalies.SkewedNodes++
+		}
+		for reason, count := range node.DropCounts() {
+			anomalies.Drops[reason.Code()] += count
+		}
+	}
+	common := 0
+	for _, count := range roots {
+		if count > common {
+			common = count
+		}
+	}
+	anomalies.RootMismatches = len(nodes) - common
+	return anomalies
+}
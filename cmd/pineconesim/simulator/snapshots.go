@@ -0,0 +1,229 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+// maxSnapshots is how many snapshots are kept before the oldest is dropped.
+const maxSnapshots = 32
+
+// Snapshot is a copy of the state that every node reported at a point in
+// time, so that it can be compared with the state at another point in time.
+type Snapshot struct {
+	Name  string                  `json:"name"`
+	Taken time.Time               `json:"taken"`
+	Nodes map[string]SnapshotNode `json:"nodes,omitempty"`
+}
+
+// SnapshotNode is the state of a single node in a snapshot. The table maps
+// the origin of each snake path through the node to the next-hop towards it.
+type SnapshotNode struct {
+	APINode
+	Table map[string]string `json:"table"`
+}
+
+// SnapshotDiff lists the nodes that were added, removed or changed between
+// two snapshots.
+type SnapshotDiff struct {
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+	Added   []string   `json:"added"`
+	Removed []string   `json:"removed"`
+	Changed []NodeDiff `json:"changed"`
+}
+
+// NodeDiff lists the changes to a single node between two snapshots.
+type NodeDiff struct {
+	Node    string        `json:"node"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// FieldChange is a single value that changed between two snapshots. Values
+// that didn't exist in one of the snapshots are empty.
+type FieldChange struct {
+	Field  string `json:"field"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// TakeSnapshot records the current state of every node under the given name,
+// replacing any earlier snapshot with the same name. If no name is given
+// then one is made up. The snapshot is returned without the node states.
+func (sim *Simulator) TakeSnapshot(name string) Snapshot {
+	snapshot := &Snapshot{
+		Taken: time.Now(),
+	}
+	phony.Block(sim.State, func() {
+		snapshot.Nodes = make(map[string]SnapshotNode, len(sim.State._state.Nodes))
+		for n, state := range sim.State._state.Nodes {
+			node := SnapshotNode{
+				APINode: sim.State._apiNode(n),
+				Table:   make(map[string]string, len(state.SnakeEntries)),
+			}
+			for origin, next := range state.SnakeEntries {
+				node.Table[origin] = next
+			}
+			snapshot.Nodes[n] = node
+		}
+	})
+
+	sim.snapshotsMutex.Lock()
+	defer sim.snapshotsMutex.Unlock()
+	sim.snapshotCount++
+	if name == "" {
+		name = fmt.Sprintf("snapshot-%d", sim.snapshotCount)
+	}
+	snapshot.Name = name
+	for i, s := range sim.snapshots {
+		if s.Name == name {
+			sim.snapshots = append(sim.snapshots[:i], sim.snapshots[i+1:]...)
+			break
+		}
+	}
+	if len(sim.snapshots) >= maxSnapshots {
+		sim.snapshots = sim.snapshots[1:]
+	}
+	sim.snapshots = append(sim.snapshots, snapshot)
+	return Snapshot{Name: snapshot.Name, Taken: snapshot.Taken}
+}
+
+// Snapshots lists the snapshots, oldest first, without the node states.
+func (sim *Simulator) Snapshots() []Snapshot {
+	sim.snapshotsMutex.Lock()
+	defer sim.snapshotsMutex.Unlock()
+	snapshots := make([]Snapshot, 0, len(sim.snapshots))
+	for _, s := range sim.snapshots {
+		snapshots = append(snapshots, Snapshot{Name: s.Name, Taken: s.Taken})
+	}
+	return snapshots
+}
+
+// Snapshot returns the snapshot with the given name, including the node
+// states.
+func (sim *Simulator) Snapshot(name string) (Snapshot, bool) {
+	sim.snapshotsMutex.Lock()
+	defer sim.snapshotsMutex.Unlock()
+	for _, s := range sim.snapshots {
+		if s.Name == name {
+			return *s, true
+		}
+	}
+	return Snapshot{}, false
+}
+
+// DeleteSnapshot forgets the snapshot with the given name.
+func (sim *Simulator) DeleteSnapshot(name string) bool {
+	sim.snapshotsMutex.Lock()
+	defer sim.snapshotsMutex.Unlock()
+	for i, s := range sim.snapshots {
+		if s.Name == name {
+			sim.snapshots = append(sim.snapshots[:i], sim.snapshots[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// DiffSnapshots compares two snapshots by name.
+func (sim *Simulator) DiffSnapshots(from, to string) (SnapshotDiff, error) {
+	sim.snapshotsMutex.Lock()
+	var a, b *Snapshot
+	for _, s := range sim.snapshots {
+		switch s.Name {
+		case from:
+			a = s
+		case to:
+			b = s
+		}
+	}
+	sim.snapshotsMutex.Unlock()
+	switch {
+	case a == nil:
+		return SnapshotDiff{}, fmt.Errorf("snapshot %q doesn't exist", from)
+	case b == nil:
+		return SnapshotDiff{}, fmt.Errorf("snapshot %q doesn't exist", to)
+	}
+	return diffSnapshots(a, b), nil
+}
+
+func diffSnapshots(a, b *Snapshot) SnapshotDiff {
+	diff := SnapshotDiff{
+		From:    a.Name,
+		To:      b.Name,
+		Added:   []string{},
+		Removed: []string{},
+		Changed: []NodeDiff{},
+	}
+	for name := range b.Nodes {
+		if _, ok := a.Nodes[name]; !ok {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+	for name, before := range a.Nodes {
+		after, ok := b.Nodes[name]
+		if !ok {
+			diff.Removed = append(diff.Removed, name)
+			continue
+		}
+		if changes := diffNodes(before, after); len(changes) > 0 {
+			diff.Changed = append(diff.Changed, NodeDiff{Node: name, Changes: changes})
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].Node < diff.Changed[j].Node
+	})
+	return diff
+}
+
+// diffNodes lists the changes to a node, with one change for each snake
+// path whose next-hop changed.
+func diffNodes(a, b SnapshotNode) []FieldChange {
+	var changes []FieldChange
+	compare := func(field, before, after string) {
+		if before != after {
+			changes = append(changes, FieldChange{Field: field, Before: before, After: after})
+		}
+	}
+	compare("coords", fmt.Sprint(a.Coords), fmt.Sprint(b.Coords))
+	compare("root", a.Root, b.Root)
+	compare("parent", a.Parent, b.Parent)
+	compare("peers", strings.Join(a.Peers, ", "), strings.Join(b.Peers, ", "))
+	compare("snake_ascending", a.SnakeAscending, b.SnakeAscending)
+	compare("snake_descending", a.SnakeDescending, b.SnakeDescending)
+
+	origins := make([]string, 0, len(a.Table)+len(b.Table))
+	for origin := range a.Table {
+		origins = append(origins, origin)
+	}
+	for origin := range b.Table {
+		if _, ok := a.Table[origin]; !ok {
+			origins = append(origins, origin)
+		}
+	}
+	sort.Strings(origins)
+	for _, origin := range origins {
+		compare("table "+origin, a.Table[origin], b.Table[origin])
+	}
+	return changes
+}
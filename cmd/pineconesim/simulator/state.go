@@ -118,6 +118,8 @@ type StateAccessor struct {
 	phony.Inbox
 	_subscribers map[chan<- SimEvent]*phony.Inbox
 	_state       *State
+	_invariants  *invariantChecker // nil unless checking, see CheckInvariantsAfter
+	_events      []LoggedEvent     // the most recent events, oldest first, see Shutdown
 }
 
 func NewStateAccessor() *StateAccessor {
@@ -148,6 +150,8 @@ func (s *StateAccessor) Subscribe(ch chan<- SimEvent) State {
 }
 
 func (s *StateAccessor) _publish(event SimEvent) {
+	s._touch(event)
+	s._logEvent(event)
 	for ch, inbox := range s._subscribers {
 		// Create a copy of the pointer before passing into the lambda
 		chCopy := ch
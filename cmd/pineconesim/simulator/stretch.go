@@ -0,0 +1,100 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// PairStretch is the stretch between a pair of nodes, which is how much
+// longer the path that the pings took was than the shortest path through the
+// topology. A stretch of 1 means that the ping took the shortest path. The
+// stretch and round trip time for a routing scheme are 0 if no ping between
+// the pair has succeeded using it yet.
+type PairStretch struct {
+	A           string  `json:"a"`
+	B           string  `json:"b"`
+	Shortest    int64   `json:"shortest"`
+	TreeHops    int64   `json:"tree_hops"`
+	SNEKHops    int64   `json:"snek_hops"`
+	TreeStretch float64 `json:"tree_stretch"`
+	SNEKStretch float64 `json:"snek_stretch"`
+	TreeRTTMS   float64 `json:"tree_rtt_ms"`
+	SNEKRTTMS   float64 `json:"snek_rtt_ms"`
+}
+
+// StretchMatrix returns the stretch of every pair of nodes that has been
+// pinged, sorted by name. Each pair only appears once, with A sorting before
+// B, since paths are assumed to be the same length in both directions.
+func (sim *Simulator) StretchMatrix() []PairStretch {
+	pairs := []PairStretch{}
+	for a, aa := range sim.Distances() {
+		for b, d := range aa {
+			if d.Real == 0 {
+				// The shortest path wasn't known when the ping was reported,
+				// so the stretch can't be worked out. CalculateStretch skips
+				// these too.
+				continue
+			}
+			pair := PairStretch{
+				A:         a,
+				B:         b,
+				Shortest:  d.Real,
+				TreeHops:  d.ObservedTree,
+				SNEKHops:  d.ObservedSNEK,
+				TreeRTTMS: float64(d.TreeRTT) / float64(time.Millisecond),
+				SNEKRTTMS: float64(d.SNEKRTT) / float64(time.Millisecond),
+			}
+			pair.TreeStretch = float64(d.ObservedTree) / float64(d.Real)
+			pair.SNEKStretch = float64(d.ObservedSNEK) / float64(d.Real)
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].A != pairs[j].A {
+			return pairs[i].A < pairs[j].A
+		}
+		return pairs[i].B < pairs[j].B
+	})
+	return pairs
+}
+
+// WriteStretchCSV writes the stretch matrix as CSV with a header row, so
+// that it can be compared between runs in a spreadsheet.
+func WriteStretchCSV(w io.Writer, pairs []PairStretch) error {
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{
+		"a", "b", "shortest", "tree_hops", "snek_hops",
+		"tree_stretch", "snek_stretch", "tree_rtt_ms", "snek_rtt_ms",
+	}); err != nil {
+		return fmt.Errorf("out.Write: %w", err)
+	}
+	for _, p := range pairs {
+		if err := out.Write([]string{
+			p.A, p.B,
+			fmt.Sprint(p.Shortest), fmt.Sprint(p.TreeHops), fmt.Sprint(p.SNEKHops),
+			fmt.Sprintf("%.3f", p.TreeStretch), fmt.Sprintf("%.3f", p.SNEKStretch),
+			fmt.Sprintf("%.3f", p.TreeRTTMS), fmt.Sprintf("%.3f", p.SNEKRTTMS),
+		}); err != nil {
+			return fmt.Errorf("out.Write: %w", err)
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
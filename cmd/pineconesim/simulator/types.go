@@ -15,7 +15,9 @@
 package simulator
 
 import (
+	"crypto/ed25519"
 	"net"
+	"time"
 )
 
 type Node struct {
@@ -23,10 +25,13 @@ type Node struct {
 	l          *net.TCPListener // nolint:structcheck,unused
 	ListenAddr *net.TCPAddr
 	Type       APINodeType
+	privateKey ed25519.PrivateKey // kept so that the node can be restarted
 }
 
 type Distance struct {
 	Real         int64
 	ObservedTree int64
 	ObservedSNEK int64
+	TreeRTT      time.Duration // of the last successful tree ping
+	SNEKRTT      time.Duration // of the last successful SNEK ping
 }
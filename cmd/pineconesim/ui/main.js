@@ -87,11 +87,17 @@ function handleSimMessage(msg) {
             SetPingToolState(event.Enabled, event.Active);
             break;
         case APIUpdateID.NetworkStatsUpdated:
-            graph.updateNetworkStats(event.TreePathConvergence, event.TreeAverageStretch, event.SnakePathConvergence, event.SnakeAverageStretch);
+            graph.updateNetworkStats(event.TreePathConvergence, event.TreeAverageStretch, event.SnakePathConvergence, event.SnakeAverageStretch, event.Anomalies);
             break;
         case APIUpdateID.BandwidthReport:
             graph.addBandwidthReport(event.Node, event.Bandwidth);
             break;
+        case APIUpdateID.InvariantsViolated:
+            for (let i = 0; i < event.Violations.length; i++) {
+                let v = event.Violations[i];
+                console.warn("Invariant " + v.invariant + " violated on " + v.node + ": expected " + v.expected + ", got " + v.actual);
+            }
+            break;
         }
         break;
     default:
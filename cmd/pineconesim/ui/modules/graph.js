@@ -23,7 +23,8 @@ let NetworkStats = {
     TreePathConvergence: 0,
     TreeAverageStretch: 0.0,
     SnakePathConvergence: 0,
-    SnakeAverageStretch: 0.0
+    SnakeAverageStretch: 0.0,
+    Anomalies: null
 };
 
 const MaxBandwidthReports = 10;
@@ -769,11 +770,12 @@ class Graph {
         }
     }
 
-    updateNetworkStats(treeConv, treeStretch, snakeConv, snakeStretch) {
+    updateNetworkStats(treeConv, treeStretch, snakeConv, snakeStretch, anomalies) {
         NetworkStats.TreePathConvergence = treeConv.toFixed(2);
         NetworkStats.TreeAverageStretch = treeStretch.toFixed(2);
         NetworkStats.SnakePathConvergence = snakeConv.toFixed(2);
         NetworkStats.SnakeAverageStretch = snakeStretch.toFixed(2);
+        NetworkStats.Anomalies = anomalies;
         handleStatsPanelUpdate();
     }
 
@@ -980,6 +982,19 @@ function handleStatsPanelUpdate() {
         avgTableSize = totalEntrySum / Nodes.size;
     }
 
+    let anomalyTable = "";
+    let anomalies = NetworkStats.Anomalies;
+    if (anomalies) {
+        anomalyTable =
+            "<tr><td>Parent Changes:</td><td>" + anomalies.parent_changes + "</td></tr>" +
+            "<tr><td>Root Changes:</td><td>" + anomalies.root_changes + "</td></tr>" +
+            "<tr><td>Nodes Disagreeing On Root:</td><td>" + anomalies.root_mismatches + "</td></tr>" +
+            "<tr><td>Nodes With Skewed Clocks:</td><td>" + anomalies.skewed_nodes + "</td></tr>";
+        for (const [reason, count] of Object.entries(anomalies.drops || {}).sort()) {
+            anomalyTable += "<tr><td>Dropped (" + reason.replace(/_/g, " ") + "):</td><td>" + count + "</td></tr>";
+        }
+    }
+
     statsPanel.innerHTML =
         "<div class=\"shift-right\"><h3>Statistics</h3></div>" +
         "<hr><table>" +
@@ -1016,5 +1031,9 @@ function handleStatsPanelUpdate() {
         "<table>" +
         "<tr><th>Root Node</th><th>Convergence</th></tr>" +
         rootTable +
+        "</table>" +
+        "<hr><h4><u>Protocol Anomalies</u></h4>" +
+        "<table>" +
+        anomalyTable +
         "</table>";
 }
@@ -24,6 +24,7 @@ export const APIUpdateID = {
     PingStateUpdated: 11,
     NetworkStatsUpdated: 12,
     BandwidthReport: 13,
+    InvariantsViolated: 14,
 };
 
 export const APICommandID = {
@@ -40,6 +41,15 @@ export const APICommandID = {
     ConfigureAdversaryPeer: 10,
     StartPings: 11,
     StopPings: 12,
+    StartMobility: 13,
+    StopMobility: 14,
+    SetClockSkew: 15,
+    SetLinkLatency: 16,
+    SetGroup: 17,
+    DisconnectGroup: 18,
+    ReconnectGroup: 19,
+    AddGroupLatency: 20,
+    RestartGroup: 21,
 };
 
 export const APINodeType = {
@@ -182,6 +182,9 @@ function selectTool(toolType) {
     case "view-analytics":
         handleToolViewAnalytics(this);
         break;
+    case "view-stretch":
+        handleToolViewStretch(this);
+        break;
     case "scenario-new":
         handleToolScenarioNew(this);
         break;
@@ -206,6 +209,15 @@ function selectTool(toolType) {
     case "remove":
         handleToolRemove(this);
         break;
+    case "snapshot-take":
+        handleToolSnapshotTake(this);
+        break;
+    case "snapshot-compare":
+        handleToolSnapshotCompare(this);
+        break;
+    case "groups":
+        handleToolGroups(this);
+        break;
     }
 }
 
@@ -250,6 +262,94 @@ function handleToolViewAnalytics(subtool) {
     setupBaseModal("analytics-modal");
 }
 
+function handleToolViewStretch(subtool) {
+    setupBaseModal("stretch-modal");
+
+    fetch("/api/stretch")
+        .then(response => response.json())
+        .then(pairs => {
+            let select = document.getElementById("stretchMetric");
+            select.onchange = function() {
+                drawStretchHeatmap(pairs, select.value);
+            };
+            drawStretchHeatmap(pairs, select.value);
+        });
+}
+
+// drawStretchHeatmap draws the chosen metric for every pair of nodes as a grid,
+// from green for the shortest path (or the lowest RTT) to red for the longest.
+// Pairs that haven't been pinged successfully are left grey.
+function drawStretchHeatmap(pairs, metric) {
+    let canvas = document.getElementById("stretchHeatmap");
+    let summary = document.getElementById("stretchSummary");
+    let ctx = canvas.getContext("2d");
+
+    let names = new Set();
+    let values = new Map();
+    let min = Infinity, max = 0, sum = 0, count = 0;
+    for (let i = 0; i < pairs.length; i++) {
+        let pair = pairs[i];
+        names.add(pair.a);
+        names.add(pair.b);
+        let value = pair[metric];
+        if (!value) {
+            continue;
+        }
+        values.set(pair.a + "\0" + pair.b, value);
+        values.set(pair.b + "\0" + pair.a, value);
+        min = Math.min(min, value);
+        max = Math.max(max, value);
+        sum += value;
+        count++;
+    }
+    names = Array.from(names).sort();
+
+    let label = 80;
+    let cell = Math.max(4, Math.min(24, Math.floor(640 / Math.max(names.length, 1))));
+    canvas.width = label + cell * names.length;
+    canvas.height = label + cell * names.length;
+    ctx.clearRect(0, 0, canvas.width, canvas.height);
+
+    if (count === 0) {
+        summary.textContent = "No pings have succeeded yet, so there is nothing to show. Start pings and try again.";
+        return;
+    }
+    summary.textContent = "Average " + (sum / count).toFixed(2) + ", best " + min.toFixed(2) +
+        ", worst " + max.toFixed(2) + " over " + count + " pairs.";
+
+    let fontSize = Math.min(cell, 12);
+    ctx.font = fontSize + "px sans-serif";
+    ctx.fillStyle = "black";
+    if (cell >= 8) {
+        for (let i = 0; i < names.length; i++) {
+            ctx.textAlign = "right";
+            ctx.fillText(names[i], label - 4, label + i * cell + cell / 2 + fontSize / 3, label - 4);
+            ctx.save();
+            ctx.translate(label + i * cell + cell / 2 + fontSize / 3, label - 4);
+            ctx.rotate(-Math.PI / 2);
+            ctx.textAlign = "left";
+            ctx.fillText(names[i], 0, 0, label - 4);
+            ctx.restore();
+        }
+    }
+
+    for (let y = 0; y < names.length; y++) {
+        for (let x = 0; x < names.length; x++) {
+            let value = values.get(names[y] + "\0" + names[x]);
+            if (x == y) {
+                ctx.fillStyle = "white";
+            } else if (value === undefined) {
+                ctx.fillStyle = "lightgrey";
+            } else {
+                // Hue 120 is green and 0 is red.
+                let scale = max > min ? (value - min) / (max - min) : 0;
+                ctx.fillStyle = "hsl(" + (120 - scale * 120) + ", 70%, 50%)";
+            }
+            ctx.fillRect(label + x * cell, label + y * cell, cell - 1, cell - 1);
+        }
+    }
+}
+
 function handleToolScenarioNew(subtool) {
     // TODO
 }
@@ -330,6 +430,15 @@ function validateEventSequence(content) {
         validSimCommands.set("ConfigureAdversaryPeer", ["Node", "Peer", "DropRates"]);
         validSimCommands.set("StartPings", []);
         validSimCommands.set("StopPings", []);
+        validSimCommands.set("StartMobility", ["RadioRange"]);
+        validSimCommands.set("StopMobility", []);
+        validSimCommands.set("SetClockSkew", ["Node"]);
+        validSimCommands.set("SetLinkLatency", ["Node", "Peer", "Latency"]);
+        validSimCommands.set("SetGroup", ["Group", "Nodes"]);
+        validSimCommands.set("DisconnectGroup", ["Group"]);
+        validSimCommands.set("ReconnectGroup", ["Group"]);
+        validSimCommands.set("AddGroupLatency", ["Group", "Latency"]);
+        validSimCommands.set("RestartGroup", ["Group"]);
 
         let validSubcommands = new Map();
         validSubcommands.set("DropRates", ["Overall", "Keepalive", "TreeAnnouncement", "TreeRouted", "VirtualSnakeBootstrap", "VirtualSnakeBootstrapACK", "VirtualSnakeSetup", "VirtualSnakeSetupACK", "VirtualSnakeTeardown", "VirtualSnakeRouted"]);
@@ -500,6 +609,169 @@ function handleToolRemove(subtool) {
     }
 }
 
+function handleToolSnapshotTake(subtool) {
+    fetch("/api/snapshots", {method: "POST"})
+        .then(response => response.json())
+        .then(snapshot => {
+            if (snapshot.error) {
+                console.log("Failed to take snapshot: " + snapshot.error);
+                return;
+            }
+            console.log("Took snapshot " + snapshot.name);
+        });
+}
+
+function handleToolSnapshotCompare(subtool) {
+    setupBaseModal("snapshot-diff-modal");
+
+    let from = document.getElementById("snapshot-from");
+    let to = document.getElementById("snapshot-to");
+    let output = document.getElementById("snapshot-diff");
+    output.innerHTML = "";
+
+    fetch("/api/snapshots")
+        .then(response => response.json())
+        .then(snapshots => {
+            from.innerHTML = "";
+            to.innerHTML = "";
+            if (!snapshots || snapshots.length < 2) {
+                output.textContent = "Take at least two snapshots to compare them.";
+                return;
+            }
+            for (let i = 0; i < snapshots.length; i++) {
+                from.add(new Option(snapshots[i].name, snapshots[i].name));
+                to.add(new Option(snapshots[i].name, snapshots[i].name));
+            }
+            // Compare the latest snapshot against the one before it to start with.
+            from.selectedIndex = snapshots.length - 2;
+            to.selectedIndex = snapshots.length - 1;
+            from.onchange = showSnapshotDiff;
+            to.onchange = showSnapshotDiff;
+            showSnapshotDiff();
+        });
+}
+
+function showSnapshotDiff() {
+    let from = document.getElementById("snapshot-from").value;
+    let to = document.getElementById("snapshot-to").value;
+    let output = document.getElementById("snapshot-diff");
+
+    fetch("/api/snapshots/" + encodeURIComponent(from) + "/" + encodeURIComponent(to))
+        .then(response => response.json())
+        .then(diff => {
+            if (diff.error) {
+                output.textContent = diff.error;
+                return;
+            }
+
+            let html = "";
+            if (diff.added && diff.added.length > 0) {
+                html += "<h4>Added</h4><p>" + diff.added.join(", ") + "</p>";
+            }
+            if (diff.removed && diff.removed.length > 0) {
+                html += "<h4>Removed</h4><p>" + diff.removed.join(", ") + "</p>";
+            }
+            let changed = [];
+            if (diff.changed && diff.changed.length > 0) {
+                html += "<h4>Changed</h4><table><tr><th>Node</th><th>Field</th><th>Before</th><th>After</th></tr>";
+                for (let i = 0; i < diff.changed.length; i++) {
+                    let node = diff.changed[i];
+                    changed.push(node.node);
+                    for (let j = 0; j < node.changes.length; j++) {
+                        let change = node.changes[j];
+                        html += "<tr><td>" + (j == 0 ? node.node : "") + "</td><td>" + change.field +
+                            "</td><td>" + change.before + "</td><td>" + change.after + "</td></tr>";
+                    }
+                }
+                html += "</table>";
+            }
+            if (html === "") {
+                html = "<p>No differences.</p>";
+            }
+            output.innerHTML = html;
+
+            // Highlight the nodes that changed so that they can be found on the graph.
+            graph.selectNodes(changed);
+        });
+}
+
+function handleToolGroups(subtool) {
+    setupBaseModal("groups-modal");
+
+    let select = document.getElementById("group-select");
+    let name = document.getElementById("group-name");
+    let latency = document.getElementById("group-latency");
+    let status = document.getElementById("group-status");
+    status.textContent = "";
+
+    let refresh = function(selected) {
+        fetch("/api/groups")
+            .then(response => response.json())
+            .then(groups => {
+                select.innerHTML = "";
+                for (let i = 0; i < groups.length; i++) {
+                    let option = new Option(groups[i].name + " (" + groups[i].nodes.length + " nodes)", groups[i].name);
+                    select.add(option);
+                }
+                if (selected) {
+                    select.value = selected;
+                }
+                showGroup(groups);
+            });
+    };
+    let showGroup = function(groups) {
+        for (let i = 0; i < groups.length; i++) {
+            if (groups[i].name === select.value) {
+                name.value = groups[i].name;
+                status.textContent = groups[i].nodes.join(", ");
+                graph.selectNodes(groups[i].nodes);
+            }
+        }
+    };
+    let request = function(method, path, body) {
+        let group = name.value || select.value;
+        if (!group) {
+            status.textContent = "Enter a group name first.";
+            return;
+        }
+        let options = {method: method};
+        if (body) {
+            options.body = JSON.stringify(body);
+        }
+        fetch("/api/groups/" + encodeURIComponent(group) + path, options)
+            .then(response => response.status == 204 ? {} : response.json())
+            .then(result => {
+                if (result.error) {
+                    status.textContent = result.error;
+                    return;
+                }
+                refresh(group);
+            });
+    };
+
+    select.onchange = function() {
+        fetch("/api/groups")
+            .then(response => response.json())
+            .then(showGroup);
+    };
+    document.getElementById("group-set").onclick = function() {
+        request("PUT", "", {"nodes": graph.GetSelectedNodes() || []});
+    };
+    document.getElementById("group-disconnect").onclick = function() {
+        request("POST", "/disconnect");
+    };
+    document.getElementById("group-reconnect").onclick = function() {
+        request("POST", "/reconnect");
+    };
+    document.getElementById("group-latency-add").onclick = function() {
+        request("POST", "/latency", {"latency_ms": parseFloat(latency.value) || 0});
+    };
+    document.getElementById("group-restart").onclick = function() {
+        request("POST", "/restart");
+    };
+    refresh();
+}
+
 function setupBaseModal(modalName) {
     // Get the modal
     let modal = document.getElementById(modalName);
@@ -575,8 +847,37 @@ function convertCommandToID(command) {
         break;
     case "StartPings":
         id = APICommandID.StartPings;
+        break;
     case "StopPings":
         id = APICommandID.StopPings;
+        break;
+    case "StartMobility":
+        id = APICommandID.StartMobility;
+        break;
+    case "StopMobility":
+        id = APICommandID.StopMobility;
+        break;
+    case "SetClockSkew":
+        id = APICommandID.SetClockSkew;
+        break;
+    case "SetLinkLatency":
+        id = APICommandID.SetLinkLatency;
+        break;
+    case "SetGroup":
+        id = APICommandID.SetGroup;
+        break;
+    case "DisconnectGroup":
+        id = APICommandID.DisconnectGroup;
+        break;
+    case "ReconnectGroup":
+        id = APICommandID.ReconnectGroup;
+        break;
+    case "AddGroupLatency":
+        id = APICommandID.AddGroupLatency;
+        break;
+    case "RestartGroup":
+        id = APICommandID.RestartGroup;
+        break;
     default:
         break;
     }
@@ -0,0 +1,195 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// linkPollInterval is how often interfaces are checked on platforms where
+// we can't get notified about changes to them.
+const linkPollInterval = time.Second * 2
+
+// LinkWatcher watches the network interfaces on the machine and disconnects
+// any peerings that were using an interface as soon as it goes down or loses
+// its address, instead of waiting for the connections to time out. This lets
+// the router find new paths straight away, which matters on phones that move
+// between Wi-Fi and cellular often. When an interface comes up or gains an
+// address, the static peers of the connection manager, if one was given, are
+// retried straight away.
+//
+// On Linux the watcher is notified of changes by netlink. On other platforms,
+// or where netlink isn't available, the interfaces are polled instead. Apps
+// that get their own network change notifications from the OS should call
+// Check when they receive one.
+type LinkWatcher struct {
+	log     types.Logger
+	router  *router.Router
+	manager *ConnectionManager
+	ctx     context.Context
+	cancel  context.CancelFunc
+	check   chan struct{}
+	mutex   sync.Mutex
+	links   map[string]linkState
+}
+
+// linkState is what we know about an interface the last time we looked.
+type linkState struct {
+	up    bool
+	addrs []net.IP
+}
+
+// NewLinkWatcher creates a new link watcher. The manager may be nil if there
+// are no static peers to retry.
+func NewLinkWatcher(log types.Logger, r *router.Router, manager *ConnectionManager) *LinkWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LinkWatcher{
+		log:     log,
+		router:  r,
+		manager: manager,
+		ctx:     ctx,
+		cancel:  cancel,
+		check:   make(chan struct{}, 1),
+	}
+}
+
+// Start starts watching interfaces.
+func (w *LinkWatcher) Start() {
+	w.mutex.Lock()
+	w.links, _ = currentLinks()
+	w.mutex.Unlock()
+	go w.watch()
+}
+
+// Stop stops watching interfaces. Peerings are not affected.
+func (w *LinkWatcher) Stop() {
+	w.cancel()
+}
+
+// Check asks the watcher to look at the interfaces again straight away.
+func (w *LinkWatcher) Check() {
+	select {
+	case w.check <- struct{}{}:
+	default:
+	}
+}
+
+// poll checks the interfaces every linkPollInterval and whenever Check is
+// called, until the watcher is stopped.
+func (w *LinkWatcher) poll() {
+	ticker := time.NewTicker(linkPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.check:
+		}
+		w.update()
+	}
+}
+
+// update compares the interfaces with the last time we looked, disconnecting
+// peerings on interfaces or addresses that have gone away and retrying static
+// peers if anything new has appeared.
+func (w *LinkWatcher) update() {
+	links, err := currentLinks()
+	if err != nil {
+		w.log.Println("Failed to list interfaces:", err)
+		return
+	}
+
+	w.mutex.Lock()
+	previous := w.links
+	w.links = links
+	w.mutex.Unlock()
+
+	appeared := false
+	for name, was := range previous {
+		now, ok := links[name]
+		switch {
+		case !was.up:
+			continue
+		case !ok || !now.up:
+			if n := w.router.DisconnectLink(name, was.addrs, fmt.Errorf("interface %s went down", name)); n > 0 {
+				w.log.Printf("Interface %s went down, disconnected %d peering(s)\n", name, n)
+			}
+		default:
+			if removed := missingAddrs(was.addrs, now.addrs); len(removed) > 0 {
+				if n := w.router.DisconnectLink("", removed, fmt.Errorf("interface %s lost address", name)); n > 0 {
+					w.log.Printf("Interface %s lost %d address(es), disconnected %d peering(s)\n", name, len(removed), n)
+				}
+			}
+		}
+	}
+	for name, now := range links {
+		was, ok := previous[name]
+		if now.up && (!ok || !was.up || len(missingAddrs(now.addrs, was.addrs)) > 0) {
+			appeared = true
+		}
+	}
+	if appeared && w.manager != nil {
+		w.manager.RetryNow()
+	}
+}
+
+// missingAddrs returns the addresses in a that aren't in b.
+func missingAddrs(a, b []net.IP) []net.IP {
+	var missing []net.IP
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x.Equal(y) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, x)
+		}
+	}
+	return missing
+}
+
+// interfaceLinks lists the interfaces using the standard library, which only
+// knows whether the interface is administratively up.
+func interfaceLinks() (map[string]linkState, error) {
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("net.Interfaces: %w", err)
+	}
+	links := make(map[string]linkState, len(intfs))
+	for _, intf := range intfs {
+		state := linkState{up: intf.Flags&net.FlagUp != 0}
+		addrs, err := intf.Addrs()
+		if err == nil {
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok {
+					state.addrs = append(state.addrs, ipnet.IP)
+				}
+			}
+		}
+		links[intf.Name] = state
+	}
+	return links, nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package connections
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// currentLinks lists the interfaces using netlink, which also tells us the
+// operational state, so that e.g. a Wi-Fi interface that has lost its
+// association counts as down even though it is still administratively up.
+// If netlink isn't available, as on some Android versions, the standard
+// library is used instead.
+func currentLinks() (map[string]linkState, error) {
+	list, err := netlink.LinkList()
+	if err != nil {
+		return interfaceLinks()
+	}
+	links := make(map[string]linkState, len(list))
+	for _, link := range list {
+		attrs := link.Attrs()
+		state := linkState{
+			up: attrs.Flags&net.FlagUp != 0 &&
+				(attrs.OperState == netlink.OperUp || attrs.OperState == netlink.OperUnknown),
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, fmt.Errorf("netlink.AddrList: %w", err)
+		}
+		for _, addr := range addrs {
+			state.addrs = append(state.addrs, addr.IP)
+		}
+		links[attrs.Name] = state
+	}
+	return links, nil
+}
+
+// watch subscribes to link and address changes with netlink and checks the
+// interfaces every time one arrives. If that isn't possible then it falls
+// back to polling.
+func (w *LinkWatcher) watch() {
+	linkch := make(chan netlink.LinkUpdate, 16)
+	addrch := make(chan netlink.AddrUpdate, 16)
+	if err := netlink.LinkSubscribe(linkch, w.ctx.Done()); err != nil {
+		w.poll()
+		return
+	}
+	if err := netlink.AddrSubscribe(addrch, w.ctx.Done()); err != nil {
+		w.poll()
+		return
+	}
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case _, ok := <-linkch:
+			if !ok {
+				w.poll()
+				return
+			}
+		case _, ok := <-addrch:
+			if !ok {
+				w.poll()
+				return
+			}
+		case <-w.check:
+		}
+		w.update()
+	}
+}
@@ -0,0 +1,388 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+	"github.com/matrix-org/pinecone/util"
+)
+
+// wsHeaderTimeout is how long a WebSockets client has to send the request
+// headers, so that slow clients can't tie up the listener.
+const wsHeaderTimeout = time.Second * 5
+
+// ListenerManager runs the inbound listeners of a router, passing every
+// connection that they accept to the router. Listeners are named by URI,
+// either "host:port" or "tcp://host:port" for TCP, or "ws://host:port" for
+// WebSockets, the same as static peers. If the host is left out, i.e. ":7777",
+// then separate IPv4 and IPv6 sockets are opened on the same port, so that
+// the listener carries on working if either family is unavailable. Sockets
+// are opened with SO_REUSEPORT where the platform supports it, so that a new
+// daemon can start listening before the old one has stopped.
+type ListenerManager struct {
+	log        types.Logger
+	router     *router.Router
+	config     net.ListenConfig
+	mutex      sync.Mutex
+	_listeners map[string]*listener
+}
+
+// ListenerInfo describes one of the listeners of a ListenerManager.
+type ListenerInfo struct {
+	URI   string   `json:"uri"`
+	Addrs []string `json:"addrs"` // the addresses that the sockets are bound to
+}
+
+// listener is a single listen URI, which may have a socket for each address
+// family.
+type listener struct {
+	uri     string
+	ws      bool
+	sockets []net.Listener
+}
+
+// NewListenerManager creates a listener manager for the given router. It
+// doesn't listen on anything until Listen or SetListeners is called.
+func NewListenerManager(log types.Logger, r *router.Router) *ListenerManager {
+	return &ListenerManager{
+		log:        log,
+		router:     r,
+		config:     net.ListenConfig{Control: reusePort},
+		_listeners: map[string]*listener{},
+	}
+}
+
+// Listen starts listening on the given URI. It is an error to listen on the
+// same URI twice.
+func (m *ListenerManager) Listen(uri string) (ListenerInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m._listen(uri)
+}
+
+// Close stops listening on the given URI. Peerings that were accepted on the
+// listener are left connected.
+func (m *ListenerManager) Close(uri string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	l, ok := m._listeners[uri]
+	if !ok {
+		return fmt.Errorf("not listening on %q", uri)
+	}
+	l.close()
+	delete(m._listeners, uri)
+	return nil
+}
+
+// CloseAll stops listening on every URI.
+func (m *ListenerManager) CloseAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for uri, l := range m._listeners {
+		l.close()
+		delete(m._listeners, uri)
+	}
+}
+
+// SetListeners replaces the listeners with the given set of URIs. Listeners
+// that are in both the old and new sets aren't touched, so their sockets stay
+// open. The first error is returned, but the rest of the URIs are still
+// tried.
+func (m *ListenerManager) SetListeners(uris []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	wanted := make(map[string]struct{}, len(uris))
+	for _, uri := range uris {
+		wanted[uri] = struct{}{}
+	}
+	for uri, l := range m._listeners {
+		if _, ok := wanted[uri]; !ok {
+			l.close()
+			delete(m._listeners, uri)
+		}
+	}
+	var first error
+	for _, uri := range uris {
+		if _, ok := m._listeners[uri]; ok {
+			continue
+		}
+		if _, err := m._listen(uri); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Listeners returns the listeners that are currently open, sorted by URI.
+func (m *ListenerManager) Listeners() []ListenerInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	infos := make([]ListenerInfo, 0, len(m._listeners))
+	for _, l := range m._listeners {
+		infos = append(infos, l.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].URI < infos[j].URI
+	})
+	return infos
+}
+
+// PublicURIs returns the URIs that other nodes could reach the listeners on,
+// i.e. to advertise using Router.AdvertisePEX. Sockets that are bound to a
+// specific address are only included if that address is public, and sockets
+// that are bound to the unspecified address are included once for every
+// public address on the local interfaces of the same family. Nodes behind NAT
+// won't have any public addresses of their own, so the list may be empty.
+func (m *ListenerManager) PublicURIs() []string {
+	local, err := net.InterfaceAddrs()
+	if err != nil {
+		m.log.Println("Failed to list interface addresses:", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seen := map[string]struct{}{}
+	var uris []string
+	for _, l := range m._listeners {
+		for _, s := range l.sockets {
+			addr, ok := s.Addr().(*net.TCPAddr)
+			if !ok {
+				continue
+			}
+			for _, ip := range advertisableIPs(addr.IP, local) {
+				uri := net.JoinHostPort(ip.String(), strconv.Itoa(addr.Port))
+				if l.ws {
+					uri = "ws://" + uri
+				}
+				if _, ok := seen[uri]; !ok {
+					seen[uri] = struct{}{}
+					uris = append(uris, uri)
+				}
+			}
+		}
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+func (m *ListenerManager) _listen(uri string) (ListenerInfo, error) {
+	if _, ok := m._listeners[uri]; ok {
+		return ListenerInfo{}, fmt.Errorf("already listening on %q", uri)
+	}
+	ws, host, port, err := parseListenURI(uri)
+	if err != nil {
+		return ListenerInfo{}, err
+	}
+	l := &listener{uri: uri, ws: ws}
+	if host != "" {
+		s, err := m.config.Listen(context.Background(), "tcp", net.JoinHostPort(host, port))
+		if err != nil {
+			return ListenerInfo{}, fmt.Errorf("net.Listen: %w", err)
+		}
+		l.sockets = append(l.sockets, s)
+	} else {
+		// Go sets IPV6_V6ONLY on "tcp6" sockets, so the IPv4 and IPv6
+		// sockets can share the port. If the port was left for the kernel
+		// to choose then the IPv6 socket takes whatever port the IPv4 one
+		// was given.
+		var errs []string
+		for _, network := range []string{"tcp4", "tcp6"} {
+			s, err := m.config.Listen(context.Background(), network, net.JoinHostPort("", port))
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", network, err))
+				continue
+			}
+			l.sockets = append(l.sockets, s)
+			if port == "0" {
+				port = strconv.Itoa(s.Addr().(*net.TCPAddr).Port)
+			}
+		}
+		if len(l.sockets) == 0 {
+			return ListenerInfo{}, fmt.Errorf("net.Listen: %s", strings.Join(errs, ", "))
+		}
+		for _, err := range errs {
+			m.log.Println("Listener", uri, "is only partly open:", err)
+		}
+	}
+	for _, s := range l.sockets {
+		if ws {
+			m.log.Printf("Listening for WebSockets on http://%s\n", s.Addr())
+			go m.serveWS(s)
+		} else {
+			m.log.Println("Listening on", s.Addr())
+			go m.serveTCP(s)
+		}
+	}
+	m._listeners[uri] = l
+	return l.info(), nil
+}
+
+// serveTCP accepts TCP connections until the socket is closed.
+func (m *ListenerManager) serveTCP(s net.Listener) {
+	for {
+		conn, err := s.Accept()
+		if err != nil {
+			m.log.Println("Stopped listening on", s.Addr())
+			return
+		}
+
+		// The handshake happens in the background so that a connection
+		// which is slow to complete it can't hold up the accept loop.
+		// The router limits how many handshakes can run at once.
+		go func() {
+			if _, err := m.router.Connect(
+				conn,
+				router.ConnectionURI(conn.RemoteAddr().String()),
+				router.ConnectionPeerType(router.PeerTypeRemote),
+			); err != nil {
+				m.log.Println("Inbound TCP connection", conn.RemoteAddr(), "failed:", err)
+				_ = conn.Close()
+				return
+			}
+
+			m.log.Println("Inbound TCP connection", conn.RemoteAddr(), "is connected")
+		}()
+	}
+}
+
+// serveWS accepts WebSockets connections until the socket is closed.
+func (m *ListenerManager) serveWS(s net.Listener) {
+	var upgrader = websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			m.log.Println(err)
+			return
+		}
+
+		if _, err := m.router.Connect(
+			util.WrapWebSocketConn(conn),
+			router.ConnectionURI(conn.RemoteAddr().String()),
+			router.ConnectionPeerType(router.PeerTypeRemote),
+			router.ConnectionZone("websocket"),
+		); err != nil {
+			m.log.Println("Inbound WS connection", conn.RemoteAddr(), "failed:", err)
+			return
+		}
+
+		m.log.Println("Inbound WS connection", conn.RemoteAddr(), "is connected")
+	})
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: wsHeaderTimeout,
+	}
+	_ = server.Serve(s)
+	m.log.Println("Stopped listening for WebSockets on", s.Addr())
+}
+
+func (l *listener) close() {
+	for _, s := range l.sockets {
+		_ = s.Close()
+	}
+}
+
+func (l *listener) info() ListenerInfo {
+	info := ListenerInfo{URI: l.uri}
+	for _, s := range l.sockets {
+		info.Addrs = append(info.Addrs, s.Addr().String())
+	}
+	return info
+}
+
+// parseListenURI splits a listen URI into whether it is for WebSockets, and
+// the host and port to listen on.
+func parseListenURI(uri string) (bool, string, string, error) {
+	addr, ws := uri, false
+	switch {
+	case strings.HasPrefix(uri, "ws://"):
+		addr, ws = strings.TrimPrefix(uri, "ws://"), true
+	case strings.HasPrefix(uri, "tcp://"):
+		addr = strings.TrimPrefix(uri, "tcp://")
+	case strings.Contains(uri, "://"):
+		return false, "", "", fmt.Errorf("unsupported listen URI %q", uri)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, "", "", fmt.Errorf("net.SplitHostPort: %w", err)
+	}
+	if port == "" {
+		port = "0"
+	}
+	return ws, host, port, nil
+}
+
+// privateNets are the ranges that are only reachable locally, or from
+// behind the same NAT, so aren't worth advertising.
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", // RFC 1918
+		"100.64.0.0/10", // carrier-grade NAT, RFC 6598
+		"fc00::/7",      // unique local addresses, RFC 4193
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPublicIP returns true if the address can be reached from the internet,
+// as far as we can tell from the address alone.
+func isPublicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// advertisableIPs returns the public addresses that a socket bound to the
+// given address can be reached on, given the addresses of the local
+// interfaces.
+func advertisableIPs(bound net.IP, local []net.Addr) []net.IP {
+	if !bound.IsUnspecified() {
+		if isPublicIP(bound) {
+			return []net.IP{bound}
+		}
+		return nil
+	}
+	v4 := bound.To4() != nil
+	var ips []net.IP
+	for _, a := range local {
+		n, ok := a.(*net.IPNet)
+		if !ok || (n.IP.To4() != nil) != v4 || !isPublicIP(n.IP) {
+			continue
+		}
+		ips = append(ips, n.IP)
+	}
+	return ips
+}
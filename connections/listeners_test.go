@@ -0,0 +1,121 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseListenURI(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		uri  string
+		ws   bool
+		host string
+		port string
+		err  bool
+	}{
+		{name: "Bare", uri: "1.2.3.4:7777", host: "1.2.3.4", port: "7777"},
+		{name: "TCP", uri: "tcp://1.2.3.4:7777", host: "1.2.3.4", port: "7777"},
+		{name: "WebSockets", uri: "ws://1.2.3.4:7777", ws: true, host: "1.2.3.4", port: "7777"},
+		{name: "NoHost", uri: ":7777", port: "7777"},
+		{name: "NoPort", uri: "tcp://1.2.3.4:", host: "1.2.3.4", port: "0"},
+		{name: "IPv6", uri: "ws://[::1]:7777", ws: true, host: "::1", port: "7777"},
+		{name: "UnsupportedScheme", uri: "udp://1.2.3.4:7777", err: true},
+		{name: "MissingPort", uri: "tcp://1.2.3.4", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ws, host, port, err := parseListenURI(tc.uri)
+			switch {
+			case tc.err && err == nil:
+				t.Fatalf("expected an error, got none")
+			case !tc.err && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.err:
+				return
+			}
+			if ws != tc.ws || host != tc.host || port != tc.port {
+				t.Fatalf("expected (%v, %q, %q), got (%v, %q, %q)", tc.ws, tc.host, tc.port, ws, host, port)
+			}
+		})
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip     string
+		public bool
+	}{
+		{"1.2.3.4", true},
+		{"2001:db8::1", true},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"127.0.0.1", false},
+		{"169.254.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+	} {
+		if public := isPublicIP(net.ParseIP(tc.ip)); public != tc.public {
+			t.Errorf("%s: expected public %v, got %v", tc.ip, tc.public, public)
+		}
+	}
+}
+
+func TestAdvertisableIPs(t *testing.T) {
+	var local []net.Addr
+	for _, cidr := range []string{
+		"127.0.0.1/8", "192.168.1.2/24", "1.2.3.4/24", "5.6.7.8/24",
+		"::1/128", "fe80::1/64", "2001:db8::1/64",
+	} {
+		ip, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.IP = ip
+		local = append(local, n)
+	}
+	// Addresses that aren't an *net.IPNet are skipped.
+	local = append(local, &net.IPAddr{IP: net.ParseIP("9.9.9.9")})
+
+	for _, tc := range []struct {
+		name  string
+		bound string
+		ips   []string
+	}{
+		{name: "PublicIPv4", bound: "1.2.3.4", ips: []string{"1.2.3.4"}},
+		{name: "PrivateIPv4", bound: "192.168.1.2"},
+		{name: "Loopback", bound: "127.0.0.1"},
+		{name: "UnspecifiedIPv4", bound: "0.0.0.0", ips: []string{"1.2.3.4", "5.6.7.8"}},
+		{name: "UnspecifiedIPv6", bound: "::", ips: []string{"2001:db8::1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, ip := range advertisableIPs(net.ParseIP(tc.bound), local) {
+				got = append(got, ip.String())
+			}
+			if !reflect.DeepEqual(got, tc.ips) {
+				t.Fatalf("expected %v, got %v", tc.ips, got)
+			}
+		})
+	}
+}
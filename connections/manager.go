@@ -31,6 +31,10 @@ import (
 
 const interval = time.Second * 5
 
+// dialStagger is how long to wait for one address of a static peer before
+// also trying the next one, as recommended for Happy Eyeballs in RFC 8305.
+const dialStagger = time.Millisecond * 250
+
 type ConnectionManager struct {
 	phony.Inbox
 	ctx             context.Context
@@ -40,13 +44,34 @@ type ConnectionManager struct {
 	ws              *websocket.DialOptions
 	_staticPeers    map[string]*connectionAttempts
 	_connectedPeers map[string]struct{}
+	_dialers        map[string]DialerFn
+	_seeds          map[string]*seedDomain
+	_resolver       SeedResolver
 }
 
+// DialerFn dials a static peer that has a URI with a scheme registered using
+// RegisterDialer. It returns a connection that is ready for the Pinecone
+// handshake.
+type DialerFn func(ctx context.Context, uri string) (net.Conn, error)
+
 type connectionAttempts struct {
+	uris     []string        // the URI of the peer, followed by any fallbacks
+	key      types.PublicKey // the key that the peer must have, if not zero
+	seed     string          // the seed domain that the peer came from, if any
 	attempts float64
 	next     time.Time
 }
 
+// connected returns true if the peer is connected using any of its URIs.
+func (a *connectionAttempts) connected(peers map[string]struct{}) bool {
+	for _, uri := range a.uris {
+		if _, ok := peers[uri]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func NewConnectionManager(r *router.Router, client *http.Client) *ConnectionManager {
 	ctx, cancel := context.WithCancel(context.Background())
 	m := &ConnectionManager{
@@ -59,11 +84,17 @@ func NewConnectionManager(r *router.Router, client *http.Client) *ConnectionMana
 		},
 		_staticPeers:    map[string]*connectionAttempts{},
 		_connectedPeers: map[string]struct{}{},
+		_dialers:        map[string]DialerFn{},
+		_seeds:          map[string]*seedDomain{},
+		_resolver:       net.DefaultResolver,
 	}
 	if m.ws.HTTPClient == nil {
 		m.ws.HTTPClient = http.DefaultClient
 	}
 	time.AfterFunc(interval, m._worker)
+	time.AfterFunc(seedRefreshInterval, func() {
+		m.Act(nil, m._refreshSeeds)
+	})
 	return m
 }
 
@@ -85,41 +116,132 @@ func (m *ConnectionManager) _connect(uri string) {
 			attempts.next = time.Now()
 		}
 	}
+	uris := []string{uri}
+	var key types.PublicKey
+	if attempts := m._staticPeers[uri]; attempts != nil {
+		uris, key = attempts.uris, attempts.key
+	}
 	ctx, cancel := context.WithTimeout(m.ctx, interval)
 	defer cancel()
-	var parent net.Conn
+	parent, connected, err := m._dialAny(ctx, uris)
+	if err != nil {
+		result(err)
+		return
+	}
+	options := []router.ConnectionOption{
+		router.ConnectionZone("static"),
+		router.ConnectionPeerType(router.PeerTypeRemote),
+		router.ConnectionURI(connected),
+	}
+	if !key.IsZero() {
+		// Refuse anyone else during the handshake, before a peering is set
+		// up with them.
+		options = append(options, router.ConnectionPublicKey(key), router.ConnectionVerifyPublicKey(true))
+	}
+	_, err = m.router.Connect(parent, options...)
+	result(err)
+}
+
+// _dialerFor returns the function that dials the given URI. The returned
+// function is safe to call from outside of the actor.
+func (m *ConnectionManager) _dialerFor(uri string) DialerFn {
+	if dialer, custom := m._dialers[uriScheme(uri)]; custom {
+		return dialer
+	}
 	switch {
 	case strings.HasPrefix(uri, "ws://"):
 		fallthrough
 	case strings.HasPrefix(uri, "wss://"):
-		c, _, err := websocket.Dial(ctx, uri, m.ws)
-		if err != nil {
-			result(err)
-			return
+		return func(ctx context.Context, uri string) (net.Conn, error) {
+			c, _, err := websocket.Dial(ctx, uri, m.ws)
+			if err != nil {
+				return nil, err
+			}
+			return websocket.NetConn(m.ctx, c, websocket.MessageBinary), nil
 		}
-		parent = websocket.NetConn(m.ctx, c, websocket.MessageBinary)
 	default:
-		var err error
-		dialer := net.Dialer{
-			Timeout: interval,
+		// If the host name resolves to both IPv4 and IPv6 addresses then
+		// the dialer will already race them against each other.
+		return func(ctx context.Context, uri string) (net.Conn, error) {
+			dialer := net.Dialer{
+				Timeout: interval,
+			}
+			return dialer.DialContext(ctx, "tcp", uri)
 		}
-		parent, err = dialer.DialContext(ctx, "tcp", uri)
-		if err != nil {
-			result(err)
-			return
+	}
+}
+
+// _dialAny dials the given URIs of a static peer, returning the first
+// connection that succeeds along with the URI that it was dialled with. To
+// connect quickly when some of the URIs don't work, i.e. IPv6 on a network
+// without IPv6 connectivity, the next URI is dialled if the previous one
+// hasn't connected within dialStagger or as soon as it fails, without waiting
+// for the earlier dials to give up. Once one dial succeeds, the others are
+// cancelled and any other connections that they make are closed.
+func (m *ConnectionManager) _dialAny(ctx context.Context, uris []string) (net.Conn, string, error) {
+	if len(uris) == 1 {
+		conn, err := m._dialerFor(uris[0])(ctx, uris[0])
+		if err == nil && conn == nil {
+			err = fmt.Errorf("no parent connection")
 		}
+		return conn, uris[0], err
 	}
-	if parent == nil {
-		result(fmt.Errorf("no parent connection"))
-		return
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type dialResult struct {
+		uri  string
+		conn net.Conn
+		err  error
 	}
-	_, err := m.router.Connect(
-		parent,
-		router.ConnectionZone("static"),
-		router.ConnectionPeerType(router.PeerTypeRemote),
-		router.ConnectionURI(uri),
-	)
-	result(err)
+	results := make(chan dialResult, len(uris))
+	started, pending := 0, 0
+	var stagger <-chan time.Time
+	start := func() {
+		uri, dialer := uris[started], m._dialerFor(uris[started])
+		started++
+		pending++
+		go func() {
+			conn, err := dialer(ctx, uri)
+			if err == nil && conn == nil {
+				err = fmt.Errorf("no parent connection")
+			}
+			results <- dialResult{uri, conn, err}
+		}()
+		if started < len(uris) {
+			stagger = time.After(dialStagger)
+		} else {
+			stagger = nil
+		}
+	}
+
+	start()
+	errs := make([]string, 0, len(uris))
+	for pending > 0 {
+		select {
+		case <-stagger:
+			start()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Any dials that are still going will be cancelled, but one
+				// of them might connect before it notices, so close those.
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, r.uri, nil
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s", r.uri, r.err))
+			if started < len(uris) {
+				start()
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("failed to dial any address: %s", strings.Join(errs, "; "))
 }
 
 func (m *ConnectionManager) _worker() {
@@ -131,7 +253,7 @@ func (m *ConnectionManager) _worker() {
 	}
 
 	for peer, attempts := range m._staticPeers {
-		if _, ok := m._connectedPeers[peer]; !ok && time.Now().After(attempts.next) {
+		if !attempts.connected(m._connectedPeers) && time.Now().After(attempts.next) {
 			uri := peer
 			m.Act(nil, func() {
 				m._connect(uri)
@@ -146,42 +268,138 @@ func (m *ConnectionManager) _worker() {
 	}
 }
 
-func (m *ConnectionManager) AddPeer(uri string) {
-	phony.Block(m, func() {
-		if _, existing := m._staticPeers[uri]; existing {
-			return
+// RetryNow forgets about any backoff and tries to connect to all static peers
+// that aren't connected at the moment, rather than waiting for their next
+// attempt. It is useful when the network has changed, e.g. a new interface
+// has come up, as the earlier failures are probably no longer relevant.
+func (m *ConnectionManager) RetryNow() {
+	m.Act(nil, func() {
+		connected := map[string]struct{}{}
+		for _, peerInfo := range m.router.Peers() {
+			connected[peerInfo.URI] = struct{}{}
 		}
-		m._staticPeers[uri] = &connectionAttempts{
-			attempts: 0,
-			next:     time.Now(),
+		for peer, attempts := range m._staticPeers {
+			attempts.attempts = 0
+			attempts.next = time.Now()
+			if !attempts.connected(connected) {
+				uri := peer
+				m.Act(nil, func() {
+					m._connect(uri)
+				})
+			}
 		}
-		m._connect(uri)
+	})
+}
+
+// RegisterDialer sets the function that will be used to dial static peers
+// with URIs that start with the given scheme, i.e. "quic" for "quic://...".
+// This allows transports to be added without the connection manager having
+// to depend on them.
+func (m *ConnectionManager) RegisterDialer(scheme string, fn DialerFn) {
+	phony.Block(m, func() {
+		m._dialers[scheme] = fn
+	})
+}
+
+// uriScheme returns the scheme of the URI, or an empty string if it doesn't
+// have one, i.e. for a plain "host:port" address.
+func uriScheme(uri string) string {
+	if i := strings.Index(uri, "://"); i > 0 {
+		return uri[:i]
+	}
+	return ""
+}
+
+// AddPeer adds a static peer. If the peer can also be reached using other
+// URIs, i.e. on both IPv4 and IPv6 addresses or using a WebSocket when TCP
+// is blocked, then those can be given as fallbacks. The URIs are dialled in
+// the order given, each one starting shortly after the last unless the last
+// one has already connected, and the first one to connect is kept.
+func (m *ConnectionManager) AddPeer(uri string, fallbacks ...string) {
+	phony.Block(m, func() {
+		m._addPeer(uri, fallbacks...)
 	})
 }
 
 func (m *ConnectionManager) RemovePeer(uri string) {
 	phony.Block(m, func() {
-		if _, existing := m._staticPeers[uri]; !existing {
-			return
+		m._removePeer(uri)
+	})
+}
+
+// SetStaticPeers replaces the set of static peers with the given URIs. Peers
+// that are no longer in the set will be disconnected and new peers will be
+// connected, but peers that are in both the old and new sets will be left
+// alone, so that their connections aren't interrupted. Peers that were found
+// using seed domains aren't affected.
+func (m *ConnectionManager) SetStaticPeers(uris []string) {
+	phony.Block(m, func() {
+		wanted := make(map[string]struct{}, len(uris))
+		for _, uri := range uris {
+			wanted[uri] = struct{}{}
 		}
-		delete(m._staticPeers, uri)
-		for _, peerInfo := range m.router.Peers() {
-			if peerInfo.URI == uri {
-				m.router.Disconnect(types.SwitchPortID(peerInfo.Port), fmt.Errorf("removing peer"))
+		for uri, attempts := range m._staticPeers {
+			if _, ok := wanted[uri]; !ok && attempts.seed == "" {
+				m._removePeer(uri)
 			}
 		}
+		for uri := range wanted {
+			m._addPeer(uri)
+		}
 	})
 }
 
-func (m *ConnectionManager) RemovePeers() {
+// StaticPeers returns the URIs of all configured static peers, not including
+// any that were found using seed domains.
+func (m *ConnectionManager) StaticPeers() []string {
+	var uris []string
 	phony.Block(m, func() {
-		for _, peerInfo := range m.router.Peers() {
-			if _, ok := m._staticPeers[peerInfo.URI]; ok {
-				m.router.Disconnect(types.SwitchPortID(peerInfo.Port), fmt.Errorf("removing peer"))
+		uris = make([]string, 0, len(m._staticPeers))
+		for uri, attempts := range m._staticPeers {
+			if attempts.seed == "" {
+				uris = append(uris, uri)
 			}
 		}
+	})
+	return uris
+}
+
+func (m *ConnectionManager) _addPeer(uri string, fallbacks ...string) {
+	if attempts, existing := m._staticPeers[uri]; existing {
+		// If the peer was found using a seed domain then it now belongs
+		// to the caller, so that it isn't removed when the seeds change.
+		attempts.seed = ""
+		return
+	}
+	m._staticPeers[uri] = &connectionAttempts{
+		uris:     append([]string{uri}, fallbacks...),
+		attempts: 0,
+		next:     time.Now(),
+	}
+	m._connect(uri)
+}
+
+func (m *ConnectionManager) _removePeer(uri string) {
+	attempts, existing := m._staticPeers[uri]
+	if !existing {
+		return
+	}
+	delete(m._staticPeers, uri)
+	uris := map[string]struct{}{}
+	for _, uri := range attempts.uris {
+		uris[uri] = struct{}{}
+	}
+	for _, peerInfo := range m.router.Peers() {
+		if _, ok := uris[peerInfo.URI]; ok {
+			m.router.DisconnectGeneration(types.SwitchPortID(peerInfo.Port), peerInfo.Generation, fmt.Errorf("removing peer"))
+		}
+	}
+}
+
+func (m *ConnectionManager) RemovePeers() {
+	phony.Block(m, func() {
 		for uri := range m._staticPeers {
-			delete(m._staticPeers, uri)
+			m._removePeer(uri)
 		}
 	})
 }
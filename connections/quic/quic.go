@@ -0,0 +1,222 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quic carries Pinecone peerings over QUIC instead of TCP. Each
+// peering is a single bidirectional stream inside a QUIC connection. Since
+// QUIC identifies connections by connection ID rather than by address, a
+// peering isn't torn down just because a NAT rebinds the port, and when a
+// connection does have to be made again, i.e. after a mobile device changes
+// networks, the TLS session ticket from the last connection lets it resume
+// with 0-RTT. The Pinecone handshake still runs over the stream, so the
+// public keys of both sides are verified in the usual way and the TLS layer
+// isn't relied upon for authentication.
+package quic
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	quicgo "github.com/lucas-clemente/quic-go"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Scheme is the URI scheme for QUIC peers, as in "quic://host:port". Use it
+// with connections.ConnectionManager.RegisterDialer.
+const Scheme = "quic"
+
+// alpnProtocol is the ALPN protocol negotiated for Pinecone peerings, which
+// keeps them apart from any other QUIC traffic on the same port.
+const alpnProtocol = "pinecone"
+
+// Timeouts for QUIC peerings. Keepalives stop NAT mappings from expiring
+// while the peering is idle, and the idle timeout matches the 5 seconds that
+// the router waits for Pinecone keepalives by default, since a connection
+// that has been silent for that long is already dead to the router.
+const (
+	handshakeTimeout = time.Second * 5
+	idleTimeout      = time.Second * 5
+)
+
+// Transport dials and accepts QUIC peerings for a router.
+type Transport struct {
+	log    types.Logger
+	router *router.Router
+	client *tls.Config
+	server *tls.Config
+	config *quicgo.Config
+	stats  *statsTracer
+}
+
+// NewTransport creates a QUIC transport for the given router. The TLS
+// certificate is generated from the router's key.
+func NewTransport(log types.Logger, r *router.Router) *Transport {
+	if log == nil {
+		log = stdlog.New(ioutil.Discard, "", 0)
+	}
+	cert := generateTLSCertificate(r)
+	stats := newStatsTracer()
+	return &Transport{
+		log:    log,
+		router: r,
+		client: &tls.Config{
+			// The Pinecone handshake verifies the remote public key, so
+			// there is nothing for TLS to verify here.
+			InsecureSkipVerify: true, // nolint:gosec
+			NextProtos:         []string{alpnProtocol},
+			// Remembering session tickets allows reconnections to the same
+			// peer to use 0-RTT.
+			ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		},
+		server: &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			NextProtos:   []string{alpnProtocol},
+		},
+		config: &quicgo.Config{
+			HandshakeIdleTimeout:    handshakeTimeout,
+			MaxIdleTimeout:          idleTimeout,
+			KeepAlive:               true,
+			DisablePathMTUDiscovery: true,
+			Tracer:                  stats,
+		},
+		stats: stats,
+	}
+}
+
+// Listen starts accepting QUIC peerings on the given UDP address. Closing
+// the returned listener stops accepting new peerings and closes the ones
+// that were accepted on it.
+func (t *Transport) Listen(addr string) (quicgo.EarlyListener, error) {
+	listener, err := quicgo.ListenAddrEarly(addr, t.server, t.config)
+	if err != nil {
+		return nil, fmt.Errorf("quic.ListenAddrEarly: %w", err)
+	}
+	t.log.Println("Listening for QUIC on", listener.Addr())
+	go func() {
+		for {
+			session, err := listener.Accept(context.Background())
+			if err != nil {
+				t.log.Println("Stopped listening for QUIC on", listener.Addr())
+				return
+			}
+			go t.accept(session)
+		}
+	}()
+	return listener, nil
+}
+
+// accept waits for the remote side to open the peering stream and then
+// hands it to the router.
+func (t *Transport) accept(session quicgo.EarlySession) {
+	ctx, cancel := context.WithTimeout(session.Context(), handshakeTimeout)
+	defer cancel()
+	stream, err := session.AcceptStream(ctx)
+	if err != nil {
+		_ = session.CloseWithError(0, "no stream")
+		return
+	}
+	conn := &streamConn{stream, session, t.stats.statsFor(session)}
+	if _, err := t.router.Connect(
+		conn,
+		router.ConnectionURI(session.RemoteAddr().String()),
+		router.ConnectionPeerType(router.PeerTypeRemote),
+		router.ConnectionZone(Scheme),
+	); err != nil {
+		t.log.Println("Inbound QUIC connection", session.RemoteAddr(), "failed:", err)
+		_ = conn.Close()
+		return
+	}
+	t.log.Println("Inbound QUIC connection", session.RemoteAddr(), "is connected")
+}
+
+// DialContext dials a QUIC peer, given either as "quic://host:port" or just
+// "host:port", and returns a connection that is ready to be passed to the
+// router. It can be registered with the connection manager as the dialer for
+// the "quic" scheme.
+func (t *Transport) DialContext(ctx context.Context, uri string) (net.Conn, error) {
+	addr := strings.TrimPrefix(uri, Scheme+"://")
+	session, err := quicgo.DialAddrEarlyContext(ctx, addr, t.client, t.config)
+	if err != nil {
+		return nil, fmt.Errorf("quic.DialAddrEarlyContext: %w", err)
+	}
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		_ = session.CloseWithError(0, "no stream")
+		return nil, fmt.Errorf("session.OpenStreamSync: %w", err)
+	}
+	return &streamConn{stream, session, t.stats.statsFor(session)}, nil
+}
+
+// streamConn makes a QUIC stream usable as a net.Conn for the router. Closing
+// it closes the whole QUIC connection, since each connection only carries a
+// single peering. It also reports the round trip time and loss of the QUIC
+// connection to the router, see router.TransportStats.
+type streamConn struct {
+	quicgo.Stream
+	session quicgo.Session
+	stats   *linkStats // nil if the connection isn't being traced
+}
+
+func (s *streamConn) LocalAddr() net.Addr {
+	return s.session.LocalAddr()
+}
+
+func (s *streamConn) RemoteAddr() net.Addr {
+	return s.session.RemoteAddr()
+}
+
+func (s *streamConn) Close() error {
+	_ = s.Stream.Close()
+	return s.session.CloseWithError(0, "peering closed")
+}
+
+func generateTLSCertificate(r *router.Router) *tls.Certificate {
+	private, public := r.PrivateKey(), r.PublicKey()
+	id := hex.EncodeToString(public[:])
+
+	template := x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: id,
+		},
+		SerialNumber: big.NewInt(1),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 365),
+		DNSNames:     []string{id},
+	}
+	certDER, err := x509.CreateCertificate(
+		rand.Reader,
+		&template,
+		&template,
+		ed25519.PublicKey(public[:]),
+		ed25519.PrivateKey(private[:]),
+	)
+	if err != nil {
+		panic(fmt.Errorf("x509.CreateCertificate: %w", err))
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  ed25519.PrivateKey(private[:]),
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quic
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func newTestRouter(t *testing.T) *router.Router {
+	t.Helper()
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := router.NewRouter(nil, sk, false)
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	return r
+}
+
+func waitFor(t *testing.T, what string, fn func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 10)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// quicPeer returns the peering on the given router that was made over QUIC,
+// if there is one.
+func quicPeer(r *router.Router) (router.PeerInfo, bool) {
+	for _, p := range r.Peers() {
+		if p.Zone == Scheme {
+			return p, true
+		}
+	}
+	return router.PeerInfo{}, false
+}
+
+func TestTransportPeering(t *testing.T) {
+	ra, rb := newTestRouter(t), newTestRouter(t)
+	ta, tb := NewTransport(nil, ra), NewTransport(nil, rb)
+
+	listener, err := tb.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	uri := Scheme + "://" + listener.Addr().String()
+	conn, err := ta.DialContext(ctx, uri)
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	if got, want := conn.RemoteAddr().String(), listener.Addr().String(); got != want {
+		t.Fatalf("expected remote address %s, got %s", want, got)
+	}
+	if _, err = ra.Connect(
+		conn,
+		router.ConnectionURI(uri),
+		router.ConnectionPeerType(router.PeerTypeRemote),
+		router.ConnectionZone(Scheme),
+	); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+
+	// The accepting side hands the stream to its router, and the Pinecone
+	// handshake then verifies the keys of both sides.
+	waitFor(t, "the accepted peering", func() bool {
+		p, ok := quicPeer(rb)
+		pk := ra.PublicKey()
+		return ok && p.PublicKey == hex.EncodeToString(pk[:])
+	})
+	waitFor(t, "the routers to converge", func() bool {
+		return ra.NextHop(nil, types.TypeVirtualSnakeRouted, rb.PublicKey()) == rb.PublicKey()
+	})
+
+	// The link statistics of the QUIC connection are reported to the router.
+	waitFor(t, "transport statistics", func() bool {
+		p, ok := quicPeer(ra)
+		return ok && p.Transport != nil && p.Transport.RTT > 0
+	})
+
+	// Closing the connection closes the whole QUIC connection, so the
+	// accepting side loses the peering too.
+	_ = conn.Close()
+	waitFor(t, "the peering to go away", func() bool {
+		_, ok := quicPeer(rb)
+		return !ok
+	})
+}
+
+func TestTransportDialWithoutScheme(t *testing.T) {
+	ra, rb := newTestRouter(t), newTestRouter(t)
+	ta, tb := NewTransport(nil, ra), NewTransport(nil, rb)
+
+	listener, err := tb.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	conn, err := ta.DialContext(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestTransportDialFailure(t *testing.T) {
+	ta := NewTransport(nil, newTestRouter(t))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	// Nothing is listening on the port, so the dial fails once the
+	// context expires.
+	if _, err := ta.DialContext(ctx, Scheme+"://127.0.0.1:1"); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+}
+
+func TestGenerateTLSCertificate(t *testing.T) {
+	r := newTestRouter(t)
+	cert := generateTLSCertificate(r)
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	pk := r.PublicKey()
+	if id := hex.EncodeToString(pk[:]); parsed.Subject.CommonName != id {
+		t.Fatalf("expected common name %s, got %s", id, parsed.Subject.CommonName)
+	}
+	public, ok := parsed.PublicKey.(ed25519.PublicKey)
+	if !ok || !public.Equal(ed25519.PublicKey(pk[:])) {
+		t.Fatalf("certificate is not for the router's key")
+	}
+}
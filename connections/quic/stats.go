@@ -0,0 +1,176 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quic
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	quicgo "github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/matrix-org/pinecone/router"
+)
+
+// linkStats collects the round trip time and packet loss of a single QUIC
+// connection from the congestion controller, see statsTracer.
+type linkStats struct {
+	mutex sync.Mutex
+	rtt   time.Duration
+	sent  uint64
+	lost  uint64
+}
+
+func (s *linkStats) get() router.LinkStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := router.LinkStats{RTT: s.rtt}
+	if s.sent > 0 {
+		stats.Loss = float64(s.lost) / float64(s.sent)
+	}
+	return stats
+}
+
+// TransportStats reports the round trip time and loss of the QUIC connection
+// to the router, see router.TransportStats.
+func (s *streamConn) TransportStats() router.LinkStats {
+	if s.stats == nil {
+		return router.LinkStats{}
+	}
+	return s.stats.get()
+}
+
+// statsTracer hooks into quic-go's connection tracing so that the link
+// statistics of each connection can be looked up from its session.
+type statsTracer struct {
+	mutex sync.Mutex
+	conns map[uint64]*linkStats // by tracing ID, see quicgo.SessionTracingKey
+}
+
+func newStatsTracer() *statsTracer {
+	return &statsTracer{
+		conns: make(map[uint64]*linkStats),
+	}
+}
+
+// statsFor returns the link statistics for the session, or nil if it isn't
+// being traced.
+func (t *statsTracer) statsFor(session quicgo.Session) *linkStats {
+	id, ok := session.Context().Value(quicgo.SessionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.conns[id]
+}
+
+func (t *statsTracer) TracerForConnection(ctx context.Context, _ logging.Perspective, _ logging.ConnectionID) logging.ConnectionTracer {
+	id, ok := ctx.Value(quicgo.SessionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	stats := &linkStats{}
+	t.mutex.Lock()
+	t.conns[id] = stats
+	t.mutex.Unlock()
+	return &connTracer{
+		stats: stats,
+		close: func() {
+			t.mutex.Lock()
+			delete(t.conns, id)
+			t.mutex.Unlock()
+		},
+	}
+}
+
+func (t *statsTracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+
+func (t *statsTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+// connTracer updates the link statistics for a single connection. Only the
+// events that matter for the statistics do anything.
+type connTracer struct {
+	stats *linkStats
+	close func()
+}
+
+func (c *connTracer) SentPacket(*logging.ExtendedHeader, logging.ByteCount, *logging.AckFrame, []logging.Frame) {
+	c.stats.mutex.Lock()
+	c.stats.sent++
+	c.stats.mutex.Unlock()
+}
+
+func (c *connTracer) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+	c.stats.mutex.Lock()
+	c.stats.lost++
+	c.stats.mutex.Unlock()
+}
+
+func (c *connTracer) UpdatedMetrics(rttStats *logging.RTTStats, _, _ logging.ByteCount, _ int) {
+	c.stats.mutex.Lock()
+	c.stats.rtt = rttStats.SmoothedRTT()
+	c.stats.mutex.Unlock()
+}
+
+func (c *connTracer) Close() {
+	c.close()
+}
+
+func (c *connTracer) StartedConnection(_, _ net.Addr, _, _ logging.ConnectionID) {}
+
+func (c *connTracer) NegotiatedVersion(_ logging.VersionNumber, _, _ []logging.VersionNumber) {}
+
+func (c *connTracer) ClosedConnection(error) {}
+
+func (c *connTracer) SentTransportParameters(*logging.TransportParameters) {}
+
+func (c *connTracer) ReceivedTransportParameters(*logging.TransportParameters) {}
+
+func (c *connTracer) RestoredTransportParameters(*logging.TransportParameters) {}
+
+func (c *connTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {}
+
+func (c *connTracer) ReceivedRetry(*logging.Header) {}
+
+func (c *connTracer) ReceivedPacket(*logging.ExtendedHeader, logging.ByteCount, []logging.Frame) {}
+
+func (c *connTracer) BufferedPacket(logging.PacketType) {}
+
+func (c *connTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {}
+
+func (c *connTracer) AcknowledgedPacket(logging.EncryptionLevel, logging.PacketNumber) {}
+
+func (c *connTracer) UpdatedCongestionState(logging.CongestionState) {}
+
+func (c *connTracer) UpdatedPTOCount(uint32) {}
+
+func (c *connTracer) UpdatedKeyFromTLS(logging.EncryptionLevel, logging.Perspective) {}
+
+func (c *connTracer) UpdatedKey(logging.KeyPhase, bool) {}
+
+func (c *connTracer) DroppedEncryptionLevel(logging.EncryptionLevel) {}
+
+func (c *connTracer) DroppedKey(logging.KeyPhase) {}
+
+func (c *connTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {}
+
+func (c *connTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel) {}
+
+func (c *connTracer) LossTimerCanceled() {}
+
+func (c *connTracer) Debug(_, _ string) {}
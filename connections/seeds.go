@@ -0,0 +1,279 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// seedRefreshInterval is how often the records for seed domains are looked up
+// again, so that changes to the seed nodes reach clients that are already
+// running.
+const seedRefreshInterval = time.Minute * 30
+
+// seedLookupTimeout is how long the lookups for a single seed domain can take.
+const seedLookupTimeout = time.Second * 10
+
+// SeedResolver looks up the DNS records of seed domains. It is implemented by
+// *net.Resolver, which is the default.
+type SeedResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// seedDomain is a domain that static peers are found from.
+type seedDomain struct {
+	peers map[string]struct{} // the URIs of the static peers found last time
+}
+
+// seedPeer is a static peer that was found in the records of a seed domain.
+type seedPeer struct {
+	uris []string
+	key  types.PublicKey
+}
+
+// AddSeedDomain adds a domain whose DNS records list static peers, so that
+// the seed nodes of a deployment can be changed without changing the config
+// of every client. The records are looked up straight away and then every 30
+// minutes, and the static peers are updated to match. Peers are listed in
+// either or both of:
+//
+//   - SRV records for _pinecone._tcp.<domain>, each of which is a peer that is
+//     dialled over TCP at the target and port;
+//   - TXT records for _pinecone.<domain>, each of which is either a PEX record
+//     in the text form from types.PEXRecord.String, or a space-separated list
+//     of URIs for a single peer, with the first being the URI of the peer and
+//     the rest fallbacks for it as in AddPeer, along with an optional
+//     "key=<hex>" entry.
+//
+// Peers from PEX records, or with a key, are disconnected again if the remote
+// side doesn't have that key. PEX records are also injected into the router.
+// If neither lookup works, the peers from the last successful lookup are kept.
+func (m *ConnectionManager) AddSeedDomain(domain string) {
+	phony.Block(m, func() {
+		m._addSeedDomain(domain)
+	})
+}
+
+// RemoveSeedDomain stops using the domain and removes the static peers that
+// were found from it.
+func (m *ConnectionManager) RemoveSeedDomain(domain string) {
+	phony.Block(m, func() {
+		m._removeSeedDomain(domain)
+	})
+}
+
+// SetSeedDomains replaces the set of seed domains with the given domains.
+// Domains that are in both the old and new sets are left alone.
+func (m *ConnectionManager) SetSeedDomains(domains []string) {
+	phony.Block(m, func() {
+		wanted := make(map[string]struct{}, len(domains))
+		for _, domain := range domains {
+			wanted[domain] = struct{}{}
+		}
+		for domain := range m._seeds {
+			if _, ok := wanted[domain]; !ok {
+				m._removeSeedDomain(domain)
+			}
+		}
+		for domain := range wanted {
+			m._addSeedDomain(domain)
+		}
+	})
+}
+
+// SetSeedResolver sets the resolver that is used to look up seed domains,
+// instead of net.DefaultResolver.
+func (m *ConnectionManager) SetSeedResolver(resolver SeedResolver) {
+	phony.Block(m, func() {
+		m._resolver = resolver
+	})
+}
+
+func (m *ConnectionManager) _addSeedDomain(domain string) {
+	domain = strings.TrimSuffix(domain, ".")
+	if _, existing := m._seeds[domain]; existing || domain == "" {
+		return
+	}
+	m._seeds[domain] = &seedDomain{
+		peers: map[string]struct{}{},
+	}
+	m._lookupSeeds(domain)
+}
+
+func (m *ConnectionManager) _removeSeedDomain(domain string) {
+	domain = strings.TrimSuffix(domain, ".")
+	seed, existing := m._seeds[domain]
+	if !existing {
+		return
+	}
+	delete(m._seeds, domain)
+	for uri := range seed.peers {
+		if attempts := m._staticPeers[uri]; attempts != nil && attempts.seed == domain {
+			m._removePeer(uri)
+		}
+	}
+}
+
+// _refreshSeeds looks up all of the seed domains again.
+func (m *ConnectionManager) _refreshSeeds() {
+	select {
+	case <-m.ctx.Done():
+		return
+	default:
+		defer time.AfterFunc(seedRefreshInterval, func() {
+			m.Act(nil, m._refreshSeeds)
+		})
+	}
+	for domain := range m._seeds {
+		m._lookupSeeds(domain)
+	}
+}
+
+// _lookupSeeds looks up the records for the seed domain in the background,
+// since it can take a while, and then updates the static peers to match.
+func (m *ConnectionManager) _lookupSeeds(domain string) {
+	resolver := m._resolver
+	go func() {
+		ctx, cancel := context.WithTimeout(m.ctx, seedLookupTimeout)
+		defer cancel()
+		peers, records, err := lookupSeeds(ctx, resolver, domain)
+		if len(records) > 0 {
+			_ = m.router.InjectPEXRecords(records...)
+		}
+		m.Act(nil, func() {
+			if err == nil {
+				m._applySeeds(domain, peers)
+			}
+		})
+	}()
+}
+
+// _applySeeds updates the static peers from the seed domain to match the ones
+// that it lists now.
+func (m *ConnectionManager) _applySeeds(domain string, peers []seedPeer) {
+	seed, ok := m._seeds[domain]
+	if !ok {
+		// The domain was removed while we were looking it up.
+		return
+	}
+	wanted := make(map[string]struct{}, len(peers))
+	for _, peer := range peers {
+		uri := peer.uris[0]
+		wanted[uri] = struct{}{}
+		if attempts, existing := m._staticPeers[uri]; existing {
+			if attempts.seed == domain {
+				attempts.uris, attempts.key = peer.uris, peer.key
+			}
+			continue
+		}
+		m._staticPeers[uri] = &connectionAttempts{
+			uris: peer.uris,
+			key:  peer.key,
+			seed: domain,
+			next: time.Now(),
+		}
+		m.Act(nil, func() {
+			m._connect(uri)
+		})
+	}
+	for uri := range seed.peers {
+		if _, ok := wanted[uri]; ok {
+			continue
+		}
+		if attempts := m._staticPeers[uri]; attempts != nil && attempts.seed == domain {
+			m._removePeer(uri)
+		}
+	}
+	seed.peers = wanted
+}
+
+// lookupSeeds returns the peers listed in the records of the seed domain,
+// along with any PEX records that were found. It only returns an error if
+// none of the lookups worked, since it is normal for a domain to only have
+// one type of record.
+func lookupSeeds(ctx context.Context, resolver SeedResolver, domain string) ([]seedPeer, []*types.PEXRecord, error) {
+	var peers []seedPeer
+	var records []*types.PEXRecord
+	_, srvs, srvErr := resolver.LookupSRV(ctx, "pinecone", "tcp", domain)
+	for _, srv := range srvs {
+		host := strings.TrimSuffix(srv.Target, ".")
+		if host == "" {
+			continue
+		}
+		peers = append(peers, seedPeer{
+			uris: []string{net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))},
+		})
+	}
+	txts, txtErr := resolver.LookupTXT(ctx, "_pinecone."+domain)
+	for _, txt := range txts {
+		peer, record, err := parseSeedTXT(txt)
+		if err != nil {
+			continue
+		}
+		if record != nil {
+			records = append(records, record)
+		}
+		peers = append(peers, peer)
+	}
+	if srvErr != nil && txtErr != nil {
+		return nil, nil, fmt.Errorf("failed to look up %s: %w", domain, srvErr)
+	}
+	return peers, records, nil
+}
+
+// parseSeedTXT parses a single TXT record of a seed domain.
+func parseSeedTXT(txt string) (seedPeer, *types.PEXRecord, error) {
+	var peer seedPeer
+	txt = strings.TrimSpace(txt)
+	if strings.HasPrefix(txt, types.PEXRecordPrefix) {
+		record, err := types.ParsePEXRecord(txt)
+		if err != nil {
+			return peer, nil, err
+		}
+		if err := record.Verify(time.Now()); err != nil {
+			return peer, nil, err
+		}
+		if len(record.URIs) == 0 {
+			return peer, nil, fmt.Errorf("PEX record has no URIs")
+		}
+		peer.uris, peer.key = record.URIs, record.Origin
+		return peer, record, nil
+	}
+	for _, field := range strings.Fields(txt) {
+		if strings.HasPrefix(field, "key=") {
+			b, err := hex.DecodeString(strings.TrimPrefix(field, "key="))
+			if err != nil || len(b) != len(peer.key) {
+				return peer, nil, fmt.Errorf("invalid key %q", field)
+			}
+			copy(peer.key[:], b)
+			continue
+		}
+		peer.uris = append(peer.uris, field)
+	}
+	if len(peer.uris) == 0 {
+		return peer, nil, fmt.Errorf("no URIs")
+	}
+	return peer, nil, nil
+}
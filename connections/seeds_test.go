@@ -0,0 +1,255 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connections
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// fakeResolver answers seed lookups from fixed records.
+type fakeResolver struct {
+	srvs   []*net.SRV
+	srvErr error
+	txts   []string
+	txtErr error
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if service != "pinecone" || proto != "tcp" {
+		return "", nil, fmt.Errorf("unexpected SRV lookup for _%s._%s.%s", service, proto, name)
+	}
+	return "", r.srvs, r.srvErr
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if name != "_pinecone.example.com" {
+		return nil, fmt.Errorf("unexpected TXT lookup for %s", name)
+	}
+	return r.txts, r.txtErr
+}
+
+func newPEXRecord(t *testing.T, uris []string, expires time.Time) *types.PEXRecord {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	var private types.PrivateKey
+	copy(private[:], sk)
+	record, err := types.NewPEXRecord(private, uris, expires)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestParseSeedTXT(t *testing.T) {
+	record := newPEXRecord(t, []string{"tcp://192.0.2.1:65432"}, time.Now().Add(time.Hour))
+	expired := newPEXRecord(t, []string{"tcp://192.0.2.1:65432"}, time.Now().Add(-time.Hour))
+	key := types.PublicKey{1, 2, 3}
+
+	for _, tc := range []struct {
+		name   string
+		txt    string
+		uris   []string
+		key    types.PublicKey
+		record bool
+		valid  bool
+	}{
+		{"single URI", "tcp://192.0.2.1:65432", []string{"tcp://192.0.2.1:65432"}, types.PublicKey{}, false, true},
+		{"fallbacks and key", " 192.0.2.1:65432 wss://example.com key=" + key.String() + " ", []string{"192.0.2.1:65432", "wss://example.com"}, key, false, true},
+		{"PEX record", record.String(), record.URIs, record.Origin, true, true},
+		{"expired PEX record", expired.String(), nil, types.PublicKey{}, false, false},
+		{"corrupt PEX record", types.PEXRecordPrefix + "!!!", nil, types.PublicKey{}, false, false},
+		{"key that isn't hex", "192.0.2.1:65432 key=zz", nil, types.PublicKey{}, false, false},
+		{"key that is too short", "192.0.2.1:65432 key=0102", nil, types.PublicKey{}, false, false},
+		{"key without a URI", "key=" + key.String(), nil, types.PublicKey{}, false, false},
+		{"empty", "", nil, types.PublicKey{}, false, false},
+	} {
+		peer, parsed, err := parseSeedTXT(tc.txt)
+		if (err == nil) != tc.valid {
+			t.Fatalf("%s: expected valid to be %v, got error %v", tc.name, tc.valid, err)
+		}
+		if !tc.valid {
+			continue
+		}
+		if !reflect.DeepEqual(peer.uris, tc.uris) || peer.key != tc.key {
+			t.Fatalf("%s: expected URIs %v with key %s, got %v with key %s", tc.name, tc.uris, tc.key, peer.uris, peer.key)
+		}
+		if (parsed != nil) != tc.record {
+			t.Fatalf("%s: expected a PEX record to be %v, got %v", tc.name, tc.record, parsed)
+		}
+	}
+}
+
+func TestLookupSeeds(t *testing.T) {
+	record := newPEXRecord(t, []string{"tcp://192.0.2.2:65432"}, time.Now().Add(time.Hour))
+	failed := fmt.Errorf("no such host")
+
+	for _, tc := range []struct {
+		name     string
+		resolver *fakeResolver
+		uris     []string
+		records  int
+		valid    bool
+	}{
+		{"SRV only", &fakeResolver{
+			srvs: []*net.SRV{
+				{Target: "seed1.example.com.", Port: 65432},
+				{Target: ".", Port: 65432},
+				{Target: "seed2.example.com", Port: 1234},
+			},
+			txtErr: failed,
+		}, []string{"seed1.example.com:65432", "seed2.example.com:1234"}, 0, true},
+		{"TXT only", &fakeResolver{
+			srvErr: failed,
+			txts:   []string{"tcp://192.0.2.1:65432 ws://192.0.2.1:8080"},
+		}, []string{"tcp://192.0.2.1:65432"}, 0, true},
+		{"PEX record", &fakeResolver{
+			srvErr: failed,
+			txts:   []string{record.String()},
+		}, []string{"tcp://192.0.2.2:65432"}, 1, true},
+		{"bad key", &fakeResolver{
+			srvErr: failed,
+			txts:   []string{"tcp://192.0.2.1:65432 key=zz", "tcp://192.0.2.3:65432"},
+		}, []string{"tcp://192.0.2.3:65432"}, 0, true},
+		{"both", &fakeResolver{
+			srvs: []*net.SRV{{Target: "seed1.example.com.", Port: 65432}},
+			txts: []string{record.String()},
+		}, []string{"seed1.example.com:65432", "tcp://192.0.2.2:65432"}, 1, true},
+		{"both lookups failing", &fakeResolver{
+			srvErr: failed,
+			txtErr: failed,
+		}, nil, 0, false},
+	} {
+		peers, records, err := lookupSeeds(context.Background(), tc.resolver, "example.com")
+		if (err == nil) != tc.valid {
+			t.Fatalf("%s: expected valid to be %v, got error %v", tc.name, tc.valid, err)
+		}
+		var uris []string
+		for _, peer := range peers {
+			uris = append(uris, peer.uris[0])
+		}
+		if !reflect.DeepEqual(uris, tc.uris) {
+			t.Fatalf("%s: expected peers %v, got %v", tc.name, tc.uris, uris)
+		}
+		if len(records) != tc.records {
+			t.Fatalf("%s: expected %d PEX records, got %d", tc.name, tc.records, len(records))
+		}
+	}
+}
+
+func TestApplySeeds(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := router.NewRouter(nil, sk, false)
+	defer r.Close()
+	m := NewConnectionManager(r, nil)
+	defer m.cancel()
+
+	// The seed peers are never reachable, so that nothing connects while
+	// the static peers are being checked.
+	m.RegisterDialer("seed", func(ctx context.Context, uri string) (net.Conn, error) {
+		return nil, fmt.Errorf("unreachable")
+	})
+	m.SetSeedResolver(&fakeResolver{
+		srvErr: fmt.Errorf("no such host"),
+		txtErr: fmt.Errorf("no such host"),
+	})
+	m.AddSeedDomain("example.com")
+
+	const domain = "example.com"
+	key := types.PublicKey{1, 2, 3}
+	apply := func(peers ...seedPeer) {
+		phony.Block(m, func() {
+			m._applySeeds(domain, peers)
+		})
+	}
+	seeded := func() map[string]*connectionAttempts {
+		found := map[string]*connectionAttempts{}
+		phony.Block(m, func() {
+			for uri, attempts := range m._staticPeers {
+				if attempts.seed == domain {
+					a := *attempts
+					found[uri] = &a
+				}
+			}
+		})
+		return found
+	}
+	uris := func(peers map[string]*connectionAttempts) []string {
+		var uris []string
+		for uri := range peers {
+			uris = append(uris, uri)
+		}
+		sort.Strings(uris)
+		return uris
+	}
+
+	// New peers from the seed domain are added, but they aren't counted as
+	// static peers that were configured by the caller.
+	apply(
+		seedPeer{uris: []string{"seed://a"}},
+		seedPeer{uris: []string{"seed://b"}, key: key},
+	)
+	peers := seeded()
+	if got := uris(peers); !reflect.DeepEqual(got, []string{"seed://a", "seed://b"}) {
+		t.Fatalf("expected both seed peers, got %v", got)
+	}
+	if peers["seed://b"].key != key {
+		t.Fatalf("expected the seed peer to have key %s, got %s", key, peers["seed://b"].key)
+	}
+	if static := m.StaticPeers(); len(static) != 0 {
+		t.Fatalf("expected no configured static peers, got %v", static)
+	}
+
+	// Peers that are no longer listed are removed, peers that are still
+	// listed are updated and new peers are added.
+	apply(
+		seedPeer{uris: []string{"seed://b", "seed://fallback"}},
+		seedPeer{uris: []string{"seed://c"}},
+	)
+	peers = seeded()
+	if got := uris(peers); !reflect.DeepEqual(got, []string{"seed://b", "seed://c"}) {
+		t.Fatalf("expected the second set of seed peers, got %v", got)
+	}
+	if b := peers["seed://b"]; !reflect.DeepEqual(b.uris, []string{"seed://b", "seed://fallback"}) || b.key != (types.PublicKey{}) {
+		t.Fatalf("expected the seed peer to be updated, got %v with key %s", b.uris, b.key)
+	}
+
+	// A seed peer that the caller adds themselves belongs to them, so it is
+	// kept when the seed domain stops listing it.
+	m.AddPeer("seed://c")
+	apply()
+	if got := uris(seeded()); len(got) != 0 {
+		t.Fatalf("expected no seed peers, got %v", got)
+	}
+	if static := m.StaticPeers(); !reflect.DeepEqual(static, []string{"seed://c"}) {
+		t.Fatalf("expected the caller's peer to be kept, got %v", static)
+	}
+
+	// Once the domain is removed, anything that it finds later is ignored.
+	m.RemoveSeedDomain(domain)
+	apply(seedPeer{uris: []string{"seed://d"}})
+	if got := uris(seeded()); len(got) != 0 {
+		t.Fatalf("expected nothing from a removed seed domain, got %v", got)
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keys stores Pinecone node keys on disk, so that a node keeps the
+// same identity across restarts. Keys are kept in PEM files which can be
+// encrypted with a passphrase, using scrypt to derive the encryption key and
+// XChaCha20-Poly1305 to encrypt the private key. Files are always written
+// atomically and are only readable by the owner.
+package keys
+
+import (
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// PEM block types for private keys.
+const (
+	pemPrivateKey          = "PINECONE PRIVATE KEY"
+	pemEncryptedPrivateKey = "PINECONE ENCRYPTED PRIVATE KEY"
+)
+
+// scrypt parameters for new files. The parameters that were used are stored
+// in each file, so they can be raised later without breaking older files.
+var (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// The largest scrypt parameters that will be accepted from a file. They are
+// read from the file before it can be authenticated, so without a limit a
+// tampered file could make loading it use any amount of memory or time.
+const (
+	maxScryptN = 1 << 20
+	maxScryptR = 8
+	maxScryptP = 4
+)
+
+const saltSize = 16
+
+// ErrPassphrase is returned when a key can't be decrypted, either because the
+// passphrase was wrong or because the file has been tampered with.
+var ErrPassphrase = errors.New("wrong passphrase or corrupt key")
+
+// Generate creates a new random private key.
+func Generate() (ed25519.PrivateKey, error) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, fmt.Errorf("ed25519.GenerateKey: %w", err)
+	}
+	return private, nil
+}
+
+// Marshal encodes the private key as a PEM block. If the passphrase isn't
+// empty then the key is encrypted with it.
+func Marshal(private ed25519.PrivateKey, passphrase []byte) ([]byte, error) {
+	return marshal(private, passphrase, nil)
+}
+
+func marshal(private ed25519.PrivateKey, passphrase []byte, headers map[string]string) ([]byte, error) {
+	if len(private) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("private key must be %d bytes", ed25519.PrivateKeySize)
+	}
+	block := &pem.Block{
+		Type:    pemPrivateKey,
+		Headers: map[string]string{},
+		Bytes:   private.Seed(),
+	}
+	for k, v := range headers {
+		block.Headers[k] = v
+	}
+	if len(passphrase) > 0 {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, fmt.Errorf("rand.Read: %w", err)
+		}
+		aead, err := newAEAD(passphrase, salt, scryptN, scryptR, scryptP)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("rand.Read: %w", err)
+		}
+		block.Type = pemEncryptedPrivateKey
+		block.Headers["KDF"] = fmt.Sprintf("scrypt,%d,%d,%d", scryptN, scryptR, scryptP)
+		block.Headers["Salt"] = hex.EncodeToString(salt)
+		block.Headers["Nonce"] = hex.EncodeToString(nonce)
+		block.Bytes = aead.Seal(nil, nonce, private.Seed(), additionalData(block))
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// Unmarshal decodes a private key that was encoded with Marshal. The
+// passphrase is only needed if the key is encrypted.
+func Unmarshal(data []byte, passphrase []byte) (ed25519.PrivateKey, error) {
+	private, _, err := unmarshal(data, passphrase)
+	return private, err
+}
+
+func unmarshal(data []byte, passphrase []byte) (ed25519.PrivateKey, map[string]string, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, fmt.Errorf("no PEM block found")
+	}
+	var seed []byte
+	switch block.Type {
+	case pemPrivateKey:
+		seed = block.Bytes
+	case pemEncryptedPrivateKey:
+		if len(passphrase) == 0 {
+			return nil, nil, fmt.Errorf("key is encrypted but no passphrase was given")
+		}
+		n, r, p, err := parseKDF(block.Headers["KDF"])
+		if err != nil {
+			return nil, nil, err
+		}
+		salt, err := hex.DecodeString(block.Headers["Salt"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid salt: %w", err)
+		}
+		if len(salt) != saltSize {
+			return nil, nil, fmt.Errorf("invalid salt length %d", len(salt))
+		}
+		nonce, err := hex.DecodeString(block.Headers["Nonce"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid nonce: %w", err)
+		}
+		aead, err := newAEAD(passphrase, salt, n, r, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(nonce) != aead.NonceSize() {
+			return nil, nil, fmt.Errorf("invalid nonce length %d", len(nonce))
+		}
+		if seed, err = aead.Open(nil, nonce, block.Bytes, additionalData(block)); err != nil {
+			return nil, nil, ErrPassphrase
+		}
+	default:
+		return nil, nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, nil, fmt.Errorf("private key seed must be %d bytes", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), block.Headers, nil
+}
+
+// parseKDF reads the scrypt parameters from the KDF header, refusing anything
+// that isn't exactly how marshal writes it or that is over the limits.
+func parseKDF(header string) (n, r, p int, err error) {
+	if _, err = fmt.Sscanf(header, "scrypt,%d,%d,%d", &n, &r, &p); err != nil || header != fmt.Sprintf("scrypt,%d,%d,%d", n, r, p) {
+		return 0, 0, 0, fmt.Errorf("unsupported KDF %q", header)
+	}
+	if n < 2 || n > maxScryptN || r < 1 || r > maxScryptR || p < 1 || p > maxScryptP {
+		return 0, 0, 0, fmt.Errorf("scrypt parameters %q are out of range", header)
+	}
+	return n, r, p, nil
+}
+
+// additionalData returns the block type and all of the headers in a canonical
+// form, so that changing any of them, such as the KDF parameters or the Until
+// header of a previous key, stops the key from decrypting.
+func additionalData(block *pem.Block) []byte {
+	names := make([]string, 0, len(block.Headers))
+	for name := range block.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(block.Type)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n%s: %s", name, block.Headers[name])
+	}
+	return []byte(b.String())
+}
+
+// newAEAD derives the encryption key for a file from the passphrase.
+func newAEAD(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("scrypt.Key: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("chacha20poly1305.NewX: %w", err)
+	}
+	return aead, nil
+}
+
+// Save writes the private key to the file at the given path, encrypting it
+// if the passphrase isn't empty. The file is replaced atomically, so a crash
+// part way through never leaves a node without a key.
+func Save(path string, private ed25519.PrivateKey, passphrase []byte) error {
+	return save(path, private, passphrase, nil)
+}
+
+func save(path string, private ed25519.PrivateKey, passphrase []byte, headers map[string]string) error {
+	data, err := marshal(private, passphrase, headers)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile writes the data to a temporary file next to the path, which is
+// only readable by the owner, and then renames it into place.
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile: %w", err)
+	}
+	defer os.Remove(f.Name()) // nolint:errcheck
+	if err := f.Chmod(0600); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("f.Chmod: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("f.Write: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("f.Sync: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("f.Close: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("os.Rename: %w", err)
+	}
+	return nil
+}
+
+// Load reads the private key from the file at the given path. The passphrase
+// is only needed if the key is encrypted.
+func Load(path string, passphrase []byte) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadFile: %w", err)
+	}
+	return Unmarshal(data, passphrase)
+}
+
+// LoadOrGenerate reads the private key from the file at the given path, or
+// generates a new key and saves it there if the file doesn't exist yet.
+func LoadOrGenerate(path string, passphrase []byte) (ed25519.PrivateKey, error) {
+	private, err := Load(path, passphrase)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return private, err
+	}
+	if private, err = Generate(); err != nil {
+		return nil, err
+	}
+	if err := Save(path, private, passphrase); err != nil {
+		return nil, err
+	}
+	return private, nil
+}
+
+// Keys are derived from seed phrases with scrypt, using a fixed salt, which
+// keeps them apart from any other use of scrypt with the same phrase. These
+// can never change, otherwise phrases would stop giving the same keys.
+const (
+	seedPhraseSalt = "pinecone seed phrase"
+	seedPhraseN    = 1 << 15
+	seedPhraseR    = 8
+	seedPhraseP    = 1
+)
+
+// MinSeedPhraseWords is the fewest words that a seed phrase can have.
+const MinSeedPhraseWords = 12
+
+// FromSeedPhrase derives a private key from a seed phrase, so that the same
+// identity can be recreated on another device, or after the key file is lost,
+// by typing the phrase in again. Case and whitespace don't matter. The phrase
+// is the only secret, so it must be chosen randomly, i.e. from a word list,
+// rather than made up.
+func FromSeedPhrase(phrase string) (ed25519.PrivateKey, error) {
+	words := strings.Fields(strings.ToLower(phrase))
+	if len(words) < MinSeedPhraseWords {
+		return nil, fmt.Errorf("seed phrase must have at least %d words", MinSeedPhraseWords)
+	}
+	seed, err := scrypt.Key([]byte(strings.Join(words, " ")), []byte(seedPhraseSalt), seedPhraseN, seedPhraseR, seedPhraseP, ed25519.SeedSize)
+	if err != nil {
+		return nil, fmt.Errorf("scrypt.Key: %w", err)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// untilHeader records in the previous key file when the previous key stops
+// being used.
+const untilHeader = "Until"
+
+// previousPath returns where the previous key is kept during a rotation.
+func previousPath(path string) string {
+	return path + ".previous"
+}
+
+// Rotation is a key along with the key that it replaced, if the replaced key
+// is still in use. The previous key and time can be passed to the router as a
+// router.RouterPredecessorKey, so that the node keeps answering to its old
+// identity while its peers catch up.
+type Rotation struct {
+	Current  ed25519.PrivateKey
+	Previous ed25519.PrivateKey // nil if there is no rotation in progress
+	Until    time.Time          // when the previous key stops being used
+}
+
+// Rotate generates a new key and saves it at the given path. The key that it
+// replaces is kept next to it, until the window has passed, so that it can be
+// loaded again by LoadRotation if the node restarts during the rotation.
+func Rotate(path string, passphrase []byte, window time.Duration) (*Rotation, error) {
+	current, err := Load(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	successor, err := Generate()
+	if err != nil {
+		return nil, err
+	}
+	rotation := &Rotation{
+		Current:  successor,
+		Previous: current,
+		Until:    time.Now().Add(window).Truncate(time.Second),
+	}
+	// The previous key is saved first, so that if something goes wrong
+	// before the new key is saved, the old key is still there.
+	headers := map[string]string{
+		untilHeader: rotation.Until.UTC().Format(time.RFC3339),
+	}
+	if err := save(previousPath(path), current, passphrase, headers); err != nil {
+		return nil, err
+	}
+	if err := Save(path, successor, passphrase); err != nil {
+		return nil, err
+	}
+	return rotation, nil
+}
+
+// LoadRotation reads the private key from the file at the given path, along
+// with the key that it replaced if the last rotation is still in progress.
+// The previous key file is removed once its rotation is over.
+func LoadRotation(path string, passphrase []byte) (*Rotation, error) {
+	current, err := Load(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	rotation := &Rotation{Current: current}
+	data, err := ioutil.ReadFile(previousPath(path))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return rotation, nil
+	case err != nil:
+		return nil, fmt.Errorf("ioutil.ReadFile: %w", err)
+	}
+	previous, headers, err := unmarshal(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("previous key: %w", err)
+	}
+	until, err := time.Parse(time.RFC3339, headers[untilHeader])
+	if err != nil {
+		return nil, fmt.Errorf("previous key has invalid %s header: %w", untilHeader, err)
+	}
+	if !time.Now().Before(until) || previous.Equal(current) {
+		_ = os.Remove(previousPath(path))
+		return rotation, nil
+	}
+	rotation.Previous, rotation.Until = previous, until
+	return rotation, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keys
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Keep the tests quick. Seed phrases don't use these parameters.
+	scryptN = 1 << 10
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	private, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, passphrase := range [][]byte{nil, []byte("correct horse")} {
+		data, err := Marshal(private, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := Unmarshal(data, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !decoded.Equal(private) {
+			t.Fatalf("decoded key doesn't match")
+		}
+	}
+
+	data, err := Marshal(private, []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Unmarshal(data, []byte("battery staple")); !errors.Is(err, ErrPassphrase) {
+		t.Fatalf("expected ErrPassphrase but got %v", err)
+	}
+	if _, err := Unmarshal(data, nil); err == nil {
+		t.Fatalf("encrypted key should not have decoded without a passphrase")
+	}
+}
+
+func TestUnmarshalTamperedHeaders(t *testing.T) {
+	private, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("correct horse")
+	headers := map[string]string{
+		untilHeader: time.Now().UTC().Format(time.RFC3339),
+	}
+	data, err := marshal(private, passphrase, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		tamper func(h map[string]string)
+		wrong  bool // should it look like the wrong passphrase?
+	}{
+		{"KDF raised", func(h map[string]string) { h["KDF"] = "scrypt,2048,8,1" }, true},
+		{"KDF too expensive", func(h map[string]string) { h["KDF"] = "scrypt,2097152,8,1" }, false},
+		{"KDF r too large", func(h map[string]string) { h["KDF"] = "scrypt,1024,1024,1" }, false},
+		{"KDF p too large", func(h map[string]string) { h["KDF"] = "scrypt,1024,8,64" }, false},
+		{"KDF trailing data", func(h map[string]string) { h["KDF"] += ",1" }, false},
+		{"salt too short", func(h map[string]string) { h["Salt"] = h["Salt"][:16] }, false},
+		{"salt changed", func(h map[string]string) { h["Salt"] = hex.EncodeToString(make([]byte, saltSize)) }, true},
+		{"until changed", func(h map[string]string) { h[untilHeader] = "2099-01-01T00:00:00Z" }, true},
+		{"until removed", func(h map[string]string) { delete(h, untilHeader) }, true},
+		{"header added", func(h map[string]string) { h["Comment"] = "hello" }, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			block, _ := pem.Decode(data)
+			tc.tamper(block.Headers)
+			_, err := Unmarshal(pem.EncodeToMemory(block), passphrase)
+			switch {
+			case err == nil:
+				t.Fatal("tampered key should not have decoded")
+			case tc.wrong && !errors.Is(err, ErrPassphrase):
+				t.Fatalf("expected ErrPassphrase but got %v", err)
+			case !tc.wrong && errors.Is(err, ErrPassphrase):
+				t.Fatalf("expected the headers to be refused before decrypting")
+			}
+		})
+	}
+}
+
+func TestLoadOrGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	passphrase := []byte("correct horse")
+	generated, err := LoadOrGenerate(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("expected key file mode 0600 but got %o", mode)
+	}
+	loaded, err := LoadOrGenerate(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Equal(generated) {
+		t.Fatalf("loaded key doesn't match the generated key")
+	}
+}
+
+func TestFromSeedPhrase(t *testing.T) {
+	phrase := "abandon ability able about above absent absorb abstract absurd abuse access accident"
+	a, err := FromSeedPhrase(phrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := FromSeedPhrase("  ABANDON ability able about above absent\nabsorb abstract absurd abuse access accident ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Equal(b) {
+		t.Fatalf("case and whitespace should not change the derived key")
+	}
+	c, err := FromSeedPhrase(phrase + " account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Equal(c) {
+		t.Fatalf("different phrases should give different keys")
+	}
+	if _, err := FromSeedPhrase("too short"); err == nil {
+		t.Fatalf("short phrase should have been rejected")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	original, err := LoadOrGenerate(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation, err := Rotate(path, nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotation.Previous.Equal(original) || rotation.Current.Equal(original) {
+		t.Fatalf("rotation should replace the original key")
+	}
+
+	loaded, err := LoadRotation(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Current.Equal(rotation.Current) || !loaded.Previous.Equal(original) {
+		t.Fatalf("loaded rotation doesn't match")
+	}
+	if !loaded.Until.Equal(rotation.Until) {
+		t.Fatalf("expected rotation until %s but got %s", rotation.Until, loaded.Until)
+	}
+
+	// Once the window has passed, the previous key is forgotten.
+	if _, err := Rotate(path, nil, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = LoadRotation(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Previous != nil {
+		t.Fatalf("expired rotation should not have been loaded")
+	}
+	if _, err := os.Stat(previousPath(path)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected previous key file to be removed but got %v", err)
+	}
+}
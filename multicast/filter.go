@@ -0,0 +1,111 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multicast
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// MulticastOption configures multicast discovery when it is created with
+// NewMulticast.
+type MulticastOption interface {
+	isMulticastOption()
+}
+
+// DiscoveredPeer is a node on the local network that we found through
+// multicast discovery, or that connected to us after finding us that way.
+type DiscoveredPeer struct {
+	PublicKey types.PublicKey
+	Zone      string   // the name of the interface that the peer was found on
+	Addr      net.Addr // the address of the peer
+	Inbound   bool     // true if the peer is connecting to us
+}
+
+// MulticastConnectFilter is called before connecting to a node that was found
+// through multicast discovery, and before accepting a connection from one,
+// and the peering is refused if it returns false. This lets applications give
+// users a say over which nodes they automatically mesh with on the local
+// network. It is called every time that we hear from a node that we aren't
+// already connected to, so it should return quickly.
+type MulticastConnectFilter func(DiscoveredPeer) bool
+
+// MulticastDisabledInterfaces lists interfaces that multicast discovery should
+// start off disabled on, see SetInterfaceEnabled.
+type MulticastDisabledInterfaces []string
+
+func (f MulticastConnectFilter) isMulticastOption()      {}
+func (d MulticastDisabledInterfaces) isMulticastOption() {}
+
+// SetInterfaceEnabled turns multicast discovery on or off for the named
+// interface. Discovery is enabled on every suitable interface by default.
+// Disabling it on an interface stops us from advertising or listening there
+// and disconnects any multicast peerings on it straight away, but leaves any
+// other peerings that happen to run over the interface alone.
+func (m *Multicast) SetInterfaceEnabled(name string, enabled bool) {
+	if enabled {
+		m.disabled.Delete(name)
+		return
+	}
+	m.disabled.Store(name, struct{}{})
+	if v, ok := m.interfaces.LoadAndDelete(name); ok {
+		v.(*multicastInterface).cancel()
+	}
+	err := fmt.Errorf("multicast disabled on %s", name)
+	if n := m.r.DisconnectZone(name, router.PeerTypeMulticast, err); n > 0 {
+		m.log.Printf("Disconnected %d multicast peering(s) on %s\n", n, name)
+	}
+}
+
+// InterfaceEnabled returns false if multicast discovery has been disabled on
+// the named interface.
+func (m *Multicast) InterfaceEnabled(name string) bool {
+	_, disabled := m.disabled.Load(name)
+	return !disabled
+}
+
+// allowed returns true if the connect filter, if there is one, allows us to
+// peer with the given node.
+func (m *Multicast) allowed(peer DiscoveredPeer) bool {
+	return m.filter == nil || m.filter(peer)
+}
+
+// zoneFor returns the name of the interface that a connection is running
+// over, which is used as the zone of multicast peerings. Link-local IPv6
+// addresses already carry it, but for IPv4 the interface has to be found by
+// the local address of the connection.
+func (m *Multicast) zoneFor(local, remote *net.TCPAddr) string {
+	if remote.Zone != "" {
+		return remote.Zone
+	}
+	var zone string
+	m.interfaces.Range(func(k, v interface{}) bool {
+		addrs, err := v.(*multicastInterface).Addrs()
+		if err != nil {
+			return true
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(local.IP) {
+				zone = k.(string)
+				return false
+			}
+		}
+		return true
+	})
+	return zone
+}
@@ -15,8 +15,10 @@
 package multicast
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -35,15 +37,28 @@ const MulticastIPv4GroupAddr = "224.0.0.114"
 const MulticastIPv6GroupAddr = "[ff02::114]"
 const MulticastGroupPort = 60606
 
+// beaconLength is the length of a beacon on the default network, which is
+// our public key followed by the port that we accept connections on. Beacons
+// for any other network carry a tag for the network after that, so that
+// routers on different networks in the same process, or on the same LAN,
+// don't go looking for each other. See router.RouterNetwork.
+const beaconLength = ed25519.PublicKeySize + 2
+
+// beaconTagLength is the length of the network tag in beacons.
+const beaconTagLength = 8
+
 type Multicast struct {
 	r          *router.Router
 	log        types.Logger
 	ctx        context.Context
 	cancel     context.CancelFunc
 	id         string
+	tag        []byte // the network tag sent in beacons, nil on the default network
 	started    atomic.Bool
 	interfaces sync.Map // -> *multicastInterface
+	disabled   sync.Map // interface name -> struct{}, see SetInterfaceEnabled
 	dialling   sync.Map
+	filter     MulticastConnectFilter
 	listener   net.Listener
 	dialer     net.Dialer
 	tcpLC      net.ListenConfig
@@ -57,13 +72,24 @@ type multicastInterface struct {
 }
 
 func NewMulticast(
-	log types.Logger, r *router.Router,
+	log types.Logger, r *router.Router, options ...MulticastOption,
 ) *Multicast {
 	public := r.PublicKey()
 	m := &Multicast{
 		r:   r,
 		log: log,
 		id:  hex.EncodeToString(public[:]),
+		tag: beaconTag(r.Network()),
+	}
+	for _, option := range options {
+		switch v := option.(type) {
+		case MulticastConnectFilter:
+			m.filter = v
+		case MulticastDisabledInterfaces:
+			for _, name := range v {
+				m.disabled.Store(name, struct{}{})
+			}
+		}
 	}
 	m.tcpLC = net.ListenConfig{
 		Control: m.tcpOptions,
@@ -109,7 +135,8 @@ func (m *Multicast) Start() {
 			for _, intf := range intfs {
 				unsuitable := intf.Flags&net.FlagUp == 0 ||
 					intf.Flags&net.FlagMulticast == 0 ||
-					intf.Flags&net.FlagPointToPoint != 0
+					intf.Flags&net.FlagPointToPoint != 0 ||
+					!m.InterfaceEnabled(intf.Name)
 
 				if v, ok := m.interfaces.Load(intf.Name); ok {
 					if unsuitable {
@@ -164,8 +191,14 @@ func (m *Multicast) accept(listener net.Listener) {
 				m.log.Println("Not TCPAddr")
 				return
 			}
+			localaddr, ok := conn.LocalAddr().(*net.TCPAddr)
+			if !ok {
+				m.log.Println("Not TCPAddr")
+				return
+			}
 
-			if !m.started.Load() {
+			zone := m.zoneFor(localaddr, tcpaddr)
+			if !m.started.Load() || (zone != "" && !m.InterfaceEnabled(zone)) {
 				_ = conn.Close()
 				return
 			}
@@ -176,8 +209,16 @@ func (m *Multicast) accept(listener net.Listener) {
 
 			if _, err := m.r.Connect(
 				tcpconn,
-				router.ConnectionZone(tcpaddr.Zone),
+				router.ConnectionZone(zone),
 				router.ConnectionPeerType(router.PeerTypeMulticast),
+				router.ConnectionKeyFilter(func(key types.PublicKey) bool {
+					return m.allowed(DiscoveredPeer{
+						PublicKey: key,
+						Zone:      zone,
+						Addr:      tcpaddr,
+						Inbound:   true,
+					})
+				}),
 			); err != nil {
 				//m.log.Println("m.s.AuthenticatedConnect:", err)
 				_ = conn.Close()
@@ -224,6 +265,9 @@ func (m *Multicast) startIPv4(intf *multicastInterface) {
 	if srcaddr == nil {
 		return
 	}
+	if !m.InterfaceEnabled(intf.Name) {
+		return
+	}
 	m.log.Printf("Multicast discovery enabled on %s (%s)\n", intf.Name, srcaddr.String())
 	m.interfaces.Store(intf.Name, intf)
 	go m.advertise(intf, conn, addr)
@@ -271,6 +315,9 @@ func (m *Multicast) startIPv6(intf *multicastInterface) {
 	if srcaddr == nil {
 		return
 	}
+	if !m.InterfaceEnabled(intf.Name) {
+		return
+	}
 	m.log.Printf("Multicast discovery enabled on %s (%s)\n", intf.Name, srcaddr.String())
 	m.interfaces.Store(intf.Name, intf)
 	go m.advertise(intf, conn, addr)
@@ -282,6 +329,9 @@ func (m *Multicast) startIPv6(intf *multicastInterface) {
 
 func (m *Multicast) advertise(intf *multicastInterface, conn net.PacketConn, addr net.Addr) {
 	defer m.interfaces.Delete(intf.Name)
+	// Closing the socket also stops the listener, which would otherwise
+	// carry on waiting for the next advertisement.
+	defer conn.Close()
 	//defer m.log.Println("Stop advertising on", intf.Name)
 	tcpaddr, _ := m.listener.Addr().(*net.TCPAddr)
 	portBytes := make([]byte, 2)
@@ -299,8 +349,9 @@ func (m *Multicast) advertise(intf *multicastInterface, conn net.PacketConn, add
 		case <-ticker.C:
 		case <-first:
 		}
+		beacon := append(ourPublicKey[:], portBytes...)
 		_, err := conn.WriteTo(
-			append(ourPublicKey[:], portBytes...),
+			append(beacon, m.tag...),
 			addr,
 		)
 		if err != nil {
@@ -331,11 +382,18 @@ func (m *Multicast) listen(intf *multicastInterface, conn net.PacketConn, srcadd
 		}
 
 		n, addr, err := conn.ReadFrom(buf)
-		if err != nil || n < ed25519.PublicKeySize+2 {
+		if err != nil || n < beaconLength {
 			//m.log.Println("conn.ReadFrom:", err)
 			intf.cancel()
 			continue
 		}
+		if intf.context.Err() != nil {
+			return
+		}
+		if !bytes.Equal(buf[beaconLength:n], m.tag) {
+			// The beacon is from a node on another network.
+			continue
+		}
 
 		copy(neighborKey[:], publicKey)
 		if neighborKey == ourPublicKey {
@@ -347,7 +405,10 @@ func (m *Multicast) listen(intf *multicastInterface, conn net.PacketConn, srcadd
 			continue
 		}
 
-		if m.r.IsConnected(neighborKey, udpaddr.Zone) {
+		// Peerings are tagged with the interface that the node was found
+		// on, so that the same node can be reached over more than one.
+		zone := intf.Name
+		if m.r.IsConnected(neighborKey, zone) {
 			continue
 		}
 
@@ -357,6 +418,15 @@ func (m *Multicast) listen(intf *multicastInterface, conn net.PacketConn, srcadd
 			Zone: udpaddr.Zone,
 		}
 
+		discovered := DiscoveredPeer{
+			PublicKey: neighborKey,
+			Zone:      zone,
+			Addr:      tcpaddr,
+		}
+		if !m.allowed(discovered) {
+			continue
+		}
+
 		if !m.started.Load() {
 			return
 		}
@@ -387,8 +457,15 @@ func (m *Multicast) listen(intf *multicastInterface, conn net.PacketConn, srcadd
 
 			if _, err := m.r.Connect(
 				tcpconn,
-				router.ConnectionZone(udpaddr.Zone),
+				router.ConnectionZone(zone),
 				router.ConnectionPeerType(router.PeerTypeMulticast),
+				router.ConnectionKeyFilter(func(key types.PublicKey) bool {
+					// The node should be the one that we heard from, but
+					// if it isn't then it has to be allowed in its own right.
+					found := discovered
+					found.PublicKey = key
+					return key == discovered.PublicKey || m.allowed(found)
+				}),
 			); err != nil {
 				m.log.Println("m.s.AuthenticatedConnect:", err)
 				_ = conn.Close()
@@ -397,6 +474,16 @@ func (m *Multicast) listen(intf *multicastInterface, conn net.PacketConn, srcadd
 	}
 }
 
+// beaconTag returns the tag that identifies the network in beacons, or nil
+// for the default network.
+func beaconTag(network string) []byte {
+	if network == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(network))
+	return sum[:beaconTagLength]
+}
+
 func (m *Multicast) tcpGeneralOptions(tcpconn *net.TCPConn) error {
 	if err := tcpconn.SetNoDelay(true); err != nil {
 		return fmt.Errorf("tcpconn.SetNoDelay: %w", err)
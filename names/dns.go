@@ -0,0 +1,91 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package names
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// DNSPrefix is prepended to a name to get the domain whose TXT records hold
+// its key, so "alice.example.org" is looked up at
+// "_pinecone-key.alice.example.org".
+const DNSPrefix = "_pinecone-key."
+
+// TXTResolver looks up DNS TXT records. It is implemented by *net.Resolver.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DNS resolves names that are domains from TXT records, each of which holds
+// a "key=<hex>" entry like the seed domain records in the connections
+// package. DNS can't be searched by key, so reverse lookups always return
+// ErrNotFound.
+type DNS struct {
+	// Resolver does the lookups. If nil then net.DefaultResolver is used.
+	Resolver TXTResolver
+	// Domain, if set, is added to names that don't contain a dot, so that
+	// "alice" can be used as a short form of "alice.example.org".
+	Domain string
+}
+
+func (d *DNS) Resolve(ctx context.Context, name string) (types.PublicKey, error) {
+	var key types.PublicKey
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	domain := strings.TrimSuffix(name, ".")
+	if d.Domain != "" && !strings.Contains(domain, ".") {
+		domain += "." + strings.Trim(d.Domain, ".")
+	}
+	records, err := resolver.LookupTXT(ctx, DNSPrefix+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return key, fmt.Errorf("%q: %w", name, ErrNotFound)
+		}
+		return key, fmt.Errorf("resolver.LookupTXT: %w", err)
+	}
+	found := false
+	for _, record := range records {
+		for _, field := range strings.Fields(record) {
+			if !strings.HasPrefix(field, "key=") {
+				continue
+			}
+			k, err := ParseKey(strings.TrimPrefix(field, "key="))
+			if err != nil {
+				return key, fmt.Errorf("invalid key for %q: %w", name, err)
+			}
+			if found && k != key {
+				return key, fmt.Errorf("%q has more than one key", name)
+			}
+			key, found = k, true
+		}
+	}
+	if !found {
+		return key, fmt.Errorf("%q: %w", name, ErrNotFound)
+	}
+	return key, nil
+}
+
+func (d *DNS) ReverseResolve(_ context.Context, key types.PublicKey) (string, error) {
+	return "", fmt.Errorf("%s: %w", key, ErrNotFound)
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package names
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// matrixSearchPath is the user directory search endpoint of the Matrix
+// client-server API.
+const matrixSearchPath = "/_matrix/client/v3/user_directory/search"
+
+// matrixSearchLimit is how many results are asked for in each search.
+const matrixSearchLimit = 20
+
+// Matrix resolves names from a Matrix user directory, for P2P Matrix
+// deployments where the server name of each user is the hex public key of
+// their node, as in "@alice:<hex>". A full user ID is resolved without a
+// lookup, since the key is part of it. Anything else is only resolved if
+// SearchNames is set. Reverse lookups search the directory for the key and
+// return the user ID.
+type Matrix struct {
+	// Homeserver is the base URL of the homeserver to search, i.e.
+	// "https://matrix.example.org".
+	Homeserver string
+	// AccessToken is for a user on the homeserver, since the user directory
+	// can't be searched anonymously.
+	AccessToken string
+	// Client makes the requests. If nil then http.DefaultClient is used.
+	Client *http.Client
+	// SearchNames resolves names that aren't full user IDs by searching the
+	// directory for a user with a matching localpart or display name. Anyone
+	// can pick any display name or localpart on a homeserver, and the
+	// homeserver itself isn't authenticated by the key, so the key that is
+	// found can't be trusted to belong to the person meant.
+	SearchNames bool
+}
+
+type matrixSearchResult struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"display_name"`
+}
+
+func (m *Matrix) Resolve(ctx context.Context, name string) (types.PublicKey, error) {
+	if strings.HasPrefix(name, "@") {
+		if key, err := matrixUserKey(name); err == nil {
+			return key, nil
+		}
+	}
+	if !m.SearchNames {
+		return types.PublicKey{}, fmt.Errorf("%q: %w", name, ErrNotFound)
+	}
+	results, err := m.search(ctx, strings.TrimPrefix(name, "@"))
+	if err != nil {
+		return types.PublicKey{}, err
+	}
+	var match *matrixSearchResult
+	for i, result := range results {
+		localpart := strings.SplitN(strings.TrimPrefix(result.UserID, "@"), ":", 2)[0]
+		if result.UserID != name && localpart != strings.TrimPrefix(name, "@") && result.DisplayName != name {
+			continue
+		}
+		if _, err := matrixUserKey(result.UserID); err != nil {
+			continue
+		}
+		if match != nil && match.UserID != result.UserID {
+			return types.PublicKey{}, fmt.Errorf("%q matches more than one user", name)
+		}
+		match = &results[i]
+	}
+	if match == nil {
+		return types.PublicKey{}, fmt.Errorf("%q: %w", name, ErrNotFound)
+	}
+	return matrixUserKey(match.UserID)
+}
+
+func (m *Matrix) ReverseResolve(ctx context.Context, key types.PublicKey) (string, error) {
+	results, err := m.search(ctx, key.String())
+	if err != nil {
+		return "", err
+	}
+	for _, result := range results {
+		if k, err := matrixUserKey(result.UserID); err == nil && k == key {
+			return result.UserID, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w", key, ErrNotFound)
+}
+
+// search asks the user directory for users matching the term.
+func (m *Matrix) search(ctx context.Context, term string) ([]matrixSearchResult, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"search_term": term,
+		"limit":       matrixSearchLimit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	url := strings.TrimSuffix(m.Homeserver, "/") + matrixSearchPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+m.AccessToken)
+	}
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client.Do: %w", err)
+	}
+	defer res.Body.Close() // nolint:errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("user directory search failed: %s", res.Status)
+	}
+	var response struct {
+		Results []matrixSearchResult `json:"results"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("json.Decode: %w", err)
+	}
+	return response.Results, nil
+}
+
+// matrixUserKey returns the public key from the server name of a P2P Matrix
+// user ID.
+func matrixUserKey(userID string) (types.PublicKey, error) {
+	parts := strings.SplitN(userID, ":", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "@") {
+		return types.PublicKey{}, fmt.Errorf("%q is not a Matrix user ID", userID)
+	}
+	return ParseKey(parts[1])
+}
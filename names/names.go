@@ -0,0 +1,116 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package names maps human-readable names to Pinecone public keys and back,
+// so that people can address nodes by name rather than by a 64-character
+// hex key. A Resolver can be backed by a static file, by DNS or by a Matrix
+// user directory, and several can be tried in turn with Chain.
+package names
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// ErrNotFound is returned by resolvers that don't know the name or key that
+// they were asked about.
+var ErrNotFound = errors.New("name not found")
+
+// Resolver looks up the public key for a name, and the name for a public
+// key.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) (types.PublicKey, error)
+	ReverseResolve(ctx context.Context, key types.PublicKey) (string, error)
+}
+
+// Chain tries each resolver in turn and returns the first answer that it
+// gets. If none of them have an answer then the first error that isn't
+// ErrNotFound is returned, or ErrNotFound if there wasn't one.
+type Chain []Resolver
+
+func (c Chain) Resolve(ctx context.Context, name string) (types.PublicKey, error) {
+	var first error
+	for _, r := range c {
+		key, err := r.Resolve(ctx, name)
+		if err == nil {
+			return key, nil
+		}
+		if first == nil && !errors.Is(err, ErrNotFound) {
+			first = err
+		}
+	}
+	if first != nil {
+		return types.PublicKey{}, first
+	}
+	return types.PublicKey{}, fmt.Errorf("%q: %w", name, ErrNotFound)
+}
+
+func (c Chain) ReverseResolve(ctx context.Context, key types.PublicKey) (string, error) {
+	var first error
+	for _, r := range c {
+		name, err := r.ReverseResolve(ctx, key)
+		if err == nil {
+			return name, nil
+		}
+		if first == nil && !errors.Is(err, ErrNotFound) {
+			first = err
+		}
+	}
+	if first != nil {
+		return "", first
+	}
+	return "", fmt.Errorf("%s: %w", key, ErrNotFound)
+}
+
+// ParseKey parses a public key given as hex.
+func ParseKey(s string) (types.PublicKey, error) {
+	var key types.PublicKey
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(b) != len(key) {
+		return key, fmt.Errorf("expected %d bytes but got %d", len(key), len(b))
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// ResolveKey returns the public key for something that a person has typed
+// in, which is either a hex public key or a name to look up with the given
+// resolver. The resolver can be nil, in which case only hex keys work.
+func ResolveKey(ctx context.Context, r Resolver, s string) (types.PublicKey, error) {
+	if key, err := ParseKey(s); err == nil {
+		return key, nil
+	}
+	if r == nil {
+		return types.PublicKey{}, fmt.Errorf("%q is not a hex public key", s)
+	}
+	return r.Resolve(ctx, s)
+}
+
+// Describe returns the name of the given public key if the resolver knows
+// it, followed by the key, for showing to people. The resolver can be nil.
+func Describe(ctx context.Context, r Resolver, key types.PublicKey) string {
+	if r != nil {
+		if name, err := r.ReverseResolve(ctx, key); err == nil {
+			return name + " (" + key.String() + ")"
+		}
+	}
+	return key.String()
+}
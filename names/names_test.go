@@ -0,0 +1,187 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package names
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func testKey(b byte) types.PublicKey {
+	var key types.PublicKey
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+func TestStatic(t *testing.T) {
+	alice, bob := testKey(1), testKey(2)
+	s, err := ParseStatic(strings.NewReader(
+		"# names for the test\n\n" +
+			"alice " + alice.String() + "\n" +
+			"bob\t" + bob.String() + "\n" +
+			"robert " + bob.String() + "\n",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if key, err := s.Resolve(ctx, "robert"); err != nil || key != bob {
+		t.Fatalf("expected robert to resolve to bob's key, got %s, %v", key, err)
+	}
+	if name, err := s.ReverseResolve(ctx, bob); err != nil || name != "bob" {
+		t.Fatalf("expected the first name for the key, got %q, %v", name, err)
+	}
+	if _, err := s.Resolve(ctx, "carol"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	for _, bad := range []string{
+		"alice\n",
+		"alice nothex\n",
+		"alice " + alice.String() + "\nalice " + bob.String() + "\n",
+	} {
+		if _, err := ParseStatic(strings.NewReader(bad)); err == nil {
+			t.Fatalf("expected %q to be refused", bad)
+		}
+	}
+}
+
+type fakeTXT map[string][]string
+
+func (f fakeTXT) LookupTXT(_ context.Context, name string) ([]string, error) {
+	records, ok := f[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func TestDNS(t *testing.T) {
+	alice := testKey(1)
+	d := &DNS{
+		Resolver: fakeTXT{
+			"_pinecone-key.alice.example.org": {"v=1 key=" + alice.String()},
+			"_pinecone-key.bad.example.org":   {"key=1234"},
+		},
+		Domain: "example.org",
+	}
+	ctx := context.Background()
+	for _, name := range []string{"alice", "alice.example.org", "alice.example.org."} {
+		if key, err := d.Resolve(ctx, name); err != nil || key != alice {
+			t.Fatalf("expected %q to resolve, got %s, %v", name, key, err)
+		}
+	}
+	if _, err := d.Resolve(ctx, "bob"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := d.Resolve(ctx, "bad"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected an invalid key error, got %v", err)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	alice, bob := testKey(1), testKey(2)
+	users := []matrixSearchResult{
+		{UserID: "@alice:" + alice.String(), DisplayName: "Alice"},
+		{UserID: "@bob:" + bob.String(), DisplayName: "Bob"},
+		{UserID: "@bob:matrix.org", DisplayName: "Bob"},
+	}
+	searches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != matrixSearchPath || req.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		searches++
+		var body struct {
+			SearchTerm string `json:"search_term"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		var results []matrixSearchResult
+		for _, user := range users {
+			if strings.Contains(strings.ToLower(user.UserID+" "+user.DisplayName), strings.ToLower(body.SearchTerm)) {
+				results = append(results, user)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	}))
+	defer server.Close()
+
+	m := &Matrix{Homeserver: server.URL + "/", AccessToken: "token"}
+	ctx := context.Background()
+	if key, err := m.Resolve(ctx, "@alice:"+alice.String()); err != nil || key != alice || searches != 0 {
+		t.Fatalf("expected a full user ID to resolve without searching, got %s, %v", key, err)
+	}
+	for _, name := range []string{"alice", "Alice", "@alice"} {
+		if _, err := m.Resolve(ctx, name); !errors.Is(err, ErrNotFound) || searches != 0 {
+			t.Fatalf("expected %q not to resolve without SearchNames, got %v", name, err)
+		}
+	}
+
+	m.SearchNames = true
+	for _, name := range []string{"alice", "Alice", "bob"} {
+		if _, err := m.Resolve(ctx, name); err != nil {
+			t.Fatalf("expected %q to resolve, got %v", name, err)
+		}
+	}
+	if _, err := m.Resolve(ctx, "carol"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if name, err := m.ReverseResolve(ctx, bob); err != nil || name != users[1].UserID {
+		t.Fatalf("expected bob's user ID, got %q, %v", name, err)
+	}
+
+	m.AccessToken = ""
+	if _, err := m.Resolve(ctx, "alice"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the search to fail, got %v", err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	alice, bob := testKey(1), testKey(2)
+	c := Chain{
+		NewStatic(map[string]types.PublicKey{"alice": alice}),
+		NewStatic(map[string]types.PublicKey{"alice": bob, "bob": bob}),
+	}
+	ctx := context.Background()
+	if key, err := c.Resolve(ctx, "alice"); err != nil || key != alice {
+		t.Fatalf("expected the first resolver to win, got %s, %v", key, err)
+	}
+	if key, err := c.Resolve(ctx, "bob"); err != nil || key != bob {
+		t.Fatalf("expected to fall through to the second resolver, got %s, %v", key, err)
+	}
+	if _, err := c.Resolve(ctx, "carol"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if key, err := ResolveKey(ctx, nil, alice.String()); err != nil || key != alice {
+		t.Fatalf("expected a hex key to pass through, got %s, %v", key, err)
+	}
+	if _, err := ResolveKey(ctx, nil, "alice"); err == nil {
+		t.Fatal("expected a name to fail without a resolver")
+	}
+	if got := Describe(ctx, c, alice); got != "alice ("+alice.String()+")" {
+		t.Fatalf("unexpected description %q", got)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package names
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Static is a fixed set of names, i.e. loaded from a file with LoadStatic.
+type Static struct {
+	keys  map[string]types.PublicKey
+	names map[types.PublicKey]string
+}
+
+// NewStatic returns a resolver for the given names. If more than one name
+// has the same key then reverse lookups give the first in sorted order.
+func NewStatic(names map[string]types.PublicKey) *Static {
+	s := &Static{
+		keys:  make(map[string]types.PublicKey, len(names)),
+		names: make(map[types.PublicKey]string, len(names)),
+	}
+	for name, key := range names {
+		s.keys[name] = key
+		if existing, ok := s.names[key]; !ok || name < existing {
+			s.names[key] = name
+		}
+	}
+	return s
+}
+
+// LoadStatic reads names from a file, as described in ParseStatic.
+func LoadStatic(path string) (*Static, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close() // nolint:errcheck
+	return ParseStatic(f)
+}
+
+// ParseStatic reads names with one per line, each as the name and then the
+// hex public key, separated by whitespace. Blank lines and lines starting
+// with # are ignored. The first name for a key is used for reverse lookups.
+func ParseStatic(r io.Reader) (*Static, error) {
+	s := &Static{
+		keys:  map[string]types.PublicKey{},
+		names: map[types.PublicKey]string{},
+	}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a name and a key", line)
+		}
+		key, err := ParseKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid key: %w", line, err)
+		}
+		if _, ok := s.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: %q is listed more than once", line, fields[0])
+		}
+		s.keys[fields[0]] = key
+		if _, ok := s.names[key]; !ok {
+			s.names[key] = fields[0]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err: %w", err)
+	}
+	return s, nil
+}
+
+// Len returns how many names there are.
+func (s *Static) Len() int {
+	return len(s.keys)
+}
+
+func (s *Static) Resolve(_ context.Context, name string) (types.PublicKey, error) {
+	key, ok := s.keys[name]
+	if !ok {
+		return key, fmt.Errorf("%q: %w", name, ErrNotFound)
+	}
+	return key, nil
+}
+
+func (s *Static) ReverseResolve(_ context.Context, key types.PublicKey) (string, error) {
+	name, ok := s.names[key]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return name, nil
+}
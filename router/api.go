@@ -31,20 +31,49 @@ type NeighbourInfo struct {
 }
 
 type PeerInfo struct {
-	URI       string
-	Port      int
-	PublicKey string
-	PeerType  int
-	Zone      string
+	URI        string
+	Port       int
+	Generation uint64 // how many peers the port has been given, see DisconnectGeneration
+	PublicKey  string
+	PeerType   int
+	Zone       string
+	Metadata   *types.NodeMetadata
+	Transport  *LinkStats
+	FrameRates FrameRates
+	Pacing     int  // current pacing rate in bytes per second, 0 if not paced
+	Version    int  // frame version used on the peering
+	Score      int  // reliability of the peering from 0 to 100
+	Leaf       bool // only traffic for the peer itself is sent to it, see PeerRole
+	Suspended  bool // the peering is suspended, see ConnectionIdleSuspend
+	Disabled   bool // the port is administratively disabled, see SetPortEnabled
+	Direction  int  // which way traffic flows, see LinkDirection
 }
 
 // Subscribe registers a subscriber to this node's events
 func (r *Router) Subscribe(ch chan<- events.Event) {
 	phony.Block(r, func() {
-		r._subscribers[ch] = &phony.Inbox{}
+		r._subscribers[ch] = &subscriber{done: make(chan struct{})}
 	})
 }
 
+// Unsubscribe stops sending events to a channel that was given to Subscribe.
+// Events that were still waiting to be delivered to it are dropped. Once this
+// returns, nothing more will be sent to the channel, so it doesn't need to be
+// read from any more and can be closed.
+func (r *Router) Unsubscribe(ch chan<- events.Event) {
+	var sub *subscriber
+	phony.Block(r, func() {
+		if sub = r._subscribers[ch]; sub != nil {
+			delete(r._subscribers, ch)
+		}
+	})
+	if sub == nil {
+		return
+	}
+	close(sub.done)
+	phony.Block(sub, func() {})
+}
+
 func (r *Router) Coords() types.Coordinates {
 	return r.state.coords()
 }
@@ -57,11 +86,22 @@ func (r *Router) Peers() []PeerInfo {
 				continue
 			}
 			infos = append(infos, PeerInfo{
-				URI:       string(p.uri),
-				Port:      int(p.port),
-				PublicKey: hex.EncodeToString(p.public[:]),
-				PeerType:  int(p.peertype),
-				Zone:      string(p.zone),
+				URI:        string(p.uri),
+				Port:       int(p.port),
+				Generation: p.generation,
+				PublicKey:  hex.EncodeToString(p.public[:]),
+				PeerType:   int(p.peertype),
+				Zone:       string(p.zone),
+				Metadata:   p._metadata,
+				Transport:  p.linkStats(),
+				FrameRates: p.rates.snapshot(),
+				Pacing:     int(p.pacer.rate()),
+				Version:    int(p.version),
+				Score:      int(p.score.value()*100 + 0.5),
+				Leaf:       p._leaf,
+				Suspended:  p.suspension.suspended(),
+				Disabled:   p._disabled,
+				Direction:  int(p._direction),
 			})
 		}
 	})
@@ -0,0 +1,49 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+)
+
+func TestUnsubscribe(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close() // nolint:errcheck
+
+	// Nothing ever reads from the channel, so the events pile up behind the
+	// first one until the channel is unsubscribed.
+	ch := make(chan events.Event)
+	r.Subscribe(ch)
+	phony.Block(r, func() {
+		for i := 0; i < 10; i++ {
+			r._publish(events.PeerAdded{})
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		r.Unsubscribe(ch)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Unsubscribe didn't return while events were waiting")
+	}
+	phony.Block(r, func() {
+		if n := len(r._subscribers); n != 0 {
+			t.Fatalf("expected no subscribers but got %d", n)
+		}
+		r._publish(events.PeerAdded{})
+	})
+	select {
+	case <-ch:
+		t.Fatal("expected no events after unsubscribing")
+	case <-time.After(time.Millisecond * 100):
+	}
+	// Unsubscribing twice does nothing.
+	r.Unsubscribe(ch)
+}
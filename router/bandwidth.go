@@ -0,0 +1,234 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// BandwidthUsage contains cumulative byte counts for a peering or for all
+// peerings with a given remote public key.
+type BandwidthUsage struct {
+	RxProto   uint64 `json:"rx_proto"`
+	TxProto   uint64 `json:"tx_proto"`
+	RxTraffic uint64 `json:"rx_traffic"`
+	TxTraffic uint64 `json:"tx_traffic"`
+}
+
+// Total returns the total number of bytes sent and received.
+func (u BandwidthUsage) Total() uint64 {
+	return u.RxProto + u.TxProto + u.RxTraffic + u.TxTraffic
+}
+
+func (u *BandwidthUsage) add(o BandwidthUsage) {
+	u.RxProto += o.RxProto
+	u.TxProto += o.TxProto
+	u.RxTraffic += o.RxTraffic
+	u.TxTraffic += o.TxTraffic
+}
+
+// PeerBandwidthUsage contains the cumulative usage of a single peering.
+type PeerBandwidthUsage struct {
+	Port      types.SwitchPortID `json:"port"`
+	PublicKey types.PublicKey    `json:"public_key"`
+	Usage     BandwidthUsage     `json:"usage"`
+}
+
+// BandwidthSnapshot contains the cumulative bandwidth usage of all connected
+// peerings, and of all remote public keys that we have been connected to
+// within their quota window, including peerings that have since gone away.
+type BandwidthSnapshot struct {
+	Time  time.Time                          `json:"time"`
+	Peers []PeerBandwidthUsage               `json:"peers"`
+	Keys  map[types.PublicKey]BandwidthUsage `json:"keys"`
+}
+
+// BandwidthCallbackFn is called with a new snapshot every time bandwidth
+// usage is reported, which happens every BWReportingInterval.
+type BandwidthCallbackFn func(snapshot BandwidthSnapshot)
+
+// QuotaAction determines what happens to a peering once the remote public
+// key has exceeded its transfer quota.
+type QuotaAction int
+
+const (
+	// QuotaDisconnect disconnects the peering and refuses any new peerings
+	// from the same public key.
+	QuotaDisconnect QuotaAction = iota
+	// QuotaDeprioritise keeps the peering up, but only forwards traffic from
+	// the peer when the next-hop has nothing else queued.
+	QuotaDeprioritise
+)
+
+// DefaultQuotaWindow is how long the usage of a remote public key is kept
+// after its last peering has gone away, unless the quota of the peering sets
+// a different window.
+const DefaultQuotaWindow = time.Hour * 24
+
+// ConnectionQuota sets a transfer limit, in total bytes sent and received,
+// for the remote public key of the connection. Usage is accounted for across
+// all peerings with the same public key, including reconnections, and quotas
+// are checked every BWReportingInterval. Once the key has been without a
+// peering for the whole window, its usage is forgotten and the quota starts
+// again. A zero window means DefaultQuotaWindow.
+type ConnectionQuota struct {
+	Bytes  uint64
+	Action QuotaAction
+	Window time.Duration
+}
+
+func (w ConnectionQuota) isConnectionOption() {}
+
+// InjectBandwidthCallback sets a function that will be called with a new
+// snapshot of the bandwidth usage every BWReportingInterval.
+func (r *Router) InjectBandwidthCallback(fn BandwidthCallbackFn) {
+	phony.Block(r.state, func() {
+		r.state._bandwidthCallback = fn
+	})
+}
+
+// BandwidthSnapshot returns a snapshot of the cumulative bandwidth usage
+// right now.
+func (r *Router) BandwidthSnapshot() BandwidthSnapshot {
+	var snapshot BandwidthSnapshot
+	phony.Block(r.state, func() {
+		snapshot = r.state._bandwidthSnapshot()
+	})
+	return snapshot
+}
+
+// takeBandwidthUsage returns the bandwidth used by the peering since the
+// last call, resetting the counters at the same time.
+func (p *peer) takeBandwidthUsage() BandwidthUsage {
+	return BandwidthUsage{
+		RxProto:   p.bytesRxProto.Swap(0),
+		TxProto:   p.bytesTxProto.Swap(0),
+		RxTraffic: p.bytesRxTraffic.Swap(0),
+		TxTraffic: p.bytesTxTraffic.Swap(0),
+	}
+}
+
+// pendingBandwidthUsage returns the bandwidth used by the peering since
+// the last call to takeBandwidthUsage, without resetting the counters.
+func (p *peer) pendingBandwidthUsage() BandwidthUsage {
+	return BandwidthUsage{
+		RxProto:   p.bytesRxProto.Load(),
+		TxProto:   p.bytesTxProto.Load(),
+		RxTraffic: p.bytesRxTraffic.Load(),
+		TxTraffic: p.bytesTxTraffic.Load(),
+	}
+}
+
+// quotaWindow returns how long the usage of the remote public key should be
+// kept after the peering has gone away.
+func (p *peer) quotaWindow() time.Duration {
+	if p.quota == nil || p.quota.Window <= 0 {
+		return DefaultQuotaWindow
+	}
+	return p.quota.Window
+}
+
+// _accountBandwidth adds the given usage to the cumulative counters for
+// the peering and for the remote public key, and pushes back the time at
+// which the usage of the key can be forgotten.
+func (s *state) _accountBandwidth(p *peer, usage BandwidthUsage) {
+	p._usage.add(usage)
+	total := s._keyUsage[p.public]
+	total.add(usage)
+	s._keyUsage[p.public] = total
+	if expiry := time.Now().Add(p.quotaWindow()); expiry.After(s._keyExpiry[p.public]) {
+		s._keyExpiry[p.public] = expiry
+	}
+}
+
+// _pruneKeyUsage forgets the usage of remote public keys that are no longer
+// peered and whose quota window has passed.
+func (s *state) _pruneKeyUsage(now time.Time) {
+	peered := make(map[types.PublicKey]struct{}, len(s._peers))
+	for _, p := range s._peers {
+		if p != nil {
+			peered[p.public] = struct{}{}
+		}
+	}
+	for public, expiry := range s._keyExpiry {
+		if _, ok := peered[public]; ok || now.Before(expiry) {
+			continue
+		}
+		delete(s._keyUsage, public)
+		delete(s._keyExpiry, public)
+	}
+}
+
+// _overQuota returns true if the public key has used more than the
+// given quota allows.
+func (s *state) _overQuota(public types.PublicKey, quota *ConnectionQuota) bool {
+	if quota == nil {
+		return false
+	}
+	usage := s._keyUsage[public]
+	return usage.Total() > quota.Bytes
+}
+
+// _enforceQuota is called after bandwidth has been accounted for, and
+// either disconnects or deprioritises the peer if it is over quota.
+func (s *state) _enforceQuota(p *peer) {
+	if !s._overQuota(p.public, p.quota) {
+		return
+	}
+	switch p.quota.Action {
+	case QuotaDisconnect:
+		p.stop(fmt.Errorf("transfer quota of %d bytes exceeded", p.quota.Bytes))
+	case QuotaDeprioritise:
+		if !p.deprioritised.Swap(true) {
+			s.r.log.Println("Deprioritising peer", p.public.String(), "on port", p.port, "as transfer quota was exceeded")
+		}
+	}
+}
+
+// _bandwidthSnapshot builds a snapshot of the cumulative bandwidth usage,
+// including any usage that hasn't been accounted for yet.
+func (s *state) _bandwidthSnapshot() BandwidthSnapshot {
+	snapshot := BandwidthSnapshot{
+		Time: time.Now(),
+		Keys: make(map[types.PublicKey]BandwidthUsage, len(s._keyUsage)),
+	}
+	for k, v := range s._keyUsage {
+		snapshot.Keys[k] = v
+	}
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		pending := p.pendingBandwidthUsage()
+		usage := p._usage
+		usage.add(pending)
+		snapshot.Peers = append(snapshot.Peers, PeerBandwidthUsage{
+			Port:      p.port,
+			PublicKey: p.public,
+			Usage:     usage,
+		})
+		total := snapshot.Keys[p.public]
+		total.add(pending)
+		snapshot.Keys[p.public] = total
+	}
+	return snapshot
+}
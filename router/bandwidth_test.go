@@ -0,0 +1,127 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestBandwidthQuotaAccounting(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	var public types.PublicKey
+	public[0] = 1
+	quota := &ConnectionQuota{Bytes: 1000, Action: QuotaDisconnect}
+
+	phony.Block(r.state, func() {
+		// Two peerings with the same public key should be accounted
+		// for together.
+		first := &peer{public: public}
+		second := &peer{public: public}
+		r.state._accountBandwidth(first, BandwidthUsage{RxTraffic: 400})
+		if r.state._overQuota(public, quota) {
+			t.Fatal("expected the key to be under quota")
+		}
+		r.state._accountBandwidth(second, BandwidthUsage{TxTraffic: 700})
+		if !r.state._overQuota(public, quota) {
+			t.Fatal("expected the key to be over quota")
+		}
+		if total := first._usage.Total(); total != 400 {
+			t.Fatalf("expected first peering to have used 400 bytes but got %d", total)
+		}
+		if total := r.state._keyUsage[public].Total(); total != 1100 {
+			t.Fatalf("expected key to have used 1100 bytes but got %d", total)
+		}
+	})
+
+	// A new peering from a key that is already over quota should be refused.
+	var err error
+	phony.Block(r.state, func() {
+		_, err = r.state._addPeer(peerConfig{public: public, quota: quota})
+	})
+	if err == nil {
+		t.Fatal("expected peering to be refused")
+	}
+}
+
+func TestBandwidthKeyUsagePruning(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	var gone, peered, recent types.PublicKey
+	gone[0], peered[0], recent[0] = 1, 2, 3
+	window := &ConnectionQuota{Bytes: 1000, Window: time.Minute}
+
+	phony.Block(r.state, func() {
+		r.state._accountBandwidth(&peer{public: gone, quota: window}, BandwidthUsage{RxTraffic: 100})
+		r.state._accountBandwidth(&peer{public: recent}, BandwidthUsage{RxTraffic: 100})
+		current := &peer{public: peered, quota: window}
+		r.state._accountBandwidth(current, BandwidthUsage{RxTraffic: 100})
+		r.state._peers = append(r.state._peers, current)
+		defer func() {
+			r.state._peers = r.state._peers[:len(r.state._peers)-1]
+		}()
+
+		// Nothing is forgotten before the window has passed.
+		r.state._pruneKeyUsage(time.Now())
+		if len(r.state._keyUsage) != 3 {
+			t.Fatalf("expected usage for 3 keys but got %d", len(r.state._keyUsage))
+		}
+
+		// Once it has, only the key that is no longer peered is forgotten.
+		// The key without a quota uses the much longer default window.
+		r.state._pruneKeyUsage(time.Now().Add(time.Minute * 2))
+		if _, ok := r.state._keyUsage[gone]; ok {
+			t.Fatal("expected usage for the unpeered key to be forgotten")
+		}
+		if _, ok := r.state._keyExpiry[gone]; ok {
+			t.Fatal("expected the expiry for the unpeered key to be forgotten")
+		}
+		if _, ok := r.state._keyUsage[peered]; !ok {
+			t.Fatal("expected usage for the peered key to be kept")
+		}
+		if _, ok := r.state._keyUsage[recent]; !ok {
+			t.Fatal("expected usage for the key within the default window to be kept")
+		}
+
+		r.state._pruneKeyUsage(time.Now().Add(DefaultQuotaWindow * 2))
+		if _, ok := r.state._keyUsage[recent]; ok {
+			t.Fatal("expected usage for the key past the default window to be forgotten")
+		}
+	})
+}
+
+func TestBandwidthSnapshotJSON(t *testing.T) {
+	var public types.PublicKey
+	public[0] = 1
+	snapshot := BandwidthSnapshot{
+		Time: time.Unix(1000, 0).UTC(),
+		Peers: []PeerBandwidthUsage{
+			{Port: 1, PublicKey: public, Usage: BandwidthUsage{RxTraffic: 100}},
+		},
+		Keys: map[types.PublicKey]BandwidthUsage{
+			public: {RxTraffic: 100, TxProto: 10},
+		},
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded BandwidthSnapshot
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if usage := decoded.Keys[public]; usage != snapshot.Keys[public] {
+		t.Fatalf("expected usage %+v for %s but got %+v", snapshot.Keys[public], public, usage)
+	}
+	if len(decoded.Peers) != 1 || decoded.Peers[0] != snapshot.Peers[0] {
+		t.Fatalf("expected peers %+v but got %+v", snapshot.Peers, decoded.Peers)
+	}
+}
@@ -0,0 +1,297 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/test/fixtures"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// newBenchChain creates a chain of in-process routers, each peered to the
+// next using an in-memory pipe, and waits for the tree to converge. The keys
+// are derived from the name of the test, so that the same test always runs
+// with the same nodes. The options are given to every router.
+func newBenchChain(tb testing.TB, length int, options ...RouterOption) []*Router {
+	routers := newFixtureRouters(tb, fixtures.Line(length), options...)
+	for i := 1; i < length; i++ {
+		connectPair(tb, routers[i-1], routers[i])
+	}
+	// The tree has converged once every node agrees on the root and on how
+	// deep the tree is from either end of the chain.
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		first, last := routers[0].Coords(), routers[length-1].Coords()
+		if first.DistanceTo(last) == length-1 && sameRoot(routers) {
+			return routers
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	tb.Fatal("tree did not converge in time")
+	return nil
+}
+
+// newFixtureRouters creates a router for each node in the topology, with keys
+// derived from the name of the test and the given options, but doesn't peer
+// them.
+func newFixtureRouters(tb testing.TB, topology fixtures.Topology, options ...RouterOption) []*Router {
+	routers := make([]*Router, 0, topology.Size)
+	for _, sk := range topology.Keys(tb.Name()) {
+		routers = append(routers, NewRouter(nil, sk, false, options...))
+	}
+	return routers
+}
+
+// pairEnd is one end of a peering made by connectEnds: the router, the
+// connection that it should peer over and any options for its side only.
+type pairEnd struct {
+	router  *Router
+	conn    net.Conn
+	options []ConnectionOption
+}
+
+// connectPair peers the two routers with each other over an in-memory pipe
+// and waits for the handshake to finish on both sides, returning the port
+// that each router gave the peering. Keepalives are turned off, and the
+// options are given to both sides.
+func connectPair(tb testing.TB, ra, rb *Router, options ...ConnectionOption) (types.SwitchPortID, types.SwitchPortID) {
+	pa, pb := net.Pipe()
+	return connectEnds(tb, pairEnd{ra, pa, options}, pairEnd{rb, pb, options})
+}
+
+// connectEnds is like connectPair, except that each end brings its own
+// connection, which the test might have wrapped, and its own options.
+func connectEnds(tb testing.TB, a, b pairEnd) (types.SwitchPortID, types.SwitchPortID) {
+	type result struct {
+		port types.SwitchPortID
+		err  error
+	}
+	connect := func(local, remote pairEnd, ch chan<- result) {
+		options := append([]ConnectionOption{
+			ConnectionPublicKey(remote.router.PublicKey()),
+			ConnectionKeepalives(false),
+		}, local.options...)
+		port, err := local.router.Connect(local.conn, options...)
+		ch <- result{port, err}
+	}
+	cha, chb := make(chan result, 1), make(chan result, 1)
+	go connect(a, b, cha)
+	go connect(b, a, chb)
+	ra, rb := <-cha, <-chb
+	for _, res := range []result{ra, rb} {
+		if res.err != nil {
+			tb.Fatalf("failed to connect: %s", res.err)
+		}
+	}
+	return ra.port, rb.port
+}
+
+// sameRoot returns true if all of the routers are following the same root.
+func sameRoot(routers []*Router) bool {
+	root := routers[0].TreeInfo().Root
+	for _, r := range routers[1:] {
+		if r.TreeInfo().Root != root {
+			return false
+		}
+	}
+	return true
+}
+
+func benchmarkForwardTree(b *testing.B, length int) {
+	routers := newBenchChain(b, length)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	src, dst := routers[0], routers[length-1]
+	dest := dst.Coords()
+	payload := make([]byte, 1024)
+	buf := make([]byte, types.MaxPayloadSize)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := src.WriteTo(payload, dest); err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := dst.ReadFrom(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkForwardTreeChain2(b *testing.B) { benchmarkForwardTree(b, 2) }
+func BenchmarkForwardTreeChain4(b *testing.B) { benchmarkForwardTree(b, 4) }
+func BenchmarkForwardTreeChain8(b *testing.B) { benchmarkForwardTree(b, 8) }
+
+func BenchmarkFrameMarshalUnmarshal(b *testing.B) {
+	frame := getFrame()
+	frame.Type = types.TypeVirtualSnakeRouted
+	frame.DestinationKey = types.FullMask
+	frame.Payload = append(frame.Payload[:0], make([]byte, 1024)...)
+	out := getFrame()
+	bp := frameBufferPool.Get().(*[]byte)
+	defer frameBufferPool.Put(bp)
+	buf := *bp
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := frame.MarshalBinary(buf[:])
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := out.UnmarshalBinary(buf[:n]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// newBenchStar creates a hub router with the given number of leaf routers
+// peered to it, and waits for the tree to converge. The hub is returned
+// first, followed by the leaves. As with newBenchChain, the keys are derived
+// from the name of the test. The options are given to every router.
+func newBenchStar(tb testing.TB, leaves int, options ...RouterOption) []*Router {
+	routers := newFixtureRouters(tb, fixtures.Star(leaves+1), options...)
+	hub := routers[0]
+	for _, leaf := range routers[1:] {
+		connectPair(tb, hub, leaf)
+	}
+	// The tree has converged once every leaf is two hops away from every
+	// other leaf, or one hop if one of them is the root.
+	deadline := time.Now().Add(time.Second * 10)
+	for time.Now().Before(deadline) {
+		converged := true
+		first := routers[1].Coords()
+		for _, leaf := range routers[2:] {
+			if d := first.DistanceTo(leaf.Coords()); d < 1 || d > 2 || leaf.TreeStats().Root != hub.TreeStats().Root {
+				converged = false
+				break
+			}
+		}
+		if converged {
+			return routers
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	tb.Fatal("tree did not converge in time")
+	return nil
+}
+
+// benchmarkForwardParallel sends traffic between pairs of leaves of a star
+// at the same time, all of which passes through the hub. Each peer of the hub
+// marshals and writes its frames on its own writer, so that part runs in
+// parallel for different peers, but every frame still goes through the state
+// actor at the hub to find its next hop. Throughput therefore only scales
+// with the number of pairs as far as the state actor allows, which comparing
+// the results for different numbers of pairs shows.
+func benchmarkForwardParallel(b *testing.B, pairs int) {
+	routers := newBenchStar(b, pairs*2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	leaves := routers[1:]
+	payload := make([]byte, 1024)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	errs := make(chan error, pairs)
+	for i := 0; i < pairs; i++ {
+		src, dst := leaves[i], leaves[i+pairs]
+		count := b.N / pairs
+		if i < b.N%pairs {
+			count++
+		}
+		go func() {
+			dest := dst.Coords()
+			buf := make([]byte, types.MaxPayloadSize)
+			for j := 0; j < count; j++ {
+				if _, err := src.WriteTo(payload, dest); err != nil {
+					errs <- err
+					return
+				}
+				// A frame can occasionally be dropped, i.e. if the tree is
+				// still settling, in which case send it again rather than
+				// waiting forever.
+				_ = dst.SetReadDeadline(time.Now().Add(time.Second))
+				_, from, err := dst.ReadFrom(buf)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if from == nil {
+					j--
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < pairs; i++ {
+		if err := <-errs; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkForwardParallel1(b *testing.B) { benchmarkForwardParallel(b, 1) }
+func BenchmarkForwardParallel4(b *testing.B) { benchmarkForwardParallel(b, 4) }
+func BenchmarkForwardParallel8(b *testing.B) { benchmarkForwardParallel(b, 8) }
+
+// benchmarkWrite sends large payloads across a chain of two routers, either
+// copying them in with WriteTo or writing them straight into a frame from
+// NewFrame and sending it with WriteFrameTo.
+func benchmarkWrite(b *testing.B, frames bool) {
+	routers := newBenchChain(b, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	src, dst := routers[0], routers[1]
+	dest := dst.Coords()
+	payload := make([]byte, 32*1024)
+	buf := make([]byte, types.MaxPayloadSize)
+
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if frames {
+			frame := src.NewFrame()
+			frame.Payload = frame.Payload[:len(payload)]
+			_, err = src.WriteFrameTo(frame, dest)
+		} else {
+			_, err = src.WriteTo(payload, dest)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := dst.ReadFrom(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B)      { benchmarkWrite(b, false) }
+func BenchmarkWriteFrameTo(b *testing.B) { benchmarkWrite(b, true) }
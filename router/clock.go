@@ -0,0 +1,126 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// RouterClockSkew runs the router on a skewed clock instead of the system
+// clock, which is only useful for simulating nodes whose clocks are wrong.
+// Offset is added to the current time and Rate is how fast the skewed clock
+// runs compared to real time, i.e. a rate of 1.01 gains a second every 100
+// seconds. A rate of zero is the same as a rate of one. The skewed clock is
+// used for the protocol timers, announcement and path expiry, keepalives and
+// the sequence numbers on bootstraps, but not for bandwidth reporting.
+type RouterClockSkew struct {
+	Offset time.Duration
+	Rate   float64
+}
+
+func (c RouterClockSkew) isRouterOption() {}
+
+// SetClockSkew changes the skew of the router's clock while it is running.
+// The skewed clock carries on from where it was, so changing only the rate
+// doesn't make the time jump, but changing the offset does. An offset of zero
+// and a rate of one put the router back on the system clock.
+func (r *Router) SetClockSkew(offset time.Duration, rate float64) {
+	r.clock.set(offset, rate)
+	r.state.Act(nil, r.state._schedule)
+}
+
+// ClockSkew returns the offset and rate of the router's clock, as last given
+// to RouterClockSkew or SetClockSkew.
+func (r *Router) ClockSkew() (time.Duration, float64) {
+	if skew := r.clock.load(); skew != nil {
+		return skew.offset, skew.rate
+	}
+	return 0, 1
+}
+
+// clock is the time source for the protocol. Without any skew it is the
+// system clock. Times returned by the clock should only be compared with
+// other times from the same clock.
+type clock struct {
+	skew atomic.Value // *clockSkew, or nil for no skew
+}
+
+// clockSkew anchors the skewed clock to a point in real time, from which it
+// runs at the given rate.
+type clockSkew struct {
+	offset time.Duration
+	rate   float64
+	real   time.Time // when the skew was set
+	skewed time.Time // what the skewed clock read at that point
+}
+
+func (c *clock) load() *clockSkew {
+	skew, _ := c.skew.Load().(*clockSkew)
+	return skew
+}
+
+func (c *clock) set(offset time.Duration, rate float64) {
+	if rate <= 0 {
+		rate = 1
+	}
+	if offset == 0 && rate == 1 {
+		c.skew.Store((*clockSkew)(nil))
+		return
+	}
+	now := time.Now()
+	skewed := now
+	if old := c.load(); old != nil {
+		skewed = old.at(now).Add(-old.offset)
+	}
+	c.skew.Store(&clockSkew{
+		offset: offset,
+		rate:   rate,
+		real:   now,
+		skewed: skewed.Add(offset),
+	})
+}
+
+// at returns the time on the skewed clock at the given real time.
+func (s *clockSkew) at(t time.Time) time.Time {
+	return s.skewed.Add(time.Duration(float64(t.Sub(s.real)) * s.rate))
+}
+
+// now returns the current time on the router's clock. A nil clock is the
+// system clock.
+func (c *clock) now() time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	if skew := c.load(); skew != nil {
+		return skew.at(time.Now())
+	}
+	return time.Now()
+}
+
+// since returns how long it has been since t on the router's clock.
+func (c *clock) since(t time.Time) time.Duration {
+	return c.now().Sub(t)
+}
+
+// real converts a duration on the router's clock into real time, for use
+// with timers and deadlines, which always run on the system clock.
+func (c *clock) real(d time.Duration) time.Duration {
+	if skew := c.load(); skew != nil {
+		return time.Duration(float64(d) / skew.rate)
+	}
+	return d
+}
@@ -0,0 +1,72 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterClockSkew{Offset: time.Hour, Rate: 2})
+	defer r.Close()
+
+	if offset, rate := r.ClockSkew(); offset != time.Hour || rate != 2 {
+		t.Fatalf("expected skew of 1h at rate 2, got %s at rate %v", offset, rate)
+	}
+	if d := r.clock.now().Sub(time.Now()); d < time.Hour-time.Second || d > time.Hour+time.Second {
+		t.Fatalf("expected clock to be an hour ahead, got %s", d)
+	}
+	if d := r.clock.real(time.Second); d != time.Second/2 {
+		t.Fatalf("expected a second to take half a second, got %s", d)
+	}
+	start := r.clock.now()
+	time.Sleep(time.Millisecond * 50)
+	if d := r.clock.since(start); d < time.Millisecond*100 {
+		t.Fatalf("expected clock to run at double speed, only %s passed", d)
+	}
+
+	// Changing the rate carries on from the current time, without a jump.
+	before := r.clock.now()
+	r.SetClockSkew(time.Hour, 1)
+	if d := r.clock.since(before); d < 0 || d > time.Second {
+		t.Fatalf("expected no jump when changing the rate, got %s", d)
+	}
+
+	// Removing the skew puts the router back on the system clock.
+	r.SetClockSkew(0, 1)
+	if offset, rate := r.ClockSkew(); offset != 0 || rate != 1 {
+		t.Fatalf("expected no skew, got %s at rate %v", offset, rate)
+	}
+	if d := r.clock.now().Sub(time.Now()); d > time.Second || d < -time.Second {
+		t.Fatalf("expected clock to match the system clock, got %s", d)
+	}
+}
+
+func TestClockSkewExpiresAnnouncements(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	r := routers[0]
+	if r.TreeInfo().IsRoot() {
+		r = routers[1]
+	}
+	if len(r.StateDump().Candidates) == 0 {
+		t.Fatal("expected a parent candidate")
+	}
+
+	// Jumping the clock past the announcement timeout makes the announcement
+	// from our parent look like it has expired.
+	r.SetClockSkew(announcementTimeout*2, 1)
+	dump := r.StateDump()
+	if len(dump.Candidates) == 0 {
+		t.Fatal("expected a parent candidate")
+	}
+	if reason := dump.Candidates[0].Ineligible; reason != "announcement expired" {
+		t.Fatalf("expected the announcement to have expired, got %q", reason)
+	}
+}
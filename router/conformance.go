@@ -0,0 +1,141 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// RouterStrictConformance enables reason-coded drops, where every frame that
+// the router drops or rejects is tagged with a DropReason and counted, so
+// that interop problems between nodes running different versions can be
+// diagnosed from DropCounts, DropCountsByType or the debug endpoint. If
+// LogEvery is set then every n-th drop for each reason is also written to the
+// log along with the peer and frame details. Without this option, drops are
+// not counted.
+type RouterStrictConformance struct {
+	LogEvery uint64 // log one in this many drops per reason, 0 to not log
+}
+
+func (c RouterStrictConformance) isRouterOption() {}
+
+// frameTypeCount is the number of known frame types, which drops and inbound
+// frame rates are tracked for separately. Frames of unknown types are only
+// counted by reason, and their rates aren't tracked.
+const frameTypeCount = int(types.TypePeerExchange) + 1
+
+// conformance counts the frames dropped for each reason, both in total and
+// for each frame type. It is safe to use from any actor, since queues drop
+// frames from the writer goroutines.
+type conformance struct {
+	log      types.Logger
+	logEvery uint64
+	counts   [dropReasonCount]atomic.Uint64
+	byType   [frameTypeCount][dropReasonCount]atomic.Uint64
+}
+
+// drop records that a frame received from or destined for the given peer was
+// dropped for the given reason. It does nothing if strict conformance mode
+// is not enabled.
+func (c *conformance) drop(reason DropReason, peer types.PublicKey, f *types.Frame) {
+	if c == nil || reason < 0 || reason >= dropReasonCount {
+		return
+	}
+	n := c.counts[reason].Inc()
+	if int(f.Type) < frameTypeCount {
+		c.byType[f.Type][reason].Inc()
+	}
+	if c.logEvery == 0 || (n-1)%c.logEvery != 0 {
+		return
+	}
+	c.log.Printf(
+		"Dropped frame of type %s (peer %s, src %s, dst %s): %s (%d so far)",
+		f.Type, peer.String()[:8], f.SourceKey.String()[:8],
+		f.DestinationKey.String()[:8], reason.Code(), n,
+	)
+}
+
+// DropCounts returns how many frames have been dropped for each reason since
+// the router started. It returns nil unless the router was created with the
+// RouterStrictConformance option.
+func (r *Router) DropCounts() map[DropReason]uint64 {
+	if r.conformance == nil {
+		return nil
+	}
+	counts := make(map[DropReason]uint64, dropReasonCount)
+	for reason := DropReason(0); reason < dropReasonCount; reason++ {
+		if n := r.conformance.counts[reason].Load(); n > 0 {
+			counts[reason] = n
+		}
+	}
+	return counts
+}
+
+// DropCountsByType returns how many frames of each type have been dropped for
+// each reason since the router started, so that protocol frames being
+// dropped, which usually points to a problem, can be told apart from traffic
+// being shed under load, which is expected. Frames of types that the router
+// doesn't know about are only included in DropCounts. It returns nil unless
+// the router was created with the RouterStrictConformance option.
+func (r *Router) DropCountsByType() map[types.FrameType]map[DropReason]uint64 {
+	if r.conformance == nil {
+		return nil
+	}
+	counts := make(map[types.FrameType]map[DropReason]uint64, frameTypeCount)
+	for t := 0; t < frameTypeCount; t++ {
+		for reason := DropReason(0); reason < dropReasonCount; reason++ {
+			n := r.conformance.byType[t][reason].Load()
+			if n == 0 {
+				continue
+			}
+			if counts[types.FrameType(t)] == nil {
+				counts[types.FrameType(t)] = make(map[DropReason]uint64)
+			}
+			counts[types.FrameType(t)][reason] = n
+		}
+	}
+	return counts
+}
+
+// DropTotals are the number of frames that have been dropped, split into
+// protocol frames and traffic frames, see DropCountsByType.
+type DropTotals struct {
+	Protocol uint64 `json:"protocol"`
+	Traffic  uint64 `json:"traffic"`
+}
+
+// DropTotals returns how many protocol frames and traffic frames have been
+// dropped since the router started. Both are zero unless the router was
+// created with the RouterStrictConformance option.
+func (r *Router) DropTotals() DropTotals {
+	var totals DropTotals
+	if r.conformance == nil {
+		return totals
+	}
+	for t := 0; t < frameTypeCount; t++ {
+		var n uint64
+		for reason := DropReason(0); reason < dropReasonCount; reason++ {
+			n += r.conformance.byType[t][reason].Load()
+		}
+		switch types.FrameType(t) {
+		case types.TypeTreeRouted, types.TypeVirtualSnakeRouted:
+			totals.Traffic += n
+		default:
+			totals.Protocol += n
+		}
+	}
+	return totals
+}
@@ -0,0 +1,113 @@
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestStrictConformanceCountsDrops(t *testing.T) {
+	var buf bytes.Buffer
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(log.New(&buf, "", 0), sk, false, RouterStrictConformance{LogEvery: 2})
+	defer r.Close()
+
+	phony.Block(r.state, func() {
+		for i := 0; i < 3; i++ {
+			f := getFrame()
+			f.Type = types.FrameType(0xff)
+			_ = r.state._forward(r.local, f)
+		}
+		f := getFrame()
+		f.Type = types.TypeVirtualSnakeBootstrap
+		f.Payload = append(f.Payload[:0], 0x01)
+		r.state._handleBootstrap(r.local, nil, f)
+	})
+
+	counts := r.DropCounts()
+	if n := counts[DropUnknownType]; n != 3 {
+		t.Fatalf("expected 3 unknown type drops but got %d", n)
+	}
+	if n := counts[DropMalformed]; n != 1 {
+		t.Fatalf("expected 1 malformed drop but got %d", n)
+	}
+	// The first and third unknown type drops are logged, along with the
+	// first malformed drop.
+	if n := strings.Count(buf.String(), "unknown_type"); n != 2 {
+		t.Fatalf("expected 2 unknown type drops to be logged but got %d", n)
+	}
+	if n := strings.Count(buf.String(), "malformed"); n != 1 {
+		t.Fatalf("expected 1 malformed drop to be logged but got %d", n)
+	}
+
+	j, err := json.Marshal(counts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"unknown_type":3`) {
+		t.Fatalf("expected reason codes as JSON keys but got %s", j)
+	}
+}
+
+func TestDropCountsWithoutStrictConformance(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	phony.Block(r.state, func() {
+		f := getFrame()
+		f.Type = types.FrameType(0xff)
+		_ = r.state._forward(r.local, f)
+	})
+	if counts := r.DropCounts(); counts != nil {
+		t.Fatalf("expected no drop counts but got %v", counts)
+	}
+}
+
+func TestDropCountsByType(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterStrictConformance{})
+	defer r.Close()
+
+	phony.Block(r.state, func() {
+		for _, ft := range []types.FrameType{
+			types.TypeVirtualSnakeBootstrap, types.TypeTreeRouted, types.TypeTreeRouted, types.FrameType(0xff),
+		} {
+			f := getFrame()
+			f.Type = ft
+			r.conformance.drop(DropQueueFull, r.public, f)
+		}
+	})
+
+	byType := r.DropCountsByType()
+	if n := byType[types.TypeTreeRouted][DropQueueFull]; n != 2 {
+		t.Fatalf("expected 2 tree-routed drops but got %d", n)
+	}
+	if n := byType[types.TypeVirtualSnakeBootstrap][DropQueueFull]; n != 1 {
+		t.Fatalf("expected 1 bootstrap drop but got %d", n)
+	}
+	if len(byType) != 2 {
+		t.Fatalf("expected drops for 2 frame types but got %v", byType)
+	}
+	// Frames of unknown types are still counted by reason.
+	if n := r.DropCounts()[DropQueueFull]; n != 4 {
+		t.Fatalf("expected 4 queue full drops but got %d", n)
+	}
+	if totals := r.DropTotals(); totals.Protocol != 1 || totals.Traffic != 2 {
+		t.Fatalf("expected 1 protocol and 2 traffic drops but got %+v", totals)
+	}
+
+	j, err := json.Marshal(r.DebugStats().DropsByType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"TreeRouted":{"queue_full":2}`) {
+		t.Fatalf("expected frame type names as JSON keys but got %s", j)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net"
+)
+
+// ConnectionDatagrams tells the router that the connection carries
+// datagrams rather than a stream, as with a connected UDP socket or a radio
+// modem, so that each read returns exactly one frame and each frame is sent
+// using a single write. Frames aren't coalesced into larger writes on these
+// peerings. The link must be able to carry datagrams of up to
+// types.MaxFrameSize bytes, unless it is given a smaller ConnectionMTU, and
+// a datagram that doesn't hold exactly one frame ends the peering. A lost
+// datagram only loses the frame inside it, although since the handshake isn't
+// retried, a lost handshake datagram means that Connect fails.
+// ConnectionTargetKey can't be used on datagram peerings.
+type ConnectionDatagrams bool
+
+func (c ConnectionDatagrams) isConnectionOption() {}
+
+// PacketConnLink returns a net.Conn that exchanges datagrams with the given
+// remote address over the packet connection, for use with Connect and
+// ConnectionDatagrams. Datagrams from any other address are ignored. The
+// link takes ownership of the packet connection and closes it when the link
+// is closed, so a packet connection can only be used for a single link.
+func PacketConnLink(conn net.PacketConn, remote net.Addr) net.Conn {
+	return &packetConnLink{conn, remote}
+}
+
+type packetConnLink struct {
+	net.PacketConn
+	remote net.Addr
+}
+
+func (c *packetConnLink) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		if addr.String() == c.remote.String() {
+			return n, nil
+		}
+	}
+}
+
+func (c *packetConnLink) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.remote)
+}
+
+func (c *packetConnLink) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func newDatagramLinks(t *testing.T) (net.Conn, net.Conn) {
+	ua, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ub, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return PacketConnLink(ua, ub.LocalAddr()), PacketConnLink(ub, ua.LocalAddr())
+}
+
+func TestDatagramPeering(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false)
+	rb := NewRouter(nil, skb, false)
+	defer ra.Close()
+	defer rb.Close()
+
+	la, lb := newDatagramLinks(t)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := rb.Connect(lb, ConnectionDatagrams(true))
+		errs <- err
+	}()
+	if _, err := ra.Connect(la, ConnectionDatagrams(true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// Agreeing on the root isn't enough, since if ra is the root then it may
+	// not have heard from rb yet, in which case it would deliver frames for
+	// rb to itself.
+	waitFor(t, "a SNEK route", func() bool {
+		hop := ra.NextHop(nil, types.TypeVirtualSnakeRouted, rb.PublicKey())
+		return ra.TreeInfo().Root == rb.TreeInfo().Root && hop == rb.PublicKey()
+	})
+
+	// Send enough frames in a row that they would have been coalesced into
+	// a single write on a stream peering.
+	payload := bytes.Repeat([]byte{0xaa}, 512)
+	buf := make([]byte, 1024)
+	_ = rb.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for i := 0; i < 8; i++ {
+		if _, err := ra.WriteTo(payload, rb.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		n, from, err := rb.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from == nil {
+			t.Fatal("timed out waiting for frame")
+		}
+		if from.String() != ra.PublicKey().String() || !bytes.Equal(buf[:n], payload) {
+			t.Fatalf("unexpected frame from %s", from)
+		}
+	}
+}
+
+func TestDatagramTargetKeyRefused(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	la, lb := newDatagramLinks(t)
+	defer lb.Close()
+	if _, err := r.Connect(la, ConnectionDatagrams(true), ConnectionTargetKey(r.PublicKey())); err == nil {
+		t.Fatal("expected target key to be refused on a datagram peering")
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// DebugStats contains a snapshot of the runtime state of the router,
+// which is useful when trying to profile performance problems on
+// live nodes.
+type DebugStats struct {
+	Goroutines         int                   `json:"goroutines"`
+	StateLatency       time.Duration         `json:"state_actor_latency_ns"`
+	FrameAllocs        uint64                `json:"frame_pool_allocs"`
+	FrameBufAllocs     uint64                `json:"frame_buffer_pool_allocs"`
+	FrameDebug         bool                  `json:"frame_debug"`        // built with the framedebug tag
+	FrameLeaks         uint64                `json:"frame_leaks"`        // only counted with FrameDebug
+	FrameDoubleFrees   uint64                `json:"frame_double_frees"` // only counted with FrameDebug
+	PeerCount          int                   `json:"peer_count"`
+	SNEKEntries        int                   `json:"snek_entries"`
+	SNEKEvictions      uint64                `json:"snek_evictions"`
+	SNEKRejected       uint64                `json:"snek_bootstraps_rejected"`
+	SNEKReplayed       uint64                `json:"snek_bootstraps_replayed"`
+	LocalQueueCount    int                   `json:"local_queue_count"`
+	QueuePurged        uint64                `json:"queue_frames_purged"`   // dropped when their peer went away
+	QueueRequeued      uint64                `json:"queue_frames_requeued"` // moved to another peer
+	HandshakesInFlight int                   `json:"handshakes_in_flight"`
+	HandshakesRejected uint64                `json:"handshakes_rejected"`
+	LoopbackFrames     uint64                `json:"loopback_frames"`
+	OversizedFrames    uint64                `json:"oversized_frames"` // refused by the reader, see ConnectionMTU
+	StateLoad          StateLoad             `json:"state_load"`
+	SetupLatency       SetupLatency          `json:"setup_latency"`
+	Drops              map[DropReason]uint64 `json:"drops,omitempty"`
+	DropsByType        DropsByType           `json:"drops_by_type,omitempty"`
+	DropTotals         DropTotals            `json:"drop_totals"`
+	Peers              []DebugPeer           `json:"peers"`
+}
+
+// DropsByType are the drop counts from DropCountsByType, keyed by the name of
+// the frame type.
+type DropsByType map[string]map[DropReason]uint64
+
+// byName returns the frame rates keyed by the name of the frame type.
+func (r FrameRates) byName() map[string]float64 {
+	if r == nil {
+		return nil
+	}
+	rates := make(map[string]float64, len(r))
+	for t, rate := range r {
+		rates[t.String()] = rate
+	}
+	return rates
+}
+
+// DebugPeer contains the queue state for a single connected peer.
+type DebugPeer struct {
+	Port         types.SwitchPortID `json:"port"`
+	PublicKey    types.PublicKey    `json:"public_key"`
+	ProtoCount   int                `json:"proto_queue_count"`
+	ProtoSize    int                `json:"proto_queue_size"`
+	TrafficCount int                `json:"traffic_queue_count"`
+	TrafficSize  int                `json:"traffic_queue_size"`
+	Transport    *LinkStats         `json:"transport,omitempty"` // see TransportStats
+	FrameRates   map[string]float64 `json:"frame_rates,omitempty"`
+	Goroutines   int                `json:"goroutines"` // running the peer's reader and writer right now, at most 2
+}
+
+// DebugStats returns a snapshot of the router runtime statistics. The
+// state actor latency is measured as the time taken for a no-op task
+// to make its way through the state actor inbox, which gives a rough
+// idea of how backed up the actor is.
+func (r *Router) DebugStats() DebugStats {
+	stats := DebugStats{
+		FrameAllocs:        framePoolAllocs.Load(),
+		FrameBufAllocs:     frameBufferPoolAllocs.Load(),
+		FrameDebug:         frameDebug,
+		FrameLeaks:         frameLeaks.Load(),
+		FrameDoubleFrees:   frameDoubleFrees.Load(),
+		LocalQueueCount:    r.local.traffic.queuecount(),
+		HandshakesInFlight: int(r.handshakes.inflight.Load()),
+		HandshakesRejected: r.handshakes.rejected.Load(),
+		LoopbackFrames:     r.loopbacks.Load(),
+		OversizedFrames:    r.oversized.Load(),
+		StateLoad:          r.StateLoad(),
+		SetupLatency:       r.SetupLatency(),
+		Drops:              r.DropCounts(),
+		DropTotals:         r.DropTotals(),
+	}
+	if byType := r.DropCountsByType(); byType != nil {
+		stats.DropsByType = make(map[string]map[DropReason]uint64, len(byType))
+		for t, counts := range byType {
+			stats.DropsByType[t.String()] = counts
+		}
+	}
+	start := time.Now()
+	phony.Block(r.state, func() {
+		stats.StateLatency = time.Since(start)
+		stats.SNEKEntries = len(r.state._table)
+		stats.SNEKEvictions = r.state._tableEvictions
+		stats.SNEKRejected = r.state._bootstrapsRejected
+		stats.SNEKReplayed = r.state._bootstrapsReplayed
+		stats.QueuePurged = r.state._queuePurged
+		stats.QueueRequeued = r.state._queueRequeued
+		for _, p := range r.state._peers {
+			if p == nil || p.port == 0 || !p.started.Load() {
+				continue
+			}
+			stats.PeerCount++
+			stats.Peers = append(stats.Peers, DebugPeer{
+				Port:         p.port,
+				PublicKey:    p.public,
+				ProtoCount:   p.proto.queuecount(),
+				ProtoSize:    p.proto.queuesize(),
+				TrafficCount: p.traffic.queuecount(),
+				TrafficSize:  p.traffic.queuesize(),
+				Transport:    p.linkStats(),
+				FrameRates:   p.rates.snapshot().byName(),
+				Goroutines:   int(p.goroutines.Load()),
+			})
+		}
+	})
+	stats.Goroutines = runtime.NumGoroutine()
+	return stats
+}
+
+// DebugHandler is an HTTP handler that returns the output of DebugStats
+// as JSON. It is intended to be mounted alongside the pprof handlers on
+// an opt-in debug listener.
+func (r *Router) DebugHandler(w http.ResponseWriter, req *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r.DebugStats()); err != nil {
+		w.WriteHeader(500)
+		return
+	}
+}
+
+// pcapLinkTypeUser0 is the first of the pcap link types reserved for
+// private use. Wireshark can be told how to decode it if needed.
+const pcapLinkTypeUser0 = 147
+
+// maxMirrorRate is the most frames per second that MirrorHandler will
+// capture, which also bounds the size of its channel.
+const maxMirrorRate = 10000
+
+// MirrorHandler is an HTTP handler that mirrors the traffic on a switch port
+// and streams it back in pcap format, so that it can be saved to a file and
+// opened in Wireshark, e.g. with curl -o. The "port" query parameter is
+// required, whereas "snaplen", "rate" (frames per second) and "seconds" are
+// optional. The snap length can be at most the longest frame, and the rate
+// at most maxMirrorRate. Each captured packet begins with a single byte
+// indicating the direction (0 for received, 1 for sent), followed by the raw
+// frame.
+func (r *Router) MirrorHandler(w http.ResponseWriter, req *http.Request) {
+	param := func(name string, def int) (int, error) {
+		if v := req.URL.Query().Get(name); v != "" {
+			return strconv.Atoi(v)
+		}
+		return def, nil
+	}
+	port, err := param("port", 0)
+	if err != nil || port <= 0 {
+		http.Error(w, "a valid port must be specified", http.StatusBadRequest)
+		return
+	}
+	snaplen, err := param("snaplen", 256)
+	if err != nil || snaplen <= 0 || snaplen > r.maxFrameSize() {
+		http.Error(w, fmt.Sprintf("snaplen must be between 1 and %d", r.maxFrameSize()), http.StatusBadRequest)
+		return
+	}
+	rate, err := param("rate", 100)
+	if err != nil || rate <= 0 || rate > maxMirrorRate {
+		http.Error(w, fmt.Sprintf("rate must be between 1 and %d", maxMirrorRate), http.StatusBadRequest)
+		return
+	}
+	seconds, err := param("seconds", 30)
+	if err != nil || seconds <= 0 {
+		http.Error(w, "seconds must be positive", http.StatusBadRequest)
+		return
+	}
+
+	ch := make(chan MirroredFrame, rate)
+	stop, err := r.MirrorPort(types.SwitchPortID(port), ch, snaplen, rate)
+	switch {
+	case errors.Is(err, ErrPortNotConnected):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"port"+strconv.Itoa(port)+".pcap\"")
+	flusher, _ := w.(http.Flusher)
+
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], uint32(snaplen+1))
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkTypeUser0)
+	if _, err := w.Write(header[:]); err != nil {
+		return
+	}
+
+	timeout := time.After(time.Duration(seconds) * time.Second)
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-r.context.Done():
+			return
+		case <-timeout:
+			return
+		case frame := <-ch:
+			var record [17]byte
+			binary.LittleEndian.PutUint32(record[0:4], uint32(frame.Time.Unix()))
+			binary.LittleEndian.PutUint32(record[4:8], uint32(frame.Time.Nanosecond()/1000))
+			binary.LittleEndian.PutUint32(record[8:12], uint32(len(frame.Data)+1))
+			binary.LittleEndian.PutUint32(record[12:16], uint32(frame.Length+1))
+			record[16] = byte(frame.Direction)
+			if _, err := w.Write(record[:]); err != nil {
+				return
+			}
+			if _, err := w.Write(frame.Data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
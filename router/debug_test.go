@@ -0,0 +1,102 @@
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestMirrorHandlerParameters(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	_, sk, _ := ed25519.GenerateKey(nil)
+	embedded := NewRouter(nil, sk, false, RouterEmbedded(true))
+	defer embedded.Close()
+
+	for _, tc := range []struct {
+		name   string
+		router *Router
+		query  string
+		code   int
+	}{
+		{"NoPort", routers[0], "", http.StatusBadRequest},
+		{"NegativeRate", routers[0], "port=1&rate=-1", http.StatusBadRequest},
+		{"HugeRate", routers[0], "port=1&rate=1000000000", http.StatusBadRequest},
+		{"ZeroSnaplen", routers[0], "port=1&snaplen=0", http.StatusBadRequest},
+		{"HugeSnaplen", routers[0], "port=1&snaplen=1000000000", http.StatusBadRequest},
+		{"ZeroSeconds", routers[0], "port=1&seconds=0", http.StatusBadRequest},
+		{"NotConnected", routers[0], "port=9", http.StatusNotFound},
+		{"Embedded", embedded, "port=1", http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tc.router.MirrorHandler(rec, httptest.NewRequest(http.MethodGet, "/mirror?"+tc.query, nil))
+			if rec.Code != tc.code {
+				t.Fatalf("expected status %d, got %d (%s)", tc.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestMirrorHandlerTruncates(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	src, dst := routers[0], routers[1]
+	waitFor(t, "a route to the other node", func() bool {
+		return src.NextHop(nil, types.TypeVirtualSnakeRouted, dst.PublicKey()) == dst.PublicKey()
+	})
+
+	const snaplen = 16
+	payload := bytes.Repeat([]byte("x"), 256)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+			_, _ = src.WriteTo(payload, dst.PublicKey())
+			time.Sleep(time.Millisecond * 20)
+		}
+	}()
+	rec := httptest.NewRecorder()
+	src.MirrorHandler(rec, httptest.NewRequest(http.MethodGet, "/mirror?port=1&seconds=1&snaplen=16", nil))
+	<-done
+
+	out := rec.Body.Bytes()
+	if len(out) < 24 {
+		t.Fatalf("expected a pcap header, got %d bytes", len(out))
+	}
+	if got := binary.LittleEndian.Uint32(out[16:20]); got != snaplen+1 {
+		t.Fatalf("expected a snap length of %d in the header, got %d", snaplen+1, got)
+	}
+	var long int
+	for out = out[24:]; len(out) >= 16; {
+		incl := int(binary.LittleEndian.Uint32(out[8:12]))
+		orig := int(binary.LittleEndian.Uint32(out[12:16]))
+		if incl > snaplen+1 || incl > orig {
+			t.Fatalf("expected at most %d bytes of a %d byte frame, got %d", snaplen+1, orig, incl)
+		}
+		if orig > len(payload) {
+			long++
+		}
+		if len(out) < 16+incl {
+			t.Fatal("truncated pcap record")
+		}
+		out = out[16+incl:]
+	}
+	if long == 0 {
+		t.Fatal("expected the traffic frames to be captured")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// ListenerDemux allows several routers in the same process to share a single
+// listener. Inbound connections are passed to the router whose public key the
+// remote side asked for with ConnectionTargetKey, or to the fallback router if
+// the remote side didn't ask for one, which is what older nodes will do.
+type ListenerDemux struct {
+	mutex    sync.RWMutex
+	routers  map[types.PublicKey]*Router
+	fallback *Router
+	timeout  time.Duration
+}
+
+// NewListenerDemux creates a new demultiplexer. The fallback router receives
+// connections that don't name a target, and may be nil, in which case those
+// connections will be refused.
+func NewListenerDemux(fallback *Router) *ListenerDemux {
+	d := &ListenerDemux{
+		routers:  map[types.PublicKey]*Router{},
+		fallback: fallback,
+		timeout:  peerKeepaliveInterval,
+	}
+	if fallback != nil {
+		d.Add(fallback)
+	}
+	return d
+}
+
+// Add makes the router available as a target for inbound connections.
+func (d *ListenerDemux) Add(r *Router) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.routers[r.public] = r
+}
+
+// Remove stops passing inbound connections to the router. Peerings that were
+// already accepted are not affected.
+func (d *ListenerDemux) Remove(r *Router) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.routers, r.public)
+	if d.fallback == r {
+		d.fallback = nil
+	}
+}
+
+// Connect reads the start of the handshake from an inbound connection, works
+// out which router it is meant for and then connects it to that router with
+// the given options. The options must not include a ConnectionPublicKey, as
+// the handshake is needed to find the target. The router that accepted the
+// connection is returned along with the port it was connected to.
+func (d *ListenerDemux) Connect(conn net.Conn, options ...ConnectionOption) (*Router, types.SwitchPortID, error) {
+	for _, option := range options {
+		if _, ok := option.(ConnectionPublicKey); ok {
+			conn.Close()
+			return nil, 0, fmt.Errorf("demultiplexed connections must autonegotiate")
+		}
+	}
+
+	buf := make([]byte, handshakeLength+ed25519.PublicKeySize)
+	if err := conn.SetReadDeadline(time.Now().Add(d.timeout)); err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("conn.SetReadDeadline: %w", err)
+	}
+	if _, err := io.ReadFull(conn, buf[:handshakeLength]); err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("io.ReadFull: %w", err)
+	}
+	var target types.PublicKey
+	prefix := buf[:handshakeLength]
+	if buf[1]&handshakeFlagTarget != 0 {
+		if _, err := io.ReadFull(conn, buf[handshakeLength:]); err != nil {
+			conn.Close()
+			return nil, 0, fmt.Errorf("io.ReadFull: %w", err)
+		}
+		copy(target[:], buf[handshakeLength:])
+		prefix = buf
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, 0, fmt.Errorf("conn.SetReadDeadline: %w", err)
+	}
+
+	d.mutex.RLock()
+	r := d.fallback
+	if !target.IsZero() {
+		r = d.routers[target]
+	}
+	d.mutex.RUnlock()
+	if r == nil {
+		conn.Close()
+		if target.IsZero() {
+			return nil, 0, fmt.Errorf("no target was given and there is no fallback router")
+		}
+		return nil, 0, fmt.Errorf("no router with public key %s", target)
+	}
+
+	// The router will read the handshake again, so replay the part that we
+	// have already consumed, including the target key, which the router
+	// checks for itself.
+	port, err := r.Connect(&prefixedConn{Conn: conn, prefix: prefix}, options...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, port, nil
+}
+
+// prefixedConn returns the prefix from reads before reading from the
+// underlying connection.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
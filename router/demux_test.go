@@ -0,0 +1,112 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestListenerDemux(t *testing.T) {
+	newRouter := func() *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		return NewRouter(nil, sk, false)
+	}
+	fallback, other, client := newRouter(), newRouter(), newRouter()
+	defer fallback.Close()
+	defer other.Close()
+	defer client.Close()
+
+	d := NewListenerDemux(fallback)
+	d.Add(other)
+
+	connect := func(options ...ConnectionOption) (*Router, error) {
+		pa, pb := net.Pipe()
+		errch := make(chan error, 1)
+		go func() {
+			_, err := client.Connect(pa, options...)
+			errch <- err
+		}()
+		r, _, err := d.Connect(pb)
+		if err != nil {
+			return nil, err
+		}
+		return r, <-errch
+	}
+
+	// Connections that name a target should reach that router.
+	r, err := connect(ConnectionTargetKey(other.PublicKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != other {
+		t.Fatalf("expected connection to reach %s but it reached %s", other.PublicKey(), r.PublicKey())
+	}
+
+	// Connections that don't name a target should reach the fallback.
+	r, err = connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != fallback {
+		t.Fatalf("expected connection to reach the fallback but it reached %s", r.PublicKey())
+	}
+
+	// Connections that name a router that isn't there should be refused.
+	d.Remove(other)
+	if _, err = connect(ConnectionTargetKey(other.PublicKey())); err == nil {
+		t.Fatal("expected connection to an unknown router to fail")
+	}
+}
+
+func TestConnectTargetKey(t *testing.T) {
+	newRouter := func() *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		return NewRouter(nil, sk, false)
+	}
+	client, server := newRouter(), newRouter()
+	defer client.Close()
+	defer server.Close()
+	// Both sides write their handshake before reading, so this needs a
+	// buffered connection rather than a pipe.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	connect := func(target types.PublicKey) error {
+		errch := make(chan error, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				_, err = server.Connect(conn, ConnectionKeepalives(false))
+			}
+			errch <- err
+		}()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		_, _ = client.Connect(conn, ConnectionTargetKey(target), ConnectionKeepalives(false))
+		return <-errch
+	}
+
+	// A connection that was meant for someone else is refused by the
+	// listening side.
+	_, other, _ := ed25519.GenerateKey(nil)
+	var wrong types.PublicKey
+	copy(wrong[:], other.Public().(ed25519.PublicKey))
+	if err := connect(wrong); err == nil {
+		t.Fatal("expected a connection for another key to be refused")
+	}
+
+	// A connection meant for us is accepted without the target key being
+	// left behind in the frame stream, so the peering converges.
+	if err := connect(server.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the peering to converge", func() bool {
+		return sameRoot([]*Router{client, server})
+	})
+}
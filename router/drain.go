@@ -0,0 +1,60 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// SetPortEnabled administratively disables or re-enables the peer on the
+// given port without closing the connection, i.e. to drain a link before
+// maintenance. A disabled port is never chosen as a next-hop or as our
+// parent, and we stop sending root announcements to it, so the peer stops
+// routing via us once our last announcement expires. Keepalives and the
+// peering itself carry on as normal, and frames that arrive on a disabled
+// port are still handled. If the peer was our parent then we look for a new
+// parent straight away, and when the port is re-enabled we check straight
+// away whether the peer would make a better parent again.
+func (r *Router) SetPortEnabled(port types.SwitchPortID, enabled bool) {
+	phony.Block(r.state, func() {
+		if port == 0 || int(port) >= len(r.state._peers) {
+			return
+		}
+		p := r.state._peers[port]
+		if p == nil || !p.started.Load() || p._disabled == !enabled {
+			return
+		}
+		p._disabled = !enabled
+		switch {
+		case enabled:
+			// The last announcement from the peer was kept while the port was
+			// disabled, so if it is still valid then we can go back to using
+			// the peer as our parent straight away. Either way, tell the peer
+			// about our root rather than waiting for the next maintenance
+			// interval, so that it can start using the port again.
+			if !r.state._selectNewParent() {
+				r.state.sendTreeAnnouncementToPeer(r.state._rootAnnouncement(), p)
+			}
+			r.state._bootstrapSoon()
+		case p == r.state._parent:
+			if r.state._selectNewParent() {
+				r.state._bootstrapSoon()
+			}
+		default:
+			r.state._bootstrapSoon()
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package router
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestSetPortEnabled(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	root, child := routers[0], routers[1]
+	if !root.TreeInfo().IsRoot() {
+		root, child = child, root
+	}
+	port := types.SwitchPortID(peerInfoFor(t, child, root).Port)
+
+	// Disabling our only port to the root leaves us with no parent, so we
+	// become a root of our own and stop routing via the peer.
+	child.SetPortEnabled(port, false)
+	if !peerInfoFor(t, child, root).Disabled {
+		t.Fatal("expected the port to be disabled")
+	}
+	if !child.TreeInfo().IsRoot() {
+		t.Fatal("expected the child to stop using the disabled port as its parent")
+	}
+	dump := child.StateDump()
+	if len(dump.Candidates) == 0 || dump.Candidates[0].Ineligible != "port disabled" {
+		t.Fatalf("expected the parent candidate to be ineligible, got %+v", dump.Candidates)
+	}
+	if hop := child.NextHop(nil, types.TypeVirtualSnakeRouted, root.PublicKey()); hop == root.PublicKey() {
+		t.Fatalf("expected no next-hop over the disabled port, got %s", hop)
+	}
+
+	// The peering itself stays up on both sides.
+	_ = peerInfoFor(t, root, child)
+
+	// Re-enabling the port lets us go back to the real root before it
+	// returns, using the announcement that the root sent us before.
+	child.SetPortEnabled(port, true)
+	if peerInfoFor(t, child, root).Disabled {
+		t.Fatal("expected the port to be enabled")
+	}
+	if child.TreeInfo().IsRoot() || !sameRoot(routers) {
+		t.Fatal("expected the child to rejoin the tree straight away")
+	}
+	if hop := child.NextHop(nil, types.TypeVirtualSnakeRouted, root.PublicKey()); hop != root.PublicKey() {
+		t.Fatal("expected a next-hop over the re-enabled port")
+	}
+}
+
+// peerInfoFor returns the peer info that r has for the peering with remote.
+func peerInfoFor(t *testing.T, r, remote *Router) PeerInfo {
+	key := remote.PublicKey()
+	for _, info := range r.Peers() {
+		if info.PublicKey == hex.EncodeToString(key[:]) {
+			return info
+		}
+	}
+	t.Fatal("peering not found")
+	return PeerInfo{}
+}
@@ -0,0 +1,200 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// DropReason explains why a frame was dropped.
+type DropReason int
+
+const (
+	DropQueueFull     DropReason = iota // the queue towards the next-hop was full
+	DropExpired                         // the frame waited in the queue for too long
+	DropBadSignature                    // a signature on the frame didn't verify
+	DropStaleSequence                   // the frame carried an old sequence number
+	DropWatermark                       // forwarding would have made the watermark worse
+	DropNoRoute                         // there was no next-hop for the destination
+	DropLoop                            // the frame would have been sent back where it came from
+	DropMalformed                       // the frame or its payload couldn't be decoded
+	DropRootMismatch                    // the frame was built for a different tree
+	DropNotAllowed                      // the snake allowlist doesn't allow the key
+	DropFiltered                        // the packet filter dropped the frame
+	DropQuota                           // the sending peer has exceeded its transfer quota
+	DropUnknownType                     // the router doesn't know how to handle the frame type
+	DropRateLimited                     // the sending peer is sending frames of this type too often
+	DropOverloaded                      // the state actor was too backed up to handle a low priority frame
+	DropReplayed                        // the frame was a replay of one that had already been seen
+	DropStalePort                       // the frame came from a peer that no longer holds its port
+	DropRoutingMode                     // the frame uses a routing scheme that is disabled, see RouterRoutingMode
+	DropTooLarge                        // the frame is larger than the MTU of the link, see ConnectionMTU
+	DropDirection                       // the frame arrived on a one-way link that doesn't carry it towards us, see ConnectionLinkDirection
+	DropNoService                       // the frame is for a local service that nobody is listening on, see ListenService
+	DropPurged                          // the frame was waiting for a peer that went away and had nowhere else to go
+	DropSuspended                       // the frame was a protocol frame of our own for a suspended peering, see ConnectionIdleSuspend
+	dropReasonCount
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropQueueFull:
+		return "queue full"
+	case DropExpired:
+		return "expired"
+	case DropBadSignature:
+		return "bad signature"
+	case DropStaleSequence:
+		return "stale sequence"
+	case DropWatermark:
+		return "watermark violation"
+	case DropNoRoute:
+		return "no route"
+	case DropLoop:
+		return "loop"
+	case DropMalformed:
+		return "malformed"
+	case DropRootMismatch:
+		return "root mismatch"
+	case DropNotAllowed:
+		return "not allowed"
+	case DropFiltered:
+		return "filtered"
+	case DropQuota:
+		return "quota exceeded"
+	case DropUnknownType:
+		return "unknown type"
+	case DropRateLimited:
+		return "rate limited"
+	case DropOverloaded:
+		return "overloaded"
+	case DropReplayed:
+		return "replayed"
+	case DropStalePort:
+		return "stale port"
+	case DropRoutingMode:
+		return "routing mode"
+	case DropTooLarge:
+		return "too large"
+	case DropDirection:
+		return "wrong direction"
+	case DropNoService:
+		return "no service"
+	case DropPurged:
+		return "purged"
+	case DropSuspended:
+		return "suspended"
+	default:
+		return "unknown"
+	}
+}
+
+// Code returns a machine-readable code for the reason, which is the same as
+// String but with underscores instead of spaces, e.g. "queue_full".
+func (r DropReason) Code() string {
+	return strings.ReplaceAll(r.String(), " ", "_")
+}
+
+// MarshalText encodes the reason as its code, so that reasons can be used as
+// JSON object keys.
+func (r DropReason) MarshalText() ([]byte, error) {
+	return []byte(r.Code()), nil
+}
+
+// UnmarshalText decodes a reason from its code, as written by MarshalText.
+func (r *DropReason) UnmarshalText(text []byte) error {
+	for reason := DropReason(0); reason < dropReasonCount; reason++ {
+		if reason.Code() == string(text) {
+			*r = reason
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown drop reason %q", text)
+}
+
+// FrameDrop describes a traffic frame that was sent by this node but was
+// dropped before it could leave, because the queue towards the next-hop was
+// congested.
+type FrameDrop struct {
+	Type        types.FrameType
+	Destination net.Addr        // a types.PublicKey or types.Coordinates
+	NextHop     types.PublicKey // the peer that the frame was queued for
+	Reason      DropReason
+}
+
+// DropCallbackFn is called every time a locally originated traffic frame is
+// dropped from a queue, so that the sender can back off. It is called on the
+// state actor, which is busy routing until it returns, so the callback must
+// not block and must not call any Router method that waits on the state actor
+// (such as Peers, NextHop or InjectDropCallback), or it will deadlock. Hand
+// the drop off to another goroutine if more work is needed.
+type DropCallbackFn func(drop FrameDrop)
+
+// InjectDropCallback sets the function that will be called when a locally
+// originated traffic frame is dropped, or nil to stop being notified.
+func (r *Router) InjectDropCallback(fn DropCallbackFn) {
+	phony.Block(r.state, func() {
+		r.state._dropCallback = fn
+	})
+}
+
+// dropHandler is called by a traffic queue when it drops a frame. The frame
+// may be reused as soon as the handler returns.
+type dropHandler func(f *types.Frame, reason DropReason)
+
+// dropHandlerFor returns a drop handler for a traffic queue towards the given
+// peer, which reports drops of locally originated frames to the callback.
+// Queues can drop frames from any goroutine, so the details are copied out of
+// the frame and then reported from the state actor.
+func (s *state) dropHandlerFor(nexthop types.PublicKey) dropHandler {
+	return func(f *types.Frame, reason DropReason) {
+		s.r.conformance.drop(reason, nexthop, f)
+		drop := FrameDrop{
+			Type:    f.Type,
+			NextHop: nexthop,
+			Reason:  reason,
+		}
+		var source types.Coordinates
+		switch f.Type {
+		case types.TypeVirtualSnakeRouted:
+			if f.SourceKey != s.r.public {
+				return
+			}
+			drop.Destination = f.DestinationKey
+		case types.TypeTreeRouted:
+			source = f.Source.Copy()
+			drop.Destination = f.Destination.Copy()
+		default:
+			return
+		}
+		s.Act(nil, func() {
+			if s._dropCallback == nil {
+				return
+			}
+			// Tree-routed frames carry our coordinates rather than our key,
+			// so they might be out of date if the tree has moved since the
+			// frame was sent, in which case we can't tell who sent it.
+			if drop.Type == types.TypeTreeRouted && !source.EqualTo(s._coords()) {
+				return
+			}
+			s._dropCallback(drop)
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestDropNotifications(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	var drops []FrameDrop
+	r.InjectDropCallback(func(drop FrameDrop) {
+		drops = append(drops, drop)
+	})
+
+	// Fill up a queue towards a made-up peer with a mix of our own traffic
+	// and traffic that we are forwarding for someone else.
+	_, other, _ := ed25519.GenerateKey(nil)
+	var nexthop, dest, remote types.PublicKey
+	copy(nexthop[:], other.Public().(ed25519.PublicKey))
+	dest[0], remote[0] = 1, 2
+	q := newLIFOQueue(2, time.Minute, log.New(ioutil.Discard, "", 0))
+	q.notify = r.state.dropHandlerFor(nexthop)
+	for _, source := range []types.PublicKey{r.public, remote, r.public, r.public} {
+		// The queue returns dropped frames to the pool, so they must
+		// come from there too.
+		frame := getFrame()
+		frame.Type = types.TypeVirtualSnakeRouted
+		frame.SourceKey = source
+		frame.DestinationKey = dest
+		q.push(frame)
+	}
+
+	// Two frames were dropped to make room but only one was ours.
+	phony.Block(r.state, func() {})
+	if len(drops) != 1 {
+		t.Fatalf("expected 1 drop notification but got %d", len(drops))
+	}
+	drop := drops[0]
+	if drop.Reason != DropQueueFull || drop.NextHop != nexthop || drop.Destination != dest {
+		t.Fatalf("unexpected drop notification %+v", drop)
+	}
+}
+
+func TestDropReasonText(t *testing.T) {
+	for reason := DropReason(0); reason < dropReasonCount; reason++ {
+		text, err := reason.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded DropReason
+		if err := decoded.UnmarshalText(text); err != nil {
+			t.Fatal(err)
+		}
+		if decoded != reason {
+			t.Fatalf("%q decoded as %s, want %s", text, decoded, reason)
+		}
+	}
+	var decoded DropReason
+	if err := decoded.UnmarshalText([]byte("gremlins")); err == nil {
+		t.Fatal("expected an unknown reason to be rejected")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sync"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Limits used by the embedded profile. Queued frames are by far the largest
+// use of memory, so frames are limited to 16 KB, rather than the 64 KB that
+// the protocol allows, and the queue depths are kept small. A fair queue has
+// one more queue than it is asked for, so each port can hold 3 × 4 traffic
+// frames, and all of the ports together hold at most 108 frames, or about
+// 1.7 MB of payloads. The reader and writer of each peer also hold a 16 KB
+// frame buffer while they run.
+const (
+	embeddedPortCount       = 8 + 1 // peers plus the local port 0
+	embeddedTrafficQueues   = 2     // fair queues per peer
+	embeddedQueueDepth      = 4     // frames per fair queue
+	embeddedLIFODepth       = 8     // frames in a max-age queue
+	embeddedSnakeTableLimit = 256
+	embeddedWriteBatchSize  = 8 * 1024
+	embeddedMaxFrameSize    = 16 * 1024 // including the frame header
+	embeddedMaxPayloadSize  = embeddedMaxFrameSize - types.FrameHeaderLength
+)
+
+// RouterEmbedded configures the router for resource-limited devices, such as
+// OpenWrt-class routers, where the node should run within roughly 10 MB of
+// memory. It lowers the port limit to 8 peerings, shrinks the traffic queues
+// and write buffers, limits frames to 16 KB so that longer frames from peers
+// are skipped and longer payloads can't be sent, limits the snake routing
+// table to 256 entries with the farthest entries evicted first, and turns off
+// port mirroring along with the RouterOptionInspector and
+// RouterStrictConformance options, which are ignored if given. The limits can
+// still be raised afterwards with SetPortLimit and SetSnakeTableLimit.
+// Building with the "minimal" build tag also leaves out the debug and API
+// endpoints.
+type RouterEmbedded bool
+
+func (e RouterEmbedded) isRouterOption() {}
+
+// writeBatchSize returns how many bytes of frames can be coalesced into a
+// single write to a peer.
+func (r *Router) writeBatchSize() int {
+	if r.embedded {
+		return embeddedWriteBatchSize
+	}
+	return peerWriteBatchSize
+}
+
+// maxFrameSize returns the longest frame, including the header, that the
+// router will read from or write to a peer.
+func (r *Router) maxFrameSize() int {
+	if r.embedded {
+		return embeddedMaxFrameSize
+	}
+	return types.MaxFrameSize
+}
+
+// maxPayloadSize returns the longest payload that the router will send.
+func (r *Router) maxPayloadSize() int {
+	if r.embedded {
+		return embeddedMaxPayloadSize
+	}
+	return types.MaxPayloadSize
+}
+
+// frameBuffers returns the pool of buffers that hold frames of up to
+// maxFrameSize bytes.
+func (r *Router) frameBuffers() *sync.Pool {
+	if r.embedded {
+		return embeddedFrameBufferPool
+	}
+	return frameBufferPool
+}
+
+// getFrame returns an empty frame with room for a payload of up to
+// maxPayloadSize bytes.
+func (r *Router) getFrame() *types.Frame {
+	if r.embedded {
+		return getPooledFrame(embeddedFramePool)
+	}
+	return getFrame()
+}
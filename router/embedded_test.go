@@ -0,0 +1,126 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestEmbeddedProfile(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false,
+		RouterEmbedded(true),
+		RouterOptionInspector(func(Direction, *types.Frame) {}),
+		RouterStrictConformance{},
+	)
+	defer r.Close()
+
+	if r.inspector != nil || r.conformance != nil {
+		t.Fatal("expected optional subsystems to be disabled")
+	}
+	var portLimit, tableLimit int
+	phony.Block(r.state, func() {
+		portLimit, tableLimit = r.state._portLimit, r.state._tableLimit
+	})
+	if portLimit != embeddedPortCount {
+		t.Fatalf("expected port limit %d but got %d", embeddedPortCount, portLimit)
+	}
+	if tableLimit != embeddedSnakeTableLimit {
+		t.Fatalf("expected snake table limit %d but got %d", embeddedSnakeTableLimit, tableLimit)
+	}
+	if size, expected := r.local.traffic.queuesize(), embeddedTrafficQueues*embeddedQueueDepth; size != expected {
+		t.Fatalf("expected local queue size %d but got %d", expected, size)
+	}
+	if _, err := r.MirrorPort(1, make(chan MirroredFrame), 64, 1); err == nil {
+		t.Fatal("expected port mirroring to be refused")
+	}
+}
+
+// TestEmbeddedMemory floods a full set of embedded routers with traffic that
+// nobody reads, so that every queue fills up, and checks that all of them
+// together still fit in the memory that one of them is meant to run in.
+func TestEmbeddedMemory(t *testing.T) {
+	const budget = 10 * 1024 * 1024
+	var before runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	routers := newBenchStar(t, embeddedPortCount-1, RouterEmbedded(true))
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	hub, leaves := routers[0], routers[1:]
+
+	// Every leaf sends as fast as it can to every other leaf and to the hub,
+	// using the longest payload that the profile allows, so that the queues
+	// at the hub fill up faster than they can drain.
+	payload := make([]byte, embeddedMaxPayloadSize)
+	if _, err := hub.WriteTo(make([]byte, embeddedMaxPayloadSize+1), leaves[0].PublicKey()); err == nil {
+		t.Fatal("expected a payload over the limit to be refused")
+	}
+	var wg sync.WaitGroup
+	stop := time.Now().Add(time.Second)
+	for _, leaf := range leaves {
+		leaf := leaf
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(stop) {
+				for _, dest := range routers {
+					if dest != leaf {
+						_, _ = leaf.WriteTo(payload, dest.Coords())
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	used := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	if used > budget {
+		t.Fatalf("expected %d embedded routers to use less than %d bytes of heap, used %d bytes", len(routers), budget, used)
+	}
+	t.Logf("%d embedded routers used %d bytes of heap", len(routers), used)
+}
+
+func TestEmbeddedSkipsLongFrames(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false)
+	rb := NewRouter(nil, skb, false, RouterEmbedded(true))
+	defer ra.Close()
+	defer rb.Close()
+
+	connectPair(t, ra, rb)
+	waitFor(t, "convergence", func() bool {
+		return sameRoot([]*Router{ra, rb}) && ra.Coords().DistanceTo(rb.Coords()) == 1
+	})
+
+	// The full router doesn't know about the limit of the embedded one, so
+	// a longer frame is skipped rather than ending the peering. The frames
+	// are sent again until they arrive in case the tree is still settling.
+	waitFor(t, "the long frame to be skipped", func() bool {
+		_, _ = ra.WriteTo(make([]byte, embeddedMaxFrameSize), rb.Coords())
+		return rb.oversized.Load() > 0
+	})
+	buf := make([]byte, types.MaxPayloadSize)
+	waitFor(t, "a short frame to arrive", func() bool {
+		_, _ = ra.WriteTo([]byte("hello"), rb.Coords())
+		_ = rb.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, _, err := rb.ReadFrom(buf)
+		return err == nil && string(buf[:n]) == "hello"
+	})
+	if ra.PeerCount(-1) != 1 || rb.PeerCount(-1) != 1 {
+		t.Fatal("expected the peering to stay up")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Errors that are returned by the router so that callers can tell failures
+// apart. They are usually wrapped with more detail, so compare against them
+// using errors.Is.
+var (
+	// ErrPortsExhausted is returned by Connect when every switch port is
+	// already in use.
+	ErrPortsExhausted = errors.New("no free switch ports")
+	// ErrDuplicatePeer is returned by Connect when the connection is already
+	// being used by another peering. The connection is left open, since it
+	// still belongs to the other peering.
+	ErrDuplicatePeer = errors.New("connection is already peered")
+	// ErrHandshakeTimeout is returned by Connect when the remote side didn't
+	// finish the handshake within the timeout, see RouterHandshakeLimits.
+	ErrHandshakeTimeout = errors.New("handshake timed out")
+	// ErrQueueFull is returned by WriteTo when the packet couldn't be queued
+	// for the next-hop and was dropped. Traffic queues that make room by
+	// dropping older frames instead never cause it.
+	ErrQueueFull = errors.New("queue full")
+	// ErrNotQueued is returned by Send when the packet was dropped before it
+	// could be queued for a next-hop, i.e. because there was no route to the
+	// destination or the packet filter refused it.
+	ErrNotQueued = errors.New("packet was not queued")
+	// ErrServiceClosed is returned by reads and writes on a ServiceConn once
+	// it has been closed or the router has been stopped.
+	ErrServiceClosed = errors.New("service closed")
+	// ErrReceiptTimeout is returned by a Delivery when the destination
+	// didn't acknowledge the packet in time. Either the packet or the
+	// receipt was lost, or the destination doesn't support receipts.
+	ErrReceiptTimeout = errors.New("no receipt received")
+	// ErrPortNotConnected is returned by MirrorPort when nothing is peered
+	// on the given switch port.
+	ErrPortNotConnected = errors.New("port is not connected")
+)
+
+// PublicKeyMismatchError is returned by Connect when the remote side of a
+// connection presents a different public key to the one that we expected,
+// either from ConnectionTargetKey or from a ConnectionPublicKey with
+// ConnectionVerifyPublicKey. The connection is closed.
+type PublicKeyMismatchError struct {
+	Expected types.PublicKey
+	Actual   types.PublicKey
+}
+
+func (e *PublicKeyMismatchError) Error() string {
+	return fmt.Sprintf("expected to connect to %s but found %s", e.Expected, e.Actual)
+}
+
+// handshakeError wraps an error from reading or writing the handshake, so
+// that a deadline being reached is reported as ErrHandshakeTimeout.
+func handshakeError(op string, err error) error {
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return fmt.Errorf("%s: %w", op, ErrHandshakeTimeout)
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
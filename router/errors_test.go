@@ -0,0 +1,115 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestConnectErrors(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+	r.SetPortLimit(2)
+
+	_, remote, _ := ed25519.GenerateKey(nil)
+	var key types.PublicKey
+	copy(key[:], remote.Public().(ed25519.PublicKey))
+	options := []ConnectionOption{ConnectionPublicKey(key), ConnectionKeepalives(false)}
+
+	pa, pb := net.Pipe()
+	defer pb.Close()
+	if _, err := r.Connect(pa, options...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Passing the same connection again is refused, without closing it
+	// from under the peering that is already using it.
+	if _, err := r.Connect(pa, options...); !errors.Is(err, ErrDuplicatePeer) {
+		t.Fatalf("expected ErrDuplicatePeer but got %v", err)
+	}
+	if !r.IsConnected(key, "") {
+		t.Fatal("expected the first peering to still be connected")
+	}
+
+	// The only free port has been taken by the first peering.
+	pc, pd := net.Pipe()
+	defer pd.Close()
+	if _, err := r.Connect(pc, options...); !errors.Is(err, ErrPortsExhausted) {
+		t.Fatalf("expected ErrPortsExhausted but got %v", err)
+	}
+}
+
+func TestWriteToQueueFull(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	// Nothing is reading from the router, so once the local queue has room
+	// for just one frame, writing to ourselves a second time has to fail.
+	r.local.traffic = newFIFOQueue(1, r.log)
+	payload := []byte("hello")
+	if _, err := r.WriteTo(payload, r.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.WriteTo(payload, r.PublicKey()); !errors.Is(err, ErrQueueFull) || n != 0 {
+		t.Fatalf("expected ErrQueueFull but wrote %d bytes with %v", n, err)
+	}
+}
+
+func TestConnectPinnedKey(t *testing.T) {
+	newRouter := func() *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		return NewRouter(nil, sk, false)
+	}
+	client, server := newRouter(), newRouter()
+	defer client.Close()
+	defer server.Close()
+	// Both sides write their handshake before reading, so this needs a
+	// buffered connection rather than a pipe.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	connect := func(pin types.PublicKey) error {
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				_, _ = server.Connect(conn, ConnectionKeepalives(false))
+			}
+		}()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		_, err = client.Connect(conn, ConnectionPublicKey(pin), ConnectionVerifyPublicKey(true), ConnectionKeepalives(false))
+		return err
+	}
+
+	// Someone else answering is refused, rather than being taken for the
+	// node that we expected.
+	_, other, _ := ed25519.GenerateKey(nil)
+	var pin types.PublicKey
+	copy(pin[:], other.Public().(ed25519.PublicKey))
+	var mismatch *PublicKeyMismatchError
+	if err := connect(pin); !errors.As(err, &mismatch) {
+		t.Fatalf("expected a PublicKeyMismatchError but got %v", err)
+	}
+	if mismatch.Expected != pin || mismatch.Actual != server.PublicKey() {
+		t.Fatalf("unexpected keys in %v", mismatch)
+	}
+	if client.IsConnected(pin, "") || client.IsConnected(server.PublicKey(), "") {
+		t.Fatal("expected the connection to be refused")
+	}
+
+	// The node that we expected is accepted after the handshake.
+	if err := connect(server.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if !client.IsConnected(server.PublicKey(), "") {
+		t.Fatal("expected to be connected to the pinned node")
+	}
+}
@@ -23,21 +23,48 @@ type Event interface {
 }
 
 type PeerAdded struct {
-	Port   types.SwitchPortID
-	PeerID string
+	Port       types.SwitchPortID
+	PeerID     string
+	Generation uint64 // tells apart successive peers on the same port
 }
 
 // Tag PeerAdded as an Event
 func (e PeerAdded) isEvent() {}
 
 type PeerRemoved struct {
-	Port   types.SwitchPortID
-	PeerID string
+	Port       types.SwitchPortID
+	PeerID     string
+	Generation uint64 // tells apart successive peers on the same port
 }
 
 // Tag PeerRemoved as an Event
 func (e PeerRemoved) isEvent() {}
 
+// PeerWedged is emitted when the watchdog recycles a peering that stopped
+// making progress, just before the peer is removed.
+type PeerWedged struct {
+	Port   types.SwitchPortID
+	PeerID string
+	Reason string // what the watchdog saw
+	Queued int    // frames that were waiting to be sent
+}
+
+// Tag PeerWedged as an Event
+func (e PeerWedged) isEvent() {}
+
+// PeerFrameRateExceeded is emitted when a peer sends us frames of some type
+// faster than the limit set with the RouterFrameRateAlerts option.
+type PeerFrameRateExceeded struct {
+	Port      types.SwitchPortID
+	PeerID    string
+	FrameType types.FrameType
+	Rate      float64 // frames per second
+	Limit     float64 // frames per second
+}
+
+// Tag PeerFrameRateExceeded as an Event
+func (e PeerFrameRateExceeded) isEvent() {}
+
 type TreeParentUpdate struct {
 	PeerID string
 }
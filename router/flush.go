@@ -0,0 +1,134 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Defaults for ConnectionFlushPolicy.
+const (
+	flushDefaultInterval  = time.Millisecond * 5
+	flushDefaultThreshold = 16 * 1024
+)
+
+// FlushMode decides when the frames that are waiting for a peering are
+// written to the connection, see ConnectionFlushPolicy.
+type FlushMode int
+
+const (
+	// FlushQueued puts whatever frames are already waiting into a single
+	// write, up to the write batch size, but never waits for more. This is
+	// the default.
+	FlushQueued FlushMode = iota
+	// FlushPerFrame writes every frame on its own, as soon as it is ready,
+	// which gives the lowest latency on interactive links at the cost of a
+	// write for every frame.
+	FlushPerFrame
+	// FlushOnTimer holds each batch open for the interval after its first
+	// frame, so that frames which arrive in the meantime go out in the same
+	// write, unless the write batch size is reached first.
+	FlushOnTimer
+	// FlushAtThreshold writes as soon as the batch reaches the given number
+	// of bytes, or when the interval after its first frame is up, so that a
+	// trickle of frames isn't held back forever.
+	FlushAtThreshold
+)
+
+// ConnectionFlushPolicy sets how frames are batched into writes on the
+// peering. Writing every frame as soon as it is ready keeps latency down,
+// but on a high-latency link, or one where every write has a cost of its own
+// such as a TLS record or a system call into a slow driver, batching frames
+// into fewer, larger writes gives much better throughput. Interval defaults
+// to 5ms and Bytes to 16KB. The policy doesn't apply to paced or datagram
+// peerings, which always write one frame at a time.
+type ConnectionFlushPolicy struct {
+	Mode     FlushMode
+	Interval time.Duration // how long FlushOnTimer and FlushAtThreshold hold a batch open
+	Bytes    int           // how big a batch FlushAtThreshold waits for
+}
+
+func (c ConnectionFlushPolicy) isConnectionOption() {}
+
+// flushPolicy is the flush policy of a single peer.
+type flushPolicy struct {
+	perFrame bool
+	wait     time.Duration // how long to hold a batch open for, 0 to not wait
+	bytes    int           // how big a batch can be, 0 for the write batch size
+}
+
+func newFlushPolicy(c ConnectionFlushPolicy) flushPolicy {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = flushDefaultInterval
+	}
+	switch c.Mode {
+	case FlushPerFrame:
+		return flushPolicy{perFrame: true}
+	case FlushOnTimer:
+		return flushPolicy{wait: interval}
+	case FlushAtThreshold:
+		bytes := c.Bytes
+		if bytes <= 0 {
+			bytes = flushDefaultThreshold
+		}
+		return flushPolicy{wait: interval, bytes: bytes}
+	default:
+		return flushPolicy{}
+	}
+}
+
+// _flushAfter returns a channel that fires once the peer's batch should be
+// written, or nil if batches aren't held open. The timer is reused for every
+// batch. This function must be called from the peer's writer actor only.
+func (p *peer) _flushAfter() <-chan time.Time {
+	if p.flush.wait <= 0 || p.pacer != nil || p.datagrams {
+		return nil
+	}
+	if p._flush == nil {
+		p._flush = time.NewTimer(p.flush.wait)
+		return p._flush.C
+	}
+	if !p._flush.Stop() {
+		select {
+		case <-p._flush.C:
+		default:
+		}
+	}
+	p._flush.Reset(p.flush.wait)
+	return p._flush.C
+}
+
+// _awaitQueued returns the next frame from the queues, waiting for one to
+// arrive until the flush channel fires or the peering stops, in which case
+// it returns nil. If the flush channel is nil then it doesn't wait at all.
+// This function must be called from the peer's writer actor only.
+func (p *peer) _awaitQueued(flush <-chan time.Time) *types.Frame {
+	if frame := p._nextQueued(); frame != nil || flush == nil {
+		return frame
+	}
+	var frame *types.Frame
+	select {
+	case <-p.context.Done():
+	case <-flush:
+	case frame = <-p.proto.pop():
+		p.proto.ack()
+	case frame = <-p.traffic.pop():
+		p.traffic.ack()
+	}
+	return frame
+}
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/test/fixtures"
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// countConn is a connection that counts how many writes are made to it.
+type countConn struct {
+	net.Conn
+	writes *atomic.Uint64
+}
+
+func (c countConn) Write(b []byte) (int, error) {
+	c.writes.Inc()
+	return c.Conn.Write(b)
+}
+
+func TestFlushPolicyDefaults(t *testing.T) {
+	if p := newFlushPolicy(ConnectionFlushPolicy{}); p != (flushPolicy{}) {
+		t.Fatalf("expected the default policy not to wait, got %+v", p)
+	}
+	if p := newFlushPolicy(ConnectionFlushPolicy{Mode: FlushAtThreshold}); p.wait != flushDefaultInterval || p.bytes != flushDefaultThreshold {
+		t.Fatalf("expected the default interval and threshold, got %+v", p)
+	}
+	if p := newFlushPolicy(ConnectionFlushPolicy{Mode: FlushOnTimer, Interval: time.Second}); p.wait != time.Second || p.bytes != 0 {
+		t.Fatalf("expected the given interval and no threshold, got %+v", p)
+	}
+
+	r := newFixtureRouters(t, fixtures.Line(1))[0]
+	defer r.Close()
+	pa, pb := net.Pipe()
+	defer pb.Close()
+	if _, err := r.Connect(pa, ConnectionFlushPolicy{Mode: FlushAtThreshold + 1}); err == nil {
+		t.Fatal("expected an unknown flush mode to be refused")
+	}
+}
+
+func TestFlushPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy ConnectionFlushPolicy
+		check  func(writes, frames uint64) bool
+	}{
+		{"PerFrame", ConnectionFlushPolicy{Mode: FlushPerFrame}, func(w, f uint64) bool { return w >= f }},
+		{"OnTimer", ConnectionFlushPolicy{Mode: FlushOnTimer, Interval: time.Millisecond * 200}, func(w, f uint64) bool { return w <= 2 }},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			routers := newFixtureRouters(t, fixtures.Line(2))
+			defer func() {
+				for _, r := range routers {
+					_ = r.Close()
+				}
+			}()
+			src, dst := routers[0], routers[1]
+			writes := atomic.NewUint64(0)
+			pa, pb := net.Pipe()
+			connectEnds(t,
+				pairEnd{src, countConn{pa, writes}, []ConnectionOption{tc.policy}},
+				pairEnd{dst, pb, nil},
+			)
+			// Agreeing on the root isn't enough, since src might not have
+			// heard from dst yet, in which case there's no route to it.
+			waitFor(t, "a route from src to dst", func() bool {
+				if !sameRoot(routers) {
+					return false
+				}
+				coords := dst.Coords()
+				next, _ := src.NextHop(nil, types.TypeTreeRouted, coords).(types.Coordinates)
+				return next.EqualTo(coords)
+			})
+
+			// The whole batch is sent again if any of it goes missing, since
+			// the tree can still move briefly, i.e. when the root announces
+			// again. Only a batch that arrived in full is checked.
+			const frames = 10
+			buf := make([]byte, types.MaxPayloadSize)
+			var w uint64
+			waitFor(t, "all of the frames to arrive", func() bool {
+				dest := dst.Coords()
+				before := writes.Load()
+				for i := 0; i < frames; i++ {
+					if _, err := src.WriteTo([]byte("hello"), dest); err != nil {
+						t.Fatal(err)
+					}
+				}
+				_ = dst.SetReadDeadline(time.Now().Add(time.Second))
+				for i := 0; i < frames; i++ {
+					if n, _, err := dst.ReadFrom(buf); err != nil || n == 0 {
+						return false
+					}
+				}
+				w = writes.Load() - before
+				return true
+			})
+			if w == 0 || !tc.check(w, frames) {
+				t.Fatalf("unexpected %d writes for %d frames", w, frames)
+			}
+		})
+	}
+}
+
+// largestConn is a connection that records the longest write made to it.
+type largestConn struct {
+	net.Conn
+	largest *atomic.Int64
+}
+
+func (c largestConn) Write(b []byte) (int, error) {
+	for n := int64(len(b)); ; {
+		if old := c.largest.Load(); n <= old || c.largest.CAS(old, n) {
+			break
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWriteBatchLimit(t *testing.T) {
+	routers := newFixtureRouters(t, fixtures.Line(2))
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	src, dst := routers[0], routers[1]
+	largest := atomic.NewInt64(0)
+	pa, pb := net.Pipe()
+	connectEnds(t, pairEnd{src, largestConn{pa, largest}, nil}, pairEnd{dst, pb, nil})
+	waitFor(t, "the tree to converge", func() bool {
+		return sameRoot(routers) && src.Coords().DistanceTo(dst.Coords()) == 1
+	})
+
+	// Frames that don't divide the limit evenly would take the batch past it
+	// if the last one was always added.
+	payload := make([]byte, 20*1024)
+	dest := dst.Coords()
+	for i := 0; i < 32; i++ {
+		if _, err := src.WriteTo(payload, dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the frames to be written", func() bool {
+		queued := 0
+		phony.Block(src.state, func() {
+			queued = src.state._peers[1].traffic.queuecount()
+		})
+		return queued == 0
+	})
+	if n := largest.Load(); n > peerWriteBatchSize {
+		t.Fatalf("expected no write longer than %d bytes, got %d", peerWriteBatchSize, n)
+	}
+}
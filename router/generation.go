@@ -0,0 +1,69 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Switch ports are reused as soon as they are free, so that our coordinates
+// stay small, which means that a port number on its own doesn't say which
+// peering it was about. Each port therefore counts how many times it has
+// been handed to a peer, and the peer keeps the generation that it was given.
+// A frame from a peer whose port has since gone to someone else is dropped
+// rather than being handled as if it came from the new neighbour, and the
+// generation is reported alongside the port everywhere that a port number
+// can be held on to and used later.
+
+// _nextGeneration returns the generation for the next peer on the given
+// port. Generations start at 1, so that 0 can mean no peer at all.
+func (s *state) _nextGeneration(port int) uint64 {
+	for len(s._generations) <= port {
+		s._generations = append(s._generations, 0)
+	}
+	s._generations[port]++
+	return s._generations[port]
+}
+
+// _isCurrent returns true if the peer still holds its switch port.
+func (s *state) _isCurrent(p *peer) bool {
+	if p == s.r.local {
+		return true
+	}
+	port := int(p.port)
+	return port < len(s._peers) && s._peers[port] == p && p.generation == s._generations[port]
+}
+
+// DisconnectGeneration disconnects the peering on the given port, like
+// Disconnect, but only if the port is still held by the peer with the given
+// generation, as reported in PeerInfo. It returns false if the peer has gone
+// already, in which case a peer that has been given the same port since then
+// is left alone.
+func (r *Router) DisconnectGeneration(port types.SwitchPortID, generation uint64, err error) bool {
+	var ok bool
+	phony.Block(r.state, func() {
+		if port == 0 || int(port) >= len(r.state._peers) {
+			return
+		}
+		p := r.state._peers[port]
+		if p == nil || p.generation != generation || !p.started.Load() {
+			return
+		}
+		p.stop(err)
+		ok = true
+	})
+	return ok
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPortGenerations(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterStrictConformance{})
+	defer r.Close()
+
+	peerWith := func() (*Router, types.SwitchPortID) {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		remote := NewRouter(nil, sk, false)
+		port, _ := connectPair(t, r, remote)
+		return remote, port
+	}
+	generation := func(port types.SwitchPortID) uint64 {
+		for _, info := range r.Peers() {
+			if info.Port == int(port) {
+				return info.Generation
+			}
+		}
+		return 0
+	}
+
+	first, port := peerWith()
+	defer first.Close()
+	if g := generation(port); g != 1 {
+		t.Fatalf("expected generation 1 but got %d", g)
+	}
+	var old *peer
+	phony.Block(r.state, func() {
+		old = r.state._peers[port]
+	})
+	r.Disconnect(port, nil)
+	waitFor(t, "the port to be freed", func() bool {
+		return generation(port) == 0
+	})
+
+	// The next peer gets the same port, but a new generation.
+	second, reused := peerWith()
+	defer second.Close()
+	if reused != port {
+		t.Fatalf("expected port %d to be reused but got %d", port, reused)
+	}
+	if g := generation(port); g != 2 {
+		t.Fatalf("expected generation 2 but got %d", g)
+	}
+
+	// A frame that was still waiting from the old peer is dropped instead of
+	// being handled as if it came from the new one.
+	phony.Block(r.state, func() {
+		f := getFrame()
+		f.Type = types.TypeKeepalive
+		_ = r.state._forward(old, f)
+	})
+	if n := r.DropCounts()[DropStalePort]; n != 1 {
+		t.Fatalf("expected 1 stale port drop but got %d", n)
+	}
+
+	// Disconnecting the old generation leaves the new peer alone.
+	if r.DisconnectGeneration(port, 1, nil) {
+		t.Fatal("expected the old generation not to be disconnected")
+	}
+	if g := generation(port); g != 2 {
+		t.Fatalf("expected the new peer to still be connected, got generation %d", g)
+	}
+	if !r.DisconnectGeneration(port, 2, nil) {
+		t.Fatal("expected the current generation to be disconnected")
+	}
+}
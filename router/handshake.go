@@ -0,0 +1,270 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// handshakeFlagTarget is set in the second byte of the handshake when the
+// handshake is followed by the public key of the node that the sender wants
+// to reach, see ConnectionTargetKey.
+const handshakeFlagTarget byte = 1 << 0
+
+// handshakeFlagMigrate is set in the second byte of the handshake when the
+// sender wants the connection to take over its existing peering with us, see
+// ConnectionMigrate.
+const handshakeFlagMigrate byte = 1 << 1
+
+// handshakeLength is the length of the handshake, not including the target
+// public key if there is one.
+const handshakeLength = 8 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+// handshakeBucketLimit is the most per-address rate limiting buckets that
+// can exist at once.
+const handshakeBucketLimit = 1024
+
+// RouterHandshakeLimits bounds the resources that connections can use while
+// they are still negotiating, which stops a public listener from being
+// exhausted by connections that never complete the handshake. The limits
+// apply to every connection that is passed to Connect without a
+// ConnectionPublicKey.
+type RouterHandshakeLimits struct {
+	Timeout         time.Duration // how long the handshake may take, 0 for the default
+	MaxInFlight     int           // how many handshakes may run at once, 0 for no limit
+	PerAddressRate  float64       // handshakes per second per remote IP, 0 for no limit
+	PerAddressBurst int           // how many handshakes per remote IP may arrive at once
+}
+
+func (l RouterHandshakeLimits) isRouterOption() {}
+
+// handshakeLimiter enforces the handshake limits.
+type handshakeLimiter struct {
+	limits   RouterHandshakeLimits
+	inflight atomic.Int32
+	rejected atomic.Uint64
+	mutex    sync.Mutex
+	buckets  map[string]*handshakeBucket
+}
+
+// handshakeBucket is a token bucket for a single remote address.
+type handshakeBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newHandshakeLimiter(limits RouterHandshakeLimits) *handshakeLimiter {
+	if limits.Timeout <= 0 {
+		limits.Timeout = peerKeepaliveInterval
+	}
+	if limits.PerAddressBurst < 1 {
+		limits.PerAddressBurst = 1
+	}
+	return &handshakeLimiter{
+		limits:  limits,
+		buckets: map[string]*handshakeBucket{},
+	}
+}
+
+// begin is called before a handshake starts. It returns an error if the
+// handshake should be refused, otherwise it returns a function that must be
+// called once the handshake has finished.
+func (l *handshakeLimiter) begin(addr net.Addr) (func(), error) {
+	if !l.allow(addr) {
+		l.rejected.Inc()
+		return nil, fmt.Errorf("too many handshakes from %s", addr)
+	}
+	if inflight := l.inflight.Inc(); l.limits.MaxInFlight > 0 && int(inflight) > l.limits.MaxInFlight {
+		l.inflight.Dec()
+		l.rejected.Inc()
+		return nil, fmt.Errorf("too many handshakes in progress")
+	}
+	return func() { l.inflight.Dec() }, nil
+}
+
+// allow takes a token from the bucket for the remote address, if per-address
+// rate limiting is enabled.
+func (l *handshakeLimiter) allow(addr net.Addr) bool {
+	if l.limits.PerAddressRate <= 0 || addr == nil {
+		return true
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	now := time.Now()
+	burst := float64(l.limits.PerAddressBurst)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[host]
+	if !ok {
+		if len(l.buckets) >= handshakeBucketLimit {
+			l.evict(now, burst)
+		}
+		b = &handshakeBucket{tokens: burst, last: now}
+		l.buckets[host] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.limits.PerAddressRate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict makes room for a new bucket. Buckets that would have refilled
+// completely by now are no different to new ones, so they are all forgotten,
+// and if there aren't any then the bucket that is closest to refilling is
+// forgotten instead, so that there are never more than handshakeBucketLimit
+// buckets. The mutex must be held.
+func (l *handshakeLimiter) evict(now time.Time, burst float64) {
+	var fullest string
+	most := -1.0
+	for k, b := range l.buckets {
+		tokens := b.tokens + now.Sub(b.last).Seconds()*l.limits.PerAddressRate
+		switch {
+		case tokens >= burst:
+			delete(l.buckets, k)
+		case tokens > most:
+			fullest, most = k, tokens
+		}
+	}
+	if len(l.buckets) >= handshakeBucketLimit {
+		delete(l.buckets, fullest)
+	}
+}
+
+// handshakeResult is what we learn about the remote side of a connection
+// from the handshake.
+type handshakeResult struct {
+	public       types.PublicKey
+	capabilities uint32
+	migrate      bool                // the remote side asked to take over an existing peering
+	rtt          time.Duration       // roughly how long the remote side took to respond
+	metadata     *types.NodeMetadata // nil if the remote side doesn't share any
+}
+
+// handshake exchanges public keys and version/capability information with
+// the remote side of the connection. If a target key is given then it is sent
+// after our own handshake, and if the remote side sent one then it must be a
+// key that we answer to. The connection is closed if the handshake fails.
+func (r *Router) handshake(conn net.Conn, target types.PublicKey, migrate bool) (handshakeResult, error) {
+	var result handshakeResult
+	done, err := r.handshakes.begin(conn.RemoteAddr())
+	if err != nil {
+		conn.Close()
+		return handshakeResult{}, err
+	}
+	defer done()
+
+	handshake := []byte{
+		ourVersion,
+		0, // flags
+		0, // network tag
+		0, // network tag
+		0, // capabilities
+		0, // capabilities
+		0, // capabilities
+		0, // capabilities
+	}
+	if !target.IsZero() {
+		handshake[1] |= handshakeFlagTarget
+	}
+	if migrate {
+		handshake[1] |= handshakeFlagMigrate
+	}
+	binary.BigEndian.PutUint16(handshake[2:4], networkTag(r.network))
+	binary.BigEndian.PutUint32(handshake[4:8], ourCapabilities|ourOptionalCapabilities)
+	handshake = append(handshake, r.public[:ed25519.PublicKeySize]...)
+	handshake = append(handshake, ed25519.Sign(r.private[:], handshake)...)
+	send := handshake
+	if !target.IsZero() {
+		send = append(send[:len(send):len(send)], target[:]...)
+	}
+	if err := conn.SetDeadline(time.Now().Add(r.handshakes.limits.Timeout)); err != nil {
+		conn.Close()
+		return handshakeResult{}, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	start := time.Now()
+	if _, err := conn.Write(send); err != nil {
+		conn.Close()
+		return handshakeResult{}, handshakeError("conn.Write", err)
+	}
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		conn.Close()
+		return handshakeResult{}, handshakeError("io.ReadFull", err)
+	}
+	result.rtt = time.Since(start)
+	if theirVersion := handshake[0]; theirVersion != ourVersion {
+		conn.Close()
+		return handshakeResult{}, fmt.Errorf("mismatched node version")
+	}
+	if result.capabilities = binary.BigEndian.Uint32(handshake[4:8]); result.capabilities&ourCapabilities != ourCapabilities {
+		conn.Close()
+		return handshakeResult{}, fmt.Errorf("mismatched node capabilities")
+	}
+	var signature types.Signature
+	offset := 8
+	offset += copy(result.public[:], handshake[offset:offset+ed25519.PublicKeySize])
+	copy(signature[:], handshake[offset:offset+ed25519.SignatureSize])
+	if !ed25519.Verify(result.public[:], handshake[:offset], signature[:]) {
+		conn.Close()
+		return handshakeResult{}, fmt.Errorf("peer sent invalid signature")
+	}
+	if binary.BigEndian.Uint16(handshake[2:4]) != networkTag(r.network) {
+		conn.Close()
+		return handshakeResult{}, fmt.Errorf("mismatched network")
+	}
+	// The target key isn't covered by the signature, so it is only used to
+	// refuse connections that were meant for someone else. A ListenerDemux
+	// replays it along with the rest of the handshake.
+	if handshake[1]&handshakeFlagTarget != 0 {
+		var theirTarget types.PublicKey
+		if _, err := io.ReadFull(conn, theirTarget[:]); err != nil {
+			conn.Close()
+			return handshakeResult{}, handshakeError("io.ReadFull", err)
+		}
+		if !r.answersTo(theirTarget) {
+			conn.Close()
+			return handshakeResult{}, fmt.Errorf("peer asked for %s, which is not our key", theirTarget)
+		}
+	}
+	result.migrate = handshake[1]&handshakeFlagMigrate != 0
+	if result.capabilities&capabilityMetadata != 0 {
+		if result.metadata, err = r.exchangeMetadata(conn, result.public); err != nil {
+			conn.Close()
+			return handshakeResult{}, err
+		}
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return handshakeResult{}, fmt.Errorf("conn.SetDeadline: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,241 @@
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestHandshakeLimiterPerAddress(t *testing.T) {
+	l := newHandshakeLimiter(RouterHandshakeLimits{
+		PerAddressRate:  0.001,
+		PerAddressBurst: 2,
+	})
+	a := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+	b := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2000}
+	c := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1000}
+	for _, addr := range []net.Addr{a, b} {
+		done, err := l.begin(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+	}
+	// The burst has been used up by the same IP on different ports.
+	if _, err := l.begin(a); err == nil {
+		t.Fatal("expected handshake to be rate limited")
+	}
+	// Other addresses should be unaffected.
+	if _, err := l.begin(c); err != nil {
+		t.Fatal(err)
+	}
+	if rejected := l.rejected.Load(); rejected != 1 {
+		t.Fatalf("expected 1 rejected handshake but got %d", rejected)
+	}
+}
+
+func TestHandshakeLimiterBucketLimit(t *testing.T) {
+	l := newHandshakeLimiter(RouterHandshakeLimits{
+		PerAddressRate:  0.001,
+		PerAddressBurst: 2,
+	})
+	addr := func(i int) net.Addr {
+		return &net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1000}
+	}
+	// Use up the burst of every address but the first, which is left with
+	// a token to spare, so that no bucket has refilled.
+	for i := 0; i < handshakeBucketLimit; i++ {
+		for j := 0; j < 2; j++ {
+			if i == 0 && j == 1 {
+				continue
+			}
+			if _, err := l.begin(addr(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A new address still gets a bucket, but the bucket closest to refilling
+	// is forgotten to make room for it rather than going over the limit.
+	if _, err := l.begin(addr(handshakeBucketLimit)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(l.buckets); n != handshakeBucketLimit {
+		t.Fatalf("expected %d buckets but got %d", handshakeBucketLimit, n)
+	}
+	if _, ok := l.buckets[net.IPv4(10, 0, 0, 0).String()]; ok {
+		t.Fatal("expected the fullest bucket to be evicted")
+	}
+	// The addresses that have used up their burst are still limited.
+	if _, err := l.begin(addr(1)); err == nil {
+		t.Fatal("expected handshake to be rate limited")
+	}
+}
+
+func TestHandshakeLimiterInFlight(t *testing.T) {
+	l := newHandshakeLimiter(RouterHandshakeLimits{
+		MaxInFlight: 1,
+	})
+	done, err := l.begin(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.begin(nil); err == nil {
+		t.Fatal("expected second handshake to be refused")
+	}
+	done()
+	if _, err := l.begin(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterHandshakeLimits{
+		Timeout: time.Millisecond * 100,
+	})
+	defer r.Close()
+
+	// The remote side never reads or writes anything, like a slowloris
+	// client would, so the handshake should give up after the timeout.
+	pa, pb := net.Pipe()
+	defer pb.Close()
+	start := time.Now()
+	if _, err := r.Connect(pa); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("expected handshake to time out but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handshake took %s to time out", elapsed)
+	}
+	if inflight := r.handshakes.inflight.Load(); inflight != 0 {
+		t.Fatalf("expected no handshakes in flight but got %d", inflight)
+	}
+}
+
+func TestMixedFrameVersions(t *testing.T) {
+	routers := make([]*Router, 3)
+	for i := range routers {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		routers[i] = NewRouter(nil, sk, false)
+		defer routers[i].Close() // nolint:errcheck
+	}
+	a, b, c := routers[0], routers[1], routers[2]
+
+	// The first peering negotiates the frame version in the handshake, so
+	// it should use Version1. The second peering is pinned to Version0 on
+	// one side only, so each side writes in its own encoding and the other
+	// side has to understand both.
+	peer := func(ra, rb *Router, optsa, optsb []ConnectionOption) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close() // nolint:errcheck
+		errs := make(chan error, 2)
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				_, err = ra.Connect(conn, optsa...)
+			}
+			errs <- err
+		}()
+		go func() {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err == nil {
+				_, err = rb.Connect(conn, optsb...)
+			}
+			errs <- err
+		}()
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	peer(a, b, nil, nil)
+	peer(b, c, []ConnectionOption{ConnectionFrameVersion(types.Version0)}, nil)
+
+	versions := func(r *Router) map[string]int {
+		v := map[string]int{}
+		for _, p := range r.Peers() {
+			if p.Port != 0 {
+				v[p.PublicKey] = p.Version
+			}
+		}
+		return v
+	}
+	if v := versions(a)[b.PublicKey().String()]; v != int(types.Version1) {
+		t.Fatalf("expected a to use Version1 towards b but got %d", v)
+	}
+	if v := versions(b)[c.PublicKey().String()]; v != int(types.Version0) {
+		t.Fatalf("expected b to use Version0 towards c but got %d", v)
+	}
+	if v := versions(c)[b.PublicKey().String()]; v != int(types.Version1) {
+		t.Fatalf("expected c to use Version1 towards b but got %d", v)
+	}
+
+	// Traffic should make it across both peerings in both directions.
+	for _, pair := range [][2]*Router{{a, c}, {c, a}} {
+		src, dst := pair[0], pair[1]
+		payload := []byte("hello from " + src.PublicKey().String()[:8])
+		buf := make([]byte, 64)
+		deadline := time.Now().Add(time.Second * 10)
+		for {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out waiting for traffic across mixed frame versions")
+			}
+			if _, err := src.WriteTo(payload, dst.PublicKey()); err != nil {
+				t.Fatal(err)
+			}
+			_ = dst.SetReadDeadline(time.Now().Add(time.Millisecond * 250))
+			n, _, err := dst.ReadFrom(buf)
+			if err == nil && bytes.Equal(buf[:n], payload) {
+				break
+			}
+		}
+	}
+}
+
+func TestConnectionKeyFilter(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false)
+	rb := NewRouter(nil, skb, false)
+	defer ra.Close()
+	defer rb.Close()
+
+	// Both sides of the handshake write before they read, so this needs a
+	// buffered connection rather than a pipe.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if pb, err := l.Accept(); err == nil {
+			_, _ = rb.Connect(pb)
+		}
+	}()
+	pa, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var filtered types.PublicKey
+	_, err = ra.Connect(pa, ConnectionKeyFilter(func(key types.PublicKey) bool {
+		filtered = key
+		return false
+	}))
+	if err == nil {
+		t.Fatal("expected connection to be refused")
+	}
+	if filtered != rb.PublicKey() {
+		t.Fatalf("expected filter to be called with %s but got %s", rb.PublicKey(), filtered)
+	}
+	if count := ra.PeerCount(-1); count != 0 {
+		t.Fatalf("expected no peers but got %d", count)
+	}
+}
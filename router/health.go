@@ -0,0 +1,141 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Arceliar/phony"
+)
+
+// RouterHealthCriteria sets how strict Healthy is. Fields that are left as
+// zero keep their defaults.
+type RouterHealthCriteria struct {
+	MinPeers      int     // how many peers we need, 1 by default
+	RootAgreement float64 // the fraction of peers that must follow our root, from 0 to 1, 0.5 by default
+}
+
+func (c RouterHealthCriteria) isRouterOption() {}
+
+// withDefaults fills in the criteria that weren't given.
+func (c RouterHealthCriteria) withDefaults() RouterHealthCriteria {
+	if c.MinPeers <= 0 {
+		c.MinPeers = 1
+	}
+	if c.RootAgreement <= 0 || c.RootAgreement > 1 {
+		c.RootAgreement = 0.5
+	}
+	return c
+}
+
+// HealthCheck names one of the criteria that Healthy checks.
+type HealthCheck string
+
+const (
+	HealthPeers HealthCheck = "peers" // we have fewer peers than RouterHealthCriteria.MinPeers
+	HealthRoot  HealthCheck = "root"  // too few of our peers follow the same root as we do
+	HealthSnake HealthCheck = "snake" // we know of lower keys but have no descending node
+	HealthLoad  HealthCheck = "load"  // the state actor is saturated, see StateLoad
+)
+
+// Problem is a reason why the router isn't healthy.
+type Problem struct {
+	Check  HealthCheck `json:"check"`
+	Detail string      `json:"detail"`
+}
+
+func (p Problem) String() string {
+	return string(p.Check) + ": " + p.Detail
+}
+
+// Healthy returns true if the router looks like it is working, or false
+// along with the problems that it found otherwise. It is meant for liveness
+// and readiness checks in orchestration systems. The router is healthy if it
+// has enough peers, enough of them agree with us on the root, we have a
+// descending node in the snake if there is any node below us to be one, and
+// the state actor isn't saturated. Only the descending side of the snake is
+// checked, since bootstraps aren't acknowledged and so we can't tell from
+// here whether our ascending node has a path to us. A router that has only
+// just started won't be healthy until the tree and snake have converged.
+func (r *Router) Healthy() (bool, []Problem) {
+	criteria := r.health.withDefaults()
+	var problems []Problem
+	phony.Block(r.state, func() {
+		s := r.state
+		root := s._rootAnnouncement().RootPublicKey
+		peers, agree := 0, 0
+		for _, p := range s._peers {
+			if p == nil || p == r.local || !p.started.Load() {
+				continue
+			}
+			peers++
+			if ann := s._announcements[p]; ann != nil && ann.RootPublicKey == root {
+				agree++
+			}
+		}
+		if peers < criteria.MinPeers {
+			problems = append(problems, Problem{
+				Check:  HealthPeers,
+				Detail: fmt.Sprintf("%d peers connected, need %d", peers, criteria.MinPeers),
+			})
+		}
+		if peers > 0 && float64(agree) < float64(peers)*criteria.RootAgreement {
+			problems = append(problems, Problem{
+				Check:  HealthRoot,
+				Detail: fmt.Sprintf("%d of %d peers follow root %s", agree, peers, root),
+			})
+		}
+		if r.routing.snake() && !r.observer {
+			if desc := s._descending; desc == nil || !desc.valid() {
+				for k := range s._knownKeys() {
+					if k.CompareTo(r.public) < 0 {
+						problems = append(problems, Problem{
+							Check:  HealthSnake,
+							Detail: fmt.Sprintf("no descending node, although %s is below us", k),
+						})
+						break
+					}
+				}
+			}
+		}
+	})
+	if load := r.StateLoad(); load.Saturated {
+		problems = append(problems, Problem{
+			Check:  HealthLoad,
+			Detail: fmt.Sprintf("state actor is saturated with %d frames waiting", load.Pending),
+		})
+	}
+	return len(problems) == 0, problems
+}
+
+// HealthHandler is an HTTP handler that reports the result of Healthy as
+// JSON, with a status of 200 if the router is healthy or 503 if it isn't, so
+// that it can be used directly as a /healthz endpoint.
+func (r *Router) HealthHandler(w http.ResponseWriter, req *http.Request) {
+	healthy, problems := r.Healthy()
+	response := struct {
+		Healthy  bool      `json:"healthy"`
+		Problems []Problem `json:"problems,omitempty"`
+	}{healthy, problems}
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(response)
+}
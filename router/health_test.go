@@ -0,0 +1,49 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthy(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+	healthy, problems := r.Healthy()
+	if healthy || len(problems) != 1 || problems[0].Check != HealthPeers {
+		t.Fatalf("expected a router without peers to be unhealthy, got %v", problems)
+	}
+	rec := httptest.NewRecorder()
+	r.HealthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", rec.Code)
+	}
+
+	// Once the tree and snake have converged, every node is healthy.
+	routers := newBenchChain(t, 3)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	for _, r := range routers {
+		r := r
+		waitFor(t, "the router to be healthy", func() bool {
+			healthy, _ := r.Healthy()
+			return healthy
+		})
+	}
+	rec = httptest.NewRecorder()
+	routers[0].HealthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	// Criteria that aren't given keep their defaults.
+	criteria := RouterHealthCriteria{MinPeers: 2}.withDefaults()
+	if criteria.MinPeers != 2 || criteria.RootAgreement != 0.5 {
+		t.Fatalf("unexpected criteria %+v", criteria)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+	"github.com/matrix-org/pinecone/util"
+)
+
+// RouterSnakeHysteresis sets how long a node must keep bootstrapping to us
+// without a break before it can replace a descending node that is still
+// working, even if it is closer to us in keyspace. Without it, a closer node
+// that keeps dropping in and out of reachability, i.e. over a marginal
+// wireless link, makes us switch back and forth between it and the next
+// closest node every time, with each switch causing more bootstraps. We
+// still switch straight away if we have no working descending node at all.
+// It is off by default.
+type RouterSnakeHysteresis time.Duration
+
+func (h RouterSnakeHysteresis) isRouterOption() {}
+
+// SnakeStats contains information about our position in the snake,
+// including how much churn there has been since the router started.
+type SnakeStats struct {
+	Descending        types.PublicKey `json:"descending"` // zero if we don't have a descending node
+	DescendingChanges uint64          `json:"descending_changes"`
+	DeferredChanges   uint64          `json:"deferred_changes"` // bootstraps that were held back by RouterSnakeHysteresis
+}
+
+// SnakeStats returns our current descending node and counts of how many
+// times it has changed.
+func (r *Router) SnakeStats() SnakeStats {
+	var stats SnakeStats
+	phony.Block(r.state, func() {
+		stats = SnakeStats{
+			DescendingChanges: r.state._descChanges,
+			DeferredChanges:   r.state._descDeferred,
+		}
+		if desc := r.state._descending; desc != nil {
+			stats.Descending = desc.PublicKey
+		}
+	})
+	return stats
+}
+
+// descendingCandidate is a node that is closer to us than our descending
+// node, but that hasn't been bootstrapping for long enough to replace it.
+type descendingCandidate struct {
+	key   types.PublicKey
+	since time.Time // when it started bootstrapping without a break
+	last  time.Time // when we last heard a bootstrap from it
+}
+
+// _acceptDescending decides whether a bootstrap from the given key should
+// replace our current descending node, which hasn't expired but is further
+// away from us than the key. The path from the key is unbroken if our last
+// path from it hadn't expired by the time that the bootstrap arrived.
+func (s *state) _acceptDescending(key types.PublicKey, unbroken bool) bool {
+	if s.r.hysteresis <= 0 {
+		return true
+	}
+	now := s.r.clock.now()
+	c := &s._descCandidate
+	switch {
+	case c.key == key:
+		if !unbroken {
+			c.since = now
+		}
+	case c.key.IsZero() || now.Sub(c.last) >= s.r.timers.snakeExpiry() ||
+		util.DHTOrdered(c.key, key, s.r.public):
+		// Nobody is waiting, or the candidate that was waiting has gone
+		// quiet, or this one is closer still, so start waiting for this one.
+		*c = descendingCandidate{key: key, since: now}
+	default:
+		// A closer candidate is already waiting.
+		s._descDeferred++
+		return false
+	}
+	c.last = now
+	if now.Sub(c.since) < s.r.hysteresis {
+		s._descDeferred++
+		return false
+	}
+	*c = descendingCandidate{}
+	return true
+}
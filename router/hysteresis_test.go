@@ -0,0 +1,82 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestSnakeHysteresis(t *testing.T) {
+	// The candidate keys need to sit below ours in keyspace.
+	var sk ed25519.PrivateKey
+	for sk == nil || sk.Public().(ed25519.PublicKey)[0] < 0x10 {
+		_, sk, _ = ed25519.GenerateKey(nil)
+	}
+	r := NewRouter(nil, sk, false, RouterSnakeHysteresis(time.Minute))
+	defer r.Close()
+	var far, near types.PublicKey
+	far[0], near[0] = 0x04, 0x08
+
+	accept := func(key types.PublicKey, unbroken bool) (accepted bool) {
+		phony.Block(r.state, func() {
+			accepted = r.state._acceptDescending(key, unbroken)
+		})
+		return
+	}
+
+	// A new candidate has to wait out the hysteresis, and a further away
+	// candidate can't jump the queue in the meantime.
+	if accept(near, false) {
+		t.Fatal("expected the first bootstrap to be held back")
+	}
+	if accept(far, true) {
+		t.Fatal("expected a further candidate to be held back")
+	}
+	r.SetClockSkew(time.Minute*2, 1)
+	if !accept(near, true) {
+		t.Fatal("expected the candidate to be accepted after the hysteresis")
+	}
+
+	// A break in the bootstraps starts the wait again.
+	if accept(near, false) {
+		t.Fatal("expected the first bootstrap to be held back")
+	}
+	r.SetClockSkew(time.Minute*4, 1)
+	if accept(near, false) {
+		t.Fatal("expected a broken path to restart the hysteresis")
+	}
+
+	if deferred := r.SnakeStats().DeferredChanges; deferred != 4 {
+		t.Fatalf("expected 4 deferred changes but got %d", deferred)
+	}
+}
+
+func TestSnakeStatsCountsChanges(t *testing.T) {
+	// Bootstrapping more often than the default means that the paths settle
+	// well within the time that waitFor allows.
+	routers := newBenchChain(t, 3, RouterTimers{BootstrapInterval: time.Second})
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	waitFor(t, "descending nodes", func() bool {
+		for _, r := range routers {
+			stats := r.SnakeStats()
+			if !stats.Descending.IsZero() && stats.DescendingChanges == 0 {
+				return false
+			}
+		}
+		// The node with the lowest key is the only one without one.
+		count := 0
+		for _, r := range routers {
+			if !r.SnakeStats().Descending.IsZero() {
+				count++
+			}
+		}
+		return count == len(routers)-1
+	})
+}
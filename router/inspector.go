@@ -0,0 +1,98 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// inspectorRate is the most frames per second that will be passed to the
+// inspector. Frames beyond this are not inspected.
+const inspectorRate = 1024
+
+// Direction says whether an inspected frame was sent or received by this
+// node.
+type Direction uint8
+
+const (
+	DirectionOutbound Direction = iota // frame was originated by this node
+	DirectionInbound                   // frame was delivered to this node
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionOutbound:
+		return "outbound"
+	case DirectionInbound:
+		return "inbound"
+	default:
+		return "unknown"
+	}
+}
+
+// RouterOptionInspector installs a callback that is given every frame that
+// is originated by or delivered to this node, for wire-level debugging or
+// auditing. This includes the protocol frames that the node sends to and
+// receives from its peers, as well as bootstraps that end with this node.
+// Frames that are only being forwarded on behalf of other nodes, including
+// bootstraps, are not inspected. The callback is given its own copy
+// of the frame, which it may keep, and runs on its own actor so that a slow
+// callback never holds up the router. At most inspectorRate frames per second
+// are inspected and the rest are skipped. Frames are only copied when they
+// are going to be inspected.
+type RouterOptionInspector func(dir Direction, f *types.Frame)
+
+func (i RouterOptionInspector) isRouterOption() {}
+
+// inspector holds the callback and rate limiting state for the inspector.
+type inspector struct {
+	phony.Inbox
+	fn     RouterOptionInspector
+	mutex  sync.Mutex
+	window time.Time // when did the current rate limiting window start?
+	count  int       // how many frames were inspected in this window?
+}
+
+// inspect passes a copy of the frame to the inspector callback, if there is
+// one and the rate limit allows it. It is safe to call from any actor.
+func (i *inspector) inspect(dir Direction, f *types.Frame) {
+	if i == nil {
+		return
+	}
+	now := time.Now()
+	i.mutex.Lock()
+	if now.Sub(i.window) >= time.Second {
+		i.window, i.count = now, 0
+	}
+	if i.count >= inspectorRate {
+		i.mutex.Unlock()
+		return
+	}
+	i.count++
+	i.mutex.Unlock()
+
+	c := *f
+	c.Destination = f.Destination.Copy()
+	c.Source = f.Source.Copy()
+	c.Extensions = append([]byte(nil), f.Extensions...)
+	c.Payload = append([]byte(nil), f.Payload...)
+	i.Act(nil, func() {
+		i.fn(dir, &c)
+	})
+}
@@ -0,0 +1,106 @@
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestInspectorSeesLocalTraffic(t *testing.T) {
+	type inspected struct {
+		dir Direction
+		f   *types.Frame
+	}
+	ch := make(chan inspected, 16)
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterOptionInspector(func(dir Direction, f *types.Frame) {
+		if f.Type == types.TypeVirtualSnakeRouted {
+			ch <- inspected{dir, f}
+		}
+	}))
+	defer r.Close()
+
+	// Sending a frame to ourselves means that it is both originated by and
+	// delivered to this node.
+	payload := []byte("hello")
+	if _, err := r.WriteTo(payload, r.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if _, _, err := r.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []Direction{DirectionOutbound, DirectionInbound} {
+		select {
+		case i := <-ch:
+			if i.dir != dir {
+				t.Fatalf("expected %s frame but got %s", dir, i.dir)
+			}
+			if !bytes.Equal(i.f.Payload, payload) {
+				t.Fatalf("expected payload %q but got %q", payload, i.f.Payload)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for %s frame", dir)
+		}
+	}
+}
+
+func TestInspectorSeesProtocolFrames(t *testing.T) {
+	type seen struct {
+		dir Direction
+		typ types.FrameType
+	}
+	var mutex sync.Mutex
+	frames := map[*Router]map[seen]bool{}
+	newRouter := func() *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		got := map[seen]bool{}
+		r := NewRouter(nil, sk, false, RouterOptionInspector(func(dir Direction, f *types.Frame) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			got[seen{dir, f.Type}] = true
+		}))
+		frames[r] = got
+		return r
+	}
+	ra, rb := newRouter(), newRouter()
+	defer ra.Close()
+	defer rb.Close()
+	connectPair(t, ra, rb)
+
+	// Both sides announce to each other, and the node that isn't the root
+	// bootstraps to the one that is, where the bootstrap ends.
+	root, child := ra, rb
+	if rb.PublicKey().CompareTo(ra.PublicKey()) > 0 {
+		root, child = rb, ra
+	}
+	expect := map[*Router][]seen{
+		root: {
+			{DirectionOutbound, types.TypeTreeAnnouncement},
+			{DirectionInbound, types.TypeTreeAnnouncement},
+			{DirectionInbound, types.TypeVirtualSnakeBootstrap},
+		},
+		child: {
+			{DirectionOutbound, types.TypeTreeAnnouncement},
+			{DirectionInbound, types.TypeTreeAnnouncement},
+			{DirectionOutbound, types.TypeVirtualSnakeBootstrap},
+		},
+	}
+	waitFor(t, "protocol frames to be inspected", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for r, want := range expect {
+			for _, s := range want {
+				if !frames[r][s] {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
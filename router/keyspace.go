@@ -0,0 +1,312 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+const (
+	keyspaceMaxResults  = 32              // the most keys that a search or query can return
+	keyspaceRounds      = 3               // the most rounds of queries in a search
+	keyspaceParallelism = 3               // how many nodes to query in each round after the first
+	keyspaceTimeout     = time.Second * 2 // how long to wait for responses in each round
+)
+
+const keyspaceFlags = types.FrameFlagKeyspaceQuery | types.FrameFlagKeyspaceResponse
+
+// keyspaceResult is a response to a keyspace query, passed from the state
+// actor to the search that is waiting for it.
+type keyspaceResult struct {
+	from types.PublicKey
+	keys []types.PublicKey
+}
+
+// SearchKeyspace performs an iterative search over the network for the keys
+// that are closest to the target key, measuring distance in both directions
+// around the keyspace. The first query is SNEK-routed towards the target
+// itself, which will deliver it to the node closest to the target, and each
+// following round queries the closest nodes found so far that haven't been
+// asked yet. The search ends when a round finds no new keys. At most count
+// keys will be returned, closest first, up to a maximum of 32.
+func (r *Router) SearchKeyspace(target types.PublicKey, count int) ([]types.PublicKey, error) {
+	if err := r.requireSnake(); err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		return nil, fmt.Errorf("count must be positive")
+	}
+	if count > keyspaceMaxResults {
+		count = keyspaceMaxResults
+	}
+
+	found := map[types.PublicKey]struct{}{}
+	asked := map[types.PublicKey]struct{}{r.public: {}}
+	phony.Block(r.state, func() {
+		for _, k := range r.state._closestKeys(target, count) {
+			found[k] = struct{}{}
+		}
+	})
+
+	for round := 0; round < keyspaceRounds; round++ {
+		var queries []types.PublicKey
+		if round == 0 {
+			queries = []types.PublicKey{target}
+		} else {
+			for _, k := range sortByKeyspaceDistance(target, found) {
+				if _, ok := asked[k]; ok {
+					continue
+				}
+				queries = append(queries, k)
+				if len(queries) == keyspaceParallelism {
+					break
+				}
+			}
+		}
+		if len(queries) == 0 {
+			break
+		}
+
+		results := make(chan keyspaceResult, len(queries))
+		nonces := make([]uint64, 0, len(queries))
+		phony.Block(r.state, func() {
+			for _, k := range queries {
+				asked[k] = struct{}{}
+				nonce, err := newKeyspaceNonce()
+				if err != nil {
+					continue
+				}
+				r.state._searches[nonce] = results
+				nonces = append(nonces, nonce)
+				r.state._sendKeyspaceQuery(k, &types.KeyspaceQuery{
+					Nonce:  nonce,
+					Target: target,
+					Count:  uint8(count),
+				})
+			}
+		})
+
+		added := 0
+		timeout := time.NewTimer(keyspaceTimeout)
+	wait:
+		for received := 0; received < len(nonces); received++ {
+			select {
+			case <-r.context.Done():
+				break wait
+			case <-timeout.C:
+				break wait
+			case result := <-results:
+				// The node that responded is asked by definition, which
+				// stops us from querying it again by key in the next round.
+				asked[result.from] = struct{}{}
+				for _, k := range append(result.keys, result.from) {
+					if _, ok := found[k]; !ok {
+						found[k] = struct{}{}
+						added++
+					}
+				}
+			}
+		}
+		timeout.Stop()
+		phony.Block(r.state, func() {
+			for _, nonce := range nonces {
+				delete(r.state._searches, nonce)
+			}
+		})
+		if added == 0 {
+			break
+		}
+	}
+
+	closest := sortByKeyspaceDistance(target, found)
+	if len(closest) > count {
+		closest = closest[:count]
+	}
+	return closest, nil
+}
+
+// _handleKeyspaceFrame handles a SNEK-routed frame that has been delivered
+// to us with one of the keyspace flags set. It returns true if the frame
+// was a keyspace frame, in which case it should not be passed to the local
+// router as traffic.
+func (s *state) _handleKeyspaceFrame(f *types.Frame) bool {
+	switch {
+	case f.Extra[0]&types.FrameFlagKeyspaceQuery != 0:
+		var query types.KeyspaceQuery
+		if _, err := query.UnmarshalBinary(f.Payload); err != nil {
+			return true
+		}
+		// The source key isn't authenticated, so the response must be no
+		// bigger than the query, otherwise anyone could use us to flood
+		// another node with responses. Queries are padded to make room.
+		count := int(query.Count)
+		if count > keyspaceMaxResults {
+			count = keyspaceMaxResults
+		}
+		if fit := (len(f.Payload) - keyspaceResponseSize(0)) / ed25519.PublicKeySize; count > fit {
+			count = fit
+		}
+		s._sendKeyspaceResponse(f.SourceKey, &types.KeyspaceResponse{
+			Nonce: query.Nonce,
+			Keys:  s._closestKeys(query.Target, count),
+		})
+		return true
+
+	case f.Extra[0]&types.FrameFlagKeyspaceResponse != 0:
+		var response types.KeyspaceResponse
+		if _, err := response.UnmarshalBinary(f.Payload); err != nil {
+			return true
+		}
+		if ch, ok := s._searches[response.Nonce]; ok {
+			select {
+			case ch <- keyspaceResult{from: f.SourceKey, keys: response.Keys}:
+			default:
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// _sendKeyspaceQuery sends a keyspace query, SNEK-routed towards the given
+// public key. The query is padded to the size of a response with the number
+// of keys asked for, since nodes never respond with more than they received.
+func (s *state) _sendKeyspaceQuery(dest types.PublicKey, query *types.KeyspaceQuery) {
+	var buf [8 + 1 + keyspaceMaxResults*32]byte
+	n, err := query.MarshalBinary(buf[:])
+	if err != nil {
+		return
+	}
+	if size := keyspaceResponseSize(int(query.Count)); n < size && size <= len(buf) {
+		n = size
+	}
+	s._sendKeyspaceFrame(dest, types.FrameFlagKeyspaceQuery, buf[:n])
+}
+
+// _sendKeyspaceResponse sends a keyspace response, SNEK-routed back to the
+// node that sent the query.
+func (s *state) _sendKeyspaceResponse(dest types.PublicKey, response *types.KeyspaceResponse) {
+	var buf [8 + 1 + keyspaceMaxResults*32]byte
+	n, err := response.MarshalBinary(buf[:])
+	if err != nil {
+		return
+	}
+	s._sendKeyspaceFrame(dest, types.FrameFlagKeyspaceResponse, buf[:n])
+}
+
+// keyspaceResponseSize returns the size of a keyspace response payload that
+// carries the given number of keys.
+func keyspaceResponseSize(keys int) int {
+	return 8 + 1 + keys*ed25519.PublicKeySize
+}
+
+func (s *state) _sendKeyspaceFrame(dest types.PublicKey, flag byte, payload []byte) {
+	frame := s.r.getFrame()
+	frame.Type = types.TypeVirtualSnakeRouted
+	frame.Extra[0] = flag
+	frame.DestinationKey = dest
+	frame.SourceKey = s.r.public
+	frame.Payload = append(frame.Payload[:0], payload...)
+	frame.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	_ = s._forward(s.r.local, frame)
+}
+
+// _closestKeys returns up to count of the keys that we know about which are
+// closest to the target, closest first.
+func (s *state) _closestKeys(target types.PublicKey, count int) []types.PublicKey {
+	closest := sortByKeyspaceDistance(target, s._knownKeys())
+	if len(closest) > count {
+		closest = closest[:count]
+	}
+	return closest
+}
+
+// _knownKeys returns our own key, the keys of our peers, their ancestors in
+// the tree and any keys in the snake routing table.
+func (s *state) _knownKeys() map[types.PublicKey]struct{} {
+	known := map[types.PublicKey]struct{}{
+		s.r.public: {},
+	}
+	if ann := s._rootAnnouncement(); ann != nil && !ann.RootPublicKey.IsZero() {
+		known[ann.RootPublicKey] = struct{}{}
+	}
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		known[p.public] = struct{}{}
+	}
+	for _, ann := range s._announcements {
+		if ann == nil {
+			continue
+		}
+		for _, sig := range ann.Signatures {
+			known[sig.PublicKey] = struct{}{}
+		}
+	}
+	for k, entry := range s._table {
+		if entry.valid() {
+			known[k.PublicKey] = struct{}{}
+		}
+	}
+	return known
+}
+
+// keyspaceDistance returns the distance between two keys, going whichever
+// way around the keyspace is shorter.
+func keyspaceDistance(a, b types.PublicKey) types.PublicKey {
+	up, down := a.DistanceTo(b), b.DistanceTo(a)
+	if down.CompareTo(up) < 0 {
+		return down
+	}
+	return up
+}
+
+// sortByKeyspaceDistance returns the keys in the set sorted by their
+// distance from the target, closest first.
+func sortByKeyspaceDistance(target types.PublicKey, keys map[types.PublicKey]struct{}) []types.PublicKey {
+	sorted := make([]types.PublicKey, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		di := keyspaceDistance(target, sorted[i])
+		dj := keyspaceDistance(target, sorted[j])
+		return di.CompareTo(dj) < 0
+	})
+	return sorted
+}
+
+func newKeyspaceNonce() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
@@ -0,0 +1,108 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestKeyspaceDistanceWraps(t *testing.T) {
+	low := types.PublicKey{0x00, 0x01}
+	high := types.PublicKey{0xff, 0xff}
+	mid := types.PublicKey{0x80}
+	// Going up from high wraps around to low, which is shorter than
+	// going down from high, so low should be closer to high than mid.
+	if keyspaceDistance(high, low).CompareTo(keyspaceDistance(high, mid)) >= 0 {
+		t.Fatal("expected keyspace distance to wrap around")
+	}
+	if keyspaceDistance(low, high) != keyspaceDistance(high, low) {
+		t.Fatal("expected keyspace distance to be symmetric")
+	}
+}
+
+func TestSearchKeyspaceFindsAllNodes(t *testing.T) {
+	routers := newBenchChain(t, 5)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	// The snake may take a moment to settle after the tree has converged,
+	// so keep searching until everything has been found.
+	target := routers[len(routers)-1].PublicKey()
+	deadline := time.Now().Add(time.Second * 15)
+	for {
+		keys, err := routers[0].SearchKeyspace(target, len(routers))
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[types.PublicKey]struct{}{}
+		for _, k := range keys {
+			found[k] = struct{}{}
+		}
+		missing := 0
+		for _, r := range routers {
+			if _, ok := found[r.PublicKey()]; !ok {
+				missing++
+			}
+		}
+		if missing == 0 {
+			if keys[0] != target {
+				t.Fatalf("expected the target to be closest but got %s", keys[0])
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("search did not find %d of %d nodes in time", missing, len(routers))
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+}
+
+func TestKeyspaceResponseNoLargerThanQuery(t *testing.T) {
+	routers := newBenchChain(t, 3)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	r := routers[1]
+
+	// Queries are answered by ourselves when the source key is our own, so
+	// the response comes straight back through the search channel.
+	query := func(padded bool) []types.PublicKey {
+		results := make(chan keyspaceResult, 1)
+		query := &types.KeyspaceQuery{Nonce: 1, Target: r.PublicKey(), Count: keyspaceMaxResults}
+		phony.Block(r.state, func() {
+			r.state._searches[query.Nonce] = results
+			defer delete(r.state._searches, query.Nonce)
+			if padded {
+				r.state._sendKeyspaceQuery(r.public, query)
+				return
+			}
+			var buf [8 + 32 + 1]byte
+			n, err := query.MarshalBinary(buf[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.state._sendKeyspaceFrame(r.public, types.FrameFlagKeyspaceQuery, buf[:n])
+		})
+		select {
+		case result := <-results:
+			return result.keys
+		default:
+			t.Fatal("no response to keyspace query")
+			return nil
+		}
+	}
+
+	if keys := query(false); len(keys) != 1 {
+		t.Fatalf("expected an unpadded query to get 1 key but got %d", len(keys))
+	}
+	if keys := query(true); len(keys) != len(routers) {
+		t.Fatalf("expected a padded query to get %d keys but got %d", len(routers), len(keys))
+	}
+}
@@ -0,0 +1,58 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestLoopback(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter(nil, sk, false)
+	defer r.Close() // nolint:errcheck
+
+	buf := make([]byte, types.MaxPayloadSize)
+	for _, addr := range []net.Addr{r.PublicKey(), r.Coords()} {
+		if _, err := r.WriteTo([]byte("hello"), addr); err != nil {
+			t.Fatal(err)
+		}
+		_ = r.SetReadDeadline(time.Now().Add(time.Second))
+		n, from, err := r.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from == nil {
+			t.Fatalf("frame sent to %s was not delivered", addr)
+		}
+		if string(buf[:n]) != "hello" {
+			t.Fatalf("expected %q but got %q", "hello", buf[:n])
+		}
+	}
+	if loopbacks := r.DebugStats().LoopbackFrames; loopbacks != 2 {
+		t.Fatalf("expected 2 loopback frames but got %d", loopbacks)
+	}
+}
+
+func TestReadFromAfterClose(t *testing.T) {
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRouter(nil, sk, false)
+	_ = r.Close()
+
+	// Reading from a closed router stops the local peer, which has no
+	// connection or protocol queue to clean up.
+	buf := make([]byte, types.MaxPayloadSize)
+	if _, from, _ := r.ReadFrom(buf); from != nil {
+		t.Fatalf("expected nothing to be read, got a packet from %s", from)
+	}
+	// Wait for the state actor to clean up after the local peer.
+	r.StateDump()
+}
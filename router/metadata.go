@@ -0,0 +1,241 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// metadataQueryTimeout is how long QueryMetadata waits for a response.
+const metadataQueryTimeout = time.Second * 5
+
+// metadataMaxLength is the most that encoded metadata can take up on the
+// wire, including the public key and the signature.
+const metadataMaxLength = 32 + types.MaxNodeMetadataSize + 64
+
+const metadataFlags = types.FrameFlagMetadataQuery | types.FrameFlagMetadataResponse
+
+// RouterMetadata is a small amount of information about the node that is
+// signed and shared with peers during the handshake, and with anyone who
+// asks using QueryMetadata, for use by community network directories and
+// diagnostic tools. It is limited to types.MaxNodeMetadataSize bytes once
+// encoded. No metadata is shared unless this option is given, although
+// metadata from peers is still accepted. If Private is set then the metadata
+// is only shared with direct peers and queries from elsewhere in the network
+// are answered as if there were none.
+type RouterMetadata struct {
+	Name    string
+	Version string // i.e. the name and version of the software
+	Contact string // i.e. an email address
+	Private bool
+}
+
+func (m RouterMetadata) isRouterOption() {}
+
+// metadataQueries are the metadata queries that are waiting for responses,
+// by nonce.
+type metadataQueries map[uint64]chan *types.NodeMetadata
+
+// Metadata returns the metadata that this node shares, or nil if it doesn't
+// share any.
+func (r *Router) Metadata() *types.NodeMetadata {
+	return r.metadata
+}
+
+// exchangeMetadata sends our metadata to the remote side of a connection and
+// receives theirs, as the final part of the handshake when both sides have
+// the metadata capability. Either side may send no metadata, in which case
+// nil is returned for it. Metadata that is too large, or that isn't signed
+// by the public key from the handshake, fails the handshake. Our metadata
+// is written while theirs is being read, since a connection without any
+// buffering, like a net.Pipe, would otherwise block with both sides writing.
+func (r *Router) exchangeMetadata(conn net.Conn, public types.PublicKey) (*types.NodeMetadata, error) {
+	send := make([]byte, 2, 2+metadataMaxLength)
+	if r.metadata != nil {
+		var err error
+		if send, err = appendMetadata(send, r.metadata); err != nil {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint16(send[:2], uint16(len(send)-2))
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(send)
+		written <- err
+	}()
+
+	var buf [2 + metadataMaxLength]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, handshakeError("io.ReadFull", err)
+	}
+	length := int(binary.BigEndian.Uint16(buf[:2]))
+	if length > metadataMaxLength {
+		return nil, fmt.Errorf("peer sent %d bytes of metadata", length)
+	}
+	if _, err := io.ReadFull(conn, buf[2:2+length]); err != nil {
+		return nil, handshakeError("io.ReadFull", err)
+	}
+	if err := <-written; err != nil {
+		return nil, handshakeError("conn.Write", err)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	metadata := &types.NodeMetadata{}
+	if _, err := metadata.UnmarshalBinary(buf[2 : 2+length]); err != nil {
+		return nil, fmt.Errorf("metadata.UnmarshalBinary: %w", err)
+	}
+	if metadata.PublicKey != public {
+		return nil, fmt.Errorf("peer sent metadata for a different key")
+	}
+	if err := metadata.Verify(); err != nil {
+		return nil, fmt.Errorf("peer sent invalid metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// appendMetadata appends the encoded metadata to the buffer.
+func appendMetadata(buf []byte, metadata *types.NodeMetadata) ([]byte, error) {
+	offset := len(buf)
+	buf = append(buf, make([]byte, metadata.Length())...)
+	n, err := metadata.MarshalBinary(buf[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("metadata.MarshalBinary: %w", err)
+	}
+	return buf[:offset+n], nil
+}
+
+// QueryMetadata asks the node with the given public key for its metadata,
+// which is SNEK-routed to it. If the node is one of our peers then the
+// metadata that it sent in the handshake is returned without asking. An
+// error is returned if the node doesn't respond in time or doesn't share any
+// metadata.
+func (r *Router) QueryMetadata(key types.PublicKey) (*types.NodeMetadata, error) {
+	if err := r.requireSnake(); err != nil {
+		return nil, err
+	}
+	if key == r.public {
+		if r.metadata == nil {
+			return nil, fmt.Errorf("no metadata is shared")
+		}
+		return r.metadata, nil
+	}
+
+	var metadata *types.NodeMetadata
+	var nonce uint64
+	var err error
+	result := make(chan *types.NodeMetadata, 1)
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p != nil && p.public == key && p._metadata != nil {
+				metadata = p._metadata
+				return
+			}
+		}
+		if nonce, err = newKeyspaceNonce(); err != nil {
+			return
+		}
+		r.state._metaQueries[nonce] = result
+		r.state._sendMetadataQuery(key, &types.MetadataQuery{Nonce: nonce})
+	})
+	switch {
+	case metadata != nil:
+		return metadata, nil
+	case err != nil:
+		return nil, fmt.Errorf("newKeyspaceNonce: %w", err)
+	}
+	defer phony.Block(r.state, func() {
+		delete(r.state._metaQueries, nonce)
+	})
+
+	timeout := time.NewTimer(metadataQueryTimeout)
+	defer timeout.Stop()
+	select {
+	case <-r.context.Done():
+		return nil, fmt.Errorf("router closed")
+	case <-timeout.C:
+		return nil, fmt.Errorf("no response from %s", key)
+	case metadata = <-result:
+	}
+	switch {
+	case metadata == nil:
+		return nil, fmt.Errorf("%s doesn't share any metadata", key)
+	case metadata.PublicKey != key:
+		return nil, fmt.Errorf("%s responded with metadata for a different key", key)
+	}
+	return metadata, nil
+}
+
+// _handleMetadataFrame handles a SNEK-routed frame that has been delivered
+// to us with one of the metadata flags set.
+func (s *state) _handleMetadataFrame(f *types.Frame) {
+	switch {
+	case f.Extra[0]&types.FrameFlagMetadataQuery != 0:
+		var query types.MetadataQuery
+		if _, err := query.UnmarshalBinary(f.Payload); err != nil {
+			return
+		}
+		response := &types.MetadataResponse{Nonce: query.Nonce}
+		if !s.r.metaPrivate {
+			response.Metadata = s.r.metadata
+		}
+		var buf [8 + metadataMaxLength]byte
+		n, err := response.MarshalBinary(buf[:])
+		if err != nil {
+			return
+		}
+		s._sendKeyspaceFrame(f.SourceKey, types.FrameFlagMetadataResponse, buf[:n])
+
+	case f.Extra[0]&types.FrameFlagMetadataResponse != 0:
+		var response types.MetadataResponse
+		if _, err := response.UnmarshalBinary(f.Payload); err != nil {
+			return
+		}
+		ch, ok := s._metaQueries[response.Nonce]
+		if !ok {
+			return
+		}
+		// A response from a node that doesn't share metadata is still
+		// passed on, so that the query can finish early.
+		if m := response.Metadata; m != nil && (m.PublicKey != f.SourceKey || m.Verify() != nil) {
+			return
+		}
+		select {
+		case ch <- response.Metadata:
+		default:
+		}
+	}
+}
+
+// _sendMetadataQuery sends a metadata query, SNEK-routed towards the given
+// public key.
+func (s *state) _sendMetadataQuery(dest types.PublicKey, query *types.MetadataQuery) {
+	var buf [8]byte
+	n, err := query.MarshalBinary(buf[:])
+	if err != nil {
+		return
+	}
+	s._sendKeyspaceFrame(dest, types.FrameFlagMetadataQuery, buf[:n])
+}
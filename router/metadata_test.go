@@ -0,0 +1,83 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	newRouter := func(options ...RouterOption) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		return NewRouter(nil, sk, false, options...)
+	}
+	a := newRouter()
+	b := newRouter(RouterMetadata{Name: "bob", Version: "pinecone/test"})
+	c := newRouter(RouterMetadata{Name: "carol", Private: true})
+	d := newRouter(RouterMetadata{Name: "dave", Contact: "dave@example.com"})
+	routers := []*Router{a, b, c, d}
+	for i, r := range routers {
+		defer r.Close() // nolint:errcheck
+		if i > 0 {
+			if err := connectNetworks(t, routers[i-1], r); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitFor(t, "peering", func() bool {
+		return a.PeerCount(-1) == 1 && b.PeerCount(-1) == 2 && c.PeerCount(-1) == 2 && d.PeerCount(-1) == 1
+	})
+
+	waitFor(t, "the tree", func() bool {
+		return sameRoot(routers)
+	})
+
+	// Metadata is exchanged in the handshake, even if it is private.
+	metadata := func(r, peer *Router) PeerInfo {
+		for _, p := range r.Peers() {
+			if p.PublicKey == peer.PublicKey().String() {
+				return p
+			}
+		}
+		t.Fatalf("no peer %s", peer.PublicKey())
+		return PeerInfo{}
+	}
+	if m := metadata(a, b).Metadata; m == nil || m.Name != "bob" || m.Version != "pinecone/test" {
+		t.Fatalf("expected metadata from b, got %+v", m)
+	}
+	if m := metadata(b, c).Metadata; m == nil || m.Name != "carol" {
+		t.Fatalf("expected metadata from c, got %+v", m)
+	}
+	if m := metadata(b, a).Metadata; m != nil {
+		t.Fatalf("expected no metadata from a, got %+v", m)
+	}
+
+	// Metadata can be queried from further away, unless it's private. The
+	// first query might be sent before the snake has converged.
+	m, err := a.QueryMetadata(d.PublicKey())
+	for i := 0; i < 3 && err != nil; i++ {
+		m, err = a.QueryMetadata(d.PublicKey())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "dave" || m.Contact != "dave@example.com" {
+		t.Fatalf("expected metadata from d, got %+v", m)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.QueryMetadata(c.PublicKey()); err == nil {
+		t.Fatal("expected a query for private metadata to fail")
+	}
+	if _, err := d.QueryMetadata(a.PublicKey()); err == nil {
+		t.Fatal("expected a query to a node without metadata to fail")
+	}
+
+	// Metadata that is too large isn't shared at all.
+	e := newRouter(RouterMetadata{Name: strings.Repeat("e", 1024)})
+	defer e.Close() // nolint:errcheck
+	if e.Metadata() != nil {
+		t.Fatal("expected oversized metadata to be refused")
+	}
+}
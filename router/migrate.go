@@ -0,0 +1,304 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// ConnectionMigrate moves an existing peering with the remote node onto the
+// new connection, rather than adding another peering alongside it, i.e. to
+// move from a relayed connection to a direct one once hole punching has
+// worked. The peering keeps its switch port, so the tree and the snake paths
+// through it aren't torn down, and it keeps everything else that it was set
+// up with apart from the connection itself. The old connection is closed once
+// both sides have moved over. The remote side is asked to migrate during the
+// handshake, so it doesn't need to set this too, but it does need to support
+// migration. If we aren't peered with the remote node already then the
+// connection is set up as a new peering as usual.
+type ConnectionMigrate bool
+
+func (m ConnectionMigrate) isConnectionOption() {}
+
+// errMigrated is returned by reads on a peering that has moved to another
+// connection part of the way through a frame. The partial frame is lost, and
+// the next read comes from the new connection.
+var errMigrated = errors.New("peering migrated to a new connection")
+
+// peerConn is the connection that a peering runs over. Most of the time it
+// passes everything straight through to the connection that the peering was
+// set up with, but that connection can be swapped for another one to the same
+// node while the peering is running, see ConnectionMigrate.
+//
+// During a migration, each side sends a keepalive with the migrate extension
+// as the last frame on the old connection and writes everything after that to
+// the new one. Reads carry on from the old connection until the marker from
+// the remote side arrives, so that frames are never split across connections,
+// and the old connection is closed once both directions have moved over. If
+// the old connection fails in the meantime then we move over straight away.
+type peerConn struct {
+	mutex      sync.Mutex
+	reading    net.Conn      // the connection that frames are read from
+	writing    net.Conn      // the connection that frames are written to
+	old        net.Conn      // the connection that we are migrating from, if any
+	next       net.Conn      // the connection that we are migrating to, if any
+	readMoved  bool          // has the remote side finished with the old connection?
+	writeMoved bool          // have we finished with the old connection?
+	waiting    chan struct{} // closed once the new connection arrives, if the remote side moved first
+	drainBy    time.Time     // when to stop waiting for the remote side to finish with the old connection
+	timeout    time.Duration // how long a migration can take, not mutated after setup
+	closed     bool
+}
+
+func newPeerConn(conn net.Conn, timeout time.Duration) *peerConn {
+	return &peerConn{
+		reading: conn,
+		writing: conn,
+		timeout: timeout,
+	}
+}
+
+// uses returns true if the given connection belongs to the peering.
+func (c *peerConn) uses(conn net.Conn) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writing == conn || c.reading == conn || c.next == conn
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	conn, waiting := c.reading, c.waiting
+	c.mutex.Unlock()
+	if waiting != nil {
+		// The remote side has moved over to a new connection already but
+		// we don't have it yet, so there's nothing to read until we do.
+		select {
+		case <-waiting:
+			return 0, errMigrated
+		case <-time.After(c.timeout):
+			return 0, fmt.Errorf("remote side migrated to a connection that didn't arrive")
+		}
+	}
+	n, err := conn.Read(b)
+	if err != nil {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.next != nil && c.reading == conn && conn == c.old {
+			c._readerMoved()
+			return n, errMigrated
+		}
+	}
+	return n, err
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	conn := c.writing
+	c.mutex.Unlock()
+	n, err := conn.Write(b)
+	if err != nil {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if c.next != nil && c.writing == conn && conn == c.old {
+			// The old connection failed before we were done with it. The
+			// frames in this write are lost but the peering carries on over
+			// the new connection.
+			c._writerMoved()
+			return len(b), nil
+		}
+	}
+	return n, err
+}
+
+func (c *peerConn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	if c.waiting != nil {
+		close(c.waiting)
+		c.waiting = nil
+	}
+	err := c.writing.Close()
+	for _, conn := range []net.Conn{c.reading, c.old, c.next} {
+		if conn != nil && conn != c.writing {
+			_ = conn.Close()
+		}
+	}
+	return err
+}
+
+func (c *peerConn) LocalAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writing.LocalAddr()
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writing.RemoteAddr()
+}
+
+func (c *peerConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the connection that frames are
+// being read from. While we are waiting for the remote side to finish with the
+// old connection, the deadline is brought forward if needed so that we don't
+// wait for longer than the migration is allowed to take.
+func (c *peerConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.next != nil && c.reading == c.old && (t.IsZero() || t.After(c.drainBy)) {
+		t = c.drainBy
+	}
+	return c.reading.SetReadDeadline(t)
+}
+
+func (c *peerConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writing.SetWriteDeadline(t)
+}
+
+// migrateTo starts moving the peering over to the given connection.
+func (c *peerConn) migrateTo(conn net.Conn) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch {
+	case c.closed:
+		return fmt.Errorf("the peering has been closed")
+	case c.next != nil:
+		return fmt.Errorf("the peering is already migrating")
+	}
+	c.old, c.next = c.writing, conn
+	if c.waiting != nil {
+		// The remote side has moved over already.
+		c.reading = conn
+		close(c.waiting)
+		c.waiting = nil
+		return nil
+	}
+	c.drainBy = time.Now().Add(c.timeout)
+	return c.old.SetReadDeadline(c.drainBy)
+}
+
+// readerMoved is called when the remote side has told us that it won't send
+// anything else on the connection that we are reading from.
+func (c *peerConn) readerMoved() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	switch {
+	case c.next != nil && c.reading == c.old:
+		c._readerMoved()
+	case c.next == nil && !c.readMoved:
+		// The remote side got the new connection set up before we did,
+		// so wait until we have it too.
+		c.readMoved = true
+		c.waiting = make(chan struct{})
+	}
+}
+
+func (c *peerConn) _readerMoved() {
+	c.reading, c.readMoved = c.next, true
+	c._finish()
+}
+
+// writerMoved is called once we have sent everything that we are going to
+// send on the old connection.
+func (c *peerConn) writerMoved() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.next != nil && c.writing == c.old {
+		c._writerMoved()
+	}
+}
+
+func (c *peerConn) _writerMoved() {
+	c.writing, c.writeMoved = c.next, true
+	c._finish()
+}
+
+// _finish closes the old connection once both directions have moved over.
+func (c *peerConn) _finish() {
+	if !c.readMoved || !c.writeMoved {
+		return
+	}
+	_ = c.old.Close()
+	c.old, c.next = nil, nil
+	c.readMoved, c.writeMoved = false, false
+}
+
+// isMigrateFrame returns true if the frame is the last one that the sender
+// will send on the connection that it arrived on.
+func isMigrateFrame(f *types.Frame) bool {
+	if f.Type != types.TypeKeepalive {
+		return false
+	}
+	_, ok := f.Extension(types.ExtensionTypeMigrate)
+	return ok
+}
+
+// migrate moves the peering over to the given connection, which must already
+// have been through the handshake with the same node.
+func (p *peer) migrate(conn net.Conn) error {
+	if err := p.conn.migrateTo(conn); err != nil {
+		return err
+	}
+	frame := p.router.getFrame()
+	frame.Type = types.TypeKeepalive
+	_ = frame.SetExtension(types.ExtensionTypeMigrate, nil)
+	p.sendProto(frame)
+	p.router.log.Println("Migrating peering with", p.public.String(), "on port", p.port, "to a new connection")
+	return nil
+}
+
+// migrate moves an existing peering with the given node over to the given
+// connection. It returns false if there is no peering to move, in which case
+// the connection should be used for a new one.
+func (r *Router) migrate(conn net.Conn, public types.PublicKey, datagrams bool) (types.SwitchPortID, bool, error) {
+	var existing *peer
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p != nil && p.port != 0 && p.public == public && p.started.Load() {
+				existing = p
+				break
+			}
+		}
+	})
+	if existing == nil {
+		return 0, false, nil
+	}
+	if existing.datagrams != datagrams {
+		conn.Close()
+		return 0, true, fmt.Errorf("can't migrate between stream and datagram peerings")
+	}
+	if err := existing.migrate(conn); err != nil {
+		conn.Close()
+		return 0, true, fmt.Errorf("peering on port %d: %w", existing.port, err)
+	}
+	return existing.port, true, nil
+}
@@ -0,0 +1,130 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// closeConn records whether the connection has been closed.
+type closeConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *closeConn) Close() error {
+	c.closed.Store(true)
+	return c.Conn.Close()
+}
+
+// tcpPair returns both ends of a TCP connection, which unlike net.Pipe can go
+// through the handshake, since both sides write before they read.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := <-accepted
+	if other == nil {
+		t.Fatal("failed to accept connection")
+	}
+	return conn, other
+}
+
+func TestConnectionMigrate(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false)
+	rb := NewRouter(nil, skb, false)
+	defer ra.Close()
+	defer rb.Close()
+
+	pa, pb := net.Pipe()
+	olda, oldb := &closeConn{Conn: pa}, &closeConn{Conn: pb}
+	porta, portb := connectEnds(t, pairEnd{ra, olda, nil}, pairEnd{rb, oldb, nil})
+	waitFor(t, "convergence", func() bool {
+		return sameRoot([]*Router{ra, rb}) && ra.Coords().DistanceTo(rb.Coords()) == 1
+	})
+	coords := rb.Coords()
+
+	// Only one side asks for the migration, since the other side is told to
+	// in the handshake. The peering moves from a pipe to TCP.
+	pa, pb = tcpPair(t)
+	migrated := make(chan error, 1)
+	go func() {
+		port, err := rb.Connect(pb)
+		if err == nil && port != portb {
+			t.Errorf("expected rb to keep port %d, got %d", portb, port)
+		}
+		migrated <- err
+	}()
+	port, err := ra.Connect(pa, ConnectionMigrate(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port != porta {
+		t.Fatalf("expected ra to keep port %d, got %d", porta, port)
+	}
+	if err := <-migrated; err != nil {
+		t.Fatal(err)
+	}
+	if ra.PeerCount(-1) != 1 || rb.PeerCount(-1) != 1 {
+		t.Fatalf("expected a single peering, got %d and %d", ra.PeerCount(-1), rb.PeerCount(-1))
+	}
+
+	// Both sides close the old connection once they have moved over, and the
+	// peering carries on over the new one without the tree moving.
+	waitFor(t, "the old connections to close", func() bool {
+		return olda.closed.Load() && oldb.closed.Load()
+	})
+	if !rb.Coords().EqualTo(coords) {
+		t.Fatalf("expected the coordinates to stay at %v, got %v", coords, rb.Coords())
+	}
+	payload, buf := []byte("hello"), make([]byte, types.MaxPayloadSize)
+	if _, err := ra.WriteTo(payload, rb.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	_ = rb.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, from, err := rb.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from == nil || string(buf[:n]) != "hello" {
+		t.Fatalf("expected the payload to arrive over the new connection, got %q from %v", buf[:n], from)
+	}
+}
+
+func TestConnectionMigrateWithoutPeering(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false)
+	rb := NewRouter(nil, skb, false)
+	defer ra.Close()
+	defer rb.Close()
+
+	// With nothing to migrate, the connection becomes a new peering.
+	pa, pb := tcpPair(t)
+	go func() {
+		_, _ = rb.Connect(pb)
+	}()
+	if _, err := ra.Connect(pa, ConnectionMigrate(true)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the peering", func() bool {
+		return ra.PeerCount(-1) == 1 && rb.PeerCount(-1) == 1
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+type MirrorDirection uint8
+
+const (
+	MirrorRx MirrorDirection = iota // frame was received from the peer
+	MirrorTx                        // frame was sent to the peer
+)
+
+func (d MirrorDirection) String() string {
+	switch d {
+	case MirrorRx:
+		return "rx"
+	case MirrorTx:
+		return "tx"
+	default:
+		return "unknown"
+	}
+}
+
+// MirroredFrame is a copy of a frame that was sent or received on a
+// mirrored switch port. The data contains the frame as it appeared on
+// the wire, truncated to the snap length of the mirror.
+type MirroredFrame struct {
+	Port      types.SwitchPortID
+	Direction MirrorDirection
+	Time      time.Time
+	Length    int    // The original length of the frame.
+	Data      []byte // The frame, truncated to the snap length.
+}
+
+// portMirror holds the configuration and rate limiting state for a
+// mirror on a single peer.
+type portMirror struct {
+	ch      chan<- MirroredFrame
+	snaplen int
+	rate    int
+	mutex   sync.Mutex
+	window  time.Time // when did the current rate limiting window start?
+	count   int       // how many frames were mirrored in this window?
+}
+
+// MirrorPort starts mirroring all frames sent and received on the given
+// switch port to the supplied channel. Each frame is truncated to snaplen
+// bytes, and at most rate frames per second will be mirrored. Frames will be
+// skipped rather than blocking the peer if the channel is full. Only one
+// mirror can be active on a port at a time, so this will replace an existing
+// mirror on the same port. The mirror stops when the returned function is
+// called or when the peer disconnects.
+func (r *Router) MirrorPort(port types.SwitchPortID, ch chan<- MirroredFrame, snaplen, rate int) (func(), error) {
+	if r.embedded {
+		return nil, fmt.Errorf("port mirroring is disabled by the embedded profile")
+	}
+	if snaplen <= 0 || rate <= 0 {
+		return nil, fmt.Errorf("snaplen and rate must be positive")
+	}
+	m := &portMirror{
+		ch:      ch,
+		snaplen: snaplen,
+		rate:    rate,
+	}
+	var p *peer
+	phony.Block(r.state, func() {
+		if int(port) < len(r.state._peers) && port != 0 {
+			p = r.state._peers[port]
+		}
+		if p == nil || !p.started.Load() {
+			p = nil
+			return
+		}
+		p.mirror.Store(m)
+	})
+	if p == nil {
+		return nil, fmt.Errorf("port %d: %w", port, ErrPortNotConnected)
+	}
+	return func() {
+		phony.Block(r.state, func() {
+			if p.mirror.Load() == m {
+				p.mirror.Store((*portMirror)(nil))
+			}
+		})
+	}, nil
+}
+
+// mirrorFrame sends a copy of the frame to the mirror for this peer, if
+// one has been configured. It is safe to call from any actor.
+func (p *peer) mirrorFrame(direction MirrorDirection, data []byte) {
+	m, _ := p.mirror.Load().(*portMirror)
+	if m == nil {
+		return
+	}
+	now := time.Now()
+	m.mutex.Lock()
+	if now.Sub(m.window) >= time.Second {
+		m.window, m.count = now, 0
+	}
+	if m.count >= m.rate {
+		m.mutex.Unlock()
+		return
+	}
+	m.count++
+	m.mutex.Unlock()
+
+	snaplen := len(data)
+	if snaplen > m.snaplen {
+		snaplen = m.snaplen
+	}
+	select {
+	case m.ch <- MirroredFrame{
+		Port:      p.port,
+		Direction: direction,
+		Time:      now,
+		Length:    len(data),
+		Data:      append([]byte(nil), data[:snaplen]...),
+	}:
+	default:
+	}
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMirrorTruncatesAndLimits(t *testing.T) {
+	ch := make(chan MirroredFrame, 16)
+	m := &portMirror{ch: ch, snaplen: 4, rate: 3}
+	p := &peer{port: 1}
+	p.mirror.Store(m)
+
+	// Only the first frames up to the rate are mirrored in any one second,
+	// and each is truncated to the snap length.
+	data := []byte("0123456789")
+	for i := 0; i < 10; i++ {
+		p.mirrorFrame(MirrorTx, data)
+	}
+	p.mirrorFrame(MirrorRx, []byte("ab"))
+	if n := len(ch); n != 3 {
+		t.Fatalf("expected 3 mirrored frames, got %d", n)
+	}
+	for i := 0; i < 3; i++ {
+		f := <-ch
+		if string(f.Data) != "0123" || f.Length != len(data) {
+			t.Fatalf("expected %q of %d bytes, got %q of %d bytes", "0123", len(data), f.Data, f.Length)
+		}
+		if f.Port != 1 || f.Direction != MirrorTx {
+			t.Fatalf("unexpected port %d or direction %s", f.Port, f.Direction)
+		}
+	}
+
+	// Once the window has moved on, frames are mirrored again, and frames
+	// shorter than the snap length are kept whole.
+	m.mutex.Lock()
+	m.window = m.window.Add(-time.Second)
+	m.mutex.Unlock()
+	p.mirrorFrame(MirrorRx, []byte("ab"))
+	select {
+	case f := <-ch:
+		if string(f.Data) != "ab" || f.Length != 2 || f.Direction != MirrorRx {
+			t.Fatalf("unexpected mirrored frame %+v", f)
+		}
+	default:
+		t.Fatal("expected a frame to be mirrored in the next window")
+	}
+
+	// The mirror doesn't block the peer when the channel is full.
+	m.mutex.Lock()
+	m.window, m.rate = time.Time{}, 100
+	m.mutex.Unlock()
+	for i := 0; i < cap(ch)+4; i++ {
+		p.mirrorFrame(MirrorTx, data)
+	}
+	if n := len(ch); n != cap(ch) {
+		t.Fatalf("expected the channel to be full, got %d frames", n)
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/matrix-org/pinecone/types"
+)
+
+// minConnectionMTU is the smallest MTU that a peering can have, which is
+// the smallest MTU that IPv6 allows. Anything smaller than this wouldn't fit
+// the tree announcements from a reasonably deep tree.
+const minConnectionMTU = 1280
+
+// ConnectionMTU gives the largest frame, in bytes and including the frame
+// header, that the link can carry, as negotiated by the transport underneath,
+// i.e. the path MTU of a datagram peering or the frame size of a radio link.
+// Both sides of the peering must be given the same MTU. Frames that would be
+// larger than the MTU are dropped rather than being written, and if the remote
+// side sends a frame header that claims a larger frame than that then it is
+// refused before the rest is read, ending the peering. Without this option,
+// frames are only limited by what the protocol allows for each frame type.
+// The MTU can't be smaller than 1280 bytes.
+type ConnectionMTU int
+
+func (c ConnectionMTU) isConnectionOption() {}
+
+// maxFrameLength returns the longest frame of the given type, including the
+// header, that can be sent or received on the peering.
+func (p *peer) maxFrameLength(t types.FrameType) int {
+	max := types.MaxFrameLength(t)
+	if p.mtu > 0 && p.mtu < max {
+		return p.mtu
+	}
+	return max
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestConnectionMTUMinimum(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	pa, pb := net.Pipe()
+	defer pb.Close()
+	var public types.PublicKey
+	public[0] = 1
+	if _, err := r.Connect(pa, ConnectionPublicKey(public), ConnectionMTU(minConnectionMTU-1)); err == nil {
+		t.Fatal("expected an MTU below the minimum to be refused")
+	}
+}
+
+func TestReaderRefusesOversizedFrames(t *testing.T) {
+	for name, tc := range map[string]struct {
+		options []ConnectionOption
+		typ     types.FrameType
+		length  int
+	}{
+		"OverMTU": {
+			options: []ConnectionOption{ConnectionMTU(minConnectionMTU)},
+			typ:     types.TypeTreeRouted,
+			length:  minConnectionMTU + 1,
+		},
+		"OverProtocolLimit": {
+			typ:    types.TypeKeepalive,
+			length: types.MaxFrameLength(types.TypeKeepalive) + 1,
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, sk, _ := ed25519.GenerateKey(nil)
+			r := NewRouter(nil, sk, false)
+			defer r.Close()
+
+			pa, pb := net.Pipe()
+			defer pb.Close()
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, pb)
+			}()
+			var public types.PublicKey
+			public[0] = 1
+			options := append(tc.options, ConnectionPublicKey(public), ConnectionKeepalives(false))
+			if _, err := r.Connect(pa, options...); err != nil {
+				t.Fatal(err)
+			}
+
+			// Only the header is sent, so if the reader tried to read the
+			// rest of the frame then it would wait forever.
+			header := make([]byte, types.FrameHeaderLength)
+			copy(header, types.FrameMagicBytes)
+			header[5] = byte(tc.typ)
+			binary.BigEndian.PutUint16(header[types.FrameHeaderLength-2:], uint16(tc.length))
+			if _, err := pb.Write(header); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the peering to end", func() bool {
+				return r.PeerCount(-1) == 0
+			})
+			if n := r.DebugStats().OversizedFrames; n != 1 {
+				t.Fatalf("expected 1 oversized frame, got %d", n)
+			}
+		})
+	}
+}
+
+func TestWriterDropsFramesOverMTU(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false, RouterStrictConformance{})
+	rb := NewRouter(nil, skb, false, RouterStrictConformance{})
+	defer ra.Close()
+	defer rb.Close()
+
+	connectPair(t, ra, rb, ConnectionMTU(minConnectionMTU))
+	waitFor(t, "convergence", func() bool {
+		return sameRoot([]*Router{ra, rb}) && ra.Coords().DistanceTo(rb.Coords()) == 1
+	})
+
+	if _, err := ra.WriteTo(make([]byte, minConnectionMTU), rb.Coords()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the drop", func() bool {
+		return ra.DropCounts()[DropTooLarge] == 1
+	})
+
+	// The peering stays up and smaller frames still get through.
+	if _, err := ra.WriteTo([]byte("hello"), rb.Coords()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, types.MaxPayloadSize)
+	_ = rb.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, _, err := rb.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Fatalf("expected hello, got %q", buf[:n])
+	}
+	if ra.PeerCount(-1) != 1 || rb.DebugStats().OversizedFrames != 0 {
+		t.Fatal("expected the peering to stay up")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// SnakeNeighbour is a node that we know about in keyspace because its
+// bootstrap set up a SNEK path through us or to us. The fields and their JSON
+// names are part of the stable API, so that simulations and research tooling
+// can compare neighbour tables across versions.
+type SnakeNeighbour struct {
+	PublicKey   types.PublicKey    `json:"public_key"`
+	Descending  bool               `json:"descending"`   // is this our descending node?
+	Terminates  bool               `json:"terminates"`   // does the path end at us, rather than passing through?
+	LearnedFrom types.PublicKey    `json:"learned_from"` // the peer that the bootstrap came from
+	LearnedPort types.SwitchPortID `json:"learned_port"`
+	NextHop     types.PublicKey    `json:"next_hop"` // the peer that the path continues to, zero if it ends at us
+	NextPort    types.SwitchPortID `json:"next_port"`
+	Root        types.Root         `json:"root"`         // the root that the node was following when it bootstrapped
+	CurrentRoot bool               `json:"current_root"` // is that the same root and sequence that we follow?
+	Coords      types.Coordinates  `json:"coords"`       // the coordinates of the node when it bootstrapped
+	Sequence    uint64             `json:"sequence"`     // the sequence number of the bootstrap
+	LastSeen    time.Time          `json:"last_seen"`
+	Expired     bool               `json:"expired"`
+}
+
+// SnakeNeighbours returns every node that we have a SNEK path for, in
+// keyspace order going downwards from our own key, so the first entry is the
+// node just below us and the last is the node just above us, wrapping around
+// the keyspace. Paths that have expired but haven't been cleaned up yet are
+// included, with Expired set.
+func (r *Router) SnakeNeighbours() []SnakeNeighbour {
+	var neighbours []SnakeNeighbour
+	phony.Block(r.state, func() {
+		root := r.state._rootAnnouncement().Root
+		neighbours = make([]SnakeNeighbour, 0, len(r.state._table))
+		for _, entry := range r.state._table {
+			n := SnakeNeighbour{
+				PublicKey:   entry.PublicKey,
+				Descending:  entry == r.state._descending,
+				Terminates:  entry.Destination == nil || entry.Destination == r.local,
+				Root:        entry.Root,
+				CurrentRoot: entry.Root.EqualTo(&root),
+				Coords:      entry.Coords.Copy(),
+				Sequence:    uint64(entry.Watermark.Sequence),
+				LastSeen:    entry.LastSeen,
+				Expired:     !entry.valid(),
+			}
+			if p := entry.Source; p != nil && p != r.local {
+				n.LearnedFrom, n.LearnedPort = p.public, p.port
+			}
+			if p := entry.Destination; p != nil && p != r.local {
+				n.NextHop, n.NextPort = p.public, p.port
+			}
+			neighbours = append(neighbours, n)
+		}
+	})
+	sort.Slice(neighbours, func(i, j int) bool {
+		di := neighbours[i].PublicKey.DistanceTo(r.public)
+		dj := neighbours[j].PublicKey.DistanceTo(r.public)
+		return di.CompareTo(dj) < 0
+	})
+	return neighbours
+}
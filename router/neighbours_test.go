@@ -0,0 +1,63 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestSnakeNeighbours(t *testing.T) {
+	routers := newBenchChain(t, 3)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	// Every node apart from the one with the lowest key has a descending
+	// node, which bootstrapped to it.
+	var lowest *Router
+	for _, r := range routers {
+		if lowest == nil || r.PublicKey().CompareTo(lowest.PublicKey()) < 0 {
+			lowest = r
+		}
+	}
+	for _, r := range routers {
+		if r == lowest {
+			continue
+		}
+		r := r
+		waitFor(t, "a descending node", func() bool {
+			return !r.SnakeStats().Descending.IsZero()
+		})
+		desc := r.SnakeStats().Descending
+		found := false
+		for _, n := range r.SnakeNeighbours() {
+			if n.PublicKey != desc {
+				continue
+			}
+			found = true
+			if !n.Descending || !n.Terminates || n.Expired || !n.CurrentRoot {
+				t.Fatalf("unexpected entry for the descending node: %+v", n)
+			}
+			if n.LearnedFrom.IsZero() || n.LearnedPort == 0 || !n.NextHop.IsZero() {
+				t.Fatalf("expected the path to be learned from a peer and end here: %+v", n)
+			}
+		}
+		if !found {
+			t.Fatal("expected the descending node in the neighbour table")
+		}
+	}
+
+	// The table is ordered going downwards through keyspace from our key.
+	for _, r := range routers {
+		var last types.PublicKey
+		for i, n := range r.SnakeNeighbours() {
+			d := n.PublicKey.DistanceTo(r.PublicKey())
+			if i > 0 && d.CompareTo(last) < 0 {
+				t.Fatal("expected the neighbours in keyspace order")
+			}
+			last = d
+		}
+	}
+}
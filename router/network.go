@@ -0,0 +1,130 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// RouterNetwork names the network that the router belongs to, so that a
+// process can run several routers on separate networks without them merging
+// into one, i.e. a home mesh and the public mesh. The name is hashed into a
+// tag that is sent in the handshake, and peerings with nodes that send a
+// different tag are refused. Routers without a network name are on the
+// default network, along with any nodes that predate network names. The tag
+// is short and isn't secret, so it only keeps networks apart by accident, not
+// on purpose. Peerings that skip the handshake with ConnectionPublicKey aren't
+// checked at all.
+type RouterNetwork string
+
+func (n RouterNetwork) isRouterOption() {}
+
+// networkTag returns the tag that is sent in the handshake for the network.
+// The default network has a tag of zero, which is what older nodes send.
+func networkTag(network string) uint16 {
+	if network == "" {
+		return 0
+	}
+	sum := sha256.Sum256([]byte(network))
+	if tag := binary.BigEndian.Uint16(sum[:2]); tag != 0 {
+		return tag
+	}
+	return 1
+}
+
+// Network returns the name of the network that the router belongs to, or an
+// empty string for the default network. See RouterNetwork.
+func (r *Router) Network() string {
+	return r.network
+}
+
+// Registry keeps track of the routers that a process is running, one per
+// network, so that an application can join several independent networks at
+// once and look up the router for each of them.
+type Registry struct {
+	mutex   sync.RWMutex
+	routers map[string]*Router // network name -> router
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		routers: map[string]*Router{},
+	}
+}
+
+// Register adds a router to the registry under its network name. It fails
+// if there is already a router for the network, or if another router in the
+// registry has the same public key, since nodes on different networks must
+// have different keys to be told apart.
+func (g *Registry) Register(r *Router) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.routers[r.network]; ok {
+		return fmt.Errorf("there is already a router for network %q", r.network)
+	}
+	for network, other := range g.routers {
+		if other.public == r.public {
+			return fmt.Errorf("network %q is already using key %s", network, r.public)
+		}
+	}
+	g.routers[r.network] = r
+	return nil
+}
+
+// Unregister removes the router for the network from the registry and
+// returns it, or nil if there wasn't one. The router isn't closed.
+func (g *Registry) Unregister(network string) *Router {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	r := g.routers[network]
+	delete(g.routers, network)
+	return r
+}
+
+// Router returns the router for the network, or nil if there isn't one.
+func (g *Registry) Router(network string) *Router {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	return g.routers[network]
+}
+
+// Networks returns the names of the networks in the registry, in order.
+func (g *Registry) Networks() []string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	networks := make([]string, 0, len(g.routers))
+	for network := range g.routers {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// Close closes every router in the registry and empties it.
+func (g *Registry) Close() error {
+	g.mutex.Lock()
+	routers := g.routers
+	g.routers = map[string]*Router{}
+	g.mutex.Unlock()
+	for _, r := range routers {
+		_ = r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// connectNetworks peers two routers over TCP, so that they go through the
+// handshake, and returns the error from the first router's side.
+func connectNetworks(t *testing.T, ra, rb *Router) error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if pb, err := l.Accept(); err == nil {
+			_, _ = rb.Connect(pb)
+		}
+	}()
+	pa, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ra.Connect(pa)
+	return err
+}
+
+func TestNetworkMismatchRefused(t *testing.T) {
+	newRouter := func(options ...RouterOption) *Router {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		return NewRouter(nil, sk, false, options...)
+	}
+	home, public := newRouter(RouterNetwork("home")), newRouter()
+	defer home.Close()
+	defer public.Close()
+	if err := connectNetworks(t, home, public); err == nil {
+		t.Fatal("expected a peering between networks to be refused")
+	}
+	if home.PeerCount(-1) != 0 {
+		t.Fatal("expected no peers")
+	}
+
+	other := newRouter(RouterNetwork("home"))
+	defer other.Close()
+	if err := connectNetworks(t, home, other); err != nil {
+		t.Fatalf("expected a peering on the same network, got %s", err)
+	}
+	waitFor(t, "peering", func() bool {
+		return home.PeerCount(-1) == 1 && other.PeerCount(-1) == 1
+	})
+}
+
+func TestNetworkTag(t *testing.T) {
+	if tag := networkTag(""); tag != 0 {
+		t.Fatalf("expected the default network to have tag 0, got %d", tag)
+	}
+	if networkTag("home") == 0 || networkTag("home") == networkTag("public") {
+		t.Fatal("expected distinct non-zero tags for named networks")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	home := NewRouter(nil, ska, false, RouterNetwork("home"))
+	public := NewRouter(nil, skb, false)
+	again := NewRouter(nil, ska, false, RouterNetwork("again"))
+	defer home.Close()
+	defer again.Close()
+
+	registry := NewRegistry()
+	defer registry.Close()
+	if err := registry.Register(home); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(public); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(public); err == nil {
+		t.Fatal("expected a second router for the same network to be refused")
+	}
+	if err := registry.Register(again); err == nil {
+		t.Fatal("expected a router with a key that is already in use to be refused")
+	}
+	if networks := registry.Networks(); !reflect.DeepEqual(networks, []string{"", "home"}) {
+		t.Fatalf("unexpected networks %q", networks)
+	}
+	if registry.Router("home") != home || registry.Router("nowhere") != nil {
+		t.Fatal("looked up the wrong router")
+	}
+	if registry.Unregister("home") != home || registry.Router("home") != nil {
+		t.Fatal("expected the router to be unregistered")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// RouterObserver puts the router into observer mode when set to true. An
+// observer connects to peers and follows the spanning tree using the tree
+// announcements that it receives, but never sends tree announcements of its
+// own, never bootstraps and never originates, forwards or accepts traffic.
+// Since peers never hear announcements from an observer, they will never
+// select it as a parent or as a next-hop, so it has no effect on the rest of
+// the network. This makes it useful as a monitoring canary, using TreeStats
+// to report what it sees.
+type RouterObserver bool
+
+func (o RouterObserver) isRouterOption() {}
+
+// TreeStats contains information about the spanning tree as seen by this
+// node, including how much churn there has been since the router started.
+type TreeStats struct {
+	Root          types.PublicKey   `json:"root"`
+	RootSequence  uint64            `json:"root_sequence"`
+	Coords        types.Coordinates `json:"coords"`
+	Depth         int               `json:"depth"`
+	Parent        types.PublicKey   `json:"parent"`
+	LastUpdate    time.Time         `json:"last_update"`
+	ParentChanges uint64            `json:"parent_changes"`
+	RootChanges   uint64            `json:"root_changes"`
+	Suppressed    uint64            `json:"suppressed_announcements"` // duplicates ignored, see RouterAnnouncementSuppression
+}
+
+// TreeStats returns the current root, our position in the tree and counts
+// of how many times the parent and root have changed.
+func (r *Router) TreeStats() TreeStats {
+	var stats TreeStats
+	phony.Block(r.state, func() {
+		ann := r.state._rootAnnouncement()
+		coords := r.state._coords()
+		stats = TreeStats{
+			Root:          ann.RootPublicKey,
+			RootSequence:  uint64(ann.RootSequence),
+			Coords:        coords,
+			Depth:         len(coords),
+			LastUpdate:    ann.receiveTime,
+			ParentChanges: r.state._parentChanges,
+			RootChanges:   r.state._rootChanges,
+			Suppressed:    r.state._annSuppressed,
+		}
+		if parent := r.state._parent; parent != nil {
+			stats.Parent = parent.public
+		}
+	})
+	return stats
+}
+
+// IsObserver returns true if the router is running in observer mode.
+func (r *Router) IsObserver() bool {
+	return r.observer
+}
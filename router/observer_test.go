@@ -0,0 +1,50 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestObserverFollowsTree(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	_, sk, _ := ed25519.GenerateKey(nil)
+	observer := NewRouter(nil, sk, false, RouterObserver(true))
+	defer func() {
+		for _, r := range append(routers, observer) {
+			_ = r.Close()
+		}
+	}()
+
+	connectPair(t, routers[1], observer)
+
+	// The observer should agree with the rest of the network on the root.
+	root := routers[1].TreeStats().Root
+	deadline := time.Now().Add(time.Second * 5)
+	for observer.TreeStats().Root != root {
+		if time.Now().After(deadline) {
+			t.Fatal("observer did not learn the root in time")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if stats := observer.TreeStats(); stats.Parent != routers[1].PublicKey() {
+		t.Fatalf("expected observer parent to be %s but got %s", routers[1].PublicKey(), stats.Parent)
+	}
+
+	// The peer should never have heard an announcement from the observer,
+	// so it can never be used as a parent or as a next-hop.
+	phony.Block(routers[1].state, func() {
+		for p, ann := range routers[1].state._announcements {
+			if p.public == observer.PublicKey() && ann != nil {
+				t.Fatal("observer sent a tree announcement")
+			}
+		}
+	})
+
+	if _, err := observer.WriteTo([]byte("hello"), types.Coordinates{}); err == nil {
+		t.Fatal("expected observer to refuse to send traffic")
+	}
+}
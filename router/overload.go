@@ -0,0 +1,134 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// stateInboxLimit is how many frames from peers can be waiting for the state
+// actor before it is considered to be saturated. Most frames are already
+// limited by each peer reader waiting for the state actor to catch up, but
+// with many busy peers the backlog can still grow.
+const stateInboxLimit = 512
+
+// stateSaturationDelay is how long a frame can wait for the state actor
+// before it is considered to be saturated, i.e. because it is spending all of
+// its time verifying signatures on a flood of protocol frames.
+const stateSaturationDelay = time.Millisecond * 250
+
+// overload tracks how backed up the state actor is with frames from peers.
+// While the state actor is saturated, low priority protocol frames are shed
+// by the peer readers instead of being queued, so that a flood of protocol
+// frames can't hold up the forwarding of traffic behind it. It stops being
+// saturated once both the backlog and the wait are down to half of their
+// limits. It is safe to use from any actor.
+type overload struct {
+	pending     atomic.Int64    // frames queued for the state actor but not handled yet
+	peak        atomic.Int64    // the most frames that have been waiting at once
+	delay       atomic.Duration // how long the last frame waited for the state actor
+	saturated   atomic.Bool     // true while frames are being shed
+	saturations atomic.Uint64   // how many times the state actor has become saturated
+	shed        atomic.Uint64   // frames that were dropped while saturated
+	coalesced   atomic.Uint64   // tree announcements replaced by a newer one before being handled
+}
+
+// StateLoad describes how backed up the state actor is, which is useful for
+// spotting protocol floods.
+type StateLoad struct {
+	Pending     int64         `json:"pending"`     // frames waiting for the state actor
+	Peak        int64         `json:"peak"`        // the most frames that have been waiting at once
+	Delay       time.Duration `json:"delay_ns"`    // how long the last frame waited for the state actor
+	Saturated   bool          `json:"saturated"`   // low priority frames are currently being shed
+	Saturations uint64        `json:"saturations"` // how many times the state actor has become saturated
+	Shed        uint64        `json:"shed"`        // low priority frames that were dropped while saturated
+	Coalesced   uint64        `json:"coalesced"`   // tree announcements that were superseded before being handled
+}
+
+// StateLoad returns how backed up the state actor is. A saturation count
+// that keeps going up is a sign that peers are flooding us with protocol
+// frames.
+func (r *Router) StateLoad() StateLoad {
+	return StateLoad{
+		Pending:     r.overload.pending.Load(),
+		Peak:        r.overload.peak.Load(),
+		Delay:       r.overload.delay.Load(),
+		Saturated:   r.overload.saturated.Load(),
+		Saturations: r.overload.saturations.Load(),
+		Shed:        r.overload.shed.Load(),
+		Coalesced:   r.overload.coalesced.Load(),
+	}
+}
+
+// lowPriority returns true for frames that can be shed when the state actor
+// is saturated. Keepalives do nothing once they arrive, bootstraps are sent
+// again every few seconds and peer exchange and keyspace searches can wait,
+// whereas traffic has to keep flowing and tree announcements are coalesced
+// instead.
+func lowPriority(f *types.Frame) bool {
+	switch f.Type {
+	case types.TypeKeepalive, types.TypeVirtualSnakeBootstrap, types.TypePeerExchange:
+		return true
+	case types.TypeVirtualSnakeRouted:
+		return f.Extra[0]&types.FrameFlagKeyspaceQuery != 0
+	default:
+		return false
+	}
+}
+
+// admit is called by a peer reader before it queues a frame for the state
+// actor. It returns false if the frame should be shed instead.
+func (o *overload) admit(r *Router, p *peer, f *types.Frame) bool {
+	if o.pending.Load() >= stateInboxLimit {
+		o.saturate(r)
+	}
+	if o.saturated.Load() && lowPriority(f) {
+		o.shed.Inc()
+		r.conformance.drop(DropOverloaded, p.public, f)
+		return false
+	}
+	pending := o.pending.Inc()
+	for {
+		if peak := o.peak.Load(); pending <= peak || o.peak.CAS(peak, pending) {
+			return true
+		}
+	}
+}
+
+// done is called by the state actor when it picks up a frame that was
+// admitted at the given time.
+func (o *overload) done(r *Router, admitted time.Time) {
+	pending := o.pending.Dec()
+	delay := time.Since(admitted)
+	o.delay.Store(delay)
+	switch {
+	case delay >= stateSaturationDelay:
+		o.saturate(r)
+	case pending <= stateInboxLimit/2 && delay < stateSaturationDelay/2:
+		if o.saturated.CAS(true, false) {
+			r.log.Println("State actor is no longer saturated")
+		}
+	}
+}
+
+func (o *overload) saturate(r *Router) {
+	if o.saturated.CAS(false, true) {
+		o.saturations.Inc()
+		r.log.Println("State actor is saturated, shedding low priority frames")
+	}
+}
@@ -0,0 +1,129 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestStateOverloadSheds(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterStrictConformance{})
+	defer r.Close()
+
+	frame := func(frameType types.FrameType, flags byte) *types.Frame {
+		f := getFrame()
+		f.Type = frameType
+		f.Extra[0] = flags
+		return f
+	}
+	bootstrap := frame(types.TypeVirtualSnakeBootstrap, 0)
+	search := frame(types.TypeVirtualSnakeRouted, types.FrameFlagKeyspaceQuery)
+	traffic := frame(types.TypeVirtualSnakeRouted, 0)
+	announcement := frame(types.TypeTreeAnnouncement, 0)
+
+	o := &r.overload
+	if !o.admit(r, r.local, bootstrap) {
+		t.Fatal("expected bootstrap to be admitted while not saturated")
+	}
+	o.done(r, time.Now())
+
+	o.pending.Store(stateInboxLimit)
+	for _, f := range []*types.Frame{bootstrap, search} {
+		if o.admit(r, r.local, f) {
+			t.Fatalf("expected %s to be shed while saturated", f.Type)
+		}
+	}
+	for _, f := range []*types.Frame{traffic, announcement} {
+		if !o.admit(r, r.local, f) {
+			t.Fatalf("expected %s to be admitted while saturated", f.Type)
+		}
+	}
+	load := r.StateLoad()
+	switch {
+	case !load.Saturated:
+		t.Fatal("expected state actor to be saturated")
+	case load.Saturations != 1:
+		t.Fatalf("expected 1 saturation, got %d", load.Saturations)
+	case load.Shed != 2:
+		t.Fatalf("expected 2 frames to be shed, got %d", load.Shed)
+	case load.Peak != stateInboxLimit+2:
+		t.Fatalf("expected peak of %d, got %d", stateInboxLimit+2, load.Peak)
+	}
+	if drops := r.DropCounts()[DropOverloaded]; drops != 2 {
+		t.Fatalf("expected 2 overloaded drops, got %d", drops)
+	}
+
+	// The state actor stays saturated until the backlog is down to half of
+	// the limit.
+	o.pending.Store(stateInboxLimit/2 + 2)
+	o.done(r, time.Now())
+	if !r.StateLoad().Saturated {
+		t.Fatal("expected state actor to still be saturated")
+	}
+	o.done(r, time.Now())
+	if r.StateLoad().Saturated {
+		t.Fatal("expected state actor to no longer be saturated")
+	}
+	if !o.admit(r, r.local, bootstrap) {
+		t.Fatal("expected bootstrap to be admitted once no longer saturated")
+	}
+
+	// A frame that waited too long for the state actor also saturates it,
+	// even if the backlog is short.
+	o.done(r, time.Now().Add(-stateSaturationDelay))
+	if load := r.StateLoad(); !load.Saturated || load.Saturations != 2 {
+		t.Fatalf("expected state actor to be saturated again, got %+v", load)
+	}
+	if o.admit(r, r.local, bootstrap) {
+		t.Fatal("expected bootstrap to be shed while saturated")
+	}
+}
+
+func TestStateOverloadCoalescesAnnouncements(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	r, sender := routers[0], routers[1]
+
+	// Hold up the state actor so that the announcements back up behind it.
+	release := make(chan struct{})
+	r.state.Act(nil, func() {
+		<-release
+	})
+	phony.Block(sender.state, func() {
+		for i := 0; i < 3; i++ {
+			sender.state._sendTreeAnnouncements()
+		}
+	})
+	deadline := time.Now().Add(time.Second * 5)
+	for r.StateLoad().Coalesced < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	close(release)
+	if coalesced := r.StateLoad().Coalesced; coalesced < 2 {
+		t.Fatalf("expected at least 2 announcements to be coalesced, got %d", coalesced)
+	}
+
+	// The newest announcement should still have been handled.
+	var ok bool
+	phony.Block(r.state, func() {
+		for p, ann := range r.state._announcements {
+			if p.public == sender.PublicKey() && ann != nil {
+				ok = true
+			}
+		}
+	})
+	if !ok {
+		t.Fatal("expected an announcement from the sender")
+	}
+	if pending := r.StateLoad().Pending; pending != 0 {
+		t.Fatalf("expected nothing pending, got %d", pending)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// Adaptive pacing backs off multiplicatively when writes take longer than
+// their share of the pacing rate and recovers additively otherwise.
+const (
+	pacingDecrease = 0.75 // multiply the rate by this when the link falls behind
+	pacingIncrease = 32   // recover by 1/n of the configured rate per write
+	pacingMinimum  = 16   // never go below 1/n of the configured rate
+)
+
+// ConnectionPacing limits how quickly frames are written to the peering, in
+// bytes per second, so that a burst of frames destined to a slow shared link
+// such as Bluetooth or LoRa is spread out rather than piling up in buffers
+// below the router. Frames wait in the peer queues instead, where the queue
+// disciplines can drop or prioritise them. If Adaptive is set then the rate
+// is lowered whenever writes to the connection take longer than the rate
+// allows, which means that the link is slower than configured, and raised
+// back towards the configured rate once writes are keeping up again.
+type ConnectionPacing struct {
+	Rate     uint64 // bytes per second, 0 for no pacing
+	Adaptive bool   // adjust the rate from the observed write latency
+}
+
+func (c ConnectionPacing) isConnectionOption() {}
+
+// pacer enforces the pacing rate for a single peer.
+type pacer struct {
+	max      float64       // Not mutated after peer setup.
+	adaptive bool          // Not mutated after peer setup.
+	current  atomic.Uint64 // Thread-safe current rate, for reporting.
+	_rate    float64       // Current rate, only accessed by the writer actor.
+	_next    time.Time     // When can the next write start?
+}
+
+func newPacer(pacing ConnectionPacing) *pacer {
+	if pacing.Rate == 0 {
+		return nil
+	}
+	p := &pacer{
+		max:      float64(pacing.Rate),
+		adaptive: pacing.Adaptive,
+		_rate:    float64(pacing.Rate),
+	}
+	p.current.Store(pacing.Rate)
+	return p
+}
+
+// rate returns the current pacing rate in bytes per second, or 0 if there is
+// no pacing. It is safe to call from any actor.
+func (p *pacer) rate() uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.current.Load()
+}
+
+// _wait blocks until the next write is allowed to start. It returns false
+// if the context was cancelled while waiting. This function must be called
+// from the peer's writer actor only.
+func (p *pacer) _wait(ctx context.Context) bool {
+	if p == nil {
+		return true
+	}
+	delay := time.Until(p._next)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// _wrote schedules the next write after a write of n bytes that started at
+// the given time. This function must be called from the peer's writer actor
+// only.
+func (p *pacer) _wrote(n int, start time.Time) {
+	if p == nil {
+		return
+	}
+	took := time.Since(start)
+	slot := time.Duration(float64(n) / p._rate * float64(time.Second))
+	if p.adaptive {
+		switch {
+		case took > slot:
+			p._rate *= pacingDecrease
+			if min := p.max / pacingMinimum; p._rate < min {
+				p._rate = min
+			}
+		case p._rate < p.max:
+			p._rate += p.max / pacingIncrease
+			if p._rate > p.max {
+				p._rate = p.max
+			}
+		}
+		p.current.Store(uint64(p._rate))
+	}
+	if p._next.Before(start) {
+		// The link has been idle, so don't let it build up credit to
+		// burst with later.
+		p._next = start
+	}
+	p._next = p._next.Add(slot)
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPacerSpacesWrites(t *testing.T) {
+	p := newPacer(ConnectionPacing{Rate: 1000})
+	p._wrote(100, time.Now())
+
+	// 100 bytes at 1000 bytes per second should hold up the next write for
+	// around 100ms.
+	start := time.Now()
+	if !p._wait(context.Background()) {
+		t.Fatal("expected wait to succeed")
+	}
+	if waited := time.Since(start); waited < time.Millisecond*80 {
+		t.Fatalf("expected to wait around 100ms but waited %s", waited)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p._wrote(100, time.Now())
+	if p._wait(ctx) {
+		t.Fatal("expected wait to be cancelled")
+	}
+}
+
+func TestPacerAdapts(t *testing.T) {
+	p := newPacer(ConnectionPacing{Rate: 1000, Adaptive: true})
+
+	// A write of 100 bytes that took 200ms means that the link is slower
+	// than the pacing rate.
+	p._wrote(100, time.Now().Add(-time.Millisecond*200))
+	if rate := p.rate(); rate >= 1000 {
+		t.Fatalf("expected rate to drop after a slow write but got %d", rate)
+	}
+	slow := p.rate()
+
+	// Writes that keep up should bring the rate back up.
+	p._next = time.Time{}
+	p._wrote(1, time.Now())
+	if rate := p.rate(); rate <= slow {
+		t.Fatalf("expected rate to recover after a fast write but got %d", rate)
+	}
+
+	if rate := newPacer(ConnectionPacing{}).rate(); rate != 0 {
+		t.Fatalf("expected no pacing but got %d", rate)
+	}
+}
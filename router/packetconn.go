@@ -15,6 +15,7 @@
 package router
 
 import (
+	"fmt"
 	"net"
 	"time"
 
@@ -26,6 +27,10 @@ import (
 // newLocalPeer returns a new local peer. It should only be called once when
 // the router is set up.
 func (r *Router) newLocalPeer() *peer {
+	queues, depth := uint16(trafficBuffer), fairFIFOQueueSize
+	if r.embedded {
+		queues, depth = embeddedTrafficQueues, embeddedQueueDepth
+	}
 	peer := &peer{
 		router:   r,
 		port:     0,
@@ -36,7 +41,7 @@ func (r *Router) newLocalPeer() *peer {
 		peertype: 0,
 		public:   r.public,
 		started:  *atomic.NewBool(true),
-		traffic:  newFairFIFOQueue(trafficBuffer, r.log),
+		traffic:  newFairFIFOQueue(queues, depth, r.log),
 	}
 	return peer
 }
@@ -59,6 +64,13 @@ func (r *Router) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 		// A protocol packet is ready to send.
 		r.local.traffic.ack()
 	}
+	if frame == nil {
+		return
+	}
+	// The frame came from the frame pool, so once we've copied out the
+	// payload it goes back, otherwise every delivered frame would cost a
+	// new allocation.
+	defer putFrame(frame)
 
 	switch frame.Type {
 	case types.TypeTreeRouted:
@@ -80,51 +92,153 @@ func (r *Router) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 // as a traffic packet. The supplied net.Addr will dictate the method used to
 // route the packet — the address should be a `types.PublicKey` for SNEK routing
 // or `types.Coordinates` for tree routing. Supplying an unsupported address type
-// will result in a `*net.AddrError` being returned.
+// will result in a `*net.AddrError` being returned, and ErrQueueFull is returned
+// if the packet was dropped because there was no room to queue it. WriteTo
+// never waits for room in the queue, so see Send for a variant that does.
 func (r *Router) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	timer := time.NewTimer(time.Second * 5)
-	defer func() {
-		if !timer.Stop() {
-			<-timer.C
+	frame, loopback, err := r.localFrame(p, addr)
+	if err != nil {
+		return 0, err
+	}
+	if loopback {
+		if err = r.loopback(frame); err != nil {
+			return 0, err
 		}
-	}()
+		return len(p), nil
+	}
+	phony.Block(r.state, func() {
+		err = r.state._forward(r.local, frame)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// NewFrame returns an empty frame from the router's frame pool, with room for
+// a payload of up to types.MaxPayloadSize bytes, or less with the embedded
+// profile, see RouterEmbedded. Write the payload straight into it, i.e. with
+// f.Payload = append(f.Payload[:0], ...) or by reading into
+// f.Payload[:cap(f.Payload)], and then send it with WriteFrameTo, so that the
+// payload isn't copied again as it would be by WriteTo. Don't replace the
+// payload with a slice of your own, since the frame goes back into the pool
+// once it has been sent.
+func (r *Router) NewFrame() *types.Frame {
+	return r.getFrame()
+}
+
+// WriteFrameTo sends the payload of a frame from NewFrame into the Pinecone
+// network, in the same way as WriteTo. Only the payload is used, and the rest
+// of the frame is filled in by the router. The router takes ownership of the
+// frame whether or not an error is returned, so it must not be used again
+// afterwards. Payloads longer than the limit are rejected, as are frames
+// whose payload no longer has the capacity that NewFrame gave it, i.e.
+// because it was grown or replaced with a slice of the caller's own.
+func (r *Router) WriteFrameTo(frame *types.Frame, addr net.Addr) (n int, err error) {
+	n, max := len(frame.Payload), r.maxPayloadSize()
+	if n > max {
+		putFrame(frame)
+		return 0, fmt.Errorf("payload of %d bytes is longer than the limit of %d bytes", n, max)
+	}
+	if c := cap(frame.Payload); c != max {
+		putFrame(frame)
+		return 0, fmt.Errorf("payload has a capacity of %d bytes rather than the %d bytes from NewFrame", c, max)
+	}
+	loopback, err := r.addressFrame(frame, addr)
+	if err != nil {
+		putFrame(frame)
+		return 0, err
+	}
+	if loopback {
+		if err = r.loopback(frame); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	phony.Block(r.state, func() {
+		err = r.state._forward(r.local, frame)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// localFrame builds a traffic frame for a packet that we are sending to the
+// given address, and reports whether the address is our own, in which case
+// the frame should be looped back rather than forwarded.
+func (r *Router) localFrame(p []byte, addr net.Addr) (*types.Frame, bool, error) {
+	if max := r.maxPayloadSize(); len(p) > max {
+		return nil, false, fmt.Errorf("payload of %d bytes is longer than the limit of %d bytes", len(p), max)
+	}
+	frame := r.getFrame()
+	frame.Payload = append(frame.Payload[:0], p...)
+	loopback, err := r.addressFrame(frame, addr)
+	if err != nil {
+		putFrame(frame)
+		return nil, false, err
+	}
+	return frame, loopback, nil
+}
+
+// addressFrame turns a frame with a payload into a traffic frame from us to
+// the given address, replacing everything but the payload, and reports
+// whether the address is our own.
+func (r *Router) addressFrame(frame *types.Frame, addr net.Addr) (bool, error) {
+	if r.observer {
+		return false, fmt.Errorf("router is running in observer mode")
+	}
+	payload := frame.Payload
+	frame.Reset()
+	frame.Payload = payload
 
 	switch ga := addr.(type) {
 	case types.Coordinates:
-		frame := getFrame()
+		if !r.routing.tree() {
+			return false, fmt.Errorf("tree routing is disabled")
+		}
 		frame.Type = types.TypeTreeRouted
 		frame.Destination = ga
 		frame.Source = r.state.coords()
-		frame.Payload = append(frame.Payload[:0], p...)
-		phony.Block(r.state, func() {
-			_ = r.state._forward(r.local, frame)
-		})
-		return len(p), nil
+		r.classify(frame, addr)
+		return ga.EqualTo(frame.Source), nil
 
 	case types.PublicKey:
-		frame := getFrame()
+		if !r.routing.snake() {
+			return false, fmt.Errorf("SNEK routing is disabled")
+		}
 		frame.Type = types.TypeVirtualSnakeRouted
 		frame.DestinationKey = ga
 		frame.SourceKey = r.public
-		frame.Payload = append(frame.Payload[:0], p...)
 		frame.Watermark = types.VirtualSnakeWatermark{
 			PublicKey: types.FullMask,
 			Sequence:  0,
 		}
-		phony.Block(r.state, func() {
-			_ = r.state._forward(r.local, frame)
-		})
-		return len(p), nil
+		r.classify(frame, addr)
+		return r.answersTo(ga), nil
 
 	default:
-		err = &net.AddrError{
+		return false, &net.AddrError{
 			Err:  "unexpected address type",
 			Addr: addr.String(),
 		}
-		return
 	}
 }
 
+// loopback delivers a frame that we sent to ourselves straight to our own
+// read queue, without waiting for the state actor. Since the frame never
+// leaves the node, it isn't passed through the packet filter or any frame
+// middleware, although the inspector still sees it in both directions.
+func (r *Router) loopback(frame *types.Frame) error {
+	r.loopbacks.Inc()
+	r.inspector.inspect(DirectionOutbound, frame)
+	if !r.local.send(frame) {
+		r.conformance.drop(DropQueueFull, r.public, frame)
+		return ErrQueueFull
+	}
+	return nil
+}
+
 // LocalAddr returns a net.Addr containing the public key of the node for
 // SNEK routing.
 func (r *Router) LocalAddr() net.Addr {
@@ -0,0 +1,70 @@
+package router
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestWriteFrameTo(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	src, dst := routers[0], routers[1]
+
+	payload := bytes.Repeat([]byte("x"), 4096)
+	buf := make([]byte, types.MaxPayloadSize)
+	for _, addr := range []net.Addr{dst.PublicKey(), dst.Coords(), src.PublicKey()} {
+		frame := src.NewFrame()
+		if cap(frame.Payload) < types.MaxPayloadSize {
+			t.Fatalf("expected room for a full payload, got %d bytes", cap(frame.Payload))
+		}
+		// Anything left in the frame other than the payload is replaced.
+		frame.Type = types.TypeKeepalive
+		frame.Payload = append(frame.Payload[:0], payload...)
+		if n, err := src.WriteFrameTo(frame, addr); err != nil {
+			t.Fatal(err)
+		} else if n != len(payload) {
+			t.Fatalf("expected %d bytes written, got %d", len(payload), n)
+		}
+
+		to := dst
+		if addr == src.PublicKey() {
+			to = src
+		}
+		_ = to.SetReadDeadline(time.Now().Add(time.Second * 5))
+		n, from, err := to.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if from == nil {
+			t.Fatalf("frame sent to %s was not delivered", addr)
+		}
+		if !bytes.Equal(buf[:n], payload) {
+			t.Fatalf("payload sent to %s was not delivered intact", addr)
+		}
+	}
+
+	if _, err := src.WriteFrameTo(src.NewFrame(), &net.TCPAddr{}); err == nil {
+		t.Fatal("expected an error for an unsupported address")
+	}
+
+	// Payloads that have grown past the limit, or been replaced with a
+	// slice that didn't come from NewFrame, are refused.
+	frame := src.NewFrame()
+	frame.Payload = append(frame.Payload[:0], make([]byte, types.MaxPayloadSize+1)...)
+	if _, err := src.WriteFrameTo(frame, dst.PublicKey()); err == nil {
+		t.Fatal("expected an error for an oversized payload")
+	}
+	frame = src.NewFrame()
+	frame.Payload = []byte("foreign")
+	if _, err := src.WriteFrameTo(frame, dst.PublicKey()); err == nil {
+		t.Fatal("expected an error for a payload that wasn't from NewFrame")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "time"
+
+// parentCostMargin is how much cheaper, in hops, another candidate has to be
+// before we will leave a parent that we have already chosen for it, so that
+// small changes in round trip time don't make us switch back and forth.
+const parentCostMargin = 0.5
+
+// RouterLatencyAwareParents enables an experimental parent selection strategy
+// that weighs the depth that each candidate parent announces in the tree
+// against the round trip time to reach it. Normally, a node picks whichever
+// peer brought it the root announcement first, which keeps the tree shallow
+// but can give us a parent on another continent while a peer next door is
+// only one hop deeper. With this option, candidates that follow the same
+// root are given a cost of their depth plus their round trip time divided by
+// the given duration, and the cheapest one is preferred, so the duration
+// sets how much round trip time one extra hop is worth. The round trip time
+// comes from the connection if it implements TransportStats, or otherwise
+// from the handshake. Candidates whose round trip time isn't known are
+// compared in the usual way. It is off by default.
+type RouterLatencyAwareParents time.Duration
+
+func (l RouterLatencyAwareParents) isRouterOption() {}
+
+// rtt returns the best known round trip time to the peer, or 0 if it isn't
+// known.
+func (p *peer) rtt() time.Duration {
+	if stats := p.linkStats(); stats != nil && stats.RTT > 0 {
+		return stats.RTT
+	}
+	if p.score != nil {
+		return p.score.rtt
+	}
+	return 0
+}
+
+// _parentCost returns the cost of choosing the peer as our parent according
+// to RouterLatencyAwareParents, in hops, or false if latency-aware parent
+// selection is off or the round trip time to the peer isn't known. Our
+// current parent gets a discount of parentCostMargin.
+func (s *state) _parentCost(p *peer, ann *rootAnnouncementWithTime) (float64, bool) {
+	hop := s.r.parentHopCost
+	rtt := p.rtt()
+	if hop <= 0 || rtt <= 0 || ann == nil {
+		return 0, false
+	}
+	cost := float64(len(ann.Signatures)) + float64(rtt)/float64(hop)
+	if p == s._parent {
+		cost -= parentCostMargin
+	}
+	return cost, true
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+// rttConn is a connection that reports a fixed round trip time.
+type rttConn struct {
+	net.Conn
+	rtt time.Duration
+}
+
+func (c rttConn) TransportStats() LinkStats {
+	return LinkStats{RTT: c.rtt}
+}
+
+func TestLatencyAwareParents(t *testing.T) {
+	// The root is peered directly with the node, but over a slow link, and
+	// the relay is one hop deeper but much closer.
+	keys := make([]ed25519.PrivateKey, 3)
+	for i := range keys {
+		_, keys[i], _ = ed25519.GenerateKey(nil)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return string(keys[i].Public().(ed25519.PublicKey)) > string(keys[j].Public().(ed25519.PublicKey))
+	})
+	root := NewRouter(nil, keys[0], false)
+	relay := NewRouter(nil, keys[1], false)
+	node := NewRouter(nil, keys[2], false, RouterLatencyAwareParents(time.Millisecond*20))
+	defer func() {
+		for _, r := range []*Router{root, relay, node} {
+			_ = r.Close()
+		}
+	}()
+	connect := func(ra, rb *Router, rtt time.Duration) {
+		pa, pb := net.Pipe()
+		connectEnds(t, pairEnd{ra, pa, nil}, pairEnd{rb, rttConn{pb, rtt}, nil})
+	}
+	connect(root, relay, time.Millisecond)
+	connect(root, node, time.Millisecond*200)
+	connect(relay, node, time.Millisecond)
+
+	// Through the root, the cost is 1 hop plus 10 hops worth of round trip
+	// time, whereas through the relay it is only just over 2 hops.
+	waitFor(t, "the node to choose the relay as its parent", func() bool {
+		return node.TreeInfo().Root == root.PublicKey() && len(node.Coords()) == 2
+	})
+}
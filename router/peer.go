@@ -15,14 +15,12 @@
 package router
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"io/ioutil"
 	"time"
 
 	"github.com/Arceliar/phony"
@@ -33,9 +31,14 @@ import (
 // NOTE: Functions prefixed with an underscore (_) are only safe to be called
 // from the actor that owns them, in order to prevent data races.
 
+// The default keepalive timers, see RouterTimers.
 const peerKeepaliveInterval = time.Second * 3
 const peerKeepaliveTimeout = time.Second * 5
 
+// peerWriteBatchSize is how many bytes of frames the writer will try to put
+// into a single write when several frames are queued up for a peer.
+const peerWriteBatchSize = 64 * 1024
+
 // Lower numbers for these consts are typically faster connections.
 const ( // These need to be a simple int type for gobind/gomobile to export them...
 	PeerTypeMulticast int = iota
@@ -53,9 +56,10 @@ type peer struct {
 	writer         phony.Inbox
 	router         *Router
 	port           types.SwitchPortID // Not mutated after peer setup.
+	generation     uint64             // Not mutated after peer setup, see DisconnectGeneration.
 	context        context.Context    // Not mutated after peer setup.
 	cancel         context.CancelFunc // Not mutated after peer setup.
-	conn           net.Conn           // Not mutated after peer setup.
+	conn           *peerConn          // Not mutated after peer setup, but can be migrated, see ConnectionMigrate.
 	uri            ConnectionURI      // Not mutated after peer setup.
 	zone           ConnectionZone     // Not mutated after peer setup.
 	peertype       ConnectionPeerType // Not mutated after peer setup.
@@ -64,10 +68,33 @@ type peer struct {
 	started        atomic.Bool        // Thread-safe toggle for marking a peer as down.
 	proto          queue              // Thread-safe queue for outbound protocol messages.
 	traffic        queue              // Thread-safe queue for outbound traffic messages.
+	mirror         atomic.Value       // Thread-safe *portMirror, if the port is being mirrored.
+	_batch         []byte             // Write buffer for several frames, never longer than the batch limit, only accessed by the writer actor.
+	_held          *types.Frame       // Frame that didn't fit in the last write, only accessed by the writer actor.
+	_keepalive     *time.Timer        // Reused for every keepalive wait, only accessed by the writer actor.
+	_flush         *time.Timer        // Reused for every batch that is held open, only accessed by the writer actor.
+	flush          flushPolicy        // Not mutated after peer setup, see ConnectionFlushPolicy.
+	quota          *ConnectionQuota   // Not mutated after peer setup.
+	pacer          *pacer             // Not mutated after peer setup, nil if not paced.
+	suspension     *suspension        // Not mutated after peer setup, nil if the peering can't be suspended.
+	datagrams      bool               // Not mutated after peer setup, true if each read or write is one frame.
+	mtu            int                // Not mutated after peer setup, 0 if the link has no MTU, see ConnectionMTU.
+	version        types.FrameVersion // Not mutated after peer setup.
+	score          *peerScore         // Not mutated after peer setup, nil for the local router.
+	deprioritised  atomic.Bool        // Thread-safe toggle for when the peer is over quota.
+	announcement   atomic.Value       // Thread-safe *types.Frame, the newest tree announcement waiting for the state actor.
+	watchdog       watchdog           // Thread-safe progress counters, see RouterPeerWatchdog.
+	rates          *frameRates        // Thread-safe inbound frame rates, nil for the local router.
+	goroutines     atomic.Int32       // Thread-safe count of goroutines running the reader and writer.
+	_usage         BandwidthUsage     // Cumulative usage, only accessed by the state actor.
+	_leaf          bool               // Is the peer a leaf? See PeerRole. Only accessed by the state actor.
+	_disabled      bool               // Is the port drained? See SetPortEnabled. Only accessed by the state actor.
+	_direction     LinkDirection      // Which way traffic flows, see ConnectionLinkDirection. Only accessed by the state actor.
 	bytesRxProto   atomic.Uint64
 	bytesRxTraffic atomic.Uint64
 	bytesTxProto   atomic.Uint64
 	bytesTxTraffic atomic.Uint64
+	_metadata      *types.NodeMetadata // Sent by the peer in the handshake, if any. Only accessed by the state actor.
 }
 
 func (p *peer) MarshalJSON() ([]byte, error) {
@@ -90,22 +117,18 @@ func (p *peer) String() string { // to make sim less ugly
 	return fmt.Sprintf("%d", p.port)
 }
 
-func (p *peer) ClearBandwidthCounters() {
-	p.bytesRxProto.Store(0)
-	p.bytesRxTraffic.Store(0)
-	p.bytesTxProto.Store(0)
-	p.bytesTxTraffic.Store(0)
-}
-
 // send queues a frame to be sent to this peer. It is safe to be called from
 // other actors. The frame will be allocated to the correct queue automatically
 // depending on whether it is a protocol frame or a traffic frame. This function
 // will return true if the message was correctly queued or false if it was dropped,
 // i.e. due to the queue overflowing.
 func (p *peer) send(f *types.Frame) bool {
+	if p == p.router.local {
+		p.router.inspector.inspect(DirectionInbound, f)
+	}
 	switch f.Type {
 	// Protocol messages
-	case types.TypeTreeAnnouncement, types.TypeKeepalive:
+	case types.TypeTreeAnnouncement, types.TypeKeepalive, types.TypePeerExchange:
 		fallthrough
 	case types.TypeVirtualSnakeBootstrap:
 		if p.proto == nil {
@@ -117,12 +140,26 @@ func (p *peer) send(f *types.Frame) bool {
 
 	// Traffic messages
 	case types.TypeVirtualSnakeRouted, types.TypeTreeRouted:
+		if p == p.router.local && p.router.deliverService(f) {
+			return true
+		}
+		if p.score != nil {
+			p.score.sent.Inc()
+		}
 		return p.traffic.push(f)
 	}
 
 	return false
 }
 
+// sendProto queues a protocol frame that this node generated itself, rather
+// than one that it is forwarding, to be sent to this peer, passing it to the
+// inspector first. It is safe to be called from other actors.
+func (p *peer) sendProto(f *types.Frame) bool {
+	p.router.inspector.inspect(DirectionOutbound, f)
+	return p.proto.push(f)
+}
+
 // stop will immediately mark a port as offline, before dispatching a task to
 // the state actor to clean up the peering. Once the peering has been stopped,
 // it will immediately be marked as unsuitable in next-hop or parent selection
@@ -145,21 +182,38 @@ func (p *peer) stop(err error) {
 	// Decrease the connection count for this peer in this zone. The multicast
 	// code uses this to determine whether we are already connected to a peer in
 	// a given zone and to ignore beacons from them if we are.
-	index := hex.EncodeToString(p.public[:]) + string(p.zone)
+	index := activeIndex{p.public, p.zone}
 	if v, ok := p.router.active.Load(index); ok && v.(*atomic.Uint64).Dec() == 0 {
 		p.router.active.Delete(index)
 	}
 
-	p.ClearBandwidthCounters()
+	// Take whatever bandwidth was used since the last report so that it can
+	// still be accounted for against the remote public key.
+	usage := p.takeBandwidthUsage()
 
 	// Next we'll send a message to the state inbox in order to clean up.
 	p.router.state.Act(nil, func() {
-		// Make sure that the connection is closed.
-		_ = p.conn.Close()
+		if p != p.router.local {
+			p.router.state._accountBandwidth(p, usage)
+		}
+
+		// Make sure that the connection is closed. The local router has no
+		// connection or protocol queue, and is only stopped once the router
+		// is shutting down.
+		if p.conn != nil {
+			_ = p.conn.Close()
+		}
 
-		// Drop all of the frames that are sitting in this peer's queues, since there
-		// is no way to send them at this point.
-		p.proto.reset()
+		// Take the traffic that is waiting in this peer's queue so that it can be
+		// routed again once the peer is gone, and drop everything else, since
+		// there is no way to send it at this point.
+		var stale []*types.Frame
+		if p != p.router.local {
+			stale = p.traffic.take(func(*types.Frame) bool { return true })
+		}
+		if p.proto != nil {
+			p.proto.reset()
+		}
 		p.traffic.reset()
 
 		// Notify the tree and SNEK that the port was disconnected.: This triggers
@@ -173,6 +227,7 @@ func (p *peer) stop(err error) {
 				break
 			}
 		}
+		p.router.state._requeueFrom(p, stale)
 
 		// Finally, yell about the disconnection in the logs.
 		if err != nil {
@@ -184,34 +239,51 @@ func (p *peer) stop(err error) {
 }
 
 // _write waits for packets to arrive in one of the peer queues and writes
-// them to the peering connection. This function must be called from the
+// them to the peering connection. Writers for different peers run in
+// parallel with each other, although the frames that they write were all
+// routed by the state actor first. This function must be called from the
 // peer's writer actor only.
 func (p *peer) _write() {
+	p.goroutines.Inc()
+	defer p.goroutines.Dec()
+
 	// If the peering has stopped then we should give up.
 	if !p.started.Load() {
+		if p._held != nil {
+			putFrame(p._held)
+			p._held = nil
+		}
 		return
 	}
 	var frame *types.Frame
 
 	// The keepalive function will return a channel that either matches the
-	// keepalive interval (if enabled) or blocks forever (if disabled).
+	// keepalive interval (if enabled) or blocks forever (if disabled). The
+	// same timer is reused every time, rather than leaving a new one behind
+	// for every frame that is written, each of which would wake us up later.
 	keepalive := func() <-chan time.Time {
-		if !p.keepalives {
-			return make(chan time.Time)
+		if !p.keepalives || p.suspension.suspended() {
+			return nil
 		}
-		return time.After(peerKeepaliveInterval)
+		interval := p.router.clock.real(p.router.timers.keepaliveInterval)
+		if p._keepalive == nil {
+			p._keepalive = time.NewTimer(interval)
+			return p._keepalive.C
+		}
+		if !p._keepalive.Stop() {
+			select {
+			case <-p._keepalive.C:
+			default:
+			}
+		}
+		p._keepalive.Reset(interval)
+		return p._keepalive.C
 	}
 
-	// Wait for some work to do.
-	select {
-	case <-p.context.Done():
-		// The peer context has been cancelled, which implies that the port
-		// has just been stopped.
-		return
-	case frame = <-p.proto.pop():
-		// A protocol packet is ready to send.
-		p.proto.ack()
-	default:
+	// Wait for some work to do, unless a frame was left over from the last
+	// write, in which case it goes first.
+	frame, p._held = p._held, nil
+	if frame == nil {
 		select {
 		case <-p.context.Done():
 			// The peer context has been cancelled, which implies that the port
@@ -220,14 +292,30 @@ func (p *peer) _write() {
 		case frame = <-p.proto.pop():
 			// A protocol packet is ready to send.
 			p.proto.ack()
-		case frame = <-p.traffic.pop():
-			// A protocol packet is ready to send.
-			p.traffic.ack()
-		case <-keepalive():
-			// Nothing else happened but we reached the keepalive interval, so
-			// we will generate a keepalive frame to send instead.
-			frame = getFrame()
-			frame.Type = types.TypeKeepalive
+		default:
+			select {
+			case <-p.context.Done():
+				// The peer context has been cancelled, which implies that the port
+				// has just been stopped.
+				return
+			case frame = <-p.proto.pop():
+				// A protocol packet is ready to send.
+				p.proto.ack()
+			case frame = <-p.traffic.pop():
+				// A protocol packet is ready to send.
+				p.traffic.ack()
+			case <-keepalive():
+				// Nothing else happened but we reached the keepalive interval. If
+				// the peering has been idle for long enough then we suspend it,
+				// otherwise we will generate a keepalive frame to send instead.
+				if p.suspension.idleFor() && p.suspend() {
+					p.writer.Act(nil, p._write)
+					return
+				}
+				frame = p.router.getFrame()
+				frame.Type = types.TypeKeepalive
+				p.router.inspector.inspect(DirectionOutbound, frame)
+			}
 		}
 	}
 
@@ -238,21 +326,95 @@ func (p *peer) _write() {
 		p.stop(fmt.Errorf("queue reset"))
 		return
 	}
-	defer framePool.Put(frame)
 
 	// We might have been waiting for a little while for one of the above
 	// cases to happen, so let's check one more time that the peering wasn't
 	// stopped before we try to marshal and send the frame.
 	if !p.started.Load() {
+		putFrame(frame)
+		return
+	}
+	if !p._writable(frame) {
+		p.writer.Act(nil, p._write)
 		return
 	}
 
-	// Marshal the frame.
-	buf := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
-	defer frameBufferPool.Put(buf)
-	n, err := frame.MarshalBinary(buf[:])
-	if err != nil {
-		p.stop(fmt.Errorf("frame.MarshalBinary: %w", err))
+	// Marshal the frame into the frame buffer. If more frames are already
+	// waiting in the queues then they are copied into the batch buffer one
+	// after another, so that they all go out in a single write. We don't do
+	// this for paced peerings since the pacing is worked out per write, or for
+	// datagram peerings since each datagram must hold exactly one frame. A
+	// frame on its own is written straight from the frame buffer.
+	pool := p.router.frameBuffers()
+	bp := pool.Get().(*[]byte)
+	defer pool.Put(bp)
+	buf := *bp
+	batch := p._batch[:0]
+	var out []byte
+	migrated := false
+	limit := p.router.writeBatchSize()
+	if p.flush.bytes > 0 {
+		limit = p.flush.bytes
+	}
+	flush := p._flushAfter()
+	for frame != nil {
+		// The frame is written in the encoding used on this peering, which
+		// isn't necessarily the one that it arrived in.
+		frame.Version = p.version
+		// The first frame has to be moved out of the frame buffer before it
+		// is reused for the second.
+		if len(out) > 0 && len(batch) == 0 {
+			if cap(batch) < limit {
+				batch = make([]byte, 0, limit)
+			}
+			batch = append(batch, out...)
+			out = batch
+		}
+		n, err := frame.MarshalBinary(buf)
+		if err != nil {
+			putFrame(frame)
+			p.stop(fmt.Errorf("frame.MarshalBinary: %w", err))
+			return
+		}
+		// A frame that would take the batch over the limit waits for the next
+		// write instead, so that the batch buffer never has to grow.
+		if len(out) > 0 && len(out)+n > limit {
+			p._held = frame
+			break
+		}
+		if frame.Type == types.TypeTreeRouted || frame.Type == types.TypeVirtualSnakeRouted {
+			p.bytesTxTraffic.Add(uint64(n))
+			p.suspension.touch()
+		} else {
+			p.bytesTxProto.Add(uint64(n))
+		}
+		p.mirrorFrame(MirrorTx, buf[:n])
+		if len(out) == 0 {
+			out = buf[:n]
+		} else {
+			batch = append(batch, buf[:n]...)
+			out = batch
+		}
+		// Nothing can follow a migrate marker on the same connection, see
+		// ConnectionMigrate.
+		migrated = isMigrateFrame(frame)
+		putFrame(frame)
+		if migrated || p.pacer != nil || p.datagrams || p.flush.perFrame || len(out) >= limit {
+			break
+		}
+		if frame = p._awaitQueued(flush); frame == nil && !p.started.Load() {
+			return
+		}
+		for frame != nil && !p._writable(frame) {
+			frame = p._nextQueued()
+		}
+	}
+	p._batch = batch
+	n := len(out)
+
+	// If the peering is paced then wait until the pacing rate allows another
+	// write. Anything else that arrives in the meantime waits in the queues.
+	if !p.pacer._wait(p.context) {
 		return
 	}
 
@@ -260,23 +422,21 @@ func (p *peer) _write() {
 	// that the write doesn't block for too long. We don't do this when keepalives
 	// are disabled, which allows writes to take longer.
 	if p.keepalives {
-		if err := p.conn.SetWriteDeadline(time.Now().Add(peerKeepaliveInterval)); err != nil {
+		if err := p.conn.SetWriteDeadline(time.Now().Add(p.router.timers.keepaliveInterval)); err != nil {
 			p.stop(fmt.Errorf("p.conn.SetWriteDeadline: %w", err))
 			return
 		}
 	}
 
-	// Write the frame to the peering.
-	if frame.Type == types.TypeTreeRouted || frame.Type == types.TypeVirtualSnakeRouted {
-		p.bytesTxTraffic.Add(uint64(n))
-	} else {
-		p.bytesTxProto.Add(uint64(n))
-	}
-	wn, err := p.conn.Write(buf[:n])
+	// Write the frames to the peering.
+	start := time.Now()
+	wn, err := p.conn.Write(out)
 	if err != nil {
 		p.stop(fmt.Errorf("p.conn.Write: %w", err))
 		return
 	}
+	p.pacer._wrote(wn, start)
+	p.watchdog.tx.Inc()
 
 	// Check that we wrote the number of bytes that we were expecting to write.
 	// If we didn't then that implies that something went wrong, so shut down the
@@ -294,28 +454,107 @@ func (p *peer) _write() {
 		}
 	}
 
+	// Everything after a migrate marker goes to the new connection.
+	if migrated {
+		p.conn.writerMoved()
+	}
+
 	// This is effectively a recursive call to queue up the next write into
 	// the actor inbox.
 	p.writer.Act(nil, p._write)
 }
 
+// _nextQueued returns the next frame from the queues if there is one waiting,
+// without blocking, or nil otherwise. Protocol frames are preferred over
+// traffic frames, as in _write. This function must be called from the peer's
+// writer actor only.
+func (p *peer) _nextQueued() *types.Frame {
+	var frame *types.Frame
+	select {
+	case frame = <-p.proto.pop():
+		p.proto.ack()
+	default:
+		select {
+		case frame = <-p.traffic.pop():
+			p.traffic.ack()
+		default:
+		}
+	}
+	return frame
+}
+
+// _writable returns true if the frame should be written to the peering. While
+// the peering is suspended, the only protocol frames that we originate that
+// get sent are the ones that tell the remote side, and the rest are dropped
+// since they would only wake the link up for nothing. Traffic frames and
+// bootstraps that we are forwarding for someone else resume the peering
+// instead, as the path that they are setting up would otherwise never be
+// built. Frames that won't fit in the MTU of the link are dropped, since the
+// remote side would end the peering if we sent them, as are frames that are
+// longer than the embedded profile allows. So are traffic frames that have
+// waited in the queue for too long since they were taken from it, see
+// ConnectionQueueMaxAge.
+// This function must be called from the peer's writer actor only.
+func (p *peer) _writable(frame *types.Frame) bool {
+	switch frame.Type {
+	case types.TypeTreeRouted, types.TypeVirtualSnakeRouted:
+		if p.traffic.stale(frame) {
+			putFrame(frame)
+			p.watchdog.tx.Inc()
+			return false
+		}
+	}
+	if p.mtu > 0 || p.router.embedded {
+		frame.Version = p.version
+		if size := frame.Size(); size > p.maxFrameLength(frame.Type) || size > p.router.maxFrameSize() {
+			p.router.conformance.drop(DropTooLarge, p.public, frame)
+			putFrame(frame)
+			p.watchdog.tx.Inc()
+			return false
+		}
+	}
+	if !p.suspension.suspended() || isSuspendFrame(frame) || isMigrateFrame(frame) {
+		return true
+	}
+	resumes := false
+	switch frame.Type {
+	case types.TypeTreeRouted, types.TypeVirtualSnakeRouted:
+		resumes = true
+	case types.TypeVirtualSnakeBootstrap:
+		resumes = !p.router.answersTo(frame.DestinationKey)
+	}
+	if !resumes {
+		p.router.conformance.drop(DropSuspended, p.public, frame)
+		putFrame(frame)
+		p.watchdog.tx.Inc()
+		return false
+	}
+	p.resume()
+	return true
+}
+
 // _read waits for packets to arrive from the peering and then handles
 // them appropriate. This function must be called from the peer's reader
 // actor only.
 func (p *peer) _read() {
+	p.goroutines.Inc()
+	defer p.goroutines.Dec()
+
 	// If the peering has stopped then we should give up.
 	if !p.started.Load() {
 		return
 	}
-	b := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
-	defer frameBufferPool.Put(b)
+	pool := p.router.frameBuffers()
+	bp := pool.Get().(*[]byte)
+	defer pool.Put(bp)
+	b := *bp
 
 	// If keepalives are enabled then we should set a read deadline to ensure
 	// that the read doesn't block for too long. If we wait for a packet for too long
 	// then we assume the remote peer is dead, as they should have sent us a keepalive
-	// packet by then.
-	if p.keepalives {
-		if err := p.conn.SetReadDeadline(time.Now().Add(peerKeepaliveTimeout)); err != nil {
+	// packet by then. The same doesn't apply while the peering is suspended.
+	if p.keepalives && !p.suspension.suspended() {
+		if err := p.conn.SetReadDeadline(time.Now().Add(p.router.clock.real(p.router.timers.keepaliveTimeout))); err != nil {
 			p.stop(fmt.Errorf("p.conn.SetReadDeadline: %w", err))
 			return
 		}
@@ -323,15 +562,71 @@ func (p *peer) _read() {
 
 	// Wait for the packet to arrive from the remote peer and read only enough bytes to
 	// get the header. This will tell us how much more we need to read to get the rest
-	// of the frame.
+	// of the frame. On datagram peerings, each datagram holds exactly one frame, so
+	// the whole frame is read at once instead.
 	isProtoTraffic := true
+	datagram, expecting := 0, 0
 	{
-		n, err := io.ReadFull(p.conn, b[:types.FrameHeaderLength])
+		var typ types.FrameType
+		var n int
+		var err error
+		if p.datagrams {
+			n, err = p.conn.Read(b[:])
+			datagram = n
+		} else {
+			n, err = io.ReadFull(p.conn, b[:types.FrameHeaderLength])
+		}
+		if errors.Is(err, errMigrated) {
+			// The peering moved to a new connection, so start reading from
+			// that instead.
+			p.reader.Act(nil, p._read)
+			return
+		}
+		if err != nil && n == 0 && isTimeout(err) && p.suspension.suspended() {
+			// The peering was suspended while we were already waiting with a
+			// read deadline, so just wait again without one.
+			p.reader.Act(nil, p._read)
+			return
+		}
 		if err != nil {
 			p.stop(fmt.Errorf("io.ReadFull: %w", err))
 			return
 		}
-		if types.FrameType(b[5]) == types.TypeTreeRouted || types.FrameType(b[5]) == types.TypeVirtualSnakeRouted {
+		if n < types.FrameHeaderLength {
+			p.stop(fmt.Errorf("datagram of %d bytes is too short for a frame", n))
+			return
+		}
+		// Check for the presence of the magic bytes at the beginning of the frame.
+		// If they are missing then something is wrong — either they sent us garbage
+		// or the offsets in one of the previous packets was incorrect.
+		if typ, expecting, err = types.PeekFrameHeader(b[:n]); err != nil {
+			p.stop(fmt.Errorf("types.PeekFrameHeader: %w", err))
+			return
+		}
+		// A frame that claims to be longer than any frame of its type could be
+		// is refused now, rather than waiting to read the rest of it, since
+		// the remote side is either broken or trying to stall the peering.
+		if max := p.maxFrameLength(typ); expecting > max {
+			p.router.oversized.Inc()
+			p.stop(fmt.Errorf("%s frame of %d bytes is longer than the limit of %d bytes", typ, expecting, max))
+			return
+		}
+		// A frame that is within the limits of the peering but longer than
+		// our frame buffers, which only happens with the embedded profile, is
+		// skipped rather than ending the peering, since the remote side has no
+		// way to know about our limit.
+		if expecting > len(b) {
+			if !p.datagrams {
+				if _, err := io.CopyN(ioutil.Discard, p.conn, int64(expecting-n)); err != nil {
+					p.stop(fmt.Errorf("io.CopyN: %w", err))
+					return
+				}
+			}
+			p.router.oversized.Inc()
+			p.reader.Act(nil, p._read)
+			return
+		}
+		if typ == types.TypeTreeRouted || typ == types.TypeVirtualSnakeRouted {
 			isProtoTraffic = false
 		}
 
@@ -339,32 +634,36 @@ func (p *peer) _read() {
 			p.bytesRxProto.Add(uint64(n))
 		} else {
 			p.bytesRxTraffic.Add(uint64(n))
+			p.suspension.touch()
 		}
 	}
 
-	// Check for the presence of the magic bytes at the beginning of the frame. If they
-	// are missing then something is wrong — either they sent us garbage or the offsets
-	// in one of the previous packets was incorrect.
-	if !bytes.Equal(b[:4], types.FrameMagicBytes) {
-		p.stop(fmt.Errorf("missing magic bytes"))
-		return
-	}
-
 	// Now read the rest of the packet. If something goes wrong with this then we will
 	// assume that either the length given to us earlier was incorrect, or something else
 	// is wrong with the peering, so we will stop the peering in either case.
-	expecting := int(binary.BigEndian.Uint16(b[types.FrameHeaderLength-2 : types.FrameHeaderLength]))
-	n, err := io.ReadFull(p.conn, b[types.FrameHeaderLength:expecting])
-	if err != nil {
-		p.stop(fmt.Errorf("io.ReadFull: %w", err))
-		return
-	}
-
-	if isProtoTraffic {
-		p.bytesRxProto.Add(uint64(n))
+	if p.datagrams {
+		if datagram != expecting {
+			p.stop(fmt.Errorf("datagram of %d bytes holds a frame of %d bytes", datagram, expecting))
+			return
+		}
 	} else {
-		p.bytesRxTraffic.Add(uint64(n))
+		n, err := io.ReadFull(p.conn, b[types.FrameHeaderLength:expecting])
+		if errors.Is(err, errMigrated) {
+			p.reader.Act(nil, p._read)
+			return
+		}
+		if err != nil {
+			p.stop(fmt.Errorf("io.ReadFull: %w", err))
+			return
+		}
+
+		if isProtoTraffic {
+			p.bytesRxProto.Add(uint64(n))
+		} else {
+			p.bytesRxTraffic.Add(uint64(n))
+		}
 	}
+	frame := b[:expecting]
 
 	// If keepalives are disabled then we can reset the read deadline again.
 	if p.keepalives {
@@ -381,24 +680,74 @@ func (p *peer) _read() {
 		return
 	}
 
-	// Check that we read the number of bytes that we were expecting to read.
-	// If we didn't then that implies that something went wrong, so shut down the
-	// peering.
-	if n < expecting-types.FrameHeaderLength {
-		p.stop(fmt.Errorf("expecting %d bytes but got %d bytes", expecting, n))
-		return
-	}
+	p.mirrorFrame(MirrorRx, frame)
+	p.watchdog.rx.Inc()
 
 	// Unmarshal the frame.
-	f := getFrame()
-	if _, err := f.UnmarshalBinary(b[:n+types.FrameHeaderLength]); err != nil {
+	f := p.router.getFrame()
+	if _, err := f.UnmarshalBinary(frame); err != nil {
 		p.stop(fmt.Errorf("f.UnmarshalBinary: %w", err))
 		return
 	}
 
+	p.observeFrame(f.Type)
+
+	// A keepalive with the migrate extension is the last frame that the remote
+	// side will send on this connection, so carry on reading from the one that
+	// the peering is moving to.
+	if isMigrateFrame(f) {
+		putFrame(f)
+		p.conn.readerMoved()
+		p.reader.Act(nil, p._read)
+		return
+	}
+
+	// A keepalive with the suspend extension means that the remote side is
+	// suspending the peering, and anything else from them resumes it.
+	if isSuspendFrame(f) {
+		p.suspendedByRemote()
+	} else if p.suspension.suspended() {
+		p.resume()
+	}
+
+	// If the state actor is saturated then low priority frames are shed here
+	// rather than adding to the backlog.
+	if !p.router.overload.admit(p.router, p, f) {
+		putFrame(f)
+		p.reader.Act(nil, p._read)
+		return
+	}
+	admitted := time.Now()
+
+	// Only the newest tree announcement from a peer matters, so if there's
+	// already one waiting for the state actor then it is replaced instead of
+	// queueing up another. Since there can only be one waiting per peer, they
+	// are queued without backpressure, so that we carry on reading while the
+	// state actor is busy and any announcements that follow can replace it.
+	if f.Type == types.TypeTreeAnnouncement {
+		if old, _ := p.announcement.Swap(f).(*types.Frame); old != nil {
+			p.router.overload.coalesced.Inc()
+			p.router.overload.pending.Dec()
+			putFrame(old)
+		} else {
+			p.router.state.Act(nil, func() {
+				p.router.overload.done(p.router, admitted)
+				f, _ := p.announcement.Swap((*types.Frame)(nil)).(*types.Frame)
+				if err := p.router.state._forward(p, f); err != nil && !errors.Is(err, ErrQueueFull) {
+					p.stop(fmt.Errorf("p.router.state._forward: %w", err))
+				}
+			})
+		}
+		p.reader.Act(nil, p._read)
+		return
+	}
+
 	// Send the frame across to the state actor to be handled/forwarded.
 	p.router.state.Act(&p.reader, func() {
-		if err := p.router.state._forward(p, f); err != nil {
+		p.router.overload.done(p.router, admitted)
+		// A full queue at the next-hop only costs us the frame, which has
+		// already been counted as dropped, so it isn't the peer's fault.
+		if err := p.router.state._forward(p, f); err != nil && !errors.Is(err, ErrQueueFull) {
 			p.stop(fmt.Errorf("p.router.state._forward: %w", err))
 			return
 		}
@@ -0,0 +1,271 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Peer exchange timings and limits. Records are sent to each peer when it
+// connects and then every pexInterval. A peer that sends us PEX frames more
+// often than pexFrameInterval, or more than pexRecordsPerFrame records at a
+// time, is ignored until it slows down, and a record from the same origin will
+// only be replaced once every pexOriginInterval, so that a single node can't
+// churn the table.
+const (
+	pexInterval        = time.Minute * 5
+	pexFrameInterval   = time.Minute
+	pexOriginInterval  = time.Minute
+	pexRecordsPerFrame = 16
+	pexTableSize       = 256
+	// pexMaxLifetime is how far in the future a record may expire, so that
+	// records can't be made which will be handed out forever.
+	pexMaxLifetime = time.Hour * 24 * 7
+)
+
+// RouterPeerExchange enables peer exchange when set to true. The router will
+// then send the PEX records that it knows about, including its own if it has
+// one from AdvertisePEX, to its direct peers and will learn records from them
+// in return. Records are signed by the node that they describe, so they can't
+// be altered by the nodes that pass them along. Without this option, PEX
+// records can still be injected and exported, but none are exchanged with
+// peers.
+type RouterPeerExchange bool
+
+func (e RouterPeerExchange) isRouterOption() {}
+
+type pexEntry struct {
+	record  *types.PEXRecord
+	updated time.Time
+}
+
+// AdvertisePEX creates a PEX record for this node with the given URIs, which
+// is handed out to peers when peer exchange is enabled and is also returned
+// by ExportPEXRecords. The record is signed again before it expires, so it
+// stays valid for as long as the node is running. Calling AdvertisePEX with
+// no URIs stops advertising.
+func (r *Router) AdvertisePEX(uris []string, ttl time.Duration) (*types.PEXRecord, error) {
+	if len(uris) == 0 {
+		phony.Block(r.state, func() {
+			r.state._pexSelf, r.state._pexURIs = nil, nil
+		})
+		return nil, nil
+	}
+	if ttl <= 0 || ttl > pexMaxLifetime {
+		return nil, fmt.Errorf("TTL must be between 0 and %s", pexMaxLifetime)
+	}
+	record, err := types.NewPEXRecord(r.private, uris, r.clock.now().Add(ttl))
+	if err != nil {
+		return nil, fmt.Errorf("types.NewPEXRecord: %w", err)
+	}
+	phony.Block(r.state, func() {
+		r.state._pexSelf = record
+		r.state._pexURIs = append([]string{}, uris...)
+		r.state._pexTTL = ttl
+	})
+	return record, nil
+}
+
+// InjectPEXRecords adds records to the PEX table that were obtained some other
+// way than from peers, i.e. from a QR code or a DNS TXT record. Each record is
+// verified first. An error is returned for the first record that couldn't be
+// added, but the rest are still added.
+func (r *Router) InjectPEXRecords(records ...*types.PEXRecord) error {
+	var err error
+	phony.Block(r.state, func() {
+		now := r.clock.now()
+		for _, record := range records {
+			if lerr := r.state._learnPEXRecord(record, now); lerr != nil && err == nil {
+				err = fmt.Errorf("PEX record for %s: %w", record.Origin, lerr)
+			}
+		}
+	})
+	return err
+}
+
+// ExportPEXRecords returns all of the PEX records that haven't expired,
+// including our own if we are advertising one, so that they can be handed out
+// as a bootstrap list. The records are sorted by origin key.
+func (r *Router) ExportPEXRecords() []*types.PEXRecord {
+	var records []*types.PEXRecord
+	phony.Block(r.state, func() {
+		records = r.state._validPEXRecords(r.clock.now())
+	})
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Origin.CompareTo(records[j].Origin) < 0
+	})
+	return records
+}
+
+// _validPEXRecords returns our own record, if any, followed by all of the
+// other records that haven't expired, in no particular order.
+func (s *state) _validPEXRecords(now time.Time) []*types.PEXRecord {
+	records := make([]*types.PEXRecord, 0, len(s._pex)+1)
+	if s._pexSelf != nil {
+		records = append(records, s._pexSelf)
+	}
+	for _, entry := range s._pex {
+		if now.Before(entry.record.ExpiresAt()) {
+			records = append(records, entry.record)
+		}
+	}
+	return records
+}
+
+// _learnPEXRecord verifies a record and stores it in the PEX table, replacing
+// any older record from the same origin.
+func (s *state) _learnPEXRecord(record *types.PEXRecord, now time.Time) error {
+	if err := record.Verify(now); err != nil {
+		return err
+	}
+	if record.ExpiresAt().After(now.Add(pexMaxLifetime)) {
+		return fmt.Errorf("PEX record expires too far in the future")
+	}
+	if record.Origin == s.r.public {
+		return nil
+	}
+	if existing, ok := s._pex[record.Origin]; ok {
+		if record.Expires <= existing.record.Expires {
+			return nil
+		}
+		if now.Sub(existing.updated) < pexOriginInterval {
+			return fmt.Errorf("PEX record updated too recently")
+		}
+	} else if len(s._pex) >= pexTableSize {
+		// Make room by evicting whichever record will expire first.
+		var evict *pexEntry
+		for _, entry := range s._pex {
+			if evict == nil || entry.record.Expires < evict.record.Expires {
+				evict = entry
+			}
+		}
+		if evict.record.Expires >= record.Expires {
+			return fmt.Errorf("PEX table is full")
+		}
+		delete(s._pex, evict.record.Origin)
+	}
+	s._pex[record.Origin] = &pexEntry{
+		record:  record,
+		updated: now,
+	}
+	return nil
+}
+
+// _maintainPEXIn schedules peer exchange for the specified duration.
+func (s *state) _maintainPEXIn(d time.Duration) {
+	s._pexDue = s.r.clock.now().Add(d)
+	s._schedule()
+}
+
+// _maintainPEX expires old records, signs our own record again if it will
+// expire soon and then sends records to all of our peers.
+func (s *state) _maintainPEX() {
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._maintainPEXIn(pexInterval)
+	}
+
+	now := s.r.clock.now()
+	for origin, entry := range s._pex {
+		if !now.Before(entry.record.ExpiresAt()) {
+			delete(s._pex, origin)
+		}
+	}
+	if self := s._pexSelf; self != nil && self.ExpiresAt().Sub(now) < s._pexTTL/2 {
+		record, err := types.NewPEXRecord(s.r.private, s._pexURIs, now.Add(s._pexTTL))
+		if err != nil {
+			s.r.log.Println("Failed to renew PEX record:", err)
+		} else {
+			s._pexSelf = record
+		}
+	}
+	for _, p := range s._peers {
+		if p != nil && p.port != 0 && p.started.Load() {
+			s._sendPEXToPeer(p)
+		}
+	}
+}
+
+// _sendPEXToPeer sends up to pexRecordsPerFrame records to the peer. Since
+// the table is a map, a different selection of records is sent each time if
+// there are more than will fit.
+func (s *state) _sendPEXToPeer(p *peer) {
+	if !s.r.pex || s.r.observer {
+		return
+	}
+	frame := s.r.getFrame()
+	frame.Type = types.TypePeerExchange
+	payload := frame.Payload[:cap(frame.Payload)]
+	offset, count := 1, 0
+	for _, record := range s._validPEXRecords(s.r.clock.now()) {
+		if count == pexRecordsPerFrame {
+			break
+		}
+		if record.Origin == p.public {
+			continue
+		}
+		n, err := record.MarshalBinary(payload[offset:])
+		if err != nil {
+			continue
+		}
+		offset += n
+		count++
+	}
+	if count == 0 {
+		putFrame(frame)
+		return
+	}
+	payload[0] = byte(count)
+	frame.Payload = payload[:offset]
+	p.sendProto(frame)
+}
+
+// _handlePEXFrame learns the records that a peer has sent us.
+func (s *state) _handlePEXFrame(p *peer, f *types.Frame) error {
+	if !s.r.pex || p == s.r.local {
+		return nil
+	}
+	now := s.r.clock.now()
+	if last, ok := s._pexHeard[p]; ok && now.Sub(last) < pexFrameInterval {
+		s.r.conformance.drop(DropRateLimited, p.public, f)
+		return nil
+	}
+	s._pexHeard[p] = now
+	if len(f.Payload) == 0 || int(f.Payload[0]) > pexRecordsPerFrame {
+		s.r.conformance.drop(DropMalformed, p.public, f)
+		return nil
+	}
+	count, offset := int(f.Payload[0]), 1
+	for i := 0; i < count; i++ {
+		record := &types.PEXRecord{}
+		n, err := record.UnmarshalBinary(f.Payload[offset:])
+		if err != nil {
+			s.r.conformance.drop(DropMalformed, p.public, f)
+			return nil
+		}
+		offset += n
+		if err := s._learnPEXRecord(record, now); err != nil {
+			s.r.log.Println("Ignoring PEX record for", record.Origin.String()[:8], "from", p.public.String()[:8]+":", err)
+		}
+	}
+	return nil
+}
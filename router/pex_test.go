@@ -0,0 +1,101 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPeerExchange(t *testing.T) {
+	routers := make([]*Router, 3)
+	for i := range routers {
+		_, sk, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The last router doesn't take part in peer exchange.
+		routers[i] = NewRouter(nil, sk, false, RouterPeerExchange(i < 2))
+		defer routers[i].Close() // nolint:errcheck
+	}
+	a, b, c := routers[0], routers[1], routers[2]
+	if _, err := a.AdvertisePEX([]string{"tcp://192.0.2.1:65432"}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*Router{b, c} {
+		connectPair(t, a, r)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for len(b.ExportPEXRecords()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("PEX record was not exchanged")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	records := b.ExportPEXRecords()
+	if len(records) != 1 || records[0].Origin != a.PublicKey() || records[0].URIs[0] != "tcp://192.0.2.1:65432" {
+		t.Fatalf("unexpected PEX records %+v", records)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if records := c.ExportPEXRecords(); len(records) != 0 {
+		t.Fatalf("router without peer exchange learned %d records", len(records))
+	}
+
+	// Records can still be injected into a router without peer exchange.
+	if err := c.InjectPEXRecords(records...); err != nil {
+		t.Fatal(err)
+	}
+	if records := c.ExportPEXRecords(); len(records) != 1 {
+		t.Fatalf("expected 1 injected record but got %d", len(records))
+	}
+	tampered := *records[0]
+	tampered.URIs = []string{"tcp://198.51.100.1:65432"}
+	if err := c.InjectPEXRecords(&tampered); err == nil {
+		t.Fatalf("tampered record should not have been injected")
+	}
+}
+
+func TestPeerExchangeRateLimit(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterPeerExchange(true), RouterStrictConformance{})
+	defer r.Close() // nolint:errcheck
+
+	records := make([]*types.PEXRecord, 2)
+	for i := range records {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		var private types.PrivateKey
+		copy(private[:], sk)
+		record, err := types.NewPEXRecord(private, []string{"tcp://192.0.2.1:65432"}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records[i] = record
+	}
+	frameFor := func(record *types.PEXRecord) *types.Frame {
+		f := getFrame()
+		f.Type = types.TypePeerExchange
+		f.Payload = f.Payload[:1+record.Length()]
+		f.Payload[0] = 1
+		if _, err := record.MarshalBinary(f.Payload[1:]); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	var learned int
+	phony.Block(r.state, func() {
+		p := &peer{router: r, port: 1}
+		_ = r.state._handlePEXFrame(p, frameFor(records[0]))
+		_ = r.state._handlePEXFrame(p, frameFor(records[1]))
+		learned = len(r.state._pex)
+	})
+	if learned != 1 {
+		t.Fatalf("expected the second PEX frame to be rate limited but learned %d records", learned)
+	}
+	if n := r.DropCounts()[DropRateLimited]; n != 1 {
+		t.Fatalf("expected 1 rate limited drop but got %d", n)
+	}
+}
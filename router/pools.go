@@ -18,26 +18,78 @@ import (
 	"sync"
 
 	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
 )
 
-var frameBufferPool = &sync.Pool{
-	New: func() interface{} {
-		b := [types.MaxFrameSize]byte{}
-		return &b
-	},
+// framePoolAllocs and frameBufferPoolAllocs count how many times the
+// pools have had to allocate new entries, for debugging purposes.
+var framePoolAllocs atomic.Uint64
+var frameBufferPoolAllocs atomic.Uint64
+
+// frameLeaks and frameDoubleFrees count misuse of the frame pool. They are
+// only counted in builds with the framedebug tag.
+var frameLeaks atomic.Uint64
+var frameDoubleFrees atomic.Uint64
+
+// frameBufferPool holds buffers that are big enough to marshal or read any
+// frame, and embeddedFrameBufferPool holds the smaller buffers that are used
+// by routers with the embedded profile, see RouterEmbedded.
+var frameBufferPool = newFrameBufferPool(types.MaxFrameSize)
+var embeddedFrameBufferPool = newFrameBufferPool(embeddedMaxFrameSize)
+
+func newFrameBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			frameBufferPoolAllocs.Inc()
+			b := make([]byte, size)
+			return &b
+		},
+	}
 }
 
-var framePool = &sync.Pool{
-	New: func() interface{} {
-		f := &types.Frame{
-			Payload: make([]byte, 0, types.MaxPayloadSize),
-		}
-		return f
-	},
+// framePool holds frames with room for any payload, and embeddedFramePool
+// holds frames with room for the payloads that routers with the embedded
+// profile will send or accept.
+var framePool = newFramePool(types.MaxPayloadSize)
+var embeddedFramePool = newFramePool(embeddedMaxPayloadSize)
+
+func newFramePool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			framePoolAllocs.Inc()
+			f := &types.Frame{
+				Payload: make([]byte, 0, size),
+			}
+			return f
+		},
+	}
 }
 
 func getFrame() *types.Frame {
-	f := framePool.Get().(*types.Frame)
+	return getPooledFrame(framePool)
+}
+
+func getPooledFrame(pool *sync.Pool) *types.Frame {
+	f := pool.Get().(*types.Frame)
 	f.Reset()
+	trackBorrow(f)
 	return f
 }
+
+// putFrame returns a frame to the pool once it is no longer needed. The frame
+// must not be used again afterwards, since it may be handed out again. Frames
+// whose payload doesn't have the capacity of one of the pools, i.e. because
+// they weren't allocated by the pool or the payload was replaced or grown, are
+// left for the garbage collector, so that everything in the pools has room
+// for the payloads that they are meant to hold.
+func putFrame(f *types.Frame) {
+	if !trackReturn(f) {
+		return
+	}
+	switch cap(f.Payload) {
+	case types.MaxPayloadSize:
+		framePool.Put(f)
+	case embeddedMaxPayloadSize:
+		embeddedFramePool.Put(f)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build framedebug
+// +build framedebug
+
+package router
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// frameDebug is true in builds with the framedebug tag. These track where
+// every frame from the pool was borrowed and returned, so that frames which
+// are leaked or returned twice can be reported with stack traces. A frame
+// that is returned twice ends up in the pool twice and is then handed out
+// to two users at once, which otherwise only shows up later as corrupted
+// payloads. This is far too slow to use outside of debugging.
+const frameDebug = true
+
+// frameScribble is written over the payload of frames as they are returned,
+// so that anything still using the frame afterwards reads obvious garbage.
+const frameScribble = 0xdd
+
+// frameRecord is what we know about a frame that has been seen by the pool.
+type frameRecord struct {
+	borrowed bool      // true if the frame is out of the pool
+	stack    []uintptr // where the frame was last borrowed or returned
+}
+
+// frameRecords are keyed by the address of the frame rather than holding a
+// pointer to it, otherwise frames would never be garbage collected and
+// leaks couldn't be spotted. Records are removed by the finalizer before
+// the address can be reused.
+var frameRecords = struct {
+	sync.Mutex
+	frames map[uintptr]*frameRecord
+}{
+	frames: map[uintptr]*frameRecord{},
+}
+
+// frameCallers returns the stack of whoever called getFrame or putFrame.
+func frameCallers() []uintptr {
+	pcs := make([]uintptr, 32)
+	return pcs[:runtime.Callers(4, pcs)]
+}
+
+func formatStack(pcs []uintptr) string {
+	var b strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "\t%s\n\t\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+// _frameRecord returns the record for the frame, creating one if the frame
+// hasn't been seen before. The caller must hold the lock.
+func _frameRecord(f *types.Frame) *frameRecord {
+	key := uintptr(unsafe.Pointer(f))
+	record, ok := frameRecords.frames[key]
+	if !ok {
+		record = &frameRecord{}
+		frameRecords.frames[key] = record
+		runtime.SetFinalizer(f, frameFinalized)
+	}
+	return record
+}
+
+// trackBorrow records that the frame has been taken from the pool.
+func trackBorrow(f *types.Frame) {
+	stack := frameCallers()
+	frameRecords.Lock()
+	defer frameRecords.Unlock()
+	record := _frameRecord(f)
+	record.borrowed, record.stack = true, stack
+}
+
+// trackReturn records that the frame is being put back into the pool, and
+// returns false if it is already in the pool, in which case it mustn't be
+// put back again.
+func trackReturn(f *types.Frame) bool {
+	stack := frameCallers()
+	frameRecords.Lock()
+	defer frameRecords.Unlock()
+	record := _frameRecord(f)
+	if !record.borrowed && record.stack != nil {
+		frameDoubleFrees.Inc()
+		log.Printf(
+			"Frame %p was returned to the pool twice\nFirst returned at:\n%sReturned again at:\n%s",
+			f, formatStack(record.stack), formatStack(stack),
+		)
+		return false
+	}
+	record.borrowed, record.stack = false, stack
+	for i := range f.Payload {
+		f.Payload[i] = frameScribble
+	}
+	return true
+}
+
+// frameFinalized is called when a frame that the pool has seen is garbage
+// collected. Frames are allowed to be dropped by the pool itself, but if the
+// frame was still borrowed then it was never returned.
+func frameFinalized(f *types.Frame) {
+	frameRecords.Lock()
+	defer frameRecords.Unlock()
+	key := uintptr(unsafe.Pointer(f))
+	record := frameRecords.frames[key]
+	delete(frameRecords.frames, key)
+	if record != nil && record.borrowed {
+		frameLeaks.Inc()
+		log.Printf(
+			"Frame %p was never returned to the pool\nBorrowed at:\n%s",
+			f, formatStack(record.stack),
+		)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build framedebug
+// +build framedebug
+
+package router
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestFramePoolDoubleFree(t *testing.T) {
+	f := getFrame()
+	f.Payload = append(f.Payload, 1, 2, 3)
+	payload := f.Payload
+	putFrame(f)
+	for i, b := range payload {
+		if b != frameScribble {
+			t.Fatalf("expected payload byte %d to be scribbled over, got %d", i, b)
+		}
+	}
+
+	before := frameDoubleFrees.Load()
+	putFrame(f)
+	if n := frameDoubleFrees.Load() - before; n != 1 {
+		t.Fatalf("expected 1 double free, got %d", n)
+	}
+
+	// The frame should only have gone back into the pool once, so it can't
+	// be handed out twice.
+	a, b := getFrame(), getFrame()
+	if a == b {
+		t.Fatal("expected frame to only be handed out once")
+	}
+	putFrame(a)
+	putFrame(b)
+}
+
+func TestFramePoolLeak(t *testing.T) {
+	before := frameLeaks.Load()
+	func() {
+		f := getFrame()
+		f.Payload = append(f.Payload, 1, 2, 3)
+	}()
+
+	// Finalizers run some time after the frame is collected.
+	deadline := time.Now().Add(time.Second * 5)
+	for frameLeaks.Load() == before && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(time.Millisecond * 10)
+	}
+	if frameLeaks.Load() == before {
+		t.Fatal("expected the leaked frame to be reported")
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+const (
+	topicRefreshInterval = time.Second * 30         // how often subscribers subscribe again
+	topicExpiry          = topicRefreshInterval * 3 // how long a subscription lasts without being refreshed
+	topicMaxTopics       = 1024                     // the most topics that we'll hold subscribers for
+	topicMaxSubscribers  = 256                      // the most subscribers that we'll hold for each topic
+	topicBuffer          = 64                       // publications waiting for a local subscriber before they're dropped
+)
+
+// topicMaxPayload is the largest message that can be published, leaving room
+// for the topic and the publisher in deliveries.
+const topicMaxPayload = types.MaxPayloadSize - 1 - 2*32
+
+// topicTable holds the subscribers to each topic that meets at us, along
+// with when each subscription expires.
+type topicTable map[types.PublicKey]map[types.PublicKey]time.Time
+
+// subscriptionTable holds our own subscriptions to each topic.
+type subscriptionTable map[types.PublicKey]map[*TopicSubscription]struct{}
+
+// Publication is a message that was published on a topic that we are
+// subscribed to.
+type Publication struct {
+	Topic     types.PublicKey
+	Publisher types.PublicKey
+	Payload   []byte
+}
+
+// TopicSubscription receives the messages published on a topic, see
+// SubscribeTopic.
+type TopicSubscription struct {
+	r        *Router
+	topic    types.PublicKey
+	messages chan Publication // closed by the state actor
+	cancel   context.CancelFunc
+}
+
+// SubscribeTopic subscribes to the topic with the given key, which would
+// usually come from types.TopicKey. Subscriptions and publications for a
+// topic are SNEK-routed towards the topic key, so they all meet at whichever
+// node has the closest key, which passes each publication on to every
+// subscriber. Subscriptions are refreshed every 30 seconds, which also moves
+// them over to a new rendezvous node if the closest node changes, although
+// anything published in the meantime can be lost. Delivery is best effort in
+// any case, and publications are dropped if they aren't read from the
+// subscription quickly enough.
+func (r *Router) SubscribeTopic(topic types.PublicKey) (*TopicSubscription, error) {
+	if err := r.requireSnake(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(r.context)
+	sub := &TopicSubscription{
+		r:        r,
+		topic:    topic,
+		messages: make(chan Publication, topicBuffer),
+		cancel:   cancel,
+	}
+	phony.Block(r.state, func() {
+		subs, ok := r.state._subscribed[topic]
+		if !ok {
+			subs = map[*TopicSubscription]struct{}{}
+			r.state._subscribed[topic] = subs
+		}
+		subs[sub] = struct{}{}
+		r.state._sendTopicMessage(topic, &types.TopicMessage{
+			Type:  types.TopicSubscribe,
+			Topic: topic,
+		})
+	})
+	go sub.refresh(ctx)
+	return sub, nil
+}
+
+// Messages returns the channel that publications on the topic arrive on. It
+// is closed once the subscription has been closed.
+func (t *TopicSubscription) Messages() <-chan Publication {
+	return t.messages
+}
+
+// Close ends the subscription. The rendezvous node is told that we are no
+// longer interested, unless there are other subscriptions to the topic.
+func (t *TopicSubscription) Close() error {
+	t.cancel()
+	phony.Block(t.r.state, func() {
+		subs, ok := t.r.state._subscribed[t.topic]
+		if _, subscribed := subs[t]; !ok || !subscribed {
+			return
+		}
+		delete(subs, t)
+		close(t.messages)
+		if len(subs) > 0 {
+			return
+		}
+		delete(t.r.state._subscribed, t.topic)
+		t.r.state._sendTopicMessage(t.topic, &types.TopicMessage{
+			Type:  types.TopicUnsubscribe,
+			Topic: t.topic,
+		})
+	})
+	return nil
+}
+
+// refresh subscribes again every so often, until the subscription is closed.
+func (t *TopicSubscription) refresh(ctx context.Context) {
+	ticker := time.NewTicker(t.r.clock.real(topicRefreshInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.r.state.Act(nil, func() {
+				t.r.state._sendTopicMessage(t.topic, &types.TopicMessage{
+					Type:  types.TopicSubscribe,
+					Topic: t.topic,
+				})
+			})
+		}
+	}
+}
+
+// PublishTopic publishes a message to everyone subscribed to the topic with
+// the given key. See SubscribeTopic.
+func (r *Router) PublishTopic(topic types.PublicKey, payload []byte) error {
+	if err := r.requireSnake(); err != nil {
+		return err
+	}
+	if len(payload) > topicMaxPayload {
+		return fmt.Errorf("message of %d bytes is larger than the maximum of %d bytes", len(payload), topicMaxPayload)
+	}
+	phony.Block(r.state, func() {
+		r.state._sendTopicMessage(topic, &types.TopicMessage{
+			Type:    types.TopicPublish,
+			Topic:   topic,
+			Payload: payload,
+		})
+	})
+	return nil
+}
+
+// _handleTopicFrame handles a SNEK-routed frame with FrameFlagTopic set that
+// has either been delivered to us or has nowhere closer to go. Deliveries are
+// only accepted if they were addressed to us, since a delivery that reaches a
+// dead end elsewhere was meant for a subscriber that has gone away.
+func (s *state) _handleTopicFrame(f *types.Frame, forUs bool) {
+	var message types.TopicMessage
+	if _, err := message.UnmarshalBinary(f.Payload); err != nil {
+		s.r.conformance.drop(DropMalformed, f.SourceKey, f)
+		return
+	}
+	now := s.r.clock.now()
+	switch message.Type {
+	case types.TopicSubscribe:
+		subs, ok := s._topics[message.Topic]
+		if !ok {
+			if len(s._topics) >= topicMaxTopics {
+				return
+			}
+			subs = map[types.PublicKey]time.Time{}
+			s._topics[message.Topic] = subs
+		}
+		if _, ok := subs[f.SourceKey]; !ok && len(subs) >= topicMaxSubscribers {
+			s._expireTopic(message.Topic, now)
+			if len(subs) >= topicMaxSubscribers {
+				return
+			}
+		}
+		subs[f.SourceKey] = now.Add(topicExpiry)
+
+	case types.TopicUnsubscribe:
+		if subs, ok := s._topics[message.Topic]; ok {
+			delete(subs, f.SourceKey)
+			if len(subs) == 0 {
+				delete(s._topics, message.Topic)
+			}
+		}
+
+	case types.TopicPublish:
+		s._expireTopic(message.Topic, now)
+		for subscriber := range s._topics[message.Topic] {
+			if subscriber == s.r.public {
+				s._deliverTopicMessage(message.Topic, f.SourceKey, message.Payload)
+				continue
+			}
+			s._sendTopicMessage(subscriber, &types.TopicMessage{
+				Type:      types.TopicDeliver,
+				Topic:     message.Topic,
+				Publisher: f.SourceKey,
+				Payload:   message.Payload,
+			})
+		}
+
+	case types.TopicDeliver:
+		if forUs {
+			s._deliverTopicMessage(message.Topic, message.Publisher, message.Payload)
+		}
+	}
+}
+
+// _expireTopic removes the subscribers to the topic that haven't refreshed
+// their subscriptions in time.
+func (s *state) _expireTopic(topic types.PublicKey, now time.Time) {
+	subs, ok := s._topics[topic]
+	if !ok {
+		return
+	}
+	for subscriber, expires := range subs {
+		if now.After(expires) {
+			delete(subs, subscriber)
+		}
+	}
+	if len(subs) == 0 {
+		delete(s._topics, topic)
+	}
+}
+
+// _deliverTopicMessage passes a publication on to our own subscriptions to
+// the topic.
+func (s *state) _deliverTopicMessage(topic, publisher types.PublicKey, payload []byte) {
+	for sub := range s._subscribed[topic] {
+		select {
+		case sub.messages <- Publication{
+			Topic:     topic,
+			Publisher: publisher,
+			Payload:   append([]byte(nil), payload...),
+		}:
+		default:
+		}
+	}
+}
+
+// _sendTopicMessage sends a topic message, SNEK-routed towards the given key.
+func (s *state) _sendTopicMessage(dest types.PublicKey, message *types.TopicMessage) {
+	pool := s.r.frameBuffers()
+	bp := pool.Get().(*[]byte)
+	defer pool.Put(bp)
+	buf := *bp
+	n, err := message.MarshalBinary(buf[:])
+	if err != nil {
+		return
+	}
+	s._sendKeyspaceFrame(dest, types.FrameFlagTopic, buf[:n])
+}
@@ -0,0 +1,75 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	routers := newBenchChain(t, 4)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	topic := types.TopicKey("weather")
+	var subs []*TopicSubscription
+	for _, r := range []*Router{routers[0], routers[2]} {
+		sub, err := r.SubscribeTopic(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		subs = append(subs, sub)
+	}
+
+	// The snake might still be settling, in which case subscriptions and
+	// publications can end up at different nodes for a while, so keep
+	// subscribing and publishing until every subscriber has heard.
+	publisher := routers[3]
+	heard := make([]bool, len(subs))
+	deadline := time.After(time.Second * 10)
+	for !heard[0] || !heard[1] {
+		for _, r := range []*Router{routers[0], routers[2]} {
+			r := r
+			r.state.Act(nil, func() {
+				r.state._sendTopicMessage(topic, &types.TopicMessage{Type: types.TopicSubscribe, Topic: topic})
+			})
+		}
+		if err := publisher.PublishTopic(topic, []byte("sunny")); err != nil {
+			t.Fatal(err)
+		}
+		for i, sub := range subs {
+			select {
+			case publication := <-sub.Messages():
+				if publication.Topic != topic || publication.Publisher != publisher.PublicKey() || string(publication.Payload) != "sunny" {
+					t.Fatalf("unexpected publication %+v", publication)
+				}
+				heard[i] = true
+			case <-time.After(time.Millisecond * 100):
+			case <-deadline:
+				t.Fatalf("timed out waiting for publications, heard %v", heard)
+			}
+		}
+	}
+
+	// Closing a subscription closes its channel.
+	_ = subs[0].Close()
+	for range subs[0].Messages() {
+	}
+}
+
+func TestPublishTooLarge(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	if err := routers[0].PublishTopic(types.TopicKey("big"), make([]byte, types.MaxPayloadSize)); err == nil {
+		t.Fatal("expected an oversized publication to be refused")
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// TrafficClassifier assigns a QoS class to a packet that the local node is
+// sending, given its destination and payload, i.e. to tell small Matrix
+// federation events apart from large media transfers by looking at the start
+// of the payload. The class is carried in the frame as an ExtensionTypeQoS
+// extension, so that nodes along the path can queue it separately too.
+// Returning types.QoSBestEffort leaves the frame without an extension. The
+// classifier is called for every packet sent with WriteTo, so it should be
+// quick, and it must not hold onto the payload after returning.
+type TrafficClassifier func(dest net.Addr, payload []byte) types.QoSClass
+
+// SetTrafficClassifier sets the classifier for locally originated traffic, or
+// removes it if nil. Without a classifier, frames are sent with no QoS class
+// unless one was set some other way.
+//
+// Traffic queues are shared fairly between flows, where a flow is all of the
+// frames between the same source and destination. Frames in different QoS
+// classes are treated as different flows, so a bulk transfer can't starve
+// interactive traffic between the same two nodes.
+func (r *Router) SetTrafficClassifier(fn TrafficClassifier) {
+	r.classifier.Store(fn)
+}
+
+// classify runs the traffic classifier, if there is one, for a frame that the
+// local node is about to send.
+func (r *Router) classify(frame *types.Frame, dest net.Addr) {
+	fn, _ := r.classifier.Load().(TrafficClassifier)
+	if fn == nil {
+		return
+	}
+	switch class := fn(dest, frame.Payload); class {
+	case types.QoSBulk, types.QoSInteractive, types.QoSRealtime:
+		_ = frame.SetExtension(types.ExtensionTypeQoS, []byte{byte(class)})
+	}
+}
+
+// frameQoS returns the QoS class of the frame, or types.QoSBestEffort if it
+// doesn't carry a valid one.
+func frameQoS(frame *types.Frame) types.QoSClass {
+	if len(frame.Extensions) == 0 {
+		return types.QoSBestEffort
+	}
+	value, ok := frame.Extension(types.ExtensionTypeQoS)
+	if !ok || len(value) != 1 || types.QoSClass(value[0]) > types.QoSRealtime {
+		return types.QoSBestEffort
+	}
+	return types.QoSClass(value[0])
+}
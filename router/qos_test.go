@@ -0,0 +1,71 @@
+package router
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestTrafficClassifier(t *testing.T) {
+	r := &Router{}
+	frame := &types.Frame{Payload: []byte("media:...")}
+	r.classify(frame, types.PublicKey{})
+	if c := frameQoS(frame); c != types.QoSBestEffort {
+		t.Fatalf("expected best effort without a classifier, got %d", c)
+	}
+
+	r.SetTrafficClassifier(func(_ net.Addr, payload []byte) types.QoSClass {
+		if bytes.HasPrefix(payload, []byte("media:")) {
+			return types.QoSBulk
+		}
+		return types.QoSInteractive
+	})
+	r.classify(frame, types.PublicKey{})
+	if c := frameQoS(frame); c != types.QoSBulk {
+		t.Fatalf("expected bulk, got %d", c)
+	}
+	frame = &types.Frame{Payload: []byte("event:...")}
+	r.classify(frame, types.PublicKey{})
+	if c := frameQoS(frame); c != types.QoSInteractive {
+		t.Fatalf("expected interactive, got %d", c)
+	}
+
+	r.SetTrafficClassifier(nil)
+	frame = &types.Frame{Payload: []byte("media:...")}
+	r.classify(frame, types.PublicKey{})
+	if len(frame.Extensions) != 0 {
+		t.Fatal("expected no extension once the classifier was removed")
+	}
+}
+
+func TestFairQueueSeparatesQoSClasses(t *testing.T) {
+	q := newFairFIFOQueue(trafficBuffer, fairFIFOQueueSize, nil)
+	frame := func(class types.QoSClass) *types.Frame {
+		f := &types.Frame{
+			Type:           types.TypeVirtualSnakeRouted,
+			SourceKey:      types.PublicKey{1},
+			DestinationKey: types.PublicKey{2},
+		}
+		if class != types.QoSBestEffort {
+			_ = f.SetExtension(types.ExtensionTypeQoS, []byte{byte(class)})
+		}
+		return f
+	}
+
+	// A backlog of bulk frames shouldn't hold up an interactive frame between
+	// the same two nodes, since it is in a different flow.
+	for i := 0; i < fairFIFOQueueSize; i++ {
+		q.push(frame(types.QoSBulk))
+	}
+	q.push(frame(types.QoSInteractive))
+	for i := 0; i < 3; i++ {
+		f := <-q.pop()
+		q.ack()
+		if frameQoS(f) == types.QoSInteractive {
+			return
+		}
+	}
+	t.Fatal("expected the interactive frame to be sent ahead of the bulk backlog")
+}
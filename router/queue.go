@@ -19,8 +19,11 @@ import "github.com/matrix-org/pinecone/types"
 type queue interface {
 	queuecount() int
 	queuesize() int
+	hasroom(frame *types.Frame) bool // could the frame be pushed without dropping another?
 	push(frame *types.Frame) bool
 	pop() <-chan *types.Frame
 	ack()
 	reset()
+	take(fn func(*types.Frame) bool) []*types.Frame // remove and return the frames that fn matches
+	stale(frame *types.Frame) bool                  // has a frame taken from the queue waited too long to be written?
 }
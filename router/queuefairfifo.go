@@ -22,25 +22,29 @@ import (
 	"github.com/matrix-org/pinecone/types"
 )
 
+// fairFIFOQueueSize is the default depth of each of the fair queues.
 const fairFIFOQueueSize = 16
 
 type fairFIFOQueue struct {
 	log     types.Logger
 	queues  map[uint16]chan *types.Frame // queue ID -> frame, map for randomness
 	num     uint16                       // how many queues should we have?
+	depth   int                          // how many frames can each queue hold?
 	count   int                          // how many queued items in total?
 	n       uint16                       // which queue did we last iterate on?
 	offset  uint64                       // adds an element of randomness to queue assignment
 	total   uint64                       // how many packets handled?
 	dropped uint64                       // how many packets dropped?
+	notify  dropHandler                  // called when a frame is dropped, if set
 	mutex   sync.Mutex
 }
 
-func newFairFIFOQueue(num uint16, log types.Logger) *fairFIFOQueue {
+func newFairFIFOQueue(num uint16, depth int, log types.Logger) *fairFIFOQueue {
 	q := &fairFIFOQueue{
 		log:    log,
 		offset: rand.Uint64(),
 		num:    num,
+		depth:  depth,
 	}
 	q.reset()
 	return q
@@ -53,11 +57,14 @@ func (q *fairFIFOQueue) queuecount() int { // nolint:unused
 }
 
 func (q *fairFIFOQueue) queuesize() int { // nolint:unused
-	return int(q.num) * fairFIFOQueueSize
+	return int(q.num) * q.depth
 }
 
+// hash returns the queue for the flow that the frame belongs to. Frames in
+// different QoS classes are put into different queues, even when they are
+// between the same nodes.
 func (q *fairFIFOQueue) hash(frame *types.Frame) uint16 {
-	h := q.offset
+	h := q.offset + uint64(frameQoS(frame))
 	switch frame.Type {
 	case types.TypeTreeRouted:
 		for _, v := range frame.Source {
@@ -77,6 +84,18 @@ func (q *fairFIFOQueue) hash(frame *types.Frame) uint16 {
 	return uint16(h % uint64(q.num))
 }
 
+// hasroom returns true if the queue for the frame's flow isn't full. Frames
+// go into queue 0 while nothing is queued, as in push.
+func (q *fairFIFOQueue) hasroom(frame *types.Frame) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.count == 0 {
+		return true
+	}
+	queue := q.queues[q.hash(frame)+1]
+	return len(queue) < cap(queue)
+}
+
 func (q *fairFIFOQueue) push(frame *types.Frame) bool {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -91,8 +110,11 @@ func (q *fairFIFOQueue) push(frame *types.Frame) bool {
 	default:
 		q.log.Println("Queue is full - dropping a frame from the head of the queue")
 		// The queue is full - perform a head drop
-		<-q.queues[h]
+		dropped := <-q.queues[h]
 		q.dropped++
+		if q.notify != nil {
+			q.notify(dropped, DropQueueFull)
+		}
 		if q.count-1 == 0 {
 			h = 0
 		}
@@ -105,9 +127,21 @@ func (q *fairFIFOQueue) push(frame *types.Frame) bool {
 func (q *fairFIFOQueue) reset() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
+	for _, queue := range q.queues {
+	drain:
+		for {
+			select {
+			case frame := <-queue:
+				putFrame(frame)
+			default:
+				break drain
+			}
+		}
+	}
+	q.count = 0
 	q.queues = make(map[uint16]chan *types.Frame, q.num+1)
 	for i := uint16(0); i <= q.num; i++ {
-		q.queues[i] = make(chan *types.Frame, fairFIFOQueueSize)
+		q.queues[i] = make(chan *types.Frame, q.depth)
 	}
 }
 
@@ -144,6 +178,41 @@ func (q *fairFIFOQueue) ack() {
 	q.count--
 }
 
+// take removes the matching frames from the queues and returns them. The
+// frames that are left behind stay in the order that they were queued in.
+func (q *fairFIFOQueue) take(fn func(*types.Frame) bool) []*types.Frame {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var taken, kept []*types.Frame
+	for _, queue := range q.queues {
+		kept = kept[:0]
+	drain:
+		for {
+			select {
+			case frame := <-queue:
+				if fn(frame) {
+					taken = append(taken, frame)
+				} else {
+					kept = append(kept, frame)
+				}
+			default:
+				break drain
+			}
+		}
+		for _, frame := range kept {
+			queue <- frame
+		}
+	}
+	q.count -= len(taken)
+	return taken
+}
+
+// stale always returns false, since frames in the fair queue don't have a
+// maximum age.
+func (q *fairFIFOQueue) stale(_ *types.Frame) bool {
+	return false
+}
+
 func (q *fairFIFOQueue) MarshalJSON() ([]byte, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestFairFIFOQueueTake(t *testing.T) {
+	q := newFairFIFOQueue(1, 8, log.New(ioutil.Discard, "", 0))
+
+	frames := make([]*types.Frame, 6)
+	for i := range frames {
+		frames[i] = &types.Frame{Type: types.TypeTreeRouted, Extra: [2]byte{byte(i)}}
+		q.push(frames[i])
+	}
+
+	// Taking the odd frames leaves the even ones behind, still in order.
+	taken := q.take(func(f *types.Frame) bool { return f.Extra[0]%2 == 1 })
+	if len(taken) != 3 {
+		t.Fatalf("expected 3 frames to be taken but got %d", len(taken))
+	}
+	if c := q.queuecount(); c != 3 {
+		t.Fatalf("expected queue count to be 3 but it was %d", c)
+	}
+	for _, i := range []int{0, 2, 4} {
+		select {
+		case frame := <-q.pop():
+			q.ack()
+			if frame != frames[i] {
+				t.Fatalf("expected frame %d but got frame %d", i, frame.Extra[0])
+			}
+		default:
+			t.Fatalf("expected frame %d to be waiting", i)
+		}
+	}
+	if c := q.queuecount(); c != 0 {
+		t.Fatalf("expected queue to be empty but count was %d", c)
+	}
+}
+
+func TestFairFIFOQueueReset(t *testing.T) {
+	q := newFairFIFOQueue(4, 8, log.New(ioutil.Discard, "", 0))
+	for i := 0; i < 6; i++ {
+		frame := getFrame()
+		frame.Type = types.TypeVirtualSnakeRouted
+		frame.SourceKey[0] = byte(i)
+		q.push(frame)
+	}
+	q.reset()
+	if c := q.queuecount(); c != 0 {
+		t.Fatalf("expected queue to be empty after reset but count was %d", c)
+	}
+	// A reader that is still waiting after the reset, such as one on a local
+	// router that has just been stopped, must not find the queue in a bad
+	// state.
+	select {
+	case frame := <-q.pop():
+		t.Fatalf("expected no frames after reset but got %v", frame)
+	default:
+	}
+}
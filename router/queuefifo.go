@@ -69,6 +69,12 @@ func (q *fifoQueue) queuesize() int { // nolint:unused
 	return cap(q.entries)
 }
 
+func (q *fifoQueue) hasroom(_ *types.Frame) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.max == 0 || len(q.entries)-1 < q.max
+}
+
 func (q *fifoQueue) push(frame *types.Frame) bool {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
@@ -89,7 +95,7 @@ func (q *fifoQueue) reset() {
 		select {
 		case frame := <-ch:
 			if frame != nil {
-				framePool.Put(frame)
+				putFrame(frame)
 			}
 		default:
 		}
@@ -112,6 +118,17 @@ func (q *fifoQueue) ack() {
 	}
 }
 
+// take doesn't take anything, since the FIFO queue is only used for protocol
+// frames, which are never routed again.
+func (q *fifoQueue) take(_ func(*types.Frame) bool) []*types.Frame {
+	return nil
+}
+
+// stale always returns false, since protocol frames never expire.
+func (q *fifoQueue) stale(_ *types.Frame) bool {
+	return false
+}
+
 func (q *fifoQueue) MarshalJSON() ([]byte, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
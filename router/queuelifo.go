@@ -15,92 +15,237 @@
 package router
 
 import (
+	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/pinecone/types"
 )
 
-type lifoQueue struct { // nolint:unused
-	frames []*types.Frame
-	size   int
-	count  int
-	mutex  sync.Mutex
-	notifs chan struct{}
+// lifoQueue is a traffic queue that always prefers to send the newest frame
+// first. Frames that have been waiting for longer than maxAge are dropped
+// instead of being sent, including the frame that the writer has already
+// taken if it waits too long to write it, and if the queue fills up then the
+// oldest frame is dropped to make room for the new one. This keeps latency low
+// for interactive traffic under congestion, at the expense of strict ordering.
+type lifoQueue struct {
+	log     types.Logger
+	frames  []lifoQueueEntry  // oldest first, newest last
+	size    int               // how many frames can be queued?
+	maxAge  time.Duration     // how long can a frame wait before expiring?
+	next    chan *types.Frame // the frame that will be sent next, if any
+	pending lifoQueueEntry    // the frame in next, or the one last taken from it
+	popped  lifoQueueEntry    // the frame taken from next before pending, if unchecked
+	total   uint64            // how many packets handled?
+	dropped uint64            // how many packets dropped because the queue was full?
+	expired uint64            // how many packets dropped because they were too old?
+	notify  dropHandler       // called when a frame is dropped, if set
+	mutex   sync.Mutex
 }
 
-func newLIFOQueue(size int) *lifoQueue { // nolint:unused,deadcode
+type lifoQueueEntry struct {
+	frame  *types.Frame
+	queued time.Time
+}
+
+func newLIFOQueue(size int, maxAge time.Duration, log types.Logger) *lifoQueue {
 	q := &lifoQueue{
-		frames: make([]*types.Frame, size),
+		log:    log,
 		size:   size,
-		notifs: make(chan struct{}, size),
+		maxAge: maxAge,
 	}
+	q.reset()
 	return q
 }
 
 func (q *lifoQueue) queuecount() int { // nolint:unused
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	return q.count
+	return len(q.frames) + len(q.next)
 }
 
 func (q *lifoQueue) queuesize() int { // nolint:unused
+	return q.size
+}
+
+func (q *lifoQueue) hasroom(_ *types.Frame) bool {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	return q.size
+	return len(q.frames)+len(q.next) < q.size
 }
 
-func (q *lifoQueue) push(frame *types.Frame) bool { // nolint:unused
+func (q *lifoQueue) push(frame *types.Frame) bool {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	if q.count == q.size {
-		return false
-	}
-	index := q.size - q.count - 1
-	q.frames[index] = frame
-	q.count++
+	now := time.Now()
+	// If the writer hasn't picked up the next frame yet then take it back,
+	// since the new frame should be sent before it. It was the newest frame
+	// until now so putting it back on the end keeps the entries in order.
 	select {
-	case q.notifs <- struct{}{}:
+	case <-q.next:
+		q.frames = append(q.frames, q.pending)
+		q.pending = lifoQueueEntry{}
 	default:
-		panic("this should be impossible")
 	}
+	q._expire(now)
+	if len(q.frames) >= q.size {
+		// The queue is full - drop the oldest frame to make room.
+		q.log.Println("Queue is full - dropping the oldest frame in the queue")
+		if q.notify != nil {
+			q.notify(q.frames[0].frame, DropQueueFull)
+		}
+		putFrame(q.frames[0].frame)
+		q.frames = append(q.frames[:0], q.frames[1:]...)
+		q.dropped++
+	}
+	q.frames = append(q.frames, lifoQueueEntry{frame, now})
+	q.total++
+	q._refill(now)
 	return true
 }
 
-func (q *lifoQueue) pop() (*types.Frame, bool) { // nolint:unused
+// _expire drops any frames that have been queued for longer than the
+// maximum age. The mutex must be held when calling this function.
+func (q *lifoQueue) _expire(now time.Time) {
+	expired := 0
+	for expired < len(q.frames) && now.Sub(q.frames[expired].queued) > q.maxAge {
+		if q.notify != nil {
+			q.notify(q.frames[expired].frame, DropExpired)
+		}
+		putFrame(q.frames[expired].frame)
+		q.frames[expired] = lifoQueueEntry{}
+		expired++
+	}
+	if expired > 0 {
+		q.frames = append(q.frames[:0], q.frames[expired:]...)
+		q.expired += uint64(expired)
+	}
+}
+
+// _refill moves the newest frame into the next slot, if the slot is empty,
+// so that the writer can pick it up. The mutex must be held when calling
+// this function.
+func (q *lifoQueue) _refill(now time.Time) {
+	if len(q.next) > 0 {
+		return
+	}
+	// The writer has taken the pending frame, so remember it until the
+	// writer checks whether it is stale.
+	if q.pending.frame != nil {
+		q.popped, q.pending = q.pending, lifoQueueEntry{}
+	}
+	q._expire(now)
+	if len(q.frames) == 0 {
+		return
+	}
+	last := len(q.frames) - 1
+	entry := q.frames[last]
+	q.frames[last] = lifoQueueEntry{}
+	q.frames = q.frames[:last]
+	q.next <- entry.frame
+	q.pending = entry
+}
+
+// stale is called by the writer for a frame that it has taken from the
+// queue, just before writing it. It returns true if the frame has waited for
+// longer than maxAge since it was queued, in which case it is counted as
+// expired and must be dropped rather than written.
+func (q *lifoQueue) stale(frame *types.Frame) bool {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	if q.count == 0 {
-		return nil, false
-	}
-	index := q.size - q.count
-	frame := q.frames[index]
-	q.frames[index] = nil
-	q.count--
-	return frame, true
+	var entry lifoQueueEntry
+	switch frame {
+	case q.pending.frame:
+		entry, q.pending = q.pending, lifoQueueEntry{}
+	case q.popped.frame:
+		entry, q.popped = q.popped, lifoQueueEntry{}
+	default:
+		return false
+	}
+	if time.Since(entry.queued) <= q.maxAge {
+		return false
+	}
+	if q.notify != nil {
+		q.notify(frame, DropExpired)
+	}
+	q.expired++
+	return true
 }
 
-func (q *lifoQueue) ack() { // nolint:unused
-	// no-op on this queue type
+func (q *lifoQueue) pop() <-chan *types.Frame {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.next
+}
+
+func (q *lifoQueue) ack() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q._refill(time.Now())
 }
 
-func (q *lifoQueue) reset() { // nolint:unused
+func (q *lifoQueue) reset() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	q.count = 0
-	for i := range q.frames {
-		if q.frames[i] != nil {
-			framePool.Put(q.frames[i])
-			q.frames[i] = nil
+	for _, entry := range q.frames {
+		putFrame(entry.frame)
+	}
+	if q.next != nil {
+		select {
+		case frame := <-q.next:
+			putFrame(frame)
+		default:
+		}
+	}
+	q.frames = make([]lifoQueueEntry, 0, q.size)
+	q.next = make(chan *types.Frame, 1)
+	q.pending, q.popped = lifoQueueEntry{}, lifoQueueEntry{}
+}
+
+// take removes the matching frames from the queue and returns them, oldest
+// first.
+func (q *lifoQueue) take(fn func(*types.Frame) bool) []*types.Frame {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	select {
+	case <-q.next:
+		q.frames = append(q.frames, q.pending)
+		q.pending = lifoQueueEntry{}
+	default:
+	}
+	var taken []*types.Frame
+	kept := q.frames[:0]
+	for _, entry := range q.frames {
+		if fn(entry.frame) {
+			taken = append(taken, entry.frame)
+		} else {
+			kept = append(kept, entry)
 		}
 	}
-	close(q.notifs)
-	for range q.notifs {
+	for i := len(kept); i < len(q.frames); i++ {
+		q.frames[i] = lifoQueueEntry{}
 	}
-	q.notifs = make(chan struct{}, q.size)
+	q.frames = kept
+	q._refill(time.Now())
+	return taken
 }
 
-func (q *lifoQueue) wait() <-chan struct{} { // nolint:unused
+func (q *lifoQueue) MarshalJSON() ([]byte, error) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
-	return q.notifs
+	return json.Marshal(struct {
+		Count   int    `json:"count"`
+		Size    int    `json:"size"`
+		MaxAge  string `json:"max_age"`
+		Total   uint64 `json:"packets_total"`
+		Dropped uint64 `json:"packets_dropped"`
+		Expired uint64 `json:"packets_expired"`
+	}{
+		Count:   len(q.frames) + len(q.next),
+		Size:    q.size,
+		MaxAge:  q.maxAge.String(),
+		Total:   q.total,
+		Dropped: q.dropped,
+		Expired: q.expired,
+	})
 }
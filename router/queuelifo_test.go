@@ -0,0 +1,152 @@
+package router
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestLIFOQueueOrdering(t *testing.T) {
+	q := newLIFOQueue(3, time.Minute, log.New(ioutil.Discard, "", 0))
+
+	frames := make([]*types.Frame, 5)
+	for i := range frames {
+		frames[i] = &types.Frame{Extra: [2]byte{byte(i)}}
+		if !q.push(frames[i]) {
+			t.Fatalf("expected %d to be added", i)
+		}
+	}
+
+	// Only the newest three frames should remain, newest first.
+	if c := q.queuecount(); c != 3 {
+		t.Fatalf("expected queue count to be 3 but it was %d", c)
+	}
+	for _, i := range []int{4, 3, 2} {
+		select {
+		case frame := <-q.pop():
+			q.ack()
+			if frame != frames[i] {
+				t.Fatalf("expected frame %d but got frame %d", i, frame.Extra[0])
+			}
+		default:
+			t.Fatalf("expected frame %d to be waiting", i)
+		}
+	}
+	if c := q.queuecount(); c != 0 {
+		t.Fatalf("expected queue to be empty but count was %d", c)
+	}
+	if q.dropped != 2 {
+		t.Fatalf("expected 2 dropped frames but got %d", q.dropped)
+	}
+}
+
+func TestLIFOQueueExpiry(t *testing.T) {
+	q := newLIFOQueue(8, time.Millisecond*10, log.New(ioutil.Discard, "", 0))
+
+	for i := 0; i < 4; i++ {
+		q.push(&types.Frame{})
+	}
+	time.Sleep(time.Millisecond * 20)
+	fresh := &types.Frame{}
+	q.push(fresh)
+
+	if c := q.queuecount(); c != 1 {
+		t.Fatalf("expected queue count to be 1 but it was %d", c)
+	}
+	if q.expired != 4 {
+		t.Fatalf("expected 4 expired frames but got %d", q.expired)
+	}
+	select {
+	case frame := <-q.pop():
+		q.ack()
+		if frame != fresh {
+			t.Fatal("expected the fresh frame to be sent")
+		}
+	default:
+		t.Fatal("expected a frame to be waiting")
+	}
+}
+
+func TestLIFOQueueStale(t *testing.T) {
+	q := newLIFOQueue(8, time.Millisecond*10, log.New(ioutil.Discard, "", 0))
+	pop := func() *types.Frame {
+		select {
+		case frame := <-q.pop():
+			q.ack()
+			return frame
+		default:
+			t.Fatal("expected a frame to be waiting")
+			return nil
+		}
+	}
+
+	// A frame that is written straight away hasn't expired.
+	fresh := &types.Frame{}
+	q.push(fresh)
+	if q.stale(pop()) {
+		t.Fatal("expected the fresh frame to be written")
+	}
+
+	// The writer might take a frame and then not get around to writing it
+	// for a while, i.e. because the connection is slow, in which case it has
+	// to be dropped even though it is no longer in the queue, and even if
+	// another frame has been queued in the meantime.
+	first, second := &types.Frame{}, &types.Frame{}
+	q.push(first)
+	if frame := pop(); frame != first {
+		t.Fatal("expected the first frame")
+	}
+	q.push(second)
+	time.Sleep(time.Millisecond * 20)
+	if !q.stale(first) {
+		t.Fatal("expected the first frame to be dropped")
+	}
+	// The same goes for a frame that was waiting to be taken by the writer.
+	if frame := pop(); frame != second {
+		t.Fatal("expected the second frame")
+	}
+	if !q.stale(second) {
+		t.Fatal("expected the second frame to be dropped")
+	}
+	if q.expired != 2 {
+		t.Fatalf("expected 2 expired frames but got %d", q.expired)
+	}
+
+	// Frames that the queue doesn't know about are left alone.
+	if q.stale(&types.Frame{}) {
+		t.Fatal("expected an unknown frame to be written")
+	}
+}
+
+func TestLIFOQueueTake(t *testing.T) {
+	q := newLIFOQueue(8, time.Minute, log.New(ioutil.Discard, "", 0))
+
+	frames := make([]*types.Frame, 5)
+	for i := range frames {
+		frames[i] = &types.Frame{Extra: [2]byte{byte(i)}}
+		q.push(frames[i])
+	}
+
+	// The newest frame is waiting to be sent, but it can still be taken.
+	taken := q.take(func(f *types.Frame) bool { return f.Extra[0] >= 3 })
+	if len(taken) != 2 || taken[0] != frames[3] || taken[1] != frames[4] {
+		t.Fatalf("expected frames 3 and 4 to be taken, got %v", taken)
+	}
+	if c := q.queuecount(); c != 3 {
+		t.Fatalf("expected queue count to be 3 but it was %d", c)
+	}
+	for _, i := range []int{2, 1, 0} {
+		select {
+		case frame := <-q.pop():
+			q.ack()
+			if frame != frames[i] {
+				t.Fatalf("expected frame %d but got frame %d", i, frame.Extra[0])
+			}
+		default:
+			t.Fatalf("expected frame %d to be waiting", i)
+		}
+	}
+}
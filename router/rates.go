@@ -0,0 +1,176 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// frameRateWindow is the time constant of the inbound frame rates. A change
+// in the rate that a peer sends at is about two thirds reflected after this
+// long, so short bursts are smoothed out but a sustained storm isn't.
+const frameRateWindow = time.Second * 10
+
+// RouterFrameRateAlerts sets limits on how many frames of each type a peer
+// may send us per second, averaged over about ten seconds. When a peer goes
+// over the limit for a type, i.e. during a teardown storm, a
+// PeerFrameRateExceeded event is published and the callback, if given, is
+// run with the details, so that the peer can be disconnected or its port
+// disabled with SetPortEnabled. The alert isn't repeated until the rate has
+// fallen back below the limit. The callback runs on its own actor. Inbound
+// frame rates are tracked for every peer whether or not this option is
+// given, see PeerInfo.FrameRates.
+type RouterFrameRateAlerts struct {
+	Limits   map[types.FrameType]float64 // frames per second, by frame type
+	Callback func(alert FrameRateAlert)  // optional
+}
+
+func (a RouterFrameRateAlerts) isRouterOption() {}
+
+// FrameRateAlert describes a peer that went over the limit for a frame type,
+// see RouterFrameRateAlerts.
+type FrameRateAlert struct {
+	Port      types.SwitchPortID
+	PublicKey types.PublicKey
+	Type      types.FrameType
+	Rate      float64 // frames per second when the limit was exceeded
+	Limit     float64 // frames per second
+}
+
+// FrameRates are the average rates that frames are received from a peer, in
+// frames per second, by frame type. Types that the peer has never sent are
+// left out.
+type FrameRates map[types.FrameType]float64
+
+// frameRateAlerts holds the limits and callback for RouterFrameRateAlerts.
+type frameRateAlerts struct {
+	phony.Inbox
+	limits [frameTypeCount]float64 // 0 if there is no limit for the type
+	fn     func(alert FrameRateAlert)
+}
+
+func newFrameRateAlerts(v RouterFrameRateAlerts) *frameRateAlerts {
+	a := &frameRateAlerts{fn: v.Callback}
+	for t, limit := range v.Limits {
+		if int(t) < frameTypeCount && limit > 0 {
+			a.limits[t] = limit
+		}
+	}
+	return a
+}
+
+// frameRates tracks the rate of inbound frames of each type from a peer as an
+// exponentially weighted moving average. It is updated by the peer's reader
+// and can be read from anywhere.
+type frameRates struct {
+	mutex    sync.Mutex
+	rates    [frameTypeCount]float64   // as of the last frame of the type
+	last     [frameTypeCount]time.Time // when the last frame of the type arrived
+	exceeded [frameTypeCount]bool      // over the limit, so don't alert again
+}
+
+// decayed returns the rate for the type as of now. The mutex must be held.
+func (r *frameRates) decayed(t types.FrameType, now time.Time) float64 {
+	if r.last[t].IsZero() {
+		return 0
+	}
+	return r.rates[t] * math.Exp(-float64(now.Sub(r.last[t]))/float64(frameRateWindow))
+}
+
+// observe counts a frame of the given type and returns the new rate for the
+// type. If a limit is given, it also returns true if the rate has just gone
+// over it.
+func (r *frameRates) observe(t types.FrameType, now time.Time, limit float64) (float64, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	// Every frame adds to the rate and then decays away, so a peer sending
+	// steadily at n frames per second settles at a rate of n.
+	rate := r.decayed(t, now) + float64(time.Second)/float64(frameRateWindow)
+	r.rates[t], r.last[t] = rate, now
+	if limit <= 0 {
+		return rate, false
+	}
+	over := rate > limit
+	alert := over && !r.exceeded[t]
+	r.exceeded[t] = over
+	return rate, alert
+}
+
+// snapshot returns the current rates, or nil if nothing has been received.
+func (r *frameRates) snapshot() FrameRates {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	var rates FrameRates
+	for t := 0; t < frameTypeCount; t++ {
+		if r.last[t].IsZero() {
+			continue
+		}
+		if rates == nil {
+			rates = FrameRates{}
+		}
+		rates[types.FrameType(t)] = r.decayed(types.FrameType(t), now)
+	}
+	return rates
+}
+
+// observeFrame counts a frame received from the peer, raising an alert if
+// the peer has gone over the limit for the frame type. It must only be called
+// from the peer's reader.
+func (p *peer) observeFrame(t types.FrameType) {
+	if p.rates == nil || int(t) >= frameTypeCount {
+		return
+	}
+	var limit float64
+	alerts := p.router.rateAlerts
+	if alerts != nil {
+		limit = alerts.limits[t]
+	}
+	rate, exceeded := p.rates.observe(t, time.Now(), limit)
+	if !exceeded {
+		return
+	}
+	p.router.log.Printf("Peer %s on port %d is sending %s frames at %.1f/s, over the limit of %.1f/s", p.public.String(), p.port, t, rate, limit)
+	p.router.Act(nil, func() {
+		p.router._publish(events.PeerFrameRateExceeded{
+			Port:      p.port,
+			PeerID:    p.public.String(),
+			FrameType: t,
+			Rate:      rate,
+			Limit:     limit,
+		})
+	})
+	if alerts.fn != nil {
+		alert := FrameRateAlert{
+			Port:      p.port,
+			PublicKey: p.public,
+			Type:      t,
+			Rate:      rate,
+			Limit:     limit,
+		}
+		alerts.Act(nil, func() {
+			alerts.fn(alert)
+		})
+	}
+}
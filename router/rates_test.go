@@ -0,0 +1,111 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestFrameRatesAverage(t *testing.T) {
+	r := &frameRates{}
+	start := time.Now()
+	var rate float64
+	var alerts int
+	// A steady 50 frames per second for a minute should settle close to 50,
+	// with a single alert once it goes over the limit.
+	for i := 0; i < 50*60; i++ {
+		var alert bool
+		rate, alert = r.observe(types.TypeTreeRouted, start.Add(time.Second*time.Duration(i)/50), 20)
+		if alert {
+			alerts++
+		}
+	}
+	if rate < 45 || rate > 55 {
+		t.Fatalf("expected a rate of about 50/s, got %.1f/s", rate)
+	}
+	if alerts != 1 {
+		t.Fatalf("expected one alert, got %d", alerts)
+	}
+
+	// Once the peer has gone quiet, the rate falls below the limit and the
+	// next burst alerts again.
+	later := start.Add(time.Minute * 2)
+	if rate, alert := r.observe(types.TypeTreeRouted, later, 20); alert || rate > 20 {
+		t.Fatalf("expected the rate to have fallen, got %.1f/s", rate)
+	}
+	alerts = 0
+	for i := 0; i < 50*60; i++ {
+		if _, alert := r.observe(types.TypeTreeRouted, later.Add(time.Second*time.Duration(i)/50), 20); alert {
+			alerts++
+		}
+	}
+	if alerts != 1 {
+		t.Fatalf("expected one more alert, got %d", alerts)
+	}
+}
+
+func TestFrameRateAlerts(t *testing.T) {
+	alerts := make(chan FrameRateAlert, 1)
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false, RouterFrameRateAlerts{
+		Limits: map[types.FrameType]float64{types.TypeTreeRouted: 5},
+		Callback: func(alert FrameRateAlert) {
+			select {
+			case alerts <- alert:
+			default:
+			}
+		},
+	})
+	rb := NewRouter(nil, skb, false)
+	defer ra.Close()
+	defer rb.Close()
+	connectPair(t, ra, rb)
+	waitFor(t, "tree", func() bool {
+		return ra.Coords().DistanceTo(rb.Coords()) == 1
+	})
+
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			if _, _, err := ra.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	// Keep the storm going until the alert arrives, since some of the frames
+	// might be dropped on the way.
+	var alert FrameRateAlert
+	deadline := time.After(time.Second * 10)
+storm:
+	for {
+		if _, err := rb.WriteTo([]byte("storm"), ra.Coords()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case alert = <-alerts:
+			break storm
+		case <-deadline:
+			t.Fatal("expected an alert")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if alert.PublicKey != rb.PublicKey() || alert.Type != types.TypeTreeRouted || alert.Limit != 5 || alert.Rate <= 5 {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+	peers := ra.Peers()
+	if len(peers) != 2 {
+		t.Fatalf("expected the local router and one peer, got %d", len(peers))
+	}
+	for _, p := range peers {
+		if p.Port == 0 {
+			if p.FrameRates != nil {
+				t.Fatalf("expected no frame rates for the local router, got %v", p.FrameRates)
+			}
+		} else if rate := p.FrameRates[types.TypeTreeRouted]; rate <= 5 {
+			t.Fatalf("expected a tree routed rate above 5/s, got %.1f/s", rate)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// receiptTimeout is how long WriteToWithReceipt waits for a receipt before
+// the delivery is given up on.
+const receiptTimeout = time.Second * 5
+
+// Delivery tracks a packet that was sent with WriteToWithReceipt until the
+// destination acknowledges it or the receipt timeout passes. A receipt means
+// that the packet reached the destination router, not that an application
+// there has read it.
+type Delivery struct {
+	sequence uint64
+	dest     types.PublicKey
+	sent     time.Time
+	done     chan struct{}
+	timer    *time.Timer
+	err      error         // only safe to read once done is closed
+	rtt      time.Duration // only safe to read once done is closed
+}
+
+// receipts are the deliveries that are waiting for receipts, by sequence
+// number.
+type receipts map[uint64]*Delivery
+
+// Sequence returns the sequence number that the destination was asked to
+// acknowledge.
+func (d *Delivery) Sequence() uint64 {
+	return d.sequence
+}
+
+// Done returns a channel that is closed once a receipt has arrived or the
+// delivery has failed.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns nil if the packet was acknowledged, ErrReceiptTimeout if no
+// receipt arrived in time, or nil if the delivery hasn't finished yet.
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// RTT returns how long it took for the receipt to arrive, or zero if it
+// hasn't (yet).
+func (d *Delivery) RTT() time.Duration {
+	select {
+	case <-d.done:
+		return d.rtt
+	default:
+		return 0
+	}
+}
+
+// Wait blocks until the delivery has finished or the context is done, and
+// returns the result of the delivery or the error from the context.
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Delivery) finish(err error) {
+	if err == nil {
+		d.rtt = time.Since(d.sent)
+	}
+	d.err = err
+	close(d.done)
+}
+
+// WriteToWithReceipt sends a packet to the node with the given public key,
+// in the same way as WriteTo, but also asks the destination to send back a
+// signed receipt for it. This lets applications that don't have their own
+// transport layer find out whether their packets are being lost. The
+// returned Delivery finishes when the receipt arrives, or fails with
+// ErrReceiptTimeout if it doesn't arrive within 5 seconds. Nodes that don't
+// support receipts still deliver the packet but never acknowledge it.
+func (r *Router) WriteToWithReceipt(p []byte, dest types.PublicKey) (*Delivery, error) {
+	frame, loopback, err := r.localFrame(p, dest)
+	if err != nil {
+		return nil, err
+	}
+	d := &Delivery{
+		dest: dest,
+		sent: time.Now(),
+		done: make(chan struct{}),
+	}
+	if loopback {
+		if err = r.loopback(frame); err != nil {
+			return nil, err
+		}
+		d.finish(nil)
+		return d, nil
+	}
+	phony.Block(r.state, func() {
+		r.state._receiptSequence++
+		d.sequence = r.state._receiptSequence
+		var value [types.ReceiptRequestSize]byte
+		binary.BigEndian.PutUint64(value[:], d.sequence)
+		if err = frame.SetExtension(types.ExtensionTypeReceipt, value[:]); err != nil {
+			putFrame(frame)
+			err = fmt.Errorf("frame.SetExtension: %w", err)
+			return
+		}
+		if err = r.state._forward(r.local, frame); err != nil {
+			return
+		}
+		r.state._receipts[d.sequence] = d
+		d.timer = time.AfterFunc(receiptTimeout, func() {
+			r.state.Act(nil, func() {
+				r.state._finishReceipt(d.sequence, ErrReceiptTimeout)
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// _finishReceipt finishes the delivery with the given sequence number, if it
+// is still waiting for a receipt.
+func (s *state) _finishReceipt(sequence uint64, err error) {
+	d, ok := s._receipts[sequence]
+	if !ok {
+		return
+	}
+	delete(s._receipts, sequence)
+	d.timer.Stop()
+	d.finish(err)
+}
+
+// _sendReceipt acknowledges a frame that has been delivered to us, if the
+// sender asked for a receipt.
+func (s *state) _sendReceipt(sender types.PublicKey, sequence uint64) {
+	receipt := types.NewReceipt(s.r.private, sender, sequence)
+	var buf [types.ReceiptSize]byte
+	n, err := receipt.MarshalBinary(buf[:])
+	if err != nil {
+		return
+	}
+	s._sendKeyspaceFrame(sender, types.FrameFlagReceipt, buf[:n])
+}
+
+// _handleReceiptFrame handles a SNEK-routed frame that has been delivered to
+// us with FrameFlagReceipt set. Receipts are only accepted if they are signed
+// by the node that the packet was sent to.
+func (s *state) _handleReceiptFrame(f *types.Frame) {
+	var receipt types.Receipt
+	if _, err := receipt.UnmarshalBinary(f.Payload); err != nil {
+		return
+	}
+	d, ok := s._receipts[receipt.Sequence]
+	switch {
+	case !ok:
+		return
+	case receipt.Receiver != d.dest || receipt.Receiver != f.SourceKey:
+		return
+	case !s.r.answersTo(receipt.Sender):
+		return
+	case receipt.Verify() != nil:
+		return
+	}
+	s._finishReceipt(receipt.Sequence, nil)
+}
+
+// receiptRequest returns the sequence number from the ExtensionTypeReceipt
+// extension on the frame, if there is one.
+func receiptRequest(f *types.Frame) (uint64, bool) {
+	value, ok := f.Extension(types.ExtensionTypeReceipt)
+	if !ok || len(value) != types.ReceiptRequestSize {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(value), true
+}
@@ -0,0 +1,93 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/test/fixtures"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestWriteToWithReceipt(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	ra, rb := routers[0], routers[1]
+
+	d, err := ra.WriteToWithReceipt([]byte("hello"), rb.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, types.MaxPayloadSize)
+	n, _, err := rb.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := d.Wait(ctx); err != nil {
+		t.Fatalf("expected a receipt, got %s", err)
+	}
+	if d.RTT() <= 0 {
+		t.Fatal("expected the round trip time to be known")
+	}
+
+	d2, err := ra.WriteToWithReceipt([]byte("again"), rb.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2.Sequence() == d.Sequence() {
+		t.Fatal("expected a new sequence number")
+	}
+	if err := d2.Wait(ctx); err != nil {
+		t.Fatalf("expected a receipt, got %s", err)
+	}
+}
+
+func TestWriteToWithReceiptTimeout(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	ra := routers[0]
+
+	// Nobody has this key, so the packet ends up at whichever node is
+	// closest to it, which doesn't answer.
+	dest := fixtures.PublicKey(t.Name(), "nobody")
+	d, err := ra.WriteToWithReceipt([]byte("hello"), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A receipt that isn't signed by the destination is ignored.
+	forged := types.NewReceipt(ra.PrivateKey(), ra.PublicKey(), d.Sequence())
+	var buf [types.ReceiptSize]byte
+	n, _ := forged.MarshalBinary(buf[:])
+	f := getFrame()
+	f.Type = types.TypeVirtualSnakeRouted
+	f.Extra[0] = types.FrameFlagReceipt
+	f.SourceKey = ra.PublicKey()
+	f.Payload = append(f.Payload[:0], buf[:n]...)
+	phony.Block(ra.state, func() {
+		ra.state._handleReceiptFrame(f)
+	})
+	if err := d.Err(); err != nil {
+		t.Fatalf("expected the delivery to still be waiting, got %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), receiptTimeout*2)
+	defer cancel()
+	if err := d.Wait(ctx); err != ErrReceiptTimeout {
+		t.Fatalf("expected %s, got %v", ErrReceiptTimeout, err)
+	}
+}
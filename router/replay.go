@@ -0,0 +1,127 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Bootstraps carry the time that they were sent, in milliseconds, as their
+// sequence number. The routing table entry for a bootstrapping key already
+// refuses anything older than the entry itself, but once the entry has
+// expired or been evicted, a recorded bootstrap could be replayed to put the
+// old path back. The replay windows remember what we have seen from each
+// origin for longer than that.
+//
+// A sequence number that we haven't seen yet is still accepted if it is less
+// than a bootstrap interval behind the highest one from the origin, so that
+// bootstraps that were reordered on the way aren't mistaken for replays. An
+// origin is remembered for an announcement timeout after we stop hearing
+// from it, after which the root will have sent a new announcement, so that a
+// replayed bootstrap fails the root check instead.
+const (
+	// replayWindowSeen is how many sequence numbers within the span we will
+	// remember for each origin.
+	replayWindowSeen = 16
+	// replayWindowLimit is the most origins that we will remember at once.
+	replayWindowLimit = 4096
+)
+
+// replayWindow tracks the sequence numbers seen from a single origin.
+type replayWindow struct {
+	highest uint64    // highest sequence number accepted
+	seen    []uint64  // sequence numbers accepted within the span
+	updated time.Time // when a sequence number was last accepted
+}
+
+// accept returns true if the sequence number hasn't been seen before and is
+// within the span of the highest one, recording it if so.
+func (w *replayWindow) accept(seq, span uint64) bool {
+	switch {
+	case seq > w.highest:
+		w.highest = seq
+	case w.highest-seq >= span:
+		return false
+	default:
+		for _, s := range w.seen {
+			if s == seq {
+				return false
+			}
+		}
+	}
+	// Forget anything that has fallen out of the span. If there are still
+	// too many left then the oldest goes, after which its sequence number
+	// is refused as too old.
+	seen := w.seen[:0]
+	for _, s := range w.seen {
+		if w.highest-s < span {
+			seen = append(seen, s)
+		}
+	}
+	w.seen = append(seen, seq)
+	if len(w.seen) > replayWindowSeen {
+		oldest := 0
+		for i, s := range w.seen {
+			if s < w.seen[oldest] {
+				oldest = i
+			}
+		}
+		w.seen = append(w.seen[:oldest], w.seen[oldest+1:]...)
+	}
+	return true
+}
+
+// replayTable holds the replay window for each origin.
+type replayTable map[types.PublicKey]*replayWindow
+
+// _acceptSequence returns true if the sequence number from the given origin
+// isn't a replay. Windows that haven't been updated in a while are treated
+// as new, and if there are too many origins then the one that we heard from
+// least recently is forgotten.
+func (s *state) _acceptSequence(origin types.PublicKey, seq uint64) bool {
+	now := s.r.clock.now()
+	w, ok := s._replays[origin]
+	if ok && now.Sub(w.updated) > s.r.timers.announcementTimeout {
+		ok = false
+	}
+	if !ok {
+		if _, exists := s._replays[origin]; !exists && len(s._replays) >= replayWindowLimit {
+			s._evictReplayWindow()
+		}
+		w = &replayWindow{}
+		s._replays[origin] = w
+	}
+	if !w.accept(seq, uint64(s.r.timers.bootstrapInterval/time.Millisecond)) {
+		s._bootstrapsReplayed++
+		return false
+	}
+	w.updated = now
+	return true
+}
+
+// _evictReplayWindow removes the window for the origin that we heard from
+// least recently.
+func (s *state) _evictReplayWindow() {
+	var oldest types.PublicKey
+	var when time.Time
+	for key, w := range s._replays {
+		if when.IsZero() || w.updated.Before(when) {
+			oldest, when = key, w.updated
+		}
+	}
+	delete(s._replays, oldest)
+}
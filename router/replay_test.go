@@ -0,0 +1,118 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestReplayWindow(t *testing.T) {
+	span := uint64(virtualSnakeBootstrapInterval / time.Millisecond)
+	var w replayWindow
+	for _, tc := range []struct {
+		seq    uint64
+		accept bool
+	}{
+		{100000, true},
+		{100000, false}, // seen already
+		{101000, true},
+		{100500, true}, // reordered, but within the span
+		{100500, false},
+		{101000 - span, false}, // too old
+		{200000, true},
+		{101000, false}, // everything before has fallen out of the span
+	} {
+		if got := w.accept(tc.seq, span); got != tc.accept {
+			t.Fatalf("sequence %d: expected %v but got %v", tc.seq, tc.accept, got)
+		}
+	}
+
+	// Only so many sequence numbers are remembered within the span, after
+	// which the oldest are refused.
+	w = replayWindow{}
+	for i := uint64(1); i <= replayWindowSeen+1; i++ {
+		if !w.accept(span+i, span) {
+			t.Fatalf("sequence %d: expected to be accepted", span+i)
+		}
+	}
+	if len(w.seen) != replayWindowSeen {
+		t.Fatalf("expected %d remembered sequences but got %d", replayWindowSeen, len(w.seen))
+	}
+}
+
+func TestBootstrapReplayRefused(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	_, remote, _ := ed25519.GenerateKey(nil)
+	var public types.PublicKey
+	copy(public[:], remote.Public().(ed25519.PublicKey))
+	index := virtualSnakeIndex{PublicKey: public}
+
+	var first, replayed, newer bool
+	var replays uint64
+	var err error
+	phony.Block(r.state, func() {
+		s := r.state
+		bootstrap := func(seq uint64) *types.Frame {
+			b := types.VirtualSnakeBootstrap{Root: s._rootAnnouncement().Root}
+			b.Sequence = types.Varu64(seq)
+			protected, perr := b.ProtectedPayload()
+			if perr != nil {
+				err = perr
+				return nil
+			}
+			copy(b.Signature[:], ed25519.Sign(remote, protected))
+			var buf [types.MaxFrameSize]byte
+			n, merr := b.MarshalBinary(buf[:])
+			if merr != nil {
+				err = merr
+				return nil
+			}
+			f := getFrame()
+			f.Type = types.TypeVirtualSnakeBootstrap
+			f.DestinationKey = public
+			f.Payload = append(f.Payload[:0], buf[:n]...)
+			return f
+		}
+		seq := uint64(s.r.clock.now().UnixMilli())
+		recorded := bootstrap(seq)
+		if err != nil {
+			return
+		}
+		first = s._handleBootstrap(s.r.local, nil, recorded)
+
+		// Once the routing table entry has gone, the recorded bootstrap
+		// would have been accepted again without the replay window.
+		if entry, ok := s._table[index]; ok {
+			if s._descending == entry {
+				s._setDescendingNode(nil)
+			}
+			s._removeRouteEntry(index)
+		}
+		replayed = s._handleBootstrap(s.r.local, nil, recorded)
+		if f := bootstrap(seq + 1); err == nil {
+			newer = s._handleBootstrap(s.r.local, nil, f)
+		}
+		replays = s._bootstrapsReplayed
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first {
+		t.Fatal("expected the first bootstrap to be accepted")
+	}
+	if replayed {
+		t.Fatal("expected the replayed bootstrap to be refused")
+	}
+	if !newer {
+		t.Fatal("expected a newer bootstrap to be accepted")
+	}
+	if replays != 1 {
+		t.Fatalf("expected 1 replayed bootstrap but got %d", replays)
+	}
+}
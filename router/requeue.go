@@ -0,0 +1,105 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/matrix-org/pinecone/types"
+)
+
+// _requeueFrom routes the traffic frames that were waiting to be sent to a
+// peer again after the peer has been disconnected, so that they aren't lost
+// along with the peering. This must be called after the peer has been removed,
+// so that it can't be picked as the next-hop again. Frames that have nowhere
+// else to go are dropped.
+func (s *state) _requeueFrom(p *peer, frames []*types.Frame) {
+	if len(frames) == 0 {
+		return
+	}
+	purge := s.dropHandlerFor(p.public)
+	for _, f := range frames {
+		nexthop, watermark := s._requeueHop(p, f)
+		// Frames are only moved to another peer. We don't deliver them to
+		// the local router here, since they weren't meant for us when they
+		// were queued.
+		if nexthop == nil || nexthop == p || nexthop == s.r.local {
+			purge(f, DropPurged)
+			putFrame(f)
+			s._queuePurged++
+			continue
+		}
+		if watermark.Sequence > 0 {
+			f.Watermark = watermark
+		}
+		if !nexthop.send(f) {
+			s.r.conformance.drop(DropQueueFull, nexthop.public, f)
+			continue
+		}
+		s._queueRequeued++
+	}
+}
+
+// _requeueHop returns the next-hop for a frame that was queued for the given
+// peer, as though the frame had arrived from that peer. It returns nil if the
+// frame can't be forwarded without making the watermark worse.
+func (s *state) _requeueHop(from *peer, f *types.Frame) (*peer, types.VirtualSnakeWatermark) {
+	switch {
+	case f.Type == types.TypeTreeRouted, len(f.Destination) > 0:
+		// SNEK frames that have fallen back to tree routing carry on
+		// being tree routed, as in _handleSnakeRoutedFrame.
+		return s._nextHopsTree(from, f.Destination), f.Watermark
+	case f.Type == types.TypeVirtualSnakeRouted:
+		nexthop, watermark := s._nextHopsSNEK(f.DestinationKey, f.Type, f.Watermark)
+		if watermark.WorseThan(f.Watermark) {
+			return nil, watermark
+		}
+		return nexthop, watermark
+	default:
+		return nil, f.Watermark
+	}
+}
+
+// _requeueMoved moves tree-routed frames that are waiting in the queue of one
+// peer to another, if our coordinates have changed since they were queued and
+// the other peer now takes them closer to their destination instead. Frames
+// that no longer have a next-hop at all are left where they are, since the rest
+// of the tree may not have caught up with the change yet.
+func (s *state) _requeueMoved() {
+	for _, p := range s._peers {
+		if p == nil || p.port == 0 || !p.started.Load() {
+			continue
+		}
+		p := p
+		frames := p.traffic.take(func(f *types.Frame) bool {
+			nexthop := s._requeueTreeHop(f)
+			return nexthop != nil && nexthop != p && nexthop != s.r.local
+		})
+		for _, f := range frames {
+			if !s._requeueTreeHop(f).send(f) {
+				s.r.conformance.drop(DropQueueFull, p.public, f)
+				continue
+			}
+			s._queueRequeued++
+		}
+	}
+}
+
+// _requeueTreeHop returns the tree next-hop for a queued frame, or nil if the
+// frame isn't being tree routed.
+func (s *state) _requeueTreeHop(f *types.Frame) *peer {
+	if f.Type != types.TypeTreeRouted && len(f.Destination) == 0 {
+		return nil
+	}
+	return s._nextHopsTree(s.r.local, f.Destination)
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+)
+
+func TestRequeuePurgesWithoutRoute(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false, RouterStrictConformance{})
+	rb := NewRouter(nil, skb, false)
+	defer ra.Close()
+	defer rb.Close()
+
+	pa, pb := net.Pipe()
+	conn := &stallConn{Conn: pa}
+	port, _ := connectEnds(t, pairEnd{ra, conn, nil}, pairEnd{rb, pb, nil})
+	waitFor(t, "convergence", func() bool {
+		return sameRoot([]*Router{ra, rb}) && ra.Coords().DistanceTo(rb.Coords()) == 1
+	})
+
+	// Once the connection stops taking writes, traffic for rb waits in the
+	// queue for the peering. The writer holds on to the first frame while it
+	// is stuck, so wait for more than one.
+	conn.hold.Lock()
+	defer conn.hold.Unlock()
+	dest, payload := rb.Coords(), make([]byte, peerWriteBatchSize/4)
+	waitFor(t, "traffic to be queued", func() bool {
+		if _, err := ra.WriteTo(payload, dest); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range ra.DebugStats().Peers {
+			if p.Port == port && p.TrafficCount > 1 {
+				return true
+			}
+		}
+		return false
+	})
+
+	// When the peering goes away there is nowhere else for the traffic to go,
+	// so it is purged rather than being left to the writer.
+	ra.Disconnect(port, nil)
+	waitFor(t, "frames to be purged", func() bool {
+		return ra.DebugStats().QueuePurged > 0
+	})
+	if stats := ra.DebugStats(); stats.QueueRequeued != 0 {
+		t.Fatalf("expected no frames to be requeued, got %d", stats.QueueRequeued)
+	}
+	if drops := ra.DropCounts(); drops[DropPurged] == 0 {
+		t.Fatal("expected the purged frames to be counted as drops")
+	}
+}
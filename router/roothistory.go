@@ -0,0 +1,119 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// rootHistoryLength is how many root announcements the root history keeps,
+// across all peers. Unlike the per-peer announcement history, entries are
+// kept after the peer that sent them has gone away, so that the history can
+// explain why we re-rooted after losing a peering.
+const rootHistoryLength = 256
+
+// RootHistoryEntry describes a root announcement that we received from a peer
+// and what we did with it.
+type RootHistoryEntry struct {
+	Time          time.Time          `json:"time"`
+	Port          types.SwitchPortID `json:"port"`
+	Peer          types.PublicKey    `json:"peer"`
+	Root          types.PublicKey    `json:"root"`
+	Sequence      types.Varu64       `json:"sequence"`
+	Depth         int                `json:"depth"`
+	Accepted      bool               `json:"accepted"`
+	Outcome       string             `json:"outcome"` // the action taken, or why it was rejected
+	Waiting       bool               `json:"waiting,omitempty"`
+	RootChanged   bool               `json:"root_changed,omitempty"`
+	ParentChanged bool               `json:"parent_changed,omitempty"`
+}
+
+// rootHistory is a ring buffer of the most recent root announcements.
+type rootHistory struct {
+	entries []RootHistoryEntry
+	next    int
+}
+
+// add records an entry, overwriting the oldest one if the buffer is full.
+func (h *rootHistory) add(entry RootHistoryEntry) {
+	if len(h.entries) < rootHistoryLength {
+		h.entries = append(h.entries, entry)
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % rootHistoryLength
+}
+
+// list returns a copy of the entries, oldest first.
+func (h *rootHistory) list() []RootHistoryEntry {
+	entries := make([]RootHistoryEntry, 0, len(h.entries))
+	entries = append(entries, h.entries[h.next:]...)
+	return append(entries, h.entries[:h.next]...)
+}
+
+// _recordRootAnnouncement adds an announcement from the given peer to the
+// root history. If the announcement was rejected then reason says why,
+// otherwise the action taken is recorded, along with whether it changed our
+// root or our parent.
+func (s *state) _recordRootAnnouncement(p *peer, ann *types.SwitchAnnouncement, reason string, action TreeAnnouncementAction, waiting bool, lastRoot types.PublicKey, lastParent *peer) {
+	entry := RootHistoryEntry{
+		Time: s.r.clock.now(),
+		Port: p.port,
+		Peer: p.public,
+	}
+	if ann != nil {
+		entry.Root = ann.RootPublicKey
+		entry.Sequence = ann.RootSequence
+		entry.Depth = len(ann.Signatures)
+	}
+	if reason != "" {
+		entry.Outcome = reason
+	} else {
+		entry.Accepted = action != DropFrame && !waiting
+		entry.Outcome = action.String()
+		entry.Waiting = waiting
+		entry.RootChanged = s._rootAnnouncement().RootPublicKey != lastRoot
+		entry.ParentChanged = s._parent != lastParent
+	}
+	s._rootHistory.add(entry)
+}
+
+// RootHistory returns the most recent root announcements that we have
+// received from our peers and what became of them, oldest first. This is
+// useful for working out why a node re-rooted or why its coordinates keep
+// changing.
+func (r *Router) RootHistory() []RootHistoryEntry {
+	var entries []RootHistoryEntry
+	phony.Block(r.state, func() {
+		entries = r.state._rootHistory.list()
+	})
+	return entries
+}
+
+// RootHistoryHandler is an HTTP handler that returns the output of
+// RootHistory as JSON.
+func (r *Router) RootHistoryHandler(w http.ResponseWriter, req *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r.RootHistory()); err != nil {
+		w.WriteHeader(500)
+		return
+	}
+}
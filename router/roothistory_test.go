@@ -0,0 +1,60 @@
+package router
+
+import (
+	"testing"
+)
+
+func TestRootHistoryRing(t *testing.T) {
+	var h rootHistory
+	for i := 0; i < rootHistoryLength+10; i++ {
+		h.add(RootHistoryEntry{Depth: i})
+	}
+	entries := h.list()
+	if len(entries) != rootHistoryLength {
+		t.Fatalf("expected %d entries, got %d", rootHistoryLength, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Depth != i+10 {
+			t.Fatalf("expected entry %d to have depth %d, got %d", i, i+10, entry.Depth)
+		}
+	}
+}
+
+func TestRootHistory(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	r, root := routers[0], routers[1]
+	if r.TreeInfo().IsRoot() {
+		r, root = root, r
+	}
+	entries := r.RootHistory()
+	if len(entries) == 0 {
+		t.Fatal("expected root announcements in the history")
+	}
+	adopted := false
+	for _, entry := range entries {
+		if entry.Peer != root.PublicKey() || entry.Root != root.PublicKey() {
+			t.Fatalf("unexpected announcement from %s with root %s", entry.Peer, entry.Root)
+		}
+		if entry.Accepted && entry.RootChanged && entry.ParentChanged {
+			adopted = true
+		}
+	}
+	if !adopted {
+		t.Fatalf("expected the root to have been adopted, got %+v", entries)
+	}
+
+	// The history outlives the peering that the announcements came from.
+	r.Disconnect(entries[0].Port, nil)
+	waitFor(t, "the peering to go away", func() bool {
+		return r.PeerCount(-1) == 0
+	})
+	if after := r.RootHistory(); len(after) < len(entries) {
+		t.Fatalf("expected at least %d entries after disconnecting, got %d", len(entries), len(after))
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// RouterPredecessorKey lets a node that has been restarted with a new key
+// keep answering to the key that it had before until the given time, so that
+// nodes which only know the previous key can still reach it while they learn
+// about the new one. The router signs a key rotation from the previous key to
+// the new one, which the session layer hands out so that either key resolves
+// to the same node.
+type RouterPredecessorKey struct {
+	PrivateKey ed25519.PrivateKey
+	Until      time.Time
+}
+
+func (k RouterPredecessorKey) isRouterOption() {}
+
+// keyRotation is a key rotation that the router is taking part in, along with
+// the other key that the router answers to while the rotation is valid.
+type keyRotation struct {
+	types.KeyRotation
+	alias   types.PublicKey  // the key that we answer to besides our own
+	private types.PrivateKey // the private key for the alias
+}
+
+// RotateKey starts moving the router to the given successor key. For the
+// length of the window, the router will answer to the successor key as well
+// as to its current key, by taking part in the snake under both. The returned
+// rotation is signed by the current key and should be distributed to anyone
+// who needs to find the node by its new key. Once the window is over, the
+// router should be restarted with the successor key, optionally using the
+// RouterPredecessorKey option to keep answering to the old key for a while
+// longer. Starting a new rotation replaces any rotation already in progress.
+// An error is returned if the successor isn't a complete ed25519 private key.
+func (r *Router) RotateKey(successor ed25519.PrivateKey, window time.Duration) (*types.KeyRotation, error) {
+	if len(successor) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("successor key is %d bytes, expected %d", len(successor), ed25519.PrivateKeySize)
+	}
+	var private types.PrivateKey
+	copy(private[:], successor)
+	rotation, err := types.NewKeyRotation(r.private, private.Public(), r.clock.now().Add(window))
+	if err != nil {
+		return nil, fmt.Errorf("types.NewKeyRotation: %w", err)
+	}
+	r.rotation.Store(&keyRotation{
+		KeyRotation: *rotation,
+		alias:       rotation.Successor,
+		private:     private,
+	})
+	r.log.Println("Rotating to key", rotation.Successor, "until", rotation.ExpiresAt())
+	r.state.Act(nil, r.state._bootstrapSoon)
+	return rotation, nil
+}
+
+// KeyRotation returns the key rotation that the router is currently taking
+// part in, either as the previous key or as the successor, or nil if there
+// isn't one or it has expired.
+func (r *Router) KeyRotation() *types.KeyRotation {
+	if rotation := r.rotating(); rotation != nil {
+		rotation := rotation.KeyRotation
+		return &rotation
+	}
+	return nil
+}
+
+// KeyRotationPrivateKey returns the private key for the other key in the key
+// rotation that is in progress, that is, the successor key if we are rotating
+// away from our current key, or the predecessor key if we were created with
+// the RouterPredecessorKey option. It returns false if there is no rotation
+// in progress.
+func (r *Router) KeyRotationPrivateKey() (types.PrivateKey, bool) {
+	if rotation := r.rotating(); rotation != nil {
+		return rotation.private, true
+	}
+	return types.PrivateKey{}, false
+}
+
+// rotating returns the current key rotation, or nil if there isn't one or it
+// has expired. It is safe to call from any actor.
+func (r *Router) rotating() *keyRotation {
+	rotation, _ := r.rotation.Load().(*keyRotation)
+	if rotation == nil || !r.clock.now().Before(rotation.ExpiresAt()) {
+		return nil
+	}
+	return rotation
+}
+
+// answersTo returns true if frames for the given key should be delivered to
+// this router, either because it is our key or because it is the other key
+// in a key rotation that is in progress.
+func (r *Router) answersTo(key types.PublicKey) bool {
+	if key == r.public {
+		return true
+	}
+	rotation := r.rotating()
+	return rotation != nil && key == rotation.alias
+}
+
+// predecessorRotation sets up a key rotation from a previous key to our own,
+// for a router created with the RouterPredecessorKey option.
+func (r *Router) predecessorRotation(k RouterPredecessorKey) error {
+	var private types.PrivateKey
+	copy(private[:], k.PrivateKey)
+	rotation, err := types.NewKeyRotation(private, r.public, k.Until)
+	if err != nil {
+		return fmt.Errorf("types.NewKeyRotation: %w", err)
+	}
+	r.rotation.Store(&keyRotation{
+		KeyRotation: *rotation,
+		alias:       rotation.Previous,
+		private:     private,
+	})
+	return nil
+}
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestRotateKey(t *testing.T) {
+	routers := newBenchChain(t, 3)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	// Root nodes don't bootstrap, so rotate a node that isn't the root and
+	// send to it from another.
+	var rotating, sender *Router
+	for _, r := range routers {
+		switch {
+		case r.TreeInfo().IsRoot():
+		case rotating == nil:
+			rotating = r
+		default:
+			sender = r
+		}
+	}
+	if sender == nil {
+		sender = routers[0]
+		if sender == rotating {
+			sender = routers[2]
+		}
+	}
+
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotation, err := rotating.RotateKey(sk, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotation.Previous != rotating.PublicKey() {
+		t.Fatalf("expected the rotation to be from our current key")
+	}
+	if err := rotation.Verify(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if current := rotating.KeyRotation(); current == nil || *current != *rotation {
+		t.Fatalf("expected the rotation to be in progress")
+	}
+
+	// Both keys should reach the rotating node once the snake has been
+	// built for the successor key.
+	buf := make([]byte, types.MaxPayloadSize)
+	for _, key := range []types.PublicKey{rotation.Previous, rotation.Successor} {
+		deadline := time.Now().Add(time.Second * 10)
+		for {
+			if time.Now().After(deadline) {
+				t.Fatalf("frame for %s was never delivered", key)
+			}
+			if _, err := sender.WriteTo([]byte("hello"), key); err != nil {
+				t.Fatal(err)
+			}
+			_ = rotating.SetReadDeadline(time.Now().Add(time.Millisecond * 250))
+			n, from, err := rotating.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from == nil {
+				continue
+			}
+			if from != sender.PublicKey() || string(buf[:n]) != "hello" {
+				t.Fatalf("unexpected frame from %s", from)
+			}
+			break
+		}
+	}
+}
+
+func TestPredecessorKey(t *testing.T) {
+	_, previous, _ := ed25519.GenerateKey(nil)
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterPredecessorKey{
+		PrivateKey: previous,
+		Until:      time.Now().Add(time.Minute),
+	})
+	defer r.Close() // nolint:errcheck
+
+	rotation := r.KeyRotation()
+	if rotation == nil {
+		t.Fatal("expected a key rotation to be in progress")
+	}
+	var old types.PublicKey
+	copy(old[:], previous.Public().(ed25519.PublicKey))
+	if rotation.Previous != old || rotation.Successor != r.PublicKey() {
+		t.Fatalf("expected a rotation from the predecessor key to our own")
+	}
+	if !r.answersTo(old) || !r.answersTo(r.PublicKey()) {
+		t.Fatalf("expected the router to answer to both keys")
+	}
+
+	expired := NewRouter(nil, sk, false, RouterPredecessorKey{
+		PrivateKey: previous,
+		Until:      time.Now().Add(-time.Minute),
+	})
+	defer expired.Close() // nolint:errcheck
+	if expired.KeyRotation() != nil || expired.answersTo(old) {
+		t.Fatalf("expected an expired predecessor key to be ignored")
+	}
+}
+
+func TestRotateKeyRejectsShortKey(t *testing.T) {
+	routers := newBenchChain(t, 1)
+	defer routers[0].Close() // nolint:errcheck
+
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []ed25519.PrivateKey{nil, sk[:ed25519.SeedSize], append(sk, 0)} {
+		if _, err := routers[0].RotateKey(key, time.Minute); err == nil {
+			t.Fatalf("RotateKey accepted a %d byte key", len(key))
+		}
+	}
+	if routers[0].KeyRotation() != nil {
+		t.Fatal("a rotation was started with an invalid key")
+	}
+}
@@ -17,10 +17,7 @@ package router
 import (
 	"context"
 	"crypto/ed25519"
-	"encoding/binary"
-	"encoding/hex"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"math"
@@ -35,7 +32,13 @@ import (
 	"go.uber.org/atomic"
 )
 
+// portCount is the default limit on the number of switch ports, including
+// the local port 0. It can be changed with SetPortLimit.
 const portCount = math.MaxUint8 - 1
+
+// portInitialCapacity is the number of switch ports that are allocated up
+// front. The port table will grow beyond this as needed.
+const portInitialCapacity = 16
 const trafficBuffer = math.MaxUint8 - 1
 
 type Router struct {
@@ -45,15 +48,60 @@ type Router struct {
 	cancel        context.CancelFunc
 	public        types.PublicKey
 	private       types.PrivateKey
-	active        sync.Map
+	active        sync.Map // activeIndex -> *atomic.Uint64
+	services      sync.Map // types.ServiceID -> *ServiceConn, see ListenService
 	local         *peer
 	state         *state
 	secure        bool
+	observer      bool
+	embedded      bool
+	pex           bool // exchange PEX records with peers?
+	handshakes    *handshakeLimiter
+	inspector     *inspector          // nil if no inspector was given
+	conformance   *conformance        // nil if strict conformance mode is off
+	rotation      atomic.Value        // *keyRotation, if a key rotation is in progress
+	classifier    atomic.Value        // TrafficClassifier, see SetTrafficClassifier
+	clock         clock               // the time source for the protocol, see RouterClockSkew
+	loopbacks     atomic.Uint64       // frames that we sent to ourselves
+	oversized     atomic.Uint64       // frames refused by the reader for being too long, see ConnectionMTU
+	overload      overload            // how backed up the state actor is
+	transit       RouterTransitPolicy // nil if every peer is a transit peer
+	watchdog      time.Duration       // how long a wedged peer is given, 0 if the watchdog is off
+	network       string              // see RouterNetwork, empty for the default network
+	timers        timers              // see RouterTimers
+	routing       RouterRoutingMode   // which routing schemes we take part in
+	metadata      *types.NodeMetadata // nil if we don't share any, see RouterMetadata
+	metaPrivate   bool                // only share metadata with direct peers?
+	hysteresis    time.Duration       // see RouterSnakeHysteresis, 0 if off
+	suppression   time.Duration       // see RouterAnnouncementSuppression, 0 if off
+	rateAlerts    *frameRateAlerts    // nil if no limits were given, see RouterFrameRateAlerts
+	parentHopCost time.Duration       // see RouterLatencyAwareParents, 0 if off
+	health        RouterHealthCriteria
 	_readDeadline *atomic.Time
-	_subscribers  map[chan<- events.Event]*phony.Inbox
+	_subscribers  map[chan<- events.Event]*subscriber
+}
+
+// subscriber delivers events to a channel given to Subscribe, in order. The
+// done channel is closed by Unsubscribe, which abandons any events that are
+// still waiting to be delivered.
+type subscriber struct {
+	phony.Inbox
+	done chan struct{}
+}
+
+// activeIndex is used to count the number of peerings with a given
+// public key in a given zone.
+type activeIndex struct {
+	public types.PublicKey
+	zone   ConnectionZone
+}
+
+// RouterOption configures the router at creation time.
+type RouterOption interface {
+	isRouterOption()
 }
 
-func NewRouter(logger types.Logger, sk ed25519.PrivateKey, debug bool) *Router {
+func NewRouter(logger types.Logger, sk ed25519.PrivateKey, debug bool, options ...RouterOption) *Router {
 	if logger == nil {
 		logger = log.New(ioutil.Discard, "", 0)
 	}
@@ -65,24 +113,136 @@ func NewRouter(logger types.Logger, sk ed25519.PrivateKey, debug bool) *Router {
 		cancel:        cancel,
 		secure:        !insecure,
 		_readDeadline: atomic.NewTime(time.Now().Add(time.Hour * 24 * 365 * 100)), // ~100 years
-		_subscribers:  make(map[chan<- events.Event]*phony.Inbox),
+		_subscribers:  make(map[chan<- events.Event]*subscriber),
+		watchdog:      defaultWatchdogTimeout,
+		timers:        defaultTimers(),
+	}
+	var limits RouterHandshakeLimits
+	var predecessor *RouterPredecessorKey
+	var metadata *RouterMetadata
+	for _, option := range options {
+		switch v := option.(type) {
+		case RouterObserver:
+			r.observer = bool(v)
+		case RouterHandshakeLimits:
+			limits = v
+		case RouterOptionInspector:
+			if v != nil {
+				r.inspector = &inspector{fn: v}
+			}
+		case RouterFrameRateAlerts:
+			r.rateAlerts = newFrameRateAlerts(v)
+		case RouterStrictConformance:
+			r.conformance = &conformance{log: logger, logEvery: v.LogEvery}
+		case RouterEmbedded:
+			r.embedded = bool(v)
+		case RouterPeerExchange:
+			r.pex = bool(v)
+		case RouterPredecessorKey:
+			predecessor = &v
+		case RouterClockSkew:
+			r.clock.set(v.Offset, v.Rate)
+		case RouterTransitPolicy:
+			r.transit = v
+		case RouterPeerWatchdog:
+			r.watchdog = time.Duration(v)
+		case RouterNetwork:
+			r.network = string(v)
+		case RouterTimers:
+			if t, err := v.timers(); err != nil {
+				r.log.Println("Using the default protocol timers:", err)
+			} else {
+				r.timers = t
+			}
+		case RouterMetadata:
+			metadata = &v
+		case RouterSnakeHysteresis:
+			r.hysteresis = time.Duration(v)
+		case RouterAnnouncementSuppression:
+			r.suppression = time.Duration(v)
+		case RouterLatencyAwareParents:
+			r.parentHopCost = time.Duration(v)
+		case RouterHealthCriteria:
+			r.health = v
+		case RouterRoutingMode:
+			switch v {
+			case RoutingBoth, RoutingTreeOnly, RoutingSnakeOnly:
+				r.routing = v
+			default:
+				r.log.Println("Ignoring unknown routing mode", int(v))
+			}
+		}
 	}
+	if r.embedded {
+		r.inspector, r.conformance = nil, nil
+	}
+	switch {
+	case r.watchdog < 0:
+		r.watchdog = 0
+	case r.watchdog < r.timers.keepaliveTimeout*2:
+		// Don't recycle healthy peerings that are only waiting for their
+		// next keepalive.
+		r.watchdog = r.timers.keepaliveTimeout * 2
+	}
+	if limits.Timeout <= 0 {
+		limits.Timeout = r.timers.keepaliveInterval
+	}
+	r.handshakes = newHandshakeLimiter(limits)
 	// Populate the node keys from the supplied private key.
 	copy(r.private[:], sk)
 	r.public = r.private.Public()
+	if predecessor != nil {
+		if err := r.predecessorRotation(*predecessor); err != nil {
+			r.log.Println("Not answering to predecessor key:", err)
+		}
+	}
+	if metadata != nil {
+		if m, err := types.NewNodeMetadata(r.private, metadata.Name, metadata.Version, metadata.Contact); err != nil {
+			r.log.Println("Not sharing node metadata:", err)
+		} else {
+			r.metadata, r.metaPrivate = m, metadata.Private
+		}
+	}
 	// Create a state actor.
 	r.state = &state{
 		r:             r,
 		_table:        make(virtualSnakeTable),
-		_peers:        make([]*peer, portCount),
+		_peers:        make([]*peer, 1, portInitialCapacity),
+		_portLimit:    portCount,
 		_filterPacket: nil,
+		_keyUsage:     make(map[types.PublicKey]BandwidthUsage),
+		_keyExpiry:    make(map[types.PublicKey]time.Time),
+		_searches:     make(map[uint64]chan keyspaceResult),
+		_metaQueries:  make(metadataQueries),
+		_receipts:     make(receipts),
+		_topics:       make(topicTable),
+		_subscribed:   make(subscriptionTable),
+		_middleware:   make(map[types.FrameType][]FrameMiddleware),
+		_pex:          make(map[types.PublicKey]*pexEntry),
+	}
+	if r.embedded {
+		r.state._portLimit = embeddedPortCount
+		r.state._tableLimit = embeddedSnakeTableLimit
+		r.state._tableEviction = SnakeEvictFarthest
 	}
 	// Create a new local peer and wire it into port 0.
 	r.local = r.newLocalPeer()
 	r.state._peers[0] = r.local
 	// Start the state actor.
 	r.state.Act(nil, r.state._start)
+	if r.watchdog > 0 {
+		go r.watchPeers(r.watchdog)
+	}
 	r.log.Println("Router identity:", r.public.String())
+	if r.observer {
+		r.log.Println("Router is running in observer mode")
+	}
+	if r.embedded {
+		r.log.Println("Router is running with the embedded profile")
+	}
+	if r.routing != RoutingBoth {
+		r.log.Println("Router is running in", r.routing, "routing mode")
+	}
 
 	return r
 }
@@ -93,13 +253,91 @@ func (r *Router) InjectPacketFilter(fn FilterFn) {
 	})
 }
 
+// UseFrameMiddleware adds middleware that will be run for every frame of the
+// given type that the router receives, including frames sent by the local
+// node. Middleware runs in the order that it was added.
+func (r *Router) UseFrameMiddleware(t types.FrameType, m FrameMiddleware) {
+	phony.Block(r.state, func() {
+		r.state._middleware[t] = append(r.state._middleware[t], m)
+	})
+}
+
+// EnableTreeFallback controls whether SNEK-routed traffic that reaches a dead
+// end at a node other than the destination should instead be tree-routed
+// towards the last-known coordinates of the destination, as learned from its
+// bootstrap frames. This can help traffic to get through while the snake is
+// being repaired. It has no effect in snake-only mode, see RouterRoutingMode.
+func (r *Router) EnableTreeFallback(enabled bool) {
+	phony.Block(r.state, func() {
+		r.state._treeFallback = enabled && r.routing.tree()
+	})
+}
+
+// SetPortLimit sets the maximum number of switch ports that the router will
+// allocate, including the local port 0, which in turn limits the number of
+// peerings that can be connected at the same time. Lowering the limit below
+// the number of ports currently in use will not disconnect existing peers,
+// but no new ones will be accepted until enough of them have gone away.
+func (r *Router) SetPortLimit(limit int) {
+	if limit < 2 {
+		limit = 2
+	}
+	phony.Block(r.state, func() {
+		r.state._portLimit = limit
+	})
+}
+
+// SetSnakeTableLimit sets the maximum number of entries that the virtual snake
+// routing table can hold, or 0 for no limit, which is the default. Once the
+// table is full, an existing entry will be evicted according to the policy
+// every time a new entry is added. Lowering the limit below the number of
+// entries in the table will evict entries straight away. The descending entry
+// is never evicted, since we rely on it to stay in the snake.
+func (r *Router) SetSnakeTableLimit(limit int, policy SnakeEvictionPolicy) {
+	if limit < 0 {
+		limit = 0
+	}
+	phony.Block(r.state, func() {
+		r.state._tableLimit = limit
+		r.state._tableEviction = policy
+		for limit > 0 && len(r.state._table) > limit {
+			if !r.state._evictRouteEntry() {
+				break
+			}
+		}
+	})
+}
+
+// SetSnakeAllowlist restricts which public keys may build snake paths through
+// this node, or removes the restriction if nil. Routing table entries that
+// were set up by keys which are no longer allowed are removed straight away.
+// The router keeps its own copy of the allowlist, so changing it afterwards
+// has no effect until it is set again.
+func (r *Router) SetSnakeAllowlist(allowlist *SnakeAllowlist) {
+	allowlist = allowlist.copy()
+	phony.Block(r.state, func() {
+		r.state._allowlist = allowlist
+		for index := range r.state._table {
+			if !r.state._snakeAllowed(index.PublicKey) {
+				r.state._removeRouteEntry(index)
+			}
+		}
+		if desc := r.state._descending; desc != nil && !r.state._snakeAllowed(desc.PublicKey) {
+			r.state._setDescendingNode(nil)
+		}
+	})
+}
+
 // _publish notifies each subscriber of a new event.
 func (r *Router) _publish(event events.Event) {
-	for ch, inbox := range r._subscribers {
+	for ch, sub := range r._subscribers {
 		// Create a copy of the pointer before passing into the lambda
-		chCopy := ch
-		inbox.Act(nil, func() {
-			chCopy <- event
+		chCopy, done := ch, sub.done
+		sub.Act(nil, func() {
+			select {
+			case chCopy <- event:
+			case <-done:
+			}
 		})
 	}
 }
@@ -107,7 +345,7 @@ func (r *Router) _publish(event events.Event) {
 // IsConnected returns true if the node is connected within the
 // given zone, or false otherwise.
 func (r *Router) IsConnected(key types.PublicKey, zone string) bool {
-	v, ok := r.active.Load(hex.EncodeToString(key[:]) + zone)
+	v, ok := r.active.Load(activeIndex{key, ConnectionZone(zone)})
 	if !ok {
 		return false
 	}
@@ -151,15 +389,59 @@ type ConnectionZone string
 type ConnectionPeerType int
 type ConnectionKeepalives bool
 
-func (w ConnectionPublicKey) isConnectionOption()  {}
-func (w ConnectionURI) isConnectionOption()        {}
-func (w ConnectionZone) isConnectionOption()       {}
-func (w ConnectionPeerType) isConnectionOption()   {}
-func (w ConnectionKeepalives) isConnectionOption() {}
+// ConnectionQueueMaxAge switches the peer to a traffic queue that sends the
+// newest frames first and drops frames that have been waiting for longer than
+// the given duration, which keeps latency down on congested links.
+type ConnectionQueueMaxAge time.Duration
+
+// ConnectionTargetKey names the public key of the node that we expect to
+// find on the remote side of an outbound connection. It is sent as part of
+// the handshake so that a listener shared by several routers, see
+// ListenerDemux, can pass the connection to the right one. It should only be
+// used when dialling a listener that is known to understand it.
+type ConnectionTargetKey types.PublicKey
+
+// ConnectionFrameVersion sets the frame encoding used on the peering, which
+// must be one that the remote side understands. Frames are translated into
+// this encoding as they are written, whatever encoding they arrived in, so a
+// node can speak an older encoding on some links and a newer one on others.
+// Without this option, the newest encoding that both sides advertise in the
+// handshake is used, or Version0 if there is no handshake because a
+// ConnectionPublicKey was given.
+type ConnectionFrameVersion types.FrameVersion
+
+// ConnectionVerifyPublicKey pins the key given with ConnectionPublicKey
+// instead of trusting it. Normally, giving a public key skips the handshake
+// and whoever is on the other end of the connection is taken to be that
+// node, which suits in-process links and transports that have already
+// authenticated the remote side. With this option the handshake is run as
+// usual and the connection is refused with a *PublicKeyMismatchError if the
+// remote side presents a different key, i.e. because the DNS name of a
+// static peer now points at another node.
+type ConnectionVerifyPublicKey bool
+
+// ConnectionKeyFilter is called with the public key of the remote side once
+// it is known, and the connection is refused if it returns false. This gives
+// a chance to turn away peers whose keys are only learned from the
+// handshake, i.e. on inbound connections.
+type ConnectionKeyFilter func(types.PublicKey) bool
+
+func (w ConnectionPublicKey) isConnectionOption()    {}
+func (w ConnectionURI) isConnectionOption()          {}
+func (w ConnectionZone) isConnectionOption()         {}
+func (w ConnectionPeerType) isConnectionOption()     {}
+func (w ConnectionKeepalives) isConnectionOption()   {}
+func (w ConnectionQueueMaxAge) isConnectionOption()  {}
+func (w ConnectionTargetKey) isConnectionOption()    {}
+func (w ConnectionFrameVersion) isConnectionOption() {}
+func (w ConnectionKeyFilter) isConnectionOption()    {}
+
+func (w ConnectionVerifyPublicKey) isConnectionOption() {}
 
 // Connect takes a connection and attaches it to the switch as a peering. This
 // function takes one or more ConnectionOptions to configure the peer. If no
-// ConnectionPublicKey is specified, the connection will autonegotiate with the
+// ConnectionPublicKey is specified, or it is pinned with
+// ConnectionVerifyPublicKey, the connection will autonegotiate with the
 // remote peer to exchange public keys and version/capability information.
 func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.SwitchPortID, error) {
 	var public types.PublicKey
@@ -167,6 +449,20 @@ func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.Swit
 	var zone ConnectionZone
 	var peertype ConnectionPeerType
 	keepalives := true
+	var maxAge ConnectionQueueMaxAge
+	var quota *ConnectionQuota
+	var target types.PublicKey
+	var pacing ConnectionPacing
+	var version *ConnectionFrameVersion
+	var filter ConnectionKeyFilter
+	var role *ConnectionPeerRole
+	var idle ConnectionIdleSuspend
+	var datagrams ConnectionDatagrams
+	var mtu ConnectionMTU
+	var direction ConnectionLinkDirection
+	var migrate ConnectionMigrate
+	var flush ConnectionFlushPolicy
+	var verify ConnectionVerifyPublicKey
 	for _, option := range options {
 		switch v := option.(type) {
 		case ConnectionPublicKey:
@@ -179,60 +475,139 @@ func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.Swit
 			peertype = v
 		case ConnectionKeepalives:
 			keepalives = bool(v)
+		case ConnectionQueueMaxAge:
+			maxAge = v
+		case ConnectionQuota:
+			quota = &v
+		case ConnectionTargetKey:
+			target = types.PublicKey(v)
+		case ConnectionPacing:
+			pacing = v
+		case ConnectionFrameVersion:
+			version = &v
+		case ConnectionKeyFilter:
+			filter = v
+		case ConnectionPeerRole:
+			role = &v
+		case ConnectionIdleSuspend:
+			idle = v
+		case ConnectionDatagrams:
+			datagrams = v
+		case ConnectionMTU:
+			mtu = v
+		case ConnectionLinkDirection:
+			direction = v
+		case ConnectionMigrate:
+			migrate = v
+		case ConnectionFlushPolicy:
+			flush = v
+		case ConnectionVerifyPublicKey:
+			verify = v
 		}
 	}
+	var duplicate bool
+	phony.Block(r.state, func() {
+		duplicate = r.state._peerForConn(conn) != nil
+	})
+	if duplicate {
+		return 0, ErrDuplicatePeer
+	}
+	if version != nil && types.FrameVersion(*version) > types.LatestFrameVersion {
+		conn.Close()
+		return 0, fmt.Errorf("unsupported frame version %d", *version)
+	}
+	if bool(datagrams) && !target.IsZero() {
+		conn.Close()
+		return 0, fmt.Errorf("target keys aren't supported on datagram peerings")
+	}
+	if mtu != 0 && mtu < minConnectionMTU {
+		conn.Close()
+		return 0, fmt.Errorf("MTU of %d bytes is below the minimum of %d bytes", mtu, minConnectionMTU)
+	}
+	if direction < ConnectionLinkDirection(LinkBidirectional) || direction > ConnectionLinkDirection(LinkReceiveOnly) {
+		conn.Close()
+		return 0, fmt.Errorf("unknown link direction %d", direction)
+	}
+	if flush.Mode < FlushQueued || flush.Mode > FlushAtThreshold {
+		conn.Close()
+		return 0, fmt.Errorf("unknown flush mode %d", flush.Mode)
+	}
 
-	var empty types.PublicKey
-	if public == empty {
-		handshake := []byte{
-			ourVersion,
-			0, // unused
-			0, // unused
-			0, // unused
-			0, // capabilities
-			0, // capabilities
-			0, // capabilities
-			0, // capabilities
-		}
-		binary.BigEndian.PutUint32(handshake[4:8], ourCapabilities)
-		handshake = append(handshake, r.public[:ed25519.PublicKeySize]...)
-		handshake = append(handshake, ed25519.Sign(r.private[:], handshake)...)
-		if err := conn.SetDeadline(time.Now().Add(peerKeepaliveInterval)); err != nil {
-			return 0, fmt.Errorf("conn.SetDeadline: %w", err)
-		}
-		if _, err := conn.Write(handshake); err != nil {
-			conn.Close()
-			return 0, fmt.Errorf("conn.Write: %w", err)
-		}
-		if _, err := io.ReadFull(conn, handshake); err != nil {
-			conn.Close()
-			return 0, fmt.Errorf("io.ReadFull: %w", err)
+	// A pinned key is checked against the one from the handshake, rather than
+	// skipping the handshake.
+	var pinned types.PublicKey
+	if verify {
+		pinned, public = public, types.PublicKey{}
+	}
+
+	frameVersion := types.Version0
+	var rtt time.Duration
+	var metadata *types.NodeMetadata
+	suspendable := false
+	if public.IsZero() {
+		result, err := r.handshake(conn, target, bool(migrate))
+		if err != nil {
+			return 0, err
 		}
-		if err := conn.SetDeadline(time.Time{}); err != nil {
-			return 0, fmt.Errorf("conn.SetDeadline: %w", err)
+		public, rtt, metadata = result.public, result.rtt, result.metadata
+		migrate = ConnectionMigrate(result.capabilities&capabilityMigrate != 0 && (bool(migrate) || result.migrate))
+		if result.capabilities&capabilityFrameVersion1 != 0 {
+			frameVersion = types.Version1
 		}
-		if theirVersion := handshake[0]; theirVersion != ourVersion {
+		suspendable = result.capabilities&capabilitySuspend != 0
+		if !target.IsZero() && public != target {
 			conn.Close()
-			return 0, fmt.Errorf("mismatched node version")
+			return 0, &PublicKeyMismatchError{Expected: target, Actual: public}
 		}
-		if theirCapabilities := binary.BigEndian.Uint32(handshake[4:8]); theirCapabilities&ourCapabilities != ourCapabilities {
+		if !pinned.IsZero() && public != pinned {
 			conn.Close()
-			return 0, fmt.Errorf("mismatched node capabilities")
+			return 0, &PublicKeyMismatchError{Expected: pinned, Actual: public}
 		}
-		var signature types.Signature
-		offset := 8
-		offset += copy(public[:], handshake[offset:offset+ed25519.PublicKeySize])
-		copy(signature[:], handshake[offset:offset+ed25519.SignatureSize])
-		if !ed25519.Verify(public[:], handshake[:offset], signature[:]) {
-			conn.Close()
-			return 0, fmt.Errorf("peer sent invalid signature")
+	}
+	if filter != nil && !filter(public) {
+		conn.Close()
+		return 0, fmt.Errorf("connection to %s refused by key filter", public)
+	}
+	if migrate {
+		if port, ok, err := r.migrate(conn, public, bool(datagrams)); ok {
+			return port, err
 		}
 	}
 
+	if version != nil {
+		frameVersion = types.FrameVersion(*version)
+	}
+	leaf := false
+	switch {
+	case role != nil:
+		leaf = PeerRole(*role) == PeerRoleLeaf
+	case r.transit != nil:
+		leaf = r.transit(public, string(zone), int(peertype)) == PeerRoleLeaf
+	}
+
 	port := types.SwitchPortID(0)
 	var err error
 	phony.Block(r.state, func() {
-		port, err = r.state._addPeer(conn, public, uri, zone, peertype, keepalives)
+		port, err = r.state._addPeer(peerConfig{
+			conn:       conn,
+			public:     public,
+			uri:        uri,
+			zone:       zone,
+			peertype:   peertype,
+			keepalives: keepalives,
+			maxAge:     maxAge,
+			quota:      quota,
+			pacing:     pacing,
+			suspension: newSuspension(suspendable, idle),
+			datagrams:  bool(datagrams),
+			mtu:        int(mtu),
+			version:    frameVersion,
+			rtt:        rtt,
+			flush:      newFlushPolicy(flush),
+			leaf:       leaf,
+			direction:  LinkDirection(direction),
+			metadata:   metadata,
+		})
 	})
 	if err != nil {
 		return types.SwitchPortID(0), err
@@ -249,12 +624,78 @@ func (r *Router) Disconnect(i types.SwitchPortID, err error) {
 		return
 	}
 	phony.Block(r.state, func() {
+		if int(i) >= len(r.state._peers) {
+			return
+		}
 		if p := r.state._peers[i]; p != nil && p.started.Load() {
 			p.stop(err)
 		}
 	})
 }
 
+// DisconnectLink disconnects every peering that runs over the given network
+// interface, which is any peering in a zone with the same name as the
+// interface or any peering whose local address is one of the given addresses.
+// It is used to react straight away when an interface goes down rather than
+// waiting for the connections to time out. The number of peerings that were
+// disconnected is returned.
+func (r *Router) DisconnectLink(intf string, addrs []net.IP, err error) (count int) {
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p == nil || p.port == 0 || !p.started.Load() {
+				continue
+			}
+			if (intf != "" && string(p.zone) == intf) || peerUsesAddress(p, addrs) {
+				p.stop(err)
+				count++
+			}
+		}
+	})
+	return
+}
+
+// DisconnectZone disconnects every peering of the given peer type in the
+// given zone, i.e. to drop all of the multicast peerings on an interface
+// without touching any static peerings that happen to use it. The number of
+// peerings that were disconnected is returned.
+func (r *Router) DisconnectZone(zone string, peertype int, err error) (count int) {
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p == nil || p.port == 0 || !p.started.Load() {
+				continue
+			}
+			if string(p.zone) == zone && int(p.peertype) == peertype {
+				p.stop(err)
+				count++
+			}
+		}
+	})
+	return
+}
+
+// peerUsesAddress returns true if the local address of the peer connection
+// is one of the given addresses.
+func peerUsesAddress(p *peer, addrs []net.IP) bool {
+	if len(addrs) == 0 || p.conn == nil {
+		return false
+	}
+	var local net.IP
+	switch addr := p.conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		local = addr.IP
+	case *net.UDPAddr:
+		local = addr.IP
+	default:
+		return false
+	}
+	for _, addr := range addrs {
+		if addr.Equal(local) {
+			return true
+		}
+	}
+	return false
+}
+
 // PeerCount returns the number of nodes that are directly
 // connected to this Pinecone node.
 func (r *Router) PeerCount(peertype int) (count int) {
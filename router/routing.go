@@ -0,0 +1,112 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// RouterRoutingMode restricts the router to one of the two routing schemes,
+// for experiments and for deployments that only need one of them. The tree
+// is still built in both modes, since SNEK routing depends on it.
+//
+// In tree-only mode, the router never bootstraps and refuses bootstraps and
+// SNEK-routed frames, so WriteTo only accepts coordinates and anything that
+// relies on SNEK routing, like keyspace searches, topics and sessions, won't
+// work. In snake-only mode, the router refuses tree-routed frames, as well
+// as SNEK-routed frames that have fallen back to tree routing, so WriteTo
+// only accepts public keys and EnableTreeFallback has no effect.
+//
+// The other nodes in the network don't know which mode a node is in and will
+// still send it frames of both kinds, which are dropped with DropRoutingMode,
+// so it is best for every node in the network to use the same mode.
+type RouterRoutingMode int
+
+const (
+	RoutingBoth      RouterRoutingMode = iota // tree and SNEK routing, the default
+	RoutingTreeOnly                           // no SNEK routing
+	RoutingSnakeOnly                          // no greedy tree routing
+)
+
+func (m RouterRoutingMode) isRouterOption() {}
+
+func (m RouterRoutingMode) String() string {
+	switch m {
+	case RoutingBoth:
+		return "both"
+	case RoutingTreeOnly:
+		return "tree-only"
+	case RoutingSnakeOnly:
+		return "snake-only"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(m))
+	}
+}
+
+// ParseRoutingMode parses a routing mode from its name, as returned by
+// String, i.e. for a command line flag.
+func ParseRoutingMode(name string) (RouterRoutingMode, error) {
+	for _, m := range []RouterRoutingMode{RoutingBoth, RoutingTreeOnly, RoutingSnakeOnly} {
+		if m.String() == name {
+			return m, nil
+		}
+	}
+	return RoutingBoth, fmt.Errorf("unknown routing mode %q", name)
+}
+
+// RoutingMode returns which routing schemes the router takes part in.
+func (r *Router) RoutingMode() RouterRoutingMode {
+	return r.routing
+}
+
+// snake returns true if the router takes part in SNEK routing.
+func (m RouterRoutingMode) snake() bool {
+	return m != RoutingTreeOnly
+}
+
+// tree returns true if the router takes part in greedy tree routing.
+func (m RouterRoutingMode) tree() bool {
+	return m != RoutingSnakeOnly
+}
+
+// allows returns true if the frame belongs to a routing scheme that the
+// router takes part in. Tree announcements, keepalives and PEX frames are
+// always allowed.
+func (m RouterRoutingMode) allows(f *types.Frame) bool {
+	switch f.Type {
+	case types.TypeVirtualSnakeBootstrap:
+		return m.snake()
+	case types.TypeVirtualSnakeRouted:
+		return m.snake() && (m.tree() || len(f.Destination) == 0)
+	case types.TypeTreeRouted:
+		return m.tree()
+	default:
+		return true
+	}
+}
+
+// requireSnake returns an error if the router doesn't take part in SNEK
+// routing, for anything that can't work without it.
+func (r *Router) requireSnake() error {
+	switch {
+	case r.observer:
+		return fmt.Errorf("router is running in observer mode")
+	case !r.routing.snake():
+		return fmt.Errorf("SNEK routing is disabled")
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestRoutingModeAllows(t *testing.T) {
+	frames := map[string]*types.Frame{
+		"bootstrap": {Type: types.TypeVirtualSnakeBootstrap},
+		"snake":     {Type: types.TypeVirtualSnakeRouted},
+		"fallback":  {Type: types.TypeVirtualSnakeRouted, Destination: types.Coordinates{1}},
+		"tree":      {Type: types.TypeTreeRouted},
+		"announce":  {Type: types.TypeTreeAnnouncement},
+	}
+	for mode, allowed := range map[RouterRoutingMode][]string{
+		RoutingBoth:      {"bootstrap", "snake", "fallback", "tree", "announce"},
+		RoutingTreeOnly:  {"tree", "announce"},
+		RoutingSnakeOnly: {"bootstrap", "snake", "announce"},
+	} {
+		want := map[string]bool{}
+		for _, name := range allowed {
+			want[name] = true
+		}
+		for name, f := range frames {
+			if got := mode.allows(f); got != want[name] {
+				t.Errorf("%s: expected %s frames to be allowed=%v but got %v", mode, name, want[name], got)
+			}
+		}
+	}
+}
+
+func TestParseRoutingMode(t *testing.T) {
+	for _, mode := range []RouterRoutingMode{RoutingBoth, RoutingTreeOnly, RoutingSnakeOnly} {
+		if parsed, err := ParseRoutingMode(mode.String()); err != nil || parsed != mode {
+			t.Fatalf("expected %s to parse, got %s (%v)", mode, parsed, err)
+		}
+	}
+	if _, err := ParseRoutingMode("greedy"); err == nil {
+		t.Fatal("expected an unknown mode to fail")
+	}
+}
+
+func TestRoutingModeWriteTo(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	tree := NewRouter(nil, sk, false, RoutingTreeOnly)
+	defer tree.Close()
+	_, sk, _ = ed25519.GenerateKey(nil)
+	snake := NewRouter(nil, sk, false, RoutingSnakeOnly)
+	defer snake.Close()
+
+	if _, err := tree.WriteTo([]byte("hello"), types.PublicKey{1}); err == nil {
+		t.Fatal("expected SNEK-routed traffic to be refused in tree-only mode")
+	}
+	if _, err := tree.SearchKeyspace(types.PublicKey{1}, 1); err == nil {
+		t.Fatal("expected keyspace searches to be refused in tree-only mode")
+	}
+	if _, err := snake.WriteTo([]byte("hello"), types.Coordinates{1}); err == nil {
+		t.Fatal("expected tree-routed traffic to be refused in snake-only mode")
+	}
+	snake.EnableTreeFallback(true)
+	phony.Block(snake.state, func() {
+		if snake.state._treeFallback {
+			t.Error("expected tree fallback to stay off in snake-only mode")
+		}
+	})
+}
+
+func TestTreeOnlyRefusesSnakeFrames(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false)
+	rb := NewRouter(nil, skb, false, RoutingTreeOnly, RouterStrictConformance{})
+	defer ra.Close()
+	defer rb.Close()
+	connectPair(t, ra, rb)
+	// Agreeing on the root isn't enough, since ra might not have heard from
+	// rb yet, in which case it would route frames for rb to itself.
+	waitFor(t, "routes from ra to rb", func() bool {
+		if !sameRoot([]*Router{ra, rb}) {
+			return false
+		}
+		coords := rb.Coords()
+		tree, _ := ra.NextHop(nil, types.TypeTreeRouted, coords).(types.Coordinates)
+		snek := ra.NextHop(nil, types.TypeVirtualSnakeRouted, rb.PublicKey())
+		return tree.EqualTo(coords) && snek == rb.PublicKey()
+	})
+
+	// Tree routing still works. The frame is sent again until it arrives in
+	// case the tree is still settling.
+	buf := make([]byte, 64)
+	waitFor(t, "tree-routed traffic to arrive", func() bool {
+		_, _ = ra.WriteTo([]byte("hello"), rb.Coords())
+		_ = rb.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, _, err := rb.ReadFrom(buf)
+		return err == nil && n > 0 && string(buf[:n]) == "hello"
+	})
+
+	// SNEK-routed traffic towards the tree-only node is refused.
+	waitFor(t, "the frame to be refused", func() bool {
+		_, _ = ra.WriteTo([]byte("hello"), rb.PublicKey())
+		return rb.DropCounts()[DropRoutingMode] > 0
+	})
+}
+
+func TestTreeFallbackAtSnakeDeadEnd(t *testing.T) {
+	// The keys are placed so that d < b < c < a, which makes a the root and
+	// b the end of the bootstrap path from d. That leaves b with no way to
+	// reach d over the snake other than the path that d set up through it.
+	keys := make([]types.PublicKey, 4)
+	private := map[types.PublicKey]ed25519.PrivateKey{}
+	for i := range keys {
+		_, sk, _ := ed25519.GenerateKey(nil)
+		copy(keys[i][:], sk.Public().(ed25519.PublicKey))
+		private[keys[i]] = sk
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CompareTo(keys[j]) < 0 })
+	// Bootstraps are sent often, so that b hears from d quickly.
+	timers := RouterTimers{BootstrapInterval: time.Second}
+	d := NewRouter(nil, private[keys[0]], false, timers)
+	b := NewRouter(nil, private[keys[1]], false, timers)
+	c := NewRouter(nil, private[keys[2]], false, timers)
+	a := NewRouter(nil, private[keys[3]], false, timers)
+	routers := []*Router{a, b, c, d}
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	connectPair(t, a, b)
+	connectPair(t, b, c)
+	connectPair(t, c, d)
+
+	// Wait for b to learn the path to d, with its coordinates.
+	waitFor(t, "the path from d to reach b", func() bool {
+		if !sameRoot(routers) || d.Coords().DistanceTo(a.Coords()) != 3 {
+			return false
+		}
+		coords, found := d.Coords(), false
+		phony.Block(b.state, func() {
+			e, ok := b.state._table[virtualSnakeIndex{PublicKey: d.public}]
+			found = ok && e.valid() && e.Coords.EqualTo(coords)
+		})
+		return found
+	})
+
+	// A frame that has already followed a newer path towards d than the one
+	// that b knows about can't use b's path, so b is a dead end for it, as
+	// happens while the snake is being repaired. The frame is sent to b as
+	// if it had come from a.
+	send := func() {
+		phony.Block(b.state, func() {
+			var from *peer
+			for _, p := range b.state._peers {
+				if p != nil && p.public == a.public && p.started.Load() {
+					from = p
+				}
+			}
+			entry, ok := b.state._table[virtualSnakeIndex{PublicKey: d.public}]
+			if from == nil || !ok {
+				t.Error("b has lost its peering with a or its path to d")
+				return
+			}
+			f := getFrame()
+			f.Type = types.TypeVirtualSnakeRouted
+			f.DestinationKey = d.public
+			f.SourceKey = a.public
+			f.Watermark = types.VirtualSnakeWatermark{
+				PublicKey: entry.Watermark.PublicKey,
+				Sequence:  entry.Watermark.Sequence + 1,
+			}
+			f.Payload = append(f.Payload[:0], "hello"...)
+			_ = b.state._forward(from, f)
+		})
+	}
+	read := func(r *Router) bool {
+		buf := make([]byte, 64)
+		_ = r.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, _, err := r.ReadFrom(buf)
+		return err == nil && n > 0 && string(buf[:n]) == "hello"
+	}
+
+	// Without the fallback the frame stops at b.
+	send()
+	if !read(b) {
+		t.Fatal("expected the frame to stop at b without the tree fallback")
+	}
+
+	// With it, the frame is tree-routed the rest of the way to d.
+	b.EnableTreeFallback(true)
+	waitFor(t, "the frame to arrive at d over the tree", func() bool {
+		send()
+		return read(d)
+	})
+}
@@ -0,0 +1,167 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// Peer scores are recalculated every peerScoreInterval. Each new observation
+// is blended into the running averages by peerScoreSmoothing, so that a
+// single bad interval doesn't immediately count against a peer but repeated
+// ones do.
+const (
+	peerScoreInterval  = time.Second * 5
+	peerScoreSmoothing = 0.25
+	// peerScoreMargin is how much better one score has to be than another
+	// before it is preferred, so that peers with similar scores don't keep
+	// swapping places as the scores move around.
+	peerScoreMargin = 0.1
+	// peerScoreRTT is the handshake round-trip time at which the RTT
+	// component of the score is halved.
+	peerScoreRTT = time.Millisecond * 250
+	// peerScoreAnnouncementSlack is how late a tree announcement can be,
+	// relative to the announcement interval, before it counts as missed. It
+	// follows the announcement interval if that has been changed.
+	peerScoreAnnouncementSlack = announcementInterval * 3 / 2
+)
+
+// peerScore tracks how reliable a peering has been. The score ranges from 0
+// to 1 and is made up of the fraction of traffic frames that weren't dropped
+// on their way to the peer, how regularly the peer has sent us tree
+// announcements and the round-trip time measured during the handshake. It is
+// only used as a tiebreaker, so peers that are otherwise equally good as a
+// parent or next-hop will be preferred if they have been more reliable.
+type peerScore struct {
+	rtt               time.Duration  // Not mutated after peer setup, 0 if unknown.
+	sent              atomic.Uint64  // Thread-safe count of traffic frames queued.
+	dropped           atomic.Uint64  // Thread-safe count of traffic frames dropped.
+	current           atomic.Float64 // Thread-safe current score.
+	_lastSent         uint64         // Only accessed by the state actor.
+	_lastDropped      uint64         // Only accessed by the state actor.
+	_delivery         float64        // Fraction of frames delivered, only accessed by the state actor.
+	_regularity       float64        // Fraction of announcements on time, only accessed by the state actor.
+	_lastAnnouncement time.Time      // Only accessed by the state actor.
+	slack             time.Duration  // Not mutated after peer setup, see peerScoreAnnouncementSlack.
+}
+
+func newPeerScore(rtt time.Duration) *peerScore {
+	s := &peerScore{
+		rtt:         rtt,
+		slack:       peerScoreAnnouncementSlack,
+		_delivery:   1,
+		_regularity: 1,
+	}
+	s.current.Store(s._calculate())
+	return s
+}
+
+// value returns the current score of the peer. Peers without a score, such
+// as the local router, always have a perfect score. It is safe to call from
+// any actor.
+func (s *peerScore) value() float64 {
+	if s == nil {
+		return 1
+	}
+	return s.current.Load()
+}
+
+// _announced records that the peer has sent us a tree announcement. This
+// function must be called from the state actor only.
+func (s *peerScore) _announced(now time.Time) {
+	if s == nil {
+		return
+	}
+	if !s._lastAnnouncement.IsZero() {
+		onTime := 0.0
+		if now.Sub(s._lastAnnouncement) <= s.slack {
+			onTime = 1
+		}
+		s._regularity += (onTime - s._regularity) * peerScoreSmoothing
+	}
+	s._lastAnnouncement = now
+}
+
+// _update folds the traffic counts and announcement timings since the last
+// update into the score. This function must be called from the state actor
+// only.
+func (s *peerScore) _update(now time.Time) {
+	if s == nil {
+		return
+	}
+	sent, dropped := s.sent.Load(), s.dropped.Load()
+	if sent > s._lastSent {
+		delivered := 1 - float64(dropped-s._lastDropped)/float64(sent-s._lastSent)
+		if delivered < 0 {
+			delivered = 0
+		}
+		s._delivery += (delivered - s._delivery) * peerScoreSmoothing
+	}
+	s._lastSent, s._lastDropped = sent, dropped
+	if !s._lastAnnouncement.IsZero() && now.Sub(s._lastAnnouncement) > s.slack {
+		// The next announcement is overdue, so count it as missed for every
+		// interval that it doesn't turn up.
+		s._regularity -= s._regularity * peerScoreSmoothing
+	}
+	s.current.Store(s._calculate())
+}
+
+func (s *peerScore) _calculate() float64 {
+	latency := 1.0
+	if s.rtt > 0 {
+		latency = float64(peerScoreRTT) / float64(peerScoreRTT+s.rtt)
+	}
+	return s._delivery * s._regularity * latency
+}
+
+// compareScores returns 1 if the score a is clearly better than b, -1 if it
+// is clearly worse and 0 if they are close enough to be treated as equal.
+func compareScores(a, b float64) int {
+	switch {
+	case a-b > peerScoreMargin:
+		return 1
+	case b-a > peerScoreMargin:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// _scorePeersIn schedules peer scoring for the specified duration.
+func (s *state) _scorePeersIn(d time.Duration) {
+	s._scoreDue = s.r.clock.now().Add(d)
+	s._schedule()
+}
+
+// _scorePeers updates the scores of all connected peers.
+func (s *state) _scorePeers() {
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+		defer s._scorePeersIn(peerScoreInterval)
+	}
+	now := s.r.clock.now()
+	for _, p := range s._peers {
+		if p != nil && p.started.Load() {
+			p.score._update(now)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+func TestPeerScore(t *testing.T) {
+	now := time.Now()
+
+	reliable := newPeerScore(0)
+	if v := reliable.value(); v != 1 {
+		t.Fatalf("expected a new peer to have a perfect score, got %f", v)
+	}
+	var local *peerScore
+	if v := local.value(); v != 1 {
+		t.Fatalf("expected a nil score to be perfect, got %f", v)
+	}
+
+	// A peer that drops half of its traffic every interval should end up
+	// clearly worse than one that drops nothing.
+	flaky := newPeerScore(0)
+	for i := 0; i < 5; i++ {
+		reliable.sent.Add(10)
+		flaky.sent.Add(10)
+		flaky.dropped.Add(5)
+		reliable._update(now)
+		flaky._update(now)
+	}
+	if compareScores(reliable.value(), flaky.value()) <= 0 {
+		t.Fatalf("expected reliable peer (%f) to beat flaky peer (%f)", reliable.value(), flaky.value())
+	}
+
+	// Announcements that keep turning up late count against the peer.
+	late := newPeerScore(0)
+	for i := 0; i < 5; i++ {
+		late._announced(now.Add(peerScoreAnnouncementSlack * 2 * time.Duration(i)))
+	}
+	late._update(now.Add(peerScoreAnnouncementSlack * 8))
+	if compareScores(1, late.value()) <= 0 {
+		t.Fatalf("expected late announcements to lower the score, got %f", late.value())
+	}
+
+	// A slow handshake lowers the score, but not an unknown one.
+	if v := newPeerScore(peerScoreRTT).value(); v != 0.5 {
+		t.Fatalf("expected the RTT to halve the score, got %f", v)
+	}
+}
+
+func TestTreeNextHopPrefersReliablePeer(t *testing.T) {
+	self := &peer{started: *atomic.NewBool(true)}
+	flaky := &peer{started: *atomic.NewBool(true), score: newPeerScore(0)}
+	reliable := &peer{started: *atomic.NewBool(true), score: newPeerScore(0)}
+	for i := 0; i < 5; i++ {
+		flaky.score.sent.Add(10)
+		flaky.score.dropped.Add(8)
+		flaky.score._update(time.Now())
+	}
+
+	root := types.Root{RootPublicKey: types.PublicKey{5}, RootSequence: 1}
+	announcement := func(order uint64) *rootAnnouncementWithTime {
+		return &rootAnnouncementWithTime{
+			receiveTime:  time.Now(),
+			receiveOrder: order,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root:       root,
+				Signatures: []types.SignatureWithHop{{Hop: 1}, {Hop: 1}},
+			},
+		}
+	}
+	selfAnn := announcement(1)
+
+	// The flaky peer sent its announcement first, which would normally win
+	// the tiebreak, but the reliable peer should be picked instead.
+	actual := getNextHopTree(treeNextHopParams{
+		types.Coordinates{1, 1, 1},
+		types.Coordinates{2},
+		nil,
+		self,
+		selfAnn,
+		&announcementTable{
+			flaky:    announcement(1),
+			reliable: announcement(2),
+		},
+	})
+	if actual != reliable {
+		t.Fatalf("expected the reliable peer to be chosen")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// sendPollInterval is how often Send checks whether there is room in the
+// queue for the next-hop again while it is waiting.
+const sendPollInterval = time.Millisecond * 5
+
+// SendInfo describes where a packet sent with Send was queued, so that the
+// sender can slow down before the queue fills up.
+type SendInfo struct {
+	Port      types.SwitchPortID // the next-hop port, 0 if the packet was for us
+	PublicKey types.PublicKey    // the public key of the next-hop
+	Queued    int                // how many packets are waiting for the next-hop, including this one
+	Capacity  int                // how many packets the queue for the next-hop can hold in total
+}
+
+// Send is like WriteTo, but instead of pushing the packet into the queue for
+// the next-hop regardless, which drops an older packet once the queue is
+// full, it waits until there is room for the packet in the queue or the
+// context is done. Once the packet has been queued, Send returns how full
+// the queue is. ErrNotQueued is returned if the packet was dropped before
+// it got to a queue, i.e. because there's no route to the destination, and
+// the context's error is returned if it was done before there was room.
+//
+// Since the packet is only queued once there is room for it, a sender that
+// calls Send in a loop is held back to the rate that the next-hop can take,
+// rather than flooding the queue and causing its own packets to be dropped.
+func (r *Router) Send(ctx context.Context, p []byte, addr net.Addr) (SendInfo, error) {
+	var info SendInfo
+	frame, loopback, err := r.localFrame(p, addr)
+	if err != nil {
+		return info, err
+	}
+	if loopback {
+		if err = r.loopback(frame); err != nil {
+			return info, err
+		}
+		info.PublicKey = r.public
+		info.Queued, info.Capacity = r.local.traffic.queuecount(), r.local.traffic.queuesize()
+		return info, nil
+	}
+
+	for {
+		var queued *peer
+		full := false
+		phony.Block(r.state, func() {
+			// Look at the next-hop first, so that the packet isn't pushed
+			// into a full queue. If the routing changes between now and
+			// _forward then the packet is queued to the new next-hop anyway.
+			nexthop, _ := r.state._nextHopsFor(r.local, frame.Type, addr, frame.Watermark)
+			if nexthop != nil && nexthop != r.local && !nexthop.traffic.hasroom(frame) {
+				full = true
+				return
+			}
+			r.state._localQueued = nil
+			err = r.state._forward(r.local, frame)
+			queued, r.state._localQueued = r.state._localQueued, nil
+		})
+		switch {
+		case err != nil:
+			return info, err
+		case queued != nil:
+			info.Port, info.PublicKey = queued.port, queued.public
+			info.Queued, info.Capacity = queued.traffic.queuecount(), queued.traffic.queuesize()
+			return info, nil
+		case !full:
+			return info, ErrNotQueued
+		}
+
+		timer := time.NewTimer(sendPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			putFrame(frame)
+			return info, ctx.Err()
+		case <-r.context.Done():
+			timer.Stop()
+			putFrame(frame)
+			return info, r.context.Err()
+		}
+	}
+}
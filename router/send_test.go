@@ -0,0 +1,104 @@
+package router
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// stallConn is a connection whose writes can be held up, as if the remote
+// side had stopped reading.
+type stallConn struct {
+	net.Conn
+	hold sync.Mutex
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	c.hold.Lock()
+	c.hold.Unlock() // nolint:staticcheck
+	return c.Conn.Write(b)
+}
+
+func TestSendWaitsForRoom(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false)
+	rb := NewRouter(nil, skb, false)
+	defer ra.Close()
+	defer rb.Close()
+
+	pa, pb := net.Pipe()
+	conn := &stallConn{Conn: pa}
+	connectEnds(t, pairEnd{ra, conn, nil}, pairEnd{rb, pb, nil})
+	waitFor(t, "convergence", func() bool {
+		return sameRoot([]*Router{ra, rb}) && ra.Coords().DistanceTo(rb.Coords()) == 1
+	})
+
+	// The payloads are large so that only a few of them fit into each write
+	// batch, otherwise the writer would empty the queue into the batch.
+	dest, payload := rb.Coords(), make([]byte, peerWriteBatchSize/4)
+	info, err := ra.Send(context.Background(), payload, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PublicKey != rb.PublicKey() || info.Port == 0 || info.Capacity == 0 {
+		t.Fatalf("expected the packet to be queued for rb, got %+v", info)
+	}
+
+	// Once the connection stops taking writes, the queue fills up and Send
+	// waits rather than pushing out packets that are already queued.
+	conn.hold.Lock()
+	sent := 0
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		_, err := ra.Send(ctx, payload, dest)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent++; sent > fairFIFOQueueSize+8 {
+			conn.hold.Unlock()
+			t.Fatal("expected Send to wait once the queue was full")
+		}
+	}
+	if n := ra.DropCounts()[DropQueueFull]; n != 0 {
+		conn.hold.Unlock()
+		t.Fatalf("expected no packets to be dropped, got %d", n)
+	}
+
+	// A waiting Send goes through once there is room again.
+	errs := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_, err := ra.Send(ctx, payload, dest)
+		errs <- err
+	}()
+	time.Sleep(sendPollInterval * 4)
+	conn.hold.Unlock()
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendWithoutRoute(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	if _, err := r.Send(context.Background(), []byte("hello"), types.Coordinates{5}); !errors.Is(err, ErrNotQueued) {
+		t.Fatalf("expected ErrNotQueued, got %v", err)
+	}
+	if _, err := r.Send(context.Background(), []byte("hello"), r.Coords()); err != nil {
+		t.Fatalf("expected a packet to ourselves to be looped back, got %v", err)
+	}
+}
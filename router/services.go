@@ -0,0 +1,210 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// ServiceConn is a packet connection for one of several local applications
+// that share the router, i.e. so that a daemon can run the session layer, a
+// management protocol and an application protocol all at once. Packets sent
+// with it carry its service ID, and packets that arrive for its service ID
+// are delivered to it instead of to the router's own ReadFrom, which only
+// receives packets for service 0. Packets for a service that nobody is
+// listening on are dropped. Nodes that don't know about services forward the
+// frames unchanged, but will deliver them to ReadFrom if they are the
+// destination.
+type ServiceConn struct {
+	router       *Router
+	id           types.ServiceID
+	traffic      queue
+	closed       chan struct{}
+	closing      atomic.Bool
+	readDeadline *atomic.Time // zero if there is no deadline
+}
+
+// ListenService returns a packet connection for the given service ID, which
+// must not be 0 and must not already be in use. The connection must be closed
+// once it is no longer needed, so that the ID can be used again.
+func (r *Router) ListenService(id types.ServiceID) (*ServiceConn, error) {
+	if id == 0 {
+		return nil, fmt.Errorf("service 0 is reserved for ReadFrom and WriteTo")
+	}
+	queues, depth := uint16(trafficBuffer), fairFIFOQueueSize
+	if r.embedded {
+		queues, depth = embeddedTrafficQueues, embeddedQueueDepth
+	}
+	c := &ServiceConn{
+		router:       r,
+		id:           id,
+		traffic:      newFairFIFOQueue(queues, depth, r.log),
+		closed:       make(chan struct{}),
+		readDeadline: atomic.NewTime(time.Time{}),
+	}
+	if _, loaded := r.services.LoadOrStore(id, c); loaded {
+		return nil, fmt.Errorf("service %d is already in use", id)
+	}
+	return c, nil
+}
+
+// frameService returns the service ID that the frame carries, or 0 if it
+// doesn't carry a valid one.
+func frameService(frame *types.Frame) types.ServiceID {
+	if len(frame.Extensions) == 0 {
+		return 0
+	}
+	value, ok := frame.Extension(types.ExtensionTypeService)
+	if !ok || len(value) != types.ServiceIDSize {
+		return 0
+	}
+	var id types.ServiceID
+	_, _ = id.UnmarshalBinary(value)
+	return id
+}
+
+// deliverService queues a traffic frame that was delivered to this node for
+// the service that it carries. It returns false if the frame isn't for a
+// service, so that it should be delivered to ReadFrom instead.
+func (r *Router) deliverService(frame *types.Frame) bool {
+	id := frameService(frame)
+	if id == 0 {
+		return false
+	}
+	v, ok := r.services.Load(id)
+	if !ok {
+		r.conformance.drop(DropNoService, frame.SourceKey, frame)
+		putFrame(frame)
+		return true
+	}
+	v.(*ServiceConn).traffic.push(frame)
+	return true
+}
+
+// ID returns the service ID of the connection.
+func (c *ServiceConn) ID() types.ServiceID {
+	return c.id
+}
+
+// ReadFrom reads the next packet for the service, in the same way as the
+// router's ReadFrom, which includes returning no packet and no error once the
+// read deadline has passed. ErrServiceClosed is returned once the connection
+// has been closed.
+func (c *ServiceConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var timeout <-chan time.Time
+	if deadline := c.readDeadline.Load(); !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var frame *types.Frame
+	select {
+	case <-c.router.context.Done():
+		return 0, nil, ErrServiceClosed
+	case <-c.closed:
+		return 0, nil, ErrServiceClosed
+	case <-timeout:
+		return 0, nil, nil
+	case frame = <-c.traffic.pop():
+		c.traffic.ack()
+	}
+	if frame == nil {
+		return 0, nil, nil
+	}
+	defer putFrame(frame)
+
+	switch frame.Type {
+	case types.TypeTreeRouted:
+		addr = frame.Source
+	case types.TypeVirtualSnakeRouted:
+		addr = frame.SourceKey
+	default:
+		return 0, nil, nil
+	}
+	n = copy(p, frame.Payload)
+	return n, addr, nil
+}
+
+// WriteTo sends a packet for the same service on the node at the given
+// address, in the same way as the router's WriteTo.
+func (c *ServiceConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.closed:
+		return 0, ErrServiceClosed
+	default:
+	}
+	r := c.router
+	frame, loopback, err := r.localFrame(p, addr)
+	if err != nil {
+		return 0, err
+	}
+	var value [types.ServiceIDSize]byte
+	_, _ = c.id.MarshalBinary(value[:])
+	if err = frame.SetExtension(types.ExtensionTypeService, value[:]); err != nil {
+		putFrame(frame)
+		return 0, fmt.Errorf("frame.SetExtension: %w", err)
+	}
+	if loopback {
+		if err = r.loopback(frame); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	phony.Block(r.state, func() {
+		err = r.state._forward(r.local, frame)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close stops the service, dropping any packets that are waiting to be read,
+// and frees up its service ID.
+func (c *ServiceConn) Close() error {
+	if !c.closing.CAS(false, true) {
+		return nil
+	}
+	c.router.services.Delete(c.id)
+	close(c.closed)
+	c.traffic.reset()
+	return nil
+}
+
+// LocalAddr returns the public key of the node.
+func (c *ServiceConn) LocalAddr() net.Addr {
+	return c.router.PublicKey()
+}
+
+// SetDeadline sets the read deadline, since writes never block.
+func (c *ServiceConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *ServiceConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Store(t)
+	return nil
+}
+
+// SetWriteDeadline is not implemented, since writes never block.
+func (c *ServiceConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,120 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestListenService(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	ra, rb := routers[0], routers[1]
+
+	if _, err := rb.ListenService(0); err == nil {
+		t.Fatal("expected service 0 to be refused")
+	}
+	sa, err := ra.ListenService(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sa.Close()
+	sb, err := rb.ListenService(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	if _, err := rb.ListenService(7); err == nil {
+		t.Fatal("expected a service ID that is in use to be refused")
+	}
+
+	buf := make([]byte, types.MaxPayloadSize)
+	read := func(read func([]byte) (int, types.PublicKey, bool), what string) string {
+		n, from, ok := read(buf)
+		if !ok {
+			return ""
+		}
+		if from != ra.PublicKey() {
+			t.Fatalf("expected %s to come from the sender, got %s", what, from)
+		}
+		return string(buf[:n])
+	}
+	readService := func(c *ServiceConn) func([]byte) (int, types.PublicKey, bool) {
+		return func(b []byte) (int, types.PublicKey, bool) {
+			_ = c.SetReadDeadline(time.Now().Add(time.Second))
+			n, addr, err := c.ReadFrom(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, _ := addr.(types.PublicKey)
+			return n, key, addr != nil
+		}
+	}
+	readRouter := func(b []byte) (int, types.PublicKey, bool) {
+		_ = rb.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+		n, addr, _ := rb.ReadFrom(b)
+		key, _ := addr.(types.PublicKey)
+		return n, key, addr != nil
+	}
+
+	// Packets for the service go to the service, not to ReadFrom, and
+	// packets without a service go to ReadFrom.
+	if _, err := sa.WriteTo([]byte("service"), rb.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ra.WriteTo([]byte("default"), rb.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(readService(sb), "service packet"); got != "service" {
+		t.Fatalf("expected the service packet on the service, got %q", got)
+	}
+	if got := read(readRouter, "default packet"); got != "default" {
+		t.Fatalf("expected the default packet on ReadFrom, got %q", got)
+	}
+
+	// Once the service is closed, packets for it are dropped rather than
+	// being delivered to ReadFrom, and the ID can be used again.
+	_ = sb.Close()
+	if _, _, err := sb.ReadFrom(buf); err != ErrServiceClosed {
+		t.Fatalf("expected ErrServiceClosed, got %v", err)
+	}
+	if _, err := sa.WriteTo([]byte("closed"), rb.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(readRouter, "packet for a closed service"); got != "" {
+		t.Fatalf("expected the packet for the closed service to be dropped, got %q", got)
+	}
+	if sb, err = rb.ListenService(7); err != nil {
+		t.Fatalf("expected the service ID to be free again, got %s", err)
+	}
+	defer sb.Close()
+}
+
+func TestListenServiceLoopback(t *testing.T) {
+	routers := newBenchChain(t, 1)
+	r := routers[0]
+	defer r.Close()
+
+	c, err := r.ListenService(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.WriteTo([]byte("hello"), r.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, types.MaxPayloadSize)
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Fatalf("expected the packet to be looped back to the service, got %q", got)
+	}
+}
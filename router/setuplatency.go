@@ -0,0 +1,203 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// setupLatencyBuckets are the upper bounds of the setup latency histogram
+// buckets. Anything slower goes into a final bucket with no upper bound.
+var setupLatencyBuckets = []time.Duration{
+	time.Millisecond * 10,
+	time.Millisecond * 25,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Millisecond * 2500,
+	time.Second * 5,
+	time.Second * 10,
+	time.Second * 30,
+}
+
+// slowSetupThreshold is how long a path can take to be set up before it is
+// logged as slow.
+const slowSetupThreshold = time.Second
+
+// SetupLatency describes how long it takes for snake paths to be set up,
+// which is roughly how long it takes for a node to become reachable by key
+// after joining the network.
+type SetupLatency struct {
+	// Ascending is how long the bootstraps from our new descending nodes
+	// took to reach us, which is how long it took to set up the ascending
+	// path of the node that sent them. Since this compares the clock of the
+	// sender to our own, it is only as accurate as the clocks are in sync.
+	Ascending LatencyHistogram `json:"ascending"`
+	// Descending is how long it took for us to find a descending node, from
+	// when we didn't have one, i.e. after joining the network or losing the
+	// previous one, until we accepted a bootstrap from a new one.
+	Descending LatencyHistogram `json:"descending"`
+	// Slow is how many of the setups above took longer than a second, each
+	// of which is also logged.
+	Slow uint64 `json:"slow"`
+}
+
+// LatencyHistogram counts latencies into buckets. The last bucket has an
+// upper bound of zero and counts everything slower than the one before it.
+type LatencyHistogram struct {
+	Buckets []LatencyBucket `json:"buckets"`
+	Count   uint64          `json:"count"`
+	Sum     time.Duration   `json:"sum_ns"`
+	Max     time.Duration   `json:"max_ns"`
+}
+
+// LatencyBucket is a single bucket of a LatencyHistogram, counting the
+// latencies that were no higher than the upper bound and higher than the
+// upper bound of the bucket before it.
+type LatencyBucket struct {
+	UpperBound time.Duration `json:"le_ns"`
+	Count      uint64        `json:"count"`
+}
+
+// Mean returns the mean latency, or zero if nothing was counted.
+func (h LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// latencyHistogram is a histogram that is only accessed by the state actor.
+type latencyHistogram struct {
+	counts []uint64 // one for each bucket and one for the overflow bucket
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(setupLatencyBuckets)+1)
+	}
+	i := 0
+	for i < len(setupLatencyBuckets) && d > setupLatencyBuckets[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	s := LatencyHistogram{
+		Buckets: make([]LatencyBucket, len(setupLatencyBuckets)+1),
+		Count:   h.count,
+		Sum:     h.sum,
+		Max:     h.max,
+	}
+	for i := range s.Buckets {
+		if i < len(setupLatencyBuckets) {
+			s.Buckets[i].UpperBound = setupLatencyBuckets[i]
+		}
+		if h.counts != nil {
+			s.Buckets[i].Count = h.counts[i]
+		}
+	}
+	return s
+}
+
+// setupLatency holds the snake path setup histograms. It is only accessed
+// by the state actor.
+type setupLatency struct {
+	ascending  latencyHistogram
+	descending latencyHistogram
+	slow       uint64
+	wanted     time.Time // when did we start looking for a descending node, zero if not looking
+}
+
+// _recordAscendingSetup is called when we accept a bootstrap from a new
+// descending node. The sequence number of a bootstrap is the time when it
+// was sent, in Unix milliseconds.
+func (s *state) _recordAscendingSetup(from *peer, rx *types.Frame, sequence types.Varu64) {
+	d := s.r.clock.now().Sub(time.UnixMilli(int64(sequence)))
+	if d < 0 {
+		d = 0 // the clocks are out of sync
+	}
+	s._setup.ascending.record(d)
+	if d >= slowSetupThreshold {
+		s._setup.slow++
+		s.r.log.Printf(
+			"Slow snake setup: bootstrap from %s took %s to reach us from coords %s via peer %s on port %d, our coords are %s",
+			rx.DestinationKey.String()[:8], d.Round(time.Millisecond), rx.Source,
+			from.public.String()[:8], from.port, s._coords(),
+		)
+	}
+}
+
+// _recordDescendingSetup is called whenever our descending node changes.
+// The time is taken from when we lost our descending node, or from when we
+// joined the network if we didn't have one, until we have one again. We
+// aren't looking for one if we have no peers at all.
+func (s *state) _recordDescendingSetup(node *virtualSnakeEntry) {
+	switch {
+	case node == nil:
+		if s._setup.wanted.IsZero() && s._hasPeers() {
+			s._setup.wanted = s.r.clock.now()
+		}
+	case !s._setup.wanted.IsZero():
+		d := s.r.clock.since(s._setup.wanted)
+		s._setup.wanted = time.Time{}
+		s._setup.descending.record(d)
+		if d >= slowSetupThreshold {
+			s._setup.slow++
+			s.r.log.Printf(
+				"Slow snake setup: took %s to find descending node %s via peer %s on port %d",
+				d.Round(time.Millisecond), node.PublicKey.String()[:8],
+				node.Source.public.String()[:8], node.Source.port,
+			)
+		}
+	}
+}
+
+// _hasPeers returns true if we have at least one working peering.
+func (s *state) _hasPeers() bool {
+	for _, p := range s._peers {
+		if p != nil && p.port != 0 && p.started.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupLatency returns the snake path setup latency histograms.
+func (r *Router) SetupLatency() SetupLatency {
+	var latency SetupLatency
+	phony.Block(r.state, func() {
+		latency = SetupLatency{
+			Ascending:  r.state._setup.ascending.snapshot(),
+			Descending: r.state._setup.descending.snapshot(),
+			Slow:       r.state._setup.slow,
+		}
+	})
+	return latency
+}
@@ -0,0 +1,52 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	if s := h.snapshot(); s.Count != 0 || len(s.Buckets) != len(setupLatencyBuckets)+1 {
+		t.Fatalf("expected an empty histogram, got %+v", s)
+	}
+	h.record(time.Millisecond * 5)
+	h.record(time.Millisecond * 10)
+	h.record(time.Millisecond * 11)
+	h.record(time.Minute)
+
+	s := h.snapshot()
+	if s.Count != 4 || s.Max != time.Minute {
+		t.Fatalf("expected 4 latencies up to a minute, got %d up to %s", s.Count, s.Max)
+	}
+	if s.Buckets[0].Count != 2 || s.Buckets[1].Count != 1 {
+		t.Fatalf("expected 2 and 1 in the first buckets, got %d and %d", s.Buckets[0].Count, s.Buckets[1].Count)
+	}
+	last := s.Buckets[len(s.Buckets)-1]
+	if last.UpperBound != 0 || last.Count != 1 {
+		t.Fatalf("expected 1 in the overflow bucket, got %+v", last)
+	}
+	if mean := s.Mean(); mean != (time.Millisecond*26+time.Minute)/4 {
+		t.Fatalf("unexpected mean %s", mean)
+	}
+}
+
+func TestSetupLatencyRecorded(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	// The node with the higher key takes the other as its descending node,
+	// so it's the one that sees the bootstrap arrive.
+	r := routers[0]
+	if r.PublicKey().CompareTo(routers[1].PublicKey()) < 0 {
+		r = routers[1]
+	}
+	waitFor(t, "setup latency", func() bool {
+		latency := r.SetupLatency()
+		return latency.Ascending.Count > 0 && latency.Descending.Count > 0
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "github.com/matrix-org/pinecone/types"
+
+// LinkDirection says which way traffic can flow over a peering. Some links,
+// i.e. certain radio setups, can only carry traffic in one direction. The
+// handshake, keepalives and tree announcements are still exchanged in both
+// directions, i.e. over a slower return channel, so that each side knows the
+// coordinates of the other, but traffic is only ever forwarded the way that
+// the link allows.
+//
+// A one-way peer is never chosen as our parent, since a parent has to carry
+// traffic both up and down the tree, and bootstraps are never sent or
+// accepted over one, since the snake path that they build would need to carry
+// traffic back the other way.
+type LinkDirection int
+
+const (
+	// LinkBidirectional peerings carry traffic in both directions. This is
+	// the default.
+	LinkBidirectional LinkDirection = iota
+	// LinkSendOnly peerings only carry traffic from us to the peer. Any
+	// traffic that the peer sends to us is dropped.
+	LinkSendOnly
+	// LinkReceiveOnly peerings only carry traffic from the peer to us, so
+	// the peer is never chosen as a next-hop.
+	LinkReceiveOnly
+)
+
+func (d LinkDirection) String() string {
+	switch d {
+	case LinkBidirectional:
+		return "bidirectional"
+	case LinkSendOnly:
+		return "send only"
+	case LinkReceiveOnly:
+		return "receive only"
+	default:
+		return "unknown"
+	}
+}
+
+// sends returns true if traffic can be sent to the peer.
+func (d LinkDirection) sends() bool {
+	return d != LinkReceiveOnly
+}
+
+// receives returns true if traffic can be received from the peer.
+func (d LinkDirection) receives() bool {
+	return d != LinkSendOnly
+}
+
+// ConnectionLinkDirection sets which way traffic can flow over the peering,
+// as seen from this side. The remote side should be given the opposite
+// direction, otherwise it may try to send traffic that we will drop.
+type ConnectionLinkDirection LinkDirection
+
+func (c ConnectionLinkDirection) isConnectionOption() {}
+
+// _acceptsTraffic returns true if a frame received from the peer can be
+// handled, which is always the case for protocol frames, but traffic is
+// dropped if it arrived on a link that shouldn't carry it towards us.
+func (p *peer) _acceptsTraffic(f *types.Frame) bool {
+	switch f.Type {
+	case types.TypeTreeRouted, types.TypeVirtualSnakeRouted:
+		return p._direction.receives()
+	default:
+		return true
+	}
+}
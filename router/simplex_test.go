@@ -0,0 +1,146 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+func TestOneWayNextHopTree(t *testing.T) {
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 1}
+	self := &peer{started: *atomic.NewBool(true)}
+	oneway := &peer{started: *atomic.NewBool(true)}
+	ourAnn := &rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{Root: root},
+	}
+	ourAnn.Signatures = []types.SignatureWithHop{{Hop: 1}, {Hop: 0}}
+	peerAnn := &rootAnnouncementWithTime{
+		receiveTime:  time.Now(),
+		receiveOrder: 1,
+		SwitchAnnouncement: types.SwitchAnnouncement{
+			Root:       root,
+			Signatures: []types.SignatureWithHop{{Hop: 1}, {Hop: 2}, {Hop: 0}},
+		},
+	}
+	anns := announcementTable{oneway: peerAnn}
+	nextHop := func() *peer {
+		return getNextHopTree(treeNextHopParams{
+			destinationCoords: types.Coordinates{1, 2},
+			ourCoords:         types.Coordinates{1},
+			selfPeer:          self,
+			lastAnnouncement:  ourAnn,
+			peerAnnouncements: &anns,
+		})
+	}
+
+	oneway._direction = LinkSendOnly
+	if p := nextHop(); p != oneway {
+		t.Fatalf("expected to send over a send-only link, got %v", p)
+	}
+	oneway._direction = LinkReceiveOnly
+	if p := nextHop(); p != nil {
+		t.Fatalf("expected no route over a receive-only link, got %v", p)
+	}
+}
+
+func TestOneWayNextHopSNEK(t *testing.T) {
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 1}
+	self := &peer{started: *atomic.NewBool(true), public: types.PublicKey{4}}
+	oneway := &peer{started: *atomic.NewBool(true), public: types.PublicKey{6}, _direction: LinkSendOnly}
+	ourAnn := &rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{Root: root},
+	}
+	anns := announcementTable{
+		oneway: &rootAnnouncementWithTime{
+			receiveTime:  time.Now(),
+			receiveOrder: 1,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: root,
+				Signatures: []types.SignatureWithHop{
+					{PublicKey: types.PublicKey{5}},
+					{PublicKey: types.PublicKey{6}},
+				},
+			},
+		},
+	}
+	nextHop := func(bootstrap bool) *peer {
+		p, _ := getNextHopSNEK(virtualSnakeNextHopParams{
+			isBootstrap:       bootstrap,
+			destinationKey:    types.PublicKey{5},
+			publicKey:         self.public,
+			watermark:         types.VirtualSnakeWatermark{PublicKey: types.FullMask},
+			selfPeer:          self,
+			lastAnnouncement:  ourAnn,
+			peerAnnouncements: anns,
+			snakeRoutes:       virtualSnakeTable{},
+		})
+		return p
+	}
+
+	if p := nextHop(false); p != oneway {
+		t.Fatalf("expected traffic to be sent over the send-only link, got %v", p)
+	}
+	if p := nextHop(true); p == oneway {
+		t.Fatal("expected bootstraps not to be sent over the send-only link")
+	}
+}
+
+func TestOneWayAcceptsTraffic(t *testing.T) {
+	for _, tc := range []struct {
+		direction LinkDirection
+		traffic   bool
+	}{
+		{LinkBidirectional, true},
+		{LinkSendOnly, false},
+		{LinkReceiveOnly, true},
+	} {
+		p := &peer{_direction: tc.direction}
+		for _, ft := range []types.FrameType{types.TypeTreeRouted, types.TypeVirtualSnakeRouted} {
+			if accepted := p._acceptsTraffic(&types.Frame{Type: ft}); accepted != tc.traffic {
+				t.Fatalf("%s link: expected accepted %v for %s, got %v", tc.direction, tc.traffic, ft, accepted)
+			}
+		}
+		if !p._acceptsTraffic(&types.Frame{Type: types.TypeTreeAnnouncement}) {
+			t.Fatalf("%s link: expected tree announcements to be accepted", tc.direction)
+		}
+	}
+}
+
+func TestOneWayNeverParent(t *testing.T) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false)
+	rb := NewRouter(nil, skb, false)
+	defer ra.Close()
+	defer rb.Close()
+
+	pa, pb := net.Pipe()
+	connectEnds(t,
+		pairEnd{ra, pa, []ConnectionOption{ConnectionLinkDirection(LinkSendOnly)}},
+		pairEnd{rb, pb, []ConnectionOption{ConnectionLinkDirection(LinkReceiveOnly)}},
+	)
+	waitFor(t, "announcements", func() bool {
+		da, db := ra.StateDump(), rb.StateDump()
+		return len(da.Candidates) == 1 && len(db.Candidates) == 1
+	})
+
+	// Both sides hear each other's announcements, but neither of them can
+	// use the other as a parent, so they each stay as their own root.
+	for _, r := range []*Router{ra, rb} {
+		if !r.TreeInfo().IsRoot() {
+			t.Fatal("expected a one-way peer not to be chosen as a parent")
+		}
+		if reason := r.StateDump().Candidates[0].Ineligible; reason != "one-way link" {
+			t.Fatalf("expected the candidate to be ineligible, got %q", reason)
+		}
+	}
+	for _, p := range ra.Peers() {
+		if p.Port != 0 && LinkDirection(p.Direction) != LinkSendOnly {
+			t.Fatalf("expected a send-only peer, got %s", LinkDirection(p.Direction))
+		}
+	}
+}
@@ -16,9 +16,9 @@ package router
 
 import (
 	"context"
-	"encoding/hex"
 	"fmt"
 	"net"
+	"reflect"
 	"time"
 
 	"github.com/Arceliar/phony"
@@ -37,20 +37,65 @@ const BWReportingInterval = time.Minute
 // state is an actor that owns all of the mutable state for the Pinecone router.
 type state struct {
 	phony.Inbox
-	r               *Router
-	_peers          []*peer            // All switch ports, connected and disconnected
-	_descending     *virtualSnakeEntry // Next descending node in keyspace
-	_parent         *peer              // Our chosen parent in the tree
-	_announcements  announcementTable  // Announcements received from our peers
-	_table          virtualSnakeTable  // Virtual snake DHT entries
-	_ordering       uint64             // Used to order incoming tree announcements
-	_sequence       uint64             // Used to sequence our root tree announcements
-	_treetimer      *time.Timer        // Tree maintenance timer
-	_snaketimer     *time.Timer        // Virtual snake maintenance timer
-	_lastbootstrap  time.Time          // When did we last bootstrap?
-	_waiting        bool               // Is the tree waiting to reparent?
-	_filterPacket   FilterFn           // Function called when forwarding packets
-	_bandwidthTimer *time.Timer
+	r                   *Router
+	_peers              []*peer                               // All switch ports, connected and disconnected
+	_portLimit          int                                   // Maximum number of switch ports, including port 0
+	_descending         *virtualSnakeEntry                    // Next descending node in keyspace
+	_parent             *peer                                 // Our chosen parent in the tree
+	_announcements      announcementTable                     // Announcements received from our peers
+	_history            announcementHistory                   // Recent announcements received from our peers
+	_rootHistory        rootHistory                           // Recent root announcements from all peers, kept after peers go away
+	_table              virtualSnakeTable                     // Virtual snake DHT entries
+	_ordering           uint64                                // Used to order incoming tree announcements
+	_sequence           uint64                                // Used to sequence our root tree announcements
+	_timer              *time.Timer                           // Shared by all of the maintenance, see _maintain
+	_wakeups            uint64                                // How many times has the maintenance timer fired?
+	_lastbootstrap      time.Time                             // When did we last bootstrap?
+	_waiting            bool                                  // Is the tree waiting to reparent?
+	_waitingUntil       time.Time                             // When will the tree stop waiting to reparent?
+	_treeDue            time.Time                             // When will tree maintenance next run?
+	_snakeDue           time.Time                             // When will virtual snake maintenance next run?
+	_scoreDue           time.Time                             // When will peers next be scored?
+	_pexDue             time.Time                             // When will peer exchange next run?
+	_bandwidthDue       time.Time                             // When will bandwidth next be reported, on the system clock?
+	_filterPacket       FilterFn                              // Function called when forwarding packets
+	_middleware         map[types.FrameType][]FrameMiddleware // Middleware for each frame type
+	_treeFallback       bool                                  // Tree-route SNEK traffic that hits a dead end?
+	_keyUsage           map[types.PublicKey]BandwidthUsage    // Cumulative usage by remote key
+	_keyExpiry          map[types.PublicKey]time.Time         // When can the usage of a key be forgotten?
+	_bandwidthCallback  BandwidthCallbackFn                   // Function called on bandwidth reports
+	_dropCallback       DropCallbackFn                        // Function called when local traffic is dropped
+	_lastRoot           types.PublicKey                       // Root key when we last sent announcements
+	_parentChanges      uint64                                // How many times has our parent changed?
+	_rootChanges        uint64                                // How many times has the root changed?
+	_annSuppressed      uint64                                // How many duplicate announcements were ignored?
+	_searches           map[uint64]chan keyspaceResult        // Keyspace searches waiting for responses
+	_metaQueries        metadataQueries                       // Metadata queries waiting for responses
+	_receipts           receipts                              // Deliveries waiting for receipts
+	_receiptSequence    uint64                                // Sequence number of the last receipt requested
+	_tableLimit         int                                   // Maximum number of SNEK table entries, 0 for no limit
+	_tableEviction      SnakeEvictionPolicy                   // Which SNEK table entry to evict when full
+	_tableEvictions     uint64                                // How many SNEK table entries have been evicted?
+	_allowlist          *SnakeAllowlist                       // Keys that may build snake paths through us, nil for all
+	_bootstrapsRejected uint64                                // How many bootstraps were refused by the allowlist?
+	_bootstrapsReplayed uint64                                // How many bootstraps were refused as replays?
+	_replays            replayTable                           // Bootstrap sequence windows by origin
+	_generations        []uint64                              // How many peers has each switch port been given?
+	_pex                map[types.PublicKey]*pexEntry         // PEX records by origin, not including our own
+	_pexSelf            *types.PEXRecord                      // Our own PEX record, if we are advertising one
+	_pexURIs            []string                              // The URIs in our own PEX record
+	_pexTTL             time.Duration                         // How long our own PEX record is valid for
+	_pexHeard           map[*peer]time.Time                   // When did each peer last send us PEX records?
+	_setup              setupLatency                          // Snake path setup latency, see SetupLatency
+	_descChanges        uint64                                // How many times has our descending node changed?
+	_descDeferred       uint64                                // How many descending changes were held back?
+	_descCandidate      descendingCandidate                   // Closer descending node waiting out the hysteresis
+	_topics             topicTable                            // Subscribers to topics that meet at us
+	_subscribed         subscriptionTable                     // Our own topic subscriptions
+	_localQueued        *peer                                 // The peer that Send last queued a frame to
+	_lastCoords         types.Coordinates                     // Our coordinates when we last sent announcements
+	_queuePurged        uint64                                // How many queued frames were dropped when their peer went away?
+	_queueRequeued      uint64                                // How many queued frames were moved to another peer?
 }
 
 // _start resets the state and starts tree and virtual snake maintenance.
@@ -62,66 +107,103 @@ func (s *state) _start() {
 	s._waiting = false
 
 	s._announcements = make(announcementTable, portCount)
+	s._history = make(announcementHistory, portCount)
+	s._pexHeard = make(map[*peer]time.Time, portCount)
 	s._table = virtualSnakeTable{}
+	s._replays = replayTable{}
 
-	if s._treetimer == nil {
-		s._treetimer = time.AfterFunc(announcementInterval, func() {
-			s.Act(nil, s._maintainTree)
+	if s._timer == nil {
+		s._timer = time.AfterFunc(s.r.clock.real(s.r.timers.announcementInterval), func() {
+			s.Act(nil, s._maintain)
 		})
-	}
-
-	if s._snaketimer == nil {
-		s._snaketimer = time.AfterFunc(time.Second, func() {
-			s.Act(nil, s._maintainSnake)
-		})
-	}
-
-	if s._bandwidthTimer == nil {
-		s._bandwidthTimer = time.AfterFunc(time.Until(
-			time.Now().Round(time.Minute).Add(BWReportingInterval)),
-			func() {
-				s.Act(nil, s._reportBandwidth)
-			})
+		s._scoreDue = s.r.clock.now().Add(peerScoreInterval)
+		s._pexDue = s.r.clock.now().Add(pexInterval)
+		s._bandwidthDue = time.Now().Round(time.Minute).Add(BWReportingInterval)
 	}
 
 	s._maintainTreeIn(0)
 	s._maintainSnakeIn(0)
 }
 
-// _maintainTreeIn resets the tree maintenance timer to the specified
-// duration.
-func (s *state) _maintainTreeIn(d time.Duration) {
-	if !s._treetimer.Stop() {
-		select {
-		case <-s._treetimer.C:
-		default:
-		}
+// maintenanceSlack is how far either side of when it is due that peer
+// scoring, peer exchange and bandwidth reporting are allowed to run, so that
+// they share a wakeup with the tree or virtual snake maintenance rather than
+// each having their own. The window is as long as the default bootstrap
+// interval, so an idle node that is bootstrapping always has a wakeup to share.
+const maintenanceSlack = peerScoreInterval / 2
+
+// _maintain runs all of the maintenance that is due and then sets the timer
+// for whatever is due next. All of the maintenance shares a single timer, so
+// that an idle node only wakes up as often as its most frequent task needs.
+func (s *state) _maintain() {
+	select {
+	case <-s.r.context.Done():
+		return
+	default:
+	}
+	s._wakeups++
+	now := s.r.clock.now()
+	early := now.Add(maintenanceSlack)
+	if !now.Before(s._treeDue) {
+		s._maintainTree()
+	}
+	if !now.Before(s._snakeDue) {
+		s._maintainSnake()
 	}
-	s._treetimer.Reset(d)
+	if !early.Before(s._scoreDue) {
+		s._scorePeers()
+	}
+	if !early.Before(s._pexDue) {
+		s._maintainPEX()
+	}
+	if !time.Now().Add(maintenanceSlack).Before(s._bandwidthDue) {
+		s._reportBandwidth()
+	}
+	s._schedule()
 }
 
-// _maintainSnakeIn resets the virtual snake maintenance timer to the
-// specified duration.
-func (s *state) _maintainSnakeIn(d time.Duration) {
-	if !s._snaketimer.Stop() {
-		select {
-		case <-s._snaketimer.C:
-		default:
+// _schedule sets the maintenance timer for whichever maintenance is due
+// first, giving the tasks with slack until the end of their window to share a
+// wakeup. It is safe to call before the state has been started, in which case
+// it does nothing.
+func (s *state) _schedule() {
+	if s._timer == nil {
+		return
+	}
+	now := s.r.clock.now()
+	next := time.Until(s._bandwidthDue.Add(maintenanceSlack))
+	for _, due := range []time.Time{
+		s._treeDue,
+		s._snakeDue,
+		s._scoreDue.Add(maintenanceSlack),
+		s._pexDue.Add(maintenanceSlack),
+	} {
+		if d := s.r.clock.real(due.Sub(now)); d < next {
+			next = d
 		}
 	}
-	s._snaketimer.Reset(d)
+	s._timer.Stop()
+	s._timer.Reset(next)
+}
+
+// _maintainTreeIn schedules tree maintenance for the specified duration.
+func (s *state) _maintainTreeIn(d time.Duration) {
+	s._treeDue = s.r.clock.now().Add(d)
+	s._schedule()
+}
+
+// _maintainSnakeIn schedules virtual snake maintenance for the specified
+// duration.
+func (s *state) _maintainSnakeIn(d time.Duration) {
+	s._snakeDue = s.r.clock.now().Add(d)
+	s._schedule()
 }
 
-// _reportBandwidthIn resets the bandwidth reporting timer to the
-// specified duration.
+// _reportBandwidthIn schedules bandwidth reporting for the specified duration,
+// rounded to the minute on the system clock.
 func (s *state) _reportBandwidthIn(d time.Duration) {
-	if !s._bandwidthTimer.Stop() {
-		select {
-		case <-s._bandwidthTimer.C:
-		default:
-		}
-	}
-	s._bandwidthTimer.Reset(time.Until(time.Now().Round(time.Minute).Add(d)))
+	s._bandwidthDue = time.Now().Round(time.Minute).Add(d)
+	s._schedule()
 }
 
 func (s *state) _reportBandwidth() {
@@ -135,25 +217,30 @@ func (s *state) _reportBandwidth() {
 	peerBandwidth := make(map[string]events.PeerBandwidthUsage)
 	for _, peer := range s._peers {
 		if peer != nil && peer != s.r.local && peer.started.Load() {
-			peerBandwidth[peer.public.String()] = events.PeerBandwidthUsage{
-				Protocol: struct {
-					Rx uint64
-					Tx uint64
-				}{
-					Rx: peer.bytesRxProto.Load(),
-					Tx: peer.bytesTxProto.Load(),
-				},
-				Overlay: struct {
-					Rx uint64
-					Tx uint64
-				}{
-					Rx: peer.bytesRxTraffic.Load(),
-					Tx: peer.bytesTxTraffic.Load(),
-				},
-			}
-			peer.ClearBandwidthCounters()
+			usage := peer.takeBandwidthUsage()
+			s._accountBandwidth(peer, usage)
+
+			// There may be more than one peering with the same public key, so
+			// add the usage together rather than overwriting it.
+			id := peer.public.String()
+			report := peerBandwidth[id]
+			report.Protocol.Rx += usage.RxProto
+			report.Protocol.Tx += usage.TxProto
+			report.Overlay.Rx += usage.RxTraffic
+			report.Overlay.Tx += usage.TxTraffic
+			peerBandwidth[id] = report
+
+			s._enforceQuota(peer)
 		}
 	}
+	s._pruneKeyUsage(time.Now())
+
+	if fn := s._bandwidthCallback; fn != nil {
+		snapshot := s._bandwidthSnapshot()
+		s.r.Act(nil, func() {
+			fn(snapshot)
+		})
+	}
 
 	captureTime := uint64(time.Now().Round(time.Minute).UnixNano())
 	s.r.Act(nil, func() {
@@ -164,63 +251,174 @@ func (s *state) _reportBandwidth() {
 	})
 }
 
+// peerConfig describes a new peering, as worked out by Connect from its
+// options and the handshake.
+type peerConfig struct {
+	conn       net.Conn
+	public     types.PublicKey
+	uri        ConnectionURI
+	zone       ConnectionZone
+	peertype   ConnectionPeerType
+	keepalives bool
+	maxAge     ConnectionQueueMaxAge
+	quota      *ConnectionQuota
+	pacing     ConnectionPacing
+	suspension *suspension
+	datagrams  bool
+	mtu        int
+	version    types.FrameVersion
+	rtt        time.Duration
+	flush      flushPolicy
+	leaf       bool
+	direction  LinkDirection
+	metadata   *types.NodeMetadata
+}
+
 // _addPeer creates a new Peer and adds it to the switch in the next available port
-func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionURI, zone ConnectionZone, peertype ConnectionPeerType, keepalives bool) (types.SwitchPortID, error) {
-	var new *peer
+func (s *state) _addPeer(cfg peerConfig) (types.SwitchPortID, error) {
+	if s._overQuota(cfg.public, cfg.quota) && cfg.quota.Action == QuotaDisconnect {
+		return 0, fmt.Errorf("transfer quota of %d bytes exceeded", cfg.quota.Bytes)
+	}
+	i, ok := s._nextFreePort()
+	if !ok {
+		return 0, ErrPortsExhausted
+	}
+	generation := s._nextGeneration(i)
+	ctx, cancel := context.WithCancel(s.r.context)
+	queues, depth, lifoDepth := uint16(trafficBuffer), fairFIFOQueueSize, trafficBuffer
+	if cfg.peertype == ConnectionPeerType(PeerTypeBluetooth) {
+		queues = 16
+	}
+	if s.r.embedded {
+		queues, depth, lifoDepth = embeddedTrafficQueues, embeddedQueueDepth, embeddedLIFODepth
+	}
+	score := newPeerScore(cfg.rtt)
+	score.slack = s.r.timers.announcementInterval * 3 / 2
+	dropped := s.dropHandlerFor(cfg.public)
+	notify := func(f *types.Frame, reason DropReason) {
+		score.dropped.Inc()
+		dropped(f, reason)
+	}
+	var traffic queue
+	if cfg.maxAge > 0 {
+		lifo := newLIFOQueue(lifoDepth, time.Duration(cfg.maxAge), s.r.log)
+		lifo.notify = notify
+		traffic = lifo
+	} else {
+		fair := newFairFIFOQueue(queues, depth, s.r.log)
+		fair.notify = notify
+		traffic = fair
+	}
+	new := &peer{
+		router:     s.r,
+		port:       types.SwitchPortID(i),
+		conn:       newPeerConn(cfg.conn, s.r.timers.keepaliveTimeout),
+		public:     cfg.public,
+		uri:        cfg.uri,
+		zone:       cfg.zone,
+		peertype:   cfg.peertype,
+		keepalives: cfg.keepalives,
+		context:    ctx,
+		cancel:     cancel,
+		proto:      newFIFOQueue(fifoNoMax, s.r.log),
+		traffic:    traffic,
+		quota:      cfg.quota,
+		pacer:      newPacer(cfg.pacing),
+		flush:      cfg.flush,
+		suspension: cfg.suspension,
+		datagrams:  cfg.datagrams,
+		mtu:        cfg.mtu,
+		version:    cfg.version,
+		score:      score,
+		rates:      &frameRates{},
+		generation: generation,
+		_leaf:      cfg.leaf,
+		_direction: cfg.direction,
+		_metadata:  cfg.metadata,
+	}
+	s._peers[i] = new
+	if s._overQuota(cfg.public, cfg.quota) {
+		new.deprioritised.Store(true)
+	}
+	s.r.log.Println("Connected to peer", new.public.String(), "on port", new.port)
+	v, _ := s.r.active.LoadOrStore(activeIndex{new.public, new.zone}, atomic.NewUint64(0))
+	v.(*atomic.Uint64).Inc()
+	s.sendTreeAnnouncementToPeer(s._rootAnnouncement(), new)
+	s._sendPEXToPeer(new)
+	new.started.Store(true)
+	if s._descending == nil {
+		s._recordDescendingSetup(nil)
+	}
+	new.reader.Act(nil, new._read)
+	new.writer.Act(nil, new._write)
+
+	s.r.Act(nil, func() {
+		s.r._publish(events.PeerAdded{Port: types.SwitchPortID(i), PeerID: new.public.String(), Generation: generation})
+	})
+	return types.SwitchPortID(i), nil
+}
+
+// _peerForConn returns the running peer that is using the given connection,
+// or nil if there isn't one.
+func (s *state) _peerForConn(conn net.Conn) *peer {
+	if !reflect.TypeOf(conn).Comparable() {
+		// Comparing connections of this type would panic, and so they
+		// can't be told apart anyway.
+		return nil
+	}
+	for _, p := range s._peers {
+		if p != nil && p.port != 0 && p.conn.uses(conn) && p.started.Load() {
+			return p
+		}
+	}
+	return nil
+}
+
+// _nextFreePort returns the lowest switch port that isn't in use, growing the
+// port table if all of the existing ports are in use. Reusing the lowest port
+// first keeps our coordinates, and those of our children, as small as possible.
+// Returns false if the port limit has been reached.
+func (s *state) _nextFreePort() (int, bool) {
 	for i, p := range s._peers {
 		if i == 0 || p != nil {
 			// Port 0 is reserved for the local router.
 			// Already allocated ports should be ignored.
 			continue
 		}
-		ctx, cancel := context.WithCancel(s.r.context)
-		queues := uint16(trafficBuffer)
-		if peertype == ConnectionPeerType(PeerTypeBluetooth) {
-			queues = 16
-		}
-		new = &peer{
-			router:     s.r,
-			port:       types.SwitchPortID(i),
-			conn:       conn,
-			public:     public,
-			uri:        uri,
-			zone:       zone,
-			peertype:   peertype,
-			keepalives: keepalives,
-			context:    ctx,
-			cancel:     cancel,
-			proto:      newFIFOQueue(fifoNoMax, s.r.log),
-			traffic:    newFairFIFOQueue(queues, s.r.log),
-		}
-		s._peers[i] = new
-		s.r.log.Println("Connected to peer", new.public.String(), "on port", new.port)
-		v, _ := s.r.active.LoadOrStore(hex.EncodeToString(new.public[:])+string(zone), atomic.NewUint64(0))
-		v.(*atomic.Uint64).Inc()
-		new.proto.push(s.r.state._rootAnnouncement().forPeer(new))
-		new.started.Store(true)
-		new.reader.Act(nil, new._read)
-		new.writer.Act(nil, new._write)
-
-		s.r.Act(nil, func() {
-			s.r._publish(events.PeerAdded{Port: types.SwitchPortID(i), PeerID: new.public.String()})
-		})
-		return types.SwitchPortID(i), nil
+		return i, true
 	}
-
-	return 0, fmt.Errorf("no free switch ports")
+	if len(s._peers) >= s._portLimit {
+		return 0, false
+	}
+	s._peers = append(s._peers, nil)
+	return len(s._peers) - 1, true
 }
 
 // _removePeer removes the Peer from the specified switch port
 func (s *state) _removePeer(port types.SwitchPortID) {
 	peerID := s._peers[port].public.String()
+	generation := s._peers[port].generation
 	s._peers[port] = nil
+	// Shrink the port table again if the highest ports are no longer in
+	// use, so that a burst of peerings doesn't leave it large forever.
+	for n := len(s._peers); n > 1 && s._peers[n-1] == nil; n-- {
+		s._peers = s._peers[:n-1]
+	}
 	s.r.Act(nil, func() {
-		s.r._publish(events.PeerRemoved{Port: port, PeerID: peerID})
+		s.r._publish(events.PeerRemoved{Port: port, PeerID: peerID, Generation: generation})
 	})
 }
 
 func (s *state) _setParent(peer *peer) {
+	changed := s._parent != peer
+	if changed {
+		s._parentChanges++
+	}
 	s._parent = peer
+	if changed {
+		// Having a parent might mean that we can bootstrap now.
+		s._maintainSnakeSooner()
+	}
 
 	s.r.Act(nil, func() {
 		peerID := ""
@@ -240,7 +438,11 @@ func (s *state) _setDescendingNode(node *virtualSnakeEntry) {
 		s._bootstrapSoon()
 	}
 
+	if node != nil && (s._descending == nil || s._descending.PublicKey != node.PublicKey) {
+		s._descChanges++
+	}
 	s._descending = node
+	s._recordDescendingSetup(node)
 
 	s.r.Act(nil, func() {
 		peerID := ""
@@ -253,6 +455,13 @@ func (s *state) _setDescendingNode(node *virtualSnakeEntry) {
 }
 
 func (s *state) _addRouteEntry(index virtualSnakeIndex, entry *virtualSnakeEntry) {
+	if _, ok := s._table[index]; !ok && s._tableLimit > 0 {
+		for len(s._table) >= s._tableLimit {
+			if !s._evictRouteEntry() {
+				break
+			}
+		}
+	}
 	s._table[index] = entry
 
 	s.r.Act(nil, func() {
@@ -290,6 +499,8 @@ func (s *state) _portDisconnected(peer *peer) {
 
 	// Delete the last tree announcement that we received from this peer.
 	delete(s._announcements, peer)
+	delete(s._history, peer)
+	delete(s._pexHeard, peer)
 
 	// Scan the local routing table for any routes that transited this now-dead
 	// peering and remove them from the routing table.
@@ -45,76 +45,288 @@ func (s *state) _nextHopsFor(from *peer, frameType types.FrameType, dest net.Add
 	return nexthop, newWatermark
 }
 
-// _forward handles frames received from a given peer. In most cases, this function will
-// look up the best next-hop for a given frame and forward it to the appropriate peer
-// queue if possible. In some special cases, like tree announcements,
-// special handling will be done before forwarding if needed.
+// frameHandler handles a frame of a specific type that was received from the
+// given peer. Handlers are called on the state actor.
+type frameHandler func(s *state, p *peer, f *types.Frame) error
+
+// FrameMiddleware is called for frames of the type that it was registered for
+// with UseFrameMiddleware, before the router handles or forwards them. It is
+// useful for gathering statistics, filtering or tracing. Calling next continues
+// handling the frame, and returning without calling next drops it. Middleware
+// runs on the state actor, which handles every frame received from every
+// peer, so it must not block or call back into the router, and it must not
+// hold on to the frame after returning.
+type FrameMiddleware func(from types.PublicKey, f *types.Frame, next func() error) error
+
+// frameHandlers contains the handler for every frame type that the router
+// understands. Frames of any other type are dropped. It is populated in init
+// because the handlers can end up calling _forward themselves.
+var frameHandlers map[types.FrameType]frameHandler
+
+func init() {
+	frameHandlers = map[types.FrameType]frameHandler{
+		types.TypeKeepalive:             (*state)._handleKeepaliveFrame,
+		types.TypeTreeAnnouncement:      (*state)._handleTreeAnnouncementFrame,
+		types.TypeTreeRouted:            (*state)._handleTreeRoutedFrame,
+		types.TypeVirtualSnakeRouted:    (*state)._handleSnakeRoutedFrame,
+		types.TypeVirtualSnakeBootstrap: (*state)._handleBootstrapFrame,
+		types.TypePeerExchange:          (*state)._handlePEXFrame,
+	}
+}
+
+// _forward handles frames received from a given peer. After applying the
+// packet filter, the frame is passed through any middleware for its type and
+// then to the handler for its type, which in most cases will look up the best
+// next-hop for the frame and forward it to the appropriate peer queue.
 func (s *state) _forward(p *peer, f *types.Frame) error {
+	// Frames can still be waiting for us after the peer that they came from
+	// has been removed. Its port may belong to someone else by now.
+	if !s._isCurrent(p) {
+		s.r.conformance.drop(DropStalePort, p.public, f)
+		return nil
+	}
+
 	if s._filterPacket != nil && s._filterPacket(p.public, f) {
 		s.r.log.Printf("Packet of type %s destined for port %d [%s] was dropped due to filter rules", f.Type.String(), p.port, p.public.String()[:8])
+		s.r.conformance.drop(DropFiltered, p.public, f)
+		return nil
+	}
+
+	// Observers only follow the tree, so they drop everything else.
+	if s.r.observer && f.Type != types.TypeTreeAnnouncement && f.Type != types.TypeKeepalive {
+		return nil
+	}
+
+	if !s.r.routing.allows(f) {
+		s.r.conformance.drop(DropRoutingMode, p.public, f)
+		return nil
+	}
+
+	if !p._acceptsTraffic(f) {
+		s.r.conformance.drop(DropDirection, p.public, f)
+		return nil
+	}
+
+	switch {
+	case p == s.r.local:
+		s.r.inspector.inspect(DirectionOutbound, f)
+	case f.Type == types.TypeKeepalive, f.Type == types.TypeTreeAnnouncement, f.Type == types.TypePeerExchange:
+		// These only ever travel a single hop, so they are always for us.
+		s.r.inspector.inspect(DirectionInbound, f)
+	}
+
+	handler, ok := frameHandlers[f.Type]
+	if !ok {
+		s.r.conformance.drop(DropUnknownType, p.public, f)
 		return nil
 	}
+	middleware := s._middleware[f.Type]
+	if len(middleware) == 0 {
+		return handler(s, p, f)
+	}
+	var next func(i int) error
+	next = func(i int) error {
+		if i == len(middleware) {
+			return handler(s, p, f)
+		}
+		return middleware[i](p.public, f, func() error {
+			return next(i + 1)
+		})
+	}
+	return next(0)
+}
+
+// _handleKeepaliveFrame handles keepalives, which are sent on a peering and
+// are never forwarded.
+func (s *state) _handleKeepaliveFrame(p *peer, f *types.Frame) error {
+	return nil
+}
+
+// _handleTreeAnnouncementFrame handles tree announcements, which are a special
+// case. The _handleTreeAnnouncement function will generate new tree
+// announcements and send them to peers if needed.
+func (s *state) _handleTreeAnnouncementFrame(p *peer, f *types.Frame) error {
+	if err := s._handleTreeAnnouncement(p, f); err != nil {
+		return fmt.Errorf("s._handleTreeAnnouncement (port %d): %w", p.port, err)
+	}
+	return nil
+}
 
+// _handleTreeRoutedFrame forwards tree-routed traffic towards its destination
+// coordinates.
+func (s *state) _handleTreeRoutedFrame(p *peer, f *types.Frame) error {
 	// Allow overlay loopback traffic by directly forwarding it to the local router.
-	isTreeLoopback := f.Type == types.TypeTreeRouted && f.Destination.EqualTo(s._coords())
-	isSnakeLoopback := f.Type == types.TypeVirtualSnakeRouted && f.DestinationKey == s.r.public
-	if isTreeLoopback || isSnakeLoopback {
+	if f.Destination.EqualTo(s._coords()) {
 		s.r.local.send(f)
 		return nil
 	}
+	nexthop, watermark := s._nextHopsFor(p, f.Type, f.Destination, f.Watermark)
+	return s._forwardTo(p, f, nexthop, watermark)
+}
+
+// _handleSnakeRoutedFrame forwards SNEK-routed traffic towards its destination
+// key, falling back to tree routing if that is enabled and the snake is broken.
+func (s *state) _handleSnakeRoutedFrame(p *peer, f *types.Frame) error {
+	// Allow overlay loopback traffic by directly forwarding it to the local router.
+	// This includes traffic for the other key of a key rotation in progress.
+	if s.r.answersTo(f.DestinationKey) {
+		if f.Extra[0]&keyspaceFlags != 0 && s._handleKeyspaceFrame(f) {
+			return nil
+		}
+		if f.Extra[0]&types.FrameFlagTopic != 0 {
+			s._handleTopicFrame(f, true)
+			return nil
+		}
+		if f.Extra[0]&metadataFlags != 0 {
+			s._handleMetadataFrame(f)
+			return nil
+		}
+		if f.Extra[0]&types.FrameFlagReceipt != 0 {
+			s._handleReceiptFrame(f)
+			return nil
+		}
+		// The frame may be read and recycled as soon as it is sent to the
+		// local router, so look for a receipt request before then.
+		sender := f.SourceKey
+		sequence, wantsReceipt := receiptRequest(f)
+		if s.r.local.send(f) && wantsReceipt {
+			s._sendReceipt(sender, sequence)
+		}
+		return nil
+	}
 
 	var nexthop *peer
 	var watermark types.VirtualSnakeWatermark
-	switch f.Type {
-	case types.TypeTreeRouted:
-		nexthop, watermark = s._nextHopsFor(p, f.Type, f.Destination, f.Watermark)
-	case types.TypeVirtualSnakeBootstrap, types.TypeVirtualSnakeRouted:
+	if len(f.Destination) > 0 {
+		// The frame has already fallen back to tree routing further up
+		// the path, so keep tree routing it towards the coordinates. If
+		// we end up at those coordinates and we aren't the destination
+		// then the coordinates were stale, so drop the frame.
+		nexthop, watermark = s._nextHopsTree(p, f.Destination), f.Watermark
+		if nexthop == p.router.local {
+			s.r.conformance.drop(DropNoRoute, p.public, f)
+			return nil
+		}
+	} else {
 		nexthop, watermark = s._nextHopsFor(p, f.Type, f.DestinationKey, f.Watermark)
+		if s._treeFallback && (nexthop == nil || nexthop == p.router.local) {
+			if treehop, coords := s._nextHopTreeFallback(p, f.DestinationKey); treehop != nil {
+				f.Destination = coords
+				nexthop, watermark = treehop, f.Watermark
+			}
+		}
 	}
-	deadend := nexthop == nil || nexthop == p.router.local
 
-	switch f.Type {
-	case types.TypeTreeAnnouncement:
-		// Tree announcements are a special case. The _handleTreeAnnouncement function
-		// will generate new tree announcements and send them to peers if needed.
-		if err := s._handleTreeAnnouncement(p, f); err != nil {
-			return fmt.Errorf("s._handleTreeAnnouncement (port %d): %w", p.port, err)
-		}
+	// Keyspace queries are delivered to whichever node is closest to the
+	// target, so we answer them here if there's nowhere better to go.
+	if nexthop == s.r.local && f.Extra[0]&keyspaceFlags != 0 {
+		s._handleKeyspaceFrame(f)
 		return nil
+	}
 
-	case types.TypeKeepalive:
-		// Keepalives are sent on a peering and are never forwarded.
+	// The same goes for topic messages, since the closest node to the topic
+	// key is where subscribers and publishers meet.
+	if nexthop == s.r.local && f.Extra[0]&types.FrameFlagTopic != 0 {
+		s._handleTopicFrame(f, false)
 		return nil
+	}
 
-	case types.TypeVirtualSnakeBootstrap:
-		// Bootstrap messages are handled at each node along the path.
-		if !s._handleBootstrap(p, nexthop, f) || deadend {
-			return nil
-		}
+	// Metadata queries and receipts are only meant for the node itself, so
+	// don't pass them to the local router as traffic if the destination
+	// isn't us.
+	if nexthop == s.r.local && f.Extra[0]&(metadataFlags|types.FrameFlagReceipt) != 0 {
+		s.r.conformance.drop(DropNoRoute, p.public, f)
+		return nil
+	}
 
-	case types.TypeVirtualSnakeRouted, types.TypeTreeRouted:
-		// Traffic type packets are forwarded normally by falling through. There
-		// are no special rules to apply to these packets, regardless of whether
-		// they are SNEK-routed or tree-routed.
+	return s._forwardTo(p, f, nexthop, watermark)
+}
+
+// _handleBootstrapFrame handles bootstrap messages, which are handled at each
+// node along the path before being forwarded.
+func (s *state) _handleBootstrapFrame(p *peer, f *types.Frame) error {
+	// Our own bootstraps for the other key of a key rotation might find
+	// their way back to us, but we don't need a path to ourselves.
+	if f.DestinationKey != s.r.public && s.r.answersTo(f.DestinationKey) {
+		return nil
+	}
+	nexthop, watermark := s._nextHopsFor(p, f.Type, f.DestinationKey, f.Watermark)
+	deadend := nexthop == nil || nexthop == p.router.local
+	if !s._handleBootstrap(p, nexthop, f) {
+		return nil
+	}
+	if deadend {
+		// The bootstrap ends with us, so it was delivered to this node.
+		s.r.inspector.inspect(DirectionInbound, f)
+		return nil
 	}
+	return s._forwardTo(p, f, nexthop, watermark)
+}
 
+// _forwardTo sends a frame that was received from the given peer on to the
+// chosen next-hop, as long as doing so wouldn't cause a loop. It returns
+// ErrQueueFull if the next-hop had no room for the frame, which callers
+// other than the local router generally ignore.
+func (s *state) _forwardTo(p *peer, f *types.Frame, nexthop *peer, watermark types.VirtualSnakeWatermark) error {
 	// If the packet's watermark is higher than the previous one or we are
 	// obviously looping, drop the packet.
 	// In the case of initial pong response frames, they are routed back to
 	// the peer we received the ping from so the "loop" is desired.
-	if nexthop == p || watermark.WorseThan(f.Watermark) {
+	switch {
+	case nexthop == p:
+		s.r.conformance.drop(DropLoop, p.public, f)
+		return nil
+	case watermark.WorseThan(f.Watermark):
+		s.r.conformance.drop(DropWatermark, p.public, f)
+		return nil
+	case nexthop == nil:
+		s.r.conformance.drop(DropNoRoute, p.public, f)
 		return nil
 	}
 
 	// If there's a suitable next-hop then try sending the packet. If we fail
 	// to queue up the packet then we will log it but there isn't an awful lot
-	// we can do at this point.
+	// we can do at this point, other than tell the local router if it was the
+	// one that sent it.
 	if watermark.Sequence > 0 {
 		f.Watermark = watermark
 	}
-	if nexthop != nil && !nexthop.send(f) {
+	// Traffic from peers that have exceeded their transfer quota is only
+	// forwarded if the next-hop has nothing else waiting to be sent.
+	if p.deprioritised.Load() && nexthop != s.r.local &&
+		(f.Type == types.TypeTreeRouted || f.Type == types.TypeVirtualSnakeRouted) &&
+		nexthop.traffic.queuecount() > 0 {
+		s.r.conformance.drop(DropQuota, p.public, f)
+		return nil
+	}
+	if !nexthop.send(f) {
 		s.r.log.Println("Dropping forwarded packet of type", f.Type)
+		s.r.conformance.drop(DropQueueFull, nexthop.public, f)
+		return ErrQueueFull
+	}
+	if p == s.r.local {
+		s._localQueued = nexthop
 	}
-
 	return nil
 }
+
+// _nextHopTreeFallback returns the tree next-hop towards the last-known
+// coordinates of the given node, as learned from bootstrap frames that passed
+// through us, along with the coordinates themselves. It returns nil if we
+// don't know the coordinates or if tree routing wouldn't get any closer.
+func (s *state) _nextHopTreeFallback(from *peer, dest types.PublicKey) (*peer, types.Coordinates) {
+	entry, ok := s._table[virtualSnakeIndex{PublicKey: dest}]
+	switch {
+	case !ok || !entry.valid() || len(entry.Coords) == 0:
+		return nil, nil
+	case !entry.Root.EqualTo(&s._rootAnnouncement().Root):
+		// The coordinates were learned from a different tree so
+		// they are meaningless now.
+		return nil, nil
+	}
+	nexthop := s._nextHopsTree(from, entry.Coords)
+	if nexthop == nil || nexthop == s.r.local {
+		return nil, nil
+	}
+	return nexthop, entry.Coords.Copy()
+}
@@ -15,6 +15,7 @@
 package router
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"time"
 
@@ -26,7 +27,7 @@ import (
 // from the actor that owns them, in order to prevent data races.
 
 const virtualSnakeMaintainInterval = time.Second
-const virtualSnakeBootstrapInterval = time.Second * 5
+const virtualSnakeBootstrapInterval = time.Second * 5 // by default, see RouterTimers
 const virtualSnakeNeighExpiryPeriod = virtualSnakeBootstrapInterval * 2
 
 type virtualSnakeTable map[virtualSnakeIndex]*virtualSnakeEntry
@@ -42,13 +43,20 @@ type virtualSnakeEntry struct {
 	Watermark   types.VirtualSnakeWatermark `json:"watermark"`
 	LastSeen    time.Time                   `json:"last_seen"`
 	Root        types.Root                  `json:"root"`
+	Coords      types.Coordinates           `json:"coords"`
+	clock       *clock                      // the clock that LastSeen was taken from
+	timers      *timers                     // the timers that the entry expires by
 }
 
 // valid returns true if the update hasn't expired, or false if it has. It is
 // required for updates to time out eventually, in the case that paths don't get
-// torn down properly for some reason.
+// torn down properly for some reason. Paths that we learned over a suspended
+// peering don't expire, since bootstraps aren't sent over it.
 func (e *virtualSnakeEntry) valid() bool {
-	return time.Since(e.LastSeen) < virtualSnakeNeighExpiryPeriod
+	if e.Source != nil && e.Source.suspension.suspended() {
+		return true
+	}
+	return e.clock.since(e.LastSeen) < e.timers.snakeExpiry()
 }
 
 // _maintainSnake is responsible for working out if we need to send bootstraps
@@ -58,7 +66,9 @@ func (s *state) _maintainSnake() {
 	case <-s.r.context.Done():
 		return
 	default:
-		defer s._maintainSnakeIn(virtualSnakeMaintainInterval)
+		defer func() {
+			s._maintainSnakeIn(s._snakeWait())
+		}()
 	}
 
 	// Work out if we are able to bootstrap. If we are the root node then
@@ -85,16 +95,58 @@ func (s *state) _maintainSnake() {
 	}
 
 	// Send a new bootstrap.
-	if time.Since(s._lastbootstrap) >= virtualSnakeBootstrapInterval {
+	if s.r.clock.since(s._lastbootstrap) >= s.r.timers.bootstrapInterval {
 		s._bootstrapNow()
 	}
 }
 
+// _snakeWait returns how long virtual snake maintenance can wait before it
+// next has something to do, which is either to send a bootstrap, if we send
+// them, or to clean up a path that has expired. It never waits for less than
+// the maintenance interval, nor for more than the bootstrap interval, since a
+// path that is set up in the meantime can't expire any sooner than that.
+func (s *state) _snakeWait() time.Duration {
+	now := s.r.clock.now()
+	next := now.Add(s.r.timers.bootstrapInterval)
+	if s._parent != nil && !s.r.observer && s.r.routing.snake() {
+		if due := s._lastbootstrap.Add(s.r.timers.bootstrapInterval); due.Before(next) {
+			next = due
+		}
+	}
+	expire := func(e *virtualSnakeEntry) {
+		if e.Source != nil && e.Source.suspension.suspended() {
+			return
+		}
+		if due := e.LastSeen.Add(e.timers.snakeExpiry()); due.Before(next) {
+			next = due
+		}
+	}
+	if desc := s._descending; desc != nil {
+		expire(desc)
+	}
+	for _, entry := range s._table {
+		expire(entry)
+	}
+	if wait := next.Sub(now); wait > virtualSnakeMaintainInterval {
+		return wait
+	}
+	return virtualSnakeMaintainInterval
+}
+
 // _bootstrapSoon will reset the bootstrap timer so that we will bootstrap on
 // the next maintenance interval. This is better than calling _bootstrapNow
 // directly which might cause more protocol traffic than necessary.
 func (s *state) _bootstrapSoon() {
-	s._lastbootstrap = time.Now().Add(-virtualSnakeBootstrapInterval)
+	s._lastbootstrap = s.r.clock.now().Add(-s.r.timers.bootstrapInterval)
+	s._maintainSnakeSooner()
+}
+
+// _maintainSnakeSooner brings virtual snake maintenance forward if it now has
+// something to do before it was next due to run.
+func (s *state) _maintainSnakeSooner() {
+	if wait := s._snakeWait(); s._snakeDue.Sub(s.r.clock.now()) > wait {
+		s._maintainSnakeIn(wait)
+	}
 }
 
 // _bootstrapNow is responsible for sending a bootstrap message to the network.
@@ -105,15 +157,33 @@ func (s *state) _bootstrapNow() {
 	if s._parent == nil {
 		return
 	}
+	// Observers don't take part in SNEK so they never bootstrap, and neither
+	// do nodes in tree-only mode.
+	if s.r.observer || !s.r.routing.snake() {
+		return
+	}
+	s._bootstrapAs(s.r.public, s.r.private)
+	// If we are in the middle of a key rotation then we also bootstrap using
+	// the other key, so that paths are built towards us for both keys.
+	if rotation := s.r.rotating(); rotation != nil {
+		s._bootstrapAs(rotation.alias, rotation.private)
+	}
+	s._lastbootstrap = s.r.clock.now()
+}
+
+// _bootstrapAs sends a bootstrap message for the given key.
+func (s *state) _bootstrapAs(public types.PublicKey, private types.PrivateKey) {
 	// Construct the bootstrap packet. We will include our root key and sequence
 	// number in the update so that the remote side can determine if we are both using
 	// the same root node when processing the update.
 	ann := s._rootAnnouncement()
-	b := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
-	defer frameBufferPool.Put(b)
+	pool := s.r.frameBuffers()
+	bp := pool.Get().(*[]byte)
+	defer pool.Put(bp)
+	b := *bp
 	bootstrap := types.VirtualSnakeBootstrap{
 		Root:     ann.Root,
-		Sequence: types.Varu64(time.Now().UnixMilli()),
+		Sequence: types.Varu64(s.r.clock.now().UnixMilli()),
 	}
 	if s.r.secure {
 		protected, err := bootstrap.ProtectedPayload()
@@ -122,7 +192,7 @@ func (s *state) _bootstrapNow() {
 		}
 		copy(
 			bootstrap.Signature[:],
-			ed25519.Sign(s.r.private[:], protected),
+			ed25519.Sign(private[:], protected),
 		)
 	}
 	n, err := bootstrap.MarshalBinary(b[:])
@@ -133,9 +203,9 @@ func (s *state) _bootstrapNow() {
 	// Construct the frame. We set the destination key to be our own public key. As
 	// the bootstrap routing defaults to routing towards higher keys, this should
 	// mean that the message gets forwarded up to the next highest key from ours.
-	send := getFrame()
+	send := s.r.getFrame()
 	send.Type = types.TypeVirtualSnakeBootstrap
-	send.DestinationKey = s.r.public
+	send.DestinationKey = public
 	send.Source = s._coords()
 	send.Payload = append(send.Payload[:0], b[:n]...)
 	send.Watermark = types.VirtualSnakeWatermark{
@@ -145,11 +215,21 @@ func (s *state) _bootstrapNow() {
 
 	// Bootstrap messages are routed using SNEK routing with special rules for
 	// bootstrap packets.
-	if p, w := s._nextHopsSNEK(send.DestinationKey, types.TypeVirtualSnakeBootstrap, send.Watermark); p != nil && p.proto != nil {
+	p, w := getNextHopSNEK(virtualSnakeNextHopParams{
+		true,
+		send.DestinationKey,
+		public,
+		send.Watermark,
+		s._parent,
+		s.r.local,
+		ann,
+		s._announcements,
+		s._table,
+	})
+	if p != nil && p.proto != nil {
 		send.Watermark = w
-		p.proto.push(send)
+		p.sendProto(send)
 	}
-	s._lastbootstrap = time.Now()
 }
 
 type virtualSnakeNextHopParams struct {
@@ -200,6 +280,12 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 
 	// newCandidate updates the best key and best peer with new candidates.
 	newCandidate := func(key types.PublicKey, seq types.Varu64, p *peer) {
+		if !p._carries(destKey) {
+			return // leaf peers only get traffic that is destined for them
+		}
+		if params.isBootstrap && p._direction != LinkBidirectional {
+			return // the path would need to carry traffic back the other way
+		}
 		bestKey, bestSeq, bestPeer, bestAnn = key, seq, p, params.peerAnnouncements[p]
 	}
 	// newCheckedCandidate performs some sanity checks on the candidate before
@@ -226,6 +312,16 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 			// The destination key is higher than our own key, so start using
 			// the path to the root as the first candidate.
 			newCandidate(params.lastAnnouncement.RootPublicKey, 0, params.parentPeer)
+		case util.LessThan(params.lastAnnouncement.RootPublicKey, destKey):
+			// The destination key is higher than the root key. Nodes can't
+			// tell a rotation alias from any other key, so this applies to
+			// every such key: either the other key of a node that is rotating
+			// keys, or a node that is about to become the root but whose
+			// announcements haven't reached us yet. No other key is closer to
+			// it than the root, so bootstraps for it end at the root and
+			// traffic for it should head there to find that path, rather than
+			// stopping here as a dead end.
+			newCandidate(params.lastAnnouncement.RootPublicKey, 0, params.parentPeer)
 		}
 
 		// Check our direct ancestors in the tree, that is, all nodes between
@@ -279,7 +375,8 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 	}
 
 	// Finally, be sure that we're using the best-looking path to our next-hop.
-	// Prefer faster link types and, if not, lower latencies to the root.
+	// Prefer faster link types, then more reliable links and, if not, lower
+	// latencies to the root.
 	if bestPeer != nil && bestAnn != nil {
 		for p, ann := range params.peerAnnouncements {
 			peerKey := p.public
@@ -289,7 +386,12 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 			case p.peertype < bestPeer.peertype:
 				// Prefer faster classes of links if possible.
 				newCandidate(bestKey, bestSeq, p)
-			case p.peertype == bestPeer.peertype &&
+			case p.peertype != bestPeer.peertype:
+				continue
+			case compareScores(p.score.value(), bestPeer.score.value()) > 0:
+				// Prefer links that have been more reliable.
+				newCandidate(bestKey, bestSeq, p)
+			case compareScores(p.score.value(), bestPeer.score.value()) == 0 &&
 				ann.RootSequence == bestAnn.RootSequence &&
 				ann.receiveOrder < bestAnn.receiveOrder:
 				// Prefer links that have the lowest latency to the root.
@@ -318,6 +420,7 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 	var bootstrap types.VirtualSnakeBootstrap
 	_, err := bootstrap.UnmarshalBinary(rx.Payload)
 	if err != nil {
+		s.r.conformance.drop(DropMalformed, from.public, rx)
 		return false
 	}
 	if s.r.secure {
@@ -325,6 +428,7 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 		// to have sent it. Silently drop it if there's a signature problem.
 		protected, err := bootstrap.ProtectedPayload()
 		if err != nil {
+			s.r.conformance.drop(DropMalformed, from.public, rx)
 			return false
 		}
 		if !ed25519.Verify(
@@ -332,15 +436,31 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 			protected,
 			bootstrap.Signature[:],
 		) {
+			s.r.conformance.drop(DropBadSignature, from.public, rx)
 			return false
 		}
 	}
 
+	// Check that the bootstrapping key is allowed to build paths through us.
+	if !s._snakeAllowed(rx.DestinationKey) {
+		s._bootstrapsRejected++
+		s.r.conformance.drop(DropNotAllowed, from.public, rx)
+		return false
+	}
+
 	// Check that the root key and sequence number in the update match our
 	// current root, otherwise we won't be able to route back to them using
 	// tree routing anyway. If they don't match, silently drop the bootstrap.
 	root := s._rootAnnouncement()
 	if !root.Root.EqualTo(&bootstrap.Root) {
+		s.r.conformance.drop(DropRootMismatch, from.public, rx)
+		return false
+	}
+
+	// Check that we haven't seen this bootstrap before, even if the routing
+	// table entry that it would have refreshed has since gone away.
+	if !s._acceptSequence(rx.DestinationKey, uint64(bootstrap.Sequence)) {
+		s.r.conformance.drop(DropReplayed, from.public, rx)
 		return false
 	}
 
@@ -348,12 +468,15 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 	index := virtualSnakeIndex{
 		PublicKey: rx.DestinationKey,
 	}
-	if existing, ok := s._table[index]; ok {
+	existing, ok := s._table[index]
+	unbroken := ok && existing.valid()
+	if ok {
 		switch {
 		case !existing.Root.EqualTo(&bootstrap.Root):
 			break // the root is different
 		case bootstrap.Sequence <= existing.Watermark.Sequence:
 			// TODO: less than-equal to might not be the right thing to do
+			s.r.conformance.drop(DropStaleSequence, from.public, rx)
 			return false
 		}
 	}
@@ -362,8 +485,11 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 		virtualSnakeIndex: &index,
 		Source:            from,
 		Destination:       to,
-		LastSeen:          time.Now(),
+		LastSeen:          s.r.clock.now(),
+		clock:             &s.r.clock,
+		timers:            &s.r.timers,
 		Root:              bootstrap.Root,
+		Coords:            rx.Source.Copy(),
 		Watermark: types.VirtualSnakeWatermark{
 			PublicKey: index.PublicKey,
 			Sequence:  bootstrap.Sequence,
@@ -389,8 +515,9 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 			update = true
 		case util.DHTOrdered(desc.PublicKey, rx.DestinationKey, s.r.public):
 			// The bootstrapping node is closer to us than our previous descending
-			// node was.
-			update = true
+			// node was, although if it has been coming and going then we might
+			// hold on to the previous one for a while longer.
+			update = s._acceptDescending(rx.DestinationKey, unbroken)
 		}
 	case desc == nil || !desc.valid():
 		// We don't have a descending entry, or we did but it expired.
@@ -404,7 +531,107 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 		// yet, so we'll just ignore the bootstrap.
 	}
 	if update {
+		if desc == nil || !desc.valid() || desc.PublicKey != rx.DestinationKey {
+			s._recordAscendingSetup(from, rx, bootstrap.Sequence)
+		}
 		s._setDescendingNode(s._table[index])
 	}
 	return true
 }
+
+// SnakeAllowlist restricts which public keys may build snake paths through
+// this node, which is useful for closed overlays where all of the nodes have
+// keys from a known set or with a known prefix. A key is allowed if it is one
+// of the Keys or starts with one of the Prefixes. Bootstraps from any other
+// key are dropped without being forwarded. Unless the router was created with
+// secure mode enabled, bootstraps are not signed and the key in them can be
+// forged, so the allowlist should only be relied upon in secure mode.
+type SnakeAllowlist struct {
+	Keys     []types.PublicKey
+	Prefixes [][]byte
+}
+
+// copy returns a deep copy of the allowlist, so that the router isn't
+// affected if the caller changes theirs afterwards.
+func (a *SnakeAllowlist) copy() *SnakeAllowlist {
+	if a == nil {
+		return nil
+	}
+	c := &SnakeAllowlist{
+		Keys:     append([]types.PublicKey(nil), a.Keys...),
+		Prefixes: make([][]byte, 0, len(a.Prefixes)),
+	}
+	for _, prefix := range a.Prefixes {
+		c.Prefixes = append(c.Prefixes, append([]byte(nil), prefix...))
+	}
+	return c
+}
+
+// allows returns true if the key is permitted by the allowlist.
+func (a *SnakeAllowlist) allows(key types.PublicKey) bool {
+	for _, k := range a.Keys {
+		if k == key {
+			return true
+		}
+	}
+	for _, prefix := range a.Prefixes {
+		if len(prefix) <= len(key) && bytes.Equal(key[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// _snakeAllowed returns true if the key is allowed to build snake paths
+// through this node. Our own key is always allowed.
+func (s *state) _snakeAllowed(key types.PublicKey) bool {
+	return s._allowlist == nil || key == s.r.public || s._allowlist.allows(key)
+}
+
+// SnakeEvictionPolicy determines which entry is evicted from the virtual
+// snake routing table when it is full.
+type SnakeEvictionPolicy int
+
+const (
+	// SnakeEvictLRU evicts the entry that was refreshed least recently.
+	SnakeEvictLRU SnakeEvictionPolicy = iota
+	// SnakeEvictFarthest evicts the entry whose key is farthest away from
+	// our own key in the keyspace. Entries close to our own key are the most
+	// useful for routing, since they are the ones that help traffic to make
+	// the last few hops towards nodes near us.
+	SnakeEvictFarthest
+)
+
+// _evictRouteEntry removes a single entry from the virtual snake routing
+// table according to the eviction policy. Expired entries are always evicted
+// first. It returns false if there was nothing that could be evicted.
+func (s *state) _evictRouteEntry() bool {
+	var victim *virtualSnakeEntry
+	var victimDistance types.PublicKey
+	for _, entry := range s._table {
+		if entry == s._descending {
+			continue
+		}
+		if !entry.valid() {
+			victim = entry
+			break
+		}
+		switch s._tableEviction {
+		case SnakeEvictFarthest:
+			distance := keyspaceDistance(s.r.public, entry.PublicKey)
+			if victim == nil || distance.CompareTo(victimDistance) > 0 {
+				victim, victimDistance = entry, distance
+			}
+		default:
+			if victim == nil || entry.LastSeen.Before(victim.LastSeen) {
+				victim = entry
+			}
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	s._removeRouteEntry(*victim.virtualSnakeIndex)
+	s._tableEvictions++
+	return true
+}
@@ -1,9 +1,13 @@
 package router
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"testing"
 	"time"
 
+	"github.com/Arceliar/phony"
+
 	"github.com/matrix-org/pinecone/types"
 	"go.uber.org/atomic"
 )
@@ -15,6 +19,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 	rootKey := types.PublicKey{9}
 	parentKey := types.PublicKey{3}
 	higherKey := types.PublicKey{5}
+	aboveRootKey := types.PublicKey{10}
 
 	peers := []*peer{
 		// self
@@ -270,6 +275,76 @@ func TestSNEKNextHopSelection(t *testing.T) {
 					virtualSnakeIndex: &virtualSnakeIndex{PublicKey: destDownKey},
 				}},
 		}, nil}, // handle a bootstrap received from a lower key node
+		{"TestNotBootstrapDestAboveRoot", virtualSnakeNextHopParams{
+			false,
+			aboveRootKey,
+			selfKey,
+			types.VirtualSnakeWatermark{PublicKey: types.FullMask, Sequence: 0},
+			peers[1],
+			peers[0],
+			&selfAnn,
+			announcementTable{
+				peers[1]: &parentAnn,
+			},
+			virtualSnakeTable{},
+		}, peers[1]}, // keys above the root head towards the root
+		{"TestBootstrapDestAboveRoot", virtualSnakeNextHopParams{
+			true,
+			aboveRootKey,
+			selfKey,
+			types.VirtualSnakeWatermark{PublicKey: types.FullMask, Sequence: 0},
+			peers[1],
+			peers[0],
+			&selfAnn,
+			announcementTable{
+				peers[1]: &parentAnn,
+			},
+			virtualSnakeTable{},
+		}, peers[1]}, // bootstraps for keys above the root end at the root
+		{"TestNotBootstrapDestAboveRootIsRoot", virtualSnakeNextHopParams{
+			false,
+			aboveRootKey,
+			rootKey,
+			types.VirtualSnakeWatermark{PublicKey: types.FullMask, Sequence: 0},
+			nil,
+			peers[0],
+			&selfAnn,
+			announcementTable{
+				peers[2]: &parentAnn,
+			},
+			virtualSnakeTable{},
+		}, peers[0]}, // the root has nowhere higher to send it
+		{"TestNotBootstrapDestAboveRootSnakeEntry", virtualSnakeNextHopParams{
+			false,
+			aboveRootKey,
+			selfKey,
+			types.VirtualSnakeWatermark{PublicKey: types.FullMask, Sequence: 0},
+			peers[1],
+			peers[0],
+			&selfAnn,
+			announcementTable{
+				peers[1]: &parentAnn,
+			},
+			virtualSnakeTable{
+				virtualSnakeIndex{}: &virtualSnakeEntry{
+					Source:            peers[3],
+					LastSeen:          time.Now(),
+					virtualSnakeIndex: &virtualSnakeIndex{PublicKey: aboveRootKey},
+				}},
+		}, peers[3]}, // a path for the key is used once it has been built
+		{"TestNotBootstrapDestBelowSelf", virtualSnakeNextHopParams{
+			false,
+			types.PublicKey{1},
+			selfKey,
+			types.VirtualSnakeWatermark{PublicKey: types.FullMask, Sequence: 0},
+			peers[1],
+			peers[0],
+			&selfAnn,
+			announcementTable{
+				peers[1]: &parentAnn,
+			},
+			virtualSnakeTable{},
+		}, peers[0]}, // keys below the root are not sent to the root
 	}
 
 	for _, tc := range cases {
@@ -283,3 +358,95 @@ func TestSNEKNextHopSelection(t *testing.T) {
 		})
 	}
 }
+
+func TestSnakeAllowlist(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	// The bootstraps are built in the same actor call as they are handled,
+	// since our root sequence can move on in between otherwise.
+	bootstrap := func(sk ed25519.PrivateKey, root types.Root) (*types.Frame, error) {
+		var public types.PublicKey
+		copy(public[:], sk.Public().(ed25519.PublicKey))
+		bootstrap := types.VirtualSnakeBootstrap{Root: root}
+		bootstrap.Sequence = types.Varu64(time.Now().UnixNano())
+		protected, err := bootstrap.ProtectedPayload()
+		if err != nil {
+			return nil, err
+		}
+		copy(bootstrap.Signature[:], ed25519.Sign(sk, protected))
+		var b [types.MaxFrameSize]byte
+		n, err := bootstrap.MarshalBinary(b[:])
+		if err != nil {
+			return nil, err
+		}
+		f := getFrame()
+		f.Type = types.TypeVirtualSnakeBootstrap
+		f.DestinationKey = public
+		f.Payload = append(f.Payload[:0], b[:n]...)
+		return f, nil
+	}
+
+	_, allowedKey, _ := ed25519.GenerateKey(nil)
+	_, prefixedKey, _ := ed25519.GenerateKey(nil)
+	var allowed types.PublicKey
+	copy(allowed[:], allowedKey.Public().(ed25519.PublicKey))
+	prefix := []byte(prefixedKey.Public().(ed25519.PublicKey)[:2])
+	var deniedKey ed25519.PrivateKey
+	for deniedKey == nil || bytes.HasPrefix(deniedKey.Public().(ed25519.PublicKey), prefix) {
+		_, deniedKey, _ = ed25519.GenerateKey(nil)
+	}
+	allowlist := &SnakeAllowlist{
+		Keys:     []types.PublicKey{allowed},
+		Prefixes: [][]byte{append([]byte(nil), prefix...)},
+	}
+	r.SetSnakeAllowlist(allowlist)
+	// The router keeps its own copy, so changing ours afterwards must not
+	// change what it allows.
+	allowlist.Keys[0] = types.PublicKey{}
+	allowlist.Prefixes[0][0] ^= 0xFF
+	allowlist.Prefixes = append(allowlist.Prefixes, []byte{})
+
+	var accepted [3]bool
+	var rejected uint64
+	var err error
+	phony.Block(r.state, func() {
+		s := r.state
+		root := s._rootAnnouncement().Root
+		for i, sk := range []ed25519.PrivateKey{allowedKey, prefixedKey, deniedKey} {
+			var f *types.Frame
+			if f, err = bootstrap(sk, root); err != nil {
+				return
+			}
+			accepted[i] = s._handleBootstrap(s.r.local, nil, f)
+		}
+		rejected = s._bootstrapsRejected
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !accepted[0] {
+		t.Fatal("expected bootstrap from allowed key to be accepted")
+	}
+	if !accepted[1] {
+		t.Fatal("expected bootstrap from allowed prefix to be accepted")
+	}
+	if accepted[2] {
+		t.Fatal("expected bootstrap from denied key to be rejected")
+	}
+	if rejected != 1 {
+		t.Fatalf("expected 1 rejected bootstrap but got %d", rejected)
+	}
+
+	// Narrowing the allowlist should remove entries that are no longer
+	// allowed.
+	r.SetSnakeAllowlist(&SnakeAllowlist{})
+	var ok bool
+	phony.Block(r.state, func() {
+		_, ok = r.state._table[virtualSnakeIndex{PublicKey: allowed}]
+	})
+	if ok {
+		t.Fatal("expected entry for key that is no longer allowed to be removed")
+	}
+}
@@ -0,0 +1,148 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPortTableGrowth(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+	r.SetPortLimit(4)
+
+	phony.Block(r.state, func() {
+		s := r.state
+		for want := 1; want < 4; want++ {
+			port, ok := s._nextFreePort()
+			if !ok || port != want {
+				t.Fatalf("expected port %d but got %d (ok=%v)", want, port, ok)
+			}
+			s._peers[port] = &peer{port: types.SwitchPortID(port)}
+		}
+		if _, ok := s._nextFreePort(); ok {
+			t.Fatal("expected the port limit to be reached")
+		}
+
+		// Freeing a port in the middle should cause it to be reused first.
+		s._removePeer(2)
+		if port, ok := s._nextFreePort(); !ok || port != 2 {
+			t.Fatalf("expected port 2 to be reused but got %d (ok=%v)", port, ok)
+		}
+
+		// Freeing the highest port should shrink the port table past
+		// any other free ports below it.
+		s._removePeer(3)
+		if l := len(s._peers); l != 2 {
+			t.Fatalf("expected port table to shrink to 2 but it was %d", l)
+		}
+	})
+}
+
+func TestSnakeTableEviction(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	// Build keys at increasing distances from our own key, so that the
+	// last one is the farthest away and the first one was seen longest ago.
+	keys := make([]types.PublicKey, 4)
+	for i := range keys {
+		keys[i] = r.public
+		keys[i][0] += byte(i + 1)
+	}
+	add := func(s *state, key types.PublicKey, lastSeen time.Time) *virtualSnakeEntry {
+		index := virtualSnakeIndex{PublicKey: key}
+		entry := &virtualSnakeEntry{
+			virtualSnakeIndex: &index,
+			Source:            r.local,
+			LastSeen:          lastSeen,
+		}
+		s._addRouteEntry(index, entry)
+		return entry
+	}
+
+	phony.Block(r.state, func() {
+		s := r.state
+		s._table = virtualSnakeTable{}
+		s._tableLimit, s._tableEviction = 3, SnakeEvictFarthest
+		now := time.Now()
+		for i, key := range keys[:3] {
+			add(s, key, now.Add(time.Duration(i)*time.Second))
+		}
+		// The farthest entry is our descending node, so it must survive.
+		s._descending = s._table[virtualSnakeIndex{PublicKey: keys[2]}]
+		add(s, keys[3], now.Add(time.Second*3))
+		if len(s._table) != 3 {
+			t.Fatalf("expected 3 entries but got %d", len(s._table))
+		}
+		if _, ok := s._table[virtualSnakeIndex{PublicKey: keys[2]}]; !ok {
+			t.Fatal("descending entry was evicted")
+		}
+		if _, ok := s._table[virtualSnakeIndex{PublicKey: keys[1]}]; ok {
+			t.Fatal("expected the farthest non-descending entry to be evicted")
+		}
+
+		// With LRU eviction, the entry seen longest ago goes first.
+		s._tableEviction = SnakeEvictLRU
+		add(s, keys[1], now.Add(time.Minute))
+		if _, ok := s._table[virtualSnakeIndex{PublicKey: keys[0]}]; ok {
+			t.Fatal("expected the least recently seen entry to be evicted")
+		}
+		if s._tableEvictions != 2 {
+			t.Fatalf("expected 2 evictions but got %d", s._tableEvictions)
+		}
+		s._descending = nil
+	})
+}
+
+func TestFrameMiddleware(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false)
+	defer r.Close()
+
+	var order []string
+	r.UseFrameMiddleware(types.TypeKeepalive, func(from types.PublicKey, f *types.Frame, next func() error) error {
+		order = append(order, "filter")
+		if f.Extra[1] == 1 {
+			return nil
+		}
+		return next()
+	})
+	r.UseFrameMiddleware(types.TypeKeepalive, func(from types.PublicKey, f *types.Frame, next func() error) error {
+		order = append(order, "stats")
+		return next()
+	})
+	r.UseFrameMiddleware(types.TypeTreeRouted, func(from types.PublicKey, f *types.Frame, next func() error) error {
+		order = append(order, "other")
+		return next()
+	})
+
+	phony.Block(r.state, func() {
+		f := &types.Frame{Type: types.TypeKeepalive}
+		if err := r.state._forward(r.local, f); err != nil {
+			t.Fatal(err)
+		}
+		f.Extra[1] = 1
+		if err := r.state._forward(r.local, f); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// The second frame should have been dropped by the first middleware
+	// before reaching the second, and middleware for other frame types
+	// should never have run.
+	expected := []string{"filter", "stats", "filter"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected middleware to run as %v but got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected middleware to run as %v but got %v", expected, order)
+		}
+	}
+}
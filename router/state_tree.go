@@ -15,6 +15,7 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"time"
@@ -28,16 +29,46 @@ import (
 // from the actor that owns them, in order to prevent data races.
 
 // announcementInterval is the frequency at which this
-// node will send root announcements to other peers.
+// node will send root announcements to other peers,
+// unless it has been changed with RouterTimers.
 const announcementInterval = time.Minute * 30
 
 // announcementTimeout is the amount of time that must
 // pass without receiving a root announcement before we
-// will assume that the peer is dead.
+// will assume that the peer is dead, unless it has been
+// changed with RouterTimers.
 const announcementTimeout = time.Minute * 45
 
 type announcementTable map[*peer]*rootAnnouncementWithTime
 
+// announcementHistoryLength is how many of the most recent root
+// announcements are remembered for each peer.
+const announcementHistoryLength = 8
+
+// announcementRecord remembers a root announcement that we received from a
+// peer and what we did about it.
+type announcementRecord struct {
+	root     types.Root
+	depth    int
+	received time.Time
+	order    uint64
+	action   TreeAnnouncementAction
+	waiting  bool // no action was taken since we were waiting to reparent
+}
+
+type announcementHistory map[*peer][]announcementRecord
+
+// add appends a record to the history of the given peer, forgetting the
+// oldest record if the history is full.
+func (h announcementHistory) add(p *peer, record announcementRecord) {
+	records := h[p]
+	if len(records) >= announcementHistoryLength {
+		copy(records, records[1:])
+		records = records[:len(records)-1]
+	}
+	h[p] = append(records, record)
+}
+
 // _maintainTree sends out root announcements if we are
 // considering ourselves to be a root node.
 func (s *state) _maintainTree() {
@@ -45,7 +76,7 @@ func (s *state) _maintainTree() {
 	case <-s.r.context.Done():
 		return
 	default:
-		defer s._maintainTreeIn(announcementInterval)
+		defer s._maintainTreeIn(s.r.timers.announcementInterval)
 	}
 
 	// If we don't have a parent then we are acting as if we are a root node,
@@ -85,7 +116,7 @@ func (a *rootAnnouncementWithTime) forPeer(p *peer) *types.Frame {
 	if err := announcement.Sign(p.router.private[:], p.port); err != nil {
 		panic("failed to sign switch announcement: " + err.Error())
 	}
-	frame := getFrame()
+	frame := p.router.getFrame()
 	frame.Type = types.TypeTreeAnnouncement
 	n, err := announcement.MarshalBinary(frame.Payload[:cap(frame.Payload)])
 	if err != nil {
@@ -97,13 +128,19 @@ func (a *rootAnnouncementWithTime) forPeer(p *peer) *types.Frame {
 
 // _rootAnnouncement returns the latest root announcement from our parent.
 // If we are the root, or the announcement from the parent has expired, we
-// will instead return a root update with ourselves as the root.
+// will instead return a root update with ourselves as the root. Observers
+// never consider themselves to be the root, so they will use an empty key
+// instead, which means that any announcement from a peer will be stronger.
 func (s *state) _rootAnnouncement() *rootAnnouncementWithTime {
 	if s._parent == nil || s._announcements[s._parent] == nil {
+		rootKey := s.r.public
+		if s.r.observer {
+			rootKey = types.PublicKey{}
+		}
 		return &rootAnnouncementWithTime{
 			SwitchAnnouncement: types.SwitchAnnouncement{
 				Root: types.Root{
-					RootPublicKey: s.r.public,
+					RootPublicKey: rootKey,
 					RootSequence:  types.Varu64(s._sequence),
 				},
 			},
@@ -145,7 +182,17 @@ func (s *state) _becomeRoot() {
 // sendTreeAnnouncementToPeer signs and sends the given root announcement
 // to a given peer.
 func (s *state) sendTreeAnnouncementToPeer(ann *rootAnnouncementWithTime, p *peer) {
-	p.proto.push(ann.forPeer(p))
+	if s.r.observer {
+		// Observers never send announcements, so that they are never
+		// chosen as a parent or next-hop by their peers.
+		return
+	}
+	if p._disabled {
+		// Nor do disabled ports, so that the peer stops routing via us
+		// once our last announcement to it expires.
+		return
+	}
+	p.sendProto(ann.forPeer(p))
 }
 
 // _sendTreeAnnouncements signs and sends the current root announcement to
@@ -158,6 +205,14 @@ func (s *state) _sendTreeAnnouncements() {
 		}
 		s.sendTreeAnnouncementToPeer(ann, p)
 	}
+	if ann.RootPublicKey != s._lastRoot {
+		s._lastRoot = ann.RootPublicKey
+		s._rootChanges++
+	}
+	if coords := ann.Coords(); !coords.EqualTo(s._lastCoords) {
+		s._lastCoords = coords
+		s._requeueMoved()
+	}
 
 	s.r.Act(nil, func() {
 		coords := []uint64{}
@@ -167,7 +222,7 @@ func (s *state) _sendTreeAnnouncements() {
 
 		var announcementTime int64
 		if ann.RootPublicKey == s.r.public {
-			announcementTime = time.Now().UnixNano()
+			announcementTime = s.r.clock.now().UnixNano()
 		} else {
 			announcementTime = ann.receiveTime.UnixNano()
 		}
@@ -237,6 +292,10 @@ func getNextHopTree(params treeNextHopParams) *peer {
 			continue // ignore peers that haven't sent us announcements
 		case p == params.fromPeer:
 			continue // don't route back where the packet came from
+		case p._disabled:
+			continue // ignore ports that have been administratively disabled
+		case !p._direction.sends():
+			continue // ignore links that only carry traffic towards us
 		case !ourRoot.Root.EqualTo(&ann.Root):
 			continue // ignore peers that are following a different root or seq
 		}
@@ -244,7 +303,20 @@ func getNextHopTree(params treeNextHopParams) *peer {
 		// Look up the coordinates of the peer, and the distance
 		// across the tree to those coordinates.
 		peerCoords := ann.PeerCoords()
+		if p._leaf && !peerCoords.EqualTo(params.destinationCoords) {
+			continue // leaf peers only get traffic that is destined for them
+		}
 		peerDist := int64(peerCoords.DistanceTo(params.destinationCoords))
+		if peerDist == bestDist && bestPeer != nil {
+			// Both peers take the frame equally close to the destination, so
+			// prefer the one that has been clearly more reliable, if any.
+			if c := compareScores(p.score.value(), bestPeer.score.value()); c != 0 {
+				if c > 0 {
+					bestPeer, bestOrdering = p, ann.receiveOrder
+				}
+				continue
+			}
+		}
 		if isBetterNextHopCandidate(peerDist, bestDist, ann.receiveOrder, bestOrdering,
 			bestPeer != nil) {
 			bestPeer, bestDist, bestOrdering = p, peerDist, ann.receiveOrder
@@ -284,6 +356,38 @@ const (
 	InformPeerOfStrongerRoot
 )
 
+func (a TreeAnnouncementAction) String() string {
+	switch a {
+	case DropFrame:
+		return "drop"
+	case AcceptUpdate:
+		return "accept update"
+	case AcceptNewParent:
+		return "accept new parent"
+	case SelectNewParent:
+		return "select new parent"
+	case SelectNewParentWithWait:
+		return "select new parent with wait"
+	case InformPeerOfStrongerRoot:
+		return "inform peer of stronger root"
+	default:
+		return "unknown"
+	}
+}
+
+// announcementDropReason returns the reason code for a root announcement
+// that failed to decode or validate.
+func announcementDropReason(err error) DropReason {
+	switch {
+	case errors.Is(err, types.ErrAnnouncementSignature):
+		return DropBadSignature
+	case errors.Is(err, types.ErrAnnouncementLoop):
+		return DropLoop
+	default:
+		return DropMalformed
+	}
+}
+
 // _handleTreeAnnouncement is called whenever a tree announcement is
 // received from a direct peer. It stores the update and then works out
 // if that update is good news or bad news.
@@ -294,9 +398,15 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 	// peer etc.
 	var newUpdate types.SwitchAnnouncement
 	if _, err := newUpdate.UnmarshalBinary(f.Payload); err != nil {
+		reason := announcementDropReason(err)
+		s.r.conformance.drop(reason, p.public, f)
+		s._recordRootAnnouncement(p, nil, reason.String(), DropFrame, false, types.PublicKey{}, nil)
 		return fmt.Errorf("update unmarshal failed: %w", err)
 	}
 	if err := newUpdate.SanityCheck(p.public); err != nil {
+		reason := announcementDropReason(err)
+		s.r.conformance.drop(reason, p.public, f)
+		s._recordRootAnnouncement(p, &newUpdate, reason.String(), DropFrame, false, types.PublicKey{}, nil)
 		return fmt.Errorf("update sanity checks failed: %w", err)
 	}
 
@@ -304,10 +414,18 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 	// assume that they are up to no good.
 	if ann := s._announcements[p]; ann != nil {
 		if newUpdate.RootPublicKey == ann.RootPublicKey && newUpdate.RootSequence < ann.RootSequence {
+			s.r.conformance.drop(DropStaleSequence, p.public, f)
+			s._recordRootAnnouncement(p, &newUpdate, DropStaleSequence.String(), DropFrame, false, types.PublicKey{}, nil)
 			return fmt.Errorf("update replays old sequence number")
 		}
 	}
 
+	// If we have only just handled the very same update from this peer
+	// then there is nothing new to act on.
+	if s._duplicateAnnouncement(p, &newUpdate) {
+		return nil
+	}
+
 	// Get the key of our current root and then work out if the root
 	// key in the new update is stronger, weaker or the same key.
 	lastParentUpdate := s._rootAnnouncement()
@@ -316,23 +434,39 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 		lastRootKey = lastParentUpdate.RootPublicKey
 	}
 	rootDelta := newUpdate.RootPublicKey.CompareTo(lastRootKey)
+	lastParent, waiting := s._parent, s._waiting
 
 	// Save the root announcement for the peer. If the update is not
 	// obviously bad then it isn't safe to "skip" storing updates.
 	s._ordering++
 	s._announcements[p] = &rootAnnouncementWithTime{
 		SwitchAnnouncement: newUpdate,
-		receiveTime:        time.Now(),
+		receiveTime:        s.r.clock.now(),
 		receiveOrder:       s._ordering,
 	}
+	p.score._announced(s._announcements[p].receiveTime)
+
+	announcementAction := determineAnnouncementAction(p == s._parent,
+		newUpdate.IsLoopOrChildOf(s.r.public), rootDelta,
+		newUpdate.RootSequence, lastParentUpdate.RootSequence)
+	if announcementAction == AcceptNewParent && (p._leaf || p._disabled || p._direction != LinkBidirectional) {
+		// Leaf peers are only a parent of last resort, and disabled ports
+		// and one-way links can't be a parent at all, so check whether any
+		// of our other peers would do instead.
+		announcementAction = SelectNewParent
+	}
+	s._history.add(p, announcementRecord{
+		root:     newUpdate.Root,
+		depth:    len(newUpdate.Signatures),
+		received: s._announcements[p].receiveTime,
+		order:    s._ordering,
+		action:   announcementAction,
+		waiting:  s._waiting,
+	})
 
 	// If we're currently waiting to re-parent then there is no
 	// further action
 	if !s._waiting {
-		announcementAction := determineAnnouncementAction(p == s._parent,
-			newUpdate.IsLoopOrChildOf(s.r.public), rootDelta,
-			newUpdate.RootSequence, lastParentUpdate.RootSequence)
-
 		switch announcementAction {
 		case DropFrame:
 			// Do nothing
@@ -347,9 +481,10 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 			}
 		case SelectNewParentWithWait:
 			s._waiting = true
+			s._waitingUntil = s.r.clock.now().Add(time.Second)
 			s._becomeRoot()
 			// Start the 1 second timer to re-run parent selection.
-			time.AfterFunc(time.Second, func() {
+			time.AfterFunc(s.r.clock.real(time.Second), func() {
 				s.Act(nil, func() {
 					s._waiting = false
 					if s._selectNewParent() {
@@ -361,6 +496,7 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 			s.sendTreeAnnouncementToPeer(lastParentUpdate, p)
 		}
 	}
+	s._recordRootAnnouncement(p, &newUpdate, "", announcementAction, waiting, lastParentUpdate.RootPublicKey, lastParent)
 
 	return nil
 }
@@ -450,8 +586,9 @@ func (s *state) _selectNewParent() bool {
 	bestRoot := root.Root
 
 	// If our own key happens to be stronger than our current root for some
-	// reason then we will just compare against our own key instead.
-	if bestRoot.RootPublicKey.CompareTo(s.r.public) < 0 {
+	// reason then we will just compare against our own key instead. This
+	// doesn't apply to observers since they can never be the root.
+	if !s.r.observer && bestRoot.RootPublicKey.CompareTo(s.r.public) < 0 {
 		bestRoot = types.Root{
 			RootPublicKey: s.r.public,
 			RootSequence:  0,
@@ -459,21 +596,62 @@ func (s *state) _selectNewParent() bool {
 	}
 	bestOrder := uint64(math.MaxUint64)
 	var bestPeer *peer
+	now := s.r.clock.now()
 
 	// Iterate through all of the announcements received from our peers.
-	// This will exclude any peers that haven't sent us updates yet.
-	for peer, ann := range s._announcements {
-		if !peer.started.Load() {
-			// The peer has been stopped for some reason, possibly due to a
-			// timeout or other protocol handling error.
-			continue
+	// This will exclude any peers that haven't sent us updates yet. Leaf
+	// peers are only considered if none of the transit peers will do.
+	for _, leaf := range []bool{false, true} {
+		if bestPeer != nil {
+			break
 		}
+		for peer, ann := range s._announcements {
+			if peer._leaf != leaf || peer._disabled || peer._direction != LinkBidirectional {
+				continue
+			}
+			if !peer.started.Load() {
+				// The peer has been stopped for some reason, possibly due to a
+				// timeout or other protocol handling error.
+				continue
+			}
 
-		if ann != nil {
-			if isBetterParentCandidate(*ann, bestRoot, bestOrder, ann.IsLoopOrChildOf(s.r.public)) {
-				bestRoot = ann.Root
-				bestPeer = peer
-				bestOrder = ann.receiveOrder
+			if ann != nil {
+				// Announcements from a suspended peer don't expire, since the
+				// peer can't send us new ones, so judge them as of when they
+				// were received.
+				at := now
+				if peer.suspension.suspended() {
+					at = ann.receiveTime
+				}
+				if bestPeer != nil && ann.Root.EqualTo(&bestRoot) && !ann.IsLoopOrChildOf(s.r.public) &&
+					at.Sub(ann.receiveTime) < s.r.timers.announcementTimeout {
+					// This peer is following the same root and sequence as our
+					// best candidate so far. If latency-aware parent selection
+					// is on, prefer the one with the cheaper mix of depth and
+					// round trip time.
+					if cost, ok := s._parentCost(peer, ann); ok {
+						if bestCost, ok := s._parentCost(bestPeer, s._announcements[bestPeer]); ok && cost != bestCost {
+							if cost < bestCost {
+								bestPeer, bestOrder = peer, ann.receiveOrder
+							}
+							continue
+						}
+					}
+					// Otherwise prefer the one that has been clearly more
+					// reliable before falling back to which of them sent us
+					// the announcement first.
+					if c := compareScores(peer.score.value(), bestPeer.score.value()); c != 0 {
+						if c > 0 {
+							bestPeer, bestOrder = peer, ann.receiveOrder
+						}
+						continue
+					}
+				}
+				if isBetterParentCandidate(*ann, bestRoot, bestOrder, ann.IsLoopOrChildOf(s.r.public), at, s.r.timers.announcementTimeout) {
+					bestRoot = ann.Root
+					bestPeer = peer
+					bestOrder = ann.receiveOrder
+				}
 			}
 		}
 	}
@@ -501,10 +679,10 @@ func (s *state) _selectNewParent() bool {
 }
 
 func isBetterParentCandidate(ann rootAnnouncementWithTime, bestRoot types.Root,
-	bestOrder uint64, containsLoop bool) bool {
+	bestOrder uint64, containsLoop bool, now time.Time, timeout time.Duration) bool {
 	isBetterCandidate := false
 
-	if time.Since(ann.receiveTime) >= announcementTimeout {
+	if now.Sub(ann.receiveTime) >= timeout {
 		// If the announcement has expired then don't consider this peer
 		// as a possible candidate.
 		return false
@@ -0,0 +1,237 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// StateDump is a snapshot of the view that the state actor has of the tree
+// and the snake at a single point in time. It is intended to be attached to
+// bug reports when the network fails to converge, so that it is possible to
+// see why a node has chosen the parent that it has and what it is waiting on.
+type StateDump struct {
+	Time       time.Time          `json:"time"`
+	PublicKey  types.PublicKey    `json:"public_key"`
+	Root       types.Root         `json:"root"`
+	Coords     types.Coordinates  `json:"coords"`
+	Parent     *types.PublicKey   `json:"parent,omitempty"` // nil if we are the root
+	ParentPort types.SwitchPortID `json:"parent_port,omitempty"`
+	Ordering   uint64             `json:"ordering"` // receive order of the last announcement
+	Candidates []StateCandidate   `json:"candidates"`
+	Peers      []StatePeer        `json:"peers"`
+	Bootstrap  StateBootstrap     `json:"bootstrap"`
+	Timers     StateTimers        `json:"timers"`
+	Searches   int                `json:"keyspace_searches"` // searches waiting for responses
+	Topics     int                `json:"topics"`            // topics that meet at us, see SubscribeTopic
+}
+
+// StateCandidate is a peer that has sent us a root announcement and so may
+// be chosen as our parent. Candidates are listed with the eligible ones
+// first, then by root, sequence and the order that the announcements were
+// received in, which is roughly the order that parent selection prefers them.
+type StateCandidate struct {
+	Port       types.SwitchPortID `json:"port"`
+	PublicKey  types.PublicKey    `json:"public_key"`
+	Root       types.Root         `json:"root"`
+	Depth      int                `json:"depth"`
+	Order      uint64             `json:"order"`
+	Received   time.Time          `json:"received"`
+	Score      int                `json:"score"`
+	Parent     bool               `json:"parent,omitempty"`     // the candidate is our current parent
+	Leaf       bool               `json:"leaf,omitempty"`       // the candidate is only chosen if no transit peer will do
+	Ineligible string             `json:"ineligible,omitempty"` // why the candidate can't be chosen, if it can't
+}
+
+// StatePeer holds the most recent root announcements received from a peer,
+// oldest first.
+type StatePeer struct {
+	Port          types.SwitchPortID  `json:"port"`
+	PublicKey     types.PublicKey     `json:"public_key"`
+	Announcements []StateAnnouncement `json:"announcements"`
+}
+
+// StateAnnouncement is a root announcement that was received from a peer,
+// along with the action that it caused us to take.
+type StateAnnouncement struct {
+	Root     types.Root `json:"root"`
+	Depth    int        `json:"depth"`
+	Order    uint64     `json:"order"`
+	Received time.Time  `json:"received"`
+	Action   string     `json:"action"`
+	Waiting  bool       `json:"waiting,omitempty"` // no action was taken since we were waiting to reparent
+}
+
+// StateBootstrap describes our bootstrapping into the snake.
+type StateBootstrap struct {
+	Enabled    bool             `json:"enabled"` // false if we are the root, an observer or tree-only
+	Last       time.Time        `json:"last"`
+	Due        time.Time        `json:"due"`             // the next bootstrap is sent at the first snake maintenance after this
+	Alias      *types.PublicKey `json:"alias,omitempty"` // also bootstrapped during a key rotation
+	Descending *types.PublicKey `json:"descending,omitempty"`
+	Paths      int              `json:"paths"`
+}
+
+// StateTimers holds when each of the state actor timers will next fire. A
+// zero time means that the timer isn't running.
+type StateTimers struct {
+	Tree     time.Time `json:"tree_maintenance"`
+	Snake    time.Time `json:"snake_maintenance"`
+	Reparent time.Time `json:"reparent"`
+}
+
+// StateDump returns a snapshot of the state actor. Unlike DebugStats, which
+// is mostly about queues and performance, this shows the inputs to parent
+// selection and bootstrapping.
+func (r *Router) StateDump() StateDump {
+	dump := StateDump{
+		Time:      r.clock.now(),
+		PublicKey: r.public,
+	}
+	rotation := r.rotating()
+	phony.Block(r.state, func() {
+		s := r.state
+		root := s._rootAnnouncement()
+		dump.Root = root.Root
+		dump.Coords = s._coords()
+		dump.Ordering = s._ordering
+		if s._parent != nil && s._announcements[s._parent] != nil {
+			parent := s._parent.public
+			dump.Parent, dump.ParentPort = &parent, s._parent.port
+		}
+
+		// Work out which root parent selection would be comparing against,
+		// in the same way that _selectNewParent does.
+		bestRoot := root.Root
+		if !r.observer && bestRoot.RootPublicKey.CompareTo(r.public) < 0 {
+			bestRoot = types.Root{RootPublicKey: r.public}
+		}
+		for p, ann := range s._announcements {
+			if ann == nil {
+				continue
+			}
+			candidate := StateCandidate{
+				Port:      p.port,
+				PublicKey: p.public,
+				Root:      ann.Root,
+				Depth:     len(ann.Signatures),
+				Order:     ann.receiveOrder,
+				Received:  ann.receiveTime,
+				Score:     int(p.score.value()*100 + 0.5),
+				Parent:    p == s._parent,
+				Leaf:      p._leaf,
+			}
+			switch {
+			case !p.started.Load():
+				candidate.Ineligible = "peer stopped"
+			case p._disabled:
+				candidate.Ineligible = "port disabled"
+			case p._direction != LinkBidirectional:
+				candidate.Ineligible = "one-way link"
+			case r.clock.since(ann.receiveTime) >= r.timers.announcementTimeout && !p.suspension.suspended():
+				candidate.Ineligible = "announcement expired"
+			case ann.IsLoopOrChildOf(r.public):
+				candidate.Ineligible = "loop or child"
+			case ann.RootPublicKey.CompareTo(bestRoot.RootPublicKey) < 0:
+				candidate.Ineligible = "weaker root"
+			case ann.RootPublicKey == bestRoot.RootPublicKey && ann.RootSequence < bestRoot.RootSequence:
+				candidate.Ineligible = "old sequence"
+			}
+			dump.Candidates = append(dump.Candidates, candidate)
+		}
+
+		for p, records := range s._history {
+			peer := StatePeer{
+				Port:          p.port,
+				PublicKey:     p.public,
+				Announcements: make([]StateAnnouncement, 0, len(records)),
+			}
+			for _, record := range records {
+				peer.Announcements = append(peer.Announcements, StateAnnouncement{
+					Root:     record.root,
+					Depth:    record.depth,
+					Order:    record.order,
+					Received: record.received,
+					Action:   record.action.String(),
+					Waiting:  record.waiting,
+				})
+			}
+			dump.Peers = append(dump.Peers, peer)
+		}
+
+		dump.Bootstrap = StateBootstrap{
+			Enabled: s._parent != nil && !r.observer && r.routing.snake(),
+			Last:    s._lastbootstrap,
+			Due:     s._lastbootstrap.Add(r.timers.bootstrapInterval),
+			Paths:   len(s._table),
+		}
+		if rotation != nil {
+			alias := rotation.alias
+			dump.Bootstrap.Alias = &alias
+		}
+		if desc := s._descending; desc != nil {
+			descending := desc.PublicKey
+			dump.Bootstrap.Descending = &descending
+		}
+
+		dump.Timers = StateTimers{
+			Tree:  s._treeDue,
+			Snake: s._snakeDue,
+		}
+		if s._waiting {
+			dump.Timers.Reparent = s._waitingUntil
+		}
+		dump.Searches = len(s._searches)
+		dump.Topics = len(s._topics)
+	})
+
+	sort.Slice(dump.Candidates, func(i, j int) bool {
+		a, b := dump.Candidates[i], dump.Candidates[j]
+		if (a.Ineligible == "") != (b.Ineligible == "") {
+			return a.Ineligible == ""
+		}
+		if c := a.Root.RootPublicKey.CompareTo(b.Root.RootPublicKey); c != 0 {
+			return c > 0
+		}
+		if a.Root.RootSequence != b.Root.RootSequence {
+			return a.Root.RootSequence > b.Root.RootSequence
+		}
+		return a.Order < b.Order
+	})
+	sort.Slice(dump.Peers, func(i, j int) bool {
+		return dump.Peers[i].Port < dump.Peers[j].Port
+	})
+	return dump
+}
+
+// StateHandler is an HTTP handler that returns the output of StateDump as
+// JSON, so that a snapshot can be taken from a live node with curl.
+func (r *Router) StateHandler(w http.ResponseWriter, req *http.Request) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(r.StateDump()); err != nil {
+		w.WriteHeader(500)
+		return
+	}
+}
@@ -0,0 +1,45 @@
+package router
+
+import (
+	"testing"
+)
+
+func TestStateDump(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	for i, r := range routers {
+		other := routers[1-i]
+		dump := r.StateDump()
+		if len(dump.Candidates) != 1 {
+			t.Fatalf("expected 1 candidate but got %d", len(dump.Candidates))
+		}
+		if c := dump.Candidates[0]; c.PublicKey != other.PublicKey() || c.Port == 0 {
+			t.Fatalf("unexpected candidate %+v", c)
+		}
+		if len(dump.Peers) != 1 || len(dump.Peers[0].Announcements) == 0 {
+			t.Fatalf("expected announcement history for 1 peer but got %+v", dump.Peers)
+		}
+		if dump.Timers.Tree.IsZero() || dump.Timers.Snake.IsZero() {
+			t.Fatalf("expected maintenance timers to be running")
+		}
+
+		isRoot := dump.Root.RootPublicKey == r.PublicKey()
+		switch {
+		case isRoot && dump.Parent != nil:
+			t.Fatalf("root should not have a parent")
+		case isRoot && dump.Candidates[0].Ineligible == "":
+			t.Fatalf("candidate following a weaker root should be ineligible")
+		case !isRoot && (dump.Parent == nil || *dump.Parent != other.PublicKey()):
+			t.Fatalf("expected parent %s", other.PublicKey())
+		case !isRoot && !dump.Candidates[0].Parent:
+			t.Fatalf("expected candidate to be marked as the parent")
+		case !isRoot && !dump.Bootstrap.Enabled:
+			t.Fatalf("expected non-root node to bootstrap")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// NOTE: Functions prefixed with an underscore (_) are only safe to be called
+// from the actor that owns them, in order to prevent data races.
+
+// RouterAnnouncementSuppression sets a window in which a tree announcement
+// that is identical to the last one from the same peer, with the same root,
+// sequence number and signature chain, is ignored instead of being handled
+// again. Without it, every copy of an announcement from the parent makes us
+// send our own announcements to all of our peers again, even though nothing
+// has changed, which adds up in dense meshes where peers re-send
+// announcements, i.e. after recovering from a suspended or migrated peering.
+// An announcement that arrives after the window has passed is handled as
+// usual, so that it still refreshes the announcement timeout. It is off by
+// default.
+type RouterAnnouncementSuppression time.Duration
+
+func (s RouterAnnouncementSuppression) isRouterOption() {}
+
+// _duplicateAnnouncement returns true if the announcement is identical to the
+// last one that we received from the peer within the suppression window.
+func (s *state) _duplicateAnnouncement(p *peer, update *types.SwitchAnnouncement) bool {
+	if s.r.suppression <= 0 {
+		return false
+	}
+	last := s._announcements[p]
+	switch {
+	case last == nil:
+		return false
+	case s.r.clock.since(last.receiveTime) >= s.r.suppression:
+		return false
+	case !sameAnnouncement(&last.SwitchAnnouncement, update):
+		return false
+	}
+	s._annSuppressed++
+	return true
+}
+
+// sameAnnouncement returns true if the announcements have the same root,
+// sequence number and signature chain.
+func sameAnnouncement(a, b *types.SwitchAnnouncement) bool {
+	if a.Root != b.Root || len(a.Signatures) != len(b.Signatures) {
+		return false
+	}
+	for i := range a.Signatures {
+		if a.Signatures[i] != b.Signatures[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestAnnouncementSuppression(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterAnnouncementSuppression(time.Second*5))
+	defer r.Close()
+
+	p := &peer{}
+	last := types.SwitchAnnouncement{
+		Root: types.Root{RootSequence: 4},
+		Signatures: []types.SignatureWithHop{
+			{Hop: 1}, {Hop: 2},
+		},
+	}
+	phony.Block(r.state, func() {
+		r.state._announcements[p] = &rootAnnouncementWithTime{
+			SwitchAnnouncement: last,
+			receiveTime:        r.clock.now(),
+		}
+	})
+	duplicate := func(from *peer, update types.SwitchAnnouncement) (dup bool) {
+		phony.Block(r.state, func() {
+			dup = r.state._duplicateAnnouncement(from, &update)
+		})
+		return
+	}
+
+	if !duplicate(p, last) {
+		t.Fatal("expected an identical announcement to be suppressed")
+	}
+	newer := last
+	newer.RootSequence++
+	if duplicate(p, newer) {
+		t.Fatal("expected an announcement with a new sequence to be handled")
+	}
+	moved := last
+	moved.Signatures = []types.SignatureWithHop{{Hop: 1}, {Hop: 3}}
+	if duplicate(p, moved) {
+		t.Fatal("expected an announcement with a new path to be handled")
+	}
+	if duplicate(&peer{}, last) {
+		t.Fatal("expected an announcement from another peer to be handled")
+	}
+
+	// Once the window has passed, the same announcement is handled again.
+	r.SetClockSkew(time.Second*10, 1)
+	if duplicate(p, last) {
+		t.Fatal("expected an identical announcement to be handled after the window")
+	}
+	if suppressed := r.TreeStats().Suppressed; suppressed != 1 {
+		t.Fatalf("expected 1 suppressed announcement but got %d", suppressed)
+	}
+}
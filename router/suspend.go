@@ -0,0 +1,191 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// ConnectionIdleSuspend suspends the peering once no traffic has been sent
+// or received over it for the given duration. A suspended peering stays
+// connected but neither side sends keepalives, tree announcements or any
+// other protocol traffic over it, and neither side gives up on the other for
+// being quiet, so that a battery-powered device can let its radio sleep
+// without losing its place in the tree or the snake. The peering resumes as
+// soon as either side has traffic to send over it, or when ResumePeer is
+// called. Peerings can only be suspended if both sides advertised support
+// for it in the handshake. Since idleness is checked when a keepalive would
+// be due, this has no effect if keepalives are disabled, although the peering
+// can still be suspended using SuspendPeer.
+type ConnectionIdleSuspend time.Duration
+
+func (c ConnectionIdleSuspend) isConnectionOption() {}
+
+// suspension tracks whether a peering is suspended. Either side can suspend
+// the peering by sending a keepalive with the suspend extension, and any
+// other frame sent by either side resumes it.
+type suspension struct {
+	idle   time.Duration // Not mutated after peer setup, 0 to only suspend on request.
+	active atomic.Bool   // Thread-safe, true while the peering is suspended.
+	last   atomic.Int64  // Thread-safe, when traffic last went over the peering, in Unix nanoseconds.
+}
+
+// newSuspension returns nil if the remote side can't be suspended, i.e.
+// because it didn't advertise support in the handshake.
+func newSuspension(capable bool, idle ConnectionIdleSuspend) *suspension {
+	if !capable {
+		return nil
+	}
+	s := &suspension{idle: time.Duration(idle)}
+	s.last.Store(time.Now().UnixNano())
+	return s
+}
+
+// suspended returns true if the peering is currently suspended.
+func (s *suspension) suspended() bool {
+	return s != nil && s.active.Load()
+}
+
+// touch notes that traffic went over the peering just now.
+func (s *suspension) touch() {
+	if s == nil || s.idle == 0 {
+		return
+	}
+	s.last.Store(time.Now().UnixNano())
+}
+
+// idleFor returns true if no traffic has gone over the peering for long
+// enough that it should be suspended.
+func (s *suspension) idleFor() bool {
+	if s == nil || s.idle == 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, s.last.Load())) >= s.idle
+}
+
+// isSuspendFrame returns true if the frame asks us to suspend the peering.
+func isSuspendFrame(f *types.Frame) bool {
+	if f.Type != types.TypeKeepalive {
+		return false
+	}
+	_, ok := f.Extension(types.ExtensionTypeSuspend)
+	return ok
+}
+
+// isTimeout returns true if the error is from a read or write deadline.
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// suspend suspends the peering and tells the remote side, returning false if
+// the peering can't be suspended or already is. Pending protocol frames are
+// dropped by the writer rather than sent, since they would only wake the
+// remote side up again.
+func (p *peer) suspend() bool {
+	if p.suspension == nil || !p.started.Load() || !p.suspension.active.CAS(false, true) {
+		return false
+	}
+	frame := p.router.getFrame()
+	frame.Type = types.TypeKeepalive
+	_ = frame.SetExtension(types.ExtensionTypeSuspend, nil)
+	p.sendProto(frame)
+	if p.keepalives {
+		_ = p.conn.SetReadDeadline(time.Time{})
+	}
+	p.router.log.Println("Suspended peering with", p.public.String(), "on port", p.port)
+	return true
+}
+
+// suspendedByRemote is called when the remote side has told us that it is
+// suspending the peering, so we stop expecting to hear from it.
+func (p *peer) suspendedByRemote() {
+	if p.suspension == nil || !p.suspension.active.CAS(false, true) {
+		return
+	}
+	p.router.log.Println("Peering with", p.public.String(), "on port", p.port, "was suspended by the remote side")
+}
+
+// resume resumes the peering, returning false if it wasn't suspended. If the
+// remote side doesn't know yet, then the keepalive that we send to it will
+// resume the peering at their end too. We then refresh the remote side with
+// our current root announcement and bootstrap again soon, since both of
+// those were held back while the peering was suspended.
+func (p *peer) resume() bool {
+	if p.suspension == nil || !p.suspension.active.CAS(true, false) {
+		return false
+	}
+	p.suspension.last.Store(time.Now().UnixNano())
+	if p.keepalives {
+		_ = p.conn.SetReadDeadline(time.Now().Add(p.router.clock.real(p.router.timers.keepaliveTimeout)))
+	}
+	frame := p.router.getFrame()
+	frame.Type = types.TypeKeepalive
+	p.sendProto(frame)
+	p.router.state.Act(nil, func() {
+		if !p.started.Load() {
+			return
+		}
+		p.router.state.sendTreeAnnouncementToPeer(p.router.state._rootAnnouncement(), p)
+		p.router.state._bootstrapSoon()
+	})
+	p.router.log.Println("Resumed peering with", p.public.String(), "on port", p.port)
+	return true
+}
+
+// SuspendPeer suspends the peering on the given port, i.e. when the radio
+// is about to sleep, see ConnectionIdleSuspend. An error is returned if the
+// remote side doesn't support suspension.
+func (r *Router) SuspendPeer(port types.SwitchPortID) error {
+	p, err := r.suspendablePeer(port)
+	if err != nil {
+		return err
+	}
+	p.suspend()
+	return nil
+}
+
+// ResumePeer resumes the peering on the given port if it was suspended.
+func (r *Router) ResumePeer(port types.SwitchPortID) error {
+	p, err := r.suspendablePeer(port)
+	if err != nil {
+		return err
+	}
+	p.resume()
+	return nil
+}
+
+func (r *Router) suspendablePeer(port types.SwitchPortID) (*peer, error) {
+	var p *peer
+	phony.Block(r.state, func() {
+		if port != 0 && int(port) < len(r.state._peers) {
+			p = r.state._peers[port]
+		}
+	})
+	switch {
+	case p == nil || !p.started.Load():
+		return nil, fmt.Errorf("no peer on port %d", port)
+	case p.suspension == nil:
+		return nil, fmt.Errorf("peer on port %d doesn't support suspension", port)
+	}
+	return p, nil
+}
@@ -0,0 +1,178 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// newSuspendablePair peers two routers over a TCP connection, so that they
+// go through the handshake and agree that the peering can be suspended. The
+// clocks run ten times faster than usual so that keepalives are due quickly.
+func newSuspendablePair(t *testing.T, options ...ConnectionOption) (*Router, *Router) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false, RouterClockSkew{Rate: 10})
+	rb := NewRouter(nil, skb, false, RouterClockSkew{Rate: 10})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if pb, err := l.Accept(); err == nil {
+			_, _ = rb.Connect(pb)
+		}
+	}()
+	pa, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ra.Connect(pa, options...); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "peering", func() bool {
+		return ra.PeerCount(-1) == 1 && rb.PeerCount(-1) == 1
+	})
+	// Anything that arrives after the peering is suspended resumes it, so
+	// wait for the first tree announcements and bootstrap to be handled.
+	waitFor(t, "convergence", func() bool {
+		root := ra
+		if rb.TreeInfo().IsRoot() {
+			root = rb
+		}
+		return sameRoot([]*Router{ra, rb}) && root.StateDump().Bootstrap.Descending != nil
+	})
+	return ra, rb
+}
+
+func waitFor(t *testing.T, what string, fn func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func suspended(r *Router) bool {
+	for _, p := range r.Peers() {
+		if p.Port != 0 {
+			return p.Suspended
+		}
+	}
+	return false
+}
+
+func TestSuspendAndResume(t *testing.T) {
+	ra, rb := newSuspendablePair(t)
+	defer ra.Close()
+	defer rb.Close()
+
+	if err := ra.SuspendPeer(1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "suspension", func() bool {
+		return suspended(ra) && suspended(rb)
+	})
+
+	// Neither side sends keepalives while suspended, so if either of them
+	// still expected them then the peering would time out here.
+	time.Sleep(time.Second)
+	if ra.PeerCount(-1) != 1 || rb.PeerCount(-1) != 1 {
+		t.Fatal("expected the suspended peering to stay connected")
+	}
+	if !suspended(ra) || !suspended(rb) {
+		t.Fatal("expected the peering to still be suspended")
+	}
+
+	// Sending traffic resumes the peering on both sides.
+	if _, err := rb.WriteTo([]byte("wake up"), ra.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	_ = ra.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, _, err := ra.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "wake up" {
+		t.Fatalf("expected \"wake up\", got %q", buf[:n])
+	}
+	waitFor(t, "resumption", func() bool {
+		return !suspended(ra) && !suspended(rb)
+	})
+}
+
+func TestIdleSuspend(t *testing.T) {
+	ra, rb := newSuspendablePair(t, ConnectionIdleSuspend(time.Millisecond*500))
+	defer ra.Close()
+	defer rb.Close()
+
+	waitFor(t, "idle suspension", func() bool {
+		return suspended(ra) && suspended(rb)
+	})
+	if err := rb.ResumePeer(1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "resumption", func() bool {
+		return !suspended(ra) && !suspended(rb)
+	})
+}
+
+func TestSuspendWithoutHandshake(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	if err := routers[0].SuspendPeer(1); err == nil {
+		t.Fatal("expected suspension to fail without a handshake")
+	}
+}
+
+func TestSuspendedWritable(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := NewRouter(nil, sk, false, RouterStrictConformance{})
+	defer r.Close()
+	p := &peer{router: r, port: 1, proto: newFIFOQueue(fifoNoMax, r.log), suspension: newSuspension(true, 0)}
+	_, other, _ := ed25519.GenerateKey(nil)
+	var transit types.PublicKey
+	copy(transit[:], other.Public().(ed25519.PublicKey))
+
+	// Our own protocol frames are dropped, and counted, without waking the
+	// peering up.
+	p.suspension.active.Store(true)
+	for _, frameType := range []types.FrameType{types.TypeTreeAnnouncement, types.TypeVirtualSnakeBootstrap} {
+		frame := getFrame()
+		frame.Type = frameType
+		frame.DestinationKey = r.PublicKey()
+		if p._writable(frame) {
+			t.Fatalf("expected our own %s to be held back", frameType)
+		}
+	}
+	if n := r.DropCounts()[DropSuspended]; n != 2 {
+		t.Fatalf("expected 2 frames to be counted as dropped, got %d", n)
+	}
+	if !p.suspension.suspended() {
+		t.Fatal("expected the peering to stay suspended")
+	}
+
+	// Bootstraps that we are forwarding for someone else resume the peering,
+	// since the path that they are building would never be set up otherwise.
+	frame := getFrame()
+	frame.Type = types.TypeVirtualSnakeBootstrap
+	frame.DestinationKey = transit
+	if !p._writable(frame) {
+		t.Fatal("expected the transit bootstrap to be written")
+	}
+	if p.suspension.suspended() {
+		t.Fatal("expected the transit bootstrap to resume the peering")
+	}
+}
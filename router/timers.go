@@ -0,0 +1,144 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bounds for the protocol timers, see RouterTimers. They are wide enough for
+// links with latencies of seconds, but stop the timers from being set so low
+// that the network is flooded, or so high that failures are never noticed.
+const (
+	minAnnouncementInterval = time.Minute
+	maxAnnouncementInterval = time.Hour * 24
+	maxAnnouncementTimeout  = time.Hour * 72
+	minBootstrapInterval    = virtualSnakeMaintainInterval
+	maxBootstrapInterval    = time.Minute * 10
+	minKeepaliveInterval    = time.Second
+	maxKeepaliveInterval    = time.Minute * 5
+	maxKeepaliveTimeout     = time.Minute * 15
+)
+
+// RouterTimers relaxes or tightens the protocol timers, i.e. for deployments
+// over satellite links or LoRa backhaul, where the defaults are too eager.
+// Any timer that is left as zero keeps its default. The timers must be the
+// same on every node in a deployment, since nodes use their own timers to
+// decide when their peers have gone quiet. If the timers are out of bounds or
+// don't make sense together then the router logs why and uses the defaults
+// instead, so use Validate to check them first.
+type RouterTimers struct {
+	AnnouncementInterval time.Duration // how often tree announcements are sent, 30 minutes by default
+	AnnouncementTimeout  time.Duration // how long a peer's announcement lasts, 45 minutes by default
+	BootstrapInterval    time.Duration // how often bootstraps are sent, 5 seconds by default, paths last twice as long
+	KeepaliveInterval    time.Duration // how often keepalives are sent on an idle peering, 3 seconds by default
+	KeepaliveTimeout     time.Duration // how long a peering can be silent before it is closed, 5 seconds by default
+}
+
+func (t RouterTimers) isRouterOption() {}
+
+// Validate returns an error if any of the timers are out of bounds, or if a
+// timeout isn't longer than the interval that it is waiting for.
+func (t RouterTimers) Validate() error {
+	_, err := t.timers()
+	return err
+}
+
+// timers fills in the defaults and checks the result.
+func (t RouterTimers) timers() (timers, error) {
+	result := defaultTimers()
+	if t.AnnouncementInterval != 0 {
+		result.announcementInterval = t.AnnouncementInterval
+	}
+	if t.AnnouncementTimeout != 0 {
+		result.announcementTimeout = t.AnnouncementTimeout
+	}
+	if t.BootstrapInterval != 0 {
+		result.bootstrapInterval = t.BootstrapInterval
+	}
+	if t.KeepaliveInterval != 0 {
+		result.keepaliveInterval = t.KeepaliveInterval
+	}
+	if t.KeepaliveTimeout != 0 {
+		result.keepaliveTimeout = t.KeepaliveTimeout
+	}
+	checks := []struct {
+		name          string
+		value, lo, hi time.Duration
+	}{
+		{"announcement interval", result.announcementInterval, minAnnouncementInterval, maxAnnouncementInterval},
+		{"announcement timeout", result.announcementTimeout, minAnnouncementInterval, maxAnnouncementTimeout},
+		{"bootstrap interval", result.bootstrapInterval, minBootstrapInterval, maxBootstrapInterval},
+		{"keepalive interval", result.keepaliveInterval, minKeepaliveInterval, maxKeepaliveInterval},
+		{"keepalive timeout", result.keepaliveTimeout, minKeepaliveInterval, maxKeepaliveTimeout},
+	}
+	for _, check := range checks {
+		switch {
+		case check.value < check.lo:
+			return result, fmt.Errorf("%s of %s is shorter than the minimum of %s", check.name, check.value, check.lo)
+		case check.value > check.hi:
+			return result, fmt.Errorf("%s of %s is longer than the maximum of %s", check.name, check.value, check.hi)
+		}
+	}
+	switch {
+	case result.announcementTimeout <= result.announcementInterval:
+		return result, fmt.Errorf("announcement timeout of %s must be longer than the announcement interval of %s", result.announcementTimeout, result.announcementInterval)
+	case result.keepaliveTimeout <= result.keepaliveInterval:
+		return result, fmt.Errorf("keepalive timeout of %s must be longer than the keepalive interval of %s", result.keepaliveTimeout, result.keepaliveInterval)
+	}
+	return result, nil
+}
+
+// timers holds the protocol timers that the router is using. It isn't
+// mutated after the router is created.
+type timers struct {
+	announcementInterval time.Duration
+	announcementTimeout  time.Duration
+	bootstrapInterval    time.Duration
+	keepaliveInterval    time.Duration
+	keepaliveTimeout     time.Duration
+}
+
+func defaultTimers() timers {
+	return timers{
+		announcementInterval: announcementInterval,
+		announcementTimeout:  announcementTimeout,
+		bootstrapInterval:    virtualSnakeBootstrapInterval,
+		keepaliveInterval:    peerKeepaliveInterval,
+		keepaliveTimeout:     peerKeepaliveTimeout,
+	}
+}
+
+// snakeExpiry returns how long a snake path lasts without a bootstrap. Like
+// the clock, it is safe to call on nil, which gives the default.
+func (t *timers) snakeExpiry() time.Duration {
+	if t == nil {
+		return virtualSnakeNeighExpiryPeriod
+	}
+	return t.bootstrapInterval * 2
+}
+
+// Timers returns the protocol timers that the router is using, with the
+// defaults filled in.
+func (r *Router) Timers() RouterTimers {
+	return RouterTimers{
+		AnnouncementInterval: r.timers.announcementInterval,
+		AnnouncementTimeout:  r.timers.announcementTimeout,
+		BootstrapInterval:    r.timers.bootstrapInterval,
+		KeepaliveInterval:    r.timers.keepaliveInterval,
+		KeepaliveTimeout:     r.timers.keepaliveTimeout,
+	}
+}
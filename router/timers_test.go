@@ -0,0 +1,101 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestRouterTimersValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		timers RouterTimers
+		valid  bool
+	}{
+		{"defaults", RouterTimers{}, true},
+		{"relaxed", RouterTimers{
+			AnnouncementInterval: time.Hour * 2,
+			AnnouncementTimeout:  time.Hour * 3,
+			BootstrapInterval:    time.Minute,
+			KeepaliveInterval:    time.Second * 30,
+			KeepaliveTimeout:     time.Minute,
+		}, true},
+		{"keepalive too often", RouterTimers{KeepaliveInterval: time.Millisecond}, false},
+		{"keepalive timeout before interval", RouterTimers{KeepaliveInterval: time.Second * 10}, false},
+		{"announcement timeout before interval", RouterTimers{AnnouncementInterval: time.Hour}, false},
+		{"bootstrap too rare", RouterTimers{BootstrapInterval: time.Hour}, false},
+		{"announcement timeout too long", RouterTimers{AnnouncementTimeout: time.Hour * 100}, false},
+	} {
+		if err := tc.timers.Validate(); (err == nil) != tc.valid {
+			t.Fatalf("%s: expected valid to be %v, got error %v", tc.name, tc.valid, err)
+		}
+	}
+}
+
+func TestRouterTimersApplied(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	relaxed := RouterTimers{
+		BootstrapInterval: time.Second * 30,
+		KeepaliveInterval: time.Second * 10,
+		KeepaliveTimeout:  time.Second * 20,
+	}
+	r := NewRouter(nil, sk, false, relaxed)
+	defer r.Close()
+
+	got := r.Timers()
+	if got.BootstrapInterval != relaxed.BootstrapInterval || got.KeepaliveTimeout != relaxed.KeepaliveTimeout {
+		t.Fatalf("expected the relaxed timers to be used, got %+v", got)
+	}
+	if got.AnnouncementInterval != announcementInterval {
+		t.Fatalf("expected the default announcement interval, got %s", got.AnnouncementInterval)
+	}
+	if r.watchdog != relaxed.KeepaliveTimeout*2 {
+		t.Fatalf("expected the watchdog to be raised to %s, got %s", relaxed.KeepaliveTimeout*2, r.watchdog)
+	}
+	if d := r.timers.snakeExpiry(); d != time.Minute {
+		t.Fatalf("expected snake paths to last a minute, got %s", d)
+	}
+
+	// Timers that don't make sense are ignored in favour of the defaults.
+	_, sk, _ = ed25519.GenerateKey(nil)
+	r = NewRouter(nil, sk, false, RouterTimers{KeepaliveTimeout: time.Second})
+	defer r.Close()
+	if got := r.Timers(); got.KeepaliveTimeout != peerKeepaliveTimeout {
+		t.Fatalf("expected the default keepalive timeout, got %s", got.KeepaliveTimeout)
+	}
+}
+
+func TestIdleWakeups(t *testing.T) {
+	// The clock runs ten times faster than real time so that the test sees
+	// a couple of bootstrap intervals without taking long.
+	const rate = 10
+	routers := newBenchChain(t, 3, RouterClockSkew{Rate: rate})
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	wakeups := func() []uint64 {
+		counts := make([]uint64, len(routers))
+		for i, r := range routers {
+			phony.Block(r.state, func() {
+				counts[i] = r.state._wakeups
+			})
+		}
+		return counts
+	}
+
+	// Once the network is idle, each node should wake up about once per
+	// bootstrap interval, with everything else sharing those wakeups, rather
+	// than every second for snake maintenance and again for peer scoring.
+	const window = virtualSnakeBootstrapInterval * 2
+	before := wakeups()
+	time.Sleep(window / rate)
+	for i, after := range wakeups() {
+		if n, limit := after-before[i], uint64(window/virtualSnakeBootstrapInterval)+1; n > limit {
+			t.Fatalf("router %d woke up %d times in %s, expected at most %d", i, n, window, limit)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// PeerRole says whether a peer can be used to carry traffic on behalf of
+// other nodes.
+type PeerRole int
+
+const (
+	// PeerRoleTransit peers can be used as a relay towards any destination.
+	// This is the default.
+	PeerRoleTransit PeerRole = iota
+	// PeerRoleLeaf peers are only ever sent traffic that is destined for
+	// the peer itself, and are only chosen as our parent in the tree if
+	// there is no other candidate. This keeps relayed traffic off devices
+	// that can't afford to carry it, i.e. phones on mobile data.
+	PeerRoleLeaf
+)
+
+func (r PeerRole) String() string {
+	switch r {
+	case PeerRoleTransit:
+		return "transit"
+	case PeerRoleLeaf:
+		return "leaf"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnectionPeerRole sets the role of the peer, overriding the
+// RouterTransitPolicy if there is one.
+type ConnectionPeerRole PeerRole
+
+func (c ConnectionPeerRole) isConnectionOption() {}
+
+// RouterTransitPolicy is called for each new peering that wasn't given a
+// ConnectionPeerRole, once the public key of the remote side is known, to
+// decide which role the peer should have.
+type RouterTransitPolicy func(key types.PublicKey, zone string, peertype int) PeerRole
+
+func (p RouterTransitPolicy) isRouterOption() {}
+
+// SetPeerRole changes the role of the peer on the given port, i.e. when the
+// remote side tells us out-of-band that it has moved onto a metered network.
+// If the peer is our parent and becomes a leaf then we look for a new parent
+// straight away.
+func (r *Router) SetPeerRole(port types.SwitchPortID, role PeerRole) {
+	phony.Block(r.state, func() {
+		if port == 0 || int(port) >= len(r.state._peers) {
+			return
+		}
+		p := r.state._peers[port]
+		if p == nil || !p.started.Load() {
+			return
+		}
+		p._leaf = role == PeerRoleLeaf
+		if p._leaf && p == r.state._parent && r.state._selectNewParent() {
+			r.state._bootstrapSoon()
+		}
+	})
+}
+
+// _carries returns true if frames for the given destination key can be sent
+// to the peer, which is always the case unless the port has been disabled,
+// the link only carries traffic towards us, or the peer is a leaf and the
+// frame is destined for someone else.
+func (p *peer) _carries(key types.PublicKey) bool {
+	return !p._disabled && p._direction.sends() && (!p._leaf || p.public == key)
+}
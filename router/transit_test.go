@@ -0,0 +1,129 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+func TestLeafPeerNextHopTree(t *testing.T) {
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 1}
+	self := &peer{started: *atomic.NewBool(true)}
+	leaf := &peer{started: *atomic.NewBool(true)}
+	transit := &peer{started: *atomic.NewBool(true)}
+	announcement := func(hops ...types.Varu64) *rootAnnouncementWithTime {
+		ann := &rootAnnouncementWithTime{
+			receiveTime:  time.Now(),
+			receiveOrder: 1,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: root,
+			},
+		}
+		for _, hop := range hops {
+			ann.Signatures = append(ann.Signatures, types.SignatureWithHop{Hop: hop})
+		}
+		return ann
+	}
+	ourAnn := announcement(1, 0)
+	anns := announcementTable{
+		leaf:    announcement(1, 2, 0),
+		transit: announcement(1, 3, 0),
+	}
+	nextHop := func(dest types.Coordinates) *peer {
+		return getNextHopTree(treeNextHopParams{
+			destinationCoords: dest,
+			ourCoords:         types.Coordinates{1},
+			selfPeer:          self,
+			lastAnnouncement:  ourAnn,
+			peerAnnouncements: &anns,
+		})
+	}
+
+	if p := nextHop(types.Coordinates{1, 2, 5}); p != leaf {
+		t.Fatalf("expected to route through the peer before it is a leaf, got %v", p)
+	}
+	leaf._leaf = true
+	if p := nextHop(types.Coordinates{1, 2, 5}); p != nil {
+		t.Fatalf("expected no route through the leaf peer, got %v", p)
+	}
+	if p := nextHop(types.Coordinates{1, 2}); p != leaf {
+		t.Fatalf("expected traffic for the leaf peer to go to it, got %v", p)
+	}
+}
+
+func TestLeafPeerNextHopSNEK(t *testing.T) {
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 1}
+	self := &peer{started: *atomic.NewBool(true), public: types.PublicKey{4}}
+	leaf := &peer{started: *atomic.NewBool(true), public: types.PublicKey{6}}
+	ourAnn := &rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{Root: root},
+	}
+	anns := announcementTable{
+		leaf: &rootAnnouncementWithTime{
+			receiveTime:  time.Now(),
+			receiveOrder: 1,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: root,
+				Signatures: []types.SignatureWithHop{
+					{PublicKey: types.PublicKey{5}},
+					{PublicKey: types.PublicKey{6}},
+				},
+			},
+		},
+	}
+	nextHop := func(dest types.PublicKey) *peer {
+		p, _ := getNextHopSNEK(virtualSnakeNextHopParams{
+			destinationKey:    dest,
+			publicKey:         self.public,
+			watermark:         types.VirtualSnakeWatermark{PublicKey: types.FullMask},
+			selfPeer:          self,
+			lastAnnouncement:  ourAnn,
+			peerAnnouncements: anns,
+			snakeRoutes:       virtualSnakeTable{},
+		})
+		return p
+	}
+
+	if p := nextHop(types.PublicKey{5}); p != leaf {
+		t.Fatalf("expected to route through the peer before it is a leaf, got %v", p)
+	}
+	leaf._leaf = true
+	if p := nextHop(types.PublicKey{5}); p != self {
+		t.Fatalf("expected no route through the leaf peer, got %v", p)
+	}
+	if p := nextHop(leaf.public); p != leaf {
+		t.Fatalf("expected traffic for the leaf peer to go to it, got %v", p)
+	}
+}
+
+func TestLeafPeerLastResortParent(t *testing.T) {
+	routers := newBenchChain(t, 2)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	r := routers[0]
+	if r.TreeInfo().IsRoot() {
+		r = routers[1]
+	}
+	r.SetPeerRole(1, PeerRoleLeaf)
+	for _, p := range r.Peers() {
+		if p.Port == 1 && !p.Leaf {
+			t.Fatal("expected the peer to be a leaf")
+		}
+	}
+
+	// With no other peers to choose from, the leaf stays as our parent
+	// rather than leaving us stranded as our own root.
+	if r.TreeInfo().IsRoot() {
+		t.Fatal("expected the leaf peer to remain our parent")
+	}
+	dump := r.StateDump()
+	if len(dump.Candidates) != 1 || !dump.Candidates[0].Leaf || !dump.Candidates[0].Parent {
+		t.Fatalf("expected the leaf peer to be our parent, got %+v", dump.Candidates)
+	}
+}
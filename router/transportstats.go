@@ -0,0 +1,61 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "time"
+
+// TransportStats can be implemented by a connection that is passed to
+// Connect if it knows something about the quality of the link underneath it
+// that the router can't measure for itself, i.e. the round trip time and loss
+// that a QUIC connection sees, or the signal strength of a Bluetooth link.
+// Whatever the connection reports is included in PeerInfo and DebugStats, so
+// that policies which take link quality into account have real data to work
+// with, and is left as nil for connections that don't implement it. It is
+// called from the state actor, so it must return quickly.
+type TransportStats interface {
+	TransportStats() LinkStats
+}
+
+// LinkStats are the link quality values reported by a connection that
+// implements TransportStats. Values that the transport doesn't know about
+// are left as zero.
+type LinkStats struct {
+	RTT  time.Duration `json:"rtt_ns,omitempty"`   // smoothed round trip time
+	Loss float64       `json:"loss,omitempty"`     // fraction of packets lost, from 0 to 1
+	RSSI int           `json:"rssi_dbm,omitempty"` // received signal strength in dBm
+}
+
+// transportStats returns the link quality from the connection that the
+// peering is currently writing to, or nil if it doesn't report any.
+func (c *peerConn) transportStats() *LinkStats {
+	c.mutex.Lock()
+	conn := c.writing
+	c.mutex.Unlock()
+	ts, ok := conn.(TransportStats)
+	if !ok {
+		return nil
+	}
+	stats := ts.TransportStats()
+	return &stats
+}
+
+// linkStats returns the link quality reported by the peer's connection, if
+// any. The local router has no connection.
+func (p *peer) linkStats() *LinkStats {
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.transportStats()
+}
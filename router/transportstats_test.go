@@ -0,0 +1,66 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/test/fixtures"
+)
+
+// statsConn is a connection that reports made up link statistics.
+type statsConn struct {
+	net.Conn
+}
+
+func (c statsConn) TransportStats() LinkStats {
+	return LinkStats{RTT: time.Millisecond * 20, Loss: 0.01, RSSI: -60}
+}
+
+func TestTransportStats(t *testing.T) {
+	routers := newFixtureRouters(t, fixtures.Line(2))
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+	ra, rb := routers[0], routers[1]
+	pa, pb := net.Pipe()
+	connectEnds(t, pairEnd{ra, statsConn{pa}, nil}, pairEnd{rb, pb, nil})
+
+	for _, info := range ra.Peers() {
+		if info.Port == 0 {
+			if info.Transport != nil {
+				t.Fatal("expected no transport stats for the local router")
+			}
+			continue
+		}
+		if info.Transport == nil || info.Transport.RTT != time.Millisecond*20 || info.Transport.RSSI != -60 {
+			t.Fatalf("expected the transport stats from the connection, got %+v", info.Transport)
+		}
+	}
+	for _, info := range rb.Peers() {
+		if info.Port != 0 && info.Transport != nil {
+			t.Fatalf("expected no transport stats from a plain connection, got %+v", info.Transport)
+		}
+	}
+	for _, peer := range ra.DebugStats().Peers {
+		if peer.Port != 0 && (peer.Transport == nil || peer.Transport.Loss != 0.01) {
+			t.Fatalf("expected the transport stats in the debug stats, got %+v", peer.Transport)
+		}
+	}
+	// The reader and writer start after the handshake, and then both wait on
+	// the connection.
+	waitFor(t, "the peer's goroutines", func() bool {
+		for _, peer := range ra.DebugStats().Peers {
+			if peer.Port == 0 {
+				continue
+			}
+			if peer.Goroutines > 2 {
+				t.Fatalf("expected one or two goroutines for the peer, got %d", peer.Goroutines)
+			}
+			return peer.Goroutines >= 1
+		}
+		return false
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// TreeInfo describes our position in the spanning tree and the root
+// announcement that it comes from.
+type TreeInfo struct {
+	Root       types.PublicKey   `json:"root"`
+	Parent     types.PublicKey   `json:"parent"` // zero if we are the root
+	Coords     types.Coordinates `json:"coords"`
+	Depth      int               `json:"depth"`
+	Sequence   uint64            `json:"sequence"`
+	Received   time.Time         `json:"received"` // zero if we are the root
+	Age        time.Duration     `json:"age"`      // time since the announcement was received
+	Signatures []TreeSignature   `json:"signatures"`
+}
+
+// TreeSignature is one hop in the signature chain of a root announcement,
+// starting from the root.
+type TreeSignature struct {
+	Hop       uint64          `json:"hop"` // the port that the signer sent the announcement out of
+	PublicKey types.PublicKey `json:"public_key"`
+	Signature string          `json:"signature"` // hex-encoded
+}
+
+// IsRoot returns true if we were the root of the tree when the TreeInfo was
+// taken.
+func (t TreeInfo) IsRoot() bool {
+	return t.Parent.IsZero()
+}
+
+// TreeInfo returns our current position in the tree along with the root
+// announcement that we are using, including the signature chain back to the
+// root. A depth that is much higher than usual, or an announcement that has
+// not been refreshed for a while, is a sign that something is wrong with
+// the tree.
+func (r *Router) TreeInfo() TreeInfo {
+	var info TreeInfo
+	phony.Block(r.state, func() {
+		ann := r.state._rootAnnouncement()
+		coords := ann.Coords()
+		info = TreeInfo{
+			Root:       ann.RootPublicKey,
+			Coords:     coords,
+			Depth:      len(coords),
+			Sequence:   uint64(ann.RootSequence),
+			Received:   ann.receiveTime,
+			Signatures: make([]TreeSignature, 0, len(ann.Signatures)),
+		}
+		if parent := r.state._parent; parent != nil && r.state._announcements[parent] != nil {
+			info.Parent = parent.public
+		}
+		for _, sig := range ann.Signatures {
+			info.Signatures = append(info.Signatures, TreeSignature{
+				Hop:       uint64(sig.Hop),
+				PublicKey: sig.PublicKey,
+				Signature: hex.EncodeToString(sig.Signature[:]),
+			})
+		}
+	})
+	if !info.Received.IsZero() {
+		info.Age = r.clock.since(info.Received)
+	}
+	return info
+}
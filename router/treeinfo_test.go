@@ -0,0 +1,55 @@
+package router
+
+import (
+	"testing"
+)
+
+func TestTreeInfo(t *testing.T) {
+	routers := newBenchChain(t, 3)
+	defer func() {
+		for _, r := range routers {
+			_ = r.Close()
+		}
+	}()
+
+	var root *Router
+	for _, r := range routers {
+		if info := r.TreeInfo(); info.IsRoot() {
+			if info.Root != r.PublicKey() {
+				t.Fatalf("root expected itself to be root but got %s", info.Root)
+			}
+			root = r
+		}
+	}
+	if root == nil {
+		t.Fatal("no router thinks it is the root")
+	}
+
+	for _, r := range routers {
+		info := r.TreeInfo()
+		if info.Root != root.PublicKey() {
+			t.Fatalf("expected root %s but got %s", root.PublicKey(), info.Root)
+		}
+		if info.Depth != len(info.Coords) {
+			t.Fatalf("expected depth %d but got %d", len(info.Coords), info.Depth)
+		}
+		if r == root {
+			if info.Depth != 0 || len(info.Signatures) != 0 {
+				t.Fatalf("expected root to have no depth or signatures")
+			}
+			continue
+		}
+		if len(info.Signatures) != info.Depth {
+			t.Fatalf("expected %d signatures but got %d", info.Depth, len(info.Signatures))
+		}
+		if first := info.Signatures[0].PublicKey; first != root.PublicKey() {
+			t.Fatalf("expected signature chain to start at the root but started at %s", first)
+		}
+		if last := info.Signatures[len(info.Signatures)-1].PublicKey; last != info.Parent {
+			t.Fatalf("expected signature chain to end at the parent but ended at %s", last)
+		}
+		if info.Received.IsZero() || info.Age < 0 {
+			t.Fatalf("expected announcement receive time to be set")
+		}
+	}
+}
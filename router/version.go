@@ -20,7 +20,16 @@ const (
 	capabilitySetupACKs // nolint:deadcode,varcheck
 	capabilityDedupedCoordinateInfo
 	capabilitySoftState
+	capabilityFrameVersion1
+	capabilitySuspend
+	capabilityMetadata
+	capabilityMigrate
 )
 
 const ourVersion uint8 = 1
 const ourCapabilities uint32 = capabilityLengthenedRootInterval | capabilityCryptographicSetups | capabilityDedupedCoordinateInfo | capabilitySoftState
+
+// ourOptionalCapabilities are advertised in the handshake but, unlike
+// ourCapabilities, aren't required of the remote side. They are used on a
+// peering only if both sides advertise them.
+const ourOptionalCapabilities uint32 = capabilityFrameVersion1 | capabilitySuspend | capabilityMetadata | capabilityMigrate
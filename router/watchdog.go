@@ -0,0 +1,135 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"go.uber.org/atomic"
+)
+
+// defaultWatchdogTimeout is how long a peering can go without making any
+// progress before the watchdog recycles it. It's well beyond the keepalive
+// timeout, since the read and write deadlines should normally deal with dead
+// peerings long before the watchdog does.
+const defaultWatchdogTimeout = time.Second * 30
+
+// RouterPeerWatchdog sets how long a peering can go without making progress
+// before the router gives up on it and closes the connection, so that it can
+// be made again. A peering isn't making progress if frames are waiting in its
+// queues but none have been written for that long, or if keepalives are
+// enabled and nothing at all has been read for that long. That would usually
+// be caught by the read and write deadlines, but not if the connection
+// ignores them or if the reader or writer is stuck somewhere else. Values
+// below twice the keepalive timeout, which is 10 seconds by default, are
+// raised to that, and a negative value turns the watchdog off. The default is
+// 30 seconds.
+type RouterPeerWatchdog time.Duration
+
+func (w RouterPeerWatchdog) isRouterOption() {}
+
+// watchdog counts the progress made by a peer's reader and writer.
+type watchdog struct {
+	rx atomic.Uint64 // Thread-safe, frames read from the connection.
+	tx atomic.Uint64 // Thread-safe, frames taken from the queues by the writer.
+
+	// The progress at the last check, owned by the router's watchdog.
+	started bool
+	lastRx  uint64
+	lastTx  uint64
+	rxSince time.Time
+	txSince time.Time
+}
+
+// watchPeers checks on all of the peerings until the router is closed,
+// recycling any that have stopped making progress for longer than the
+// timeout. A single ticker is shared by all of the peerings, rather than
+// each having its own, so that a node with lots of peers doesn't wake up
+// any more often when it is idle.
+func (r *Router) watchPeers(timeout time.Duration) {
+	ticker := time.NewTicker(r.clock.real(timeout) / 4)
+	defer ticker.Stop()
+	var peers []*peer
+	for {
+		var now time.Time
+		select {
+		case <-r.context.Done():
+			return
+		case now = <-ticker.C:
+		}
+		limit := r.clock.real(timeout)
+		phony.Block(r.state, func() {
+			peers = append(peers[:0], r.state._peers...)
+		})
+		for _, p := range peers {
+			if p == nil || p == r.local || !p.started.Load() || p.context.Err() != nil {
+				continue
+			}
+			p.check(now, limit)
+		}
+	}
+}
+
+// check recycles the peering if either the reader or the writer has stopped
+// making progress for longer than the limit. It must only be called from the
+// router's watchdog.
+func (p *peer) check(now time.Time, limit time.Duration) {
+	w := &p.watchdog
+	rx, tx := w.rx.Load(), w.tx.Load()
+	if !w.started {
+		w.started = true
+		w.lastRx, w.lastTx, w.rxSince = rx, tx, now
+		return
+	}
+
+	// Nothing is read from a suspended peering, and nothing at all is
+	// expected without keepalives, so only a peering that should be hearing
+	// keepalives can be wedged on the reading side.
+	if rx != w.lastRx || !p.keepalives || p.suspension.suspended() {
+		w.lastRx, w.rxSince = rx, now
+	} else if idle := now.Sub(w.rxSince); idle > limit {
+		p.recycle(fmt.Sprintf("nothing read for %s", idle.Round(time.Second)), 0)
+		return
+	}
+
+	// The writer is only wedged if there is something for it to do.
+	queued := p.proto.queuecount() + p.traffic.queuecount()
+	if tx != w.lastTx || queued == 0 {
+		w.lastTx, w.txSince = tx, time.Time{}
+	} else if w.txSince.IsZero() {
+		w.txSince = now
+	} else if stuck := now.Sub(w.txSince); stuck > limit {
+		p.recycle(fmt.Sprintf("%d frames queued but nothing written for %s", queued, stuck.Round(time.Second)), queued)
+	}
+}
+
+// recycle stops a wedged peering. The connection is closed straight away,
+// since the reader or the writer might be stuck in it.
+func (p *peer) recycle(reason string, queued int) {
+	p.router.log.Println("Watchdog recycling wedged peer", p.public.String(), "on port", p.port, "because", reason)
+	_ = p.conn.Close()
+	p.stop(fmt.Errorf("watchdog: %s", reason))
+	p.router.Act(nil, func() {
+		p.router._publish(events.PeerWedged{
+			Port:   p.port,
+			PeerID: p.public.String(),
+			Reason: reason,
+			Queued: queued,
+		})
+	})
+}
@@ -0,0 +1,153 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/router/events"
+	"go.uber.org/atomic"
+)
+
+// wedgeConn is a connection that ignores deadlines and, once wedged, never
+// returns from reads or writes until it is closed.
+type wedgeConn struct {
+	net.Conn
+	reads, writes atomic.Bool
+	closed        chan struct{}
+	once          sync.Once
+}
+
+func (c *wedgeConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.reads.Load() {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+func (c *wedgeConn) Write(b []byte) (int, error) {
+	if c.writes.Load() {
+		<-c.closed
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *wedgeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *wedgeConn) SetDeadline(time.Time) error      { return nil }
+func (c *wedgeConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *wedgeConn) SetWriteDeadline(time.Time) error { return nil }
+
+// newWedgePair peers two routers over TCP, with the connection on the first
+// router's side able to be wedged. The clocks run ten times faster than usual
+// so that the watchdog fires after a second.
+func newWedgePair(t *testing.T, keepalives bool) (*Router, *Router, *wedgeConn) {
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := NewRouter(nil, ska, false, RouterClockSkew{Rate: 10}, RouterPeerWatchdog(time.Second*10))
+	rb := NewRouter(nil, skb, false, RouterClockSkew{Rate: 10})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if pb, err := l.Accept(); err == nil {
+			_, _ = rb.Connect(pb, ConnectionPublicKey(ra.PublicKey()), ConnectionKeepalives(keepalives))
+		}
+	}()
+	pa, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &wedgeConn{Conn: pa, closed: make(chan struct{})}
+	if _, err := ra.Connect(conn, ConnectionPublicKey(rb.PublicKey()), ConnectionKeepalives(keepalives)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "peering", func() bool {
+		return ra.PeerCount(-1) == 1 && rb.PeerCount(-1) == 1
+	})
+	return ra, rb, conn
+}
+
+// waitForWedged waits for the watchdog to report a wedged peer.
+func waitForWedged(t *testing.T, ch <-chan events.Event) events.PeerWedged {
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case event := <-ch:
+			if wedged, ok := event.(events.PeerWedged); ok {
+				return wedged
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the watchdog")
+		}
+	}
+}
+
+func TestWatchdogRecyclesWedgedReader(t *testing.T) {
+	ra, rb, conn := newWedgePair(t, true)
+	defer ra.Close()
+	defer rb.Close()
+	ch := make(chan events.Event, 64)
+	ra.Subscribe(ch)
+
+	// A healthy peering that is only exchanging keepalives isn't recycled,
+	// even though it is idle for longer than the watchdog timeout.
+	time.Sleep(time.Second * 2)
+	if ra.PeerCount(-1) != 1 {
+		t.Fatal("expected the idle peering to stay up")
+	}
+
+	conn.reads.Store(true)
+	wedged := waitForWedged(t, ch)
+	if wedged.Port != 1 || wedged.PeerID != rb.PublicKey().String() {
+		t.Fatalf("unexpected event %+v", wedged)
+	}
+	waitFor(t, "peer removal", func() bool {
+		return ra.PeerCount(-1) == 0
+	})
+}
+
+func TestWatchdogRecyclesWedgedWriter(t *testing.T) {
+	// Without keepalives, nothing is expected to be read, so only the writer
+	// can be found to be wedged.
+	ra, rb, conn := newWedgePair(t, false)
+	defer ra.Close()
+	defer rb.Close()
+	ch := make(chan events.Event, 64)
+	ra.Subscribe(ch)
+	waitFor(t, "tree", func() bool {
+		return sameRoot([]*Router{ra, rb})
+	})
+
+	conn.writes.Store(true)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		payload := []byte("wedged")
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 50):
+				_, _ = ra.WriteTo(payload, rb.Coords())
+			}
+		}
+	}()
+	if wedged := waitForWedged(t, ch); wedged.Queued == 0 {
+		t.Fatalf("expected frames to be queued, got %+v", wedged)
+	}
+	waitFor(t, "peer removal", func() bool {
+		return ra.PeerCount(-1) == 0
+	})
+}
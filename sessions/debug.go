@@ -0,0 +1,300 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !minimal
+// +build !minimal
+
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// DebugProtocol is a session protocol name for remote debugging. It isn't
+// used unless it's passed to NewSessions, and only then by ServeDebug and
+// SubscribeDebug.
+const DebugProtocol = "pinecone-debug"
+
+// debugSubscriberBuffer is how many events can be waiting for a subscriber
+// before they start being dropped.
+const debugSubscriberBuffer = 256
+
+// DebugMessage is a single message from a remote debug subscription. Each
+// message carries either one of the remote router's events or a snapshot of
+// its debug stats, depending on the type.
+type DebugMessage struct {
+	Type    string             // the event type, e.g. "PeerAdded", or "DebugStats"
+	Time    time.Time          // when the remote node sent the message
+	Event   events.Event       // nil for debug stats or for event types that we don't know
+	Stats   *router.DebugStats // only for debug stats
+	Raw     json.RawMessage    // the event as it was encoded by the remote node
+	Dropped uint64             // events dropped before this one because we weren't reading quickly enough
+}
+
+// debugMessage is the wire encoding of a DebugMessage. Messages are sent as
+// newline-delimited JSON.
+type debugMessage struct {
+	Type    string             `json:"type"`
+	Time    time.Time          `json:"time"`
+	Event   json.RawMessage    `json:"event,omitempty"`
+	Stats   *router.DebugStats `json:"stats,omitempty"`
+	Dropped uint64             `json:"dropped,omitempty"`
+	Error   string             `json:"error,omitempty"` // only for refusals
+}
+
+// debugSubscriber is a single remote debug subscription being served.
+type debugSubscriber struct {
+	events  chan debugMessage
+	mutex   sync.Mutex
+	dropped uint64 // protected by mutex
+}
+
+// ServeDebug answers remote debug subscriptions on this protocol, which
+// should be DebugProtocol and mustn't be used for anything else, since every
+// stream that arrives on it is taken to be a subscription. Only the nodes
+// with keys in admins are allowed to subscribe. Since sessions are
+// authenticated with the keys at either end, this lets an operator watch a
+// node that is only reachable over the overlay, i.e. because it sits behind
+// a NAT. Subscribers receive the router's events as they happen, along with
+// a snapshot of its debug stats when they first subscribe and then every
+// interval, if it isn't zero.
+func (s *SessionProtocol) ServeDebug(admins []types.PublicKey, interval time.Duration) {
+	allowed := make(map[types.PublicKey]struct{}, len(admins))
+	for _, key := range admins {
+		allowed[key] = struct{}{}
+	}
+	var mutex sync.Mutex
+	subscribers := map[*debugSubscriber]struct{}{}
+
+	// A single subscription fans out to everyone who is currently subscribed,
+	// until the protocol stops accepting streams. Subscribers that aren't
+	// keeping up have events dropped rather than holding up the others.
+	ch := make(chan events.Event, debugSubscriberBuffer)
+	s.s.r.Subscribe(ch)
+	go func() {
+		for event := range ch {
+			message, err := newDebugEvent(event)
+			if err != nil {
+				continue
+			}
+			mutex.Lock()
+			for sub := range subscribers {
+				select {
+				case sub.events <- message:
+				default:
+					sub.mutex.Lock()
+					sub.dropped++
+					sub.mutex.Unlock()
+				}
+			}
+			mutex.Unlock()
+		}
+	}()
+
+	go func() {
+		defer func() {
+			s.s.r.Unsubscribe(ch)
+			close(ch)
+		}()
+		for {
+			conn, err := s.Accept()
+			if err != nil {
+				return
+			}
+			key, _ := conn.RemoteAddr().(types.PublicKey)
+			if _, ok := allowed[key]; !ok {
+				s.s.log.Println("Refused remote debug subscription from", key)
+				_ = json.NewEncoder(conn).Encode(debugMessage{
+					Type:  "Error",
+					Time:  time.Now(),
+					Error: "not an admin",
+				})
+				_ = conn.Close()
+				continue
+			}
+			s.s.log.Println("Accepted remote debug subscription from", key)
+			sub := &debugSubscriber{
+				events: make(chan debugMessage, debugSubscriberBuffer),
+			}
+			mutex.Lock()
+			subscribers[sub] = struct{}{}
+			mutex.Unlock()
+			go func() {
+				s.serveDebugSubscriber(conn, sub, interval)
+				mutex.Lock()
+				delete(subscribers, sub)
+				mutex.Unlock()
+				_ = conn.Close()
+				s.s.log.Println("Remote debug subscription from", key, "ended")
+			}()
+		}
+	}()
+}
+
+// serveDebugSubscriber writes messages to a subscriber until either the
+// subscriber goes away or the session is closed.
+func (s *SessionProtocol) serveDebugSubscriber(conn net.Conn, sub *debugSubscriber, interval time.Duration) {
+	// Subscribers don't send anything, so the read only returns once the
+	// remote side has closed the stream.
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, conn)
+		close(done)
+	}()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	encoder := json.NewEncoder(conn)
+	stats := func() debugMessage {
+		stats := s.s.r.DebugStats()
+		return debugMessage{Type: "DebugStats", Time: time.Now(), Stats: &stats}
+	}
+	message := stats()
+	for {
+		sub.mutex.Lock()
+		message.Dropped, sub.dropped = sub.dropped, 0
+		sub.mutex.Unlock()
+		if err := encoder.Encode(message); err != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-s.s.context.Done():
+			return
+		case <-tick:
+			message = stats()
+		case message = <-sub.events:
+		}
+	}
+}
+
+func newDebugEvent(event events.Event) (debugMessage, error) {
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return debugMessage{}, fmt.Errorf("json.Marshal: %w", err)
+	}
+	return debugMessage{
+		Type:  strings.TrimPrefix(fmt.Sprintf("%T", event), "events."),
+		Time:  time.Now(),
+		Event: raw,
+	}, nil
+}
+
+// DebugSubscription is a remote debug subscription opened by SubscribeDebug.
+type DebugSubscription struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+// SubscribeDebug subscribes to the events and debug stats of the node with
+// the given key, which must be serving them on this protocol with ServeDebug
+// and have our key as one of its admins.
+func (s *SessionProtocol) SubscribeDebug(ctx context.Context, key types.PublicKey) (*DebugSubscription, error) {
+	conn, err := s.DialContext(ctx, key.Network(), key.String()+":0")
+	if err != nil {
+		return nil, fmt.Errorf("s.DialContext: %w", err)
+	}
+	// QUIC doesn't tell the remote side about a stream until something
+	// has been written to it.
+	if _, err := conn.Write([]byte{'\n'}); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("conn.Write: %w", err)
+	}
+	return &DebugSubscription{
+		conn:    conn,
+		decoder: json.NewDecoder(conn),
+	}, nil
+}
+
+// Next blocks until the next message arrives from the remote node. An error
+// is returned if the remote node refused the subscription or once the
+// subscription has ended.
+func (d *DebugSubscription) Next() (*DebugMessage, error) {
+	var message debugMessage
+	if err := d.decoder.Decode(&message); err != nil {
+		return nil, err
+	}
+	if message.Error != "" {
+		return nil, fmt.Errorf("remote debug subscription refused: %s", message.Error)
+	}
+	event, err := decodeDebugEvent(message.Type, message.Event)
+	if err != nil {
+		return nil, fmt.Errorf("decodeDebugEvent: %w", err)
+	}
+	return &DebugMessage{
+		Type:    message.Type,
+		Time:    message.Time,
+		Event:   event,
+		Stats:   message.Stats,
+		Raw:     message.Event,
+		Dropped: message.Dropped,
+	}, nil
+}
+
+// Close ends the subscription.
+func (d *DebugSubscription) Close() error {
+	return d.conn.Close()
+}
+
+// decodeDebugEvent decodes an event of the given type. Event types that we
+// don't know about, i.e. from a newer version, are returned as nil so that
+// the raw encoding can still be looked at.
+func decodeDebugEvent(name string, raw json.RawMessage) (events.Event, error) {
+	var event events.Event
+	switch name {
+	case "PeerAdded":
+		event = &events.PeerAdded{}
+	case "PeerRemoved":
+		event = &events.PeerRemoved{}
+	case "PeerWedged":
+		event = &events.PeerWedged{}
+	case "TreeParentUpdate":
+		event = &events.TreeParentUpdate{}
+	case "SnakeDescUpdate":
+		event = &events.SnakeDescUpdate{}
+	case "TreeRootAnnUpdate":
+		event = &events.TreeRootAnnUpdate{}
+	case "SnakeEntryAdded":
+		event = &events.SnakeEntryAdded{}
+	case "SnakeEntryRemoved":
+		event = &events.SnakeEntryRemoved{}
+	case "BandwidthReport":
+		event = &events.BandwidthReport{}
+	default:
+		return nil, nil
+	}
+	if err := json.Unmarshal(raw, event); err != nil {
+		return nil, err
+	}
+	// Hand back the event by value, as the router would have published it.
+	return reflect.ValueOf(event).Elem().Interface().(events.Event), nil
+}
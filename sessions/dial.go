@@ -36,26 +36,11 @@ import (
 // routing. The address must be the destination public key specified in hex.
 // If the context expires then the session will be torn down automatically.
 func (s *SessionProtocol) DialContext(ctx context.Context, network, addrstr string) (net.Conn, error) {
-	host, _, err := net.SplitHostPort(addrstr)
+	pk, err := s.destination(addrstr)
 	if err != nil {
-		return nil, fmt.Errorf("net.SplitHostPort: %w", err)
-	}
-
-	var pk types.PublicKey
-	var addr net.Addr
-	pkb, err := hex.DecodeString(host)
-	if err != nil {
-		return nil, fmt.Errorf("hex.DecodeString: %w", err)
-	}
-	if len(pkb) != ed25519.PublicKeySize {
-		return nil, fmt.Errorf("host must be length of an ed25519 public key")
-	}
-	copy(pk[:], pkb)
-	addr = pk
-
-	if pk == s.s.r.PublicKey() {
-		return nil, fmt.Errorf("loopback dial")
+		return nil, err
 	}
+	addr := net.Addr(pk)
 
 	var retrying bool
 retry:
@@ -64,9 +49,10 @@ retry:
 		session.Lock()
 		tlsConfig := &tls.Config{
 			NextProtos:         []string{s.proto},
+			ServerName:         hex.EncodeToString(pk[:]),
 			InsecureSkipVerify: true,
 			GetClientCertificate: func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
-				return s.s.tlsCert, nil
+				return s.s.certificate(s.s.r.PublicKey()), nil
 			},
 			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
 				if c := len(rawCerts); c != 1 {
@@ -83,6 +69,7 @@ retry:
 				if !bytes.Equal(public, pk[:]) {
 					return fmt.Errorf("remote side returned incorrect public key")
 				}
+				s.s.learnRotation(cert, pk)
 				return nil
 			},
 		}
@@ -120,6 +107,35 @@ retry:
 	return &Stream{stream, session}, nil
 }
 
+// destination returns the public key to open a session with for the given
+// address, which must be the destination public key specified in hex.
+func (s *SessionProtocol) destination(addrstr string) (types.PublicKey, error) {
+	var pk types.PublicKey
+	host, _, err := net.SplitHostPort(addrstr)
+	if err != nil {
+		return pk, fmt.Errorf("net.SplitHostPort: %w", err)
+	}
+	pkb, err := hex.DecodeString(host)
+	if err != nil {
+		return pk, fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	if len(pkb) != ed25519.PublicKeySize {
+		return pk, fmt.Errorf("host must be length of an ed25519 public key")
+	}
+	copy(pk[:], pkb)
+	if pk == s.s.r.PublicKey() {
+		return pk, fmt.Errorf("loopback dial")
+	}
+	if rotation := s.s.r.KeyRotation(); rotation != nil {
+		if _, ok := rotation.Other(pk); ok {
+			return pk, fmt.Errorf("loopback dial")
+		}
+	}
+	// If the key has been rotated then we might already have a session open
+	// to the successor key, which we can use instead.
+	return s.resolve(pk), nil
+}
+
 // Dial dials a given public key using the supplied network.
 // The address must be the destination public key specified in hex.
 func (q *SessionProtocol) Dial(network, addr string) (net.Conn, error) {
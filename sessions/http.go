@@ -15,10 +15,18 @@
 package sessions
 
 import (
+	"encoding/hex"
+	"fmt"
+	"net"
 	"net/http"
+	"sync"
 	"time"
+
+	"github.com/matrix-org/pinecone/types"
 )
 
+// HTTP is a ready-made HTTP server and client for a session protocol, see
+// SessionProtocol.HTTP.
 type HTTP struct {
 	httpServer    *http.Server
 	httpMux       *http.ServeMux
@@ -26,15 +34,14 @@ type HTTP struct {
 	httpClient    *http.Client
 }
 
+// HTTP starts serving HTTP on the session protocol, using the returned mux,
+// and returns a client that makes requests to other nodes. Keepalives are
+// disabled, so each request opens a new stream. To serve a handler of your
+// own, or to tune the client, use Listener and HTTPTransport instead.
 func (q *SessionProtocol) HTTP() *HTTP {
-	t := &http.Transport{
-		DisableKeepAlives:   true,
-		MaxIdleConnsPerHost: -1,
-		Dial:                q.Dial,
-		DialTLS:             q.DialTLS,
-		DialContext:         q.DialContext,
-		DialTLSContext:      q.DialTLSContext,
-	}
+	t := q.HTTPTransport()
+	t.DisableKeepAlives = true
+	t.MaxIdleConnsPerHost = -1
 
 	h := &HTTP{
 		httpServer: &http.Server{
@@ -52,7 +59,7 @@ func (q *SessionProtocol) HTTP() *HTTP {
 		Timeout:   time.Second * 30,
 	}
 
-	go h.httpServer.Serve(q) // nolint:errcheck
+	go h.httpServer.Serve(q.Listener()) // nolint:errcheck
 	return h
 }
 
@@ -63,3 +70,77 @@ func (h *HTTP) Mux() *http.ServeMux {
 func (h *HTTP) Client() *http.Client {
 	return h.httpClient
 }
+
+// HTTPTransport returns an http.RoundTripper that sends requests to other
+// nodes over sessions on this protocol. The host of the request URL is the
+// public key of the remote node in hex, as in "https://<key>/path". Sessions
+// are already encrypted and authenticated by the remote key, so "https" URLs
+// aren't encrypted a second time, and the port is ignored. Connections are
+// kept alive and reused between requests to the same node.
+func (q *SessionProtocol) HTTPTransport() *http.Transport {
+	return &http.Transport{
+		Dial:                q.Dial,
+		DialTLS:             q.DialTLS,
+		DialContext:         q.DialContext,
+		DialTLSContext:      q.DialTLSContext,
+		IdleConnTimeout:     time.Second * 30,
+		MaxIdleConnsPerHost: 4,
+	}
+}
+
+// Listener returns a net.Listener that accepts streams on this protocol, so
+// that it can be passed to http.Server.Serve, or anything else that serves
+// from a listener. Closing the listener stops it accepting streams, which
+// lets an http.Server shut down cleanly, but doesn't close the sessions.
+// Only one listener should be used for each protocol at a time.
+func (q *SessionProtocol) Listener() net.Listener {
+	return &streamListener{
+		q:      q,
+		closed: make(chan struct{}),
+	}
+}
+
+type streamListener struct {
+	q         *SessionProtocol
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *streamListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, fmt.Errorf("listener closed")
+	case stream := <-l.q.streams:
+		if stream == nil {
+			return nil, fmt.Errorf("listener closed")
+		}
+		return stream, nil
+	}
+}
+
+func (l *streamListener) Addr() net.Addr {
+	return l.q.Addr()
+}
+
+func (l *streamListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+// RemotePublicKey returns the public key of the node that sent an HTTP
+// request that was received over a session. Sessions are authenticated, so
+// handlers can use it to decide who is allowed to do what.
+func RemotePublicKey(r *http.Request) (types.PublicKey, error) {
+	var pk types.PublicKey
+	b, err := hex.DecodeString(r.RemoteAddr)
+	if err != nil {
+		return pk, fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	if len(b) != len(pk) {
+		return pk, fmt.Errorf("remote address isn't a public key")
+	}
+	copy(pk[:], b)
+	return pk, nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// defaultIdleTimeout is long enough to ride out the snake being rebuilt,
+// since we address the remote side by public key, not by route.
+const defaultIdleTimeout = time.Second * 30
+
+// SessionsOption configures the session layer when it is created with
+// NewSessions.
+type SessionsOption interface {
+	isSessionsOption()
+}
+
+// SessionIdleTimeout sets how long a session can go without hearing anything
+// from the remote side before it is closed. Streams on a session that has
+// timed out return a *SessionClosedError with Timeout() set. The default is
+// 30 seconds.
+type SessionIdleTimeout time.Duration
+
+func (t SessionIdleTimeout) isSessionsOption() {}
+
+// SessionKeepalives controls whether keepalive pings are sent on sessions
+// that are otherwise idle. With keepalives, an idle session stays open for
+// as long as the remote side is still reachable and answering, and is closed
+// once it has stopped answering for the idle timeout. Without them, any
+// session that carries no traffic for the idle timeout is closed, whether the
+// remote side is still there or not. Keepalives are enabled by default.
+type SessionKeepalives bool
+
+func (k SessionKeepalives) isSessionsOption() {}
+
+// SessionClosed is emitted when a session with a remote node ends, for
+// whatever reason, so that embedders can clean up any state that they hold
+// for it.
+type SessionClosed struct {
+	Protocol  string
+	PublicKey types.PublicKey
+	Err       error // why the session was closed
+	Time      time.Time
+}
+
+// TimedOut returns true if the session was closed because the remote side
+// stopped responding.
+func (c SessionClosed) TimedOut() bool {
+	var err net.Error
+	return errors.As(c.Err, &err) && err.Timeout()
+}
+
+// SessionClosures returns a channel that receives an event every time a
+// session ends. Events will be dropped if the channel isn't read from quickly
+// enough.
+func (s *Sessions) SessionClosures() <-chan SessionClosed {
+	return s.closures
+}
+
+// SessionClosedError is returned by reads and writes on a stream once its
+// session has been closed. It implements net.Error, so a session that timed
+// out can be told apart using Timeout().
+type SessionClosedError struct {
+	Err error // why the session was closed
+}
+
+func (e *SessionClosedError) Error() string {
+	return "session closed: " + e.Err.Error()
+}
+
+func (e *SessionClosedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SessionClosedError) Timeout() bool {
+	var err net.Error
+	return errors.As(e.Err, &err) && err.Timeout()
+}
+
+func (e *SessionClosedError) Temporary() bool {
+	return false
+}
+
+// sessionClosed notifies about a session that has ended.
+func (s *SessionProtocol) sessionClosed(key types.PublicKey, err error) {
+	select {
+	case s.s.closures <- SessionClosed{
+		Protocol:  s.proto,
+		PublicKey: key,
+		Err:       err,
+		Time:      time.Now(),
+	}:
+	default:
+	}
+}
@@ -30,7 +30,13 @@ func (q *Sessions) listener() {
 			return
 		}
 
-		key := session.RemoteAddr().(types.PublicKey)
+		// Sessions are keyed purely by public key. Anything that arrived
+		// from a tree-routed address can't be matched to a key, so drop it.
+		key, ok := session.RemoteAddr().(types.PublicKey)
+		if !ok {
+			_ = session.CloseWithError(0, "sessions must be addressed by public key")
+			continue
+		}
 		tls := session.ConnectionState().TLS
 		if c := len(tls.PeerCertificates); c != 1 {
 			continue
@@ -43,6 +49,7 @@ func (q *Sessions) listener() {
 		if !bytes.Equal(public, key[:]) {
 			continue
 		}
+		q.learnRotation(cert, key)
 
 		if proto := q.Protocol(session.ConnectionState().TLS.NegotiatedProtocol); proto != nil {
 			entry, ok := proto.getSession(key)
@@ -63,12 +70,12 @@ func (s *SessionProtocol) sessionlistener(session *activeSession) {
 		return
 	}
 
-	defer s.sessions.Delete(key)
-
 	ctx := session.Context()
 	for {
 		stream, err := session.AcceptStream(ctx)
 		if err != nil {
+			s.sessions.Delete(key)
+			s.sessionClosed(key, err)
 			return
 		}
 
@@ -0,0 +1,133 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// pathCheckDelay is how long to wait after a routing change before checking
+// the paths of active sessions, so that a burst of changes, e.g. while the
+// tree is reconverging, results in a single check.
+const pathCheckDelay = time.Millisecond * 250
+
+// PathChange is emitted when the route used by an established session has
+// changed, for example because the snake has been rebuilt or our position in
+// the tree has moved. Sessions are addressed purely by public key, so they
+// survive these changes without the streams being interrupted.
+type PathChange struct {
+	Protocol  string
+	PublicKey types.PublicKey
+	NextHop   types.PublicKey // the zero key if there is currently no route
+	Coords    types.Coordinates
+	Time      time.Time
+}
+
+// Reachable returns true if there is a route to the remote side of the
+// session after the change.
+func (c PathChange) Reachable() bool {
+	return !c.NextHop.IsZero()
+}
+
+// pathIndex identifies a session for the purpose of tracking its path.
+type pathIndex struct {
+	proto string
+	key   types.PublicKey
+}
+
+// PathChanges returns a channel that receives an event every time the route
+// to the remote side of an established session changes. Events will be
+// dropped if the channel isn't read from quickly enough.
+func (s *Sessions) PathChanges() <-chan PathChange {
+	return s.pathChanges
+}
+
+// pathWatcher follows routing changes in the router and checks whether the
+// next-hop for each active session has changed as a result.
+func (s *Sessions) pathWatcher() {
+	ch := make(chan events.Event, 64)
+	s.r.Subscribe(ch)
+	defer s.r.Unsubscribe(ch)
+
+	timer := time.NewTimer(pathCheckDelay)
+	timer.Stop()
+	for {
+		select {
+		case <-s.context.Done():
+			timer.Stop()
+			return
+
+		case event := <-ch:
+			switch event.(type) {
+			case events.PeerAdded, events.PeerRemoved, events.TreeParentUpdate,
+				events.TreeRootAnnUpdate, events.SnakeDescUpdate,
+				events.SnakeEntryAdded, events.SnakeEntryRemoved:
+				timer.Reset(pathCheckDelay)
+			}
+
+		case <-timer.C:
+			s.checkPaths()
+		}
+	}
+}
+
+// checkPaths works out the current next-hop for every active session and
+// emits a PathChange for each one that differs from last time. It is only
+// called from the path watcher goroutine.
+func (s *Sessions) checkPaths() {
+	coords := s.r.Coords()
+	seen := map[pathIndex]struct{}{}
+	for proto, p := range s.protocols {
+		p.sessions.Range(func(k, _ interface{}) bool {
+			key, ok := k.(types.PublicKey)
+			if !ok {
+				return true
+			}
+			index := pathIndex{proto, key}
+			seen[index] = struct{}{}
+			var nexthop types.PublicKey
+			if hop, ok := s.r.NextHop(nil, types.TypeVirtualSnakeRouted, key).(types.PublicKey); ok && hop != s.r.PublicKey() {
+				nexthop = hop
+			}
+			previous, known := s.paths[index]
+			s.paths[index] = nexthop
+			if !known || previous == nexthop {
+				// Either nothing has changed or this is the first time we've
+				// seen the session, in which case there's no change to report.
+				return true
+			}
+			select {
+			case s.pathChanges <- PathChange{
+				Protocol:  proto,
+				PublicKey: key,
+				NextHop:   nexthop,
+				Coords:    coords,
+				Time:      time.Now(),
+			}:
+			default:
+			}
+			return true
+		})
+	}
+	// Forget about sessions that have gone away.
+	for index := range s.paths {
+		if _, ok := seen[index]; !ok {
+			delete(s.paths, index)
+		}
+	}
+}
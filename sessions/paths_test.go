@@ -0,0 +1,127 @@
+package sessions
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// newRouters returns two routers that aren't peered yet.
+func newRouters(t *testing.T) (*router.Router, *router.Router) {
+	t.Helper()
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := router.NewRouter(nil, ska, false)
+	rb := router.NewRouter(nil, skb, false)
+	t.Cleanup(func() {
+		_ = ra.Close()
+		_ = rb.Close()
+	})
+	return ra, rb
+}
+
+// disconnectRouters drops the peering from the first router to the second
+// and waits until the first no longer has a route to it.
+func disconnectRouters(t *testing.T, ra, rb *router.Router) {
+	t.Helper()
+	for _, peer := range ra.Peers() {
+		if peer.PublicKey == rb.PublicKey().String() {
+			ra.Disconnect(types.SwitchPortID(peer.Port), nil)
+		}
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if ra.NextHop(nil, types.TypeVirtualSnakeRouted, rb.PublicKey()) != rb.PublicKey() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("route did not go away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckPaths(t *testing.T) {
+	ra, rb := newRouters(t)
+	connectRouters(t, ra, rb)
+
+	// The path watcher isn't running, so the paths are only checked when
+	// we ask for them to be.
+	s := &Sessions{
+		r:           ra,
+		protocols:   map[string]*SessionProtocol{"test": {}},
+		paths:       map[pathIndex]types.PublicKey{},
+		pathChanges: make(chan PathChange, 16),
+	}
+	s.protocols["test"].sessions.Store(rb.PublicKey(), &activeSession{})
+	index := pathIndex{"test", rb.PublicKey()}
+
+	// The first time that a session is seen there's nothing to compare to.
+	s.checkPaths()
+	if hop := s.paths[index]; hop != rb.PublicKey() {
+		t.Fatalf("expected the next-hop to be %s but got %s", rb.PublicKey(), hop)
+	}
+	if len(s.pathChanges) != 0 {
+		t.Fatalf("expected no path change for a new session")
+	}
+
+	disconnectRouters(t, ra, rb)
+	s.checkPaths()
+	select {
+	case change := <-s.pathChanges:
+		if change.Protocol != "test" || change.PublicKey != rb.PublicKey() {
+			t.Fatalf("path change is for the wrong session: %+v", change)
+		}
+		if change.Reachable() {
+			t.Fatalf("expected the session to be unreachable but got next-hop %s", change.NextHop)
+		}
+	default:
+		t.Fatalf("expected a path change once the route went away")
+	}
+	s.checkPaths()
+	if len(s.pathChanges) != 0 {
+		t.Fatalf("expected no path change when nothing has changed")
+	}
+
+	// Sessions that have ended are forgotten.
+	s.protocols["test"].sessions.Delete(rb.PublicKey())
+	s.checkPaths()
+	if len(s.paths) != 0 {
+		t.Fatalf("expected the path of the ended session to be forgotten")
+	}
+}
+
+func TestPathChanges(t *testing.T) {
+	ra, rb := newRouters(t)
+	s := NewSessions(log.New(ioutil.Discard, "", 0), ra, []string{"test"})
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+	s.Protocol("test").sessions.Store(rb.PublicKey(), &activeSession{})
+
+	// Peering and then disconnecting again gives the path watcher a chance
+	// to see the session, so that the route coming back is reported.
+	connectRouters(t, ra, rb)
+	disconnectRouters(t, ra, rb)
+	time.Sleep(pathCheckDelay * 4)
+	connectRouters(t, ra, rb)
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case change := <-s.PathChanges():
+			if change.PublicKey != rb.PublicKey() {
+				t.Fatalf("path change is for the wrong session: %+v", change)
+			}
+			if change.Reachable() && change.NextHop == rb.PublicKey() {
+				return
+			}
+		case <-timeout:
+			t.Fatal("no path change was reported when the route came back")
+		}
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// Defaults for session pools, see NewPool.
+const (
+	defaultPoolMaxSessions = 64
+	defaultPoolMaxIdle     = 4
+	defaultPoolIdleTimeout = time.Second * 30
+)
+
+// SessionPoolOption configures a session pool when it is created with
+// NewPool.
+type SessionPoolOption interface {
+	isSessionPoolOption()
+}
+
+// PoolMaxSessions sets how many destinations the pool keeps idle streams
+// for. Once the limit is reached, the idle streams for the destination that
+// was used least recently are closed to make room. The default is 64.
+type PoolMaxSessions int
+
+func (m PoolMaxSessions) isSessionPoolOption() {}
+
+// PoolMaxIdle sets how many idle streams the pool keeps for each destination.
+// Streams that are returned to the pool beyond this are closed. The default
+// is 4.
+type PoolMaxIdle int
+
+func (m PoolMaxIdle) isSessionPoolOption() {}
+
+// PoolIdleTimeout sets how long a stream can sit unused in the pool before
+// it is closed. The default is 30 seconds.
+type PoolIdleTimeout time.Duration
+
+func (t PoolIdleTimeout) isSessionPoolOption() {}
+
+// SessionPool hands out streams to remote nodes, reusing streams that
+// earlier callers have finished with where it can, so that request/response
+// protocols don't pay for a new stream, or a new session and the path
+// lookup that goes with it, on every request. A stream is given back to the
+// pool by closing it, so it is up to the protocol to make sure that nothing
+// is left unread on a stream before it is closed.
+type SessionPool struct {
+	s           *SessionProtocol
+	maxSessions int
+	maxIdle     int
+	idleTimeout time.Duration
+	mutex       sync.Mutex                     // protects everything below
+	entries     map[types.PublicKey]*poolEntry // idle streams by destination
+	closed      bool
+	done        chan struct{}
+}
+
+type poolEntry struct {
+	idle     []*PooledStream // most recently returned last
+	lastUsed time.Time
+}
+
+// NewPool creates a session pool for the protocol. The pool should be
+// closed once it is no longer needed, which closes any idle streams.
+func (s *SessionProtocol) NewPool(options ...SessionPoolOption) *SessionPool {
+	p := &SessionPool{
+		s:           s,
+		maxSessions: defaultPoolMaxSessions,
+		maxIdle:     defaultPoolMaxIdle,
+		idleTimeout: defaultPoolIdleTimeout,
+		entries:     map[types.PublicKey]*poolEntry{},
+		done:        make(chan struct{}),
+	}
+	for _, option := range options {
+		switch o := option.(type) {
+		case PoolMaxSessions:
+			if o > 0 {
+				p.maxSessions = int(o)
+			}
+		case PoolMaxIdle:
+			if o >= 0 {
+				p.maxIdle = int(o)
+			}
+		case PoolIdleTimeout:
+			if o > 0 {
+				p.idleTimeout = time.Duration(o)
+			}
+		}
+	}
+	go p.reaper()
+	return p
+}
+
+// DialContext returns an idle stream to the given public key if there is
+// one, otherwise it dials a new one in the same way as
+// SessionProtocol.DialContext does. The returned connection is always a
+// *PooledStream.
+func (p *SessionPool) DialContext(ctx context.Context, network, addrstr string) (net.Conn, error) {
+	pk, err := p.s.destination(addrstr)
+	if err != nil {
+		return nil, err
+	}
+	if stream := p.take(pk); stream != nil {
+		return stream, nil
+	}
+	conn, err := p.s.DialContext(ctx, network, addrstr)
+	if err != nil {
+		return nil, err
+	}
+	return &PooledStream{Stream: conn.(*Stream), pool: p, key: pk}, nil
+}
+
+// Dial is DialContext without a context.
+func (p *SessionPool) Dial(network, addrstr string) (net.Conn, error) {
+	return p.DialContext(context.Background(), network, addrstr)
+}
+
+// Close closes all of the idle streams in the pool. Streams that are still
+// in use are closed, rather than returned to the pool, once they are done.
+func (p *SessionPool) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	for key, entry := range p.entries {
+		for _, stream := range entry.idle {
+			stream.discard()
+		}
+		delete(p.entries, key)
+	}
+	return nil
+}
+
+// take removes the most recently returned idle stream to the given key from
+// the pool, skipping any whose session has since closed. It returns nil if
+// there isn't one.
+func (p *SessionPool) take(key types.PublicKey) *PooledStream {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, ok := p.entries[key]
+	if !ok {
+		return nil
+	}
+	entry.lastUsed = time.Now()
+	for len(entry.idle) > 0 {
+		stream := entry.idle[len(entry.idle)-1]
+		entry.idle = entry.idle[:len(entry.idle)-1]
+		if stream.usable() {
+			stream.returned.Store(false)
+			return stream
+		}
+		stream.discard()
+	}
+	return nil
+}
+
+// put returns a stream to the pool, closing it instead if it can't be used
+// again or there's no room for it.
+func (p *SessionPool) put(stream *PooledStream) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed || !stream.usable() {
+		stream.discard()
+		return
+	}
+	entry, ok := p.entries[stream.key]
+	if !ok {
+		if len(p.entries) >= p.maxSessions {
+			p._evict()
+		}
+		entry = &poolEntry{}
+		p.entries[stream.key] = entry
+	}
+	if len(entry.idle) >= p.maxIdle {
+		stream.discard()
+		return
+	}
+	// Deadlines set by the last user mustn't affect the next one.
+	_ = stream.SetDeadline(time.Time{})
+	stream.idleSince = time.Now()
+	entry.lastUsed = stream.idleSince
+	entry.idle = append(entry.idle, stream)
+}
+
+// _evict closes the idle streams for the destination that was used least
+// recently. The mutex must be held when calling this function.
+func (p *SessionPool) _evict() {
+	var oldest types.PublicKey
+	var oldestEntry *poolEntry
+	for key, entry := range p.entries {
+		if oldestEntry == nil || entry.lastUsed.Before(oldestEntry.lastUsed) {
+			oldest, oldestEntry = key, entry
+		}
+	}
+	if oldestEntry == nil {
+		return
+	}
+	for _, stream := range oldestEntry.idle {
+		stream.discard()
+	}
+	delete(p.entries, oldest)
+}
+
+// reaper closes streams that have been idle for longer than the idle
+// timeout, until the pool or the sessions are closed.
+func (p *SessionPool) reaper() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.s.s.context.Done():
+			_ = p.Close()
+			return
+		case now := <-ticker.C:
+			p.reap(now)
+		}
+	}
+}
+
+func (p *SessionPool) reap(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, entry := range p.entries {
+		idle := entry.idle[:0]
+		for _, stream := range entry.idle {
+			if now.Sub(stream.idleSince) < p.idleTimeout && stream.usable() {
+				idle = append(idle, stream)
+			} else {
+				stream.discard()
+			}
+		}
+		entry.idle = idle
+		if len(entry.idle) == 0 && now.Sub(entry.lastUsed) >= p.idleTimeout {
+			delete(p.entries, key)
+		}
+	}
+}
+
+// PooledStream is a stream that was handed out by a SessionPool. Closing it
+// returns it to the pool, unless a read or write on it has failed, in which
+// case it is closed for real.
+type PooledStream struct {
+	*Stream
+	pool      *SessionPool
+	key       types.PublicKey
+	failed    atomic.Bool
+	returned  atomic.Bool
+	idleSince time.Time // protected by the pool mutex
+}
+
+func (s *PooledStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	if err != nil {
+		s.failed.Store(true)
+	}
+	return n, err
+}
+
+func (s *PooledStream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if err != nil {
+		s.failed.Store(true)
+	}
+	return n, err
+}
+
+// CloseWrite closes the write side of the stream, see Stream.CloseWrite. The
+// stream can't be reused afterwards, so it is closed for real when Close is
+// called.
+func (s *PooledStream) CloseWrite() error {
+	s.failed.Store(true)
+	return s.Stream.CloseWrite()
+}
+
+// CloseRead closes the read side of the stream, see Stream.CloseRead. As with
+// CloseWrite, the stream won't be returned to the pool.
+func (s *PooledStream) CloseRead() error {
+	s.failed.Store(true)
+	return s.Stream.CloseRead()
+}
+
+// Close returns the stream to the pool. It must not be used afterwards.
+func (s *PooledStream) Close() error {
+	if s.returned.Swap(true) {
+		return nil
+	}
+	s.pool.put(s)
+	return nil
+}
+
+// Discard closes the stream without returning it to the pool, i.e. if the
+// caller gave up on a response halfway through and the stream can't be
+// reused because of it.
+func (s *PooledStream) Discard() error {
+	if s.returned.Swap(true) {
+		return nil
+	}
+	return s.discard()
+}
+
+// usable returns true if the stream can be handed out again.
+func (s *PooledStream) usable() bool {
+	if s.failed.Load() {
+		return false
+	}
+	select {
+	case <-s.session.Context().Done():
+		return false
+	case <-s.Stream.Context().Done():
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *PooledStream) discard() error {
+	return s.Stream.Close()
+}
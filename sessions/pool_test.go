@@ -0,0 +1,168 @@
+package sessions
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// openSession is a session that is still open.
+type openSession struct {
+	quic.Session
+}
+
+func (openSession) Context() context.Context {
+	return context.Background()
+}
+
+// fakeStream is a QUIC stream that only keeps track of whether it has been
+// closed.
+type fakeStream struct {
+	quic.Stream
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newFakeStream() *fakeStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &fakeStream{ctx: ctx, cancel: cancel}
+}
+
+func (s *fakeStream) Context() context.Context        { return s.ctx }
+func (s *fakeStream) CancelRead(quic.StreamErrorCode) {}
+func (s *fakeStream) SetDeadline(time.Time) error     { return nil }
+func (s *fakeStream) Close() error {
+	s.cancel()
+	return nil
+}
+
+func (s *fakeStream) closed() bool {
+	return s.ctx.Err() != nil
+}
+
+// newTestPool creates a pool that isn't attached to any sessions and doesn't
+// run the reaper, so that the tests can reap when they want to.
+func newTestPool(maxSessions, maxIdle int) *SessionPool {
+	return &SessionPool{
+		maxSessions: maxSessions,
+		maxIdle:     maxIdle,
+		idleTimeout: defaultPoolIdleTimeout,
+		entries:     map[types.PublicKey]*poolEntry{},
+		done:        make(chan struct{}),
+	}
+}
+
+// newPooledStream returns a stream to the given key that was handed out by
+// the pool, along with the QUIC stream underneath it.
+func newPooledStream(p *SessionPool, key types.PublicKey) (*PooledStream, *fakeStream) {
+	fake := newFakeStream()
+	return &PooledStream{
+		Stream: &Stream{Stream: fake, session: openSession{}},
+		pool:   p,
+		key:    key,
+	}, fake
+}
+
+func TestPoolReapsIdleStreams(t *testing.T) {
+	p := newTestPool(defaultPoolMaxSessions, defaultPoolMaxIdle)
+	key := types.PublicKey{1}
+	stream, fake := newPooledStream(p, key)
+	broken, brokenFake := newPooledStream(p, key)
+	_ = stream.Close()
+	_ = broken.Close()
+
+	// A stream that breaks while it is idle is reaped straight away, but
+	// the others are kept until they have been idle for the timeout.
+	_ = brokenFake.Close()
+	now := time.Now()
+	p.reap(now.Add(p.idleTimeout / 2))
+	if !brokenFake.closed() || fake.closed() {
+		t.Fatal("expected only the broken stream to be reaped")
+	}
+	if n := len(p.entries[key].idle); n != 1 {
+		t.Fatalf("expected 1 idle stream, got %d", n)
+	}
+
+	p.reap(now.Add(p.idleTimeout))
+	if !fake.closed() {
+		t.Fatal("expected the idle stream to be closed once it passed the idle timeout")
+	}
+	if _, ok := p.entries[key]; ok {
+		t.Fatal("expected the destination to be forgotten once it had no idle streams")
+	}
+}
+
+func TestPoolMaxSessions(t *testing.T) {
+	p := newTestPool(2, 2)
+	a, b, c := types.PublicKey{1}, types.PublicKey{2}, types.PublicKey{3}
+
+	// Only as many streams as the idle limit are kept for a destination.
+	var fakes []*fakeStream
+	for i := 0; i < 3; i++ {
+		stream, fake := newPooledStream(p, a)
+		_ = stream.Close()
+		fakes = append(fakes, fake)
+	}
+	if n := len(p.entries[a].idle); n != 2 || !fakes[2].closed() {
+		t.Fatalf("expected the stream beyond the idle limit to be closed, got %d idle", n)
+	}
+
+	// Once there are idle streams for as many destinations as the limit,
+	// the destination that was used least recently makes room.
+	stream, fakeB := newPooledStream(p, b)
+	_ = stream.Close()
+	p.entries[a].lastUsed = time.Now().Add(-time.Minute)
+	stream, fakeC := newPooledStream(p, c)
+	_ = stream.Close()
+	if _, ok := p.entries[a]; ok || !fakes[0].closed() || !fakes[1].closed() {
+		t.Fatal("expected the least recently used destination to be evicted")
+	}
+	if len(p.entries) != 2 || fakeB.closed() || fakeC.closed() {
+		t.Fatalf("expected the other destinations to be kept, got %d", len(p.entries))
+	}
+}
+
+func TestPoolReusesStreamsPerDestination(t *testing.T) {
+	p := newTestPool(defaultPoolMaxSessions, defaultPoolMaxIdle)
+	a, b := types.PublicKey{1}, types.PublicKey{2}
+	streamA, _ := newPooledStream(p, a)
+	streamB, _ := newPooledStream(p, b)
+	_ = streamA.Close()
+	_ = streamB.Close()
+
+	// Each destination only gets its own streams back.
+	if got := p.take(b); got != streamB {
+		t.Fatal("expected the idle stream to b to be reused")
+	}
+	if got := p.take(b); got != nil {
+		t.Fatal("expected no more idle streams to b")
+	}
+	if got := p.take(a); got != streamA {
+		t.Fatal("expected the idle stream to a to be reused")
+	}
+
+	// Closing a stream that was taken again returns it again, but only once.
+	_ = streamA.Close()
+	_ = streamA.Close()
+	if n := len(p.entries[a].idle); n != 1 {
+		t.Fatalf("expected 1 idle stream to a, got %d", n)
+	}
+
+	// Streams that have failed or closed underneath aren't reused.
+	streamB.failed.Store(true)
+	_ = streamB.Close()
+	if got := p.take(b); got != nil {
+		t.Fatal("expected a failed stream not to be returned to the pool")
+	}
+	if got := p.take(a); got != streamA {
+		t.Fatal("expected the idle stream to a to be reused")
+	}
+	_ = streamA.Close()
+	_ = streamA.Stream.Stream.Close()
+	if got := p.take(a); got != nil {
+		t.Fatal("expected a closed stream to be skipped")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// rotationExtension is the certificate extension that carries the key
+// rotation that a node is taking part in, if any. The OID isn't registered
+// anywhere, since it only has to be recognised by other Pinecone nodes, and
+// each arc has to fit in 31 bits for crypto/x509 to parse it.
+var rotationExtension = asn1.ObjectIdentifier{2, 25, 1882780339}
+
+// certificates are the TLS certificates that we present, generated for the
+// key rotation that the router was taking part in at the time.
+type certificates struct {
+	rotation *types.KeyRotation                   // nil if not rotating
+	byKey    map[types.PublicKey]*tls.Certificate // one for each key we answer to
+}
+
+// certificate returns the TLS certificate for the given key, or for our own
+// key if we don't answer to the given key. Certificates are generated again
+// whenever the router starts or finishes a key rotation.
+func (s *Sessions) certificate(key types.PublicKey) *tls.Certificate {
+	rotation := s.r.KeyRotation()
+	s.certMutex.Lock()
+	defer s.certMutex.Unlock()
+	if s.certs == nil || !sameRotation(s.certs.rotation, rotation) {
+		certs := &certificates{
+			rotation: rotation,
+			byKey: map[types.PublicKey]*tls.Certificate{
+				s.r.PublicKey(): s.generateTLSCertificate(s.r.PrivateKey(), rotation),
+			},
+		}
+		if private, ok := s.r.KeyRotationPrivateKey(); ok && rotation != nil {
+			certs.byKey[private.Public()] = s.generateTLSCertificate(private, rotation)
+		}
+		s.certs = certs
+	}
+	if cert, ok := s.certs.byKey[key]; ok {
+		return cert
+	}
+	return s.certs.byKey[s.r.PublicKey()]
+}
+
+// serverCertificate picks the certificate for the key that the remote side
+// dialled, which it gives as the server name.
+func (s *Sessions) serverCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var key types.PublicKey
+	if b, err := hex.DecodeString(hello.ServerName); err == nil && len(b) == len(key) {
+		copy(key[:], b)
+	}
+	return s.certificate(key), nil
+}
+
+func sameRotation(a, b *types.KeyRotation) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// learnRotation remembers the key rotation in a certificate that the remote
+// side presented, if there is one and it is valid, so that later dials to
+// the previous key can use a session that is already open to the successor.
+func (s *Sessions) learnRotation(cert *x509.Certificate, key types.PublicKey) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(rotationExtension) {
+			continue
+		}
+		var rotation types.KeyRotation
+		if _, err := rotation.UnmarshalBinary(ext.Value); err != nil {
+			return
+		}
+		if _, ok := rotation.Other(key); !ok || rotation.Verify(time.Now()) != nil {
+			return
+		}
+		s.rotations.Store(rotation.Previous, &rotation)
+		return
+	}
+}
+
+// resolve returns the key to use for a session with the given key. If the
+// key has been rotated and this protocol already has a session open to the
+// successor key, the successor is returned so that the session is reused.
+// Only the previous key is ever resolved to the successor, since the previous
+// key is the one that signed the rotation.
+func (p *SessionProtocol) resolve(key types.PublicKey) types.PublicKey {
+	v, ok := p.s.rotations.Load(key)
+	if !ok {
+		return key
+	}
+	rotation := v.(*types.KeyRotation)
+	if !time.Now().Before(rotation.ExpiresAt()) {
+		p.s.rotations.Delete(key)
+		return key
+	}
+	if _, ok := p.sessions.Load(rotation.Successor); ok {
+		return rotation.Successor
+	}
+	return key
+}
@@ -36,14 +36,20 @@ import (
 
 type Sessions struct {
 	r            *router.Router
-	log          types.Logger                // logger
-	context      context.Context             // router context
-	cancel       context.CancelFunc          // shut down the router
-	protocols    map[string]*SessionProtocol // accepted connections by proto
-	tlsCert      *tls.Certificate            //
-	tlsServerCfg *tls.Config                 //
-	quicListener quic.Listener               //
-	quicConfig   *quic.Config                //
+	log          types.Logger                  // logger
+	context      context.Context               // router context
+	cancel       context.CancelFunc            // shut down the router
+	protocols    map[string]*SessionProtocol   // accepted connections by proto
+	certMutex    sync.Mutex                    // protects certs
+	certs        *certificates                 // our TLS certificates, see certificate
+	rotations    sync.Map                      // previous types.PublicKey -> *types.KeyRotation
+	tlsServerCfg *tls.Config                   //
+	quicListener quic.Listener                 //
+	quicConfig   *quic.Config                  //
+	pathChanges  chan PathChange               // route changes for active sessions
+	closures     chan SessionClosed            // sessions that have ended
+	paths        map[pathIndex]types.PublicKey // last known next-hop by session, owned by pathWatcher
+	stats        sync.Map                      // QUIC session tracing ID (uint64) -> *sessionTracer
 }
 
 type SessionProtocol struct {
@@ -58,7 +64,7 @@ type activeSession struct {
 	sync.RWMutex
 }
 
-func NewSessions(log types.Logger, r *router.Router, protos []string) *Sessions {
+func NewSessions(log types.Logger, r *router.Router, protos []string, options ...SessionsOption) *Sessions {
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &Sessions{
 		r:         r,
@@ -67,10 +73,25 @@ func NewSessions(log types.Logger, r *router.Router, protos []string) *Sessions
 		cancel:    cancel,
 		protocols: make(map[string]*SessionProtocol, len(protos)),
 		quicConfig: &quic.Config{
-			MaxIdleTimeout:          time.Second * 15,
+			// Keepalives stop sessions from going idle, but the idle timeout
+			// still closes sessions to nodes that have stopped responding.
+			MaxIdleTimeout:          defaultIdleTimeout,
+			KeepAlive:               true,
 			DisablePathMTUDiscovery: true,
 		},
+		pathChanges: make(chan PathChange, 16),
+		closures:    make(chan SessionClosed, 16),
+		paths:       map[pathIndex]types.PublicKey{},
 	}
+	for _, option := range options {
+		switch o := option.(type) {
+		case SessionIdleTimeout:
+			s.quicConfig.MaxIdleTimeout = time.Duration(o)
+		case SessionKeepalives:
+			s.quicConfig.KeepAlive = bool(o)
+		}
+	}
+	s.quicConfig.Tracer = &statsTracer{s}
 	for _, proto := range protos {
 		s.protocols[proto] = &SessionProtocol{
 			s:       s,
@@ -79,11 +100,10 @@ func NewSessions(log types.Logger, r *router.Router, protos []string) *Sessions
 		}
 	}
 
-	s.tlsCert = s.generateTLSCertificate()
 	s.tlsServerCfg = &tls.Config{
-		Certificates: []tls.Certificate{*s.tlsCert},
-		ClientAuth:   tls.RequireAnyClientCert,
-		NextProtos:   protos,
+		GetCertificate: s.serverCertificate,
+		ClientAuth:     tls.RequireAnyClientCert,
+		NextProtos:     protos,
 	}
 
 	var err error
@@ -93,6 +113,7 @@ func NewSessions(log types.Logger, r *router.Router, protos []string) *Sessions
 	}
 
 	go s.listener()
+	go s.pathWatcher()
 	return s
 }
 
@@ -123,8 +144,8 @@ func (p *SessionProtocol) getSession(pk types.PublicKey) (*activeSession, bool)
 	return v.(*activeSession), ok
 }
 
-func (s *Sessions) generateTLSCertificate() *tls.Certificate {
-	private, public := s.r.PrivateKey(), s.r.PublicKey()
+func (s *Sessions) generateTLSCertificate(private types.PrivateKey, rotation *types.KeyRotation) *tls.Certificate {
+	public := private.Public()
 	id := hex.EncodeToString(public[:])
 
 	template := x509.Certificate{
@@ -135,6 +156,15 @@ func (s *Sessions) generateTLSCertificate() *tls.Certificate {
 		NotAfter:     time.Now().Add(time.Hour * 24 * 365),
 		DNSNames:     []string{id},
 	}
+	if rotation != nil {
+		value := make([]byte, rotation.Length())
+		if _, err := rotation.MarshalBinary(value); err != nil {
+			panic(fmt.Errorf("rotation.MarshalBinary: %w", err))
+		}
+		template.ExtraExtensions = []pkix.Extension{
+			{Id: rotationExtension, Value: value},
+		}
+	}
 
 	certDER, err := x509.CreateCertificate(
 		rand.Reader,
@@ -0,0 +1,223 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/logging"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// statsRateInterval is how often the measured send and receive rates are
+// updated. Each update is averaged with the previous ones so that the rates
+// don't jump around with every burst of traffic.
+const statsRateInterval = time.Second
+
+// statsRateWeight is the weight given to the latest interval when updating
+// the measured rates.
+const statsRateWeight = 0.25
+
+// SessionStats describes the current state of a session with a remote node.
+// Round-trip times and the congestion window come from the QUIC congestion
+// controller, so they reflect the path that the session is taking through
+// the network right now and will change if the route to the remote side does.
+// Applications such as media calls can use these to adapt their bitrate.
+type SessionStats struct {
+	Protocol         string
+	PublicKey        types.PublicKey
+	RTT              time.Duration // smoothed round-trip time
+	MinRTT           time.Duration // lowest round-trip time seen
+	LatestRTT        time.Duration // most recent round-trip time sample
+	CongestionWindow uint64        // in bytes
+	BytesInFlight    uint64        // sent but not yet acknowledged
+	BytesSent        uint64        // including QUIC overheads
+	BytesReceived    uint64        // including QUIC overheads
+	PacketsLost      uint64        //
+	SendRate         float64       // measured, in bytes per second
+	ReceiveRate      float64       // measured, in bytes per second
+}
+
+// Throughput returns the estimated number of bytes per second that can be
+// sent on the session, which is how much the congestion controller will allow
+// in flight for each round trip. It will be zero until the first round-trip
+// time has been measured.
+func (s SessionStats) Throughput() float64 {
+	if s.RTT <= 0 {
+		return 0
+	}
+	return float64(s.CongestionWindow) / s.RTT.Seconds()
+}
+
+// SessionStats returns the statistics for every open session on this
+// protocol. Sessions that are still being set up aren't included.
+func (s *SessionProtocol) SessionStats() []SessionStats {
+	var stats []SessionStats
+	s.sessions.Range(func(k, v interface{}) bool {
+		key, ok := k.(types.PublicKey)
+		if !ok {
+			return true
+		}
+		session := v.(*activeSession)
+		session.RLock()
+		defer session.RUnlock()
+		if session.Session == nil {
+			return true
+		}
+		id, ok := session.Context().Value(quic.SessionTracingKey).(uint64)
+		if !ok {
+			return true
+		}
+		if tracer, ok := s.s.stats.Load(id); ok {
+			stat := tracer.(*sessionTracer).snapshot()
+			stat.Protocol, stat.PublicKey = s.proto, key
+			stats = append(stats, stat)
+		}
+		return true
+	})
+	return stats
+}
+
+// statsTracer hands out a sessionTracer for every QUIC session, so that the
+// metrics from the congestion controller can be looked up later.
+type statsTracer struct {
+	s *Sessions
+}
+
+func (t *statsTracer) TracerForConnection(ctx context.Context, _ logging.Perspective, _ logging.ConnectionID) logging.ConnectionTracer {
+	id, ok := ctx.Value(quic.SessionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+	tracer := &sessionTracer{
+		s:      t.s,
+		id:     id,
+		window: time.Now(),
+	}
+	t.s.stats.Store(id, tracer)
+	return tracer
+}
+
+func (t *statsTracer) SentPacket(net.Addr, *logging.Header, logging.ByteCount, []logging.Frame) {}
+
+func (t *statsTracer) DroppedPacket(net.Addr, logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+
+// sessionTracer records the metrics for a single QUIC session. Most of the
+// events that QUIC traces aren't interesting here and are ignored.
+type sessionTracer struct {
+	s         *Sessions
+	id        uint64
+	mutex     sync.Mutex
+	stats     SessionStats
+	window    time.Time // when the current rate interval started
+	windowTx  uint64    // bytes sent in the current rate interval
+	windowRx  uint64    // bytes received in the current rate interval
+	rateValid bool      // true once the first rate interval has ended
+}
+
+// snapshot returns a copy of the current statistics.
+func (t *sessionTracer) snapshot() SessionStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t._updateRates(time.Now())
+	return t.stats
+}
+
+// _updateRates folds the current interval into the measured rates once it
+// has run for long enough. If the session has been idle for a while then the
+// interval will be long, bringing the rates down accordingly. The mutex must
+// be held.
+func (t *sessionTracer) _updateRates(now time.Time) {
+	elapsed := now.Sub(t.window)
+	if elapsed < statsRateInterval {
+		return
+	}
+	tx := float64(t.windowTx) / elapsed.Seconds()
+	rx := float64(t.windowRx) / elapsed.Seconds()
+	if t.rateValid {
+		tx = t.stats.SendRate + (tx-t.stats.SendRate)*statsRateWeight
+		rx = t.stats.ReceiveRate + (rx-t.stats.ReceiveRate)*statsRateWeight
+	}
+	t.stats.SendRate, t.stats.ReceiveRate = tx, rx
+	t.window, t.windowTx, t.windowRx = now, 0, 0
+	t.rateValid = true
+}
+
+func (t *sessionTracer) SentPacket(_ *logging.ExtendedHeader, size logging.ByteCount, _ *logging.AckFrame, _ []logging.Frame) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stats.BytesSent += uint64(size)
+	t.windowTx += uint64(size)
+	t._updateRates(time.Now())
+}
+
+func (t *sessionTracer) ReceivedPacket(_ *logging.ExtendedHeader, size logging.ByteCount, _ []logging.Frame) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stats.BytesReceived += uint64(size)
+	t.windowRx += uint64(size)
+	t._updateRates(time.Now())
+}
+
+func (t *sessionTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stats.RTT = rttStats.SmoothedRTT()
+	t.stats.MinRTT = rttStats.MinRTT()
+	t.stats.LatestRTT = rttStats.LatestRTT()
+	t.stats.CongestionWindow = uint64(cwnd)
+	t.stats.BytesInFlight = uint64(bytesInFlight)
+}
+
+func (t *sessionTracer) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stats.PacketsLost++
+}
+
+// Close is called once the QUIC session has closed.
+func (t *sessionTracer) Close() {
+	t.s.stats.Delete(t.id)
+}
+
+func (t *sessionTracer) StartedConnection(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+}
+func (t *sessionTracer) NegotiatedVersion(chosen logging.VersionNumber, clientVersions, serverVersions []logging.VersionNumber) {
+}
+func (t *sessionTracer) ClosedConnection(error)                                                    {}
+func (t *sessionTracer) SentTransportParameters(*logging.TransportParameters)                      {}
+func (t *sessionTracer) ReceivedTransportParameters(*logging.TransportParameters)                  {}
+func (t *sessionTracer) RestoredTransportParameters(*logging.TransportParameters)                  {}
+func (t *sessionTracer) ReceivedVersionNegotiationPacket(*logging.Header, []logging.VersionNumber) {}
+func (t *sessionTracer) ReceivedRetry(*logging.Header)                                             {}
+func (t *sessionTracer) BufferedPacket(logging.PacketType)                                         {}
+func (t *sessionTracer) DroppedPacket(logging.PacketType, logging.ByteCount, logging.PacketDropReason) {
+}
+func (t *sessionTracer) AcknowledgedPacket(logging.EncryptionLevel, logging.PacketNumber)   {}
+func (t *sessionTracer) UpdatedCongestionState(logging.CongestionState)                     {}
+func (t *sessionTracer) UpdatedPTOCount(uint32)                                             {}
+func (t *sessionTracer) UpdatedKeyFromTLS(logging.EncryptionLevel, logging.Perspective)     {}
+func (t *sessionTracer) UpdatedKey(logging.KeyPhase, bool)                                  {}
+func (t *sessionTracer) DroppedEncryptionLevel(logging.EncryptionLevel)                     {}
+func (t *sessionTracer) DroppedKey(logging.KeyPhase)                                        {}
+func (t *sessionTracer) SetLossTimer(logging.TimerType, logging.EncryptionLevel, time.Time) {}
+func (t *sessionTracer) LossTimerExpired(logging.TimerType, logging.EncryptionLevel)        {}
+func (t *sessionTracer) LossTimerCanceled()                                                 {}
+func (t *sessionTracer) Debug(name, msg string)                                             {}
@@ -15,16 +15,77 @@
 package sessions
 
 import (
+	"io"
 	"net"
 
 	"github.com/lucas-clemente/quic-go"
 )
 
+// Stream is a single bidirectional stream within a session. It behaves like
+// a TCP connection: it implements net.Conn, including deadlines, and can be
+// half-closed with CloseWrite and CloseRead, so that libraries written for
+// TCP, i.e. net/http, work over it unmodified. Reads and writes that pass a
+// deadline fail with an error that has Timeout() set and matches
+// os.ErrDeadlineExceeded, and the stream can be used again after the deadline
+// has been moved. Deadlines are separate from the session idle timeout.
 type Stream struct {
 	quic.Stream
 	session quic.Session
 }
 
+// Read reads from the stream. Once the session has been closed, i.e. because
+// the remote side stopped responding for longer than the idle timeout, the
+// error returned is a *SessionClosedError.
+func (s *Stream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	return n, s.wrapError(err)
+}
+
+// Write writes to the stream. Once the session has been closed, the error
+// returned is a *SessionClosedError.
+func (s *Stream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	return n, s.wrapError(err)
+}
+
+// Close closes both directions of the stream. Unlike closing a QUIC stream,
+// which only closes the write side, reads that are waiting on the stream are
+// unblocked and anything that the remote side sends afterwards is discarded.
+func (s *Stream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+// CloseWrite closes the write side of the stream. The remote side reads io.EOF
+// once it has read everything that was written before, but can still write
+// to us.
+func (s *Stream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// CloseRead closes the read side of the stream. The remote side is told to
+// stop sending, and writes from it fail, but we can still write to it.
+func (s *Stream) CloseRead() error {
+	s.Stream.CancelRead(0)
+	return nil
+}
+
+// wrapError turns errors that happen because the session has closed into a
+// *SessionClosedError. io.EOF is passed through as it is, since a remote side
+// that closes the stream after its last write isn't an error, and callers
+// such as io.Copy compare against it directly.
+func (s *Stream) wrapError(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	select {
+	case <-s.session.Context().Done():
+		return &SessionClosedError{err}
+	default:
+		return err
+	}
+}
+
 func (s *Stream) LocalAddr() net.Addr {
 	return s.session.LocalAddr()
 }
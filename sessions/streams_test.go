@@ -0,0 +1,193 @@
+package sessions
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/matrix-org/pinecone/router"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// closedSession is a session that has already been closed.
+type closedSession struct {
+	quic.Session
+}
+
+func (closedSession) Context() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestStreamWrapError(t *testing.T) {
+	s := &Stream{session: closedSession{}}
+	if err := s.wrapError(nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// The remote side closing the stream after its last write is reported
+	// as io.EOF, even once the session has gone too.
+	if err := s.wrapError(io.EOF); err != io.EOF {
+		t.Fatalf("expected io.EOF to be passed through, got %v", err)
+	}
+	cause := errors.New("connection reset")
+	err := s.wrapError(cause)
+	var closed *SessionClosedError
+	if !errors.As(err, &closed) || !errors.Is(err, cause) {
+		t.Fatalf("expected a SessionClosedError wrapping the cause, got %v", err)
+	}
+}
+
+// connectRouters peers two routers directly and waits until the first has a
+// SNEK route to the second.
+func connectRouters(t *testing.T, ra, rb *router.Router) {
+	t.Helper()
+	pa, pb := net.Pipe()
+	errs := make(chan error, 2)
+	go func() {
+		_, err := ra.Connect(pa, router.ConnectionPublicKey(rb.PublicKey()), router.ConnectionKeepalives(false))
+		errs <- err
+	}()
+	go func() {
+		_, err := rb.Connect(pb, router.ConnectionPublicKey(ra.PublicKey()), router.ConnectionKeepalives(false))
+		errs <- err
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Connect: %v", err)
+		}
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if ra.NextHop(nil, types.TypeVirtualSnakeRouted, rb.PublicKey()) == rb.PublicKey() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routers did not converge")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newStreamPair peers two routers directly, starts sessions on both and
+// returns a stream dialled from the first to the second along with the
+// accepted end of it on the second.
+func newStreamPair(t *testing.T) (*Stream, *Stream) {
+	t.Helper()
+	_, ska, _ := ed25519.GenerateKey(nil)
+	_, skb, _ := ed25519.GenerateKey(nil)
+	ra := router.NewRouter(nil, ska, false)
+	rb := router.NewRouter(nil, skb, false)
+	t.Cleanup(func() {
+		_ = ra.Close()
+		_ = rb.Close()
+	})
+	connectRouters(t, ra, rb)
+
+	logger := log.New(ioutil.Discard, "", 0)
+	sa := NewSessions(logger, ra, []string{"test"})
+	sb := NewSessions(logger, rb, []string{"test"})
+	t.Cleanup(func() {
+		_ = sa.Close()
+		_ = sb.Close()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pk := rb.PublicKey()
+	dialled, err := sa.Protocol("test").DialContext(ctx, "pinecone", net.JoinHostPort(hex.EncodeToString(pk[:]), "0"))
+	if err != nil {
+		t.Fatalf("DialContext: %v", err)
+	}
+	// The stream only reaches the remote side once something is sent on it.
+	if _, err = dialled.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	accepted, err := sb.Protocol("test").Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(accepted, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected %q, got %q (%v)", "hello", buf, err)
+	}
+	return dialled.(*Stream), accepted.(*Stream)
+}
+
+func TestStreamHalfClose(t *testing.T) {
+	a, b := newStreamPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	if _, err := a.Write([]byte("request")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := a.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	// The remote side sees everything written before CloseWrite followed
+	// by a clean EOF.
+	got, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "request" {
+		t.Fatalf("expected %q, got %q", "request", got)
+	}
+	// The other direction stays open until the remote side closes it.
+	if _, err = b.Write([]byte("response")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err = b.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	if got, err = ioutil.ReadAll(a); err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "response" {
+		t.Fatalf("expected %q, got %q", "response", got)
+	}
+}
+
+func TestStreamDeadline(t *testing.T) {
+	a, b := newStreamPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	if err := b.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	_, err := b.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	// Moving the deadline makes the stream usable again.
+	if err = b.SetDeadline(time.Time{}); err != nil {
+		t.Fatalf("SetDeadline: %v", err)
+	}
+	if _, err = a.Write([]byte("x")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	buf := make([]byte, 1)
+	if _, err = io.ReadFull(b, buf); err != nil || buf[0] != 'x' {
+		t.Fatalf("expected %q, got %q (%v)", "x", buf, err)
+	}
+
+	if err = a.SetWriteDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("SetWriteDeadline: %v", err)
+	}
+	if _, err = a.Write([]byte("y")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected os.ErrDeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fixtures generates node keys and network topologies for tests and
+// for the simulator. Everything is derived from a seed, so the same seed gives
+// the same node identities every time, and a failure that names a node can be
+// reproduced by anyone with the seed.
+package fixtures
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// Key returns the private key for the named node, derived from the seed.
+func Key(seed, name string) ed25519.PrivateKey {
+	h := sha256.Sum256([]byte("pinecone fixture\x00" + seed + "\x00" + name))
+	return ed25519.NewKeyFromSeed(h[:])
+}
+
+// PublicKey returns the public key for the named node, derived from the seed.
+func PublicKey(seed, name string) types.PublicKey {
+	var public types.PublicKey
+	copy(public[:], Key(seed, name).Public().(ed25519.PublicKey))
+	return public
+}
+
+// Topology describes a network of numbered nodes and the links between them.
+type Topology struct {
+	Kind  string   // what sort of topology this is, i.e. "ring"
+	Size  int      // how many nodes there are
+	Links [][2]int // pairs of node numbers, the lower number first
+}
+
+// Name returns the name of the given node, which is its number. Keys for the
+// node can be generated from the name with Key.
+func (t Topology) Name(i int) string {
+	return strconv.Itoa(i)
+}
+
+// Names returns the names of all of the nodes in order.
+func (t Topology) Names() []string {
+	names := make([]string, t.Size)
+	for i := range names {
+		names[i] = t.Name(i)
+	}
+	return names
+}
+
+// Keys returns the private keys of all of the nodes in order, derived from
+// the seed.
+func (t Topology) Keys(seed string) []ed25519.PrivateKey {
+	keys := make([]ed25519.PrivateKey, t.Size)
+	for i := range keys {
+		keys[i] = Key(seed, t.Name(i))
+	}
+	return keys
+}
+
+// String returns the topology in the format of the simulator graph files,
+// with one link on each line.
+func (t Topology) String() string {
+	var b strings.Builder
+	for _, l := range t.Links {
+		fmt.Fprintf(&b, "%s %s\n", t.Name(l[0]), t.Name(l[1]))
+	}
+	return b.String()
+}
+
+// Line returns n nodes connected one after another.
+func Line(n int) Topology {
+	t := Topology{Kind: "line", Size: n}
+	for i := 1; i < n; i++ {
+		t.Links = append(t.Links, [2]int{i - 1, i})
+	}
+	return t
+}
+
+// Star returns a hub, which is node 0, with the other n-1 nodes connected to
+// it.
+func Star(n int) Topology {
+	t := Topology{Kind: "star", Size: n}
+	for i := 1; i < n; i++ {
+		t.Links = append(t.Links, [2]int{0, i})
+	}
+	return t
+}
+
+// Ring returns a line of n nodes with the ends joined together. Rings of
+// fewer than three nodes are the same as lines.
+func Ring(n int) Topology {
+	t := Line(n)
+	t.Kind = "ring"
+	if n > 2 {
+		t.Links = append(t.Links, [2]int{0, n - 1})
+	}
+	return t
+}
+
+// Tree returns a balanced tree of n nodes, where every node has the given
+// number of children apart from those on the bottom row. Node 0 is at the top
+// and the children of node i are numbered from i*fanout+1.
+func Tree(n, fanout int) Topology {
+	t := Topology{Kind: "tree", Size: n}
+	if fanout < 1 {
+		fanout = 1
+	}
+	for i := 1; i < n; i++ {
+		t.Links = append(t.Links, [2]int{(i - 1) / fanout, i})
+	}
+	return t
+}
+
+// Parse returns the topology given by a description such as "line:8",
+// "star:8", "ring:8", "tree:15" or "tree:40:3", where the number is the size
+// and the optional third part is the fanout of a tree, which is 2 by default.
+func Parse(desc string) (Topology, error) {
+	parts := strings.Split(desc, ":")
+	if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[0] != "tree") {
+		return Topology{}, fmt.Errorf("topology %q should look like \"ring:8\"", desc)
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil || n < 1 {
+		return Topology{}, fmt.Errorf("topology %q has an invalid size", desc)
+	}
+	switch parts[0] {
+	case "line":
+		return Line(n), nil
+	case "star":
+		return Star(n), nil
+	case "ring":
+		return Ring(n), nil
+	case "tree":
+		fanout := 2
+		if len(parts) == 3 {
+			if fanout, err = strconv.Atoi(parts[2]); err != nil || fanout < 1 {
+				return Topology{}, fmt.Errorf("topology %q has an invalid fanout", desc)
+			}
+		}
+		return Tree(n, fanout), nil
+	default:
+		return Topology{}, fmt.Errorf("unknown topology %q", parts[0])
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fixtures
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeysAreDeterministic(t *testing.T) {
+	if !bytes.Equal(Key("seed", "0"), Key("seed", "0")) {
+		t.Fatal("expected the same seed and name to give the same key")
+	}
+	if bytes.Equal(Key("seed", "0"), Key("seed", "1")) {
+		t.Fatal("expected different names to give different keys")
+	}
+	if bytes.Equal(Key("seed", "0"), Key("other", "0")) {
+		t.Fatal("expected different seeds to give different keys")
+	}
+	if PublicKey("seed", "0") != PublicKey("seed", "0") {
+		t.Fatal("expected the same seed and name to give the same public key")
+	}
+}
+
+func TestTopologies(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		links int
+		last  [2]int // the last link
+	}{
+		{"line:5", 4, [2]int{3, 4}},
+		{"star:5", 4, [2]int{0, 4}},
+		{"ring:5", 5, [2]int{0, 4}},
+		{"ring:2", 1, [2]int{0, 1}},
+		{"tree:7", 6, [2]int{2, 6}},
+		{"tree:13:3", 12, [2]int{3, 12}},
+	} {
+		topology, err := Parse(tc.desc)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.desc, err)
+		}
+		if len(topology.Links) != tc.links {
+			t.Fatalf("%s: expected %d links but got %d", tc.desc, tc.links, len(topology.Links))
+		}
+		if last := topology.Links[len(topology.Links)-1]; last != tc.last {
+			t.Fatalf("%s: expected the last link to be %v but got %v", tc.desc, tc.last, last)
+		}
+	}
+	for _, desc := range []string{"", "line", "line:0", "mesh:4", "ring:4:2", "tree:4:0"} {
+		if _, err := Parse(desc); err == nil {
+			t.Fatalf("expected %q to be refused", desc)
+		}
+	}
+	if s := Line(3).String(); s != "0 1\n1 2\n" {
+		t.Fatalf("unexpected graph file %q", s)
+	}
+}
@@ -16,10 +16,24 @@ package types
 
 import (
 	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"os"
 )
 
+// Errors returned when decoding or validating a switch announcement. They
+// are usually wrapped with more detail, so check for them with errors.Is.
+var (
+	ErrAnnouncementTooShort     = errors.New("announcement is too short")
+	ErrAnnouncementTrailingData = errors.New("announcement has trailing data")
+	ErrAnnouncementNoSignatures = errors.New("update has no signatures")
+	ErrAnnouncementRootMismatch = errors.New("update first signature doesn't match root key")
+	ErrAnnouncementZeroHop      = errors.New("update contains invalid 0 hop")
+	ErrAnnouncementNotFromPeer  = errors.New("update last signature is not from direct peer")
+	ErrAnnouncementLoop         = errors.New("update contains routing loop")
+	ErrAnnouncementSignature    = errors.New("signature verification failed")
+)
+
 type Root struct {
 	RootPublicKey PublicKey `json:"root_public_key"`
 	RootSequence  Varu64    `json:"root_sequence"`
@@ -58,7 +72,7 @@ func (a *SwitchAnnouncement) Sign(privKey ed25519.PrivateKey, forPort SwitchPort
 func (a *SwitchAnnouncement) UnmarshalBinary(data []byte) (int, error) {
 	expected := ed25519.PublicKeySize + 1
 	if size := len(data); size < expected {
-		return 0, fmt.Errorf("expecting at least %d bytes, got %d bytes", expected, size)
+		return 0, fmt.Errorf("%w: expecting at least %d bytes, got %d bytes", ErrAnnouncementTooShort, expected, size)
 	}
 	remaining := data[copy(a.RootPublicKey[:ed25519.PublicKeySize], data):]
 	if l, err := a.RootSequence.UnmarshalBinary(remaining); err != nil {
@@ -74,7 +88,7 @@ func (a *SwitchAnnouncement) UnmarshalBinary(data []byte) (int, error) {
 		}
 		if _, ok := os.LookupEnv("PINECONE_DISABLE_SIGNATURES"); !ok {
 			if !ed25519.Verify(signature.PublicKey[:], data[:len(data)-len(remaining)], signature.Signature[:]) {
-				return 0, fmt.Errorf("signature verification failed for hop %d", signature.Hop)
+				return 0, fmt.Errorf("%w for hop %d", ErrAnnouncementSignature, signature.Hop)
 			}
 		}
 		a.Signatures = append(a.Signatures, signature)
@@ -101,25 +115,94 @@ func (a *SwitchAnnouncement) MarshalBinary(buffer []byte) (int, error) {
 	return offset, nil
 }
 
-func (a *SwitchAnnouncement) SanityCheck(from PublicKey) error {
+// Length returns the number of bytes that MarshalBinary will write.
+func (a *SwitchAnnouncement) Length() int {
+	length := a.Root.Length()
+	for _, sig := range a.Signatures {
+		length += sig.Hop.Length() + ed25519.PublicKeySize + ed25519.SignatureSize
+	}
+	return length
+}
+
+// Encode returns the announcement encoded into a new buffer of exactly the
+// right length.
+func (a *SwitchAnnouncement) Encode() ([]byte, error) {
+	buffer := make([]byte, a.Length())
+	n, err := a.MarshalBinary(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
+
+// DecodeSwitchAnnouncement decodes an announcement from the payload of a
+// tree announcement frame and checks that it is well-formed, as Validate
+// does. The whole payload must be used by the announcement. Since the sender
+// of the frame isn't known here, callers that do know it should also check
+// that the last signature is from the sender, or use SanityCheck instead.
+func DecodeSwitchAnnouncement(data []byte) (*SwitchAnnouncement, error) {
+	a := &SwitchAnnouncement{}
+	n, err := a.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, fmt.Errorf("%w: %d bytes after the last signature", ErrAnnouncementTrailingData, len(data)-n)
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Verify checks every signature in the announcement. Unlike UnmarshalBinary,
+// it always checks the signatures, even if PINECONE_DISABLE_SIGNATURES is set.
+func (a *SwitchAnnouncement) Verify() error {
+	data, err := a.Encode()
+	if err != nil {
+		return fmt.Errorf("a.Encode: %w", err)
+	}
+	offset := a.Root.Length()
+	for index, sig := range a.Signatures {
+		if !ed25519.Verify(sig.PublicKey[:], data[:offset], sig.Signature[:]) {
+			return fmt.Errorf("%w for hop %d (signature %d)", ErrAnnouncementSignature, sig.Hop, index)
+		}
+		offset += sig.Hop.Length() + ed25519.PublicKeySize + ed25519.SignatureSize
+	}
+	return nil
+}
+
+// Validate checks that the announcement is well-formed: it must have at
+// least one signature, the first signature must be from the root, no hop can
+// be 0 and no key can sign more than once.
+func (a *SwitchAnnouncement) Validate() error {
 	if len(a.Signatures) == 0 {
-		return fmt.Errorf("update has no signatures")
+		return ErrAnnouncementNoSignatures
 	}
-	sigs := make(map[PublicKey]struct{}, len(a.Signatures))
+	sigs := make(map[PublicKey]int, len(a.Signatures))
 	for index, sig := range a.Signatures {
 		if index == 0 && sig.PublicKey != a.RootPublicKey {
-			return fmt.Errorf("update first signature doesn't match root key")
+			return fmt.Errorf("%w (root %s, signed by %s)", ErrAnnouncementRootMismatch, a.RootPublicKey, sig.PublicKey)
 		}
 		if sig.Hop == 0 {
-			return fmt.Errorf("update contains invalid 0 hop")
-		}
-		if index == len(a.Signatures)-1 && from != sig.PublicKey {
-			return fmt.Errorf("update last signature is not from direct peer")
+			return fmt.Errorf("%w (signature %d)", ErrAnnouncementZeroHop, index)
 		}
-		if _, ok := sigs[sig.PublicKey]; ok {
-			return fmt.Errorf("update contains routing loop")
+		if previous, ok := sigs[sig.PublicKey]; ok {
+			return fmt.Errorf("%w (%s signed at %d and %d)", ErrAnnouncementLoop, sig.PublicKey, previous, index)
 		}
-		sigs[sig.PublicKey] = struct{}{}
+		sigs[sig.PublicKey] = index
+	}
+	return nil
+}
+
+// SanityCheck validates the announcement and also checks that the last
+// signature is from the peer that sent it to us.
+func (a *SwitchAnnouncement) SanityCheck(from PublicKey) error {
+	if err := a.Validate(); err != nil {
+		return err
+	}
+	if last := a.Signatures[len(a.Signatures)-1].PublicKey; last != from {
+		return fmt.Errorf("%w (signed by %s, received from %s)", ErrAnnouncementNotFromPeer, last, from)
 	}
 	return nil
 }
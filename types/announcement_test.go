@@ -17,6 +17,7 @@ package types
 import (
 	"bytes"
 	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -78,3 +79,77 @@ func TestMarshalUnmarshalAnnouncement(t *testing.T) {
 		t.Fatalf("third public key doesn't match")
 	}
 }
+
+func TestDecodeAndVerifyAnnouncement(t *testing.T) {
+	pkr, skr, _ := ed25519.GenerateKey(nil)
+	pk1, sk1, _ := ed25519.GenerateKey(nil)
+	input := &SwitchAnnouncement{
+		Root: Root{
+			RootSequence: 1,
+		},
+	}
+	copy(input.RootPublicKey[:], pkr)
+	if err := input.Sign(skr, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Sign(sk1, 2); err != nil {
+		t.Fatal(err)
+	}
+	data, err := input.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != input.Length() {
+		t.Fatalf("expected %d bytes but got %d", input.Length(), len(data))
+	}
+
+	output, err := DecodeSwitchAnnouncement(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	var from PublicKey
+	copy(from[:], pk1)
+	if err := output.SanityCheck(from); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.SanityCheck(output.RootPublicKey); !errors.Is(err, ErrAnnouncementNotFromPeer) {
+		t.Fatalf("expected ErrAnnouncementNotFromPeer but got %v", err)
+	}
+
+	if _, err := DecodeSwitchAnnouncement(data[:8]); !errors.Is(err, ErrAnnouncementTooShort) {
+		t.Fatalf("expected ErrAnnouncementTooShort but got %v", err)
+	}
+	if _, err := DecodeSwitchAnnouncement(append(data[:len(data):len(data)], 0)); !errors.Is(err, ErrAnnouncementTrailingData) {
+		t.Fatalf("expected ErrAnnouncementTrailingData but got %v", err)
+	}
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := DecodeSwitchAnnouncement(tampered); !errors.Is(err, ErrAnnouncementSignature) {
+		t.Fatalf("expected ErrAnnouncementSignature but got %v", err)
+	}
+
+	output.Signatures[1].Signature[0] ^= 0xff
+	if err := output.Verify(); !errors.Is(err, ErrAnnouncementSignature) {
+		t.Fatalf("expected ErrAnnouncementSignature but got %v", err)
+	}
+	output.Signatures[1].Hop = 0
+	if err := output.Validate(); !errors.Is(err, ErrAnnouncementZeroHop) {
+		t.Fatalf("expected ErrAnnouncementZeroHop but got %v", err)
+	}
+	output.Signatures[1] = output.Signatures[0]
+	if err := output.Validate(); !errors.Is(err, ErrAnnouncementLoop) {
+		t.Fatalf("expected ErrAnnouncementLoop but got %v", err)
+	}
+	output.Signatures = output.Signatures[1:]
+	output.RootPublicKey = from
+	if err := output.Validate(); !errors.Is(err, ErrAnnouncementRootMismatch) {
+		t.Fatalf("expected ErrAnnouncementRootMismatch but got %v", err)
+	}
+	output.Signatures = nil
+	if err := output.Validate(); !errors.Is(err, ErrAnnouncementNoSignatures) {
+		t.Fatalf("expected ErrAnnouncementNoSignatures but got %v", err)
+	}
+}
@@ -109,11 +109,66 @@ func (a *Coordinates) Copy() Coordinates {
 	return append(Coordinates{}, *a...)
 }
 
+// DistanceTo returns the number of hops across the tree between a and b,
+// which is the tree metric used for greedy routing: the hops from a up to
+// the nearest common ancestor, plus the hops from there down to b.
 func (a Coordinates) DistanceTo(b Coordinates) int {
 	ancestor := getCommonPrefix(a, b)
 	return len(a) + len(b) - 2*ancestor
 }
 
+// CommonPrefix returns the coordinates of the nearest common ancestor of a
+// and b in the tree, which is the root if they have nothing in common.
+func (a Coordinates) CommonPrefix(b Coordinates) Coordinates {
+	return append(Coordinates{}, a[:getCommonPrefix(a, b)]...)
+}
+
+// IsAncestorOf returns true if a is above b in the tree, that is, if a is a
+// strict prefix of b.
+func (a Coordinates) IsAncestorOf(b Coordinates) bool {
+	return len(a) < len(b) && getCommonPrefix(a, b) == len(a)
+}
+
+// IsDescendantOf returns true if a is below b in the tree.
+func (a Coordinates) IsDescendantOf(b Coordinates) bool {
+	return b.IsAncestorOf(a)
+}
+
+// CompareTo returns -1 if a sorts before b, 1 if a sorts after b or 0 if
+// they are equal. Coordinates are compared port by port, with ancestors
+// sorting before their descendants, so sorting a set of coordinates gives a
+// depth-first walk of the tree.
+func (a Coordinates) CompareTo(b Coordinates) int {
+	prefix := getCommonPrefix(a, b)
+	switch {
+	case prefix < len(a) && prefix < len(b):
+		if a[prefix] < b[prefix] {
+			return -1
+		}
+		return 1
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// CompareDistance returns -1 if a is closer to the destination than b, 1 if
+// b is closer or 0 if they are the same distance away, using DistanceTo.
+func (dest Coordinates) CompareDistance(a, b Coordinates) int {
+	da, db := a.DistanceTo(dest), b.DistanceTo(dest)
+	switch {
+	case da < db:
+		return -1
+	case da > db:
+		return 1
+	default:
+		return 0
+	}
+}
+
 func getCommonPrefix(a, b Coordinates) int {
 	c := 0
 	l := len(a)
@@ -66,3 +66,85 @@ func TestSwitchPortDistances(t *testing.T) {
 		t.Fatalf("distance from root to other should be 7, got %d", dist)
 	}
 }
+
+func TestSwitchPortCommonPrefix(t *testing.T) {
+	cases := []struct {
+		a, b     Coordinates
+		expected Coordinates
+	}{
+		{Coordinates{}, Coordinates{1, 2}, Coordinates{}},
+		{Coordinates{1, 2, 3}, Coordinates{1, 2, 3, 4}, Coordinates{1, 2, 3}},
+		{Coordinates{1, 2, 3, 4}, Coordinates{1, 3, 3, 4}, Coordinates{1}},
+		{Coordinates{2}, Coordinates{1}, Coordinates{}},
+		{Coordinates{1, 2}, Coordinates{1, 2}, Coordinates{1, 2}},
+	}
+	for _, tc := range cases {
+		if prefix := tc.a.CommonPrefix(tc.b); !prefix.EqualTo(tc.expected) {
+			t.Fatalf("common prefix of %v and %v should be %v, got %v", tc.a, tc.b, tc.expected, prefix)
+		}
+		if prefix := tc.b.CommonPrefix(tc.a); !prefix.EqualTo(tc.expected) {
+			t.Fatalf("common prefix of %v and %v should be %v, got %v", tc.b, tc.a, tc.expected, prefix)
+		}
+	}
+
+	// The prefix must not share memory with the coordinates it came from.
+	a := Coordinates{1, 2, 3}
+	prefix := a.CommonPrefix(Coordinates{1, 2})
+	prefix[0] = 9
+	if a[0] != 1 {
+		t.Fatalf("modifying the common prefix modified the original coordinates")
+	}
+}
+
+func TestSwitchPortAncestry(t *testing.T) {
+	root := Coordinates{}
+	parent := Coordinates{1, 2, 3}
+	us := Coordinates{1, 2, 3, 4}
+	other := Coordinates{1, 3}
+	if !root.IsAncestorOf(us) || !parent.IsAncestorOf(us) {
+		t.Fatalf("root and parent should be ancestors of us")
+	}
+	if !us.IsDescendantOf(parent) || !us.IsDescendantOf(root) {
+		t.Fatalf("us should be a descendant of root and parent")
+	}
+	if us.IsAncestorOf(parent) || us.IsAncestorOf(us) || other.IsAncestorOf(us) {
+		t.Fatalf("us should not be an ancestor of parent, itself or other")
+	}
+	if parent.IsDescendantOf(us) || us.IsDescendantOf(us) || us.IsDescendantOf(other) {
+		t.Fatalf("us should not be a descendant of itself or other, nor parent of us")
+	}
+}
+
+func TestSwitchPortCompare(t *testing.T) {
+	cases := []struct {
+		a, b     Coordinates
+		expected int
+	}{
+		{Coordinates{}, Coordinates{}, 0},
+		{Coordinates{}, Coordinates{1}, -1},
+		{Coordinates{1, 2}, Coordinates{1}, 1},
+		{Coordinates{1, 2}, Coordinates{1, 3}, -1},
+		{Coordinates{1, 3}, Coordinates{1, 2, 4}, 1},
+		{Coordinates{2}, Coordinates{1, 9, 9}, 1},
+		{Coordinates{1, 2, 3}, Coordinates{1, 2, 3}, 0},
+	}
+	for _, tc := range cases {
+		if c := tc.a.CompareTo(tc.b); c != tc.expected {
+			t.Fatalf("comparing %v to %v should give %d, got %d", tc.a, tc.b, tc.expected, c)
+		}
+		if c := tc.b.CompareTo(tc.a); c != -tc.expected {
+			t.Fatalf("comparing %v to %v should give %d, got %d", tc.b, tc.a, -tc.expected, c)
+		}
+	}
+
+	dest := Coordinates{1, 2, 3}
+	if c := dest.CompareDistance(Coordinates{1, 2}, Coordinates{1}); c != -1 {
+		t.Fatalf("expected [1 2] to be closer to %v than [1], got %d", dest, c)
+	}
+	if c := dest.CompareDistance(Coordinates{1, 3}, Coordinates{1, 2, 3, 4, 5, 6}); c != 0 {
+		t.Fatalf("expected [1 3] and [1 2 3 4 5 6] to be as close to %v, got %d", dest, c)
+	}
+	if c := dest.CompareDistance(Coordinates{}, dest); c != 1 {
+		t.Fatalf("expected %v to be closer to itself than the root, got %d", dest, c)
+	}
+}
@@ -15,9 +15,10 @@
 package types
 
 import (
-	"bytes"
 	"crypto/ed25519"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 )
 
@@ -40,9 +41,19 @@ var FullMask = PublicKey{
 	0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
 }
 
+// IsEmpty returns true if the key is all zeroes. It is equivalent to IsZero.
 func (a PublicKey) IsEmpty() bool {
-	empty := PublicKey{}
-	return a == empty
+	return a.IsZero()
+}
+
+// IsZero returns true if the key is all zeroes. It runs in constant time and
+// does not allocate.
+func (a PublicKey) IsZero() bool {
+	var v byte
+	for i := range a {
+		v |= a[i]
+	}
+	return v == 0
 }
 
 func (a PublicKey) EqualMaskTo(b, m PublicKey) bool {
@@ -54,8 +65,38 @@ func (a PublicKey) EqualMaskTo(b, m PublicKey) bool {
 	return true
 }
 
+// CompareTo returns -1 if a is lower than b in keyspace, 1 if a is higher than
+// b or 0 if they are equal. It runs in constant time and does not allocate.
 func (a PublicKey) CompareTo(b PublicKey) int {
-	return bytes.Compare(a[:], b[:])
+	// Work upwards from the least significant byte, so that the most
+	// significant byte that differs decides the result, without branching
+	// on the contents of either key.
+	var result int
+	for i := len(a) - 1; i >= 0; i-- {
+		d := int(a[i]) - int(b[i])
+		sign := (-d>>31)&1 - (d>>31)&1
+		result = subtle.ConstantTimeByteEq(a[i], b[i])*result + sign
+	}
+	return result
+}
+
+// DistanceTo returns the distance from a to b when travelling upwards through
+// keyspace, wrapping around from the highest key to the lowest, in the same
+// sense as DHTWrappedOrdered. The result is a 256-bit big-endian value, so two
+// distances can be compared using CompareTo. It does not allocate.
+func (a PublicKey) DistanceTo(b PublicKey) PublicKey {
+	var d PublicKey
+	var borrow int
+	for i := len(a) - 1; i >= 0; i-- {
+		v := int(b[i]) - int(a[i]) - borrow
+		borrow = 0
+		if v < 0 {
+			v += 256
+			borrow = 1
+		}
+		d[i] = byte(v)
+	}
+	return d
 }
 
 func (a PublicKey) String() string {
@@ -66,6 +107,34 @@ func (a PublicKey) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + a.String() + `"`), nil
 }
 
+// UnmarshalJSON decodes a key from a hex string, as written by MarshalJSON.
+func (a *PublicKey) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return a.UnmarshalText([]byte(s))
+}
+
+// MarshalText encodes the key as a hex string, which also allows keys to be
+// used as JSON object keys.
+func (a PublicKey) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText decodes a key from a hex string, as written by MarshalText.
+func (a *PublicKey) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	if len(b) != len(a) {
+		return fmt.Errorf("expected %d bytes but got %d", len(a), len(b))
+	}
+	copy(a[:], b)
+	return nil
+}
+
 func (a PublicKey) Network() string {
 	return "ed25519"
 }
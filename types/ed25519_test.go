@@ -1,6 +1,11 @@
 package types
 
-import "testing"
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+)
 
 func TestPartialKeyMatch(t *testing.T) {
 	a := PublicKey{1, 2, 3, 3, 3}
@@ -13,3 +18,129 @@ func TestPartialKeyMatch(t *testing.T) {
 		t.Fatalf("Should not have matched but did")
 	}
 }
+
+func TestPublicKeyIsZero(t *testing.T) {
+	if !(PublicKey{}).IsZero() {
+		t.Fatalf("Empty key should be zero")
+	}
+	if (PublicKey{31: 1}).IsZero() {
+		t.Fatalf("Non-empty key should not be zero")
+	}
+}
+
+func TestPublicKeyCompareTo(t *testing.T) {
+	tests := []struct {
+		a, b PublicKey
+		want int
+	}{
+		{PublicKey{}, PublicKey{}, 0},
+		{FullMask, FullMask, 0},
+		{PublicKey{31: 1}, PublicKey{31: 2}, -1},
+		{PublicKey{31: 0xFF}, PublicKey{31: 0}, 1},
+		// The most significant byte that differs decides the order.
+		{PublicKey{0: 1, 31: 0xFF}, PublicKey{0: 2}, -1},
+		{PublicKey{0: 0xFF}, PublicKey{0: 0xFE, 1: 0xFF}, 1},
+		{PublicKey{5: 0x80, 6: 1}, PublicKey{5: 0x80, 6: 0}, 1},
+	}
+	for i, tc := range tests {
+		if got := tc.a.CompareTo(tc.b); got != tc.want {
+			t.Fatalf("test %d: got %d, want %d", i, got, tc.want)
+		}
+		if got := tc.b.CompareTo(tc.a); got != -tc.want {
+			t.Fatalf("test %d reversed: got %d, want %d", i, got, -tc.want)
+		}
+	}
+	// Check against bytes.Compare for random keys.
+	for i := 0; i < 1000; i++ {
+		var a, b PublicKey
+		_, _ = rand.Read(a[:])
+		copy(b[:], a[:])
+		// Share a prefix of random length so that the keys are close.
+		_, _ = rand.Read(b[i%len(b):])
+		if got, want := a.CompareTo(b), bytes.Compare(a[:], b[:]); got != want {
+			t.Fatalf("%s vs %s: got %d, want %d", a, b, got, want)
+		}
+	}
+}
+
+func TestPublicKeyDistanceTo(t *testing.T) {
+	tests := []struct {
+		a, b, want PublicKey
+	}{
+		{PublicKey{31: 1}, PublicKey{31: 5}, PublicKey{31: 4}},
+		{PublicKey{31: 5}, PublicKey{31: 5}, PublicKey{}},
+		{PublicKey{31: 0xFF}, PublicKey{30: 1}, PublicKey{31: 1}},
+		// Going from a higher key to a lower one wraps around keyspace.
+		{PublicKey{31: 1}, PublicKey{}, FullMask},
+	}
+	for i, tc := range tests {
+		if got := tc.a.DistanceTo(tc.b); got != tc.want {
+			t.Fatalf("test %d: got %s, want %s", i, got, tc.want)
+		}
+	}
+}
+
+func TestPublicKeyJSON(t *testing.T) {
+	key := PublicKey{1, 2, 3, 31: 4}
+	data, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded PublicKey
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != key {
+		t.Fatalf("got %s, want %s", decoded, key)
+	}
+	if err := json.Unmarshal([]byte(`"0102"`), &decoded); err == nil {
+		t.Fatalf("expected a short key to be rejected")
+	}
+}
+
+func TestPublicKeyText(t *testing.T) {
+	key := PublicKey{1, 2, 3, 31: 4}
+	text, err := key.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(text) != key.String() {
+		t.Fatalf("got %q, want %q", text, key.String())
+	}
+	var decoded PublicKey
+	if err := decoded.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != key {
+		t.Fatalf("got %s, want %s", decoded, key)
+	}
+	for _, bad := range []string{"0102", "zz" + key.String()[2:]} {
+		if err := decoded.UnmarshalText([]byte(bad)); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func BenchmarkPublicKeyCompareTo(b *testing.B) {
+	x, y := PublicKey{1, 2, 3}, PublicKey{1, 2, 4}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = x.CompareTo(y)
+	}
+}
+
+func BenchmarkPublicKeyIsZero(b *testing.B) {
+	x := PublicKey{31: 1}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = x.IsZero()
+	}
+}
+
+func BenchmarkPublicKeyDistanceTo(b *testing.B) {
+	x, y := FullMask, PublicKey{1, 2, 3}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = x.DistanceTo(y)
+	}
+}
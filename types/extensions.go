@@ -0,0 +1,241 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// FrameFlagExtensions is set in the first extra byte of the frame header when
+// the frame carries an extension area. The extension area follows directly
+// after the frame header and starts with a 2 byte length, followed by any
+// number of TLV entries, each with a 1 byte type, a 1 byte length and then
+// the value itself. Nodes must forward extensions that they don't understand
+// unchanged.
+const FrameFlagExtensions byte = 1 << 7
+
+// MaxExtensionsSize is the maximum size of the extension area, not including
+// the 2 byte length.
+const MaxExtensionsSize = 1024
+
+type ExtensionType uint8
+
+const (
+	ExtensionTypeQoS          ExtensionType = iota + 1 // 1 byte traffic class, see QoSClass
+	ExtensionTypeTraceContext                          // 25 bytes, see TraceContext
+	ExtensionTypeMTUProbe                              // 4 bytes, see MTUProbe
+	ExtensionTypeSuspend                               // 0 bytes, only on keepalives, the sender is suspending the peering
+	ExtensionTypeService                               // 2 bytes, see ServiceID
+	ExtensionTypeMigrate                               // 0 bytes, only on keepalives, the sender has moved the peering to a new connection
+	ExtensionTypeReceipt                               // 8 bytes, a sequence number, the sender wants a Receipt for the frame
+)
+
+func (t ExtensionType) String() string {
+	switch t {
+	case ExtensionTypeQoS:
+		return "QoS"
+	case ExtensionTypeTraceContext:
+		return "TraceContext"
+	case ExtensionTypeMTUProbe:
+		return "MTUProbe"
+	case ExtensionTypeSuspend:
+		return "Suspend"
+	case ExtensionTypeService:
+		return "Service"
+	case ExtensionTypeMigrate:
+		return "Migrate"
+	case ExtensionTypeReceipt:
+		return "Receipt"
+	default:
+		return fmt.Sprintf("Unknown(%d)", uint8(t))
+	}
+}
+
+// Extension returns the value of the first extension of the given type that
+// the frame carries, if any. The returned slice refers to the frame's own
+// buffer and is only valid until the frame is modified or reset.
+func (f *Frame) Extension(t ExtensionType) ([]byte, bool) {
+	for offset := 0; offset+2 <= len(f.Extensions); {
+		l := int(f.Extensions[offset+1])
+		if ExtensionType(f.Extensions[offset]) == t {
+			return f.Extensions[offset+2 : offset+2+l], true
+		}
+		offset += 2 + l
+	}
+	return nil, false
+}
+
+// SetExtension adds an extension to the frame, replacing any existing
+// extensions of the same type.
+func (f *Frame) SetExtension(t ExtensionType, value []byte) error {
+	if len(value) > 255 {
+		return fmt.Errorf("extension value too long")
+	}
+	f.RemoveExtension(t)
+	if len(f.Extensions)+2+len(value) > MaxExtensionsSize {
+		return fmt.Errorf("extension area too large")
+	}
+	f.Extensions = append(f.Extensions, byte(t), byte(len(value)))
+	f.Extensions = append(f.Extensions, value...)
+	return nil
+}
+
+// RemoveExtension removes all extensions of the given type from the frame.
+func (f *Frame) RemoveExtension(t ExtensionType) {
+	kept := f.Extensions[:0]
+	for offset := 0; offset+2 <= len(f.Extensions); {
+		end := offset + 2 + int(f.Extensions[offset+1])
+		if ExtensionType(f.Extensions[offset]) != t {
+			kept = append(kept, f.Extensions[offset:end]...)
+		}
+		offset = end
+	}
+	f.Extensions = kept
+}
+
+// marshalExtensions writes the extension area into the buffer, returning
+// the number of bytes written.
+func (f *Frame) marshalExtensions(buffer []byte) (int, error) {
+	if len(f.Extensions) > MaxExtensionsSize {
+		return 0, fmt.Errorf("extension area too large")
+	}
+	if len(buffer) < 2+len(f.Extensions) {
+		return 0, fmt.Errorf("buffer too small for extensions")
+	}
+	binary.BigEndian.PutUint16(buffer[:2], uint16(len(f.Extensions)))
+	return 2 + copy(buffer[2:], f.Extensions), nil
+}
+
+// unmarshalExtensions reads the extension area from the data, checking that
+// every entry is well-formed, and returns the number of bytes read.
+func (f *Frame) unmarshalExtensions(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, fmt.Errorf("frame is not long enough to include extensions")
+	}
+	l := int(binary.BigEndian.Uint16(data[:2]))
+	if l > MaxExtensionsSize {
+		return 0, fmt.Errorf("extension area too large")
+	}
+	if len(data) < 2+l {
+		return 0, fmt.Errorf("frame is not long enough to include extensions")
+	}
+	area := data[2 : 2+l]
+	for offset := 0; offset < len(area); {
+		if offset+2 > len(area) {
+			return 0, fmt.Errorf("extension header truncated")
+		}
+		offset += 2 + int(area[offset+1])
+		if offset > len(area) {
+			return 0, fmt.Errorf("extension value truncated")
+		}
+	}
+	f.Extensions = append(f.Extensions[:0], area...)
+	return 2 + l, nil
+}
+
+// QoSClass is the value of an ExtensionTypeQoS extension, which hints at
+// how the traffic in the frame should be treated under congestion.
+type QoSClass uint8
+
+const (
+	QoSBestEffort  QoSClass = iota // the default when no extension is present
+	QoSBulk                        // throughput matters more than latency
+	QoSInteractive                 // latency matters more than throughput
+	QoSRealtime                    // late frames are worthless, e.g. voice or video
+)
+
+// TraceContext is the value of an ExtensionTypeTraceContext extension, and
+// carries a distributed tracing context in the same form as the W3C
+// traceparent header.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   uint8
+}
+
+const TraceContextSize = 16 + 8 + 1
+
+func (c *TraceContext) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < TraceContextSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buf, c.TraceID[:])
+	offset += copy(buf[offset:], c.SpanID[:])
+	buf[offset] = c.Flags
+	return offset + 1, nil
+}
+
+func (c *TraceContext) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < TraceContextSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(c.TraceID[:], buf)
+	offset += copy(c.SpanID[:], buf[offset:])
+	c.Flags = buf[offset]
+	return offset + 1, nil
+}
+
+// ServiceID is the value of an ExtensionTypeService extension, which says
+// which of the local applications on the destination node a traffic frame is
+// for. Frames without the extension are for service 0, which is the default.
+type ServiceID uint16
+
+const ServiceIDSize = 2
+
+func (s ServiceID) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ServiceIDSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	binary.BigEndian.PutUint16(buf, uint16(s))
+	return ServiceIDSize, nil
+}
+
+func (s *ServiceID) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ServiceIDSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	*s = ServiceID(binary.BigEndian.Uint16(buf))
+	return ServiceIDSize, nil
+}
+
+// MTUProbe is the value of an ExtensionTypeMTUProbe extension. The sender
+// pads the payload so that the marshalled frame is exactly Size bytes long,
+// and the receiver can then answer with the same ID to show that a frame of
+// that size made it across the path.
+type MTUProbe struct {
+	ID   uint16
+	Size uint16
+}
+
+const MTUProbeSize = 4
+
+func (p *MTUProbe) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < MTUProbeSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	binary.BigEndian.PutUint16(buf[0:2], p.ID)
+	binary.BigEndian.PutUint16(buf[2:4], p.Size)
+	return MTUProbeSize, nil
+}
+
+func (p *MTUProbe) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < MTUProbeSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	p.ID = binary.BigEndian.Uint16(buf[0:2])
+	p.Size = binary.BigEndian.Uint16(buf[2:4])
+	return MTUProbeSize, nil
+}
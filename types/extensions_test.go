@@ -0,0 +1,138 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarshalUnmarshalFrameExtensions(t *testing.T) {
+	trace := TraceContext{
+		TraceID: [16]byte{1, 2, 3, 4},
+		SpanID:  [8]byte{5, 6, 7, 8},
+		Flags:   1,
+	}
+	var tracebuf [TraceContextSize]byte
+	if _, err := trace.MarshalBinary(tracebuf[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frameType := range []FrameType{TypeTreeRouted, TypeVirtualSnakeRouted, TypeVirtualSnakeBootstrap} {
+		input := Frame{
+			Version:        Version0,
+			Type:           frameType,
+			Extra:          [2]byte{FrameFlagKeyspaceQuery},
+			Destination:    Coordinates{1, 2, 3},
+			DestinationKey: PublicKey{1},
+			Source:         Coordinates{4, 5},
+			SourceKey:      PublicKey{2},
+			Payload:        []byte("ABCDEFG"),
+		}
+		if err := input.SetExtension(ExtensionTypeQoS, []byte{byte(QoSInteractive)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := input.SetExtension(ExtensionTypeTraceContext, tracebuf[:]); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, 65535)
+		n, err := input.MarshalBinary(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf[6]&FrameFlagExtensions == 0 {
+			t.Fatalf("%s: extensions flag not set", frameType)
+		}
+		output := Frame{
+			Payload: make([]byte, 0, MaxPayloadSize),
+		}
+		if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatalf("%s: %s", frameType, err)
+		}
+		if output.Extra != input.Extra {
+			t.Fatalf("%s: wrong extra bytes, got %v, expected %v", frameType, output.Extra, input.Extra)
+		}
+		if !bytes.Equal(output.Payload, input.Payload) {
+			t.Fatalf("%s: wrong payload, got %v, expected %v", frameType, output.Payload, input.Payload)
+		}
+		qos, ok := output.Extension(ExtensionTypeQoS)
+		if !ok || !bytes.Equal(qos, []byte{byte(QoSInteractive)}) {
+			t.Fatalf("%s: wrong QoS extension, got %v", frameType, qos)
+		}
+		value, ok := output.Extension(ExtensionTypeTraceContext)
+		if !ok {
+			t.Fatalf("%s: trace context extension missing", frameType)
+		}
+		var got TraceContext
+		if _, err := got.UnmarshalBinary(value); err != nil {
+			t.Fatal(err)
+		}
+		if got != trace {
+			t.Fatalf("%s: wrong trace context, got %+v, expected %+v", frameType, got, trace)
+		}
+		if _, ok := output.Extension(ExtensionTypeMTUProbe); ok {
+			t.Fatalf("%s: unexpected MTU probe extension", frameType)
+		}
+	}
+}
+
+func TestFrameExtensionsReplaceAndRemove(t *testing.T) {
+	var f Frame
+	if err := f.SetExtension(ExtensionTypeQoS, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetExtension(ExtensionTypeMTUProbe, []byte{0, 1, 5, 220}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.SetExtension(ExtensionTypeQoS, []byte{2}); err != nil {
+		t.Fatal(err)
+	}
+	if qos, _ := f.Extension(ExtensionTypeQoS); !bytes.Equal(qos, []byte{2}) {
+		t.Fatalf("expected QoS extension to be replaced, got %v", qos)
+	}
+	value, ok := f.Extension(ExtensionTypeMTUProbe)
+	if !ok {
+		t.Fatal("MTU probe extension missing")
+	}
+	var probe MTUProbe
+	if _, err := probe.UnmarshalBinary(value); err != nil {
+		t.Fatal(err)
+	}
+	if probe.ID != 1 || probe.Size != 1500 {
+		t.Fatalf("wrong MTU probe, got %+v", probe)
+	}
+	f.RemoveExtension(ExtensionTypeQoS)
+	f.RemoveExtension(ExtensionTypeMTUProbe)
+	if len(f.Extensions) != 0 {
+		t.Fatalf("expected no extensions, got %v", f.Extensions)
+	}
+}
+
+func TestUnmarshalFrameMalformedExtensions(t *testing.T) {
+	data := []byte{
+		0x70, 0x69, 0x6e, 0x65, // magic bytes
+		0,                      // version 0
+		byte(TypeKeepalive),    // type
+		FrameFlagExtensions, 0, // extra
+		0, 15, // frame length
+		0, 3, // extension area length
+		byte(ExtensionTypeQoS), 2, 1, // value is shorter than its length
+	}
+	var f Frame
+	if _, err := f.UnmarshalBinary(data); err == nil {
+		t.Fatal("expected malformed extensions to fail")
+	}
+}
@@ -15,8 +15,6 @@
 package types
 
 import (
-	"bytes"
-	"crypto/ed25519"
 	"encoding/binary"
 	"fmt"
 	"math"
@@ -39,10 +37,33 @@ const (
 	TypeTreeRouted                             // traffic frame, forwarded using tree routing
 	TypeVirtualSnakeBootstrap                  // protocol frame, forwarded using SNEK
 	TypeVirtualSnakeRouted                     // traffic frame, forwarded using SNEK
+	TypePeerExchange                           // protocol frame, direct to peers only
 )
 
+// Frame versions differ only in how the frame body is encoded, so that the
+// router can translate between them at the boundary of each link. Version1
+// encodes the payload length as a Varu64 instead of a fixed two bytes, which
+// saves a byte on most small frames. The header is the same for all versions.
 const (
 	Version0 FrameVersion = iota
+	Version1
+)
+
+// LatestFrameVersion is the newest frame version that this node can encode
+// and decode.
+const LatestFrameVersion = Version1
+
+// Flags that can be set in the first extra byte of the frame header. Nodes
+// that don't understand a flag will forward the frame unchanged, so they are
+// safe to use on frames that are routed normally. The top bit is reserved for
+// FrameFlagExtensions.
+const (
+	FrameFlagKeyspaceQuery    byte = 1 << iota // SNEK-routed frame carries a KeyspaceQuery
+	FrameFlagKeyspaceResponse                  // SNEK-routed frame carries a KeyspaceResponse
+	FrameFlagTopic                             // SNEK-routed frame carries a TopicMessage
+	FrameFlagMetadataQuery                     // SNEK-routed frame carries a MetadataQuery
+	FrameFlagMetadataResponse                  // SNEK-routed frame carries a MetadataResponse
+	FrameFlagReceipt                           // SNEK-routed frame carries a Receipt
 )
 
 var FrameMagicBytes = []byte{0x70, 0x69, 0x6e, 0x65}
@@ -59,6 +80,7 @@ type Frame struct {
 	Source         Coordinates
 	SourceKey      PublicKey
 	Watermark      VirtualSnakeWatermark
+	Extensions     []byte // TLV extension area, see FrameFlagExtensions
 	Payload        []byte
 }
 
@@ -72,153 +94,120 @@ func (f *Frame) Reset() {
 	f.Source = Coordinates{}
 	f.SourceKey = PublicKey{}
 	f.Watermark = VirtualSnakeWatermark{}
+	f.Extensions = f.Extensions[:0]
 	f.Payload = f.Payload[:0]
 }
 
+// MarshalBinary writes the frame into the buffer, returning the number of
+// bytes written. The body of the frame is laid out as described by the frame
+// type's layout in framelayout.go.
 func (f *Frame) MarshalBinary(buffer []byte) (int, error) {
+	if size := f.Size(); len(buffer) < size {
+		return 0, fmt.Errorf("buffer too small for frame of %d bytes", size)
+	}
 	copy(buffer[:4], FrameMagicBytes)
 	buffer[4], buffer[5] = byte(f.Version), byte(f.Type)
 	copy(buffer[6:], f.Extra[:])
 	offset := FrameHeaderLength
-	switch f.Type {
-	case TypeVirtualSnakeBootstrap: // destination = key, source = coords
-		payloadLen := len(f.Payload)
-		binary.BigEndian.PutUint16(buffer[offset+0:offset+2], uint16(payloadLen))
-		offset += 2
-		offset += copy(buffer[offset:], f.DestinationKey[:ed25519.PublicKeySize])
-		offset += copy(buffer[offset:], f.Watermark.PublicKey[:ed25519.PublicKeySize])
-		n, err := f.Watermark.Sequence.MarshalBinary(buffer[offset:])
-		if err != nil {
-			return 0, fmt.Errorf("f.WatermarkSeq.MarshalBinary: %w", err)
-		}
-		offset += n
-		if f.Payload != nil {
-			f.Payload = f.Payload[:payloadLen]
-			offset += copy(buffer[offset:], f.Payload[:payloadLen])
-		}
-
-	case TypeVirtualSnakeRouted: // destination = key, source = key
-		payloadLen := len(f.Payload)
-		binary.BigEndian.PutUint16(buffer[offset+0:offset+2], uint16(payloadLen))
-		offset += 2
-		offset += copy(buffer[offset:], f.DestinationKey[:ed25519.PublicKeySize])
-		offset += copy(buffer[offset:], f.SourceKey[:ed25519.PublicKeySize])
-		offset += copy(buffer[offset:], f.Watermark.PublicKey[:ed25519.PublicKeySize])
-		n, err := f.Watermark.Sequence.MarshalBinary(buffer[offset:])
+	if len(f.Extensions) > 0 {
+		buffer[6] |= FrameFlagExtensions
+		n, err := f.marshalExtensions(buffer[offset:])
 		if err != nil {
-			return 0, fmt.Errorf("f.WatermarkSeq.MarshalBinary: %w", err)
+			return 0, fmt.Errorf("f.marshalExtensions: %w", err)
 		}
 		offset += n
-		if f.Payload != nil {
-			f.Payload = f.Payload[:payloadLen]
-			offset += copy(buffer[offset:], f.Payload[:payloadLen])
-		}
-
-	case TypeKeepalive:
-
-	default: // destination = coords, source = coords
-		payloadLen := len(f.Payload)
-		binary.BigEndian.PutUint16(buffer[offset+0:offset+2], uint16(payloadLen))
-		dn, err := f.Destination.MarshalBinary(buffer[offset+2:])
-		if err != nil {
-			return 0, fmt.Errorf("f.Destination.MarshalBinary: %w", err)
-		}
-		sn, err := f.Source.MarshalBinary(buffer[offset+2+dn:])
-		if err != nil {
-			return 0, fmt.Errorf("f.Source.MarshalBinary: %w", err)
-		}
-		if dn > math.MaxUint16 || sn > math.MaxUint16 || payloadLen > math.MaxUint16 {
-			return 0, fmt.Errorf("frame contents too large")
-		}
-		offset += 2 + dn + sn
-		if f.Payload != nil {
-			f.Payload = f.Payload[:payloadLen]
-			offset += copy(buffer[offset:], f.Payload[:payloadLen])
-		}
+	} else {
+		buffer[6] &^= FrameFlagExtensions
 	}
-
+	n, err := f.marshalFields(buffer[offset:])
+	if err != nil {
+		return 0, err
+	}
+	offset += n
 	binary.BigEndian.PutUint16(buffer[FrameHeaderLength-2:FrameHeaderLength], uint16(offset))
 	return offset, nil
 }
 
+// UnmarshalBinary reads a whole frame from the data, which must be exactly
+// as long as the frame length in the header says, and returns the number of
+// bytes read.
 func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 	f.Reset()
-	if len(data) < FrameHeaderLength {
-		return 0, fmt.Errorf("frame is not long enough to include metadata")
+	typ, framelen, err := PeekFrameHeader(data)
+	if err != nil {
+		return 0, err
 	}
-	if !bytes.Equal(data[:4], FrameMagicBytes) {
-		return 0, fmt.Errorf("frame doesn't contain magic bytes")
+	f.Version, f.Type = FrameVersion(data[4]), typ
+	if f.Version > LatestFrameVersion {
+		return 0, fmt.Errorf("unsupported frame version %d", f.Version)
 	}
-	f.Version, f.Type = FrameVersion(data[4]), FrameType(data[5])
-	f.Extra[0], f.Extra[1] = data[6], data[7]
 	copy(f.Extra[:], data[6:])
-	framelen := int(binary.BigEndian.Uint16(data[FrameHeaderLength-2 : FrameHeaderLength]))
 	if len(data) != framelen {
 		return 0, fmt.Errorf("frame length incorrect")
 	}
 	offset := FrameHeaderLength
-	switch f.Type {
-	case TypeVirtualSnakeBootstrap: // destination = key, source = coords
-		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
-		if payloadLen > cap(f.Payload) {
-			return 0, fmt.Errorf("payload length exceeds frame capacity")
-		}
-		offset += 2
-		offset += copy(f.DestinationKey[:], data[offset:])
-		offset += copy(f.Watermark.PublicKey[:], data[offset:])
-		n, err := f.Watermark.Sequence.UnmarshalBinary(data[offset:])
-		if err != nil {
-			return 0, fmt.Errorf("f.WatermarkSeq.UnmarshalBinary: %w", err)
-		}
-		offset += n
-		f.Payload = f.Payload[:payloadLen]
-		offset += copy(f.Payload[:payloadLen], data[offset:])
-		return offset, nil
-
-	case TypeVirtualSnakeRouted: // destination = key, source = key
-		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
-		if payloadLen > cap(f.Payload) {
-			return 0, fmt.Errorf("payload length exceeds frame capacity")
-		}
-		offset += 2
-		offset += copy(f.DestinationKey[:], data[offset:])
-		offset += copy(f.SourceKey[:], data[offset:])
-		offset += copy(f.Watermark.PublicKey[:], data[offset:])
-		n, err := f.Watermark.Sequence.UnmarshalBinary(data[offset:])
+	if f.Extra[0]&FrameFlagExtensions != 0 {
+		f.Extra[0] &^= FrameFlagExtensions
+		n, err := f.unmarshalExtensions(data[offset:])
 		if err != nil {
-			return 0, fmt.Errorf("f.WatermarkSeq.UnmarshalBinary: %w", err)
+			return 0, fmt.Errorf("f.unmarshalExtensions: %w", err)
 		}
 		offset += n
-		f.Payload = f.Payload[:payloadLen]
-		offset += copy(f.Payload[:payloadLen], data[offset:])
-		return offset, nil
-
-	case TypeKeepalive:
-		return offset, nil
+	}
+	n, err := f.unmarshalFields(data[offset:])
+	if err != nil {
+		return 0, err
+	}
+	return offset + n, nil
+}
 
-	default: // destination = coords, source = coords
-		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
-		if payloadLen > cap(f.Payload) {
-			return 0, fmt.Errorf("payload length exceeds frame capacity")
+// marshalPayloadLength writes the payload length in the encoding used by the
+// frame version, returning how many bytes were written.
+func (f *Frame) marshalPayloadLength(buffer []byte, length int) (int, error) {
+	if length > math.MaxUint16 {
+		return 0, fmt.Errorf("payload too large")
+	}
+	if f.Version == Version0 {
+		if len(buffer) < 2 {
+			return 0, fmt.Errorf("buffer too small")
 		}
-		offset += 2
-		dstLen, dstErr := f.Destination.UnmarshalBinary(data[offset:])
-		if dstErr != nil {
-			return 0, fmt.Errorf("f.Destination.UnmarshalBinary: %w", dstErr)
+		binary.BigEndian.PutUint16(buffer[:2], uint16(length))
+		return 2, nil
+	}
+	n, err := Varu64(length).MarshalBinary(buffer)
+	if err != nil {
+		return 0, fmt.Errorf("Varu64.MarshalBinary: %w", err)
+	}
+	return n, nil
+}
+
+// unmarshalPayloadLength reads the payload length in the encoding used by
+// the frame version, returning the length and how many bytes were read.
+func (f *Frame) unmarshalPayloadLength(data []byte) (int, int, error) {
+	var length, n int
+	if f.Version == Version0 {
+		if len(data) < 2 {
+			return 0, 0, fmt.Errorf("frame is not long enough to include payload length")
+		}
+		length, n = int(binary.BigEndian.Uint16(data[:2])), 2
+	} else {
+		var v Varu64
+		vn, err := v.UnmarshalBinary(data)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Varu64.UnmarshalBinary: %w", err)
 		}
-		offset += dstLen
-		srcLen, srcErr := f.Source.UnmarshalBinary(data[offset:])
-		if srcErr != nil {
-			return 0, fmt.Errorf("f.Source.UnmarshalBinary: %w", srcErr)
+		if vn == 0 {
+			return 0, 0, fmt.Errorf("frame is not long enough to include payload length")
 		}
-		offset += srcLen
-		if size := offset + payloadLen; len(data) != int(size) {
-			return 0, fmt.Errorf("frame expecting %d total bytes, got %d bytes", size, len(data))
+		if v > math.MaxUint16 {
+			return 0, 0, fmt.Errorf("payload length exceeds maximum payload size")
 		}
-		f.Payload = f.Payload[:payloadLen]
-		offset += copy(f.Payload, data[offset:])
-		return offset + payloadLen, nil
+		length, n = int(v), vn
+	}
+	if length > cap(f.Payload) {
+		return 0, 0, fmt.Errorf("payload length exceeds frame capacity")
 	}
+	return length, n, nil
 }
 
 func (t FrameType) String() string {
@@ -233,6 +222,8 @@ func (t FrameType) String() string {
 		return "VirtualSnakeRouted"
 	case TypeKeepalive:
 		return "Keepalive"
+	case TypePeerExchange:
+		return "PeerExchange"
 	default:
 		return "Unknown"
 	}
@@ -242,6 +233,8 @@ func (v FrameVersion) String() string {
 	switch v {
 	case Version0:
 		return "Version0"
+	case Version1:
+		return "Version1"
 	default:
 		return "VersionUnknown"
 	}
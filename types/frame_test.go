@@ -216,3 +216,114 @@ func TestMarshalUnmarshalSNEKFrame(t *testing.T) {
 		t.Fatal("wrong payload")
 	}
 }
+
+func TestMarshalUnmarshalSNEKFrameCoords(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(nil)
+	tests := []struct {
+		name  string
+		input Frame
+	}{
+		{
+			name: "bootstrap with source coords",
+			input: Frame{
+				Type:    TypeVirtualSnakeBootstrap,
+				Source:  Coordinates{1, 2, 3},
+				Payload: []byte{9, 9, 9, 9, 9},
+			},
+		},
+		{
+			name: "snek routed with destination coords",
+			input: Frame{
+				Type:        TypeVirtualSnakeRouted,
+				Destination: Coordinates{4, 5, 6, 7},
+				Payload:     []byte("HELLO!"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			copy(tc.input.DestinationKey[:], pk)
+			buf := make([]byte, 65535)
+			n, err := tc.input.MarshalBinary(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output := Frame{
+				Payload: make([]byte, 0, MaxPayloadSize),
+			}
+			if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+				t.Fatal(err)
+			}
+			if !output.Source.EqualTo(tc.input.Source) {
+				t.Fatalf("wrong source coords, got %v, expected %v", output.Source, tc.input.Source)
+			}
+			if !output.Destination.EqualTo(tc.input.Destination) {
+				t.Fatalf("wrong destination coords, got %v, expected %v", output.Destination, tc.input.Destination)
+			}
+			if !bytes.Equal(tc.input.Payload, output.Payload) {
+				t.Fatal("wrong payload")
+			}
+		})
+	}
+}
+
+func TestMarshalUnmarshalFrameVersion1(t *testing.T) {
+	input := Frame{
+		Version:     Version1,
+		Type:        TypeTreeRouted,
+		Destination: Coordinates{1, 2, 3, 4, 5000},
+		Source:      Coordinates{4, 3, 2, 1},
+		Payload:     []byte("ABCDEFG"),
+	}
+	expected := []byte{
+		0x70, 0x69, 0x6e, 0x65, // magic bytes
+		1,                    // version 1
+		byte(TypeTreeRouted), // type greedy
+		0, 0,                 // extra
+		0, 32, // frame length
+		7,                        // payload len (varu64)
+		0, 6, 1, 2, 3, 4, 167, 8, // destination (2+6 bytes but 5 ports!)
+		0, 4, 4, 3, 2, 1, // source (2+4 bytes)
+		65, 66, 67, 68, 69, 70, 71, // payload (7 bytes)
+	}
+	buf := make([]byte, 65535)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("wrong marshalled output, got %v, expected %v", buf[:n], expected)
+	}
+
+	// Translating the frame to Version0 should produce the same frame
+	// as it would have been if it had been sent as Version0 to begin with.
+	output := Frame{
+		Payload: make([]byte, 0, MaxPayloadSize),
+	}
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output.Version != Version1 {
+		t.Fatalf("wrong version, got %s", output.Version)
+	}
+	output.Version = Version0
+	n, err = output.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.Version = Version0
+	buf0 := make([]byte, 65535)
+	n0, err := input.MarshalBinary(buf0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], buf0[:n0]) {
+		t.Fatalf("translated frame differs, got %v, expected %v", buf[:n], buf0[:n0])
+	}
+
+	// Frames from versions that we don't know about should be rejected.
+	buf[4] = byte(LatestFrameVersion + 1)
+	if _, err := output.UnmarshalBinary(buf[:n]); err == nil {
+		t.Fatal("expected unknown frame version to be rejected")
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// frameField is a single field in the body of a frame, which follows the
+// frame header and the extension area, if there is one.
+type frameField uint8
+
+const (
+	fieldPayloadLength       frameField = iota // 2 bytes in Version0, a Varu64 from Version1
+	fieldDestinationKey                        // public key
+	fieldSourceKey                             // public key
+	fieldWatermark                             // public key followed by a Varu64 sequence number
+	fieldDestination                           // coordinates
+	fieldSource                                // coordinates
+	fieldPayload                               // as many bytes as fieldPayloadLength gives
+	fieldTrailingDestination                   // coordinates, only present if there are bytes left
+	fieldTrailingSource                        // coordinates, only present if there are bytes left
+)
+
+// frameLayout describes the fields in the body of a frame type, in the order
+// that they appear on the wire. Marshalling, unmarshalling and working out
+// the size of a frame are all driven from the layout, so adding a field to a
+// frame type only means changing its layout here.
+type frameLayout struct {
+	fields []frameField
+	// exact is set if the frame must end after the last field. Otherwise
+	// anything left over is ignored, so that new trailing fields can be
+	// added without older nodes rejecting the frame.
+	exact bool
+}
+
+// treeLayout is used by tree-routed frames and by any frame types that
+// don't have a layout of their own.
+var treeLayout = frameLayout{
+	fields: []frameField{fieldPayloadLength, fieldDestination, fieldSource, fieldPayload},
+	exact:  true,
+}
+
+// frameLayouts holds the layout of every frame type, indexed by type.
+var frameLayouts = [...]frameLayout{
+	TypeKeepalive:        {},
+	TypeTreeAnnouncement: treeLayout,
+	TypeTreeRouted:       treeLayout,
+	TypeVirtualSnakeBootstrap: {
+		fields: []frameField{
+			fieldPayloadLength, fieldDestinationKey, fieldWatermark,
+			fieldPayload, fieldTrailingSource,
+		},
+	},
+	TypeVirtualSnakeRouted: {
+		fields: []frameField{
+			fieldPayloadLength, fieldDestinationKey, fieldSourceKey, fieldWatermark,
+			fieldPayload, fieldTrailingDestination,
+		},
+	},
+	TypePeerExchange: treeLayout,
+}
+
+func layoutFor(t FrameType) *frameLayout {
+	if int(t) < len(frameLayouts) {
+		return &frameLayouts[t]
+	}
+	return &treeLayout
+}
+
+// MaxFrameLength returns the most bytes that a frame of the given type can
+// take up, including the header, going by the protocol alone. Frame types
+// with no body can only be as long as the header and the extension area,
+// and anything else can be as long as the 2 byte frame length allows.
+func MaxFrameLength(t FrameType) int {
+	if len(layoutFor(t).fields) == 0 {
+		return FrameHeaderLength + 2 + MaxExtensionsSize
+	}
+	return math.MaxUint16
+}
+
+// PeekFrameHeader checks the magic bytes at the start of the data and returns
+// the type of the frame and its total length, including the header, without
+// unmarshalling the rest of it. Only the first FrameHeaderLength bytes are
+// needed.
+func PeekFrameHeader(data []byte) (FrameType, int, error) {
+	if len(data) < FrameHeaderLength {
+		return 0, 0, fmt.Errorf("frame is not long enough to include metadata")
+	}
+	if !bytes.Equal(data[:4], FrameMagicBytes) {
+		return 0, 0, fmt.Errorf("frame doesn't contain magic bytes")
+	}
+	length := int(binary.BigEndian.Uint16(data[FrameHeaderLength-2 : FrameHeaderLength]))
+	if length < FrameHeaderLength {
+		return 0, 0, fmt.Errorf("frame length %d is shorter than the header", length)
+	}
+	return FrameType(data[5]), length, nil
+}
+
+// Size returns the number of bytes that the frame will take up once it has
+// been marshalled, including the header.
+func (f *Frame) Size() int {
+	size := FrameHeaderLength
+	if len(f.Extensions) > 0 {
+		size += 2 + len(f.Extensions)
+	}
+	for _, field := range layoutFor(f.Type).fields {
+		switch field {
+		case fieldPayloadLength:
+			if f.Version == Version0 {
+				size += 2
+			} else {
+				size += Varu64(len(f.Payload)).Length()
+			}
+		case fieldDestinationKey, fieldSourceKey:
+			size += ed25519.PublicKeySize
+		case fieldWatermark:
+			size += ed25519.PublicKeySize + f.Watermark.Sequence.Length()
+		case fieldDestination:
+			size += coordinatesLength(f.Destination)
+		case fieldSource:
+			size += coordinatesLength(f.Source)
+		case fieldPayload:
+			size += len(f.Payload)
+		case fieldTrailingDestination:
+			if len(f.Destination) > 0 {
+				size += coordinatesLength(f.Destination)
+			}
+		case fieldTrailingSource:
+			if len(f.Source) > 0 {
+				size += coordinatesLength(f.Source)
+			}
+		}
+	}
+	return size
+}
+
+// marshalFields writes the body of the frame into the buffer, following the
+// layout for the frame type, and returns the number of bytes written.
+func (f *Frame) marshalFields(buffer []byte) (int, error) {
+	offset := 0
+	for _, field := range layoutFor(f.Type).fields {
+		switch field {
+		case fieldPayloadLength:
+			n, err := f.marshalPayloadLength(buffer[offset:], len(f.Payload))
+			if err != nil {
+				return 0, err
+			}
+			offset += n
+		case fieldDestinationKey:
+			offset += copy(buffer[offset:], f.DestinationKey[:])
+		case fieldSourceKey:
+			offset += copy(buffer[offset:], f.SourceKey[:])
+		case fieldWatermark:
+			offset += copy(buffer[offset:], f.Watermark.PublicKey[:])
+			n, err := f.Watermark.Sequence.MarshalBinary(buffer[offset:])
+			if err != nil {
+				return 0, fmt.Errorf("f.WatermarkSeq.MarshalBinary: %w", err)
+			}
+			offset += n
+		case fieldDestination, fieldTrailingDestination:
+			if field == fieldTrailingDestination && len(f.Destination) == 0 {
+				continue
+			}
+			n, err := marshalCoordinates(buffer[offset:], f.Destination)
+			if err != nil {
+				return 0, fmt.Errorf("f.Destination.MarshalBinary: %w", err)
+			}
+			offset += n
+		case fieldSource, fieldTrailingSource:
+			if field == fieldTrailingSource && len(f.Source) == 0 {
+				continue
+			}
+			n, err := marshalCoordinates(buffer[offset:], f.Source)
+			if err != nil {
+				return 0, fmt.Errorf("f.Source.MarshalBinary: %w", err)
+			}
+			offset += n
+		case fieldPayload:
+			offset += copy(buffer[offset:], f.Payload)
+		}
+	}
+	return offset, nil
+}
+
+// unmarshalFields reads the body of the frame from the data, following the
+// layout for the frame type, and returns the number of bytes read.
+func (f *Frame) unmarshalFields(data []byte) (int, error) {
+	layout := layoutFor(f.Type)
+	offset, payloadLen := 0, 0
+	for _, field := range layout.fields {
+		switch field {
+		case fieldPayloadLength:
+			l, n, err := f.unmarshalPayloadLength(data[offset:])
+			if err != nil {
+				return 0, err
+			}
+			payloadLen = l
+			offset += n
+		case fieldDestinationKey, fieldSourceKey:
+			if len(data) < offset+ed25519.PublicKeySize {
+				return 0, fmt.Errorf("frame is not long enough to include public key")
+			}
+			if field == fieldDestinationKey {
+				offset += copy(f.DestinationKey[:], data[offset:])
+			} else {
+				offset += copy(f.SourceKey[:], data[offset:])
+			}
+		case fieldWatermark:
+			if len(data) < offset+ed25519.PublicKeySize+1 {
+				return 0, fmt.Errorf("frame is not long enough to include watermark")
+			}
+			offset += copy(f.Watermark.PublicKey[:], data[offset:])
+			n, err := f.Watermark.Sequence.UnmarshalBinary(data[offset:])
+			if err != nil {
+				return 0, fmt.Errorf("f.WatermarkSeq.UnmarshalBinary: %w", err)
+			}
+			offset += n
+		case fieldDestination, fieldTrailingDestination:
+			if len(data) < offset+2 {
+				if field == fieldTrailingDestination {
+					continue
+				}
+				return 0, fmt.Errorf("frame is not long enough to include destination")
+			}
+			n, err := f.Destination.UnmarshalBinary(data[offset:])
+			if err != nil {
+				return 0, fmt.Errorf("f.Destination.UnmarshalBinary: %w", err)
+			}
+			offset += n
+		case fieldSource, fieldTrailingSource:
+			if len(data) < offset+2 {
+				if field == fieldTrailingSource {
+					continue
+				}
+				return 0, fmt.Errorf("frame is not long enough to include source")
+			}
+			n, err := f.Source.UnmarshalBinary(data[offset:])
+			if err != nil {
+				return 0, fmt.Errorf("f.Source.UnmarshalBinary: %w", err)
+			}
+			offset += n
+		case fieldPayload:
+			if size := offset + payloadLen; len(data) < size {
+				return 0, fmt.Errorf("frame expecting %d body bytes, got %d bytes", size, len(data))
+			}
+			f.Payload = f.Payload[:payloadLen]
+			offset += copy(f.Payload, data[offset:])
+		}
+	}
+	if layout.exact && offset != len(data) {
+		return 0, fmt.Errorf("frame expecting %d body bytes, got %d bytes", offset, len(data))
+	}
+	return offset, nil
+}
+
+// coordinatesLength returns the marshalled length of the coordinates.
+func coordinatesLength(c Coordinates) int {
+	l := 2
+	for _, p := range c {
+		l += Varu64(p).Length()
+	}
+	return l
+}
+
+// marshalCoordinates writes the coordinates into the buffer, checking that
+// they fit in the 2 byte length first.
+func marshalCoordinates(buffer []byte, c Coordinates) (int, error) {
+	if l := coordinatesLength(c); l-2 > math.MaxUint16 {
+		return 0, fmt.Errorf("coordinates too long")
+	} else if len(buffer) < l {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	return c.MarshalBinary(buffer)
+}
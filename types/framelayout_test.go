@@ -0,0 +1,116 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"testing"
+)
+
+func layoutTestFrames() []Frame {
+	var key PublicKey
+	_, sk, _ := ed25519.GenerateKey(nil)
+	copy(key[:], sk.Public().(ed25519.PublicKey))
+	frames := []Frame{
+		{Type: TypeKeepalive},
+		{Type: TypeTreeAnnouncement, Payload: []byte("announcement")},
+		{Type: TypeTreeRouted, Destination: Coordinates{1, 2, 300}, Source: Coordinates{4}, Payload: []byte("tree")},
+		{Type: TypeVirtualSnakeBootstrap, DestinationKey: key, Watermark: VirtualSnakeWatermark{PublicKey: key, Sequence: 1000}, Payload: []byte("bootstrap")},
+		{Type: TypeVirtualSnakeBootstrap, DestinationKey: key, Source: Coordinates{1, 2}, Payload: []byte("bootstrap")},
+		{Type: TypeVirtualSnakeRouted, DestinationKey: key, SourceKey: key, Payload: []byte("snake")},
+		{Type: TypeVirtualSnakeRouted, DestinationKey: key, SourceKey: key, Destination: Coordinates{7, 8}, Payload: []byte("snake")},
+		{Type: TypePeerExchange, Payload: make([]byte, 200)},
+		{Type: FrameType(200), Destination: Coordinates{1}, Payload: []byte("unknown")},
+	}
+	withExtensions := Frame{Type: TypeTreeRouted, Payload: []byte("extensions")}
+	_ = withExtensions.SetExtension(ExtensionTypeQoS, []byte{byte(QoSBulk)})
+	return append(frames, withExtensions)
+}
+
+func TestFrameSize(t *testing.T) {
+	buf := make([]byte, MaxFrameSize)
+	for _, version := range []FrameVersion{Version0, Version1} {
+		for _, frame := range layoutTestFrames() {
+			frame.Version = version
+			n, err := frame.MarshalBinary(buf)
+			if err != nil {
+				t.Fatalf("%s %s: %s", version, frame.Type, err)
+			}
+			if size := frame.Size(); size != n {
+				t.Fatalf("%s %s: size is %d but marshalled %d bytes", version, frame.Type, size, n)
+			}
+			if _, err := frame.MarshalBinary(buf[:n-1]); err == nil {
+				t.Fatalf("%s %s: expected a buffer that is too small to be refused", version, frame.Type)
+			}
+			output := Frame{Payload: make([]byte, 0, MaxPayloadSize)}
+			read, err := output.UnmarshalBinary(buf[:n])
+			if err != nil {
+				t.Fatalf("%s %s: %s", version, frame.Type, err)
+			}
+			if read != n {
+				t.Fatalf("%s %s: read %d bytes of %d", version, frame.Type, read, n)
+			}
+		}
+	}
+}
+
+func TestPeekFrameHeader(t *testing.T) {
+	frame := Frame{Version: Version1, Type: TypeTreeRouted, Payload: []byte("ABCDEFG")}
+	buf := make([]byte, MaxFrameSize)
+	n, err := frame.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, length, err := PeekFrameHeader(buf[:FrameHeaderLength])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != TypeTreeRouted || length != n {
+		t.Fatalf("expected %s of %d bytes, got %s of %d bytes", TypeTreeRouted, n, typ, length)
+	}
+	if _, _, err := PeekFrameHeader(buf[:FrameHeaderLength-1]); err == nil {
+		t.Fatal("expected a short header to be refused")
+	}
+	binary.BigEndian.PutUint16(buf[FrameHeaderLength-2:], FrameHeaderLength-1)
+	if _, _, err := PeekFrameHeader(buf[:FrameHeaderLength]); err == nil {
+		t.Fatal("expected a length shorter than the header to be refused")
+	}
+	buf[0] = 0
+	if _, _, err := PeekFrameHeader(buf[:FrameHeaderLength]); err == nil {
+		t.Fatal("expected missing magic bytes to be refused")
+	}
+}
+
+func TestUnmarshalTruncatedFrame(t *testing.T) {
+	buf := make([]byte, MaxFrameSize)
+	for _, frame := range layoutTestFrames() {
+		frame.Version = Version1
+		n, err := frame.MarshalBinary(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Cutting the body short, but fixing up the frame length so that it
+		// still matches, must be caught instead of reading past the end.
+		for l := FrameHeaderLength; l < n; l++ {
+			truncated := append([]byte{}, buf[:l]...)
+			binary.BigEndian.PutUint16(truncated[FrameHeaderLength-2:], uint16(l))
+			output := Frame{Payload: make([]byte, 0, MaxPayloadSize)}
+			if _, err := output.UnmarshalBinary(truncated); err == nil && layoutFor(frame.Type).exact {
+				t.Fatalf("%s: expected frame truncated to %d of %d bytes to be refused", frame.Type, l, n)
+			}
+		}
+	}
+}
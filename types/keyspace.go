@@ -0,0 +1,94 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+// KeyspaceQuery asks the receiving node for the keys that it knows about
+// which are closest to the target key. It is carried as the payload of a
+// SNEK-routed frame with FrameFlagKeyspaceQuery set.
+type KeyspaceQuery struct {
+	Nonce  uint64
+	Target PublicKey
+	Count  uint8
+}
+
+func (q *KeyspaceQuery) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 8+ed25519.PublicKeySize+1 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	binary.BigEndian.PutUint64(buf[:8], q.Nonce)
+	offset := 8
+	offset += copy(buf[offset:], q.Target[:])
+	buf[offset] = q.Count
+	return offset + 1, nil
+}
+
+func (q *KeyspaceQuery) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 8+ed25519.PublicKeySize+1 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	q.Nonce = binary.BigEndian.Uint64(buf[:8])
+	offset := 8
+	offset += copy(q.Target[:], buf[offset:])
+	q.Count = buf[offset]
+	return offset + 1, nil
+}
+
+// KeyspaceResponse is sent in reply to a KeyspaceQuery and contains the keys
+// that the responding node knows about, closest to the target first. It is
+// carried as the payload of a SNEK-routed frame with FrameFlagKeyspaceResponse
+// set.
+type KeyspaceResponse struct {
+	Nonce uint64
+	Keys  []PublicKey
+}
+
+func (r *KeyspaceResponse) MarshalBinary(buf []byte) (int, error) {
+	if len(r.Keys) > 255 {
+		return 0, fmt.Errorf("too many keys")
+	}
+	if len(buf) < 8+1+len(r.Keys)*ed25519.PublicKeySize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	binary.BigEndian.PutUint64(buf[:8], r.Nonce)
+	buf[8] = uint8(len(r.Keys))
+	offset := 9
+	for _, k := range r.Keys {
+		offset += copy(buf[offset:], k[:])
+	}
+	return offset, nil
+}
+
+func (r *KeyspaceResponse) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 9 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	r.Nonce = binary.BigEndian.Uint64(buf[:8])
+	count := int(buf[8])
+	if len(buf) < 9+count*ed25519.PublicKeySize {
+		return 0, fmt.Errorf("buffer too small for %d keys", count)
+	}
+	offset := 9
+	r.Keys = make([]PublicKey, count)
+	for i := range r.Keys {
+		offset += copy(r.Keys[i][:], buf[offset:])
+	}
+	return offset, nil
+}
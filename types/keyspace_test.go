@@ -0,0 +1,52 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestMarshalUnmarshalKeyspaceQuery(t *testing.T) {
+	input := KeyspaceQuery{
+		Nonce:  1234567890,
+		Target: PublicKey{1, 2, 3},
+		Count:  8,
+	}
+	buf := make([]byte, 128)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output KeyspaceQuery
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != input {
+		t.Fatalf("got %+v, expected %+v", output, input)
+	}
+}
+
+func TestMarshalUnmarshalKeyspaceResponse(t *testing.T) {
+	input := KeyspaceResponse{
+		Nonce: 1234567890,
+		Keys:  []PublicKey{{1}, {2}, {3}},
+	}
+	buf := make([]byte, 128)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output KeyspaceResponse
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output.Nonce != input.Nonce || len(output.Keys) != len(input.Keys) {
+		t.Fatalf("got %+v, expected %+v", output, input)
+	}
+	for i := range input.Keys {
+		if output.Keys[i] != input.Keys[i] {
+			t.Fatalf("key %d: got %s, expected %s", i, output.Keys[i], input.Keys[i])
+		}
+	}
+	if _, err := output.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatal("expected truncated response to fail")
+	}
+}
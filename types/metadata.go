@@ -0,0 +1,197 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+// MaxNodeMetadataSize is the most space that the fields of NodeMetadata can
+// take up once encoded, including a length byte for each field. Metadata is
+// sent in the handshake and in reply to queries, so it is kept small.
+const MaxNodeMetadataSize = 256
+
+// nodeMetadataFields is how many length-prefixed fields NodeMetadata has.
+const nodeMetadataFields = 3
+
+// NodeMetadata describes a node for community network directories and
+// diagnostics. It is signed by the node that it describes, so it can be
+// passed on by other nodes without being tampered with. None of the fields
+// are checked for accuracy, so they shouldn't be trusted for anything more
+// than display.
+type NodeMetadata struct {
+	PublicKey PublicKey `json:"public_key"`
+	Name      string    `json:"name,omitempty"`
+	Version   string    `json:"version,omitempty"` // software and version
+	Contact   string    `json:"contact,omitempty"` // i.e. an email address
+	Signature Signature `json:"signature"`
+}
+
+// NewNodeMetadata creates metadata for the node with the given private key
+// and signs it.
+func NewNodeMetadata(private PrivateKey, name, version, contact string) (*NodeMetadata, error) {
+	m := &NodeMetadata{
+		PublicKey: private.Public(),
+		Name:      name,
+		Version:   version,
+		Contact:   contact,
+	}
+	protected, err := m.ProtectedPayload()
+	if err != nil {
+		return nil, err
+	}
+	copy(m.Signature[:], ed25519.Sign(private[:], protected))
+	return m, nil
+}
+
+// Verify checks that the metadata was signed by the node that it describes.
+func (m *NodeMetadata) Verify() error {
+	protected, err := m.ProtectedPayload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(m.PublicKey[:], protected, m.Signature[:]) {
+		return fmt.Errorf("node metadata has an invalid signature")
+	}
+	return nil
+}
+
+func (m *NodeMetadata) fieldsLength() int {
+	return nodeMetadataFields + len(m.Name) + len(m.Version) + len(m.Contact)
+}
+
+func (m *NodeMetadata) ProtectedPayload() ([]byte, error) {
+	if m.fieldsLength() > MaxNodeMetadataSize {
+		return nil, fmt.Errorf("node metadata is larger than %d bytes", MaxNodeMetadataSize)
+	}
+	buffer := make([]byte, ed25519.PublicKeySize+m.fieldsLength())
+	offset := copy(buffer, m.PublicKey[:])
+	for _, field := range []string{m.Name, m.Version, m.Contact} {
+		buffer[offset] = uint8(len(field))
+		offset++
+		offset += copy(buffer[offset:], field)
+	}
+	return buffer[:offset], nil
+}
+
+func (m *NodeMetadata) Length() int {
+	return ed25519.PublicKeySize + m.fieldsLength() + ed25519.SignatureSize
+}
+
+func (m *NodeMetadata) MarshalBinary(buf []byte) (int, error) {
+	protected, err := m.ProtectedPayload()
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) < len(protected)+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buf, protected)
+	offset += copy(buf[offset:], m.Signature[:])
+	return offset, nil
+}
+
+func (m *NodeMetadata) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize+nodeMetadataFields+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(m.PublicKey[:], buf)
+	var fields [nodeMetadataFields]string
+	for i := range fields {
+		if len(buf) < offset+1 {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		l := int(buf[offset])
+		offset++
+		if len(buf) < offset+l {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		fields[i] = string(buf[offset : offset+l])
+		offset += l
+	}
+	m.Name, m.Version, m.Contact = fields[0], fields[1], fields[2]
+	if m.fieldsLength() > MaxNodeMetadataSize {
+		return 0, fmt.Errorf("node metadata is larger than %d bytes", MaxNodeMetadataSize)
+	}
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(m.Signature[:], buf[offset:])
+	return offset, nil
+}
+
+// MetadataQuery asks the receiving node for its NodeMetadata. It is carried
+// as the payload of a SNEK-routed frame with FrameFlagMetadataQuery set.
+type MetadataQuery struct {
+	Nonce uint64
+}
+
+func (q *MetadataQuery) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 8 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	binary.BigEndian.PutUint64(buf[:8], q.Nonce)
+	return 8, nil
+}
+
+func (q *MetadataQuery) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 8 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	q.Nonce = binary.BigEndian.Uint64(buf[:8])
+	return 8, nil
+}
+
+// MetadataResponse is sent in reply to a MetadataQuery. The metadata is nil
+// if the node doesn't share any. It is carried as the payload of a SNEK-routed
+// frame with FrameFlagMetadataResponse set.
+type MetadataResponse struct {
+	Nonce    uint64
+	Metadata *NodeMetadata
+}
+
+func (r *MetadataResponse) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 8 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	binary.BigEndian.PutUint64(buf[:8], r.Nonce)
+	if r.Metadata == nil {
+		return 8, nil
+	}
+	n, err := r.Metadata.MarshalBinary(buf[8:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Metadata.MarshalBinary: %w", err)
+	}
+	return 8 + n, nil
+}
+
+func (r *MetadataResponse) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 8 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	r.Nonce = binary.BigEndian.Uint64(buf[:8])
+	r.Metadata = nil
+	if len(buf) == 8 {
+		return 8, nil
+	}
+	r.Metadata = &NodeMetadata{}
+	n, err := r.Metadata.UnmarshalBinary(buf[8:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Metadata.UnmarshalBinary: %w", err)
+	}
+	return 8 + n, nil
+}
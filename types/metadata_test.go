@@ -0,0 +1,79 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+func TestNodeMetadata(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	var private PrivateKey
+	copy(private[:], sk)
+
+	input, err := NewNodeMetadata(private, "alice", "pinecone/1.0", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, input.Length())
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output NodeMetadata
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != *input {
+		t.Fatalf("got %+v, expected %+v", output, *input)
+	}
+	if err := output.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := output.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatal("expected truncated metadata to fail")
+	}
+
+	output.Name = "mallory"
+	if err := output.Verify(); err == nil {
+		t.Fatal("expected modified metadata to fail verification")
+	}
+
+	if _, err := NewNodeMetadata(private, strings.Repeat("a", MaxNodeMetadataSize), "", ""); err == nil {
+		t.Fatal("expected oversized metadata to be refused")
+	}
+}
+
+func TestMarshalUnmarshalMetadataResponse(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	var private PrivateKey
+	copy(private[:], sk)
+	metadata, err := NewNodeMetadata(private, "bob", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, input := range []MetadataResponse{
+		{Nonce: 1234567890, Metadata: metadata},
+		{Nonce: 1234567890},
+	} {
+		buf := make([]byte, 512)
+		n, err := input.MarshalBinary(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output MetadataResponse
+		if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if output.Nonce != input.Nonce || (output.Metadata == nil) != (input.Metadata == nil) {
+			t.Fatalf("got %+v, expected %+v", output, input)
+		}
+		if input.Metadata != nil && *output.Metadata != *input.Metadata {
+			t.Fatalf("got %+v, expected %+v", *output.Metadata, *input.Metadata)
+		}
+	}
+}
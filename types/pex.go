@@ -0,0 +1,214 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PEXRecordPrefix is prepended to the text form of a PEXRecord, so that it
+// can be recognised when it is pasted, scanned from a QR code or stored in a
+// DNS TXT record.
+const PEXRecordPrefix = "pex:"
+
+// Limits on the size of a PEXRecord, which keep a full exchange of records
+// well within a single frame.
+const (
+	MaxPEXURIs      = 8
+	MaxPEXURILength = 255
+)
+
+// pexSignaturePrefix separates signatures on PEX records from any other
+// signatures that are made using the node key.
+var pexSignaturePrefix = []byte("pinecone pex")
+
+// PEXRecord advertises the URIs that a node can be peered with. It is signed
+// by the Origin key, so it can be passed around by other nodes, or out-of-band,
+// without being tampered with, and it expires at Expires, so stale addresses
+// eventually stop being handed out.
+type PEXRecord struct {
+	Origin    PublicKey `json:"origin"`
+	URIs      []string  `json:"uris"`
+	Expires   Varu64    `json:"expires"` // Unix time in milliseconds
+	Signature Signature `json:"signature"`
+}
+
+// NewPEXRecord creates a record for the given private key advertising the
+// given URIs, which stays valid until the given time.
+func NewPEXRecord(private PrivateKey, uris []string, expires time.Time) (*PEXRecord, error) {
+	r := &PEXRecord{
+		Origin:  private.Public(),
+		URIs:    append([]string{}, uris...),
+		Expires: Varu64(expires.UnixMilli()),
+	}
+	protected, err := r.ProtectedPayload()
+	if err != nil {
+		return nil, err
+	}
+	copy(r.Signature[:], ed25519.Sign(private[:], protected))
+	return r, nil
+}
+
+// ParsePEXRecord decodes a record from the text form returned by String. It
+// doesn't verify the record.
+func ParsePEXRecord(s string) (*PEXRecord, error) {
+	if !strings.HasPrefix(s, PEXRecordPrefix) {
+		return nil, fmt.Errorf("PEX record must start with %q", PEXRecordPrefix)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, PEXRecordPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("base64.DecodeString: %w", err)
+	}
+	r := &PEXRecord{}
+	n, err := r.UnmarshalBinary(b)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(b) {
+		return nil, fmt.Errorf("PEX record has %d trailing bytes", len(b)-n)
+	}
+	return r, nil
+}
+
+// String returns the record in a text form that is safe to use in URLs, QR
+// codes and DNS TXT records. It can be decoded again with ParsePEXRecord.
+func (r *PEXRecord) String() string {
+	b := make([]byte, r.Length())
+	n, err := r.MarshalBinary(b)
+	if err != nil {
+		return ""
+	}
+	return PEXRecordPrefix + base64.RawURLEncoding.EncodeToString(b[:n])
+}
+
+// ExpiresAt returns the time at which the record stops being valid.
+func (r *PEXRecord) ExpiresAt() time.Time {
+	return time.UnixMilli(int64(r.Expires))
+}
+
+// Verify checks that the record was signed by the origin key and that it
+// hasn't expired at the given time.
+func (r *PEXRecord) Verify(now time.Time) error {
+	if !now.Before(r.ExpiresAt()) {
+		return fmt.Errorf("PEX record expired at %s", r.ExpiresAt())
+	}
+	protected, err := r.ProtectedPayload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(r.Origin[:], protected, r.Signature[:]) {
+		return fmt.Errorf("PEX record has an invalid signature")
+	}
+	return nil
+}
+
+func (r *PEXRecord) ProtectedPayload() ([]byte, error) {
+	buffer := make([]byte, len(pexSignaturePrefix)+r.Length()-ed25519.SignatureSize)
+	offset := copy(buffer, pexSignaturePrefix)
+	n, err := r.marshalContents(buffer[offset:])
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:offset+n], nil
+}
+
+func (r *PEXRecord) Length() int {
+	l := ed25519.PublicKeySize + r.Expires.Length() + 1 + ed25519.SignatureSize
+	for _, uri := range r.URIs {
+		l += 1 + len(uri)
+	}
+	return l
+}
+
+// marshalContents writes everything but the signature into the buffer.
+func (r *PEXRecord) marshalContents(buf []byte) (int, error) {
+	if len(r.URIs) > MaxPEXURIs {
+		return 0, fmt.Errorf("too many URIs")
+	}
+	if len(buf) < r.Length()-ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buf, r.Origin[:])
+	n, err := r.Expires.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Expires.MarshalBinary: %w", err)
+	}
+	offset += n
+	buf[offset] = byte(len(r.URIs))
+	offset++
+	for _, uri := range r.URIs {
+		if len(uri) > MaxPEXURILength {
+			return 0, fmt.Errorf("URI too long")
+		}
+		buf[offset] = byte(len(uri))
+		offset++
+		offset += copy(buf[offset:], uri)
+	}
+	return offset, nil
+}
+
+func (r *PEXRecord) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < r.Length() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset, err := r.marshalContents(buf)
+	if err != nil {
+		return 0, err
+	}
+	offset += copy(buf[offset:], r.Signature[:])
+	return offset, nil
+}
+
+func (r *PEXRecord) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize+r.Expires.MinLength()+1+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(r.Origin[:], buf)
+	n, err := r.Expires.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Expires.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+1 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	count := int(buf[offset])
+	offset++
+	if count > MaxPEXURIs {
+		return 0, fmt.Errorf("too many URIs")
+	}
+	r.URIs = make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if len(buf) < offset+1 {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		l := int(buf[offset])
+		offset++
+		if len(buf) < offset+l {
+			return 0, fmt.Errorf("buffer too small")
+		}
+		r.URIs = append(r.URIs, string(buf[offset:offset+l]))
+		offset += l
+	}
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(r.Signature[:], buf[offset:])
+	return offset, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMarshalUnmarshalPEXRecord(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	var private PrivateKey
+	copy(private[:], sk)
+	uris := []string{"tcp://192.0.2.1:65432", "wss://example.com/pinecone"}
+	record, err := NewPEXRecord(private, uris, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, record.Length())
+	n, err := record.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != record.Length() {
+		t.Fatalf("expected %d bytes but got %d", record.Length(), n)
+	}
+	var decoded PEXRecord
+	if _, err := decoded.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&decoded, record) {
+		t.Fatalf("decoded record %+v doesn't match %+v", decoded, record)
+	}
+	if err := decoded.Verify(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParsePEXRecord(record.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, record) {
+		t.Fatalf("parsed record %+v doesn't match %+v", parsed, record)
+	}
+	if _, err := ParsePEXRecord(record.String()[len(PEXRecordPrefix):]); err == nil {
+		t.Fatalf("record without prefix should not have parsed")
+	}
+	if _, err := decoded.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatalf("truncated record should not have decoded")
+	}
+}
+
+func TestVerifyPEXRecord(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	var private PrivateKey
+	copy(private[:], sk)
+	record, err := NewPEXRecord(private, []string{"tcp://192.0.2.1:65432"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := record.Verify(time.Now().Add(time.Hour * 2)); err == nil {
+		t.Fatalf("expired record should not have verified")
+	}
+	record.URIs[0] = "tcp://198.51.100.1:65432"
+	if err := record.Verify(time.Now()); err == nil {
+		t.Fatalf("altered record should not have verified")
+	}
+
+	uris := make([]string, MaxPEXURIs+1)
+	if _, err := NewPEXRecord(private, uris, time.Now().Add(time.Hour)); err == nil {
+		t.Fatalf("record with too many URIs should not have been created")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+)
+
+// ReceiptRequestSize is the size of the value of an ExtensionTypeReceipt
+// extension, which is the sequence number that the receipt should carry.
+const ReceiptRequestSize = 8
+
+// ReceiptSize is the size of an encoded Receipt.
+const ReceiptSize = ed25519.PublicKeySize*2 + 8 + ed25519.SignatureSize
+
+// Receipt acknowledges a SNEK-routed frame whose sender asked for one with an
+// ExtensionTypeReceipt extension. It is signed by the Receiver, which is the
+// node that the frame was delivered to, so the Sender knows that the frame
+// really arrived there. It is carried as the payload of a SNEK-routed frame
+// with FrameFlagReceipt set.
+type Receipt struct {
+	Sender    PublicKey `json:"sender"`
+	Receiver  PublicKey `json:"receiver"`
+	Sequence  uint64    `json:"sequence"`
+	Signature Signature `json:"signature"`
+}
+
+// NewReceipt creates a receipt from the node with the given private key for
+// the frame with the given sequence number from the sender, and signs it.
+func NewReceipt(receiver PrivateKey, sender PublicKey, sequence uint64) *Receipt {
+	r := &Receipt{
+		Sender:   sender,
+		Receiver: receiver.Public(),
+		Sequence: sequence,
+	}
+	copy(r.Signature[:], ed25519.Sign(receiver[:], r.ProtectedPayload()))
+	return r
+}
+
+// Verify checks that the receipt was signed by the Receiver.
+func (r *Receipt) Verify() error {
+	if !ed25519.Verify(r.Receiver[:], r.ProtectedPayload(), r.Signature[:]) {
+		return fmt.Errorf("receipt has an invalid signature")
+	}
+	return nil
+}
+
+func (r *Receipt) ProtectedPayload() []byte {
+	buffer := make([]byte, ed25519.PublicKeySize*2+8)
+	offset := copy(buffer, r.Sender[:])
+	offset += copy(buffer[offset:], r.Receiver[:])
+	binary.BigEndian.PutUint64(buffer[offset:], r.Sequence)
+	return buffer
+}
+
+func (r *Receipt) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ReceiptSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buf, r.ProtectedPayload())
+	offset += copy(buf[offset:], r.Signature[:])
+	return offset, nil
+}
+
+func (r *Receipt) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ReceiptSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(r.Sender[:], buf)
+	offset += copy(r.Receiver[:], buf[offset:])
+	r.Sequence = binary.BigEndian.Uint64(buf[offset:])
+	offset += 8
+	offset += copy(r.Signature[:], buf[offset:])
+	return offset, nil
+}
@@ -0,0 +1,46 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"testing"
+)
+
+func TestReceipt(t *testing.T) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	var private PrivateKey
+	copy(private[:], sk)
+	pk, _, _ := ed25519.GenerateKey(nil)
+	var sender PublicKey
+	copy(sender[:], pk)
+
+	input := NewReceipt(private, sender, 1234567890)
+	if input.Receiver != private.Public() {
+		t.Fatal("expected the receipt to be from the signing key")
+	}
+	if err := input.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	var buf [ReceiptSize]byte
+	n, err := input.MarshalBinary(buf[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != ReceiptSize {
+		t.Fatalf("expected %d bytes, got %d", ReceiptSize, n)
+	}
+	var output Receipt
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != *input {
+		t.Fatalf("got %+v, expected %+v", output, *input)
+	}
+	if _, err := output.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatal("expected truncated receipt to fail")
+	}
+
+	output.Sequence++
+	if err := output.Verify(); err == nil {
+		t.Fatal("expected modified receipt to fail verification")
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+)
+
+// KeyRotation announces that a node is moving from the Previous key to the
+// Successor key. It is signed by the Previous key, so anyone who trusted the
+// Previous key can trust the Successor too, but only until Expires, after
+// which the node will no longer answer to the Previous key.
+type KeyRotation struct {
+	Previous  PublicKey `json:"previous"`
+	Successor PublicKey `json:"successor"`
+	Expires   Varu64    `json:"expires"` // Unix time in milliseconds
+	Signature Signature `json:"signature"`
+}
+
+// NewKeyRotation creates a rotation from the given previous private key to
+// the successor public key, which stays valid until the given time.
+func NewKeyRotation(previous PrivateKey, successor PublicKey, expires time.Time) (*KeyRotation, error) {
+	r := &KeyRotation{
+		Previous:  previous.Public(),
+		Successor: successor,
+		Expires:   Varu64(expires.UnixMilli()),
+	}
+	if r.Previous == r.Successor {
+		return nil, fmt.Errorf("successor key must be different to the previous key")
+	}
+	protected, err := r.ProtectedPayload()
+	if err != nil {
+		return nil, err
+	}
+	copy(r.Signature[:], ed25519.Sign(previous[:], protected))
+	return r, nil
+}
+
+// ExpiresAt returns the time at which the rotation stops being valid.
+func (r *KeyRotation) ExpiresAt() time.Time {
+	return time.UnixMilli(int64(r.Expires))
+}
+
+// Other returns the other key in the rotation, given either the previous or
+// the successor key. It returns false if the key isn't part of the rotation.
+func (r *KeyRotation) Other(key PublicKey) (PublicKey, bool) {
+	switch key {
+	case r.Previous:
+		return r.Successor, true
+	case r.Successor:
+		return r.Previous, true
+	default:
+		return PublicKey{}, false
+	}
+}
+
+// Verify checks that the rotation was signed by the previous key and that it
+// hasn't expired at the given time.
+func (r *KeyRotation) Verify(now time.Time) error {
+	if !now.Before(r.ExpiresAt()) {
+		return fmt.Errorf("key rotation expired at %s", r.ExpiresAt())
+	}
+	protected, err := r.ProtectedPayload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(r.Previous[:], protected, r.Signature[:]) {
+		return fmt.Errorf("key rotation has an invalid signature")
+	}
+	return nil
+}
+
+func (r *KeyRotation) ProtectedPayload() ([]byte, error) {
+	buffer := make([]byte, ed25519.PublicKeySize*2+r.Expires.Length())
+	offset := copy(buffer, r.Previous[:])
+	offset += copy(buffer[offset:], r.Successor[:])
+	n, err := r.Expires.MarshalBinary(buffer[offset:])
+	if err != nil {
+		return nil, fmt.Errorf("r.Expires.MarshalBinary: %w", err)
+	}
+	return buffer[:offset+n], nil
+}
+
+func (r *KeyRotation) Length() int {
+	return ed25519.PublicKeySize*2 + r.Expires.Length() + ed25519.SignatureSize
+}
+
+func (r *KeyRotation) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < r.Length() {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(buf, r.Previous[:])
+	offset += copy(buf[offset:], r.Successor[:])
+	n, err := r.Expires.MarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Expires.MarshalBinary: %w", err)
+	}
+	offset += n
+	offset += copy(buf[offset:], r.Signature[:])
+	return offset, nil
+}
+
+func (r *KeyRotation) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < ed25519.PublicKeySize*2+r.Expires.MinLength()+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := copy(r.Previous[:], buf)
+	offset += copy(r.Successor[:], buf[offset:])
+	n, err := r.Expires.UnmarshalBinary(buf[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("r.Expires.UnmarshalBinary: %w", err)
+	}
+	offset += n
+	if len(buf) < offset+ed25519.SignatureSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset += copy(r.Signature[:], buf[offset:])
+	return offset, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestMarshalUnmarshalKeyRotation(t *testing.T) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	pk2, _, _ := ed25519.GenerateKey(nil)
+	var previous PrivateKey
+	var successor PublicKey
+	copy(previous[:], sk1)
+	copy(successor[:], pk2)
+
+	input, err := NewKeyRotation(previous, successor, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := input.Verify(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, input.Length())
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output KeyRotation
+	if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if output != *input {
+		t.Fatalf("expected %+v, got %+v", *input, output)
+	}
+	if other, ok := output.Other(previous.Public()); !ok || other != successor {
+		t.Fatalf("expected the previous key to resolve to the successor")
+	}
+	if other, ok := output.Other(successor); !ok || other != previous.Public() {
+		t.Fatalf("expected the successor key to resolve to the previous key")
+	}
+	if _, err := output.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatalf("expected a truncated rotation to fail to unmarshal")
+	}
+}
+
+func TestKeyRotationVerify(t *testing.T) {
+	_, sk1, _ := ed25519.GenerateKey(nil)
+	pk2, _, _ := ed25519.GenerateKey(nil)
+	var previous PrivateKey
+	var successor PublicKey
+	copy(previous[:], sk1)
+	copy(successor[:], pk2)
+
+	rotation, err := NewKeyRotation(previous, successor, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rotation.Verify(time.Now().Add(time.Hour * 2)); err == nil {
+		t.Fatalf("expected an expired rotation to fail verification")
+	}
+	forged := *rotation
+	forged.Successor[0] ^= 0xff
+	if err := forged.Verify(time.Now()); err == nil {
+		t.Fatalf("expected a modified rotation to fail verification")
+	}
+	if _, err := NewKeyRotation(previous, previous.Public(), time.Now().Add(time.Hour)); err == nil {
+		t.Fatalf("expected rotating to the same key to fail")
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testvectors
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// keySeeds are the seeds for the keys that sign the vectors. Each seed is
+// the given byte repeated.
+var keySeeds = []struct {
+	name string
+	seed byte
+}{
+	{"alice", 0x01},
+	{"bob", 0x02},
+	{"carol", 0x03},
+}
+
+// pexExpiry is the expiry time on peer exchange records in the vectors, far
+// enough in the future that they remain valid.
+var pexExpiry = time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Generate builds the set of vectors from scratch, encoding each frame using
+// this implementation. The result is what is checked in as vectors.json.
+func Generate() (*Set, error) {
+	set := &Set{}
+	keys := map[string]ed25519.PrivateKey{}
+	public := map[string]types.PublicKey{}
+	for _, k := range keySeeds {
+		seed := make([]byte, ed25519.SeedSize)
+		for i := range seed {
+			seed[i] = k.seed
+		}
+		sk := ed25519.NewKeyFromSeed(seed)
+		keys[k.name] = sk
+		var pk types.PublicKey
+		copy(pk[:], sk.Public().(ed25519.PublicKey))
+		public[k.name] = pk
+		set.Keys = append(set.Keys, Key{
+			Name:      k.name,
+			Seed:      seed,
+			PublicKey: HexBytes(pk[:]),
+		})
+	}
+
+	announcement, err := treeAnnouncement(keys["alice"], keys["bob"])
+	if err != nil {
+		return nil, fmt.Errorf("treeAnnouncement: %w", err)
+	}
+	bootstrap, err := virtualSnakeBootstrap(keys["carol"], public["alice"])
+	if err != nil {
+		return nil, fmt.Errorf("virtualSnakeBootstrap: %w", err)
+	}
+	query, err := keyspaceQuery(public["carol"])
+	if err != nil {
+		return nil, fmt.Errorf("keyspaceQuery: %w", err)
+	}
+	exchange, err := peerExchange(keys["alice"], keys["bob"])
+	if err != nil {
+		return nil, fmt.Errorf("peerExchange: %w", err)
+	}
+	var extensions types.Frame
+	if err := extensions.SetExtension(types.ExtensionTypeQoS, []byte{byte(types.QoSInteractive)}); err != nil {
+		return nil, fmt.Errorf("extensions.SetExtension: %w", err)
+	}
+	trace := types.TraceContext{Flags: 1}
+	for i := range trace.TraceID {
+		trace.TraceID[i] = byte(i)
+	}
+	for i := range trace.SpanID {
+		trace.SpanID[i] = byte(0xf0 + i)
+	}
+	var traceBuf [types.TraceContextSize]byte
+	if _, err := trace.MarshalBinary(traceBuf[:]); err != nil {
+		return nil, fmt.Errorf("trace.MarshalBinary: %w", err)
+	}
+	if err := extensions.SetExtension(types.ExtensionTypeTraceContext, traceBuf[:]); err != nil {
+		return nil, fmt.Errorf("extensions.SetExtension: %w", err)
+	}
+
+	vectors := []struct {
+		name        string
+		description string
+		frame       types.Frame
+	}{
+		{
+			name:        "keepalive",
+			description: "A keepalive, which is only the header.",
+			frame: types.Frame{
+				Type: types.TypeKeepalive,
+			},
+		},
+		{
+			name:        "tree_announcement",
+			description: "A tree announcement with alice as the root at sequence 7, signed by alice for port 1 and then by bob for port 3.",
+			frame: types.Frame{
+				Type:    types.TypeTreeAnnouncement,
+				Payload: announcement,
+			},
+		},
+		{
+			name:        "tree_routed",
+			description: "A tree-routed traffic frame from [4 3 2 1] to [1 2 3 4 5000].",
+			frame: types.Frame{
+				Type:        types.TypeTreeRouted,
+				Destination: types.Coordinates{1, 2, 3, 4, 5000},
+				Source:      types.Coordinates{4, 3, 2, 1},
+				Payload:     []byte("ABCDEFG"),
+			},
+		},
+		{
+			name:        "tree_routed_root",
+			description: "A tree-routed traffic frame from the root to a direct child on port 1, where the source coordinates are empty.",
+			frame: types.Frame{
+				Type:        types.TypeTreeRouted,
+				Destination: types.Coordinates{1},
+				Payload:     []byte("ABCDEFG"),
+			},
+		},
+		{
+			name:        "tree_routed_extensions",
+			description: "A tree-routed traffic frame carrying a QoS extension for interactive traffic and a trace context extension.",
+			frame: types.Frame{
+				Type:        types.TypeTreeRouted,
+				Destination: types.Coordinates{1, 2},
+				Source:      types.Coordinates{3},
+				Extensions:  extensions.Extensions,
+				Payload:     []byte("ABCDEFG"),
+			},
+		},
+		{
+			name:        "virtual_snake_bootstrap",
+			description: "A bootstrap from carol at [1 2], signed by carol at sequence 1 with alice as the root at sequence 7, with the watermark that the sender starts with.",
+			frame: types.Frame{
+				Type:           types.TypeVirtualSnakeBootstrap,
+				DestinationKey: public["carol"],
+				Source:         types.Coordinates{1, 2},
+				Watermark: types.VirtualSnakeWatermark{
+					PublicKey: types.FullMask,
+				},
+				Payload: bootstrap,
+			},
+		},
+		{
+			name:        "virtual_snake_routed",
+			description: "A SNEK-routed traffic frame from alice to bob, with a watermark from carol's path at sequence 42.",
+			frame: types.Frame{
+				Type:           types.TypeVirtualSnakeRouted,
+				DestinationKey: public["bob"],
+				SourceKey:      public["alice"],
+				Watermark: types.VirtualSnakeWatermark{
+					PublicKey: public["carol"],
+					Sequence:  42,
+				},
+				Payload: []byte("hello"),
+			},
+		},
+		{
+			name:        "virtual_snake_routed_fallback",
+			description: "A SNEK-routed traffic frame from alice to bob that is being tree-routed to [1 2 3] as a fallback.",
+			frame: types.Frame{
+				Type:           types.TypeVirtualSnakeRouted,
+				Destination:    types.Coordinates{1, 2, 3},
+				DestinationKey: public["bob"],
+				SourceKey:      public["alice"],
+				Watermark: types.VirtualSnakeWatermark{
+					PublicKey: public["carol"],
+					Sequence:  42,
+				},
+				Payload: []byte("hello"),
+			},
+		},
+		{
+			name:        "keyspace_query",
+			description: "A SNEK-routed keyspace query from alice to bob, asking for the 4 keys closest to carol's.",
+			frame: types.Frame{
+				Type:           types.TypeVirtualSnakeRouted,
+				Extra:          [2]byte{types.FrameFlagKeyspaceQuery, 0},
+				DestinationKey: public["bob"],
+				SourceKey:      public["alice"],
+				Watermark: types.VirtualSnakeWatermark{
+					PublicKey: types.FullMask,
+				},
+				Payload: query,
+			},
+		},
+		{
+			name:        "peer_exchange",
+			description: "A peer exchange frame carrying records from alice and bob, each signed by their origin and expiring at the start of 2100.",
+			frame: types.Frame{
+				Type:    types.TypePeerExchange,
+				Payload: exchange,
+			},
+		},
+	}
+
+	var buf [types.MaxFrameSize]byte
+	for _, version := range []types.FrameVersion{types.Version0, types.Version1} {
+		for _, v := range vectors {
+			frame := v.frame
+			frame.Version = version
+			n, err := frame.MarshalBinary(buf[:])
+			if err != nil {
+				return nil, fmt.Errorf("%s: frame.MarshalBinary: %w", v.name, err)
+			}
+			set.Vectors = append(set.Vectors, Vector{
+				Name:        fmt.Sprintf("%s_v%d", v.name, version),
+				Description: v.description,
+				Frame:       fromFrame(&frame),
+				Encoded:     append(HexBytes{}, buf[:n]...),
+			})
+		}
+	}
+	return set, nil
+}
+
+// treeAnnouncement returns the payload of a tree announcement signed by the
+// root and then a child. The signatures are made directly rather than using
+// SwitchAnnouncement.Sign, which skips them if PINECONE_DISABLE_SIGNATURES
+// is set.
+func treeAnnouncement(root, child ed25519.PrivateKey) ([]byte, error) {
+	var announcement types.SwitchAnnouncement
+	copy(announcement.RootPublicKey[:], root.Public().(ed25519.PublicKey))
+	announcement.RootSequence = 7
+	var buf [types.MaxPayloadSize]byte
+	for _, hop := range []struct {
+		key  ed25519.PrivateKey
+		port types.SwitchPortID
+	}{
+		{root, 1},
+		{child, 3},
+	} {
+		n, err := announcement.MarshalBinary(buf[:])
+		if err != nil {
+			return nil, fmt.Errorf("announcement.MarshalBinary: %w", err)
+		}
+		sig := types.SignatureWithHop{
+			Hop: types.Varu64(hop.port),
+		}
+		copy(sig.PublicKey[:], hop.key.Public().(ed25519.PublicKey))
+		copy(sig.Signature[:], ed25519.Sign(hop.key, buf[:n]))
+		announcement.Signatures = append(announcement.Signatures, sig)
+	}
+	return announcement.Encode()
+}
+
+// virtualSnakeBootstrap returns the payload of a bootstrap that is signed by
+// the bootstrapping node.
+func virtualSnakeBootstrap(from ed25519.PrivateKey, root types.PublicKey) ([]byte, error) {
+	bootstrap := types.VirtualSnakeBootstrap{
+		Sequence: 1,
+		Root: types.Root{
+			RootPublicKey: root,
+			RootSequence:  7,
+		},
+	}
+	protected, err := bootstrap.ProtectedPayload()
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap.ProtectedPayload: %w", err)
+	}
+	copy(bootstrap.Signature[:], ed25519.Sign(from, protected))
+	var buf [types.MaxPayloadSize]byte
+	n, err := bootstrap.MarshalBinary(buf[:])
+	if err != nil {
+		return nil, fmt.Errorf("bootstrap.MarshalBinary: %w", err)
+	}
+	return buf[:n], nil
+}
+
+// keyspaceQuery returns the payload of a keyspace query for the given key.
+func keyspaceQuery(target types.PublicKey) ([]byte, error) {
+	query := types.KeyspaceQuery{
+		Nonce:  0x0102030405060708,
+		Target: target,
+		Count:  4,
+	}
+	var buf [types.MaxPayloadSize]byte
+	n, err := query.MarshalBinary(buf[:])
+	if err != nil {
+		return nil, fmt.Errorf("query.MarshalBinary: %w", err)
+	}
+	return buf[:n], nil
+}
+
+// peerExchange returns the payload of a peer exchange frame, which is a
+// count of records followed by the records themselves.
+func peerExchange(origins ...ed25519.PrivateKey) ([]byte, error) {
+	buf := make([]byte, types.MaxPayloadSize)
+	buf[0] = byte(len(origins))
+	offset := 1
+	for i, origin := range origins {
+		var private types.PrivateKey
+		copy(private[:], origin)
+		record, err := types.NewPEXRecord(private, []string{
+			fmt.Sprintf("tcp://192.0.2.%d:65432", i+1),
+			fmt.Sprintf("ws://[2001:db8::%d]:65433", i+1),
+		}, pexExpiry)
+		if err != nil {
+			return nil, fmt.Errorf("types.NewPEXRecord: %w", err)
+		}
+		n, err := record.MarshalBinary(buf[offset:])
+		if err != nil {
+			return nil, fmt.Errorf("record.MarshalBinary: %w", err)
+		}
+		offset += n
+	}
+	return buf[:offset], nil
+}
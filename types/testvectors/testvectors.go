@@ -0,0 +1,306 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testvectors contains canonical encodings of every Pinecone frame
+// type, so that other implementations of the wire format, i.e. a port to
+// another language, can check that they agree with this one byte for byte.
+//
+// The vectors are checked in as vectors.json, which can be read from any
+// language. Each vector describes the fields of a frame along with the exact
+// bytes that it encodes to. Frames that carry signed payloads are signed
+// using the keys listed at the top of the file, which are derived from fixed
+// seeds, and since ed25519 signatures are deterministic the vectors never
+// change unless the wire format does.
+package testvectors
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// HexBytes is a byte slice that is encoded as a hex string in JSON.
+type HexBytes []byte
+
+func (b HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *HexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("hex.DecodeString: %w", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// Key is one of the keys used to sign the vectors. The private key is the
+// ed25519 key derived from the seed.
+type Key struct {
+	Name      string   `json:"name"`
+	Seed      HexBytes `json:"seed"`
+	PublicKey HexBytes `json:"public_key"`
+}
+
+// Watermark is the JSON form of a types.VirtualSnakeWatermark.
+type Watermark struct {
+	PublicKey HexBytes     `json:"public_key"`
+	Sequence  types.Varu64 `json:"sequence"`
+}
+
+// Frame is the JSON form of the fields of a types.Frame. Fields that aren't
+// encoded for the frame type are left out, and coordinates are given as
+// arrays of port numbers.
+type Frame struct {
+	Version        types.FrameVersion `json:"version"`
+	Type           types.FrameType    `json:"type"`
+	Extra          HexBytes           `json:"extra"`
+	Destination    []uint64           `json:"destination,omitempty"`
+	DestinationKey HexBytes           `json:"destination_key,omitempty"`
+	Source         []uint64           `json:"source,omitempty"`
+	SourceKey      HexBytes           `json:"source_key,omitempty"`
+	Watermark      *Watermark         `json:"watermark,omitempty"`
+	Extensions     HexBytes           `json:"extensions,omitempty"`
+	Payload        HexBytes           `json:"payload,omitempty"`
+}
+
+// Vector is a single frame along with its canonical encoding.
+type Vector struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Frame       Frame    `json:"frame"`
+	Encoded     HexBytes `json:"encoded"`
+}
+
+// Set is the full set of vectors, as found in vectors.json.
+type Set struct {
+	Keys    []Key    `json:"keys"`
+	Vectors []Vector `json:"vectors"`
+}
+
+// Parse reads a set of vectors from JSON, i.e. the contents of vectors.json.
+func Parse(data []byte) (*Set, error) {
+	var set Set
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return &set, nil
+}
+
+// Encode returns the set as JSON in the same form as vectors.json.
+func (s *Set) Encode() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		return nil, fmt.Errorf("enc.Encode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Vector returns the vector with the given name.
+func (s *Set) Vector(name string) (*Vector, bool) {
+	for i := range s.Vectors {
+		if s.Vectors[i].Name == name {
+			return &s.Vectors[i], true
+		}
+	}
+	return nil, false
+}
+
+// Validate checks the encodings produced by another implementation, keyed by
+// vector name, against every vector in the set. It returns an error listing
+// each vector that is missing or doesn't match.
+func (s *Set) Validate(encodings map[string][]byte) error {
+	var failures []string
+	for i := range s.Vectors {
+		v := &s.Vectors[i]
+		encoded, ok := encodings[v.Name]
+		if !ok {
+			failures = append(failures, fmt.Sprintf("%s: no encoding given", v.Name))
+			continue
+		}
+		if err := v.Validate(encoded); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d vectors failed:\n%s", len(failures), len(s.Vectors), strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// Validate checks an encoding of the vector produced by another
+// implementation. If it doesn't match the canonical encoding, the error says
+// where the first difference is and which field of the frame it falls in,
+// if the encoding can still be decoded.
+func (v *Vector) Validate(encoded []byte) error {
+	if bytes.Equal(encoded, v.Encoded) {
+		return nil
+	}
+	offset := 0
+	for offset < len(encoded) && offset < len(v.Encoded) && encoded[offset] == v.Encoded[offset] {
+		offset++
+	}
+	err := fmt.Errorf("%s: differs at byte %d (got %d bytes, expected %d bytes)", v.Name, offset, len(encoded), len(v.Encoded))
+	var got types.Frame
+	got.Payload = make([]byte, 0, types.MaxPayloadSize)
+	if _, derr := got.UnmarshalBinary(encoded); derr != nil {
+		return fmt.Errorf("%w, and doesn't decode: %s", err, derr)
+	}
+	if field := diffFrames(fromFrame(&got), v.Frame); field != "" {
+		return fmt.Errorf("%w, %s field differs", err, field)
+	}
+	return err
+}
+
+// ToFrame returns the frame that the vector describes, ready to be encoded
+// with MarshalBinary.
+func (f *Frame) ToFrame() (*types.Frame, error) {
+	frame := &types.Frame{
+		Version:     f.Version,
+		Type:        f.Type,
+		Destination: toCoords(f.Destination),
+		Source:      toCoords(f.Source),
+		Extensions:  f.Extensions,
+		Payload:     f.Payload,
+	}
+	if len(f.Extra) != len(frame.Extra) {
+		return nil, fmt.Errorf("extra must be %d bytes", len(frame.Extra))
+	}
+	copy(frame.Extra[:], f.Extra)
+	for _, key := range []struct {
+		from HexBytes
+		to   *types.PublicKey
+	}{
+		{f.DestinationKey, &frame.DestinationKey},
+		{f.SourceKey, &frame.SourceKey},
+	} {
+		if key.from != nil && len(key.from) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("keys must be %d bytes", ed25519.PublicKeySize)
+		}
+		copy(key.to[:], key.from)
+	}
+	if f.Watermark != nil {
+		if len(f.Watermark.PublicKey) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("keys must be %d bytes", ed25519.PublicKeySize)
+		}
+		copy(frame.Watermark.PublicKey[:], f.Watermark.PublicKey)
+		frame.Watermark.Sequence = f.Watermark.Sequence
+	}
+	return frame, nil
+}
+
+// fromFrame returns the JSON form of the frame, leaving out the fields that
+// aren't encoded for the frame type.
+func fromFrame(frame *types.Frame) Frame {
+	f := Frame{
+		Version: frame.Version,
+		Type:    frame.Type,
+		Extra:   HexBytes(frame.Extra[:]),
+	}
+	if len(frame.Extensions) > 0 {
+		f.Extensions = append(HexBytes{}, frame.Extensions...)
+	}
+	if frame.Type == types.TypeKeepalive {
+		return f
+	}
+	if len(frame.Payload) > 0 {
+		f.Payload = append(HexBytes{}, frame.Payload...)
+	}
+	watermark := func() *Watermark {
+		return &Watermark{
+			PublicKey: append(HexBytes{}, frame.Watermark.PublicKey[:]...),
+			Sequence:  frame.Watermark.Sequence,
+		}
+	}
+	switch frame.Type {
+	case types.TypeVirtualSnakeBootstrap:
+		f.DestinationKey = append(HexBytes{}, frame.DestinationKey[:]...)
+		f.Source = fromCoords(frame.Source)
+		f.Watermark = watermark()
+	case types.TypeVirtualSnakeRouted:
+		f.DestinationKey = append(HexBytes{}, frame.DestinationKey[:]...)
+		f.SourceKey = append(HexBytes{}, frame.SourceKey[:]...)
+		f.Destination = fromCoords(frame.Destination)
+		f.Watermark = watermark()
+	default:
+		f.Destination = fromCoords(frame.Destination)
+		f.Source = fromCoords(frame.Source)
+	}
+	return f
+}
+
+func toCoords(ports []uint64) types.Coordinates {
+	if len(ports) == 0 {
+		return nil
+	}
+	coords := make(types.Coordinates, len(ports))
+	for i, port := range ports {
+		coords[i] = types.SwitchPortID(port)
+	}
+	return coords
+}
+
+func fromCoords(coords types.Coordinates) []uint64 {
+	if len(coords) == 0 {
+		return nil
+	}
+	ports := make([]uint64, len(coords))
+	for i, port := range coords {
+		ports[i] = uint64(port)
+	}
+	return ports
+}
+
+// diffFrames returns the name of the first field that differs between the
+// two frames, or an empty string if they are the same.
+func diffFrames(a, b Frame) string {
+	switch {
+	case a.Version != b.Version:
+		return "version"
+	case a.Type != b.Type:
+		return "type"
+	case !bytes.Equal(a.Extra, b.Extra):
+		return "extra"
+	case !toCoords(a.Destination).EqualTo(toCoords(b.Destination)):
+		return "destination"
+	case !bytes.Equal(a.DestinationKey, b.DestinationKey):
+		return "destination_key"
+	case !toCoords(a.Source).EqualTo(toCoords(b.Source)):
+		return "source"
+	case !bytes.Equal(a.SourceKey, b.SourceKey):
+		return "source_key"
+	case (a.Watermark == nil) != (b.Watermark == nil):
+		return "watermark"
+	case a.Watermark != nil && (!bytes.Equal(a.Watermark.PublicKey, b.Watermark.PublicKey) || a.Watermark.Sequence != b.Watermark.Sequence):
+		return "watermark"
+	case !bytes.Equal(a.Extensions, b.Extensions):
+		return "extensions"
+	case !bytes.Equal(a.Payload, b.Payload):
+		return "payload"
+	default:
+		return ""
+	}
+}
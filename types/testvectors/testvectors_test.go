@@ -0,0 +1,163 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testvectors
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+var update = flag.Bool("update", false, "rewrite vectors.json from Generate")
+
+func loadVectors(t *testing.T) *Set {
+	data, err := ioutil.ReadFile("vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestVectorsMatchGenerate(t *testing.T) {
+	set, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := set.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := ioutil.WriteFile("vectors.json", generated, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := ioutil.ReadFile("vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated, golden) {
+		t.Fatal("vectors.json is out of date, either the wire format has changed or it needs to be regenerated with -update")
+	}
+}
+
+func TestVectorsRoundTrip(t *testing.T) {
+	set := loadVectors(t)
+	seen := map[types.FrameType]bool{}
+	for _, v := range set.Vectors {
+		v := v
+		seen[v.Frame.Type] = true
+		t.Run(v.Name, func(t *testing.T) {
+			frame, err := v.Frame.ToFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf [types.MaxFrameSize]byte
+			n, err := frame.MarshalBinary(buf[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := v.Validate(buf[:n]); err != nil {
+				t.Fatal(err)
+			}
+			decoded := types.Frame{
+				Payload: make([]byte, 0, types.MaxPayloadSize),
+			}
+			if _, err := decoded.UnmarshalBinary(v.Encoded); err != nil {
+				t.Fatal(err)
+			}
+			if field := diffFrames(fromFrame(&decoded), v.Frame); field != "" {
+				t.Fatalf("decoded %s field doesn't match", field)
+			}
+		})
+	}
+	for _, ft := range []types.FrameType{
+		types.TypeKeepalive, types.TypeTreeAnnouncement, types.TypeTreeRouted,
+		types.TypeVirtualSnakeBootstrap, types.TypeVirtualSnakeRouted, types.TypePeerExchange,
+	} {
+		if !seen[ft] {
+			t.Errorf("no vector for %s frames", ft)
+		}
+	}
+}
+
+func TestVectorsSignatures(t *testing.T) {
+	set := loadVectors(t)
+	if v, ok := set.Vector("tree_announcement_v1"); !ok {
+		t.Fatal("missing tree announcement vector")
+	} else if _, err := types.DecodeSwitchAnnouncement(v.Frame.Payload); err != nil {
+		t.Fatalf("tree announcement doesn't verify: %s", err)
+	}
+	if v, ok := set.Vector("peer_exchange_v1"); !ok {
+		t.Fatal("missing peer exchange vector")
+	} else {
+		payload := v.Frame.Payload[1:]
+		for i := 0; i < int(v.Frame.Payload[0]); i++ {
+			var record types.PEXRecord
+			n, err := record.UnmarshalBinary(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := record.Verify(time.Date(2050, time.January, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+				t.Fatalf("peer exchange record %d doesn't verify: %s", i, err)
+			}
+			payload = payload[n:]
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	set := loadVectors(t)
+	v, ok := set.Vector("virtual_snake_routed_v1")
+	if !ok {
+		t.Fatal("missing SNEK-routed vector")
+	}
+
+	// A wrong byte in the payload should be pinned down to the payload.
+	wrong := append([]byte{}, v.Encoded...)
+	wrong[len(wrong)-1] ^= 0xff
+	if err := v.Validate(wrong); err == nil || !strings.Contains(err.Error(), "payload field differs") {
+		t.Fatalf("expected payload to differ, got %v", err)
+	}
+
+	// A truncated frame won't decode at all.
+	if err := v.Validate(v.Encoded[:len(v.Encoded)-1]); err == nil || !strings.Contains(err.Error(), "doesn't decode") {
+		t.Fatalf("expected truncated frame not to decode, got %v", err)
+	}
+
+	// Every vector has to be given when validating the whole set.
+	encodings := map[string][]byte{}
+	for _, v := range set.Vectors {
+		encodings[v.Name] = v.Encoded
+	}
+	if err := set.Validate(encodings); err != nil {
+		t.Fatal(err)
+	}
+	delete(encodings, v.Name)
+	encodings["keepalive_v0"] = wrong
+	err := set.Validate(encodings)
+	if err == nil || !strings.Contains(err.Error(), "2 of") || !strings.Contains(err.Error(), v.Name+": no encoding given") {
+		t.Fatalf("expected 2 vectors to fail, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+)
+
+// TopicMessageType says what a TopicMessage is for.
+type TopicMessageType uint8
+
+const (
+	TopicSubscribe   TopicMessageType = iota + 1 // a node wants to receive messages on the topic
+	TopicUnsubscribe                             // a node no longer wants to receive messages on the topic
+	TopicPublish                                 // a node is sending a message to everyone on the topic
+	TopicDeliver                                 // a published message is being passed on to a subscriber
+)
+
+func (t TopicMessageType) String() string {
+	switch t {
+	case TopicSubscribe:
+		return "Subscribe"
+	case TopicUnsubscribe:
+		return "Unsubscribe"
+	case TopicPublish:
+		return "Publish"
+	case TopicDeliver:
+		return "Deliver"
+	default:
+		return fmt.Sprintf("Unknown (%d)", t)
+	}
+}
+
+// TopicKey returns the key for the named topic. Everything to do with the
+// topic is SNEK-routed towards the key, which means that it all meets at the
+// node with the closest key.
+func TopicKey(name string) PublicKey {
+	return PublicKey(sha256.Sum256([]byte(name)))
+}
+
+// TopicMessage is carried as the payload of a SNEK-routed frame with
+// FrameFlagTopic set. Subscriptions and publications are sent towards the
+// topic key, and deliveries are sent from the node that the topic key led to
+// on to each subscriber. The publisher is only included in deliveries, since
+// it is the source of the frame otherwise, and only publications and
+// deliveries carry a payload.
+type TopicMessage struct {
+	Type      TopicMessageType
+	Topic     PublicKey
+	Publisher PublicKey
+	Payload   []byte
+}
+
+func (m *TopicMessage) length() int {
+	n := 1 + ed25519.PublicKeySize
+	if m.Type == TopicDeliver {
+		n += ed25519.PublicKeySize
+	}
+	return n
+}
+
+func (m *TopicMessage) MarshalBinary(buf []byte) (int, error) {
+	n := m.length()
+	if len(buf) < n+len(m.Payload) {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	buf[0] = byte(m.Type)
+	offset := 1
+	offset += copy(buf[offset:], m.Topic[:])
+	if m.Type == TopicDeliver {
+		offset += copy(buf[offset:], m.Publisher[:])
+	}
+	offset += copy(buf[offset:], m.Payload)
+	return offset, nil
+}
+
+func (m *TopicMessage) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < 1 {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	m.Type = TopicMessageType(buf[0])
+	n := m.length()
+	if len(buf) < n {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	offset := 1
+	offset += copy(m.Topic[:], buf[offset:])
+	m.Publisher = PublicKey{}
+	if m.Type == TopicDeliver {
+		offset += copy(m.Publisher[:], buf[offset:])
+	}
+	m.Payload = append(m.Payload[:0], buf[offset:]...)
+	return len(buf), nil
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarshalUnmarshalTopicMessage(t *testing.T) {
+	for _, input := range []TopicMessage{
+		{Type: TopicSubscribe, Topic: TopicKey("news")},
+		{Type: TopicPublish, Topic: TopicKey("news"), Payload: []byte("hello")},
+		{Type: TopicDeliver, Topic: TopicKey("news"), Publisher: PublicKey{1, 2, 3}, Payload: []byte("hello")},
+	} {
+		buf := make([]byte, 128)
+		n, err := input.MarshalBinary(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output TopicMessage
+		if _, err := output.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if output.Type != input.Type || output.Topic != input.Topic || output.Publisher != input.Publisher || !bytes.Equal(output.Payload, input.Payload) {
+			t.Fatalf("got %+v, expected %+v", output, input)
+		}
+	}
+	deliver := TopicMessage{Type: TopicDeliver}
+	buf := make([]byte, 128)
+	n, _ := deliver.MarshalBinary(buf)
+	var output TopicMessage
+	if _, err := output.UnmarshalBinary(buf[:n-1]); err == nil {
+		t.Fatal("expected truncated delivery to fail")
+	}
+}
+
+func TestTopicKey(t *testing.T) {
+	if TopicKey("news") != TopicKey("news") || TopicKey("news") == TopicKey("weather") {
+		t.Fatal("expected topic keys to depend only on the name")
+	}
+}
@@ -15,21 +15,11 @@
 package util
 
 import (
-	"crypto/ed25519"
-
 	"github.com/matrix-org/pinecone/types"
 )
 
 func LessThan(first, second types.PublicKey) bool {
-	for i := 0; i < ed25519.PublicKeySize; i++ {
-		if first[i] < second[i] {
-			return true
-		}
-		if first[i] > second[i] {
-			return false
-		}
-	}
-	return false
+	return first.CompareTo(second) < 0
 }
 
 // DHTOrdered returns true if the order of A, B and C is